@@ -0,0 +1,32 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+func blobPath(name string, table string, column string, rowid int64) string {
+	values := url.Values{}
+	values.Set("table", table)
+	values.Set("column", column)
+	values.Set("rowid", strconv.FormatInt(rowid, 10))
+	return databasePath(name, "blob") + "?" + values.Encode()
+}
+
+// ReadBlob streams the blob or text stored in the column of the row with the given rowid, the caller closes it.
+func (c *Client) ReadBlob(ctx context.Context, name string, table string, column string, rowid int64) (io.ReadCloser, error) {
+	response, err := c.do(ctx, request{method: http.MethodGet, path: blobPath(name, table, column, rowid)})
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// WriteBlob replaces the value stored in the column of the row with the given rowid by the size bytes read from
+// content. The request isn't retried, content can't be replayed.
+func (c *Client) WriteBlob(ctx context.Context, name string, table string, column string, rowid int64, content io.Reader, size int64) error {
+	return c.doJSON(ctx, request{method: http.MethodPut, path: blobPath(name, table, column, rowid), stream: io.LimitReader(content, size), size: size}, nil)
+}
@@ -0,0 +1,236 @@
+// Package client is the Go client of the persisto HTTP API.
+//
+//	c := client.New("http://localhost:8080", client.Options{})
+//	results, err := c.Query(ctx, "production-db", "SELECT id, name FROM users;")
+//	users, err := client.ScanRows[User](results[0])
+package client
+
+import (
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	AdminTokenHeader     = "X-Persisto-Admin-Token"
+	IdempotencyKeyHeader = "Idempotency-Key"
+)
+
+// RetryPolicy controls how failed requests are retried. Only requests that are safe to repeat are retried: reads and
+// writes carrying an idempotency key.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one, 1 disables retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, it doubles after every attempt.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between two attempts.
+	MaxBackoff time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+}
+
+type Options struct {
+	// AdminToken is sent with every request, it is required by the admin routes only.
+	AdminToken string
+	// HTTPClient defaults to a client with a 5 minutes timeout.
+	HTTPClient *http.Client
+	// Retry defaults to DefaultRetryPolicy.
+	Retry *RetryPolicy
+}
+
+// Client is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	adminToken string
+	http       *http.Client
+	retry      RetryPolicy
+}
+
+func New(baseURL string, options Options) *Client {
+	client := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		adminToken: options.AdminToken,
+		http:       options.HTTPClient,
+		retry:      DefaultRetryPolicy,
+	}
+	if client.http == nil {
+		client.http = &http.Client{Timeout: 5 * time.Minute}
+	}
+	if options.Retry != nil {
+		client.retry = *options.Retry
+	}
+	if client.retry.MaxAttempts < 1 {
+		client.retry.MaxAttempts = 1
+	}
+	return client
+}
+
+type idempotencyKeyContextKey struct{}
+
+// WithIdempotencyKey makes the write issued with the returned context use the given idempotency key instead of a
+// generated one, e.g. to keep the same key across restarts of the caller.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+func idempotencyKey(ctx context.Context) string {
+	if key, ok := ctx.Value(idempotencyKeyContextKey{}).(string); ok && key != "" {
+		return key
+	}
+	buffer := make([]byte, 16)
+	cryptorand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
+
+type request struct {
+	method string
+	path   string
+	body   any
+	// NOTE: raw bodies are sent once as they can't be replayed, size is their Content-Length
+	stream io.Reader
+	size   int64
+	accept string
+	// NOTE: versions the resource must still have for the request to apply, sent as If-Match
+	ifMatch string
+	// NOTE: safe requests don't change anything and are retried as is
+	safe bool
+	// NOTE: idempotent requests carry an idempotency key, the server applies them once however many times they're retried
+	idempotent bool
+}
+
+// do sends the request, retrying it when allowed, and returns the response for the caller to close.
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	var content []byte
+	if req.body != nil {
+		var err error
+		if content, err = json.Marshal(req.body); err != nil {
+			return nil, err
+		}
+	}
+
+	retryable := (req.method == http.MethodGet || req.safe || req.idempotent) && req.stream == nil
+	key := ""
+	if req.idempotent {
+		key = idempotencyKey(ctx)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < c.retry.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			if err := c.wait(ctx, attempt); err != nil {
+				return nil, errors.Join(lastErr, err)
+			}
+		}
+
+		var body io.Reader = bytes.NewReader(content)
+		if req.stream != nil {
+			body = req.stream
+		}
+		httpRequest, err := http.NewRequestWithContext(ctx, req.method, c.baseURL+req.path, body)
+		if err != nil {
+			return nil, err
+		}
+		if content != nil {
+			httpRequest.Header.Set("Content-Type", "application/json")
+		}
+		if req.stream != nil {
+			httpRequest.Header.Set("Content-Type", "application/octet-stream")
+			httpRequest.ContentLength = req.size
+		}
+		if req.accept != "" {
+			httpRequest.Header.Set("Accept", req.accept)
+		}
+		if req.ifMatch != "" {
+			httpRequest.Header.Set("If-Match", req.ifMatch)
+		}
+		if c.adminToken != "" {
+			httpRequest.Header.Set(AdminTokenHeader, c.adminToken)
+		}
+		if key != "" {
+			httpRequest.Header.Set(IdempotencyKeyHeader, key)
+		}
+
+		response, err := c.http.Do(httpRequest)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			if !retryable {
+				return nil, err
+			}
+			continue
+		}
+
+		if response.StatusCode < http.StatusBadRequest {
+			return response, nil
+		}
+
+		lastErr = decodeError(response)
+		if !retryable || !isRetryableStatus(response.StatusCode) {
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+func (c *Client) wait(ctx context.Context, attempt int) error {
+	backoff := c.retry.InitialBackoff << (attempt - 1)
+	if backoff <= 0 || backoff > c.retry.MaxBackoff {
+		backoff = c.retry.MaxBackoff
+	}
+	// NOTE: full jitter, clients failing together don't retry together
+	if backoff > 0 {
+		backoff = rand.N(backoff) + 1
+	}
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	// NOTE: a conflict on a request carrying an idempotency key means the first attempt is still in progress
+	case http.StatusConflict, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// doJSON sends the request and decodes the response body in result.
+func (c *Client) doJSON(ctx context.Context, req request, result any) error {
+	response, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if result == nil {
+		_, err = io.Copy(io.Discard, response.Body)
+		return err
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode response of %s %s: %w", req.method, req.path, err)
+	}
+	return nil
+}
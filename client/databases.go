@@ -0,0 +1,508 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type Database struct {
+	Name           string `json:"name"`
+	Stage          uint   `json:"stage"`
+	LastAccessedAt string `json:"last_accessed_at,omitempty"`
+	RequestCount   uint   `json:"request_count"`
+	Degraded       bool   `json:"degraded"`
+	// NOTE: stage the database is moving to, 0 when it isn't moving
+	MovingToStage uint `json:"moving_to_stage,omitempty"`
+	// NOTE: why the database is at its stage, one of the Placement constants
+	Placement string `json:"placement,omitempty"`
+	// NOTE: time since the oldest write the copy at the persistence stage misses, and whether it exceeds the sync window
+	SyncLagMs          int64 `json:"sync_lag_ms"`
+	SyncWindowExceeded bool  `json:"sync_window_exceeded,omitempty"`
+}
+
+// Reasons a database is at its current stage, reported in Database.Placement.
+const (
+	PlacementInitial         = "initial"
+	PlacementManual          = "manual"
+	PlacementPromotion       = "promotion"
+	PlacementDemotion        = "demotion"
+	PlacementEviction        = "eviction"
+	PlacementLeaseLost       = "lease_lost"
+	PlacementStandbyPromoted = "standby_promoted"
+)
+
+// Storage classes reported in Column.Type, mixed when a column holds values of several classes.
+const (
+	ColumnTypeInteger = "integer"
+	ColumnTypeReal    = "real"
+	ColumnTypeText    = "text"
+	ColumnTypeBlob    = "blob"
+	ColumnTypeNull    = "null"
+	ColumnTypeMixed   = "mixed"
+)
+
+// RolledBackError is the error of the queries of a failed transaction other than the failing one.
+const RolledBackError = "Transaction rolled back."
+
+// RolledBackToSavepointError starts the error of the queries rolled back to a savepoint other than the failing one, it
+// is followed by the name of the savepoint.
+const RolledBackToSavepointError = "Rolled back to savepoint "
+
+// Column describes a column of a typed query result.
+type Column struct {
+	Name         string `json:"name"`
+	DeclaredType string `json:"declaredType,omitempty"`
+	Type         string `json:"type"`
+}
+
+// QueryResult is the result of one query, Data holds the raw rows, see ScanRows to decode them. A truncated result
+// holds the first rows only, the next ones are read by running the statement again with NextPageToken as PageToken.
+// Rows holds the values of every row in the order of Columns instead of Data when the rows are asked for as arrays, see
+// QueryArrays. Types holds the storage class of every value, row by row in the order of Columns, when a column is mixed.
+type QueryResult struct {
+	Success       bool            `json:"success"`
+	Data          json.RawMessage `json:"data,omitempty"`
+	Rows          json.RawMessage `json:"rows,omitempty"`
+	Columns       []Column        `json:"columns,omitempty"`
+	Types         [][]string      `json:"types,omitempty"`
+	Truncated     bool            `json:"truncated,omitempty"`
+	NextPageToken string          `json:"next_page_token,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	Code          ErrorCode       `json:"code,omitempty"`
+	SQLite        *SQLiteError    `json:"sqlite,omitempty"`
+	// Debug holds the status counters of the query when they were asked for, see QueryDebug.
+	Debug *QueryStats `json:"debug,omitempty"`
+}
+
+// QueryStats are the SQLite status counters of a query, what it actually did to produce its result.
+type QueryStats struct {
+	Statements    int     `json:"statements"`
+	DurationMs    float64 `json:"duration_ms"`
+	VMSteps       int     `json:"vm_steps"`
+	FullscanSteps int     `json:"fullscan_steps"`
+	Sorts         int     `json:"sorts"`
+	AutoIndexes   int     `json:"autoindexes"`
+	CacheHits     int     `json:"cache_hits"`
+	PagesRead     int     `json:"pages_read"`
+	PagesWritten  int     `json:"pages_written"`
+}
+
+// Err returns the failure of the query as an *Error, nil when it succeeded.
+func (result QueryResult) Err() error {
+	if result.Success {
+		return nil
+	}
+	return &Error{Title: "Query failed", Detail: result.Error, Code: result.Code, SQLite: result.SQLite}
+}
+
+// ExecuteResult is the result of one write query.
+type ExecuteResult struct {
+	Success bool `json:"success"`
+	Data    struct {
+		RowsAffected int64 `json:"RowsAffected"`
+		LastInsertID int64 `json:"LastInsertID"`
+	} `json:"data"`
+	// NOTE: level the write reached when it succeeded, AckLocal with the sync error in Error when a persistent write
+	// couldn't be synced
+	Ack    string       `json:"ack,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Code   ErrorCode    `json:"code,omitempty"`
+	SQLite *SQLiteError `json:"sqlite,omitempty"`
+}
+
+// Levels at which the writes are acknowledged.
+const (
+	AckLocal      = "local"
+	AckPersistent = "persistent"
+)
+
+// Err returns the failure of the query as an *Error, nil when it succeeded.
+func (result ExecuteResult) Err() error {
+	if result.Success {
+		return nil
+	}
+	return &Error{Title: "Query failed", Detail: result.Error, Code: result.Code, SQLite: result.SQLite}
+}
+
+func databasePath(name string, operation string) string {
+	return fmt.Sprintf("/databases/%s/%s", url.PathEscape(name), operation)
+}
+
+func (c *Client) ListDatabases(ctx context.Context) ([]Database, error) {
+	var response struct {
+		Databases []Database `json:"databases"`
+	}
+	err := c.doJSON(ctx, request{method: http.MethodGet, path: "/databases"}, &response)
+	return response.Databases, err
+}
+
+// GetDatabase returns the database with the given name, an error with the not_found code when it doesn't exist.
+func (c *Client) GetDatabase(ctx context.Context, name string) (Database, error) {
+	databases, err := c.ListDatabases(ctx)
+	if err != nil {
+		return Database{}, err
+	}
+	for _, database := range databases {
+		if database.Name == name {
+			return database, nil
+		}
+	}
+	return Database{}, &Error{Status: http.StatusNotFound, Title: "Database not found", Detail: name, Code: ErrorCodeNotFound}
+}
+
+func (c *Client) CreateDatabase(ctx context.Context, name string) (Database, error) {
+	return c.createDatabase(ctx, map[string]any{"name": name})
+}
+
+// AdoptDatabase creates the database like CreateDatabase, adopting it when a stage of the server already holds it
+// without it being in the catalog instead of failing with a conflict.
+func (c *Client) AdoptDatabase(ctx context.Context, name string) (Database, error) {
+	return c.createDatabase(ctx, map[string]any{"name": name, "adopt": true})
+}
+
+// NOTE: workloads a database may be declared with, they pick the stage it is created at with its size
+const (
+	WorkloadReadHeavy  = "read_heavy"
+	WorkloadWriteHeavy = "write_heavy"
+	WorkloadArchival   = "archival"
+)
+
+// CreateDatabaseWithWorkload creates the database like CreateDatabase, at the stage the declared workload calls for
+// rather than the default creation stage of the server.
+func (c *Client) CreateDatabaseWithWorkload(ctx context.Context, name string, workload string) (Database, error) {
+	return c.createDatabase(ctx, map[string]any{"name": name, "workload": workload})
+}
+
+func (c *Client) createDatabase(ctx context.Context, body map[string]any) (Database, error) {
+	// NOTE: the create route returns the database struct as is, without json tags
+	var response struct {
+		Database struct {
+			Name         string
+			Stage        uint
+			LastAccessed time.Time
+			RequestCount uint
+			Degraded     bool
+		}
+	}
+	req := request{method: http.MethodPost, path: "/databases", body: body, idempotent: true}
+	if err := c.doJSON(ctx, req, &response); err != nil {
+		return Database{}, err
+	}
+	return Database{
+		Name:           response.Database.Name,
+		Stage:          response.Database.Stage,
+		LastAccessedAt: response.Database.LastAccessed.Format(time.RFC3339),
+		RequestCount:   response.Database.RequestCount,
+		Degraded:       response.Database.Degraded,
+	}, nil
+}
+
+type queryBody struct {
+	Queries     []string `json:"queries"`
+	Parameters  [][]any  `json:"parameters,omitempty"`
+	Typed       bool     `json:"typed,omitempty"`
+	RowTypes    bool     `json:"row_types,omitempty"`
+	Arrays      bool     `json:"arrays,omitempty"`
+	Transaction bool     `json:"transaction,omitempty"`
+	OnError     string   `json:"on_error,omitempty"`
+	Ack         string   `json:"ack,omitempty"`
+	PageTokens  []string `json:"page_tokens,omitempty"`
+	Consistent  bool     `json:"consistent,omitempty"`
+	Debug       bool     `json:"debug,omitempty"`
+}
+
+// Statement is a query and the values bound to its placeholders. PageToken continues a truncated result of the read
+// query, it is ignored by the writes.
+type Statement struct {
+	Query      string
+	Parameters []any
+	PageToken  string
+}
+
+// NOTE: integers past the float64 precision are sent as text, the column affinity converts them back
+const maxExactJSONInteger = 1 << 53
+
+func encodeParameter(parameter any) any {
+	switch parameter := parameter.(type) {
+	case []byte:
+		return map[string]string{"base64": base64.StdEncoding.EncodeToString(parameter)}
+	case time.Time:
+		return parameter.Format(time.RFC3339Nano)
+	case int64:
+		if parameter >= maxExactJSONInteger || parameter <= -maxExactJSONInteger {
+			return strconv.FormatInt(parameter, 10)
+		}
+	case int:
+		return encodeParameter(int64(parameter))
+	}
+	return parameter
+}
+
+func statementsBody(statements []Statement) queryBody {
+	body := queryBody{Queries: make([]string, len(statements))}
+	hasParameters, hasPageTokens := false, false
+	for _, statement := range statements {
+		hasParameters = hasParameters || len(statement.Parameters) > 0
+		hasPageTokens = hasPageTokens || statement.PageToken != ""
+	}
+	if hasParameters {
+		body.Parameters = make([][]any, len(statements))
+	}
+	if hasPageTokens {
+		body.PageTokens = make([]string, len(statements))
+	}
+
+	for index, statement := range statements {
+		body.Queries[index] = statement.Query
+		if hasPageTokens {
+			body.PageTokens[index] = statement.PageToken
+		}
+		if hasParameters {
+			body.Parameters[index] = make([]any, len(statement.Parameters))
+			for parameterIndex, parameter := range statement.Parameters {
+				body.Parameters[index][parameterIndex] = encodeParameter(parameter)
+			}
+		}
+	}
+	return body
+}
+
+// Query runs read queries, a failed query is reported in its result and doesn't fail the others.
+func (c *Client) Query(ctx context.Context, name string, queries ...string) ([]QueryResult, error) {
+	return c.query(ctx, name, queryBody{Queries: queries})
+}
+
+// QueryTyped runs read queries and includes the columns and their types in the results.
+func (c *Client) QueryTyped(ctx context.Context, name string, queries ...string) ([]QueryResult, error) {
+	return c.query(ctx, name, queryBody{Queries: queries, Typed: true, RowTypes: true})
+}
+
+// QueryStatements runs read queries with bound parameters, the results include the columns and their types.
+func (c *Client) QueryStatements(ctx context.Context, name string, statements ...Statement) ([]QueryResult, error) {
+	body := statementsBody(statements)
+	body.Typed, body.RowTypes = true, true
+	return c.query(ctx, name, body)
+}
+
+// QuerySnapshot runs read queries with bound parameters in a single read transaction, so that all of them see the same
+// snapshot of the database. The results include the columns and their types.
+func (c *Client) QuerySnapshot(ctx context.Context, name string, statements ...Statement) ([]QueryResult, error) {
+	body := statementsBody(statements)
+	body.Typed, body.RowTypes = true, true
+	body.Consistent = true
+	return c.query(ctx, name, body)
+}
+
+// QueryArrays runs read queries with bound parameters like QueryStatements, and returns their rows in Rows as arrays
+// of values in the order of the columns of the query, the keys of the rows returned as objects being sorted.
+func (c *Client) QueryArrays(ctx context.Context, name string, statements ...Statement) ([]QueryResult, error) {
+	body := statementsBody(statements)
+	body.Typed, body.RowTypes, body.Arrays = true, true, true
+	return c.query(ctx, name, body)
+}
+
+// QueryDebug runs read queries with bound parameters like QueryStatements, and includes the SQLite status counters of
+// every query in its result to investigate how it performs.
+func (c *Client) QueryDebug(ctx context.Context, name string, statements ...Statement) ([]QueryResult, error) {
+	body := statementsBody(statements)
+	body.Typed, body.RowTypes = true, true
+	body.Debug = true
+	return c.query(ctx, name, body)
+}
+
+func (c *Client) query(ctx context.Context, name string, body queryBody) ([]QueryResult, error) {
+	var response struct {
+		Results []QueryResult `json:"results"`
+	}
+	// NOTE: reads are safe to repeat, the request is retried without an idempotency key
+	req := request{method: http.MethodPost, path: databasePath(name, "query"), body: body, safe: true}
+	err := c.doJSON(ctx, req, &response)
+	return response.Results, err
+}
+
+// Formats of the exported results, see Export.
+const (
+	ExportFormatArrow   = "application/vnd.apache.arrow.stream"
+	ExportFormatParquet = "application/vnd.apache.parquet"
+	ExportFormatCSV     = "text/csv"
+)
+
+// Export streams all of the rows of a read query as an Arrow IPC stream, a Parquet file or CSV, format is one of the
+// ExportFormat* content types. The response is sent gzip-compressed and decompressed by the transport as it is read.
+// The caller closes the returned body.
+func (c *Client) Export(ctx context.Context, name string, format string, statement Statement) (io.ReadCloser, error) {
+	body := struct {
+		Query      string `json:"query"`
+		Parameters []any  `json:"parameters,omitempty"`
+	}{Query: statement.Query}
+	for _, parameter := range statement.Parameters {
+		body.Parameters = append(body.Parameters, encodeParameter(parameter))
+	}
+
+	response, err := c.do(ctx, request{method: http.MethodPost, path: databasePath(name, "query/export"), body: body, safe: true, accept: format})
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// Execute runs write queries, retries of the request are applied once thanks to its idempotency key.
+func (c *Client) Execute(ctx context.Context, name string, queries ...string) ([]ExecuteResult, error) {
+	return c.execute(ctx, name, queryBody{Queries: queries})
+}
+
+// ExecuteStatements runs write queries with bound parameters.
+func (c *Client) ExecuteStatements(ctx context.Context, name string, statements ...Statement) ([]ExecuteResult, error) {
+	return c.execute(ctx, name, statementsBody(statements))
+}
+
+// ExecuteTransaction runs write queries in a single transaction, a failing query rolls back all of them.
+func (c *Client) ExecuteTransaction(ctx context.Context, name string, statements ...Statement) ([]ExecuteResult, error) {
+	body := statementsBody(statements)
+	body.Transaction = true
+	return c.execute(ctx, name, body)
+}
+
+// ExecuteTransactionWithSavepoints runs write queries in a single transaction, a failing query rolls back the queries
+// since the innermost open savepoint and the transaction carries on from the RELEASE of that savepoint. The results of
+// the queries undone or skipped start with RolledBackToSavepointError, without open savepoint a failing query rolls
+// back all of them.
+func (c *Client) ExecuteTransactionWithSavepoints(ctx context.Context, name string, statements ...Statement) ([]ExecuteResult, error) {
+	body := statementsBody(statements)
+	body.Transaction = true
+	body.OnError = "rollback_to_savepoint"
+	return c.execute(ctx, name, body)
+}
+
+// ExecutePersistent runs write queries with bound parameters and returns once they are synced to the persistence stage,
+// the writes not synced are reported with the AckLocal level.
+func (c *Client) ExecutePersistent(ctx context.Context, name string, statements ...Statement) ([]ExecuteResult, error) {
+	body := statementsBody(statements)
+	body.Ack = AckPersistent
+	return c.execute(ctx, name, body)
+}
+
+func (c *Client) execute(ctx context.Context, name string, body queryBody) ([]ExecuteResult, error) {
+	var response struct {
+		Results []ExecuteResult `json:"results"`
+	}
+	// NOTE: writes return no rows, there is no page to continue
+	body.PageTokens = nil
+	body.Consistent = false
+	req := request{method: http.MethodPost, path: databasePath(name, "execute"), body: body, idempotent: true}
+	err := c.doJSON(ctx, req, &response)
+	return response.Results, err
+}
+
+type stageResponse struct {
+	Name  string `json:"name"`
+	Stage uint   `json:"stage"`
+}
+
+// Sync forces the database to be synced to the remote stage and returns the stage it is on.
+func (c *Client) Sync(ctx context.Context, name string) (uint, error) {
+	var response stageResponse
+	req := request{method: http.MethodPost, path: databasePath(name, "sync"), idempotent: true}
+	err := c.doJSON(ctx, req, &response)
+	return response.Stage, err
+}
+
+// Move moves the database to the given stage.
+func (c *Client) Move(ctx context.Context, name string, stage uint) error {
+	req := request{method: http.MethodPost, path: databasePath(name, "move"), body: map[string]uint{"stage": stage}, idempotent: true}
+	return c.doJSON(ctx, req, nil)
+}
+
+// DownloadURL returns a presigned URL of the remote copy of the database, valid for expiresIn or the server default
+// when zero.
+func (c *Client) DownloadURL(ctx context.Context, name string, expiresIn time.Duration) (string, time.Time, error) {
+	path := databasePath(name, "download-url")
+	if expiresIn > 0 {
+		path += fmt.Sprintf("?expires_in=%d", int(expiresIn.Seconds()))
+	}
+
+	var response struct {
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	err := c.doJSON(ctx, request{method: http.MethodGet, path: path}, &response)
+	return response.URL, response.ExpiresAt, err
+}
+
+// Backup streams the remote copy of the database to w and returns the number of bytes written.
+func (c *Client) Backup(ctx context.Context, name string, w io.Writer) (int64, error) {
+	downloadURL, _, err := c.DownloadURL(ctx, name, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	// NOTE: the presigned URL targets the bucket, it mustn't receive the admin token
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	response, err := c.http.Do(httpRequest)
+	if err != nil {
+		return 0, fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to download %s: %s", name, response.Status)
+	}
+	return io.Copy(w, response.Body)
+}
+
+// StreamQueryStatements runs read queries like QueryStatements, passing every result to fn as soon as its query
+// completes, in the order they complete, with the index of its statement. Large batches are run this way without
+// holding all of their results at once. fn stops the iteration by returning an error, which is returned.
+func (c *Client) StreamQueryStatements(ctx context.Context, name string, fn func(index int, result QueryResult) error, statements ...Statement) error {
+	body := statementsBody(statements)
+	body.Typed, body.RowTypes = true, true
+	req := request{method: http.MethodPost, path: databasePath(name, "query/stream"), body: body, safe: true}
+	return streamResults(c, ctx, req, len(statements), fn)
+}
+
+// StreamExecuteStatements runs write queries like ExecuteStatements, passing every result to fn as soon as its query
+// completes. fn stops the iteration by returning an error, which is returned, the remaining queries are still run.
+func (c *Client) StreamExecuteStatements(ctx context.Context, name string, fn func(index int, result ExecuteResult) error, statements ...Statement) error {
+	body := statementsBody(statements)
+	body.PageTokens = nil
+	req := request{method: http.MethodPost, path: databasePath(name, "execute/stream"), body: body, idempotent: true}
+	return streamResults(c, ctx, req, len(statements), fn)
+}
+
+// streamResults decodes the JSON lines of a streamed response, one result of the batch at a time, and fails when the
+// response ends before the results of every query were received.
+func streamResults[T any](c *Client, ctx context.Context, req request, expected int, fn func(index int, result T) error) error {
+	response, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	decoder := json.NewDecoder(response.Body)
+	for received := 0; ; received++ {
+		var line struct {
+			Index  int `json:"index"`
+			Result T   `json:"result"`
+		}
+		if err := decoder.Decode(&line); err == io.EOF && received == expected {
+			return nil
+		} else if err == io.EOF {
+			return fmt.Errorf("stream ended after %d of %d results", received, expected)
+		} else if err != nil {
+			return fmt.Errorf("failed to decode streamed result: %w", err)
+		}
+		if err := fn(line.Index, line.Result); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorCode identifies the cause of a failure, the values match the codes returned by the server.
+type ErrorCode string
+
+const (
+	ErrorCodeNotFound           ErrorCode = "not_found"
+	ErrorCodeConflict           ErrorCode = "conflict"
+	ErrorCodeInvalidInput       ErrorCode = "invalid_input"
+	ErrorCodeUnauthorized       ErrorCode = "unauthorized"
+	ErrorCodeQuotaExceeded      ErrorCode = "quota_exceeded"
+	ErrorCodeStageUnavailable   ErrorCode = "stage_unavailable"
+	ErrorCodeSyncFailed         ErrorCode = "sync_failed"
+	ErrorCodeBusy               ErrorCode = "busy"
+	ErrorCodeQueryFailed        ErrorCode = "query_failed"
+	ErrorCodeReadOnly           ErrorCode = "read_only"
+	ErrorCodeForbidden          ErrorCode = "forbidden"
+	ErrorCodePreconditionFailed ErrorCode = "precondition_failed"
+	ErrorCodeTooLarge           ErrorCode = "too_large"
+	ErrorCodeInternal           ErrorCode = "internal"
+)
+
+// Error is returned for the responses with an error status.
+type Error struct {
+	Status int       `json:"status"`
+	Title  string    `json:"title"`
+	Detail string    `json:"detail"`
+	Code   ErrorCode `json:"code"`
+	// SQLite holds the result codes of a failed query when SQLite reported its failure.
+	SQLite *SQLiteError `json:"-"`
+}
+
+// SQLiteError holds the SQLite result codes of a failed query, e.g. to tell a unique constraint violation, with the
+// SQLITE_CONSTRAINT_UNIQUE extended name, from a syntax error.
+type SQLiteError struct {
+	Code         int    `json:"code"`
+	Name         string `json:"name"`
+	ExtendedCode int    `json:"extended_code"`
+	ExtendedName string `json:"extended_name"`
+	// Statement is the index in the batch of the query which failed, -1 when no query failed on its own.
+	Statement int `json:"statement"`
+	// Offset is the byte offset in the query of the token which triggered a syntax error.
+	Offset *int `json:"offset,omitempty"`
+}
+
+// SQLiteErrorOf returns the SQLite result codes of err when it is or wraps an *Error carrying them, nil otherwise.
+func SQLiteErrorOf(err error) *SQLiteError {
+	var clientErr *Error
+	if errors.As(err, &clientErr) {
+		return clientErr.SQLite
+	}
+	return nil
+}
+
+func (err *Error) Error() string {
+	message := err.Title
+	if err.Detail != "" {
+		message += ": " + err.Detail
+	}
+	if err.Code != "" {
+		message += fmt.Sprintf(" (%s)", err.Code)
+	}
+	return message
+}
+
+// CodeOf returns the code of err when it is or wraps an *Error, an empty code otherwise.
+func CodeOf(err error) ErrorCode {
+	var clientErr *Error
+	if errors.As(err, &clientErr) {
+		return clientErr.Code
+	}
+	return ""
+}
+
+func decodeError(response *http.Response) error {
+	defer response.Body.Close()
+
+	err := &Error{Status: response.StatusCode}
+	if decodeErr := json.NewDecoder(response.Body).Decode(err); decodeErr != nil || err.Title == "" {
+		err.Title = response.Status
+	}
+	err.Status = response.StatusCode
+	return err
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ManifestSignatureHeader carries the signature of the manifest body.
+const ManifestSignatureHeader = "X-Persisto-Manifest-Signature"
+
+// Manifest is the inventory of the databases of a server.
+type Manifest struct {
+	Version     int                `json:"version"`
+	GeneratedAt time.Time          `json:"generated_at"`
+	Bucket      string             `json:"bucket"`
+	Databases   []ManifestDatabase `json:"databases"`
+
+	// Raw is the body as received, the one the signature covers.
+	Raw []byte `json:"-"`
+	// Signature is the hex encoded HMAC-SHA256 of Raw, empty when the server doesn't sign its manifests.
+	Signature string `json:"-"`
+}
+
+// ManifestDatabase is a database of the manifest, Error tells why some of its fields couldn't be read.
+type ManifestDatabase struct {
+	Name             string     `json:"name"`
+	Stage            uint       `json:"stage"`
+	StageName        string     `json:"stage_name"`
+	Placement        string     `json:"placement"`
+	Degraded         bool       `json:"degraded"`
+	SizeBytes        int64      `json:"size_bytes"`
+	Checksum         string     `json:"checksum,omitempty"`
+	SyncedAt         *time.Time `json:"synced_at,omitempty"`
+	RemoteGeneration string     `json:"remote_generation,omitempty"`
+	SyncPending      bool       `json:"sync_pending,omitempty"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// Verify reports whether the manifest is signed with the key, the MANIFEST_SIGNING_KEY of the server.
+func (manifest Manifest) Verify(key string) bool {
+	signature, err := hex.DecodeString(manifest.Signature)
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(manifest.Raw)
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+// Manifest returns the inventory of the databases of the server, it requires the admin token. With checksums, the
+// server reads every row of every database to digest its content.
+func (c *Client) Manifest(ctx context.Context, withChecksums bool) (Manifest, error) {
+	req := request{method: http.MethodGet, path: fmt.Sprintf("/admin/manifest?checksums=%t", withChecksums)}
+	response, err := c.do(ctx, req)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer response.Body.Close()
+
+	var manifest Manifest
+	if manifest.Raw, err = io.ReadAll(response.Body); err != nil {
+		return Manifest{}, err
+	}
+	if err := json.Unmarshal(manifest.Raw, &manifest); err != nil {
+		return Manifest{}, fmt.Errorf("failed to decode response of %s %s: %w", req.method, req.path, err)
+	}
+	manifest.Signature = response.Header.Get(ManifestSignatureHeader)
+	return manifest, nil
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Quotas bound the resources of a database, zero meaning unlimited.
+type Quotas struct {
+	MaxSizeBytes int64 `json:"max_size_bytes"`
+	// NOTE: sync lag allowed to the database, zero to follow the configured sync window
+	SyncWindowSeconds int64 `json:"sync_window_seconds,omitempty"`
+}
+
+// Policy restricts a principal to the rows of a table matching the filter, the masked columns are read as NULL.
+type Policy struct {
+	Principal     string   `json:"principal"`
+	Table         string   `json:"table"`
+	Filter        string   `json:"filter,omitempty"`
+	MaskedColumns []string `json:"masked_columns,omitempty"`
+}
+
+// StatementPolicy restricts the statements the clients may run on a database, the zero policy allows all of them.
+// ReadOnly lists the endpoints only allowed to read, among query, execute and pgwire.
+type StatementPolicy struct {
+	DenyDDL    bool     `json:"deny_ddl,omitempty"`
+	DenyAttach bool     `json:"deny_attach,omitempty"`
+	DenyPragma bool     `json:"deny_pragma,omitempty"`
+	ReadOnly   []string `json:"read_only,omitempty"`
+	MaxRows    int      `json:"max_rows,omitempty"`
+}
+
+// Spec is the desired state of a database, nil fields aren't managed and keep their current value. Empty, non nil,
+// tags and policies remove the existing ones. Policies and statement policies require the admin token.
+type Spec struct {
+	Stage         *uint             `json:"stage,omitempty"`
+	SchemaVersion *int64            `json:"schema_version,omitempty"`
+	Quotas        *Quotas           `json:"quotas,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+	Statements    *StatementPolicy  `json:"statements,omitempty"`
+	Policies      []Policy          `json:"policies,omitempty"`
+	// NOTE: picks the stage of a missing database when Stage is nil, it isn't reported in its state
+	Workload string `json:"workload,omitempty"`
+}
+
+// DatabaseState is the current state of a database, in the shape of its spec. Policies are only reported to the admins.
+type DatabaseState struct {
+	Name          string            `json:"name"`
+	Stage         uint              `json:"stage"`
+	SchemaVersion int64             `json:"schema_version"`
+	Quotas        Quotas            `json:"quotas"`
+	Tags          map[string]string `json:"tags"`
+	Statements    StatementPolicy   `json:"statements"`
+	Policies      []Policy          `json:"policies,omitempty"`
+}
+
+func provisioningPath(name string) string {
+	return fmt.Sprintf("/databases/%s", url.PathEscape(name))
+}
+
+// Provision converges the database towards the spec, creating it when missing, and returns its state along with the
+// changes applied, none when it already matched the spec.
+func (c *Client) Provision(ctx context.Context, name string, spec Spec) (DatabaseState, []string, error) {
+	var response struct {
+		DatabaseState
+		Changes []string `json:"changes"`
+	}
+	// NOTE: applying the same spec again changes nothing, so it is retried as is
+	req := request{method: http.MethodPut, path: provisioningPath(name), body: spec, safe: true}
+	err := c.doJSON(ctx, req, &response)
+	return response.DatabaseState, response.Changes, err
+}
+
+// DescribeDatabase returns the current state of the database, an error with the not_found code when it doesn't exist.
+func (c *Client) DescribeDatabase(ctx context.Context, name string) (DatabaseState, error) {
+	var response DatabaseState
+	err := c.doJSON(ctx, request{method: http.MethodGet, path: provisioningPath(name)}, &response)
+	return response, err
+}
+
+// DeleteDatabase deletes the database from every stage, deleting a missing database succeeds.
+func (c *Client) DeleteDatabase(ctx context.Context, name string) error {
+	return c.doJSON(ctx, request{method: http.MethodDelete, path: provisioningPath(name), safe: true}, nil)
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ScanRows decodes the rows of a successful query result into values of T, columns are matched to the fields of T by
+// their json tags, or to the keys when T is a map. Blobs are base64 encoded and decode into []byte fields.
+func ScanRows[T any](result QueryResult) ([]T, error) {
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+
+	rows := []T{}
+	if len(result.Data) == 0 {
+		return rows, nil
+	}
+	if err := json.Unmarshal(result.Data, &rows); err != nil {
+		return nil, fmt.Errorf("failed to scan rows: %w", err)
+	}
+	return rows, nil
+}
+
+// QueryEach runs a single read query and decodes its rows one at a time as the response is received, so that large
+// results don't have to be held in memory at once. The pages of a truncated result are requested one after the other.
+// fn stops the iteration by returning an error, which is returned.
+func QueryEach[T any](ctx context.Context, c *Client, name string, query string, fn func(row T) error) error {
+	token := ""
+	for {
+		next, err := queryEachPage(ctx, c, name, query, token, fn)
+		if err != nil || next == "" {
+			return err
+		}
+		token = next
+	}
+}
+
+// queryEachPage decodes the rows of a page of the result like QueryEach, and returns the token of the next page, empty
+// for the last one.
+func queryEachPage[T any](ctx context.Context, c *Client, name string, query string, token string, fn func(row T) error) (string, error) {
+	body := queryBody{Queries: []string{query}}
+	if token != "" {
+		body.PageTokens = []string{token}
+	}
+	req := request{method: http.MethodPost, path: databasePath(name, "query"), body: body, safe: true}
+	response, err := c.do(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	decoder := json.NewDecoder(response.Body)
+	decoder.UseNumber()
+
+	if err := enterObjectKey(decoder, "results"); err != nil {
+		return "", err
+	}
+	if err := expectDelim(decoder, '['); err != nil {
+		return "", err
+	}
+	if !decoder.More() {
+		return "", fmt.Errorf("no result returned for the query")
+	}
+	if err := expectDelim(decoder, '{'); err != nil {
+		return "", err
+	}
+
+	// NOTE: the result fields are read as they come, the rows are only decoded one by one
+	var result QueryResult
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+
+		if key != "data" {
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return "", err
+			}
+			switch key {
+			case "success":
+				json.Unmarshal(value, &result.Success)
+			case "error":
+				json.Unmarshal(value, &result.Error)
+			case "code":
+				json.Unmarshal(value, &result.Code)
+			case "next_page_token":
+				json.Unmarshal(value, &result.NextPageToken)
+			}
+			continue
+		}
+
+		if err := expectDelim(decoder, '['); err != nil {
+			return "", err
+		}
+		for decoder.More() {
+			var row T
+			if err := decoder.Decode(&row); err != nil {
+				return "", fmt.Errorf("failed to scan row: %w", err)
+			}
+			if err := fn(row); err != nil {
+				return "", err
+			}
+		}
+		if err := expectDelim(decoder, ']'); err != nil {
+			return "", err
+		}
+	}
+
+	return result.NextPageToken, result.Err()
+}
+
+// enterObjectKey reads the opening of an object and its keys until the given one, skipping the values of the others.
+func enterObjectKey(decoder *json.Decoder, key string) error {
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if token == key {
+			return nil
+		}
+		var skipped json.RawMessage
+		if err := decoder.Decode(&skipped); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("missing %q in response", key)
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("unexpected %v in response, expected %v", token, delim)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+// Package sqldriver is a database/sql driver running the queries through the persisto HTTP API.
+//
+//	import _ "persisto/client/sqldriver"
+//
+//	db, err := sql.Open("persisto", "persisto://localhost:8080/production-db")
+//
+// The data source name is persisto://host[:port]/database, add ?tls=true to reach the server over HTTPS. Placeholders
+// are positional, either ? or ?NNN. Transactions are sent to the server at commit as a single atomic batch: their
+// writes are buffered, so results are only known once committed and reads are refused after a write.
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"persisto/client"
+)
+
+const DriverName = "persisto"
+
+var (
+	ErrNamedParameters = errors.New("persisto: named parameters are not supported")
+	ErrReadAfterWrite  = errors.New("persisto: reads after writes are not supported in a transaction, the writes are only sent at commit")
+	ErrResultPending   = errors.New("persisto: results of a transaction write are only available once committed")
+	ErrIsolationLevel  = errors.New("persisto: only the default isolation level is supported")
+)
+
+func init() {
+	sql.Register(DriverName, &Driver{})
+}
+
+type Driver struct{}
+
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	connector, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(context.Background())
+}
+
+func (d *Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("persisto: invalid data source name: %w", err)
+	}
+	if parsed.Scheme != DriverName {
+		return nil, fmt.Errorf("persisto: invalid data source name scheme %q, expected %q", parsed.Scheme, DriverName)
+	}
+
+	database := strings.Trim(parsed.Path, "/")
+	if parsed.Host == "" || database == "" {
+		return nil, errors.New("persisto: the data source name must be persisto://host[:port]/database")
+	}
+
+	scheme := "http"
+	if parsed.Query().Get("tls") == "true" {
+		scheme = "https"
+	}
+
+	return NewConnector(client.New(scheme+"://"+parsed.Host, client.Options{}), database), nil
+}
+
+// Connector opens connections to a database through the given client, it allows configuring the client, e.g. its
+// retries, before handing it to sql.OpenDB.
+type Connector struct {
+	client   *client.Client
+	database string
+}
+
+func NewConnector(client *client.Client, database string) *Connector {
+	return &Connector{client: client, database: database}
+}
+
+func (c *Connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &conn{client: c.client, database: c.database}, nil
+}
+
+func (c *Connector) Driver() driver.Driver {
+	return &Driver{}
+}
+
+// conn is stateless besides the transaction being built, every query is an independent request.
+type conn struct {
+	client   *client.Client
+	database string
+	tx       *tx
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{conn: c, query: query}, nil
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Prepare(query)
+}
+
+func (c *conn) Close() error {
+	c.tx = nil
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, options driver.TxOptions) (driver.Tx, error) {
+	if options.Isolation != driver.IsolationLevel(sql.LevelDefault) {
+		return nil, ErrIsolationLevel
+	}
+	c.tx = &tx{conn: c}
+	return c.tx, nil
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	_, err := c.client.GetDatabase(ctx, c.database)
+	return err
+}
+
+func (c *conn) CheckNamedValue(value *driver.NamedValue) error {
+	if value.Name != "" {
+		return ErrNamedParameters
+	}
+	// NOTE: the default conversion covers every type the API accepts
+	converted, err := driver.DefaultParameterConverter.ConvertValue(value.Value)
+	if err != nil {
+		return err
+	}
+	value.Value = converted
+	return nil
+}
+
+func statement(query string, arguments []driver.NamedValue) client.Statement {
+	parameters := make([]any, len(arguments))
+	for index, argument := range arguments {
+		parameters[index] = argument.Value
+	}
+	return client.Statement{Query: query, Parameters: parameters}
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, arguments []driver.NamedValue) (driver.Rows, error) {
+	if c.tx != nil && len(c.tx.statements) > 0 {
+		return nil, ErrReadAfterWrite
+	}
+
+	// NOTE: the pages of a truncated result are requested as the rows are read
+	fetch := func(pageToken string) (client.QueryResult, error) {
+		page := statement(query, arguments)
+		page.PageToken = pageToken
+		results, err := c.client.QueryStatements(ctx, c.database, page)
+		if err != nil {
+			return client.QueryResult{}, err
+		}
+		if len(results) != 1 {
+			return client.QueryResult{}, fmt.Errorf("persisto: expected 1 result, got %d", len(results))
+		}
+		return results[0], results[0].Err()
+	}
+
+	result, err := fetch("")
+	if err != nil {
+		return nil, err
+	}
+	return newRows(result, fetch)
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, arguments []driver.NamedValue) (driver.Result, error) {
+	if c.tx != nil {
+		return c.tx.add(statement(query, arguments)), nil
+	}
+
+	results, err := c.client.ExecuteStatements(ctx, c.database, statement(query, arguments))
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != 1 {
+		return nil, fmt.Errorf("persisto: expected 1 result, got %d", len(results))
+	}
+	if err := results[0].Err(); err != nil {
+		return nil, err
+	}
+	return &result{rowsAffected: results[0].Data.RowsAffected, lastInsertID: results[0].Data.LastInsertID, done: true}, nil
+}
+
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+// NumInput returns -1, the placeholders are only checked by the server.
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+func (s *stmt) Exec(arguments []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(arguments))
+}
+
+func (s *stmt) Query(arguments []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(arguments))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, arguments []driver.NamedValue) (driver.Result, error) {
+	return s.conn.ExecContext(ctx, s.query, arguments)
+}
+
+func (s *stmt) QueryContext(ctx context.Context, arguments []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.QueryContext(ctx, s.query, arguments)
+}
+
+func namedValues(values []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(values))
+	for index, value := range values {
+		named[index] = driver.NamedValue{Ordinal: index + 1, Value: value}
+	}
+	return named
+}
+
+// result is filled once the statement ran, at commit for the writes of a transaction.
+type result struct {
+	rowsAffected int64
+	lastInsertID int64
+	done         bool
+}
+
+func (r *result) LastInsertId() (int64, error) {
+	if !r.done {
+		return 0, ErrResultPending
+	}
+	return r.lastInsertID, nil
+}
+
+func (r *result) RowsAffected() (int64, error) {
+	if !r.done {
+		return 0, ErrResultPending
+	}
+	return r.rowsAffected, nil
+}
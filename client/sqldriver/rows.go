@@ -0,0 +1,121 @@
+package sqldriver
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"persisto/client"
+)
+
+// rows holds a page of a query result, the next page is fetched once its rows are read.
+type rows struct {
+	columns       []client.Column
+	data          []map[string]json.RawMessage
+	types         [][]string
+	index         int
+	nextPageToken string
+	fetch         func(pageToken string) (client.QueryResult, error)
+}
+
+func newRows(queryResult client.QueryResult, fetch func(pageToken string) (client.QueryResult, error)) (*rows, error) {
+	r := &rows{fetch: fetch}
+	if err := r.load(queryResult); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rows) load(queryResult client.QueryResult) error {
+	// NOTE: the types describe the values of the page, they may differ from one page to the other
+	r.columns, r.data, r.index, r.nextPageToken = queryResult.Columns, nil, 0, queryResult.NextPageToken
+	r.types = queryResult.Types
+	if len(queryResult.Data) > 0 {
+		if err := json.Unmarshal(queryResult.Data, &r.data); err != nil {
+			return fmt.Errorf("persisto: failed to decode rows: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *rows) Columns() []string {
+	names := make([]string, len(r.columns))
+	for index, column := range r.columns {
+		names[index] = column.Name
+	}
+	return names
+}
+
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	return strings.ToUpper(r.columns[index].DeclaredType)
+}
+
+func (r *rows) Close() error {
+	r.data, r.types, r.nextPageToken = nil, nil, ""
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	for r.index >= len(r.data) {
+		if r.nextPageToken == "" {
+			return io.EOF
+		}
+		queryResult, err := r.fetch(r.nextPageToken)
+		if err != nil {
+			return err
+		}
+		if err := r.load(queryResult); err != nil {
+			return err
+		}
+	}
+	row, position := r.data[r.index], r.index
+	r.index++
+
+	for index, column := range r.columns {
+		columnType := column.Type
+		// NOTE: the values of a mixed column are decoded with the type of every one of them
+		if column.Type == client.ColumnTypeMixed && position < len(r.types) && index < len(r.types[position]) {
+			columnType = r.types[position][index]
+		}
+		value, err := decodeValue(row[column.Name], columnType)
+		if err != nil {
+			return fmt.Errorf("persisto: column %s: %w", column.Name, err)
+		}
+		dest[index] = value
+	}
+	return nil
+}
+
+// decodeValue converts a JSON encoded value back to the SQLite storage class it was read with.
+func decodeValue(raw json.RawMessage, columnType string) (driver.Value, error) {
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+
+	switch raw[0] {
+	case '"':
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, err
+		}
+		// NOTE: blobs are base64 encoded, they are told apart from text by the type of their column or of the value
+		if columnType == client.ColumnTypeBlob {
+			return base64.StdEncoding.DecodeString(text)
+		}
+		return text, nil
+	case 't', 'f':
+		var boolean bool
+		err := json.Unmarshal(raw, &boolean)
+		return boolean, err
+	default:
+		if integer, err := strconv.ParseInt(string(raw), 10, 64); err == nil {
+			return integer, nil
+		}
+		return strconv.ParseFloat(string(raw), 64)
+	}
+}
@@ -0,0 +1,65 @@
+package sqldriver
+
+import (
+	"context"
+	"fmt"
+
+	"persisto/client"
+)
+
+// tx buffers the writes of a transaction and sends them in a single atomic request at commit.
+type tx struct {
+	conn       *conn
+	statements []client.Statement
+	results    []*result
+}
+
+func (t *tx) add(statement client.Statement) *result {
+	pending := &result{}
+	t.statements = append(t.statements, statement)
+	t.results = append(t.results, pending)
+	return pending
+}
+
+func (t *tx) Commit() error {
+	defer func() { t.conn.tx = nil }()
+
+	if len(t.statements) == 0 {
+		return nil
+	}
+
+	results, err := t.conn.client.ExecuteTransaction(context.Background(), t.conn.database, t.statements...)
+	if err != nil {
+		return err
+	}
+	if len(results) != len(t.statements) {
+		return fmt.Errorf("persisto: expected %d results, got %d", len(t.statements), len(results))
+	}
+
+	// NOTE: the other queries of a failed transaction only tell it was rolled back, the failing one is reported
+	var failure error
+	for _, executeResult := range results {
+		if executeResult.Success {
+			continue
+		}
+		if executeResult.Error != client.RolledBackError {
+			return executeResult.Err()
+		}
+		failure = executeResult.Err()
+	}
+	if failure != nil {
+		return failure
+	}
+
+	for index, executeResult := range results {
+		t.results[index].rowsAffected = executeResult.Data.RowsAffected
+		t.results[index].lastInsertID = executeResult.Data.LastInsertID
+		t.results[index].done = true
+	}
+	return nil
+}
+
+func (t *tx) Rollback() error {
+	t.conn.tx = nil
+	return nil
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// RowsOptions selects the rows of a table read by ReadRows, the zero value reads the first 100 rows in the order of
+// the key of the table.
+type RowsOptions struct {
+	// Columns defaults to every column of the table.
+	Columns []string
+	// Filters are <column>:<operator>[:<value>] expressions, e.g. "status:eq:active" or "deleted_at:null", all of
+	// them must match.
+	Filters []string
+	// OrderBy is a NOT NULL column, the key of the table breaks the ties.
+	OrderBy    string
+	Descending bool
+	Limit      int
+	// After is the NextCursor of the previous page.
+	After string
+}
+
+// RowsPage is a page of rows read from a table, Data holds the raw rows. NextCursor is empty on the last page.
+type RowsPage struct {
+	Data       json.RawMessage `json:"rows"`
+	Columns    []Column        `json:"columns"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// ReadRows reads a page of the rows of a table without writing SQL, the next page is read by passing NextCursor as
+// After with the same options.
+func (c *Client) ReadRows(ctx context.Context, name string, table string, options RowsOptions) (RowsPage, error) {
+	values := url.Values{}
+	if len(options.Columns) > 0 {
+		values.Set("columns", strings.Join(options.Columns, ","))
+	}
+	for _, filter := range options.Filters {
+		values.Add("filter", filter)
+	}
+	if options.OrderBy != "" {
+		values.Set("order_by", options.OrderBy)
+	}
+	if options.Descending {
+		values.Set("desc", "true")
+	}
+	if options.Limit > 0 {
+		values.Set("limit", strconv.Itoa(options.Limit))
+	}
+	if options.After != "" {
+		values.Set("after", options.After)
+	}
+
+	path := databasePath(name, "tables/"+url.PathEscape(table)+"/rows")
+	if encoded := values.Encode(); encoded != "" {
+		path += "?" + encoded
+	}
+
+	var page RowsPage
+	err := c.doJSON(ctx, request{method: http.MethodGet, path: path, safe: true}, &page)
+	return page, err
+}
+
+// Row is a row of a table read by its key. Version changes whenever one of its values does, it is passed to UpdateRow
+// and DeleteRow to only write the row while it is unchanged.
+type Row struct {
+	Data    json.RawMessage `json:"row"`
+	Columns []Column        `json:"columns"`
+	Version string          `json:"version"`
+}
+
+func rowPath(name string, table string, key string) string {
+	return databasePath(name, "tables/"+url.PathEscape(table)+"/rows/"+url.PathEscape(key))
+}
+
+// ifMatch quotes the version as an entity tag, an empty version matches any state of the row.
+func ifMatch(version string) string {
+	if version == "" || version == "*" {
+		return version
+	}
+	return `"` + version + `"`
+}
+
+// ReadRow reads the row of a table with the given key, the value of its single column primary key or its rowid.
+func (c *Client) ReadRow(ctx context.Context, name string, table string, key string) (Row, error) {
+	var row Row
+	err := c.doJSON(ctx, request{method: http.MethodGet, path: rowPath(name, table, key)}, &row)
+	return row, err
+}
+
+// UpdateRow sets the values of some columns of the row of a table and returns the row as updated. With a version the
+// row is only updated while it still has it, otherwise the update fails with ErrorCodePreconditionFailed.
+func (c *Client) UpdateRow(ctx context.Context, name string, table string, key string, values map[string]any, version string) (Row, error) {
+	body := map[string]any{"values": values}
+
+	var row Row
+	err := c.doJSON(ctx, request{method: http.MethodPatch, path: rowPath(name, table, key), body: body, ifMatch: ifMatch(version)}, &row)
+	return row, err
+}
+
+// DeleteRow deletes the row of a table. With a version the row is only deleted while it still has it, otherwise the
+// deletion fails with ErrorCodePreconditionFailed.
+func (c *Client) DeleteRow(ctx context.Context, name string, table string, key string, version string) error {
+	return c.doJSON(ctx, request{method: http.MethodDelete, path: rowPath(name, table, key), ifMatch: ifMatch(version)}, nil)
+}
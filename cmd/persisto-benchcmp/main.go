@@ -0,0 +1,208 @@
+// persisto-benchcmp compares the output of go test -bench with a baseline taken the same way, and fails when a benchmark
+// regressed past the threshold.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const usage = `Usage: persisto-benchcmp [flags] <baseline> <current>
+
+Compares the benchmarks of two outputs of go test -bench, averaging the runs of every benchmark, e.g. with -count 5.
+A time, size or count per operation regresses when it grows, a throughput (MB/s) when it shrinks.
+
+Flags:
+`
+
+// NOTE: the suffix go test appends to the names of the benchmarks, the GOMAXPROCS they ran with
+var procsSuffix = regexp.MustCompile(`-\d+$`)
+
+// Result is a metric of a benchmark, averaged over its runs.
+type Result struct {
+	Benchmark string
+	Unit      string
+	Baseline  float64
+	Current   float64
+	// NOTE: NaN when the metric is missing from either output or is zero in the baseline
+	Delta     float64
+	Regressed bool
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(arguments []string, output io.Writer) error {
+	var threshold float64
+
+	flagSet := flag.NewFlagSet("persisto-benchcmp", flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprint(flagSet.Output(), usage)
+		flagSet.PrintDefaults()
+	}
+	flagSet.Float64Var(&threshold, "threshold", 10, "percentage past which a change is a regression")
+
+	if err := flagSet.Parse(arguments); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 2 {
+		flagSet.Usage()
+		return flag.ErrHelp
+	}
+
+	baseline, err := parseFile(flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+	current, err := parseFile(flagSet.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	results := compare(baseline, current, threshold)
+	if err := printResults(output, results); err != nil {
+		return err
+	}
+
+	regressions := 0
+	for _, result := range results {
+		if result.Regressed {
+			regressions++
+		}
+	}
+	if regressions > 0 {
+		return fmt.Errorf("%d metrics regressed by more than %g%%", regressions, threshold)
+	}
+	return nil
+}
+
+// parseFile returns the average of every metric of every benchmark of the output, by benchmark and unit.
+func parseFile(path string) (map[string]map[string]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sums, counts := map[string]map[string]float64{}, map[string]map[string]int{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// NOTE: the name, the iterations and pairs of a value and its unit
+		if len(fields) < 4 || len(fields)%2 != 0 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+
+		name := procsSuffix.ReplaceAllString(fields[0], "")
+		if sums[name] == nil {
+			sums[name], counts[name] = map[string]float64{}, map[string]int{}
+		}
+		for i := 2; i < len(fields); i += 2 {
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid value %q of %s", path, fields[i], name)
+			}
+			sums[name][fields[i+1]] += value
+			counts[name][fields[i+1]]++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(sums) == 0 {
+		return nil, fmt.Errorf("%s: no benchmark found", path)
+	}
+
+	for name, units := range sums {
+		for unit := range units {
+			units[unit] /= float64(counts[name][unit])
+		}
+	}
+	return sums, nil
+}
+
+// compare returns the metrics of both outputs sorted by benchmark and unit.
+func compare(baseline, current map[string]map[string]float64, threshold float64) []Result {
+	keys := map[[2]string]bool{}
+	for _, metrics := range []map[string]map[string]float64{baseline, current} {
+		for name, units := range metrics {
+			for unit := range units {
+				keys[[2]string{name, unit}] = true
+			}
+		}
+	}
+
+	results := make([]Result, 0, len(keys))
+	for key := range keys {
+		result := Result{Benchmark: key[0], Unit: key[1], Baseline: math.NaN(), Current: math.NaN(), Delta: math.NaN()}
+		baselineValue, inBaseline := baseline[key[0]][key[1]]
+		currentValue, inCurrent := current[key[0]][key[1]]
+		if inBaseline {
+			result.Baseline = baselineValue
+		}
+		if inCurrent {
+			result.Current = currentValue
+		}
+		if inBaseline && inCurrent && baselineValue != 0 {
+			result.Delta = (currentValue - baselineValue) / baselineValue * 100
+			// NOTE: a throughput is better when it grows, every other metric when it shrinks
+			if strings.HasSuffix(key[1], "/s") {
+				result.Regressed = result.Delta < -threshold
+			} else {
+				result.Regressed = result.Delta > threshold
+			}
+		}
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Benchmark != results[j].Benchmark {
+			return results[i].Benchmark < results[j].Benchmark
+		}
+		return results[i].Unit < results[j].Unit
+	})
+	return results
+}
+
+func printResults(output io.Writer, results []Result) error {
+	writer := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "BENCHMARK\tUNIT\tBASELINE\tCURRENT\tDELTA\t")
+	for _, result := range results {
+		delta := "-"
+		if !math.IsNaN(result.Delta) {
+			delta = fmt.Sprintf("%+.1f%%", result.Delta)
+		}
+		if result.Regressed {
+			delta += " REGRESSED"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t\n", result.Benchmark, result.Unit, formatValue(result.Baseline), formatValue(result.Current), delta)
+	}
+	return writer.Flush()
+}
+
+func formatValue(value float64) string {
+	if math.IsNaN(value) {
+		return "-"
+	}
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
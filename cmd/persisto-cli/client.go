@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"persisto/client"
+)
+
+// Client runs the commands through the HTTP API of a persisto server.
+type Client struct {
+	api *client.Client
+}
+
+func newClient(server, adminToken string) *Client {
+	return &Client{api: client.New(server, client.Options{AdminToken: adminToken})}
+}
+
+func databaseInfo(database client.Database) DatabaseInfo {
+	return DatabaseInfo{
+		Name:           database.Name,
+		Stage:          database.Stage,
+		LastAccessedAt: database.LastAccessedAt,
+		RequestCount:   database.RequestCount,
+		Degraded:       database.Degraded,
+	}
+}
+
+func (c *Client) List() ([]DatabaseInfo, error) {
+	databases, err := c.api.ListDatabases(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]DatabaseInfo, 0, len(databases))
+	for _, database := range databases {
+		infos = append(infos, databaseInfo(database))
+	}
+	return infos, nil
+}
+
+func (c *Client) Status(name string) (DatabaseInfo, error) {
+	database, err := c.api.GetDatabase(context.Background(), name)
+	return databaseInfo(database), err
+}
+
+func (c *Client) Create(name string) (DatabaseInfo, error) {
+	database, err := c.api.CreateDatabase(context.Background(), name)
+	return databaseInfo(database), err
+}
+
+func (c *Client) Run(name string, queries []string, write bool) ([]QueryResult, error) {
+	if write {
+		executeResults, err := c.api.Execute(context.Background(), name, queries...)
+		if err != nil {
+			return nil, err
+		}
+		results := make([]QueryResult, 0, len(executeResults))
+		for _, result := range executeResults {
+			results = append(results, QueryResult{Success: result.Success, Data: result.Data, Error: result.Error, Code: string(result.Code)})
+		}
+		return results, nil
+	}
+
+	// NOTE: typed for the columns, so that the rows print in the order the queries select them
+	queryResults, err := c.api.QueryTyped(context.Background(), name, queries...)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]QueryResult, 0, len(queryResults))
+	for _, result := range queryResults {
+		converted := QueryResult{Success: result.Success, Columns: columnNames(result.Columns), Error: result.Error, Code: string(result.Code)}
+		if len(result.Data) > 0 {
+			if err := json.Unmarshal(result.Data, &converted.Data); err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, converted)
+	}
+	return results, nil
+}
+
+func (c *Client) Sync(name string) (DatabaseInfo, error) {
+	stage, err := c.api.Sync(context.Background(), name)
+	return DatabaseInfo{Name: name, Stage: stage}, err
+}
+
+func (c *Client) Move(name string, stage uint) (DatabaseInfo, error) {
+	if err := c.api.Move(context.Background(), name, stage); err != nil {
+		return DatabaseInfo{}, err
+	}
+	return DatabaseInfo{Name: name, Stage: stage}, nil
+}
+
+func (c *Client) Backup(name string, path string) (int64, error) {
+	reader, writer := io.Pipe()
+
+	go func() {
+		_, err := c.api.Backup(context.Background(), name, writer)
+		writer.CloseWithError(err)
+	}()
+
+	written, err := writeFile(path, reader)
+	reader.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to back up %s: %w", name, err)
+	}
+	return written, nil
+}
+
+func (c *Client) Manifest() (client.Manifest, error) {
+	return c.api.Manifest(context.Background(), true)
+}
+
+// NOTE: writes to a temporary file first so an interrupted backup never leaves a truncated copy behind
+func writeFile(path string, content io.Reader) (int64, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), ".persisto-backup-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+
+	written, err := io.Copy(file, content)
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+
+	return written, os.Rename(file.Name(), path)
+}
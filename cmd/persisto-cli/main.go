@@ -0,0 +1,253 @@
+// persisto-cli administers a persisto server through its HTTP API, or a bucket directly when offline.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"persisto/client"
+)
+
+const usage = `Usage: persisto-cli [flags] <command> [arguments]
+
+Commands:
+  list                          List the databases.
+  status <database>             Show the stage and activity of a database.
+  create <database>             Create a database.
+  query <database> <sql>...     Run read queries.
+  execute <database> <sql>...   Run write queries.
+  sync <database>               Sync a database to the remote stage.
+  move <database> <stage>       Move a database to another stage.
+  backup <database> <file>      Download a copy of a database.
+  manifest [file]               Print or save the signed manifest of every database.
+
+Offline mode (--offline) reads the bucket directly using the server configuration, it supports list, status, query
+and backup.
+
+Flags:
+`
+
+// Options are the settings shared by every command.
+type Options struct {
+	Server     string
+	AdminToken string
+	Output     string
+	Offline    bool
+	EnvFile    string
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(arguments []string) error {
+	var options Options
+	var profileName string
+
+	flagSet := flag.NewFlagSet("persisto-cli", flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprint(flagSet.Output(), usage)
+		flagSet.PrintDefaults()
+	}
+	flagSet.StringVar(&profileName, "profile", os.Getenv("PERSISTO_PROFILE"), "profile of the CLI configuration file to use")
+	flagSet.StringVar(&options.Server, "server", "", "URL of the persisto server")
+	flagSet.StringVar(&options.AdminToken, "admin-token", "", "admin token of the server")
+	flagSet.StringVar(&options.Output, "output", "", "output format (table, json)")
+	flagSet.BoolVar(&options.Offline, "offline", false, "operate on the bucket directly instead of through a server")
+	flagSet.StringVar(&options.EnvFile, "env-file", "", "env file of the server configuration, used in offline mode")
+
+	if err := flagSet.Parse(arguments); err != nil {
+		return err
+	}
+
+	if err := applyProfile(&options, profileName); err != nil {
+		return err
+	}
+
+	if flagSet.NArg() == 0 {
+		flagSet.Usage()
+		return flag.ErrHelp
+	}
+
+	var backend Backend
+	if options.Offline {
+		offline, err := newOfflineBackend(options.EnvFile)
+		if err != nil {
+			return err
+		}
+		backend = offline
+	} else {
+		backend = newClient(options.Server, options.AdminToken)
+	}
+
+	output := newOutput(options.Output)
+	command, commandArguments := flagSet.Arg(0), flagSet.Args()[1:]
+
+	switch command {
+	case "list":
+		databases, err := backend.List()
+		if err != nil {
+			return err
+		}
+		return output.databases(databases)
+
+	case "status":
+		if err := expectArguments(commandArguments, 1, "status <database>"); err != nil {
+			return err
+		}
+		database, err := backend.Status(commandArguments[0])
+		if err != nil {
+			return err
+		}
+		return output.databases([]DatabaseInfo{database})
+
+	case "create":
+		if err := expectArguments(commandArguments, 1, "create <database>"); err != nil {
+			return err
+		}
+		database, err := backend.Create(commandArguments[0])
+		if err != nil {
+			return err
+		}
+		return output.databases([]DatabaseInfo{database})
+
+	case "query", "execute":
+		if len(commandArguments) < 2 {
+			return fmt.Errorf("usage: %s <database> <sql>...", command)
+		}
+		results, err := backend.Run(commandArguments[0], commandArguments[1:], command == "execute")
+		if err != nil {
+			return err
+		}
+		return output.results(results)
+
+	case "sync":
+		if err := expectArguments(commandArguments, 1, "sync <database>"); err != nil {
+			return err
+		}
+		database, err := backend.Sync(commandArguments[0])
+		if err != nil {
+			return err
+		}
+		return output.databases([]DatabaseInfo{database})
+
+	case "move":
+		if err := expectArguments(commandArguments, 2, "move <database> <stage>"); err != nil {
+			return err
+		}
+		stage, err := strconv.ParseUint(commandArguments[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid stage %q", commandArguments[1])
+		}
+		database, err := backend.Move(commandArguments[0], uint(stage))
+		if err != nil {
+			return err
+		}
+		return output.databases([]DatabaseInfo{database})
+
+	case "backup":
+		if err := expectArguments(commandArguments, 2, "backup <database> <file>"); err != nil {
+			return err
+		}
+		written, err := backend.Backup(commandArguments[0], commandArguments[1])
+		if err != nil {
+			return err
+		}
+		return output.message(fmt.Sprintf("Saved %s to %s (%d bytes).", commandArguments[0], commandArguments[1], written), map[string]any{
+			"database": commandArguments[0],
+			"file":     commandArguments[1],
+			"bytes":    written,
+		})
+
+	case "manifest":
+		if len(commandArguments) > 1 {
+			return fmt.Errorf("usage: manifest [file]")
+		}
+		manifest, err := backend.Manifest()
+		if err != nil {
+			return err
+		}
+		if len(commandArguments) == 0 {
+			return output.manifest(manifest)
+		}
+		if _, err := writeFile(commandArguments[0], bytes.NewReader(manifest.Raw)); err != nil {
+			return fmt.Errorf("failed to save the manifest: %w", err)
+		}
+		return output.message(fmt.Sprintf("Saved the manifest of %d databases to %s (signature %s).", len(manifest.Databases), commandArguments[0], signatureOrNone(manifest.Signature)), map[string]any{
+			"file":      commandArguments[0],
+			"databases": len(manifest.Databases),
+			"signature": manifest.Signature,
+		})
+
+	default:
+		return fmt.Errorf("unknown command %q, see persisto-cli -h", command)
+	}
+}
+
+func expectArguments(arguments []string, count int, usage string) error {
+	if len(arguments) != count {
+		return fmt.Errorf("usage: %s", usage)
+	}
+	return nil
+}
+
+// NOTE: commands only differ by where they run, through the API or against the bucket
+type Backend interface {
+	List() ([]DatabaseInfo, error)
+	Status(name string) (DatabaseInfo, error)
+	Create(name string) (DatabaseInfo, error)
+	Run(name string, queries []string, write bool) ([]QueryResult, error)
+	Sync(name string) (DatabaseInfo, error)
+	Move(name string, stage uint) (DatabaseInfo, error)
+	Backup(name string, path string) (int64, error)
+	Manifest() (client.Manifest, error)
+}
+
+type DatabaseInfo struct {
+	Name           string `json:"name"`
+	Stage          uint   `json:"stage"`
+	LastAccessedAt string `json:"last_accessed_at,omitempty"`
+	RequestCount   uint   `json:"request_count"`
+	Degraded       bool   `json:"degraded"`
+	SizeBytes      int64  `json:"size_bytes,omitempty"`
+}
+
+type QueryResult struct {
+	Success bool     `json:"success"`
+	Data    any      `json:"data,omitempty"`
+	Columns []string `json:"columns,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Code    string   `json:"code,omitempty"`
+}
+
+func columnNames(columns []client.Column) []string {
+	names := make([]string, len(columns))
+	for index, column := range columns {
+		names[index] = column.Name
+	}
+	return names
+}
+
+func signatureOrNone(signature string) string {
+	if signature == "" {
+		return "none"
+	}
+	return signature
+}
+
+var errOfflineUnsupported = errors.New("not supported in offline mode, it requires a running server")
+
+func normalizeServer(server string) string {
+	return strings.TrimSuffix(server, "/")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"persisto/client"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"go.uber.org/zap/zapcore"
+)
+
+// Offline runs the commands against the remote bucket directly, using the configuration of the server. It only
+// supports reads, writing behind the back of a running server would corrupt its state.
+type Offline struct{}
+
+func newOfflineBackend(envFile string) (*Offline, error) {
+	if _, err := utils.SetupConfiguration("--config", envFile); err != nil {
+		return nil, fmt.Errorf("failed to load the configuration: %w", err)
+	}
+
+	// NOTE: logs of the server packages would mix with the output of the commands
+	utils.LOG_FILE_PATH = os.DevNull
+	if _, err := utils.SetupLogger(zapcore.ErrorLevel); err != nil {
+		return nil, err
+	}
+
+	remotevfs.RegisterRemoteVfs()
+
+	return &Offline{}, nil
+}
+
+func remoteKey(name string) string {
+	if strings.HasSuffix(name, ".db") {
+		return name
+	}
+	return name + ".db"
+}
+
+func (o *Offline) List() ([]DatabaseInfo, error) {
+	files, err := remotevfs.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	databases := []DatabaseInfo{}
+	for _, file := range files {
+		name, isDatabase := remotevfs.DatabaseNameFromKey(file.Key)
+		if !isDatabase || strings.Contains(file.Key, "/") {
+			continue
+		}
+
+		database := DatabaseInfo{
+			Name:      name,
+			Stage:     utils.Config.Storage.Remote.StageNumber,
+			SizeBytes: file.Size,
+		}
+		if file.LastModified != nil {
+			database.LastAccessedAt = file.LastModified.Format("2006-01-02T15:04:05Z07:00")
+		}
+		databases = append(databases, database)
+	}
+	return databases, nil
+}
+
+func (o *Offline) Status(name string) (DatabaseInfo, error) {
+	databases, err := o.List()
+	if err != nil {
+		return DatabaseInfo{}, err
+	}
+	for _, database := range databases {
+		if database.Name == name {
+			return database, nil
+		}
+	}
+	return DatabaseInfo{}, fmt.Errorf("database %q not found in the bucket", name)
+}
+
+func (o *Offline) Create(name string) (DatabaseInfo, error) {
+	return DatabaseInfo{}, fmt.Errorf("create is %w", errOfflineUnsupported)
+}
+
+func (o *Offline) Run(name string, queries []string, write bool) ([]QueryResult, error) {
+	if write {
+		return nil, fmt.Errorf("execute is %w", errOfflineUnsupported)
+	}
+
+	if _, err := o.Status(name); err != nil {
+		return nil, err
+	}
+
+	connection, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?vfs=r2&mode=ro", remoteKey(name)))
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	results := make([]QueryResult, 0, len(queries))
+	for _, query := range queries {
+		if utils.IsWriteOperation(query) {
+			results = append(results, QueryResult{Error: "Write queries are not supported in offline mode.", Code: string(utils.ErrorCodeInvalidInput)})
+			continue
+		}
+
+		rows, err := connection.Query(query)
+		if err != nil {
+			results = append(results, QueryResult{Error: err.Error(), Code: string(utils.ErrorCodeOf(err))})
+			continue
+		}
+
+		data, columns, err := utils.QueryResultToMaps(rows)
+		if err != nil {
+			results = append(results, QueryResult{Error: err.Error(), Code: string(utils.ErrorCodeOf(err))})
+			continue
+		}
+
+		// NOTE: round trip through json so rows print the same way as the ones returned by a server
+		content, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		result := QueryResult{Success: true, Columns: make([]string, len(columns))}
+		for index, column := range columns {
+			result.Columns[index] = column.Name
+		}
+		if err := json.Unmarshal(content, &result.Data); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (o *Offline) Sync(name string) (DatabaseInfo, error) {
+	return DatabaseInfo{}, fmt.Errorf("sync is %w", errOfflineUnsupported)
+}
+
+func (o *Offline) Move(name string, stage uint) (DatabaseInfo, error) {
+	return DatabaseInfo{}, fmt.Errorf("move is %w", errOfflineUnsupported)
+}
+
+func (o *Offline) Backup(name string, path string) (int64, error) {
+	reader, writer := io.Pipe()
+
+	go func() {
+		_, err := remotevfs.DownloadObject(context.Background(), remoteKey(name), writer)
+		writer.CloseWithError(err)
+	}()
+
+	written, err := writeFile(path, reader)
+	reader.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to back up %s: %w", name, err)
+	}
+	return written, nil
+}
+
+func (o *Offline) Manifest() (client.Manifest, error) {
+	return client.Manifest{}, fmt.Errorf("manifest is %w", errOfflineUnsupported)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"persisto/client"
+)
+
+// Output prints the results of the commands either as aligned tables or as JSON.
+type Output struct {
+	json bool
+}
+
+func newOutput(format string) Output {
+	return Output{json: format == "json"}
+}
+
+func (o Output) printJSON(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func (o Output) databases(databases []DatabaseInfo) error {
+	if o.json {
+		return o.printJSON(databases)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tSTAGE\tLAST ACCESSED\tREQUESTS\tDEGRADED")
+	for _, database := range databases {
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%d\t%t\n", database.Name, database.Stage, database.LastAccessedAt, database.RequestCount, database.Degraded)
+	}
+	return writer.Flush()
+}
+
+func (o Output) manifest(manifest client.Manifest) error {
+	if o.json {
+		// NOTE: printed as received, so that the output still matches its signature
+		_, err := os.Stdout.Write(manifest.Raw)
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tSTAGE\tSIZE\tCHECKSUM\tSYNCED AT\tSYNC PENDING")
+	for _, database := range manifest.Databases {
+		syncedAt := ""
+		if database.SyncedAt != nil {
+			syncedAt = database.SyncedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%s\t%s\t%t\n", database.Name, database.Stage, database.SizeBytes, database.Checksum, syncedAt, database.SyncPending)
+	}
+	fmt.Fprintf(writer, "\nSignature: %s\n", signatureOrNone(manifest.Signature))
+	return writer.Flush()
+}
+
+func (o Output) results(results []QueryResult) error {
+	if o.json {
+		return o.printJSON(results)
+	}
+
+	for index, result := range results {
+		if index > 0 {
+			fmt.Println()
+		}
+		if !result.Success {
+			fmt.Printf("Error: %s", result.Error)
+			if result.Code != "" {
+				fmt.Printf(" (%s)", result.Code)
+			}
+			fmt.Println()
+			continue
+		}
+
+		rows, isRows := asRows(result.Data)
+		if !isRows {
+			content, _ := json.Marshal(result.Data)
+			fmt.Println(string(content))
+			continue
+		}
+		if err := printRows(rows, result.Columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func asRows(data any) ([]map[string]any, bool) {
+	items, isList := data.([]any)
+	if !isList {
+		return nil, false
+	}
+
+	rows := make([]map[string]any, 0, len(items))
+	for _, item := range items {
+		row, isRow := item.(map[string]any)
+		if !isRow {
+			return nil, false
+		}
+		rows = append(rows, row)
+	}
+	return rows, true
+}
+
+// printRows prints the rows with the columns in the order given, sorted when the result came without them, e.g. the
+// rows returned by the writes.
+func printRows(rows []map[string]any, columns []string) error {
+	if len(rows) == 0 {
+		fmt.Println("(no rows)")
+		return nil
+	}
+
+	if len(columns) == 0 {
+		for column := range rows[0] {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, strings.ToUpper(strings.Join(columns, "\t")))
+	for _, row := range rows {
+		values := make([]string, len(columns))
+		for index, column := range columns {
+			if row[column] == nil {
+				values[index] = "NULL"
+			} else {
+				values[index] = fmt.Sprint(row[column])
+			}
+		}
+		fmt.Fprintln(writer, strings.Join(values, "\t"))
+	}
+	return writer.Flush()
+}
+
+func (o Output) message(text string, value any) error {
+	if o.json {
+		return o.printJSON(value)
+	}
+	fmt.Println(text)
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Profile holds the defaults of a CLI profile, flags and environment variables take precedence over it.
+type Profile struct {
+	Server     string `json:"server"`
+	AdminToken string `json:"admin_token"`
+	Output     string `json:"output"`
+	Offline    bool   `json:"offline"`
+	EnvFile    string `json:"env_file"`
+}
+
+func profilesPath() (string, error) {
+	if path := os.Getenv("PERSISTO_CLI_CONFIG"); path != "" {
+		return path, nil
+	}
+	directory, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(directory, "persisto", "cli.json"), nil
+}
+
+func loadProfiles() (map[string]Profile, error) {
+	path, err := profilesPath()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]Profile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Profiles map[string]Profile `json:"profiles"`
+	}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("invalid CLI configuration %s: %w", path, err)
+	}
+	return file.Profiles, nil
+}
+
+// applyProfile fills the options left unset by the flags from the environment, then the profile, then the defaults.
+func applyProfile(options *Options, name string) error {
+	profiles, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		name = "default"
+	}
+	profile, exists := profiles[name]
+	if !exists && name != "default" {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+
+	fill := func(value *string, variable, fallback, defaultValue string) {
+		if *value != "" {
+			return
+		}
+		*value = os.Getenv(variable)
+		if *value == "" {
+			*value = fallback
+		}
+		if *value == "" {
+			*value = defaultValue
+		}
+	}
+
+	fill(&options.Server, "PERSISTO_SERVER", profile.Server, "http://localhost:8080")
+	fill(&options.AdminToken, "PERSISTO_ADMIN_TOKEN", profile.AdminToken, "")
+	fill(&options.Output, "PERSISTO_OUTPUT", profile.Output, "table")
+	fill(&options.EnvFile, "PERSISTO_ENV_FILE", profile.EnvFile, ".env")
+	options.Offline = options.Offline || profile.Offline
+	options.Server = normalizeServer(options.Server)
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package benchmarks
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"persisto/src/harness"
+)
+
+const (
+	localStage  = 2
+	remoteStage = 3
+
+	mebibyte = 1 << 20
+	// NOTE: the databases are filled with rows of that many random bytes
+	rowBytes = 4096
+)
+
+// NOTE: the stages only move when a benchmark moves them, and the writes are only synced when it syncs them
+var settings = map[string]string{
+	"SETTINGS_AUTO_STAGE_MOVEMENT": "false",
+	"SETTINGS_AUTO_SYNC_ENABLED":   "false",
+}
+
+func TestMain(m *testing.M) {
+	harness.Main(m)
+}
+
+func BenchmarkQuery(b *testing.B) {
+	instance := harness.Start(b, settings)
+	for _, stage := range []uint{localStage, remoteStage} {
+		name := fmt.Sprintf("stage%d", stage)
+		create(b, instance, name, mebibyte, stage)
+
+		b.Run(fmt.Sprintf("stage=%d/point", stage), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				query(b, instance, name, fmt.Sprintf("SELECT id, length(body) FROM blobs WHERE id = %d", i%(mebibyte/rowBytes)+1))
+			}
+		})
+		b.Run(fmt.Sprintf("stage=%d/scan", stage), func(b *testing.B) {
+			b.SetBytes(mebibyte)
+			for i := 0; i < b.N; i++ {
+				query(b, instance, name, "SELECT sum(length(body)) FROM blobs")
+			}
+		})
+	}
+}
+
+func BenchmarkPromotion(b *testing.B) {
+	instance := harness.Start(b, settings)
+	for _, size := range []int{1, 8, 32} {
+		name := fmt.Sprintf("promoted%d", size)
+		create(b, instance, name, size*mebibyte, remoteStage)
+
+		b.Run(fmt.Sprintf("size=%dMiB", size), func(b *testing.B) {
+			b.SetBytes(int64(size * mebibyte))
+			for i := 0; i < b.N; i++ {
+				move(b, instance, name, localStage)
+
+				b.StopTimer()
+				move(b, instance, name, remoteStage)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func BenchmarkDemotion(b *testing.B) {
+	instance := harness.Start(b, settings)
+	for _, size := range []int{1, 8, 32} {
+		name := fmt.Sprintf("demoted%d", size)
+		create(b, instance, name, size*mebibyte, remoteStage)
+
+		b.Run(fmt.Sprintf("size=%dMiB", size), func(b *testing.B) {
+			b.SetBytes(int64(size * mebibyte))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				move(b, instance, name, localStage)
+				b.StartTimer()
+
+				move(b, instance, name, remoteStage)
+			}
+		})
+	}
+}
+
+// BenchmarkSectorCache scans a database served from the remote stage, the reads and bytes of the remote stage per scan
+// report what the sector caches saved.
+func BenchmarkSectorCache(b *testing.B) {
+	caches := []struct {
+		name     string
+		settings map[string]string
+	}{
+		// NOTE: a single sector, the sectors evicted during a scan are read again
+		{"memory=64KiB", map[string]string{"STORAGE_REMOTE_CACHE_MAX_BYTES": "65536"}},
+		{"memory=100MiB", map[string]string{"STORAGE_REMOTE_CACHE_MAX_BYTES": "104857600"}},
+		{"disk", map[string]string{"STORAGE_REMOTE_CACHE_MAX_BYTES": "65536", "STORAGE_REMOTE_DISK_CACHE_ENABLED": "true"}},
+	}
+	for _, cache := range caches {
+		b.Run(cache.name, func(b *testing.B) {
+			environment := map[string]string{}
+			for _, overridden := range []map[string]string{settings, cache.settings} {
+				for name, value := range overridden {
+					environment[name] = value
+				}
+			}
+			instance := harness.Start(b, environment)
+			create(b, instance, "cached", 8*mebibyte, remoteStage)
+			// NOTE: the first scan fills the caches
+			query(b, instance, "cached", "SELECT sum(length(body)) FROM blobs")
+
+			before := instance.Remote.Stats()
+			b.SetBytes(8 * mebibyte)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				query(b, instance, "cached", "SELECT sum(length(body)) FROM blobs")
+			}
+			b.StopTimer()
+
+			after := instance.Remote.Stats()
+			b.ReportMetric(float64(after.Reads-before.Reads)/float64(b.N), "remote-reads/op")
+			b.ReportMetric(float64(after.BytesRead-before.BytesRead)/float64(b.N), "remote-B/op")
+		})
+	}
+}
+
+// BenchmarkSync syncs a database served from the local stage after a write of a single row.
+func BenchmarkSync(b *testing.B) {
+	instance := harness.Start(b, settings)
+	for _, size := range []int{1, 8, 32} {
+		name := fmt.Sprintf("synced%d", size)
+		create(b, instance, name, size*mebibyte, localStage)
+
+		b.Run(fmt.Sprintf("size=%dMiB", size), func(b *testing.B) {
+			before := instance.Remote.Stats()
+			b.SetBytes(int64(size * mebibyte))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				execute(b, instance, name, "UPDATE blobs SET body = randomblob(4096) WHERE id = 1")
+				b.StartTimer()
+
+				if _, err := instance.Client.Sync(context.Background(), name); err != nil {
+					b.Fatalf("failed to sync database %s: %v", name, err)
+				}
+			}
+			b.StopTimer()
+
+			after := instance.Remote.Stats()
+			b.ReportMetric(float64(after.BytesWritten-before.BytesWritten)/float64(b.N), "remote-written-B/op")
+		})
+	}
+}
+
+// create creates a database holding size bytes of rows at the stage. It is filled at the local stage, where the writes
+// aren't uploaded one transaction at a time.
+func create(b *testing.B, instance *harness.Instance, name string, size int, stage uint) {
+	b.Helper()
+	if _, err := instance.Client.CreateDatabase(context.Background(), name); err != nil {
+		b.Fatalf("failed to create database %s: %v", name, err)
+	}
+	move(b, instance, name, localStage)
+	execute(b, instance, name,
+		"CREATE TABLE blobs (id INTEGER PRIMARY KEY, body BLOB)",
+		fmt.Sprintf("WITH RECURSIVE rows(id) AS (SELECT 1 UNION ALL SELECT id + 1 FROM rows WHERE id < %d) INSERT INTO blobs SELECT id, randomblob(%d) FROM rows", size/rowBytes, rowBytes),
+	)
+	if _, err := instance.Client.Sync(context.Background(), name); err != nil {
+		b.Fatalf("failed to sync database %s: %v", name, err)
+	}
+	if stage != localStage {
+		move(b, instance, name, stage)
+	}
+}
+
+func move(b *testing.B, instance *harness.Instance, name string, stage uint) {
+	b.Helper()
+	if err := instance.Client.Move(context.Background(), name, stage); err != nil {
+		b.Fatalf("failed to move database %s to stage %d: %v", name, stage, err)
+	}
+}
+
+func execute(b *testing.B, instance *harness.Instance, name string, queries ...string) {
+	b.Helper()
+	results, err := instance.Client.Execute(context.Background(), name, queries...)
+	if err != nil {
+		b.Fatalf("failed to write database %s: %v", name, err)
+	}
+	for _, result := range results {
+		if err := result.Err(); err != nil {
+			b.Fatalf("failed to write database %s: %v", name, err)
+		}
+	}
+}
+
+func query(b *testing.B, instance *harness.Instance, name string, statement string) {
+	b.Helper()
+	results, err := instance.Client.Query(context.Background(), name, statement)
+	if err != nil {
+		b.Fatalf("failed to read database %s: %v", name, err)
+	}
+	if err := results[0].Err(); err != nil {
+		b.Fatalf("failed to read database %s: %v", name, err)
+	}
+}
@@ -0,0 +1,10 @@
+// Package benchmarks measures the stages end to end against the fake remote stage of the harness: the latency of the
+// queries at each stage, the duration of the promotions and demotions by database size, the reads of the remote stage
+// the sector caches save and the throughput of the syncs.
+//
+//	go test -run '^$' -bench . -count 5 ./src/harness/benchmarks/ > current.txt
+//	go run ./cmd/persisto-benchcmp baseline.txt current.txt
+//
+// The fake remote answers from a local directory, the figures measure the server rather than a bucket: they are
+// compared with a baseline taken on the same machine, see make bench-compare.
+package benchmarks
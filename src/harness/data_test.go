@@ -0,0 +1,34 @@
+package harness_test
+
+import (
+	"net/http"
+	"testing"
+
+	"persisto/src/harness"
+)
+
+func TestCompareRequiresPrincipal(t *testing.T) {
+	instance := harness.Start(t, map[string]string{"POLICIES_ENABLED": "true", "POLICIES_PRINCIPALS": "reader:reader-token", "POLICIES_REQUIRE_PRINCIPAL": "true"})
+	principal := http.Header{"X-Persisto-Principal-Token": {"reader-token"}}
+	create(t, instance, "production")
+	create(t, instance, "staging")
+	// NOTE: every request needs a principal, the principal isn't restricted by any policy of the databases
+	for name, queries := range map[string][]string{
+		"production": {"CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT)", "INSERT INTO notes VALUES (1, 'production-marker')"},
+		"staging":    {"CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT)"},
+	} {
+		if status, body := instance.Request(http.MethodPost, "/databases/"+name+"/execute", principal, map[string]any{"queries": queries}); status != http.StatusOK {
+			t.Fatalf("failed to write database %s, answered %d: %s", name, status, body)
+		}
+	}
+
+	comparison := map[string]any{"source": "production", "apply": true}
+	if status, body := instance.Request(http.MethodPost, "/databases/staging/data/compare", nil, comparison); status != http.StatusUnauthorized {
+		t.Fatalf("the comparison without principal answered %d, want %d: %s", status, http.StatusUnauthorized, body)
+	}
+	// NOTE: the policies can't restrict the rows read from the whole source
+	if status, body := instance.Request(http.MethodPost, "/databases/staging/data/compare", principal, comparison); status != http.StatusForbidden {
+		t.Fatalf("the comparison of a principal answered %d, want %d: %s", status, http.StatusForbidden, body)
+	}
+	expectPrincipalRows(t, instance, "staging", "reader-token", "SELECT count(*) AS count FROM notes", `[{"count":0}]`)
+}
@@ -0,0 +1,373 @@
+// Package harness runs the server against a fake remote stage for the end-to-end tests of the stages. The server runs
+// in a child process, the test binary started again, so that a test crashes and restarts it like a deployment would,
+// while the fake remote and the directories of the server are kept by the test process across restarts.
+//
+//	func TestMain(m *testing.M) {
+//		harness.Main(m)
+//	}
+//
+//	func TestDemotion(t *testing.T) {
+//		instance := harness.Start(t, nil)
+//		...
+//		instance.AdvanceClock(time.Hour)
+//		instance.RunMonitor()
+//	}
+package harness
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"persisto/client"
+	"persisto/src/internal/stages"
+	"persisto/src/server"
+	"persisto/src/utils"
+)
+
+const (
+	// NOTE: set in the environment of the child process, the test binary then serves instead of running the tests
+	serveEnvironment = "PERSISTO_HARNESS_SERVE"
+
+	Bucket     = "harness"
+	AdminToken = "harness-admin-token"
+
+	startTimeout = 30 * time.Second
+	idleTimeout  = 30 * time.Second
+)
+
+// Main runs the tests of the package, or serves when the test binary is the child process of an Instance. It is called
+// from the TestMain of the packages using the harness.
+func Main(m *testing.M) {
+	if os.Getenv(serveEnvironment) != "" {
+		if err := serve(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Instance is a server running in a child process against a fake remote stage.
+type Instance struct {
+	tb testing.TB
+
+	// Remote is the remote stage of the server, it outlives the restarts.
+	Remote *FakeRemote
+	// Client talks to the server, with the admin token.
+	Client *client.Client
+	// Directory holds the local stage, the catalog and the logs of the server, it outlives the restarts.
+	Directory string
+
+	url         string
+	environment []string
+	process     *exec.Cmd
+	exited      chan struct{}
+}
+
+// Start starts a server against a new fake remote stage, with an ephemeral configuration overridden by environment. It is
+// crashed at the end of the test.
+//
+// The stage monitor only runs when RunMonitor is called, its clock only moves with AdvanceClock.
+func Start(tb testing.TB, environment map[string]string) *Instance {
+	tb.Helper()
+
+	directory := tb.TempDir()
+	remote, err := NewFakeRemote(filepath.Join(directory, "remote"))
+	if err != nil {
+		tb.Fatalf("failed to start the fake remote: %v", err)
+	}
+	tb.Cleanup(remote.Close)
+
+	port, err := freePort()
+	if err != nil {
+		tb.Fatalf("failed to pick a port: %v", err)
+	}
+
+	instance := &Instance{
+		tb:        tb,
+		Remote:    remote,
+		Directory: filepath.Join(directory, "server"),
+		url:       fmt.Sprintf("http://127.0.0.1:%d", port),
+	}
+	if err := os.MkdirAll(instance.Directory, 0o755); err != nil {
+		tb.Fatalf("failed to create the server directory: %v", err)
+	}
+
+	settings := map[string]string{
+		"SERVER_PORT":                       strconv.Itoa(port),
+		"SERVER_ADMIN_TOKEN":                AdminToken,
+		"STORAGE_REMOTE_ENDPOINT":           remote.Endpoint(),
+		"STORAGE_REMOTE_BUCKET_NAME":        Bucket,
+		"STORAGE_REMOTE_ACCESS_KEY_ID":      "harness",
+		"STORAGE_REMOTE_SECRET_KEY":         "harness",
+		"STORAGE_REMOTE_CREDENTIALS_SOURCE": "static",
+		"STORAGE_REMOTE_REGION":             "us-east-1",
+		// NOTE: the ticker of the monitor never fires during a test, see RunMonitor
+		"SETTINGS_STAGE_TIMEOUT_SECONDS":       "86400",
+		"SETTINGS_MIN_STAGE_RESIDENCY_SECONDS": "0",
+		"SETTINGS_MOVE_COOLDOWN_SECONDS":       "0",
+		"LOGGING_OUTPUT_FILE_PATH":             "server.log",
+	}
+	for name, value := range environment {
+		settings[name] = value
+	}
+	instance.environment = append(os.Environ(), serveEnvironment+"=1")
+	for name, value := range settings {
+		instance.environment = append(instance.environment, name+"="+value)
+	}
+	instance.Client = client.New(instance.url, client.Options{AdminToken: AdminToken, Retry: &client.RetryPolicy{MaxAttempts: 1}})
+
+	tb.Cleanup(instance.Crash)
+	instance.launch()
+	return instance
+}
+
+// URL returns the base URL of the server.
+func (instance *Instance) URL() string {
+	return instance.url
+}
+
+// Crash kills the server, nothing it holds in memory reaches the stages. It does nothing when it isn't running.
+func (instance *Instance) Crash() {
+	if instance.process == nil {
+		return
+	}
+	instance.process.Process.Kill()
+	<-instance.exited
+	instance.process = nil
+}
+
+// Restart crashes the server when it runs and starts it again on the same directories and fake remote, e.g. to check
+// what a crash left behind is recovered at startup.
+func (instance *Instance) Restart() {
+	instance.tb.Helper()
+	instance.Crash()
+	instance.launch()
+}
+
+// Logs returns the logs written by the server since it was first started.
+func (instance *Instance) Logs() string {
+	logs, _ := os.ReadFile(filepath.Join(instance.Directory, "server.log"))
+	return string(logs)
+}
+
+// AdvanceClock moves the clock of the stage monitor forward, the databases then look inactive for that much longer.
+func (instance *Instance) AdvanceClock(duration time.Duration) {
+	instance.tb.Helper()
+	instance.control("/harness/clock?advance=" + duration.String())
+}
+
+// RunMonitor runs a round of the stage monitor and waits for the demotions it started.
+func (instance *Instance) RunMonitor() {
+	instance.tb.Helper()
+	instance.control("/harness/monitor")
+}
+
+// WaitIdle waits for the stage operations running in the background, e.g. the promotions and syncs the requests
+// started.
+func (instance *Instance) WaitIdle() {
+	instance.tb.Helper()
+	instance.control("/harness/idle")
+}
+
+// Stage returns the stage the database is served from.
+func (instance *Instance) Stage(name string) uint {
+	instance.tb.Helper()
+	database, err := instance.Client.GetDatabase(context.Background(), name)
+	if err != nil {
+		instance.tb.Fatalf("failed to get database %s: %v", name, err)
+	}
+	return database.Stage
+}
+
+// Get sends a GET request to the server with the admin token and decodes the response in result, failing the test
+// unless it succeeds.
+func (instance *Instance) Get(path string, result any) {
+	instance.tb.Helper()
+	instance.expect(http.MethodGet, path, nil, result)
+}
+
+// Post sends a POST request with the body encoded in JSON to the server with the admin token and decodes the response
+// in result, failing the test unless it succeeds.
+func (instance *Instance) Post(path string, body any, result any) {
+	instance.tb.Helper()
+	instance.expect(http.MethodPost, path, body, result)
+}
+
+// Request sends a request with the body encoded in JSON and the headers to the server, without the admin token unless
+// the headers hold it, and returns the status and the body of the response whatever the status.
+func (instance *Instance) Request(method string, path string, header http.Header, body any) (int, []byte) {
+	instance.tb.Helper()
+	var content io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			instance.tb.Fatal(err)
+		}
+		content = bytes.NewReader(encoded)
+	}
+	request, err := http.NewRequest(method, instance.url+path, content)
+	if err != nil {
+		instance.tb.Fatal(err)
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		instance.tb.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer response.Body.Close()
+	answer, _ := io.ReadAll(response.Body)
+	return response.StatusCode, answer
+}
+
+func (instance *Instance) expect(method string, path string, body any, result any) {
+	instance.tb.Helper()
+	status, answer := instance.Request(method, path, http.Header{client.AdminTokenHeader: {AdminToken}}, body)
+	if status < 200 || status > 299 {
+		instance.tb.Fatalf("%s %s answered %d: %s", method, path, status, answer)
+	}
+	if result == nil {
+		return
+	}
+	if err := json.Unmarshal(answer, result); err != nil {
+		instance.tb.Fatalf("failed to decode the answer to %s %s: %v", method, path, err)
+	}
+}
+
+func (instance *Instance) control(path string) {
+	instance.tb.Helper()
+	response, err := http.Post(instance.url+path, "", nil)
+	if err != nil {
+		instance.tb.Fatalf("POST %s failed: %v", path, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(response.Body)
+		instance.tb.Fatalf("POST %s answered %d: %s", path, response.StatusCode, body)
+	}
+}
+
+func (instance *Instance) launch() {
+	instance.tb.Helper()
+
+	executable, err := os.Executable()
+	if err != nil {
+		instance.tb.Fatalf("failed to find the test binary: %v", err)
+	}
+	process := exec.Command(executable)
+	process.Dir = instance.Directory
+	process.Env = instance.environment
+	output, err := os.OpenFile(filepath.Join(instance.Directory, "output.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		instance.tb.Fatal(err)
+	}
+	defer output.Close()
+	process.Stdout, process.Stderr = output, output
+	if err := process.Start(); err != nil {
+		instance.tb.Fatalf("failed to start the server: %v", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		process.Wait()
+		close(exited)
+	}()
+	instance.process, instance.exited = process, exited
+
+	deadline := time.Now().Add(startTimeout)
+	for {
+		response, err := http.Get(instance.url + "/health")
+		if err == nil {
+			response.Body.Close()
+			return
+		}
+		select {
+		case <-exited:
+			instance.process = nil
+			output, _ := os.ReadFile(filepath.Join(instance.Directory, "output.log"))
+			instance.tb.Fatalf("the server exited at startup:\n%s", output)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			instance.tb.Fatalf("the server didn't answer within %s:\n%s", startTimeout, instance.Logs())
+		}
+	}
+}
+
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// serve runs the server in the child process, along with the routes driving the stage monitor.
+func serve() error {
+	if err := server.Setup(); err != nil {
+		return err
+	}
+
+	// NOTE: set before the monitor starts, the clock is never replaced while it reads it
+	var offset atomic.Int64
+	stages.SetMonitorClock(func() time.Time { return time.Now().Add(time.Duration(offset.Load())) })
+	handler := server.Start()
+
+	router := http.NewServeMux()
+	router.Handle("/", handler)
+	router.HandleFunc("POST /harness/clock", func(w http.ResponseWriter, r *http.Request) {
+		advance, err := time.ParseDuration(r.URL.Query().Get("advance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		offset.Add(int64(advance))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	router.HandleFunc("POST /harness/monitor", func(w http.ResponseWriter, r *http.Request) {
+		stages.MonitorOnce()
+		writeIdle(w)
+	})
+	router.HandleFunc("POST /harness/idle", func(w http.ResponseWriter, r *http.Request) {
+		writeIdle(w)
+	})
+
+	err := server.HTTPServer(router, fmt.Sprintf("127.0.0.1:%d", utils.Config.Server.Port)).ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// writeIdle answers once the stage operations running in the background ended.
+func writeIdle(w http.ResponseWriter) {
+	deadline := time.Now().Add(idleTimeout)
+	for stages.BackgroundOperations() > 0 {
+		if time.Now().After(deadline) {
+			http.Error(w, fmt.Sprintf("%d stage operations still running after %s", stages.BackgroundOperations(), idleTimeout), http.StatusGatewayTimeout)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,26 @@
+package harness_test
+
+import (
+	"context"
+	"testing"
+
+	"persisto/client"
+	"persisto/src/harness"
+)
+
+func TestArraysKeepColumnsSharingAName(t *testing.T) {
+	instance := harness.Start(t, nil)
+	create(t, instance, "notes")
+	execute(t, instance, "notes",
+		"CREATE TABLE a (id INTEGER PRIMARY KEY)", "CREATE TABLE b (id INTEGER PRIMARY KEY, a_id INTEGER)",
+		"INSERT INTO a VALUES (1)", "INSERT INTO b VALUES (10, 1)",
+	)
+
+	results, err := instance.Client.QueryArrays(context.Background(), "notes", client.Statement{Query: "SELECT a.id, b.id FROM a JOIN b ON b.a_id = a.id"})
+	if err != nil || len(results) != 1 || !results[0].Success {
+		t.Fatalf("failed to query database notes: %v %+v", err, results)
+	}
+	if string(results[0].Rows) != "[[1,10]]" {
+		t.Fatalf("the query returns the rows %s, want [[1,10]]", results[0].Rows)
+	}
+}
@@ -0,0 +1,653 @@
+package harness
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NOTE: the fake remote answers the subset of the S3 API the remote stage calls: the objects are written, read whole or
+// by range, copied, listed and deleted, conditionally on their ETag, with their metadata. Requests are neither signed
+// nor checked, any credentials are accepted.
+
+// FakeRemote is a bucket server storing its objects in a directory, the remote stage of the servers the harness starts
+// talks to it through its endpoint. It outlives them, so that a restarted server finds the objects of the previous one.
+type FakeRemote struct {
+	directory string
+	server    *httptest.Server
+
+	// NOTE: serializes the requests, a conditional write never interleaves with another write of the object
+	mutex sync.Mutex
+	// NOTE: set while the remote answers every request with a 503, see SetUnavailable
+	unavailable atomic.Bool
+	// NOTE: guarded by mutex
+	stats RemoteStats
+
+	// NOTE: set while the writes wait, see HoldWrites
+	holdMutex sync.Mutex
+	hold      *writeHold
+}
+
+// writeHold keeps the writes waiting until it is released.
+type writeHold struct {
+	prefix   string
+	waiting  chan struct{}
+	released chan struct{}
+	once     sync.Once
+}
+
+// RemoteStats counts the requests the remote served, see FakeRemote.Stats.
+type RemoteStats struct {
+	Requests int64
+	// Reads counts the objects, or ranges of objects, read with a GET.
+	Reads     int64
+	BytesRead int64
+	// Writes counts the objects written with a PUT, copies excluded.
+	Writes       int64
+	BytesWritten int64
+}
+
+// objectMetadata is stored next to the content of each object.
+type objectMetadata struct {
+	ETag         string            `json:"etag"`
+	ContentType  string            `json:"content_type,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	LastModified time.Time         `json:"last_modified"`
+}
+
+// NewFakeRemote serves the objects stored in the directory, it is created when missing.
+func NewFakeRemote(directory string) (*FakeRemote, error) {
+	for _, subdirectory := range []string{"objects", "metadata"} {
+		if err := os.MkdirAll(filepath.Join(directory, subdirectory), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	remote := &FakeRemote{directory: directory}
+	remote.server = httptest.NewServer(http.HandlerFunc(remote.serve))
+	return remote, nil
+}
+
+// Endpoint returns the URL of the remote, for STORAGE_REMOTE_ENDPOINT. It is an IP address, the buckets are addressed
+// in the path.
+func (remote *FakeRemote) Endpoint() string {
+	return remote.server.URL
+}
+
+// Close stops serving the remote, its objects are kept in its directory. The writes held are released first.
+func (remote *FakeRemote) Close() {
+	remote.releaseWrites()
+	remote.server.Close()
+}
+
+// SetUnavailable makes the remote answer every request with a 503 until it is called again with false, e.g. to open the
+// circuit breaker of the remote stage.
+func (remote *FakeRemote) SetUnavailable(unavailable bool) {
+	remote.unavailable.Store(unavailable)
+}
+
+// HoldWrites makes the writes and deletions of the objects whose key starts with the prefix wait until release is
+// called, e.g. to crash the server in the middle of a demotion. waiting is closed once a write waits. A write whose client
+// went away meanwhile is dropped, it never reaches the bucket. Only one hold is set at a time.
+func (remote *FakeRemote) HoldWrites(prefix string) (waiting <-chan struct{}, release func()) {
+	remote.holdMutex.Lock()
+	defer remote.holdMutex.Unlock()
+
+	if remote.hold == nil {
+		remote.hold = &writeHold{prefix: prefix, waiting: make(chan struct{}), released: make(chan struct{})}
+	}
+	return remote.hold.waiting, remote.releaseWrites
+}
+
+func (remote *FakeRemote) releaseWrites() {
+	remote.holdMutex.Lock()
+	defer remote.holdMutex.Unlock()
+
+	if remote.hold != nil {
+		close(remote.hold.released)
+		remote.hold = nil
+	}
+}
+
+// wait holds the write until the writes are released, it reports false when the client went away meanwhile.
+func (remote *FakeRemote) wait(r *http.Request, key string) bool {
+	remote.holdMutex.Lock()
+	hold := remote.hold
+	remote.holdMutex.Unlock()
+	if hold == nil || !strings.HasPrefix(key, hold.prefix) {
+		return true
+	}
+
+	hold.once.Do(func() { close(hold.waiting) })
+	select {
+	case <-hold.released:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// Stats returns the requests the remote served since it was started, those answered while it was unavailable excluded.
+func (remote *FakeRemote) Stats() RemoteStats {
+	remote.mutex.Lock()
+	defer remote.mutex.Unlock()
+
+	return remote.stats
+}
+
+// Keys returns the keys of the objects of the bucket starting with the prefix, sorted.
+func (remote *FakeRemote) Keys(bucket string, prefix string) ([]string, error) {
+	remote.mutex.Lock()
+	defer remote.mutex.Unlock()
+
+	return remote.keys(bucket, prefix)
+}
+
+// Object returns the content of the object, fs.ErrNotExist when it doesn't exist.
+func (remote *FakeRemote) Object(bucket string, key string) ([]byte, error) {
+	remote.mutex.Lock()
+	defer remote.mutex.Unlock()
+
+	return os.ReadFile(remote.objectPath(bucket, key))
+}
+
+// PutObject stores the object as a client would, e.g. a copy made by another tool or a half-written one.
+func (remote *FakeRemote) PutObject(bucket string, key string, content []byte) error {
+	remote.mutex.Lock()
+	defer remote.mutex.Unlock()
+
+	_, err := remote.write(bucket, key, content, objectMetadata{ContentType: "application/octet-stream"})
+	return err
+}
+
+// DeleteObject removes the object, it is not an error when it doesn't exist.
+func (remote *FakeRemote) DeleteObject(bucket string, key string) error {
+	remote.mutex.Lock()
+	defer remote.mutex.Unlock()
+
+	return remote.remove(bucket, key)
+}
+
+func (remote *FakeRemote) serve(w http.ResponseWriter, r *http.Request) {
+	if remote.unavailable.Load() {
+		writeError(w, http.StatusServiceUnavailable, "ServiceUnavailable", "the fake remote is unavailable")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		writeError(w, http.StatusBadRequest, "InvalidBucketName", "the bucket is missing from the path")
+		return
+	}
+	if (r.Method == http.MethodPut || r.Method == http.MethodDelete) && !remote.wait(r, key) {
+		return
+	}
+
+	remote.mutex.Lock()
+	defer remote.mutex.Unlock()
+
+	remote.stats.Requests++
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet:
+		remote.list(w, r, bucket)
+	case key == "":
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "only the listings of the bucket are served")
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		remote.get(w, r, bucket, key)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		remote.copy(w, r, bucket, key)
+	case r.Method == http.MethodPut:
+		remote.put(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		remote.delete(w, r, bucket, key)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", fmt.Sprintf("%s isn't served", r.Method))
+	}
+}
+
+func (remote *FakeRemote) get(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	metadata, err := remote.metadata(bucket, key)
+	if err != nil {
+		writeObjectError(w, r, err)
+		return
+	}
+	if !matches(r.Header.Get("If-Match"), metadata.ETag, true) {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "the object changed")
+		return
+	}
+	content, err := os.ReadFile(remote.objectPath(bucket, key))
+	if err != nil {
+		writeObjectError(w, r, err)
+		return
+	}
+
+	header := w.Header()
+	header.Set("ETag", metadata.ETag)
+	header.Set("Last-Modified", metadata.LastModified.UTC().Format(http.TimeFormat))
+	header.Set("Accept-Ranges", "bytes")
+	if metadata.ContentType != "" {
+		header.Set("Content-Type", metadata.ContentType)
+	}
+	for name, value := range metadata.Metadata {
+		header.Set("X-Amz-Meta-"+name, value)
+	}
+
+	status := http.StatusOK
+	if ranged := r.Header.Get("Range"); ranged != "" {
+		first, last, err := parseRange(ranged, int64(len(content)))
+		if err != nil {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", err.Error())
+			return
+		}
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(content)))
+		content = content[first : last+1]
+		status = http.StatusPartialContent
+	}
+	header.Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		remote.stats.Reads++
+		remote.stats.BytesRead += int64(len(content))
+		w.Write(content)
+	}
+}
+
+func (remote *FakeRemote) put(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	content, err := readBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if !remote.preconditionsHold(w, r, bucket, key) {
+		return
+	}
+
+	remote.stats.Writes++
+	remote.stats.BytesWritten += int64(len(content))
+	metadata := objectMetadata{ContentType: r.Header.Get("Content-Type"), Metadata: userMetadata(r.Header)}
+	etag, err := remote.write(bucket, key, content, metadata)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (remote *FakeRemote) copy(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	sourceBucket, sourceKey, _ := strings.Cut(source, "/")
+	// NOTE: a version of the source may follow its key
+	sourceKey, _, _ = strings.Cut(sourceKey, "?")
+
+	metadata, err := remote.metadata(sourceBucket, sourceKey)
+	if err != nil {
+		writeObjectError(w, r, err)
+		return
+	}
+	content, err := os.ReadFile(remote.objectPath(sourceBucket, sourceKey))
+	if err != nil {
+		writeObjectError(w, r, err)
+		return
+	}
+	if !remote.preconditionsHold(w, r, bucket, key) {
+		return
+	}
+	if strings.EqualFold(r.Header.Get("X-Amz-Metadata-Directive"), "REPLACE") {
+		metadata = objectMetadata{ContentType: r.Header.Get("Content-Type"), Metadata: userMetadata(r.Header)}
+	}
+
+	etag, err := remote.write(bucket, key, content, metadata)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	type copyObjectResult struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string   `xml:"ETag"`
+		LastModified string   `xml:"LastModified"`
+	}
+	writeXML(w, http.StatusOK, copyObjectResult{ETag: etag, LastModified: time.Now().UTC().Format(time.RFC3339)})
+}
+
+func (remote *FakeRemote) delete(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	if etag := r.Header.Get("If-Match"); etag != "" {
+		metadata, err := remote.metadata(bucket, key)
+		if err != nil {
+			writeObjectError(w, r, err)
+			return
+		}
+		if !matches(etag, metadata.ETag, true) {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "the object changed")
+			return
+		}
+	}
+	if err := remote.remove(bucket, key); err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (remote *FakeRemote) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	keys, err := remote.keys(bucket, prefix)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	type listedObject struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+		StorageClass string `xml:"StorageClass"`
+	}
+	type commonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+	type listBucketResult struct {
+		XMLName        xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name           string         `xml:"Name"`
+		Prefix         string         `xml:"Prefix"`
+		Delimiter      string         `xml:"Delimiter,omitempty"`
+		KeyCount       int            `xml:"KeyCount"`
+		MaxKeys        int            `xml:"MaxKeys"`
+		IsTruncated    bool           `xml:"IsTruncated"`
+		Contents       []listedObject `xml:"Contents"`
+		CommonPrefixes []commonPrefix `xml:"CommonPrefixes"`
+	}
+
+	// NOTE: every key is returned in a single page
+	result := listBucketResult{Name: bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: len(keys) + 1000}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if delimiter != "" {
+			if index := strings.Index(key[len(prefix):], delimiter); index >= 0 {
+				common := key[:len(prefix)+index+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: common})
+				}
+				continue
+			}
+		}
+		metadata, err := remote.metadata(bucket, key)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(remote.objectPath(bucket, key))
+		if err != nil {
+			continue
+		}
+		result.Contents = append(result.Contents, listedObject{
+			Key:          key,
+			LastModified: metadata.LastModified.UTC().Format(time.RFC3339Nano),
+			ETag:         metadata.ETag,
+			Size:         info.Size(),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	writeXML(w, http.StatusOK, result)
+}
+
+// preconditionsHold checks the If-Match and If-None-Match headers of a write against the current object, answering the
+// request when they don't hold.
+func (remote *FakeRemote) preconditionsHold(w http.ResponseWriter, r *http.Request, bucket string, key string) bool {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return true
+	}
+
+	current := ""
+	metadata, err := remote.metadata(bucket, key)
+	switch {
+	case err == nil:
+		current = metadata.ETag
+	case errors.Is(err, fs.ErrNotExist):
+		if ifMatch != "" {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "the object doesn't exist")
+			return false
+		}
+	default:
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return false
+	}
+
+	if (ifMatch != "" && !matches(ifMatch, current, true)) || (ifNoneMatch != "" && matches(ifNoneMatch, current, false)) {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "the object changed")
+		return false
+	}
+	return true
+}
+
+// write stores the object and its metadata, the content is written aside then renamed so that a reader never sees it
+// half-written. It returns the ETag of the object.
+func (remote *FakeRemote) write(bucket string, key string, content []byte, metadata objectMetadata) (string, error) {
+	sum := md5.Sum(content)
+	metadata.ETag = `"` + hex.EncodeToString(sum[:]) + `"`
+	metadata.LastModified = time.Now().UTC()
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+
+	for path, data := range map[string][]byte{remote.objectPath(bucket, key): content, remote.metadataPath(bucket, key): encoded} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return "", err
+		}
+		temporaryPath := path + ".writing"
+		if err := os.WriteFile(temporaryPath, data, 0o644); err != nil {
+			return "", err
+		}
+		if err := os.Rename(temporaryPath, path); err != nil {
+			return "", err
+		}
+	}
+	return metadata.ETag, nil
+}
+
+func (remote *FakeRemote) remove(bucket string, key string) error {
+	for _, path := range []string{remote.objectPath(bucket, key), remote.metadataPath(bucket, key)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (remote *FakeRemote) metadata(bucket string, key string) (objectMetadata, error) {
+	var metadata objectMetadata
+	encoded, err := os.ReadFile(remote.metadataPath(bucket, key))
+	if err != nil {
+		return metadata, err
+	}
+	return metadata, json.Unmarshal(encoded, &metadata)
+}
+
+func (remote *FakeRemote) keys(bucket string, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(remote.directory, "objects", url.PathEscape(bucket)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".writing") {
+			continue
+		}
+		key, err := url.QueryUnescape(entry.Name())
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// NOTE: the keys are escaped into a single file name, the objects of a bucket are the files of its directory
+func (remote *FakeRemote) objectPath(bucket string, key string) string {
+	return filepath.Join(remote.directory, "objects", url.PathEscape(bucket), url.QueryEscape(key))
+}
+
+func (remote *FakeRemote) metadataPath(bucket string, key string) string {
+	return filepath.Join(remote.directory, "metadata", url.PathEscape(bucket), url.QueryEscape(key)+".json")
+}
+
+// readBody returns the content of a write, decoding the aws-chunked encoding the clients use to send the checksums of
+// the content after it.
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	chunked := strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") || strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-")
+	if !chunked {
+		return body, nil
+	}
+
+	var content bytes.Buffer
+	reader := bufio.NewReader(bytes.NewReader(body))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("unterminated chunk header: %w", err)
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk size %q: %w", sizeField, err)
+		}
+		if size == 0 {
+			// NOTE: the trailers holding the checksums follow, they aren't checked
+			return content.Bytes(), nil
+		}
+		if _, err := io.CopyN(&content, reader, size); err != nil {
+			return nil, fmt.Errorf("truncated chunk: %w", err)
+		}
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, fmt.Errorf("unterminated chunk: %w", err)
+		}
+	}
+}
+
+func userMetadata(header http.Header) map[string]string {
+	metadata := map[string]string{}
+	for name, values := range header {
+		if suffix, found := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); found && len(values) > 0 {
+			metadata[suffix] = values[0]
+		}
+	}
+	return metadata
+}
+
+// matches reports whether the ETag of a precondition matches the current one, "*" matching any existing object.
+func matches(condition string, current string, emptyMatches bool) bool {
+	if condition == "" {
+		return emptyMatches
+	}
+	if current == "" {
+		return false
+	}
+	for _, etag := range strings.Split(condition, ",") {
+		etag = strings.TrimSpace(etag)
+		if etag == "*" || strings.Trim(etag, `"`) == strings.Trim(current, `"`) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange returns the first and last bytes of a single bytes range, clamped to the size of the object.
+func parseRange(header string, size int64) (int64, int64, error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range %q", header)
+	}
+	firstField, lastField, _ := strings.Cut(spec, "-")
+
+	if firstField == "" {
+		suffix, err := strconv.ParseInt(lastField, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		return max(size-suffix, 0), size - 1, nil
+	}
+
+	first, err := strconv.ParseInt(firstField, 10, 64)
+	if err != nil || first >= size {
+		return 0, 0, fmt.Errorf("range %q not satisfiable for an object of %d bytes", header, size)
+	}
+	last := size - 1
+	if lastField != "" {
+		if last, err = strconv.ParseInt(lastField, 10, 64); err != nil || last < first {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		last = min(last, size-1)
+	}
+	return first, last, nil
+}
+
+func writeObjectError(w http.ResponseWriter, r *http.Request, err error) {
+	if !errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	// NOTE: the answers to HEAD have no body, the clients only see the status
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeError(w, http.StatusNotFound, "NoSuchKey", "the object doesn't exist")
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	type errorResponse struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}
+	writeXML(w, status, errorResponse{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, status int, value any) {
+	encoded, err := xml.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(encoded)
+}
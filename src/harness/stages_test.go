@@ -0,0 +1,199 @@
+package harness_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"persisto/client"
+	"persisto/src/harness"
+	"persisto/src/internal/journal"
+)
+
+const (
+	localStage  = 2
+	remoteStage = 3
+)
+
+func TestMain(m *testing.M) {
+	harness.Main(m)
+}
+
+func TestPromotionAndDemotion(t *testing.T) {
+	instance := harness.Start(t, map[string]string{"SETTINGS_REQUEST_COUNT_THRESHOLD": "1"})
+	create(t, instance, "notes")
+
+	execute(t, instance, "notes", "CREATE TABLE notes (body TEXT)", "INSERT INTO notes VALUES ('promoted-marker')")
+	query(t, instance, "notes", "SELECT body FROM notes")
+	instance.WaitIdle()
+	if stage := instance.Stage("notes"); stage != localStage {
+		t.Fatalf("the database is at stage %d after its requests, want %d", stage, localStage)
+	}
+
+	// NOTE: the clock stays under the stage timeout, the database was accessed too recently to be demoted
+	instance.AdvanceClock(time.Hour)
+	instance.RunMonitor()
+	if stage := instance.Stage("notes"); stage != localStage {
+		t.Fatalf("the database is at stage %d before its stage timeout, want %d", stage, localStage)
+	}
+
+	execute(t, instance, "notes", "INSERT INTO notes VALUES ('demoted-marker')")
+	instance.AdvanceClock(48 * time.Hour)
+	instance.RunMonitor()
+	if stage := instance.Stage("notes"); stage != remoteStage {
+		t.Fatalf("the database is at stage %d past its stage timeout, want %d", stage, remoteStage)
+	}
+	expectObject(t, instance, "notes", "demoted-marker")
+}
+
+func TestSync(t *testing.T) {
+	instance := harness.Start(t, map[string]string{"SETTINGS_AUTO_SYNC_ENABLED": "false"})
+	create(t, instance, "notes")
+	move(t, instance, "notes", localStage)
+
+	execute(t, instance, "notes", "CREATE TABLE notes (body TEXT)", "INSERT INTO notes VALUES ('synced-marker')")
+	if content, err := instance.Remote.Object(harness.Bucket, "notes.db"); err != nil || bytes.Contains(content, []byte("synced-marker")) {
+		t.Fatalf("the remote copy holds the write before the sync or can't be read: %v", err)
+	}
+
+	if _, err := instance.Client.Sync(context.Background(), "notes"); err != nil {
+		t.Fatalf("failed to sync the database: %v", err)
+	}
+	expectObject(t, instance, "notes", "synced-marker")
+}
+
+func TestCrashKeepsSyncedWrites(t *testing.T) {
+	instance := harness.Start(t, nil)
+	create(t, instance, "notes")
+	move(t, instance, "notes", localStage)
+
+	execute(t, instance, "notes", "CREATE TABLE notes (body TEXT)", "INSERT INTO notes VALUES ('synced-marker')")
+	instance.WaitIdle()
+
+	instance.Restart()
+	expectRows(t, instance, "notes", "SELECT body FROM notes", `[{"body":"synced-marker"}]`)
+}
+
+func TestInterruptedDemotionIsRolledForward(t *testing.T) {
+	instance := harness.Start(t, map[string]string{"SETTINGS_AUTO_SYNC_ENABLED": "false"})
+	create(t, instance, "notes")
+	move(t, instance, "notes", localStage)
+	execute(t, instance, "notes", "CREATE TABLE notes (body TEXT)", "INSERT INTO notes VALUES ('demoted-marker')")
+
+	// NOTE: the server is killed while the demotion writes the remote copy, only the local copy holds the write
+	waiting, release := instance.Remote.HoldWrites("notes.db")
+	moved := make(chan error, 1)
+	go func() { moved <- instance.Client.Move(context.Background(), "notes", remoteStage) }()
+	select {
+	case <-waiting:
+	case err := <-moved:
+		t.Fatalf("the demotion ended without writing the remote copy: %v", err)
+	case <-time.After(30 * time.Second):
+		t.Fatal("the demotion didn't write the remote copy")
+	}
+	instance.Crash()
+	<-moved
+	release()
+
+	instance.Restart()
+	var report struct {
+		Pending   []journal.Intent   `json:"pending"`
+		Recovered []journal.Recovery `json:"recovered"`
+	}
+	instance.Get("/journal", &report)
+	if len(report.Recovered) != 1 || report.Recovered[0].Intent.Operation != journal.OperationMove || report.Recovered[0].Outcome != journal.OutcomeRolledForward {
+		t.Fatalf("the demotion wasn't rolled forward at startup: %+v", report.Recovered)
+	}
+	if len(report.Pending) != 0 {
+		t.Fatalf("intents are left in the journal: %+v", report.Pending)
+	}
+	expectObject(t, instance, "notes", "demoted-marker")
+	expectRows(t, instance, "notes", "SELECT body FROM notes", `[{"body":"demoted-marker"}]`)
+}
+
+func TestOfflineWritesAreUploaded(t *testing.T) {
+	instance := harness.Start(t, map[string]string{"SETTINGS_AUTO_SYNC_ENABLED": "false"})
+	create(t, instance, "notes")
+	move(t, instance, "notes", localStage)
+	execute(t, instance, "notes", "CREATE TABLE notes (body TEXT)")
+	if _, err := instance.Client.Sync(context.Background(), "notes"); err != nil {
+		t.Fatalf("failed to sync the database: %v", err)
+	}
+
+	instance.Remote.SetUnavailable(true)
+	instance.Restart()
+	execute(t, instance, "notes", "INSERT INTO notes VALUES ('offline-marker')")
+
+	instance.Remote.SetUnavailable(false)
+	instance.Restart()
+	expectObject(t, instance, "notes", "offline-marker")
+	expectRows(t, instance, "notes", "SELECT body FROM notes", `[{"body":"offline-marker"}]`)
+}
+
+func create(t *testing.T, instance *harness.Instance, name string) {
+	t.Helper()
+	if _, err := instance.Client.CreateDatabase(context.Background(), name); err != nil {
+		t.Fatalf("failed to create database %s: %v", name, err)
+	}
+}
+
+func move(t *testing.T, instance *harness.Instance, name string, stage uint) {
+	t.Helper()
+	if err := instance.Client.Move(context.Background(), name, stage); err != nil {
+		t.Fatalf("failed to move database %s to stage %d: %v", name, stage, err)
+	}
+}
+
+func execute(t *testing.T, instance *harness.Instance, name string, queries ...string) {
+	t.Helper()
+	results, err := instance.Client.Execute(context.Background(), name, queries...)
+	if err != nil {
+		t.Fatalf("failed to write database %s: %v", name, err)
+	}
+	for _, result := range results {
+		if err := result.Err(); err != nil {
+			t.Fatalf("failed to write database %s: %v", name, err)
+		}
+	}
+}
+
+func query(t *testing.T, instance *harness.Instance, name string, query string) client.QueryResult {
+	t.Helper()
+	results, err := instance.Client.Query(context.Background(), name, query)
+	if err != nil {
+		t.Fatalf("failed to read database %s: %v", name, err)
+	}
+	if err := results[0].Err(); err != nil {
+		t.Fatalf("failed to read database %s: %v", name, err)
+	}
+	return results[0]
+}
+
+func expectRows(t *testing.T, instance *harness.Instance, name string, statement string, want string) {
+	t.Helper()
+	result := query(t, instance, name, statement)
+	var got, expected any
+	if err := json.Unmarshal(result.Data, &got); err != nil {
+		t.Fatalf("failed to decode the rows of database %s: %v", name, err)
+	}
+	json.Unmarshal([]byte(want), &expected)
+	gotJSON, _ := json.Marshal(got)
+	expectedJSON, _ := json.Marshal(expected)
+	if !bytes.Equal(gotJSON, expectedJSON) {
+		t.Fatalf("database %s holds %s, want %s", name, gotJSON, expectedJSON)
+	}
+}
+
+// expectObject checks the remote copy of the database holds the text, the pages of the tables hold their text as is.
+func expectObject(t *testing.T, instance *harness.Instance, name string, text string) {
+	t.Helper()
+	content, err := instance.Remote.Object(harness.Bucket, name+".db")
+	if err != nil {
+		t.Fatalf("failed to read the remote copy of database %s: %v", name, err)
+	}
+	if !bytes.Contains(content, []byte(text)) {
+		t.Fatalf("the remote copy of database %s doesn't hold %q", name, text)
+	}
+}
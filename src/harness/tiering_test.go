@@ -0,0 +1,135 @@
+package harness_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"persisto/client"
+	"persisto/src/harness"
+	"persisto/src/internal/journal"
+)
+
+func TestSnapshotCarriesTieredTables(t *testing.T) {
+	instance := harness.Start(t, nil)
+	create(t, instance, "notes")
+	move(t, instance, "notes", localStage)
+	execute(t, instance, "notes", "CREATE TABLE hot (body TEXT)", "CREATE TABLE cold (body TEXT)", "INSERT INTO hot VALUES ('tiered-marker')", "INSERT INTO cold VALUES ('main-marker')")
+	tier(t, instance, "notes", "hot")
+
+	instance.Post("/databases/notes/snapshots", map[string]string{"tag": "tiered"}, nil)
+	instance.Post("/databases/notes/snapshots/tiered/clone", map[string]string{"target": "clone"}, nil)
+
+	var database struct {
+		TieredTables []string `json:"tiered_tables"`
+	}
+	instance.Get("/databases/notes", &database)
+	if len(database.TieredTables) != 1 {
+		t.Fatalf("the database lists tiered tables %v, want [hot]", database.TieredTables)
+	}
+	database.TieredTables = nil
+	instance.Get("/databases/clone", &database)
+	if len(database.TieredTables) != 0 {
+		t.Fatalf("the clone lists tiered tables %v, want none", database.TieredTables)
+	}
+	expectRows(t, instance, "clone", "SELECT body FROM main.hot UNION ALL SELECT body FROM main.cold", `[{"body":"tiered-marker"},{"body":"main-marker"}]`)
+}
+
+func TestPersistentAckCoversTieredTables(t *testing.T) {
+	instance := harness.Start(t, nil)
+	create(t, instance, "notes")
+	execute(t, instance, "notes", "CREATE TABLE hot (body TEXT)")
+	tier(t, instance, "notes", "hot")
+
+	if _, err := instance.Client.ExecutePersistent(context.Background(), "notes", client.Statement{Query: "INSERT INTO hot VALUES ('persistent-marker')"}); err != nil {
+		t.Fatalf("failed to write database notes: %v", err)
+	}
+	content, err := instance.Remote.Object(harness.Bucket, "notes.db.tiered")
+	if err != nil || !bytes.Contains(content, []byte("persistent-marker")) {
+		t.Fatalf("the remote companion misses the write acknowledged as persistent: %v", err)
+	}
+}
+
+func TestCrashKeepsTieredWrites(t *testing.T) {
+	instance := harness.Start(t, map[string]string{"SETTINGS_AUTO_STAGE_MOVEMENT": "false"})
+	create(t, instance, "notes")
+	execute(t, instance, "notes", "CREATE TABLE hot (body TEXT)")
+	tier(t, instance, "notes", "hot")
+
+	// NOTE: the server is killed while the companion is uploaded, only the local companion holds the write
+	waiting, release := instance.Remote.HoldWrites("notes.db.tiered")
+	execute(t, instance, "notes", "INSERT INTO hot VALUES ('tiered-marker')")
+	select {
+	case <-waiting:
+	case <-time.After(30 * time.Second):
+		t.Fatal("the companion wasn't uploaded after the write")
+	}
+	instance.Crash()
+	release()
+
+	instance.Restart()
+	var report struct {
+		Recovered []journal.Recovery `json:"recovered"`
+	}
+	instance.Get("/journal", &report)
+	if len(report.Recovered) != 1 || report.Recovered[0].Intent.Operation != journal.OperationTieredWrite || report.Recovered[0].Outcome != journal.OutcomeRolledForward {
+		t.Fatalf("the tiered write wasn't recovered at startup: %+v", report.Recovered)
+	}
+	expectRows(t, instance, "notes", "SELECT body FROM hot", `[{"body":"tiered-marker"}]`)
+}
+
+func TestPoliciesAndTieringExcludeEachOther(t *testing.T) {
+	instance := harness.Start(t, map[string]string{"POLICIES_ENABLED": "true", "POLICIES_PRINCIPALS": "reader:reader-token"})
+	create(t, instance, "notes")
+	execute(t, instance, "notes",
+		"CREATE TABLE hot (tenant TEXT, body TEXT)", "INSERT INTO hot VALUES ('acme', 'visible-marker'), ('other', 'hidden-marker')",
+		"CREATE TABLE cold (body TEXT)", "INSERT INTO cold VALUES ('tiered-marker')",
+	)
+	admin := http.Header{client.AdminTokenHeader: {harness.AdminToken}}
+
+	instance.Request(http.MethodPut, "/admin/databases/notes/policies/reader/hot", admin, map[string]string{"filter": "tenant = 'acme'"})
+	if status, body := instance.Request(http.MethodPost, "/databases/notes/tables/hot/tier", admin, map[string]string{"tier": "local"}); status != http.StatusConflict {
+		t.Fatalf("tiering a restricted table answered %d, want %d: %s", status, http.StatusConflict, body)
+	}
+	tier(t, instance, "notes", "cold")
+	if status, body := instance.Request(http.MethodPut, "/admin/databases/notes/policies/reader/cold", admin, map[string]string{"filter": "1"}); status != http.StatusConflict {
+		t.Fatalf("restricting a tiered table answered %d, want %d: %s", status, http.StatusConflict, body)
+	}
+
+	expectPrincipalRows(t, instance, "notes", "reader-token", "SELECT body FROM hot", `[{"body":"visible-marker"}]`)
+	expectPrincipalRows(t, instance, "notes", "reader-token", "SELECT body FROM cold", `[{"body":"tiered-marker"}]`)
+}
+
+func tier(t *testing.T, instance *harness.Instance, name string, table string) {
+	t.Helper()
+	instance.Post("/databases/"+name+"/tables/"+table+"/tier", map[string]string{"tier": "local"}, nil)
+}
+
+// expectPrincipalRows checks the rows the principal of the token reads from the database.
+func expectPrincipalRows(t *testing.T, instance *harness.Instance, name string, token string, statement string, want string) {
+	t.Helper()
+	status, body := instance.Request(http.MethodPost, "/databases/"+name+"/query", http.Header{"X-Persisto-Principal-Token": {token}}, map[string]any{"queries": []string{statement}})
+	var response struct {
+		Results []struct {
+			Data  json.RawMessage `json:"data"`
+			Error string          `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil || len(response.Results) != 1 {
+		t.Fatalf("the principal failed to read database %s, answered %d: %s", name, status, body)
+	}
+	if response.Results[0].Error != "" {
+		t.Fatalf("the principal failed to read database %s: %s", name, response.Results[0].Error)
+	}
+	var got, expected any
+	json.Unmarshal(response.Results[0].Data, &got)
+	json.Unmarshal([]byte(want), &expected)
+	gotJSON, _ := json.Marshal(got)
+	expectedJSON, _ := json.Marshal(expected)
+	if !bytes.Equal(gotJSON, expectedJSON) {
+		t.Fatalf("the principal reads %s from database %s, want %s", gotJSON, name, expectedJSON)
+	}
+}
@@ -0,0 +1,246 @@
+package admission
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+)
+
+// NOTE: the queries beyond the concurrency limits wait in a single queue, a waiting query is admitted as soon as both
+// the global limit and the limit of its database allow it, so the queries of a saturated database don't hold back those
+// of the others. A query finding the queue full, or waiting longer than the queue timeout, is shed with a busy error.
+//
+// NOTE: the queue is ordered by priority, the interactive queries are admitted before the batch ones, which are admitted
+// before the maintenance ones. SETTINGS_INTERACTIVE_RESERVED_PERCENT of the slots and of the queue are only taken by the
+// interactive queries, so that the other work never leaves them waiting behind it.
+
+type waiter struct {
+	database string
+	priority utils.Priority
+	ready    chan struct{}
+	admitted bool
+}
+
+var (
+	mutex             sync.Mutex
+	running           int
+	runningByDatabase = map[string]int{}
+	queue             = list.New()
+	queuedByDatabase  = map[string]int{}
+	byPriority        = map[utils.Priority]*PriorityStats{}
+
+	admitted     int64
+	rejected     int64
+	timedOut     int64
+	waitedMillis int64
+)
+
+// Stats is the state of the admission control.
+type Stats struct {
+	Running  int   `json:"running" doc:"Queries running."`
+	Queued   int   `json:"queued" doc:"Queries waiting for a slot."`
+	Admitted int64 `json:"admitted" doc:"Queries admitted since the start."`
+	Rejected int64 `json:"rejected" doc:"Queries shed as the queue was full since the start."`
+	TimedOut int64 `json:"timed_out" doc:"Queries shed after waiting too long in the queue since the start."`
+	// NOTE: the total wait of the admitted queries, the mean wait is WaitedMs / Admitted
+	WaitedMs   int64                            `json:"waited_ms" doc:"Time the admitted queries spent in the queue since the start."`
+	ByPriority map[utils.Priority]PriorityStats `json:"by_priority" doc:"Queries by priority class."`
+}
+
+// PriorityStats is the state of the admission control for the queries of a priority class.
+type PriorityStats struct {
+	Running  int   `json:"running"`
+	Queued   int   `json:"queued"`
+	Admitted int64 `json:"admitted"`
+}
+
+func enabled() bool {
+	return utils.Config.Settings.MaxConcurrentQueries > 0 || utils.Config.Settings.MaxConcurrentDatabaseQueries > 0
+}
+
+// available returns the part of the limit the queries of the priority may take, the interactive ones take all of it.
+func available(limit int, priority utils.Priority) int {
+	if priority == utils.PriorityInteractive {
+		return limit
+	}
+	return limit - limit*utils.Config.Settings.InteractiveReservedPercent/100
+}
+
+// NOTE: mutex must be held
+func admissible(database string, priority utils.Priority) bool {
+	if limit := utils.Config.Settings.MaxConcurrentQueries; limit > 0 && running >= available(limit, priority) {
+		return false
+	}
+	if limit := utils.Config.Settings.MaxConcurrentDatabaseQueries; limit > 0 && runningByDatabase[database] >= available(limit, priority) {
+		return false
+	}
+	return true
+}
+
+// NOTE: mutex must be held
+func statsOf(priority utils.Priority) *PriorityStats {
+	stats, exists := byPriority[priority]
+	if !exists {
+		stats = &PriorityStats{}
+		byPriority[priority] = stats
+	}
+	return stats
+}
+
+// NOTE: mutex must be held
+func start(database string, priority utils.Priority) {
+	running++
+	runningByDatabase[database]++
+	admitted++
+	statsOf(priority).Running++
+	statsOf(priority).Admitted++
+}
+
+// NOTE: mutex must be held, the waiter is queued after those of its priority and of the more urgent ones
+func enqueue(w *waiter) *list.Element {
+	for element := queue.Front(); element != nil; element = element.Next() {
+		if element.Value.(*waiter).priority.Rank() > w.priority.Rank() {
+			return queue.InsertBefore(w, element)
+		}
+	}
+	return queue.PushBack(w)
+}
+
+// Admit waits for a slot to run a query on the database at the priority of the context, see utils.PriorityOf, the
+// returned function releases it once the query is done. It fails with a busy error when the query is shed, and with the
+// error of the context once it is done.
+func Admit(ctx context.Context, database string) (func(), error) {
+	if !enabled() {
+		return func() {}, nil
+	}
+	priority := utils.PriorityOf(ctx)
+
+	mutex.Lock()
+	if admissible(database, priority) {
+		start(database, priority)
+		mutex.Unlock()
+		return releaser(database, priority), nil
+	}
+
+	if queue.Len() >= available(utils.Config.Settings.MaxQueuedQueries, priority) {
+		rejected++
+		mutex.Unlock()
+		return nil, utils.NewError(utils.ErrorCodeBusy, fmt.Sprintf("%d queries are already queued, retry later", queue.Len()), nil)
+	}
+	if limit := utils.Config.Settings.MaxQueuedDatabaseQueries; limit > 0 && queuedByDatabase[database] >= available(limit, priority) {
+		rejected++
+		mutex.Unlock()
+		return nil, utils.NewError(utils.ErrorCodeBusy, fmt.Sprintf("%d queries on database %s are already queued, retry later", queuedByDatabase[database], database), nil)
+	}
+
+	w := &waiter{database: database, priority: priority, ready: make(chan struct{})}
+	element := enqueue(w)
+	queuedByDatabase[database]++
+	statsOf(priority).Queued++
+	mutex.Unlock()
+
+	queuedAt := time.Now()
+	timeout := time.NewTimer(time.Duration(utils.Config.Settings.QueueTimeoutMilliseconds) * time.Millisecond)
+	defer timeout.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		recordWait(queuedAt)
+		return releaser(database, priority), nil
+	case <-timeout.C:
+		err = utils.NewError(utils.ErrorCodeBusy, fmt.Sprintf("query on database %s waited %dms for a slot, retry later", database, utils.Config.Settings.QueueTimeoutMilliseconds), nil)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	mutex.Lock()
+	// NOTE: admitted while giving up, the slot is handed over to the next waiter
+	if w.admitted {
+		mutex.Unlock()
+		release(database, priority)
+		return nil, err
+	}
+	if ctx.Err() == nil {
+		timedOut++
+	}
+	queue.Remove(element)
+	dequeued(database, priority)
+	mutex.Unlock()
+	return nil, err
+}
+
+func releaser(database string, priority utils.Priority) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { release(database, priority) })
+	}
+}
+
+func release(database string, priority utils.Priority) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	running--
+	runningByDatabase[database]--
+	if runningByDatabase[database] <= 0 {
+		delete(runningByDatabase, database)
+	}
+	statsOf(priority).Running--
+
+	// NOTE: in queue order, the waiters whose database is still saturated, or whose priority can't take the slots left,
+	// are skipped
+	for element := queue.Front(); element != nil; {
+		next := element.Next()
+		w := element.Value.(*waiter)
+		if admissible(w.database, w.priority) {
+			queue.Remove(element)
+			dequeued(w.database, w.priority)
+			start(w.database, w.priority)
+			w.admitted = true
+			close(w.ready)
+		} else if limit := utils.Config.Settings.MaxConcurrentQueries; limit > 0 && running >= limit {
+			return
+		}
+		element = next
+	}
+}
+
+// NOTE: mutex must be held
+func dequeued(database string, priority utils.Priority) {
+	queuedByDatabase[database]--
+	if queuedByDatabase[database] <= 0 {
+		delete(queuedByDatabase, database)
+	}
+	statsOf(priority).Queued--
+}
+
+func recordWait(queuedAt time.Time) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	waitedMillis += time.Since(queuedAt).Milliseconds()
+}
+
+// GetStats returns the state of the admission control.
+func GetStats() Stats {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	stats := Stats{
+		Running:    running,
+		Queued:     queue.Len(),
+		Admitted:   admitted,
+		Rejected:   rejected,
+		TimedOut:   timedOut,
+		WaitedMs:   waitedMillis,
+		ByPriority: map[utils.Priority]PriorityStats{},
+	}
+	for _, priority := range utils.Priorities {
+		stats.ByPriority[priority] = *statsOf(priority)
+	}
+	return stats
+}
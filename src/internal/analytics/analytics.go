@@ -0,0 +1,237 @@
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/internal/connections"
+	"persisto/src/utils"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/driver"
+)
+
+const (
+	OrderSlowest  = "slowest"
+	OrderFrequent = "frequent"
+	OrderScanned  = "scanned"
+)
+
+// NOTE: statements beyond the configured limit of a database are aggregated under this fingerprint
+const otherFingerprint = "<other>"
+
+// Statement is the aggregate of the executions of a statement fingerprint over a window.
+type Statement struct {
+	Fingerprint string  `json:"fingerprint"`
+	Executions  int64   `json:"executions"`
+	TotalMillis float64 `json:"total_ms"`
+	MeanMillis  float64 `json:"mean_ms"`
+	MaxMillis   float64 `json:"max_ms"`
+	RowsScanned int64   `json:"rows_scanned"`
+	VMSteps     int64   `json:"vm_steps"`
+}
+
+// bucket holds the executions of a statement fingerprint over a minute.
+type bucket struct {
+	minute      int64
+	executions  int64
+	total       time.Duration
+	max         time.Duration
+	rowsScanned int64
+	vmSteps     int64
+}
+
+var (
+	// NOTE: per database, per fingerprint, buckets ordered by minute
+	statistics      = map[string]map[string][]bucket{}
+	statisticsMutex sync.Mutex
+
+	literals   = regexp.MustCompile(`'(?:[^']|'')*'|\bx'[0-9a-fA-F]*'|\b\d+(?:\.\d+)?(?:[eE][+-]?\d+)?\b`)
+	lists      = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)+\s*\)`)
+	whitespace = regexp.MustCompile(`\s+`)
+)
+
+// Fingerprint normalizes a statement so that executions differing only by their literals are aggregated together.
+func Fingerprint(query string) string {
+	fingerprint := literals.ReplaceAllString(query, "?")
+	fingerprint = whitespace.ReplaceAllString(strings.TrimSpace(fingerprint), " ")
+	fingerprint = lists.ReplaceAllString(fingerprint, "(?, ...)")
+	return strings.TrimSuffix(fingerprint, ";")
+}
+
+func init() {
+	connections.Register(connections.Hook{Name: "analytics", Order: connections.OrderObservers, Open: func(ctx context.Context, connection *connections.Connection) error {
+		return Profile(connection.Conn, connection.Database)
+	}})
+}
+
+// Profile records the statements run on the connection against the database, nothing is done when analytics are
+// disabled.
+func Profile(conn *sql.Conn, name string) error {
+	if !utils.Config.Analytics.Enabled {
+		return nil
+	}
+
+	return conn.Raw(func(driverConn any) error {
+		raw := driverConn.(driver.Conn).Raw()
+		return raw.Trace(sqlite3.TRACE_PROFILE, func(_ sqlite3.TraceEvent, arg1 any, arg2 any) error {
+			statement, isStatement := arg1.(*sqlite3.Stmt)
+			nanoseconds, isDuration := arg2.(int64)
+			if !isStatement || !isDuration {
+				return nil
+			}
+			// NOTE: SQLite doesn't count the rows read through indexes, full scans are the expensive ones
+			scanned := statement.Status(sqlite3.STMTSTATUS_FULLSCAN_STEP, true)
+			steps := statement.Status(sqlite3.STMTSTATUS_VM_STEP, true)
+			Record(name, statement.SQL(), time.Duration(nanoseconds), int64(scanned), int64(steps))
+			utils.ObserveStatement(raw, statement, nanoseconds, scanned, steps)
+			return nil
+		})
+	})
+}
+
+// Execer is implemented by the connections and transactions statements are executed on.
+type Execer interface {
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Exec executes the query on a connection profiled by Profile. The driver runs statements without parameters outside
+// of the prepared statements SQLite profiles, a single statement is prepared so that it is profiled, scripts of several
+// statements are timed as a whole and their scanned rows are unknown.
+func Exec(ctx context.Context, execer Execer, name string, query string, parameters ...any) (sql.Result, error) {
+	if !utils.Config.Analytics.Enabled || len(parameters) != 0 {
+		return execer.ExecContext(ctx, query, parameters...)
+	}
+
+	statement, err := execer.PrepareContext(ctx, query)
+	if err == nil {
+		defer statement.Close()
+		return statement.ExecContext(ctx)
+	}
+
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query)
+	Record(name, query, time.Since(start), 0, 0)
+	return result, err
+}
+
+// Record adds an execution of the statement to the statistics of the database.
+func Record(name string, query string, duration time.Duration, rowsScanned int64, vmSteps int64) {
+	if !utils.Config.Analytics.Enabled {
+		return
+	}
+
+	fingerprint := Fingerprint(query)
+	minute := time.Now().Unix() / 60
+
+	statisticsMutex.Lock()
+	defer statisticsMutex.Unlock()
+
+	statements, exists := statistics[name]
+	if !exists {
+		statements = map[string][]bucket{}
+		statistics[name] = statements
+	}
+	if _, exists := statements[fingerprint]; !exists && len(statements) >= utils.Config.Analytics.MaxStatements {
+		fingerprint = otherFingerprint
+	}
+
+	buckets := prune(statements[fingerprint], minute)
+	if len(buckets) == 0 || buckets[len(buckets)-1].minute != minute {
+		buckets = append(buckets, bucket{minute: minute})
+	}
+	current := &buckets[len(buckets)-1]
+	current.executions++
+	current.total += duration
+	current.max = max(current.max, duration)
+	current.rowsScanned += rowsScanned
+	current.vmSteps += vmSteps
+	statements[fingerprint] = buckets
+}
+
+// prune drops the buckets older than the retention, statisticsMutex must be held.
+func prune(buckets []bucket, minute int64) []bucket {
+	oldest := minute - int64(utils.Config.Analytics.RetentionMinutes)
+	index := sort.Search(len(buckets), func(i int) bool { return buckets[i].minute > oldest })
+	return buckets[index:]
+}
+
+// Top returns the limit statements of the database ranked by the given order over the last window.
+func Top(name string, window time.Duration, order string, limit int) []Statement {
+	now := time.Now()
+	since := now.Add(-window).Unix() / 60
+
+	statisticsMutex.Lock()
+	statements := make([]Statement, 0, len(statistics[name]))
+	for fingerprint, buckets := range statistics[name] {
+		// NOTE: statements no longer executed are only dropped here
+		buckets = prune(buckets, now.Unix()/60)
+		if len(buckets) == 0 {
+			delete(statistics[name], fingerprint)
+			continue
+		}
+		statistics[name][fingerprint] = buckets
+
+		statement := Statement{Fingerprint: fingerprint}
+		var total, longest time.Duration
+		for _, bucket := range buckets {
+			if bucket.minute < since {
+				continue
+			}
+			statement.Executions += bucket.executions
+			statement.RowsScanned += bucket.rowsScanned
+			statement.VMSteps += bucket.vmSteps
+			total += bucket.total
+			longest = max(longest, bucket.max)
+		}
+		if statement.Executions == 0 {
+			continue
+		}
+		statement.TotalMillis = milliseconds(total)
+		statement.MeanMillis = milliseconds(total / time.Duration(statement.Executions))
+		statement.MaxMillis = milliseconds(longest)
+		statements = append(statements, statement)
+	}
+	statisticsMutex.Unlock()
+
+	sort.Slice(statements, func(i, j int) bool {
+		switch order {
+		case OrderFrequent:
+			if statements[i].Executions != statements[j].Executions {
+				return statements[i].Executions > statements[j].Executions
+			}
+		case OrderScanned:
+			if statements[i].RowsScanned != statements[j].RowsScanned {
+				return statements[i].RowsScanned > statements[j].RowsScanned
+			}
+		default:
+			if statements[i].MeanMillis != statements[j].MeanMillis {
+				return statements[i].MeanMillis > statements[j].MeanMillis
+			}
+		}
+		return statements[i].Fingerprint < statements[j].Fingerprint
+	})
+
+	if len(statements) > limit {
+		statements = statements[:limit]
+	}
+	return statements
+}
+
+// Forget drops the statistics of the database, e.g. once it is deleted.
+func Forget(name string) {
+	statisticsMutex.Lock()
+	defer statisticsMutex.Unlock()
+
+	delete(statistics, name)
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration.Microseconds()) / 1000
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"persisto/src/internal/audit"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+var (
+	auditSetupOnce sync.Once
+)
+
+// SetupAuditing starts the audit sinks, the buffered events are delivered before exiting on SIGINT or SIGTERM.
+func SetupAuditing() {
+	auditSetupOnce.Do(func() {
+		if err := audit.SetupAuditor(); err != nil {
+			utils.Logger.Fatal("Failed to setup audit logging.", zap.Error(err))
+		}
+
+		if !utils.Config.Audit.Enabled {
+			return
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+		go func() {
+			<-signals
+			utils.Logger.Info("Delivering the buffered audit events before exiting.")
+			audit.Close()
+			os.Exit(0)
+		}()
+	})
+}
@@ -0,0 +1,258 @@
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// NOTE: events are dropped when the buffer is full and batches dropped once their retries are exhausted
+	DeliveryBestEffort = "best_effort"
+	// NOTE: recording blocks while the buffer is full and batches are retried until a sink accepts them
+	DeliveryAtLeastOnce = "at_least_once"
+)
+
+const (
+	EventDatabaseCreated     = "database.created"
+	EventDatabaseProvisioned = "database.provisioned"
+	EventDatabaseDeleted     = "database.deleted"
+	EventDatabaseExecuted    = "database.executed"
+	EventDownloadURLIssued   = "database.download_url_issued"
+	EventDatabaseSynced      = "database.synced"
+	EventDatabaseMoved       = "database.moved"
+	EventDatabaseBackedUp    = "database.backed_up"
+	EventDatabaseRestored    = "database.restored"
+	EventDataSynced          = "database.data_synced"
+	EventDatabaseImported    = "database.imported"
+	EventSnapshotCreated     = "database.snapshot_created"
+	EventSnapshotDeleted     = "database.snapshot_deleted"
+	EventDatabaseScrubbed    = "database.scrubbed"
+	EventDatabaseDrilled     = "database.drilled"
+	EventTableTiered         = "database.table_tiered"
+	EventSyncWindowExceeded  = "database.sync_window_exceeded"
+	EventSyncWindowRecovered = "database.sync_window_recovered"
+	EventSyncDeadLettered    = "database.sync_dead_lettered"
+	EventCorruptionDetected  = "database.corruption_detected"
+	EventJobRun              = "database.job_run"
+	EventStorageCollected    = "storage.collected"
+	EventStorageFailedBack   = "storage.failed_back"
+	EventConfigurationRead   = "admin.configuration_read"
+	EventCatalogRefreshed    = "admin.catalog_refreshed"
+	EventCatalogSnapshotted  = "admin.catalog_snapshotted"
+	EventCatalogRestored     = "admin.catalog_restored"
+	EventJournalRetried      = "admin.journal_retried"
+	EventJournalDismissed    = "admin.journal_dismissed"
+	EventLogLevelChanged     = "admin.log_level_changed"
+	EventMovementsFrozen     = "admin.movements_frozen"
+	EventMovementsResumed    = "admin.movements_resumed"
+	EventDeadLetterDismissed = "admin.sync_dead_letter_dismissed"
+	EventPolicySet           = "admin.policy_set"
+	EventPolicyRemoved       = "admin.policy_removed"
+	EventColumnMasked        = "admin.column_masked"
+	EventColumnUnmasked      = "admin.column_unmasked"
+	EventJobSet              = "admin.job_set"
+	EventJobRemoved          = "admin.job_removed"
+	EventHookSet             = "admin.hook_set"
+	EventHookRemoved         = "admin.hook_removed"
+	EventCheckSet            = "admin.check_set"
+	EventCheckRemoved        = "admin.check_removed"
+	EventTemplateSet         = "admin.template_set"
+	EventTemplateRemoved     = "admin.template_removed"
+	EventRetentionSet        = "admin.retention_set"
+	EventRetentionRemoved    = "admin.retention_removed"
+	EventInstancePromoted    = "instance.promoted"
+)
+
+// Event is an audit record, it is delivered to every configured sink.
+type Event struct {
+	ID        string         `json:"id"`
+	Time      time.Time      `json:"time"`
+	Type      string         `json:"type"`
+	Database  string         `json:"database,omitempty"`
+	RequestID string         `json:"requestId,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+}
+
+// Sink is an audit destination, Write must only return once the batch is durably stored by the destination.
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, events []Event) error
+	Close() error
+}
+
+var (
+	sinks  []Sink
+	events chan Event
+
+	// NOTE: events recorded before setup, after close or when auditing is disabled are ignored
+	enabled    bool
+	enabledMtx sync.RWMutex
+
+	stopped     chan struct{}
+	auditorOnce sync.Once
+	closeOnce   sync.Once
+)
+
+func newSink(name string) (Sink, error) {
+	switch name {
+	case "file":
+		return newFileSink(utils.Config.Audit.FilePath)
+	case "stdout":
+		return newStdoutSink(), nil
+	case "s3":
+		return newS3Sink(utils.Config.Audit.S3Prefix), nil
+	case "kafka":
+		return newKafkaSink(utils.Config.Audit.KafkaBrokers, utils.Config.Audit.KafkaTopic, utils.Config.Audit.KafkaRequiredAcks)
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q", name)
+	}
+}
+
+// SetupAuditor creates the configured sinks and starts delivering the recorded events to them.
+func SetupAuditor() error {
+	var setupError error
+
+	auditorOnce.Do(func() {
+		if !utils.Config.Audit.Enabled {
+			return
+		}
+
+		for _, name := range utils.Config.Audit.Sinks {
+			sink, err := newSink(name)
+			if err != nil {
+				setupError = fmt.Errorf("failed to setup audit sink %s: %w", name, err)
+				return
+			}
+			sinks = append(sinks, sink)
+		}
+
+		events = make(chan Event, utils.Config.Audit.BufferSize)
+		stopped = make(chan struct{})
+
+		enabledMtx.Lock()
+		enabled = true
+		enabledMtx.Unlock()
+
+		go deliver()
+
+		utils.Logger.Info("Audit logging enabled.", zap.Strings("sinks", utils.Config.Audit.Sinks), zap.String("delivery", utils.Config.Audit.Delivery))
+	})
+
+	return setupError
+}
+
+// Record queues an audit event, the ID and time are filled in when missing.
+func Record(event Event) {
+	enabledMtx.RLock()
+	defer enabledMtx.RUnlock()
+
+	if !enabled {
+		return
+	}
+
+	if event.ID == "" {
+		id := make([]byte, 16)
+		rand.Read(id)
+		event.ID = hex.EncodeToString(id)
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	if utils.Config.Audit.Delivery == DeliveryAtLeastOnce {
+		events <- event
+		return
+	}
+
+	select {
+	case events <- event:
+	default:
+		utils.Logger.Warn("Audit buffer full, dropping event.", zap.String("type", event.Type), zap.String("database", event.Database))
+	}
+}
+
+func deliver() {
+	defer close(stopped)
+
+	ticker := time.NewTicker(time.Duration(utils.Config.Audit.FlushIntervalMilliseconds) * time.Millisecond)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, utils.Config.Audit.BatchSize)
+	for {
+		select {
+		case event, open := <-events:
+			if !open {
+				flush(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= utils.Config.Audit.BatchSize {
+				flush(batch)
+				batch = make([]Event, 0, utils.Config.Audit.BatchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				flush(batch)
+				batch = make([]Event, 0, utils.Config.Audit.BatchSize)
+			}
+		}
+	}
+}
+
+// flush writes the batch to every sink, each sink is retried on its own so one failing destination doesn't duplicate
+// the events of the others.
+func flush(batch []Event) {
+	if len(batch) == 0 {
+		return
+	}
+
+	retryInterval := time.Duration(utils.Config.Audit.RetryIntervalMilliseconds) * time.Millisecond
+
+	for _, sink := range sinks {
+		for attempt := 0; ; attempt++ {
+			err := sink.Write(context.Background(), batch)
+			if err == nil {
+				break
+			}
+
+			if utils.Config.Audit.Delivery != DeliveryAtLeastOnce && attempt >= utils.Config.Audit.MaxRetries {
+				utils.Logger.Error("Failed to deliver audit events, dropping them.", zap.String("sink", sink.Name()), zap.Int("events", len(batch)), zap.Error(err))
+				break
+			}
+
+			utils.Logger.Warn("Failed to deliver audit events, retrying.", zap.String("sink", sink.Name()), zap.Int("attempt", attempt+1), zap.Error(err))
+			time.Sleep(retryInterval)
+		}
+	}
+}
+
+// Close delivers the buffered events and closes the sinks.
+func Close() {
+	closeOnce.Do(func() {
+		enabledMtx.Lock()
+		wasEnabled := enabled
+		enabled = false
+		enabledMtx.Unlock()
+
+		if !wasEnabled {
+			return
+		}
+
+		close(events)
+		<-stopped
+
+		for _, sink := range sinks {
+			if err := sink.Close(); err != nil {
+				utils.Logger.Warn("Failed to close audit sink.", zap.String("sink", sink.Name()), zap.Error(err))
+			}
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"persisto/src/vfs/remotevfs"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func encodeLines(events []Event) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// fileSink appends the events as JSON lines, synced to disk on every batch.
+type fileSink struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{file: file}, nil
+}
+
+func (sink *fileSink) Name() string {
+	return "file"
+}
+
+func (sink *fileSink) Write(ctx context.Context, events []Event) error {
+	lines, err := encodeLines(events)
+	if err != nil {
+		return err
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if _, err := sink.file.Write(lines); err != nil {
+		return err
+	}
+	return sink.file.Sync()
+}
+
+func (sink *fileSink) Close() error {
+	return sink.file.Close()
+}
+
+type stdoutSink struct{}
+
+func newStdoutSink() *stdoutSink {
+	return &stdoutSink{}
+}
+
+func (sink *stdoutSink) Name() string {
+	return "stdout"
+}
+
+func (sink *stdoutSink) Write(ctx context.Context, events []Event) error {
+	lines, err := encodeLines(events)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(lines)
+	return err
+}
+
+func (sink *stdoutSink) Close() error {
+	return nil
+}
+
+// s3Sink stores every batch as its own JSON lines object in the remote bucket, keyed by date so batches can be
+// listed and expired by prefix.
+type s3Sink struct {
+	prefix string
+}
+
+func newS3Sink(prefix string) *s3Sink {
+	return &s3Sink{prefix: prefix}
+}
+
+func (sink *s3Sink) Name() string {
+	return "s3"
+}
+
+func (sink *s3Sink) Write(ctx context.Context, events []Event) error {
+	lines, err := encodeLines(events)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: the first event ID makes the key unique and stable across retries of the same batch
+	first := events[0]
+	key := fmt.Sprintf("%s%s/%s-%s.jsonl", sink.prefix, first.Time.Format("2006/01/02"), first.Time.Format("150405.000000000"), first.ID)
+	return remotevfs.PutObject(ctx, key, lines, "application/x-ndjson")
+}
+
+func (sink *s3Sink) Close() error {
+	return nil
+}
+
+// kafkaSink produces one message per event, keyed by database so the events of a database stay ordered.
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+func newKafkaSink(brokers []string, topic string, requiredAcks int) (*kafkaSink, error) {
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("no kafka brokers configured")
+	}
+
+	return &kafkaSink{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequiredAcks(requiredAcks),
+			BatchTimeout: 10 * time.Millisecond,
+			// NOTE: retries are handled by the auditor
+			MaxAttempts: 1,
+		},
+	}, nil
+}
+
+func (sink *kafkaSink) Name() string {
+	return "kafka"
+}
+
+func (sink *kafkaSink) Write(ctx context.Context, events []Event) error {
+	messages := make([]kafka.Message, 0, len(events))
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, kafka.Message{Key: []byte(event.Database), Value: value, Time: event.Time})
+	}
+	return sink.writer.WriteMessages(ctx, messages...)
+}
+
+func (sink *kafkaSink) Close() error {
+	return sink.writer.Close()
+}
@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"sync"
+
+	"persisto/src/internal/backups"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/stages"
+)
+
+var (
+	backupsSetupOnce sync.Once
+)
+
+func SetupBackups() {
+	backupsSetupOnce.Do(func() {
+		getDatabases := func() []stages.Database {
+			if databases.Dbs == nil {
+				return []stages.Database{}
+			}
+
+			all := databases.Dbs.All()
+			result := make([]stages.Database, len(all))
+			for i, database := range all {
+				result[i] = database
+			}
+			return result
+		}
+
+		backups.SetupScheduler(getDatabases)
+	})
+}
@@ -0,0 +1,262 @@
+package backups
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+)
+
+// NOTE: sortable and free of characters needing escaping in object keys
+const timestampLayout = "20060102T150405Z"
+
+type Backup struct {
+	Database  string    `json:"database"`
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+	SizeBytes int64     `json:"size_bytes"`
+	// NOTE: only set on the backups just taken, the listings don't read the manifests
+	Manifest *Manifest `json:"manifest,omitempty"`
+}
+
+var (
+	// NOTE: returns the databases currently managed, set when the scheduler is setup
+	listDatabases = func() []stages.Database { return []stages.Database{} }
+)
+
+// SetupScheduler periodically backs up the selected databases and applies the retention policy to their backups.
+func SetupScheduler(getDatabases func() []stages.Database) {
+	listDatabases = getDatabases
+
+	if !utils.Config.Backups.Enabled {
+		utils.StagesLogger.Info("Scheduled backups disabled, not starting scheduler.")
+		return
+	}
+
+	go func() {
+		interval := time.Duration(utils.Config.Backups.IntervalSeconds) * time.Second
+		utils.StagesLogger.Info("Starting backup scheduler.", zap.Duration("interval", interval), zap.Strings("databases", utils.Config.Backups.Databases))
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			RunScheduledBackups()
+		}
+	}()
+}
+
+// RunScheduledBackups backs up every selected database then prunes its backups, failures are logged and don't stop
+// the other databases from being backed up.
+func RunScheduledBackups() {
+	for _, database := range selectedDatabases() {
+		backup, err := Create(database)
+		if err != nil {
+			database.GetLogger().Error("Scheduled backup failed.", zap.Error(err))
+			continue
+		}
+		audit.Record(audit.Event{
+			Type:     audit.EventDatabaseBackedUp,
+			Database: backup.Database,
+			Details:  map[string]any{"key": backup.Key, "sizeBytes": backup.SizeBytes, "scheduled": true},
+		})
+
+		removed, err := ApplyRetention(database.GetName(), time.Now())
+		if err != nil {
+			database.GetLogger().Warn("Failed to apply backup retention.", zap.Error(err))
+			continue
+		}
+		if len(removed) > 0 {
+			database.GetLogger().Info("Expired backups removed.", zap.Int("removed", len(removed)))
+		}
+	}
+}
+
+func selectedDatabases() []stages.Database {
+	databases := listDatabases()
+	if len(utils.Config.Backups.Databases) == 0 {
+		return databases
+	}
+
+	selected := make(map[string]bool, len(utils.Config.Backups.Databases))
+	for _, name := range utils.Config.Backups.Databases {
+		selected[strings.TrimSpace(name)] = true
+	}
+
+	var result []stages.Database
+	for _, database := range databases {
+		if selected[database.GetName()] {
+			result = append(result, database)
+		}
+	}
+	return result
+}
+
+func databasePrefix(name string) string {
+	return utils.Config.Backups.Prefix + name + "/"
+}
+
+// Create takes a consistent snapshot of the database, from whichever stage it is on, to the backup prefix. The copy is
+// staged on the local disk to be checksummed, then compressed and encrypted when the backups are, before it is uploaded
+// with its manifest.
+func Create(database stages.Database) (Backup, error) {
+	// NOTE: the read lock keeps the database from moving to another stage while it is copied
+	database.GetMutex().RLock()
+	defer database.GetMutex().RUnlock()
+
+	createdAt := time.Now().UTC().Truncate(time.Second)
+	key := databasePrefix(database.GetName()) + createdAt.Format(timestampLayout) + ".db"
+	manifest := &Manifest{
+		Database:      database.GetName(),
+		Key:           key,
+		CreatedAt:     createdAt,
+		SourceStage:   database.GetStage(),
+		WriteSequence: database.GetCopySequence(database.GetStage()),
+	}
+
+	scratch, err := os.MkdirTemp("", "persisto-backup-*")
+	if err != nil {
+		return Backup{}, err
+	}
+	defer os.RemoveAll(scratch)
+	path := filepath.Join(scratch, utils.DatabaseFileName(database.GetName()))
+
+	// NOTE: the requests keep writing to the database while it is copied, it is opened read-only but not immutable
+	connectionString, err := stages.ConnectionString(database.GetName(), database.GetStage(), stages.ConnectionOptions{ReadOnly: true})
+	if err != nil {
+		return Backup{}, err
+	}
+
+	source, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return Backup{}, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer source.Close()
+
+	// NOTE: VACUUM INTO reads the database in a single transaction, the copy is consistent even with concurrent writes
+	start := time.Now()
+	if _, err := source.Exec("VACUUM INTO ?", localConnectionString(path, false)); err != nil {
+		return Backup{}, fmt.Errorf("failed to copy database: %w", err)
+	}
+	// NOTE: the backup holds the tiered tables of the database, it is restored without its companion
+	if err := stages.InlineTieredTables(localConnectionString(path, false), stages.TieredKey(database.GetName()), stages.TieredPath(database.GetName())); err != nil {
+		return Backup{}, fmt.Errorf("failed to copy the tiered tables: %w", err)
+	}
+	if err := upload(path, manifest); err != nil {
+		return Backup{}, utils.NewError(utils.ErrorCodeStageUnavailable, "failed to write backup", err)
+	}
+
+	size, err := remotevfs.FileSize(key)
+	if err != nil {
+		database.GetLogger().Warn("Failed to get backup size.", zap.String("key", key), zap.Error(err))
+	}
+
+	backup := Backup{Database: database.GetName(), Key: key, CreatedAt: createdAt, SizeBytes: size, Manifest: manifest}
+	database.GetLogger().Info("Database backed up.", zap.String("key", key), zap.Int64("sizeBytes", size), zap.Bool("encrypted", manifest.Encrypted), zap.String("compression", manifest.Compression), zap.Duration("duration", time.Since(start)))
+
+	return backup, nil
+}
+
+// List returns the backups of the database, newest first.
+func List(name string) ([]Backup, error) {
+	files, _, err := remotevfs.ListFilesWithOptions(remotevfs.ListOptions{Prefix: databasePrefix(name)})
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []Backup{}
+	for _, file := range files {
+		createdAt, err := time.Parse(timestampLayout, strings.TrimSuffix(path.Base(file.Key), ".db"))
+		if err != nil || !strings.HasSuffix(file.Key, ".db") {
+			// NOTE: staging objects of an interrupted backup or foreign objects
+			continue
+		}
+		backups = append(backups, Backup{Database: name, Key: file.Key, CreatedAt: createdAt, SizeBytes: file.Size})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+	return backups, nil
+}
+
+// Find returns the backup of the database with the given key.
+func Find(name, key string) (Backup, error) {
+	backups, err := List(name)
+	if err != nil {
+		return Backup{}, err
+	}
+	for _, backup := range backups {
+		if backup.Key == key {
+			return backup, nil
+		}
+	}
+	return Backup{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("backup %s of database %s not found", key, name), nil)
+}
+
+// FindAt returns the newest backup of the database taken at or before the given time.
+func FindAt(name string, at time.Time) (Backup, error) {
+	backups, err := List(name)
+	if err != nil {
+		return Backup{}, err
+	}
+	// NOTE: backups are sorted newest first
+	for _, backup := range backups {
+		if !backup.CreatedAt.After(at) {
+			return backup, nil
+		}
+	}
+	return Backup{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("no backup of database %s taken before %s", name, at.Format(time.RFC3339)), nil)
+}
+
+// RestoreTo copies the backup to the remote stage under the target database name, the target must not exist. The backup
+// is checked against its manifest first, see Download, the manifest returned is nil for the backups taken without one.
+func RestoreTo(backup Backup, target string) (*Manifest, error) {
+	uri, manifest, cleanup, err := Open(backup)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	if err := copyTo(uri, target); err != nil {
+		return nil, utils.NewError(utils.ErrorCodeStageUnavailable, "failed to restore backup", err)
+	}
+
+	utils.StagesLogger.Info("Backup restored.", zap.String("backup", backup.Key), zap.String("database", target), zap.Bool("verified", manifest != nil))
+	return manifest, nil
+}
+
+// copyTo copies the database opened by the URI to the remote stage under the target database name.
+func copyTo(uri string, target string) error {
+	// NOTE: the copies taken before they carried the tiered tables miss them, the database copied would fail to open
+	tiered, err := stages.ListsTieredTables(uri)
+	if err != nil {
+		return fmt.Errorf("failed to read source: %w", err)
+	}
+	if tiered {
+		return utils.NewError(utils.ErrorCodeConflict, "the copy lacks the tiered tables of its database, it can't be restored", nil)
+	}
+
+	source, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
+	}
+	defer source.Close()
+
+	_, err = source.Exec("VACUUM INTO ?", stages.RemoteConnectionString(utils.DatabaseFileName(target), stages.ConnectionOptions{WithoutPragmas: true}))
+	return err
+}
@@ -0,0 +1,233 @@
+package backups
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: every backup is described by a manifest stored next to it under <key>.manifest, the backups taken before the
+// manifests were written have none and are read unchecked
+const manifestSuffix = ".manifest"
+
+// NOTE: AES-256-GCM, the nonce is stored ahead of the sealed database
+const backupKeyLength = 32
+
+// Manifest describes a backup as it was taken, so that it is checked before being read. SizeBytes and SHA256 describe
+// the database copied, before it is compressed and encrypted.
+type Manifest struct {
+	Database      string    `json:"database"`
+	Key           string    `json:"key"`
+	CreatedAt     time.Time `json:"created_at"`
+	SizeBytes     int64     `json:"size_bytes"`
+	SHA256        string    `json:"sha256"`
+	Encrypted     bool      `json:"encrypted"`
+	KeyID         string    `json:"key_id,omitempty" doc:"Encryption key the key of the backup is derived from."`
+	Compression   string    `json:"compression,omitempty" enum:"gzip,zstd" doc:"Compression of the stored backup, left out when stored as is."`
+	SourceStage   uint      `json:"source_stage"`
+	WriteSequence uint64    `json:"write_sequence" doc:"Last write held by the copy of the database the backup was taken from."`
+}
+
+func manifestKey(key string) string {
+	return key + manifestSuffix
+}
+
+// backupCipher returns the cipher of the backups derived from the master key with the given ID, the keys retired from
+// active use still open the backups they encrypted.
+func backupCipher(keyID string) (cipher.AEAD, error) {
+	key, err := utils.GetEncryptionKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	derived, err := utils.DeriveEncryptionKey(key, "backups", backupKeyLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive backup encryption key: %w", err)
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the database under the key of the backup, bound to it so that it can't be passed off as another one.
+func seal(aead cipher.AEAD, body []byte, key string) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(body)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, body, []byte(key)), nil
+}
+
+func unseal(aead cipher.AEAD, body []byte, key string) ([]byte, error) {
+	if len(body) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted backup is truncated")
+	}
+	return aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], []byte(key))
+}
+
+// upload stores the database copied to the file as the backup, encrypted with the active key when the backups are, and
+// then its manifest, the backup only counts as verifiable once both are stored.
+func upload(path string, manifest *Manifest) error {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(body)
+	manifest.SizeBytes, manifest.SHA256 = int64(len(body)), hex.EncodeToString(digest[:])
+
+	// NOTE: compressed before being encrypted, the ciphertext doesn't compress
+	if compression := utils.Config.Backups.Compression; compression != utils.CompressionNone {
+		if body, err = utils.Compress(body, compression); err != nil {
+			return fmt.Errorf("failed to compress backup: %w", err)
+		}
+		manifest.Compression = compression
+	}
+
+	if utils.Config.Backups.EncryptionEnabled {
+		key, err := utils.GetActiveEncryptionKey()
+		if err != nil {
+			return fmt.Errorf("failed to get backup encryption key: %w", err)
+		}
+		aead, err := backupCipher(key.ID)
+		if err != nil {
+			return err
+		}
+		if body, err = seal(aead, body, manifest.Key); err != nil {
+			return err
+		}
+		manifest.Encrypted, manifest.KeyID = true, key.ID
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	if err := remotevfs.PutObject(ctx, manifest.Key, body, "application/octet-stream"); err != nil {
+		return err
+	}
+	return remotevfs.PutObject(ctx, manifestKey(manifest.Key), content, "application/json")
+}
+
+// ReadManifest returns the manifest of the backup, a not found error for the backups taken without one.
+func ReadManifest(backup Backup) (Manifest, error) {
+	content, _, err := remotevfs.GetObjectWithGeneration(context.Background(), manifestKey(backup.Key))
+	if errors.Is(err, remotevfs.ErrObjectNotFound) {
+		return Manifest{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("backup %s has no manifest", backup.Key), err)
+	}
+	if err != nil {
+		return Manifest{}, utils.NewError(utils.ErrorCodeStageUnavailable, "failed to read backup manifest", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return Manifest{}, utils.NewError(utils.ErrorCodeCorrupted, fmt.Sprintf("manifest of backup %s is invalid", backup.Key), err)
+	}
+	if manifest.Key != backup.Key {
+		return Manifest{}, utils.NewError(utils.ErrorCodeCorrupted, fmt.Sprintf("manifest of backup %s describes %s", backup.Key, manifest.Key), nil)
+	}
+	return manifest, nil
+}
+
+// Download writes the database of the backup to the file at path, decrypted and decompressed, once checked against its
+// manifest. A backup whose size or digest doesn't match is refused with a corrupted error and nothing is written. The
+// backups taken without manifest are written unchecked, the manifest returned is nil for them.
+func Download(backup Backup, path string) (*Manifest, error) {
+	manifest, err := ReadManifest(backup)
+	if utils.ErrorCodeOf(err) == utils.ErrorCodeNotFound {
+		utils.StagesLogger.Warn("Backup has no manifest, reading it unchecked.", zap.String("key", backup.Key))
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if _, err := remotevfs.DownloadObject(context.Background(), backup.Key, file); err != nil {
+			return nil, utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to download %s", backup.Key), err)
+		}
+		return nil, file.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	body, _, err := remotevfs.GetObjectWithGeneration(context.Background(), backup.Key)
+	if err != nil {
+		return nil, utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to download %s", backup.Key), err)
+	}
+	if manifest.Encrypted {
+		aead, err := backupCipher(manifest.KeyID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open backup %s: %w", backup.Key, err)
+		}
+		if body, err = unseal(aead, body, backup.Key); err != nil {
+			return nil, utils.NewError(utils.ErrorCodeCorrupted, fmt.Sprintf("backup %s fails its authentication", backup.Key), err)
+		}
+	}
+	if body, err = utils.Decompress(body, manifest.Compression); err != nil {
+		return nil, utils.NewError(utils.ErrorCodeCorrupted, fmt.Sprintf("backup %s can't be decompressed", backup.Key), err)
+	}
+
+	digest := sha256.Sum256(body)
+	if int64(len(body)) != manifest.SizeBytes || hex.EncodeToString(digest[:]) != manifest.SHA256 {
+		return nil, utils.NewError(utils.ErrorCodeCorrupted, fmt.Sprintf("backup %s doesn't match its manifest", backup.Key), nil)
+	}
+	return &manifest, os.WriteFile(path, body, 0o600)
+}
+
+// Open downloads the backup to a scratch directory like Download and returns the connection string opening it
+// read-only, along with the function removing it once read.
+func Open(backup Backup) (string, *Manifest, func(), error) {
+	scratch, err := os.MkdirTemp("", "persisto-backup-*")
+	if err != nil {
+		return "", nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(scratch) }
+
+	path := filepath.Join(scratch, utils.DatabaseFileName(backup.Database))
+	manifest, err := Download(backup, path)
+	if err != nil {
+		cleanup()
+		return "", nil, nil, err
+	}
+	return localConnectionString(path, true), manifest, cleanup, nil
+}
+
+// localConnectionString opens the file through the VFS of the operating system, the files attached by VACUUM INTO
+// would otherwise go through the VFS of the database copied, e.g. to the bucket.
+func localConnectionString(path string, readOnly bool) string {
+	if readOnly {
+		return "file:" + path + "?vfs=os&mode=ro&immutable=1"
+	}
+	return "file:" + path + "?vfs=os"
+}
+
+// Verify downloads the backup and checks it against its manifest like Download, without keeping it. The backups taken
+// without manifest can't be verified, they are reported as not found.
+func Verify(backup Backup) (Manifest, error) {
+	if _, err := ReadManifest(backup); err != nil {
+		return Manifest{}, err
+	}
+	_, manifest, cleanup, err := Open(backup)
+	if err != nil {
+		return Manifest{}, err
+	}
+	cleanup()
+	return *manifest, nil
+}
@@ -0,0 +1,84 @@
+package backups
+
+import (
+	"time"
+
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// Retain returns the backups kept by a grandfather-father-son policy: the newest backup of each of the last hourly
+// hours, daily days and weekly weeks, backups older than maxAge are dropped whatever their slot. Backups must be sorted
+// newest first.
+func Retain(backups []Backup, now time.Time, hourly, daily, weekly int, maxAge time.Duration) map[string]bool {
+	kept := make(map[string]bool)
+
+	slots := []struct {
+		count  int
+		period func(time.Time) time.Time
+	}{
+		{hourly, func(t time.Time) time.Time { return t.Truncate(time.Hour) }},
+		{daily, func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC) }},
+		{weekly, func(t time.Time) time.Time {
+			day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+			// NOTE: weeks start on monday
+			return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		}},
+	}
+
+	for _, slot := range slots {
+		seen := make(map[time.Time]bool)
+		for _, backup := range backups {
+			if len(seen) >= slot.count {
+				break
+			}
+			period := slot.period(backup.CreatedAt.UTC())
+			if seen[period] {
+				continue
+			}
+			// NOTE: backups are sorted newest first, the first one of a period is its newest
+			seen[period] = true
+			kept[backup.Key] = true
+		}
+	}
+
+	if maxAge > 0 {
+		for _, backup := range backups {
+			if now.Sub(backup.CreatedAt) > maxAge {
+				delete(kept, backup.Key)
+			}
+		}
+	}
+
+	return kept
+}
+
+// ApplyRetention deletes the backups of the database no longer retained by the configured policy and returns them.
+func ApplyRetention(name string, now time.Time) ([]Backup, error) {
+	backups, err := List(name)
+	if err != nil {
+		return nil, err
+	}
+
+	config := utils.Config.Backups
+	kept := Retain(backups, now, config.KeepHourly, config.KeepDaily, config.KeepWeekly, time.Duration(config.MaxAgeDays)*24*time.Hour)
+
+	var removed []Backup
+	for _, backup := range backups {
+		if kept[backup.Key] {
+			continue
+		}
+		if err := remotevfs.Delete(backup.Key); err != nil {
+			utils.StagesLogger.Warn("Failed to delete expired backup.", zap.String("key", backup.Key), zap.Error(err))
+			continue
+		}
+		// NOTE: a manifest left behind describes no backup, it is skipped by the listings
+		if err := remotevfs.Delete(manifestKey(backup.Key)); err != nil {
+			utils.StagesLogger.Warn("Failed to delete the manifest of expired backup.", zap.String("key", backup.Key), zap.Error(err))
+		}
+		removed = append(removed, backup)
+	}
+	return removed, nil
+}
@@ -0,0 +1,158 @@
+package backups
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: tags are part of the keys of the snapshots, they are kept free of characters needing escaping
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Snapshot is a copy of a database taken on demand and named by its tag. Unlike the backups, snapshots are never
+// pruned, they are kept until they are deleted.
+type Snapshot struct {
+	Database  string    `json:"database"`
+	Tag       string    `json:"tag"`
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+	SizeBytes int64     `json:"size_bytes"`
+}
+
+func snapshotPrefix(name string) string {
+	return utils.Config.Backups.SnapshotsPrefix + name + "/"
+}
+
+func snapshotKey(name string, tag string) string {
+	return snapshotPrefix(name) + tag + ".db"
+}
+
+// URI opens the snapshot read-only on the remote stage. A snapshot is never written once taken, it is opened immutable
+// so that its reads take no lock on the bucket.
+func (snapshot Snapshot) URI() string {
+	return stages.RemoteConnectionString(snapshot.Key, stages.ConnectionOptions{ReadOnly: true, Immutable: true, WithoutPragmas: true})
+}
+
+// CreateSnapshot takes a consistent snapshot of the database, from whichever stage it is on, named by the tag. A tag
+// is never reused, the snapshot it names must be deleted first.
+func CreateSnapshot(database stages.Database, tag string) (Snapshot, error) {
+	if !tagPattern.MatchString(tag) {
+		return Snapshot{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid snapshot tag %s, it must match %s", tag, tagPattern), nil)
+	}
+
+	key := snapshotKey(database.GetName(), tag)
+	if _, err := remotevfs.FileSize(key); err == nil {
+		return Snapshot{}, utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("snapshot %s of database %s already exists", tag, database.GetName()), nil)
+	}
+
+	// NOTE: the read lock keeps the database from moving to another stage while it is copied
+	database.GetMutex().RLock()
+	defer database.GetMutex().RUnlock()
+
+	// NOTE: the requests keep writing to the database while it is copied, it is opened read-only but not immutable
+	connectionString, err := stages.ConnectionString(database.GetName(), database.GetStage(), stages.ConnectionOptions{ReadOnly: true})
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	source, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer source.Close()
+
+	createdAt := time.Now().UTC().Truncate(time.Second)
+	start := time.Now()
+	if _, err := source.Exec("VACUUM INTO ?", stages.RemoteConnectionString(key, stages.ConnectionOptions{WithoutPragmas: true})); err != nil {
+		return Snapshot{}, utils.NewError(utils.ErrorCodeStageUnavailable, "failed to write snapshot", err)
+	}
+	// NOTE: the snapshot holds the tiered tables of the database, it is cloned without its companion
+	if err := stages.InlineTieredTables(stages.RemoteConnectionString(key, stages.ConnectionOptions{WithoutPragmas: true}), stages.TieredKey(database.GetName()), stages.TieredPath(database.GetName())); err != nil {
+		remotevfs.Delete(key)
+		return Snapshot{}, utils.NewError(utils.ErrorCodeStageUnavailable, "failed to copy the tiered tables into the snapshot", err)
+	}
+
+	size, err := remotevfs.FileSize(key)
+	if err != nil {
+		database.GetLogger().Warn("Failed to get snapshot size.", zap.String("key", key), zap.Error(err))
+	}
+
+	snapshot := Snapshot{Database: database.GetName(), Tag: tag, Key: key, CreatedAt: createdAt, SizeBytes: size}
+	database.GetLogger().Info("Database snapshot taken.", zap.String("tag", tag), zap.Int64("sizeBytes", size), zap.Duration("duration", time.Since(start)))
+
+	return snapshot, nil
+}
+
+// ListSnapshots returns the snapshots of the database, newest first.
+func ListSnapshots(name string) ([]Snapshot, error) {
+	files, _, err := remotevfs.ListFilesWithOptions(remotevfs.ListOptions{Prefix: snapshotPrefix(name)})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []Snapshot{}
+	for _, file := range files {
+		tag := strings.TrimSuffix(path.Base(file.Key), ".db")
+		if !strings.HasSuffix(file.Key, ".db") || file.Key != snapshotKey(name, tag) || !tagPattern.MatchString(tag) {
+			// NOTE: staging objects of an interrupted snapshot, nested or foreign objects
+			continue
+		}
+		snapshot := Snapshot{Database: name, Tag: tag, Key: file.Key, SizeBytes: file.Size}
+		if file.LastModified != nil {
+			snapshot.CreatedAt = file.LastModified.UTC()
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+// FindSnapshot returns the snapshot of the database with the given tag.
+func FindSnapshot(name string, tag string) (Snapshot, error) {
+	snapshots, err := ListSnapshots(name)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Tag == tag {
+			return snapshot, nil
+		}
+	}
+	return Snapshot{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("snapshot %s of database %s not found", tag, name), nil)
+}
+
+// DeleteSnapshot deletes the snapshot of the database with the given tag.
+func DeleteSnapshot(name string, tag string) error {
+	snapshot, err := FindSnapshot(name, tag)
+	if err != nil {
+		return err
+	}
+	if err := remotevfs.Delete(snapshot.Key); err != nil {
+		return utils.NewError(utils.ErrorCodeStageUnavailable, "failed to delete snapshot", err)
+	}
+	utils.StagesLogger.Info("Database snapshot deleted.", zap.String("database", name), zap.String("tag", tag))
+	return nil
+}
+
+// CloneSnapshotTo copies the snapshot to the remote stage under the target database name, the target must not exist.
+func CloneSnapshotTo(snapshot Snapshot, target string) error {
+	if err := copyTo(snapshot.URI(), target); err != nil {
+		return utils.NewError(utils.ErrorCodeStageUnavailable, "failed to clone snapshot", err)
+	}
+
+	utils.StagesLogger.Info("Snapshot cloned.", zap.String("snapshot", snapshot.Key), zap.String("database", target))
+	return nil
+}
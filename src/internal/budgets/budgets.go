@@ -0,0 +1,332 @@
+package budgets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: the consumption of every principal is counted over the current UTC day and month, the requests of a principal
+// having exhausted one of its budgets are refused until the period ends. The costs are estimated from the R2 prices:
+// the statements reaching a database served from the remote stage are counted as a class B operation for a read and a
+// class A operation for a write, and the bytes of the requests and responses as egress.
+
+// Budget bounds the consumption of a principal over a period, zero meaning unlimited.
+type Budget struct {
+	Queries int64   `json:"queries,omitempty" doc:"Queries allowed over the period."`
+	Bytes   int64   `json:"bytes,omitempty" doc:"Bytes of the requests and responses allowed over the period."`
+	Cost    float64 `json:"cost,omitempty" doc:"Estimated cost allowed over the period, in dollars."`
+}
+
+// Consumption is what a principal consumed over a period.
+type Consumption struct {
+	Queries int64   `json:"queries" doc:"Queries run."`
+	Bytes   int64   `json:"bytes" doc:"Bytes of the requests and responses."`
+	Cost    float64 `json:"cost" doc:"Estimated cost, in dollars."`
+}
+
+// Period is the consumption of a principal over a day or a month along with its budget.
+type Period struct {
+	Start       time.Time   `json:"start"`
+	End         time.Time   `json:"end"`
+	Consumption Consumption `json:"consumption"`
+	Budget      Budget      `json:"budget"`
+	Exhausted   bool        `json:"exhausted" doc:"Whether the requests of the principal are refused until the end of the period."`
+}
+
+// BudgetReport is the consumption of a principal over the current day and month.
+type BudgetReport struct {
+	Principal string `json:"principal"`
+	Day       Period `json:"day"`
+	Month     Period `json:"month"`
+}
+
+// Charge is what a request consumed.
+type Charge struct {
+	Queries int64
+	Bytes   int64
+	// NOTE: R2 operations the request is estimated to cost, writes are class A and reads class B
+	ClassA int64
+	ClassB int64
+}
+
+type account struct {
+	DayStart   time.Time   `json:"day_start"`
+	Day        Consumption `json:"day"`
+	MonthStart time.Time   `json:"month_start"`
+	Month      Consumption `json:"month"`
+}
+
+var (
+	budgetsSetupOnce sync.Once
+
+	accounts      = map[string]*account{}
+	accountsMutex sync.Mutex
+	// NOTE: whether the accounts changed since they were last saved
+	dirty bool
+)
+
+// SetupBudgets loads the consumption saved by the previous run and periodically saves it to the bucket, so that a
+// restart doesn't reset the budgets.
+func SetupBudgets() {
+	budgetsSetupOnce.Do(func() {
+		if !utils.Config.Budgets.Enabled {
+			utils.Logger.Info("Usage budgets disabled, not starting them.")
+			return
+		}
+
+		if err := load(); err != nil {
+			utils.Logger.Warn("Failed to load the consumption of the principals, starting from scratch.", zap.Error(err))
+		}
+
+		go func() {
+			interval := time.Duration(utils.Config.Budgets.SaveIntervalSeconds) * time.Second
+			utils.Logger.Info("Starting usage budgets.", zap.Duration("saveInterval", interval))
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				if err := save(); err != nil {
+					utils.Logger.Warn("Failed to save the consumption of the principals.", zap.Error(err))
+				}
+			}
+		}()
+	})
+}
+
+func consumptionKey() string {
+	return utils.Config.Budgets.Prefix + "consumption.json"
+}
+
+func load() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	body, _, err := remotevfs.GetObjectWithGeneration(ctx, consumptionKey())
+	if errors.Is(err, remotevfs.ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	saved := map[string]*account{}
+	if err := json.Unmarshal(body, &saved); err != nil {
+		return err
+	}
+
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	accounts = saved
+	return nil
+}
+
+func save() error {
+	accountsMutex.Lock()
+	if !dirty {
+		accountsMutex.Unlock()
+		return nil
+	}
+	body, err := json.Marshal(accounts)
+	dirty = false
+	accountsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := remotevfs.PutObject(ctx, consumptionKey(), body, "application/json"); err != nil {
+		accountsMutex.Lock()
+		dirty = true
+		accountsMutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+func dayStart(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func monthStart(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// accountOf returns the account of the principal with the periods ended reset, accountsMutex must be held.
+func accountOf(principal string, now time.Time) *account {
+	current, exists := accounts[principal]
+	if !exists {
+		current = &account{}
+		accounts[principal] = current
+	}
+	if start := dayStart(now); !current.DayStart.Equal(start) {
+		current.DayStart, current.Day = start, Consumption{}
+	}
+	if start := monthStart(now); !current.MonthStart.Equal(start) {
+		current.MonthStart, current.Month = start, Consumption{}
+	}
+	return current
+}
+
+// Budgets returns the daily and monthly budgets BUDGETS_LIMITS sets for the principal, those of the principal
+// replacing the ones of every principal.
+func Budgets(principal string) (Budget, Budget) {
+	return budgetsFrom(utils.Config.Budgets.Limits, principal)
+}
+
+// budgetsFrom returns the daily and monthly budgets the entries in the format of BUDGETS_LIMITS set for the principal.
+func budgetsFrom(entries []string, principal string) (Budget, Budget) {
+	var daily, monthly Budget
+	for _, owner := range []string{"*", principal} {
+		for _, entry := range entries {
+			name, limits, _ := strings.Cut(strings.TrimSpace(entry), ":")
+			if name != owner {
+				continue
+			}
+			for _, limit := range strings.Split(limits, "+") {
+				name, value, _ := strings.Cut(limit, "=")
+				switch name {
+				case "daily_queries":
+					daily.Queries, _ = strconv.ParseInt(value, 10, 64)
+				case "monthly_queries":
+					monthly.Queries, _ = strconv.ParseInt(value, 10, 64)
+				case "daily_bytes":
+					daily.Bytes, _ = strconv.ParseInt(value, 10, 64)
+				case "monthly_bytes":
+					monthly.Bytes, _ = strconv.ParseInt(value, 10, 64)
+				case "daily_cost":
+					daily.Cost, _ = strconv.ParseFloat(value, 64)
+				case "monthly_cost":
+					monthly.Cost, _ = strconv.ParseFloat(value, 64)
+				}
+			}
+		}
+	}
+	return daily, monthly
+}
+
+// exhausted reports whether the consumption reached one of the limits of the budget.
+func (budget Budget) exhausted(consumption Consumption) bool {
+	return (budget.Queries > 0 && consumption.Queries >= budget.Queries) ||
+		(budget.Bytes > 0 && consumption.Bytes >= budget.Bytes) ||
+		(budget.Cost > 0 && consumption.Cost >= budget.Cost)
+}
+
+// Check fails with a busy error when the principal exhausted its daily or monthly budget, along with the time its
+// requests are accepted again.
+func Check(principal string) (time.Time, error) {
+	if !utils.Config.Budgets.Enabled || principal == "" {
+		return time.Time{}, nil
+	}
+
+	daily, monthly := Budgets(principal)
+	now := time.Now().UTC()
+
+	accountsMutex.Lock()
+	current := *accountOf(principal, now)
+	accountsMutex.Unlock()
+
+	if monthly.exhausted(current.Month) {
+		until := current.MonthStart.AddDate(0, 1, 0)
+		return until, utils.NewError(utils.ErrorCodeBusy, fmt.Sprintf("principal %s exhausted its monthly budget, its requests are refused until %s", principal, until.Format(time.RFC3339)), nil)
+	}
+	if daily.exhausted(current.Day) {
+		until := current.DayStart.AddDate(0, 0, 1)
+		return until, utils.NewError(utils.ErrorCodeBusy, fmt.Sprintf("principal %s exhausted its daily budget, its requests are refused until %s", principal, until.Format(time.RFC3339)), nil)
+	}
+	return time.Time{}, nil
+}
+
+// Record adds what a request of the principal consumed to its daily and monthly consumption.
+func Record(principal string, charge Charge) {
+	if !utils.Config.Budgets.Enabled || principal == "" {
+		return
+	}
+
+	prices := utils.Config.Budgets
+	cost := float64(charge.ClassA)*prices.ClassAPrice/1e6 + float64(charge.ClassB)*prices.ClassBPrice/1e6 + float64(charge.Bytes)*prices.EgressPrice/1e9
+
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+
+	current := accountOf(principal, time.Now().UTC())
+	for _, consumption := range []*Consumption{&current.Day, &current.Month} {
+		consumption.Queries += charge.Queries
+		consumption.Bytes += charge.Bytes
+		consumption.Cost += cost
+	}
+	dirty = true
+}
+
+// ReportOf returns the consumption of the principal over the current day and month.
+func ReportOf(principal string) BudgetReport {
+	return reportWith(utils.Config.Budgets.Limits, principal)
+}
+
+func reportWith(entries []string, principal string) BudgetReport {
+	daily, monthly := budgetsFrom(entries, principal)
+	now := time.Now().UTC()
+
+	accountsMutex.Lock()
+	current := *accountOf(principal, now)
+	accountsMutex.Unlock()
+
+	return BudgetReport{
+		Principal: principal,
+		Day:       Period{Start: current.DayStart, End: current.DayStart.AddDate(0, 0, 1), Consumption: current.Day, Budget: daily, Exhausted: daily.exhausted(current.Day)},
+		Month:     Period{Start: current.MonthStart, End: current.MonthStart.AddDate(0, 1, 0), Consumption: current.Month, Budget: monthly, Exhausted: monthly.exhausted(current.Month)},
+	}
+}
+
+// Reports returns the consumption of the given principals, sorted by name.
+func Reports(principals []string) []BudgetReport {
+	sorted := append([]string{}, principals...)
+	sort.Strings(sorted)
+
+	reports := make([]BudgetReport, 0, len(sorted))
+	for _, principal := range sorted {
+		reports = append(reports, ReportOf(principal))
+	}
+	return reports
+}
+
+// Simulate returns the consumption of the given principals over the current day and month against the budgets the
+// entries in the format of BUDGETS_LIMITS would set, without changing the configured ones.
+func Simulate(entries []string, principals []string) []BudgetReport {
+	sorted := append([]string{}, principals...)
+	sort.Strings(sorted)
+
+	reports := make([]BudgetReport, 0, len(sorted))
+	for _, principal := range sorted {
+		reports = append(reports, reportWith(entries, principal))
+	}
+	return reports
+}
+
+type queriesKey struct{}
+
+// WithQueries returns the context of a request whose handler counts the queries it runs through CountQueries.
+func WithQueries(ctx context.Context) (context.Context, *int64) {
+	queries := new(int64)
+	return context.WithValue(ctx, queriesKey{}, queries), queries
+}
+
+// CountQueries records the queries run by the request of the context, see WithQueries.
+func CountQueries(ctx context.Context, queries int) {
+	if counter, ok := ctx.Value(queriesKey{}).(*int64); ok {
+		*counter += int64(queries)
+	}
+}
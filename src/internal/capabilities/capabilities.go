@@ -0,0 +1,97 @@
+package capabilities
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"persisto/src/utils"
+	"persisto/src/vfs"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+)
+
+// Capabilities is what the embedded SQLite supports, along with the VFSes the databases are opened through.
+type Capabilities struct {
+	Version        string     `json:"version,omitempty" doc:"Version of persisto."`
+	SQLiteVersion  string     `json:"sqlite_version" example:"3.50.1"`
+	CompileOptions []string   `json:"compile_options" doc:"Options SQLite was compiled with, as PRAGMA compile_options reports them."`
+	Extensions     []string   `json:"extensions" doc:"Features enabled at compile time, e.g. fts5 or rtree, from the ENABLE_ compile options."`
+	Modules        []string   `json:"modules" doc:"Virtual table modules, e.g. fts5 or json_each."`
+	Functions      []string   `json:"functions" doc:"SQL functions, the built-in ones and those of the extensions."`
+	VFS            []vfs.Info `json:"vfs"`
+}
+
+var (
+	// NOTE: the embedded SQLite doesn't change while the server runs, it is only read once
+	sqlite      Capabilities
+	sqliteErr   error
+	sqliteReady sync.Once
+)
+
+// Read returns the capabilities of the embedded SQLite and the VFSes registered.
+func Read() (Capabilities, error) {
+	sqliteReady.Do(func() { sqlite, sqliteErr = readSQLite() })
+	if sqliteErr != nil {
+		return Capabilities{}, sqliteErr
+	}
+
+	capabilities := sqlite
+	capabilities.Version = utils.Config.Server.Version
+	capabilities.VFS = vfs.Registered()
+	return capabilities, nil
+}
+
+func readSQLite() (Capabilities, error) {
+	var capabilities Capabilities
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return capabilities, fmt.Errorf("failed to open SQLite: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.QueryRow("SELECT sqlite_version()").Scan(&capabilities.SQLiteVersion); err != nil {
+		return capabilities, fmt.Errorf("failed to read SQLite version: %v", err)
+	}
+	if capabilities.CompileOptions, err = readNames(db, "PRAGMA compile_options"); err != nil {
+		return capabilities, fmt.Errorf("failed to read SQLite compile options: %v", err)
+	}
+	// NOTE: the pragmas readable as table-valued functions are modules too, they aren't features of their own
+	if capabilities.Modules, err = readNames(db, "SELECT name FROM pragma_module_list WHERE name NOT LIKE 'pragma_%' ORDER BY name"); err != nil {
+		return capabilities, fmt.Errorf("failed to read SQLite modules: %v", err)
+	}
+	if capabilities.Functions, err = readNames(db, "SELECT DISTINCT name FROM pragma_function_list ORDER BY name"); err != nil {
+		return capabilities, fmt.Errorf("failed to read SQLite functions: %v", err)
+	}
+
+	capabilities.Extensions = []string{}
+	for _, option := range capabilities.CompileOptions {
+		if extension, enabled := strings.CutPrefix(option, "ENABLE_"); enabled {
+			capabilities.Extensions = append(capabilities.Extensions, strings.ToLower(extension))
+		}
+	}
+	slices.Sort(capabilities.Extensions)
+	return capabilities, nil
+}
+
+func readNames(db *sql.DB, query string) ([]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
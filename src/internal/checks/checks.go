@@ -0,0 +1,330 @@
+package checks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"persisto/src/utils"
+)
+
+// NOTE: the checks are stored in the database they verify, they follow it across stages, backups and replicas, so that
+// a copy is verified against the checks it holds itself, without the catalog. They run on every copy the database is
+// moved or restored to, after the generic integrity checks, to validate the invariants of the application.
+const Table = "_persisto_checks"
+
+// NOTE: comparisons of the first value a check returns with its expected value
+const (
+	ComparisonEqual          = "eq"
+	ComparisonNotEqual       = "ne"
+	ComparisonGreater        = "gt"
+	ComparisonGreaterOrEqual = "gte"
+	ComparisonLess           = "lt"
+	ComparisonLessOrEqual    = "lte"
+)
+
+// Comparisons are the comparisons a check may assert.
+var Comparisons = []string{ComparisonEqual, ComparisonNotEqual, ComparisonGreater, ComparisonGreaterOrEqual, ComparisonLess, ComparisonLessOrEqual}
+
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Check is a read query asserting an invariant of the database, e.g. SELECT count(*) FROM orders.
+type Check struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	// NOTE: without expected value the check passes when its first value is neither NULL, 0, false nor empty, like the
+	// verification queries of the drills
+	Comparison string `json:"comparison,omitempty" enum:"eq,ne,gt,gte,lt,lte"`
+	Expected   string `json:"expected,omitempty"`
+}
+
+// CheckResult is the outcome of a check on a copy of the database.
+type CheckResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Value  string `json:"value,omitempty" doc:"First value returned by the query, as text."`
+	Error  string `json:"error,omitempty"`
+}
+
+// Executor runs the statements managing the checks of a database.
+type Executor interface {
+	Query(query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, error)
+	ExecuteTransaction(queries []string, parameters [][]any) ([]utils.ExecResultType, int, error)
+}
+
+// Querier reads a copy of the database the checks run on, a *sql.DB or a *sql.Conn.
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// List returns the checks of the database.
+func List(database Executor) ([]Check, error) {
+	exists, err := tableExists(database)
+	if err != nil || !exists {
+		return []Check{}, err
+	}
+
+	rows, _, err := database.Query("SELECT name, query, comparison, expected FROM " + Table + " ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	checks := make([]Check, 0, len(rows))
+	for _, row := range rows {
+		check := Check{}
+		check.Name, _ = row["name"].(string)
+		check.Query, _ = row["query"].(string)
+		check.Comparison, _ = row["comparison"].(string)
+		check.Expected, _ = row["expected"].(string)
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// Find returns the check of the database.
+func Find(database Executor, name string) (Check, error) {
+	checks, err := List(database)
+	if err != nil {
+		return Check{}, err
+	}
+	for _, check := range checks {
+		if check.Name == name {
+			return check, nil
+		}
+	}
+	return Check{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("check %s not found", name), nil)
+}
+
+// Set creates or replaces the check once its query ran on the database, it returns the check and its current result.
+func Set(database Executor, check Check) (Check, CheckResult, error) {
+	if !namePattern.MatchString(check.Name) {
+		return Check{}, CheckResult{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid check name %s, it must match %s", check.Name, namePattern), nil)
+	}
+	if strings.TrimSpace(check.Query) == "" {
+		return Check{}, CheckResult{}, utils.NewError(utils.ErrorCodeInvalidInput, "the query of a check can't be empty", nil)
+	}
+	if check.Comparison != "" && !slices.Contains(Comparisons, check.Comparison) {
+		return Check{}, CheckResult{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("unknown comparison %s, the comparisons are %s", check.Comparison, strings.Join(Comparisons, ", ")), nil)
+	}
+	if check.Comparison != "" && check.Expected == "" {
+		return Check{}, CheckResult{}, utils.NewError(utils.ErrorCodeInvalidInput, "a comparison needs an expected value", nil)
+	}
+	if check.Comparison == "" && check.Expected != "" {
+		check.Comparison = ComparisonEqual
+	}
+
+	// NOTE: a query failing now would fail every verification, the moves and restores of the database with it
+	rows, columns, err := database.Query(check.Query)
+	if err != nil {
+		return Check{}, CheckResult{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("the query of check %s failed", check.Name), err)
+	}
+	result := CheckResult{Name: check.Name}
+	if len(rows) == 0 || len(columns) == 0 {
+		result.Error = "no rows returned"
+	} else if value := rows[0][columns[0].Name]; value != nil {
+		evaluate(&result, check, formatValue(value), true)
+	} else {
+		evaluate(&result, check, "", false)
+	}
+
+	queries := []string{
+		"CREATE TABLE IF NOT EXISTS " + Table + " (name TEXT PRIMARY KEY, query TEXT NOT NULL, comparison TEXT, expected TEXT)",
+		"INSERT INTO " + Table + " (name, query, comparison, expected) VALUES (?, ?, ?, ?) ON CONFLICT (name) DO UPDATE SET query = excluded.query, comparison = excluded.comparison, expected = excluded.expected",
+	}
+	parameters := [][]any{nil, {check.Name, check.Query, nullable(check.Comparison), nullable(check.Expected)}}
+	if _, _, err := database.ExecuteTransaction(queries, parameters); err != nil {
+		return Check{}, CheckResult{}, err
+	}
+	return check, result, nil
+}
+
+// Remove deletes the check.
+func Remove(database Executor, name string) error {
+	if _, err := Find(database, name); err != nil {
+		return err
+	}
+	_, _, err := database.ExecuteTransaction([]string{"DELETE FROM " + Table + " WHERE name = ?"}, [][]any{{name}})
+	return err
+}
+
+// Run runs the checks the copy of the database holds on it, none when it holds none.
+func Run(ctx context.Context, source Querier) ([]CheckResult, error) {
+	// NOTE: the table is only created with the first check
+	tables, err := source.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", Table)
+	if err != nil {
+		return nil, err
+	}
+	exists := tables.Next()
+	tables.Close()
+	if err := tables.Err(); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return []CheckResult{}, nil
+	}
+
+	rows, err := source.QueryContext(ctx, "SELECT name, query, COALESCE(comparison, ''), COALESCE(expected, '') FROM "+Table+" ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	var checks []Check
+	for rows.Next() {
+		var check Check
+		if err := rows.Scan(&check.Name, &check.Query, &check.Comparison, &check.Expected); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	results := make([]CheckResult, 0, len(checks))
+	for _, check := range checks {
+		results = append(results, run(ctx, source, check))
+	}
+	return results, nil
+}
+
+// Verify runs the checks the copy of the database holds on it, failing unless they all pass.
+func Verify(ctx context.Context, source Querier) ([]CheckResult, error) {
+	results, err := Run(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run the checks: %w", err)
+	}
+	return results, Failed(results)
+}
+
+// Failed returns an error describing the checks which didn't pass, nil when they all did.
+func Failed(results []CheckResult) error {
+	var failures []error
+	for _, result := range results {
+		switch {
+		case result.Error != "":
+			failures = append(failures, fmt.Errorf("check %s failed: %s", result.Name, result.Error))
+		case !result.Passed:
+			failures = append(failures, fmt.Errorf("check %s failed with %q", result.Name, result.Value))
+		}
+	}
+	return errors.Join(failures...)
+}
+
+func run(ctx context.Context, source Querier, check Check) CheckResult {
+	result := CheckResult{Name: check.Name}
+
+	rows, err := source.QueryContext(ctx, check.Query)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer rows.Close()
+
+	// NOTE: only the first value of the first row counts, e.g. SELECT count(*) FROM orders
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Error = "no rows returned"
+		}
+		return result
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	values := make([]sql.NullString, len(columns))
+	destinations := make([]any, len(columns))
+	for index := range values {
+		destinations[index] = &values[index]
+	}
+	if err := rows.Scan(destinations...); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	evaluate(&result, check, values[0].String, values[0].Valid)
+	return result
+}
+
+// evaluate asserts the first value returned by the check, valid unless NULL.
+func evaluate(result *CheckResult, check Check, value string, valid bool) {
+	result.Value = value
+	if check.Comparison == "" {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "", "0", "false":
+		default:
+			result.Passed = valid
+		}
+		return
+	}
+	if !valid {
+		result.Error = "the query returned NULL"
+		return
+	}
+
+	// NOTE: compared as numbers when both are, e.g. 10 and 9.5, as text otherwise
+	comparison := strings.Compare(value, check.Expected)
+	actual, actualErr := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	expected, expectedErr := strconv.ParseFloat(strings.TrimSpace(check.Expected), 64)
+	if actualErr == nil && expectedErr == nil {
+		comparison = compareNumbers(actual, expected)
+	} else if check.Comparison != ComparisonEqual && check.Comparison != ComparisonNotEqual {
+		result.Error = fmt.Sprintf("%q and %q can't be ordered, only numbers can", value, check.Expected)
+		return
+	}
+
+	switch check.Comparison {
+	case ComparisonEqual:
+		result.Passed = comparison == 0
+	case ComparisonNotEqual:
+		result.Passed = comparison != 0
+	case ComparisonGreater:
+		result.Passed = comparison > 0
+	case ComparisonGreaterOrEqual:
+		result.Passed = comparison >= 0
+	case ComparisonLess:
+		result.Passed = comparison < 0
+	case ComparisonLessOrEqual:
+		result.Passed = comparison <= 0
+	}
+}
+
+func compareNumbers(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func formatValue(value any) string {
+	switch value := value.(type) {
+	case []byte:
+		return string(value)
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func tableExists(database Executor) (bool, error) {
+	rows, _, err := database.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", Table)
+	return len(rows) > 0, err
+}
+
+func nullable(value string) any {
+	if value == "" {
+		return nil
+	}
+	return value
+}
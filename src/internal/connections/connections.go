@@ -0,0 +1,135 @@
+package connections
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"sync"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/driver"
+)
+
+// NOTE: order of the hooks of persisto, the hooks of other features run in between
+const (
+	// NOTE: pragmas and limits of the connection
+	OrderSettings = 100
+	// NOTE: functions, collations and attached databases the statements can use
+	OrderExtensions = 200
+	// NOTE: policies restricting what the statements of the connection may do
+	OrderRestrictions = 300
+	// NOTE: tracing and profiling of the statements
+	OrderObservers = 400
+)
+
+// Authorizer is the signature of the SQLite authorizer callbacks.
+type Authorizer = func(action sqlite3.AuthorizerActionCode, name3rd, name4th, schema, inner string) sqlite3.AuthorizerReturnCode
+
+// Connection is a connection being opened to a database, handed to every hook.
+type Connection struct {
+	Conn     *sql.Conn
+	Database string
+	// NOTE: empty for the statements persisto runs itself
+	Principal string
+	Endpoint  string
+	// NOTE: set for the read-only connections to the replicas of a follower
+	Replica bool
+
+	authorizers []Authorizer
+	values      map[any]any
+}
+
+// Hook runs on every new connection to the databases it applies to, before any statement of the client. A failing hook
+// fails the connection.
+type Hook struct {
+	// NOTE: registering a hook with the name of another one replaces it
+	Name string
+	// NOTE: the hooks run by increasing order, then by order of registration
+	Order int
+	// NOTE: empty for every database
+	Database string
+	Open     func(ctx context.Context, connection *Connection) error
+}
+
+var (
+	hooks      []Hook
+	hooksMutex sync.RWMutex
+)
+
+// Register adds the hook run on every new connection.
+func Register(hook Hook) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+
+	hooks = slices.DeleteFunc(hooks, func(registered Hook) bool { return registered.Name == hook.Name })
+	index, _ := slices.BinarySearchFunc(hooks, hook.Order, func(registered Hook, order int) int {
+		// NOTE: after the hooks of the same order, which were registered first
+		if registered.Order <= order {
+			return -1
+		}
+		return 1
+	})
+	hooks = slices.Insert(hooks, index, hook)
+}
+
+// Unregister removes the hook with the given name, e.g. once the database it applies to is deleted.
+func Unregister(name string) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+
+	hooks = slices.DeleteFunc(hooks, func(registered Hook) bool { return registered.Name == name })
+}
+
+// Open runs the hooks of the database on the connection, then sets the authorizers they added. Only one authorizer can
+// be set on a connection, they are chained so that a statement is allowed only when all of them allow it.
+func Open(ctx context.Context, connection *Connection) error {
+	hooksMutex.RLock()
+	registered := slices.Clone(hooks)
+	hooksMutex.RUnlock()
+
+	for _, hook := range registered {
+		if hook.Database != "" && hook.Database != connection.Database {
+			continue
+		}
+		// NOTE: the errors are returned as is, the hooks describe what failed and some of them are errors of the client
+		if err := hook.Open(ctx, connection); err != nil {
+			return err
+		}
+	}
+
+	if len(connection.authorizers) == 0 {
+		return nil
+	}
+	authorizers := connection.authorizers
+	return connection.Conn.Raw(func(driverConn any) error {
+		return driverConn.(driver.Conn).Raw().SetAuthorizer(func(action sqlite3.AuthorizerActionCode, name3rd, name4th, schema, inner string) sqlite3.AuthorizerReturnCode {
+			for _, authorizer := range authorizers {
+				if code := authorizer(action, name3rd, name4th, schema, inner); code != sqlite3.AUTH_OK {
+					return code
+				}
+			}
+			return sqlite3.AUTH_OK
+		})
+	})
+}
+
+// Authorize adds an authorizer to the connection, run after the ones of the hooks that ran before.
+func (connection *Connection) Authorize(authorizer Authorizer) {
+	if authorizer != nil {
+		connection.authorizers = append(connection.authorizers, authorizer)
+	}
+}
+
+// SetValue keeps a value a hook computed for the callers of the connection, the key is a type of the package of the
+// hook like with context.WithValue.
+func (connection *Connection) SetValue(key any, value any) {
+	if connection.values == nil {
+		connection.values = map[any]any{}
+	}
+	connection.values[key] = value
+}
+
+// Value returns the value kept by a hook, nil when it didn't run.
+func (connection *Connection) Value(key any) any {
+	return connection.values[key]
+}
@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"sync"
+
+	"persisto/src/internal/coordination"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+var (
+	coordinationSetupOnce sync.Once
+)
+
+func SetupCoordination() {
+	coordinationSetupOnce.Do(func() {
+		coordination.Setup(func(name string) {
+			if databases.Dbs == nil {
+				return
+			}
+
+			database, err := databases.Dbs.FindByName(name)
+			if err != nil {
+				return
+			}
+
+			if err := stages.DropLocalCopy(database); err != nil {
+				utils.Logger.Error("Failed to drop local copy of database after losing its lease.", zap.String("database", name), zap.Error(err))
+			}
+		})
+	})
+}
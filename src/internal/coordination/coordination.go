@@ -0,0 +1,301 @@
+package coordination
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// Lease is the object stored in the bucket for every database written by an instance, the holder is the only instance
+// allowed to write and move the database until the lease expires.
+type Lease struct {
+	Database  string    `json:"database"`
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NOTE: lease held by the active instance, standbys take over once it expires. Database names can't contain a slash so
+// it never collides with the lease of a database.
+const ActiveLease = "instances/active"
+
+// heldLease is a lease held by this instance along with the generation of its object, needed to renew it.
+type heldLease struct {
+	Lease
+	generation string
+}
+
+var (
+	instanceID string
+
+	heldLeases      = map[string]*heldLease{}
+	heldLeasesMutex sync.Mutex
+
+	setupOnce sync.Once
+)
+
+// InstanceID returns the identifier under which this instance holds its leases.
+func InstanceID() string {
+	return instanceID
+}
+
+// Setup starts renewing the leases held by this instance, nothing is done when coordination is disabled. onLost is
+// called with the databases whose lease was taken over by another instance.
+func Setup(onLost func(name string)) {
+	setupOnce.Do(func() {
+		instanceID = utils.Config.Coordination.InstanceID
+		if instanceID == "" {
+			// NOTE: the random suffix keeps restarted instances from taking over the leases of their previous run
+			hostname, _ := os.Hostname()
+			suffix := make([]byte, 4)
+			rand.Read(suffix)
+			instanceID = fmt.Sprintf("%s-%s", hostname, hex.EncodeToString(suffix))
+		}
+
+		if !utils.Config.Coordination.Enabled {
+			return
+		}
+
+		go func() {
+			interval := time.Duration(utils.Config.Coordination.RenewIntervalSeconds) * time.Second
+			utils.StagesLogger.Info("Starting lease renewal.", zap.String("instance", instanceID), zap.Duration("interval", interval))
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				for _, name := range renewLeases() {
+					onLost(name)
+				}
+			}
+		}()
+	})
+}
+
+func leaseKey(name string) string {
+	return utils.Config.Coordination.LeasePrefix + name + ".json"
+}
+
+func leaseDuration() time.Duration {
+	return time.Duration(utils.Config.Coordination.LeaseSeconds) * time.Second
+}
+
+// Holds reports whether this instance currently holds the lease of the database, always true when coordination is
+// disabled. It only looks at the local state and is meant for the automatic stage movements.
+func Holds(name string) bool {
+	if !utils.Config.Coordination.Enabled {
+		return true
+	}
+
+	heldLeasesMutex.Lock()
+	defer heldLeasesMutex.Unlock()
+
+	lease, exists := heldLeases[name]
+	return exists && time.Now().Before(lease.ExpiresAt)
+}
+
+// Acquire makes sure this instance holds the lease of the database before it is written or moved, taking it over when
+// it is free or expired. A read_only error naming the holder is returned when another instance holds it.
+func Acquire(name string) error {
+	if !utils.Config.Coordination.Enabled || Holds(name) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	generation := ""
+	body, currentGeneration, err := remotevfs.GetObjectWithGeneration(ctx, leaseKey(name))
+	switch {
+	case errors.Is(err, remotevfs.ErrObjectNotFound):
+	case err != nil:
+		return utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to read the lease of database %s", name), err)
+	default:
+		var current Lease
+		if err := json.Unmarshal(body, &current); err != nil {
+			utils.StagesLogger.Warn("Ignoring unreadable lease.", zap.String("database", name), zap.Error(err))
+		} else if current.Holder != instanceID && time.Now().Before(current.ExpiresAt) {
+			return notHolderError(current)
+		}
+		generation = currentGeneration
+	}
+
+	lease := &heldLease{Lease: Lease{Database: name, Holder: instanceID, ExpiresAt: time.Now().Add(leaseDuration())}}
+	lease.generation, err = writeLease(ctx, lease.Lease, generation)
+	if errors.Is(err, remotevfs.ErrPreconditionFailed) {
+		return utils.NewError(utils.ErrorCodeReadOnly, fmt.Sprintf("database %s was just acquired by another instance", name), nil)
+	}
+	if err != nil {
+		return utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to acquire the lease of database %s", name), err)
+	}
+
+	heldLeasesMutex.Lock()
+	heldLeases[name] = lease
+	heldLeasesMutex.Unlock()
+
+	utils.StagesLogger.Info("Lease acquired.", zap.String("database", name), zap.Time("expiresAt", lease.ExpiresAt))
+	return nil
+}
+
+// Lookup returns the current lease of the database as stored in the bucket, whoever holds it. It reports false when
+// the database has no lease.
+func Lookup(name string) (Lease, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	body, _, err := remotevfs.GetObjectWithGeneration(ctx, leaseKey(name))
+	if errors.Is(err, remotevfs.ErrObjectNotFound) {
+		return Lease{}, false, nil
+	}
+	if err != nil {
+		return Lease{}, false, utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to read the lease of %s", name), err)
+	}
+
+	var lease Lease
+	if err := json.Unmarshal(body, &lease); err != nil {
+		return Lease{}, false, utils.NewError(utils.ErrorCodeInternal, fmt.Sprintf("lease of %s is unreadable", name), err)
+	}
+	return lease, true, nil
+}
+
+// TakeOver acquires the lease even when another instance still holds it, used by a forced promotion once the previous
+// holder is known to be stopped. A holder still running loses the lease on its next renewal.
+func TakeOver(name string) error {
+	if !utils.Config.Coordination.Enabled || Holds(name) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	generation := ""
+	_, currentGeneration, err := remotevfs.GetObjectWithGeneration(ctx, leaseKey(name))
+	switch {
+	case errors.Is(err, remotevfs.ErrObjectNotFound):
+	case err != nil:
+		return utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to read the lease of %s", name), err)
+	default:
+		generation = currentGeneration
+	}
+
+	lease := &heldLease{Lease: Lease{Database: name, Holder: instanceID, ExpiresAt: time.Now().Add(leaseDuration())}}
+	lease.generation, err = writeLease(ctx, lease.Lease, generation)
+	if errors.Is(err, remotevfs.ErrPreconditionFailed) {
+		return utils.NewError(utils.ErrorCodeReadOnly, fmt.Sprintf("lease of %s was just acquired by another instance", name), nil)
+	}
+	if err != nil {
+		return utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to take over the lease of %s", name), err)
+	}
+
+	heldLeasesMutex.Lock()
+	heldLeases[name] = lease
+	heldLeasesMutex.Unlock()
+
+	utils.StagesLogger.Warn("Lease taken over.", zap.String("database", name), zap.Time("expiresAt", lease.ExpiresAt))
+	return nil
+}
+
+// Release gives up the lease of the database, e.g. once it is deleted, so another instance can take it right away.
+func Release(name string) {
+	if !utils.Config.Coordination.Enabled {
+		return
+	}
+
+	heldLeasesMutex.Lock()
+	lease, exists := heldLeases[name]
+	delete(heldLeases, name)
+	heldLeasesMutex.Unlock()
+
+	if !exists {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := remotevfs.DeleteObjectIfGeneration(ctx, leaseKey(name), lease.generation); err != nil && !errors.Is(err, remotevfs.ErrObjectNotFound) {
+		utils.StagesLogger.Warn("Failed to release lease, it will expire.", zap.String("database", name), zap.Error(err))
+	}
+}
+
+// Leases returns the leases held by this instance.
+func Leases() []Lease {
+	heldLeasesMutex.Lock()
+	defer heldLeasesMutex.Unlock()
+
+	result := make([]Lease, 0, len(heldLeases))
+	for _, lease := range heldLeases {
+		result = append(result, lease.Lease)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Database < result[j].Database
+	})
+	return result
+}
+
+// renewLeases extends the leases held by this instance and returns the ones lost to another instance.
+func renewLeases() []string {
+	heldLeasesMutex.Lock()
+	leases := make([]heldLease, 0, len(heldLeases))
+	for _, lease := range heldLeases {
+		leases = append(leases, *lease)
+	}
+	heldLeasesMutex.Unlock()
+
+	var lost []string
+	for _, lease := range leases {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		renewed := heldLease{Lease: lease.Lease}
+		renewed.ExpiresAt = time.Now().Add(leaseDuration())
+		generation, err := writeLease(ctx, renewed.Lease, lease.generation)
+		cancel()
+
+		heldLeasesMutex.Lock()
+		switch {
+		case errors.Is(err, remotevfs.ErrPreconditionFailed), errors.Is(err, remotevfs.ErrObjectNotFound):
+			// NOTE: the lease object was overwritten, another instance took it over after it expired, unless it was just released
+			if _, exists := heldLeases[lease.Database]; exists {
+				delete(heldLeases, lease.Database)
+				lost = append(lost, lease.Database)
+				utils.StagesLogger.Error("Lease lost to another instance.", zap.String("database", lease.Database))
+			}
+		case err != nil:
+			// NOTE: kept until it expires, the next renewal may succeed
+			utils.StagesLogger.Warn("Failed to renew lease.", zap.String("database", lease.Database), zap.Time("expiresAt", lease.ExpiresAt), zap.Error(err))
+		default:
+			if current, exists := heldLeases[lease.Database]; exists {
+				current.ExpiresAt = renewed.ExpiresAt
+				current.generation = generation
+			}
+		}
+		heldLeasesMutex.Unlock()
+	}
+	return lost
+}
+
+func writeLease(ctx context.Context, lease Lease, generation string) (string, error) {
+	body, err := json.Marshal(lease)
+	if err != nil {
+		return "", err
+	}
+	return remotevfs.PutObjectIfGeneration(ctx, leaseKey(lease.Database), body, "application/json", generation)
+}
+
+func notHolderError(lease Lease) error {
+	return utils.NewError(
+		utils.ErrorCodeReadOnly,
+		fmt.Sprintf("database %s is written by instance %s until %s, send the writes there", lease.Database, lease.Holder, lease.ExpiresAt.Format(time.RFC3339)),
+		nil,
+	)
+}
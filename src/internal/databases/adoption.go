@@ -0,0 +1,103 @@
+package databases
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: objects written this recently are left for the next listing, a database being created at the remote stage is
+// written to the bucket before it enters the catalog
+const adoptionSettleDuration = 30 * time.Second
+
+var adoptionSetupOnce sync.Once
+
+// SetupRemoteAdoption periodically lists the remote stage and adopts the databases other tools placed in the bucket,
+// see STORAGE_REMOTE_ADOPTION_INTERVAL_SECONDS.
+func SetupRemoteAdoption() {
+	adoptionSetupOnce.Do(func() {
+		if utils.Config.Storage.Remote.AdoptionIntervalSeconds == 0 {
+			utils.Logger.Info("Adoption of the remote databases disabled, not starting it.")
+			return
+		}
+
+		go func() {
+			interval := time.Duration(utils.Config.Storage.Remote.AdoptionIntervalSeconds) * time.Second
+			utils.Logger.Info("Starting adoption of the remote databases.", zap.Duration("interval", interval))
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				if Dbs == nil {
+					continue
+				}
+				if _, err := Dbs.AdoptRemoteDatabases(); err != nil {
+					utils.Logger.Warn("Failed to adopt the remote databases.", zap.Error(err))
+				}
+			}
+		}()
+	})
+}
+
+// AdoptRemoteDatabases adds to the catalog the databases the remote stage holds and the catalog doesn't, e.g. copied to
+// the bucket by another tool, and returns their names. The objects whose name isn't a valid database name and the
+// databases whose deletion is pending are left out.
+func (databases *Databases) AdoptRemoteDatabases() ([]string, error) {
+	files, _, err := remotevfs.ListFilesWithOptions(remotevfs.ListOptions{Delimiter: "/"})
+	if err != nil {
+		return nil, err
+	}
+	deleting, err := pendingDeletions()
+	if err != nil {
+		return nil, err
+	}
+	return databases.adopt(files, deleting), nil
+}
+
+// adopt adds the databases of the listed objects missing from the catalog, see AdoptRemoteDatabases.
+func (databases *Databases) adopt(files []remotevfs.FileInfo, deleting []string) []string {
+	adopted := []string{}
+	for _, file := range files {
+		name, isDatabase := remotevfs.DatabaseNameFromKey(file.Key)
+		if !isDatabase || slices.Contains(deleting, name) {
+			continue
+		}
+		if file.LastModified != nil && time.Since(*file.LastModified) < adoptionSettleDuration {
+			continue
+		}
+		if _, err := databases.FindByName(name); err == nil {
+			continue
+		}
+
+		// NOTE: the listing may predate a deletion completed meanwhile, the object is checked again before the adoption
+		exists, err := remotevfs.ObjectExists(file.Key)
+		if err != nil {
+			utils.Logger.Warn("Failed to check a remote database before adopting it.", zap.String("database", name), zap.Error(err))
+			continue
+		}
+		if !exists {
+			continue
+		}
+
+		if _, err := databases.AddRemoteDatabase(name); err != nil {
+			utils.Logger.Warn("Failed to adopt a remote database into the catalog.", zap.String("database", name), zap.Error(err))
+			continue
+		}
+		adopted = append(adopted, name)
+
+		utils.Logger.Info("Adopted remote database into the catalog.", zap.String("database", name))
+		audit.Record(audit.Event{
+			Type:     audit.EventDatabaseCreated,
+			Database: name,
+			Details:  map[string]any{"stage": utils.GetRemoteStage(), "adopted": true, "discovered": true},
+		})
+	}
+	return adopted
+}
@@ -0,0 +1,114 @@
+package databases
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"persisto/src/internal/connections"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+)
+
+// NOTE: a transaction may span other databases of the catalog, attached to its connection under their name. SQLite
+// commits the changes made to every database of the connection atomically, through a super-journal, as long as they all
+// use a rollback journal. The databases of the transaction are entered together, must be served from the same stage and
+// are synced as a group once it committed, see stages.SyncGroupToUpperStages.
+type attachedKey struct{}
+
+// NOTE: the journal modes SQLite writes a super-journal with, WAL and the in-memory journals commit database by database
+var atomicJournalModes = []string{"delete", "truncate", "persist"}
+
+func init() {
+	// NOTE: runs before the restrictions, which refuse the ATTACH of a client
+	connections.Register(connections.Hook{Name: "attached", Order: connections.OrderExtensions, Open: func(ctx context.Context, connection *connections.Connection) error {
+		attached, isAttached := connection.Value(attachedKey{}).([]*Database)
+		if !isAttached {
+			return nil
+		}
+
+		schemas := []string{"main"}
+		for _, database := range attached {
+			connectionString, err := stages.ConnectionString(database.Name, database.Stage, stages.ConnectionOptions{WithoutPragmas: true})
+			if err != nil {
+				return err
+			}
+			if _, err := connection.Conn.ExecContext(ctx, "ATTACH DATABASE ? AS "+utils.QuoteIdentifier(database.Name), connectionString); err != nil {
+				return fmt.Errorf("failed to attach database %s: %w", database.Name, err)
+			}
+			schemas = append(schemas, database.Name)
+		}
+
+		for _, schema := range schemas {
+			var mode string
+			if err := connection.Conn.QueryRowContext(ctx, "PRAGMA "+utils.QuoteIdentifier(schema)+".journal_mode").Scan(&mode); err != nil {
+				return fmt.Errorf("failed to read the journal mode of %s: %w", schema, err)
+			}
+			if !slices.Contains(atomicJournalModes, strings.ToLower(mode)) {
+				name := schema
+				if schema == "main" {
+					name = connection.Database
+				}
+				return utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("database %s uses the %s journal mode, a transaction spanning several databases is only atomic with a rollback journal", name, mode), nil)
+			}
+		}
+		return nil
+	}})
+}
+
+// checkAttachable checks the databases can be attached to a transaction on the database, run by the principal.
+func (database *Database) checkAttachable(principal string, attached []*Database) error {
+	if len(attached) == 0 {
+		return nil
+	}
+	// NOTE: the policies of the principal are those of the database of the request, the attached ones would escape theirs
+	if principal != "" {
+		return utils.NewError(utils.ErrorCodeInvalidInput, "a transaction run by a principal can't attach other databases", nil)
+	}
+
+	seen := map[string]bool{database.Name: true}
+	for _, other := range attached {
+		if seen[other.Name] {
+			return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("database %s is part of the transaction more than once", other.Name), nil)
+		}
+		seen[other.Name] = true
+	}
+	return nil
+}
+
+// enterAll enters the database and the attached ones for writing, see enter, in the order of their names so that two
+// transactions never wait for each other. It returns the connection string of the database and the function leaving
+// all of them.
+func (database *Database) enterAll(ctx context.Context, attached []*Database) (string, func(), error) {
+	participants := append([]*Database{database}, attached...)
+	slices.SortFunc(participants, func(a, b *Database) int { return strings.Compare(a.Name, b.Name) })
+
+	var connectionString string
+	var leaves []func()
+	leave := func() {
+		for _, leave := range slices.Backward(leaves) {
+			leave()
+		}
+	}
+	for _, participant := range participants {
+		participantConnection, participantLeave, err := participant.enter(ctx, false)
+		if err != nil {
+			leave()
+			return "", nil, err
+		}
+		leaves = append(leaves, participantLeave)
+		if participant == database {
+			connectionString = participantConnection
+		}
+	}
+
+	// NOTE: the stages can't change while the databases are entered, SQLite only commits atomically through one VFS
+	for _, other := range attached {
+		if other.Stage != database.Stage {
+			leave()
+			return "", nil, utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("database %s is served from stage %d and %s from stage %d, a transaction can only span databases of the same stage", database.Name, database.Stage, other.Name, other.Stage), nil)
+		}
+	}
+	return connectionString, leave, nil
+}
@@ -0,0 +1,125 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+
+	"persisto/src/internal/coordination"
+	"persisto/src/internal/metering"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+
+	"github.com/ncruces/go-sqlite3"
+	"go.uber.org/zap"
+)
+
+// ReadBlobAs passes the value of the column of the row to read, streamed rather than loaded in memory, see
+// utils.ReadBlob. It is restricted like QueryAs, the tables and columns a policy restricts for the principal can't be
+// streamed.
+func (database *Database) ReadBlobAs(ctx context.Context, principal string, endpoint string, table string, column string, rowid int64, read func(size int64, blob io.Reader) error) error {
+	err := database.handleAccess()
+	if err != nil {
+		database.GetLogger().Warn("Failed to handle database request.", zap.Error(err))
+	}
+
+	if utils.Config.Settings.AutoStageMovement && database.RequestCount >= utils.Config.Settings.RequestCountThreshold {
+		stages.PromoteInBackground(database)
+	}
+
+	connectionString, leave, err := database.enter(ctx, true)
+	if err != nil {
+		database.GetLogger().Warn("Failed to enter database.", zap.Error(err))
+		return err
+	}
+	defer leave()
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	conn, session, _, err := database.connect(ctx, connection, principal, endpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := session.CheckStreaming(table, column); err != nil {
+		return err
+	}
+
+	if err := utils.ReadBlob(ctx, conn, table, column, rowid, read); err != nil {
+		return err
+	}
+	metering.RecordQuery(database.Name, 1)
+	return nil
+}
+
+// WriteBlobAs replaces the value of the column of the row by the size bytes read from body, streamed rather than loaded
+// in memory, see utils.WriteBlob. It is restricted like ExecuteAs, the tables and columns a policy restricts for the
+// principal can't be streamed.
+func (database *Database) WriteBlobAs(ctx context.Context, principal string, endpoint string, table string, column string, rowid int64, size int64, body io.Reader) error {
+	if err := coordination.Acquire(database.Name); err != nil {
+		return err
+	}
+
+	err := database.handleAccess()
+	if err != nil {
+		database.GetLogger().Warn("Failed to handle database request.", zap.Error(err))
+	}
+
+	connectionString, leave, err := database.enter(ctx, false)
+	if err != nil {
+		database.GetLogger().Warn("Failed to enter database.", zap.Error(err))
+		return err
+	}
+	defer leave()
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	conn, session, _, err := database.connect(ctx, connection, principal, endpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := session.CheckStreaming(table, column); err != nil {
+		return err
+	}
+
+	if err := utils.WriteBlob(ctx, conn, table, column, rowid, size, body); err != nil {
+		if errors.Is(err, sqlite3.FULL) && utils.IsClosestStage(database.Stage) && !database.sizeQuotaReached() {
+			stages.RunInBackground(func() { stages.EvictForWrite(database) })
+		}
+		return err
+	}
+	metering.RecordStatements(database.Name, 1, 1)
+
+	if utils.Config.Settings.AutoStageMovement && database.RequestCount >= utils.Config.Settings.RequestCountThreshold {
+		stages.PromoteInBackground(database)
+	}
+
+	if utils.Config.Settings.AutoSyncEnabled {
+		stages.SyncInBackground(database, utils.PriorityOf(ctx))
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package databases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: the catalog built from the stages at startup only knows where the databases are, what the running instance
+// learnt about them is kept in memory. With CATALOG_BACKUP_INTERVAL_SECONDS it is snapshotted to the remote stage, and
+// the last snapshot is applied to the catalog of the next instance, so that a replacement node recovers the placements,
+// the request counts and the freeze rather than starting every database over from the remote stage. What the databases
+// hold themselves, e.g. their tags, quotas, policies and jobs, already follows their files.
+const catalogSnapshotVersion = 1
+
+// CatalogSnapshot is what the instance knows about the databases of its catalog beyond their files.
+type CatalogSnapshot struct {
+	Version   int            `json:"version"`
+	TakenAt   time.Time      `json:"taken_at"`
+	Freeze    *CatalogFreeze `json:"freeze,omitempty" doc:"Set when the automatic movements were frozen."`
+	Databases []CatalogEntry `json:"databases"`
+}
+
+// CatalogFreeze is the freeze of the automatic movements of a snapshot.
+type CatalogFreeze struct {
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason"`
+}
+
+// CatalogEntry is a database of a snapshot of the catalog.
+type CatalogEntry struct {
+	Name         string     `json:"name"`
+	Stage        uint       `json:"stage"`
+	Placement    string     `json:"placement"`
+	MovedAt      *time.Time `json:"moved_at,omitempty"`
+	LastAccessed time.Time  `json:"last_accessed"`
+	RequestCount uint       `json:"request_count"`
+}
+
+// CatalogRestore is what applying a snapshot changed in the running catalog.
+type CatalogRestore struct {
+	TakenAt  time.Time `json:"taken_at" doc:"When the snapshot applied was taken."`
+	Restored []string  `json:"restored" doc:"Databases whose placement and counters were restored."`
+	Promoted []string  `json:"promoted" doc:"Databases promoted back to the stage they were served from."`
+	Missing  []string  `json:"missing" doc:"Databases of the snapshot missing from the catalog, e.g. deleted since or never synced."`
+	Frozen   bool      `json:"frozen" doc:"Set when the freeze of the automatic movements was restored."`
+}
+
+var catalogBackupsSetupOnce sync.Once
+
+// SetupCatalogBackups applies the last snapshot of the catalog with CATALOG_RESTORE_ON_START, then snapshots the
+// catalog every CATALOG_BACKUP_INTERVAL_SECONDS.
+func SetupCatalogBackups() {
+	catalogBackupsSetupOnce.Do(func() {
+		if Dbs == nil {
+			return
+		}
+
+		if utils.Config.Catalog.RestoreOnStart {
+			restore, err := Dbs.RestoreCatalog()
+			switch {
+			case err == nil:
+				utils.Logger.Info("Restored the snapshot of the catalog.", zap.Time("takenAt", restore.TakenAt), zap.Int("restored", len(restore.Restored)), zap.Strings("missing", restore.Missing))
+				audit.Record(audit.Event{
+					Type:    audit.EventCatalogRestored,
+					Details: map[string]any{"taken_at": restore.TakenAt, "restored": len(restore.Restored), "promoted": restore.Promoted, "missing": restore.Missing, "startup": true},
+				})
+			case utils.ErrorCodeOf(err) == utils.ErrorCodeNotFound:
+				utils.Logger.Info("No snapshot of the catalog to restore.")
+			default:
+				utils.Logger.Warn("Failed to restore the snapshot of the catalog, starting from the stages alone.", zap.Error(err))
+			}
+		}
+
+		if utils.Config.Catalog.BackupIntervalSeconds == 0 {
+			utils.Logger.Info("Snapshots of the catalog disabled, not starting them.")
+			return
+		}
+
+		go func() {
+			interval := time.Duration(utils.Config.Catalog.BackupIntervalSeconds) * time.Second
+			utils.Logger.Info("Starting snapshots of the catalog.", zap.Duration("interval", interval))
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				if _, err := Dbs.SnapshotCatalog(); err != nil {
+					utils.Logger.Warn("Failed to snapshot the catalog.", zap.Error(err))
+				}
+			}
+		}()
+	})
+}
+
+func catalogSnapshotKey() string {
+	return utils.Config.Catalog.Prefix + "catalog.json"
+}
+
+// SnapshotCatalog stores the snapshot of the catalog in the remote stage, replacing the previous one, and returns it.
+func (databases *Databases) SnapshotCatalog() (CatalogSnapshot, error) {
+	snapshot := CatalogSnapshot{Version: catalogSnapshotVersion, TakenAt: time.Now().UTC(), Databases: []CatalogEntry{}}
+
+	if freeze := stages.GetFreezeStatus(); freeze.Frozen && freeze.Since != nil {
+		snapshot.Freeze = &CatalogFreeze{Since: *freeze.Since, Reason: freeze.Reason}
+	}
+	for _, database := range databases.All() {
+		entry := CatalogEntry{
+			Name:         database.GetName(),
+			Stage:        database.GetStage(),
+			Placement:    database.GetPlacement(),
+			LastAccessed: database.GetLastAccessed().UTC(),
+			RequestCount: database.GetRequestCount(),
+		}
+		if movedAt := database.GetMovedAt(); !movedAt.IsZero() {
+			movedAt = movedAt.UTC()
+			entry.MovedAt = &movedAt
+		}
+		snapshot.Databases = append(snapshot.Databases, entry)
+	}
+	slices.SortFunc(snapshot.Databases, func(a, b CatalogEntry) int { return strings.Compare(a.Name, b.Name) })
+
+	body, err := json.Marshal(snapshot)
+	if err != nil {
+		return snapshot, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := remotevfs.PutObject(ctx, catalogSnapshotKey(), body, "application/json"); err != nil {
+		return snapshot, utils.NewError(utils.ErrorCodeStageUnavailable, "failed to store the snapshot of the catalog", err)
+	}
+	return snapshot, nil
+}
+
+// LoadCatalogSnapshot returns the last snapshot of the catalog stored in the remote stage.
+func LoadCatalogSnapshot() (CatalogSnapshot, error) {
+	var snapshot CatalogSnapshot
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	body, _, err := remotevfs.GetObjectWithGeneration(ctx, catalogSnapshotKey())
+	if errors.Is(err, remotevfs.ErrObjectNotFound) {
+		return snapshot, utils.NewError(utils.ErrorCodeNotFound, "no snapshot of the catalog was taken", nil)
+	}
+	if err != nil {
+		return snapshot, utils.NewError(utils.ErrorCodeStageUnavailable, "failed to read the snapshot of the catalog", err)
+	}
+	if err := json.Unmarshal(body, &snapshot); err != nil {
+		return snapshot, utils.NewError(utils.ErrorCodeInternal, "the snapshot of the catalog is unreadable", err)
+	}
+	if snapshot.Version != catalogSnapshotVersion {
+		return snapshot, utils.NewError(utils.ErrorCodeInternal, "the snapshot of the catalog was taken by an incompatible version", nil)
+	}
+	return snapshot, nil
+}
+
+// RestoreCatalog applies the last snapshot of the catalog to the running catalog, see applySnapshot.
+func (databases *Databases) RestoreCatalog() (CatalogRestore, error) {
+	snapshot, err := LoadCatalogSnapshot()
+	if err != nil {
+		return CatalogRestore{}, err
+	}
+	return databases.applySnapshot(snapshot), nil
+}
+
+// applySnapshot applies the snapshot to the running catalog. The databases served from a closer stage when it was taken
+// are promoted back to it, the others get their placement and last move back. The counters are only restored for the
+// databases not requested since the start, the requests served meanwhile are more recent, and the freeze of the
+// automatic movements is only restored while they run, the freeze in place is never lifted.
+func (databases *Databases) applySnapshot(snapshot CatalogSnapshot) CatalogRestore {
+	restore := CatalogRestore{TakenAt: snapshot.TakenAt, Restored: []string{}, Promoted: []string{}, Missing: []string{}}
+
+	if snapshot.Freeze != nil && !stages.Frozen() {
+		stages.Freeze(snapshot.Freeze.Reason)
+		restore.Frozen = true
+	}
+
+	for _, entry := range snapshot.Databases {
+		database, err := databases.FindByName(entry.Name)
+		if err != nil {
+			restore.Missing = append(restore.Missing, entry.Name)
+			continue
+		}
+
+		if database.GetRequestCount() == 0 {
+			database.SetRequestCount(entry.RequestCount)
+			database.SetLastAccessed(entry.LastAccessed)
+		}
+
+		switch {
+		case database.GetMovingTo() != 0:
+		case entry.Stage == database.GetStage():
+			database.SetPlacement(entry.Placement)
+			if entry.MovedAt != nil {
+				database.SetMovedAt(*entry.MovedAt)
+			}
+		case utils.IsClosestStage(entry.Stage) && !utils.IsClosestStage(database.GetStage()):
+			stages.PromoteInBackground(database)
+			restore.Promoted = append(restore.Promoted, entry.Name)
+		}
+		restore.Restored = append(restore.Restored, entry.Name)
+	}
+
+	return restore
+}
@@ -0,0 +1,42 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+
+	"persisto/src/internal/checks"
+)
+
+// RunChecks runs the checks of the database on the copy it is served from, see checks.Run. It doesn't count as an
+// access to the database.
+func (database *Database) RunChecks(ctx context.Context) ([]checks.CheckResult, error) {
+	connectionString, leave, err := database.enter(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	conn, err := connection.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// NOTE: the checks only read, a query writing would change the copy it verifies
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+		return nil, err
+	}
+	return checks.Run(ctx, conn)
+}
@@ -1,38 +1,100 @@
 package databases
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"persisto/src/internal/analytics"
+	"persisto/src/internal/connections"
+	"persisto/src/internal/coordination"
+	"persisto/src/internal/hooks"
+	"persisto/src/internal/journal"
+	"persisto/src/internal/metering"
+	"persisto/src/internal/policies"
 	"persisto/src/internal/stages"
+	"persisto/src/internal/statements"
 	"persisto/src/utils"
 	"persisto/src/vfs/localvfs"
 	"persisto/src/vfs/remotevfs"
 
+	"github.com/ncruces/go-sqlite3"
 	_ "github.com/ncruces/go-sqlite3/driver"
 	_ "github.com/ncruces/go-sqlite3/embed"
 	"go.uber.org/zap"
 )
 
-var (
-	DEFAULT_DATABASE_PATH string = "./storage"
-)
-
 type Database struct {
 	Path         string
 	Name         string
 	Stage        uint
 	LastAccessed time.Time
 	RequestCount uint
-
-	mutex sync.RWMutex
+	// NOTE: set when the local file was changed outside persisto and hasn't been verified or restored yet
+	Degraded bool
+
+	// NOTE: held shared by the requests while their connection is open and exclusively by the stage operations
+	mutex utils.CatalogMutex
+	// NOTE: stage the database is moving to, 0 when it isn't moving
+	movingTo atomic.Uint32
+	// NOTE: unix nanoseconds of the last move, zero when the database never moved
+	movedAt atomic.Int64
+	// NOTE: why the database is at its current stage, nil until it moves
+	placement atomic.Pointer[string]
+	// NOTE: set once the deletion is recorded, the requests still waiting for the database no longer reach it
+	deleted atomic.Bool
+	// NOTE: set once a write made while the remote stage is offline is recorded in the journal, see holdOfflineWrite
+	offlineWriteHeld atomic.Bool
+
+	// NOTE: size quota of the database in bytes as last read by a connection, zero when unlimited
+	sizeQuota atomic.Int64
+
+	// NOTE: counts the writes since the start, copySequences holds the last of them each copy of the database holds.
+	// Reads are only served from a copy holding every write, even when a stage switch happened since.
+	writeSequence      atomic.Uint64
+	copySequences      map[uint]uint64
+	copySequencesMutex sync.Mutex
+	// NOTE: when the writes the persistence stage may miss were made, see SyncLag
+	writeTimes []writeTime
+
+	// NOTE: sync window of the database in seconds as last read by a connection, zero to follow the configured one
+	syncWindowQuota    atomic.Int64
+	syncWindowExceeded atomic.Bool
+
+	// NOTE: set while tables are kept in the companion on the local storage, see PromoteTable. The companion is fetched
+	// and persisted under companionMutex, tieringMutex orders the moves of the tables.
+	tiered                 atomic.Bool
+	companionUploadPending atomic.Bool
+	companionMutex         sync.Mutex
+	tieringMutex           sync.Mutex
+	// NOTE: the writes to a tiered database are held in the journal until the companion is uploaded, see
+	// holdTieredWrite, the fields are guarded by tieredWritesMutex
+	tieredWriteHeld   bool
+	tieredWritten     bool
+	tieredMissedSince time.Time
+	tieredWritesMutex sync.Mutex
+
+	// NOTE: bound the connections opened concurrently, see SETTINGS_MAX_DATABASE_CONNECTIONS
+	connectionSlots     chan struct{}
+	connectionSlotsOnce sync.Once
+
+	// NOTE: tagged with the stage it was built for, rebuilt once the database moves
+	logger      *zap.Logger
+	loggerStage uint
+	loggerMutex sync.Mutex
 }
 
+// Databases is the catalog of the databases served by the instance, held by its CatalogStore.
 type Databases struct {
-	Items []*Database
+	store CatalogStore
 }
 
 var (
@@ -46,7 +108,19 @@ func SetupDatabases() (*Databases, error) {
 	databasesSetupOnce.Do(func() {
 		utils.Logger.Info("Setting up databases.")
 
-		databases, err := ListDatabases(utils.Config.Storage.Remote.StageNumber)
+		store, err := NewCatalogStore()
+		if err != nil {
+			utils.Logger.Error("Failed to setup the catalog store.", zap.Error(err))
+			DatabaseSetupError = err
+			return
+		}
+
+		// NOTE: the operations interrupted by a crash are recovered before the stages are listed, so that the catalog
+		// holds none of the copies they left half-written
+		recoverInterrupted()
+
+		// NOTE: offline, the local stage holds the only copy of the databases, the catalog is built from it
+		listed, err := ListDatabases(utils.GetFarthestStage())
 
 		if err != nil {
 			utils.Logger.Error("Failed to prefetch databases.", zap.Error(err))
@@ -54,51 +128,175 @@ func SetupDatabases() (*Databases, error) {
 			return
 		}
 
+		// NOTE: the databases whose deletion is pending stay out of the catalog, their cleanup is resumed
+		var names []string
+		if !utils.RemoteOffline() {
+			names, err = pendingDeletions()
+			if err != nil {
+				utils.Logger.Error("Failed to list the pending database deletions.", zap.Error(err))
+			}
+		}
+		databases := &Databases{store: store}
+		for _, database := range listed {
+			if slices.Contains(names, database.Name) {
+				continue
+			}
+			if err := store.Add(database); err != nil {
+				utils.Logger.Error("Failed to add database to the catalog.", zap.String("database", database.Name), zap.Error(err))
+				DatabaseSetupError = err
+				return
+			}
+		}
+		deleting := resumeDeletions(names)
+
 		Dbs = databases
 
-		utils.Logger.Info("Successfully setup databases.", zap.Reflect("databases", databases))
+		utils.Logger.Info("Successfully setup databases.", zap.Reflect("databases", databases.All()))
+
+		reconcile(databases, deleting)
 	})
 
 	return Dbs, DatabaseSetupError
 }
 
 func (database *Database) GetConnectionString() (string, error) {
-	switch database.Stage {
-	case utils.Config.Storage.Local.StageNumber:
-		return fmt.Sprintf("file:%s?vfs=disk", database.Path), nil
-	case utils.Config.Storage.Remote.StageNumber:
-		dbName := database.Name
-		if !strings.HasSuffix(dbName, ".db") {
-			dbName += ".db"
-		}
-		return fmt.Sprintf("file:%s?vfs=r2", dbName), nil
-	default:
-		utils.Logger.Error("Invalid database stage provided.", zap.Uint("stage", database.Stage))
-		return fmt.Sprintf("file:%s?vfs=disk", database.Path), nil
+	connectionString, err := stages.ConnectionString(database.Name, database.Stage, stages.ConnectionOptions{})
+	if err != nil {
+		database.GetLogger().Error("Invalid database stage provided.", zap.Uint("stage", database.Stage))
 	}
+	return connectionString, err
 }
 
+// FindByName returns the database of the catalog with the given name, once normalized.
 func (databases *Databases) FindByName(name string) (*Database, error) {
-	for i := range databases.Items {
-		if databases.Items[i].Name == name {
-			return databases.Items[i], nil
-		}
+	name = utils.NormalizeDatabaseName(name)
+	if database, found := databases.store.Get(name); found {
+		return database, nil
 	}
-	return nil, fmt.Errorf("Database not found")
+	return nil, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("database %s not found", name), nil)
+}
+
+// All returns the databases of the catalog sorted by name, the catalog may change once it is returned.
+func (databases *Databases) All() []*Database {
+	return databases.store.List()
+}
+
+// ListStage returns the databases of the catalog served from the stage, sorted by name.
+func (databases *Databases) ListStage(stage uint) []*Database {
+	return databases.store.ListStage(stage)
 }
 
+// ListTenant returns the databases of the catalog owned by the tenant, see STORAGE_REMOTE_TENANTS, sorted by name.
+func (databases *Databases) ListTenant(tenant string) []*Database {
+	return databases.store.ListTenant(tenant)
+}
+
+// Len returns the number of databases of the catalog.
+func (databases *Databases) Len() int {
+	return databases.store.Len()
+}
+
+// CreateDatabaseAndInitialize creates the database at the stage under the normalized name, which must follow the
+// naming scheme of utils.ValidateDatabaseName. It fails with a conflict when a stage already holds a database under the
+// name without it being in the catalog, rather than taking over its file, see AdoptDatabase.
 func (databases *Databases) CreateDatabaseAndInitialize(name string, stage uint) (*Database, error) {
-	var path string
+	name = utils.NormalizeDatabaseName(name)
+	if err := utils.ValidateDatabaseName(name); err != nil {
+		return nil, err
+	}
 
-	switch stage {
-	case utils.GetLocalStage():
-		path = fmt.Sprintf("%s/%s.db", DEFAULT_DATABASE_PATH, name)
-	case utils.GetRemoteStage():
-		path = name
-	default:
-		minStage, maxStage := utils.GetValidStageRange()
-		utils.Logger.Error("Invalid stage provided for database creation.", zap.Uint("stage", stage))
-		return nil, fmt.Errorf("invalid stage: %d. Valid stages are %d-%d", stage, minStage, maxStage)
+	path, err := databasePath(name, stage)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkNoPendingDeletion(name); err != nil {
+		return nil, err
+	}
+
+	existing, err := ExistingStages(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		held := make([]string, len(existing))
+		for i, existingStage := range existing {
+			held[i] = fmt.Sprintf("%d (%s)", existingStage, stages.GetStageName(existingStage))
+		}
+		return nil, utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("database %s isn't in the catalog but already exists at stage %s, adopt it or choose another name", name, strings.Join(held, " and ")), nil)
+	}
+
+	return databases.add(name, stage, path)
+}
+
+// AdoptDatabase adds to the catalog a database whose file exists at a stage without being in the catalog, e.g. one
+// written by another instance or left by a catalog that was lost. The remote copy is adopted when both stages hold one,
+// it is the durable one. The file must hold a readable database.
+func (databases *Databases) AdoptDatabase(name string) (*Database, error) {
+	name = utils.NormalizeDatabaseName(name)
+	if err := utils.ValidateDatabaseName(name); err != nil {
+		return nil, err
+	}
+	if _, err := databases.FindByName(name); err == nil {
+		return nil, utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("database %s is already in the catalog", name), nil)
+	}
+	if err := checkNoPendingDeletion(name); err != nil {
+		return nil, err
+	}
+
+	existing, err := ExistingStages(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) == 0 {
+		return nil, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("no stage holds a database named %s", name), nil)
+	}
+
+	stage := existing[0]
+	if slices.Contains(existing, utils.GetRemoteStage()) {
+		stage = utils.GetRemoteStage()
+	}
+	path, err := databasePath(name, stage)
+	if err != nil {
+		return nil, err
+	}
+	database, err := databases.add(name, stage, path)
+	if errors.Is(err, sqlite3.NOTADB) {
+		return nil, utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("the file of %s at stage %d doesn't hold a database, it can't be adopted", name, stage), err)
+	}
+	return database, err
+}
+
+// ExistingStages returns the stages holding a file or an object under the name of the database, whether or not it is
+// in the catalog.
+func ExistingStages(name string) ([]uint, error) {
+	var existing []uint
+
+	if _, err := os.Stat(stages.LocalPath(name)); err == nil {
+		existing = append(existing, utils.GetLocalStage())
+	} else if !os.IsNotExist(err) {
+		return nil, utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to check whether database %s exists in the local stage", name), err)
+	}
+
+	// NOTE: the bucket can't be read while the remote stage is offline, the databases it holds are adopted once back
+	if utils.RemoteOffline() {
+		return existing, nil
+	}
+	exists, err := remotevfs.ObjectExists(utils.DatabaseFileName(name))
+	if err != nil {
+		return nil, utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to check whether database %s exists in the remote stage", name), err)
+	}
+	if exists {
+		existing = append(existing, utils.GetRemoteStage())
+	}
+
+	return existing, nil
+}
+
+// add initializes the database at the stage and adds it to the catalog.
+func (databases *Databases) add(name string, stage uint, path string) (*Database, error) {
+	if err := coordination.Acquire(name); err != nil {
+		return nil, err
 	}
 
 	database := &Database{
@@ -111,11 +309,39 @@ func (databases *Databases) CreateDatabaseAndInitialize(name string, stage uint)
 
 	err := database.initialize()
 	if err != nil {
-		utils.Logger.Error("Failed to initialize database.", zap.Reflect("database", database), zap.Error(err))
+		database.GetLogger().Error("Failed to initialize database.", zap.Error(err))
+		return nil, err
+	}
+
+	if err := databases.store.Add(database); err != nil {
 		return nil, err
 	}
 
-	databases.Items = append(databases.Items, database)
+	return database, nil
+}
+
+// databasePath returns the path of the database at the stage.
+func databasePath(name string, stage uint) (string, error) {
+	path, err := stages.Path(name, stage)
+	if err != nil {
+		utils.Logger.Error("Invalid stage provided for database creation.", zap.Uint("stage", stage))
+	}
+	return path, err
+}
+
+// AddRemoteDatabase adds a database whose file already exists in the remote stage to the catalog, failing with a
+// conflict when the catalog already holds one under its name.
+func (databases *Databases) AddRemoteDatabase(name string) (*Database, error) {
+	database := &Database{
+		Path:         utils.DatabaseFileName(name),
+		Name:         name,
+		Stage:        utils.GetRemoteStage(),
+		LastAccessed: time.Now(),
+		RequestCount: 0,
+	}
+	if err := databases.store.Add(database); err != nil {
+		return nil, err
+	}
 
 	return database, nil
 }
@@ -123,117 +349,346 @@ func (databases *Databases) CreateDatabaseAndInitialize(name string, stage uint)
 func (database *Database) initialize() error {
 	connectionString, err := database.GetConnectionString()
 	if err != nil {
-		utils.Logger.Error("Failed to get connection string for database initialization.", zap.Error(err), zap.Reflect("database", database))
+		database.GetLogger().Error("Failed to get connection string for database initialization.", zap.Error(err))
+		return err
+	}
+
+	// NOTE: SQLite doesn't create the file until a statement writes to it, the file is written at its stage beforehand
+	// instead of running DDL, so that nothing is left behind when initialization fails
+	err = stages.Materialize(database, database.Stage)
+	if err != nil {
+		database.GetLogger().Error("Database initialization failed - failed to materialize the database file", zap.String("connectionString", connectionString), zap.String("name", database.Name), zap.Error(err))
 		return err
 	}
 
 	connection, err := sql.Open("sqlite3", connectionString)
 	if err != nil {
-		utils.Logger.Error("Error creating database connection", zap.String("connectionString", connectionString), zap.String("name", database.Name), zap.Error(err))
+		database.GetLogger().Error("Error creating database connection", zap.String("connectionString", connectionString), zap.String("name", database.Name), zap.Error(err))
 		return err
 	}
 	defer connection.Close()
 
 	err = connection.Ping()
 	if err != nil {
-		utils.Logger.Error("Database initialization failed - ping failed", zap.String("connectionString", connectionString), zap.String("name", database.Name), zap.Error(err))
+		database.GetLogger().Error("Database initialization failed - ping failed", zap.String("connectionString", connectionString), zap.String("name", database.Name), zap.Error(err))
+		return err
+	}
+
+	// NOTE: reading the schema checks the file is a readable database, without requiring write access to its stage
+	_, err = connection.Exec("SELECT count(*) FROM sqlite_master")
+	if err != nil {
+		database.GetLogger().Error("Database initialization failed - test query failed", zap.String("connectionString", connectionString), zap.String("name", database.Name), zap.Error(err))
 		return err
 	}
 
-	// TODO: replace hack with a more general approach that creates a file in the appropriate stage
-	// NOTE: for remote databases, we need to ensure the file is actually created in the storage, SQLite won't create the file until we perform an operation that requires writing
-	if database.Stage == utils.Config.Storage.Remote.StageNumber {
-		utils.Logger.Debug("Creating database file in remote storage", zap.String("name", database.Name))
+	database.GetLogger().Info("Database successfully initialized", zap.String("name", database.Name), zap.Uint("stage", database.Stage), zap.String("connectionString", connectionString))
 
-		// NOTE: create the database file by performing a write operation
-		_, err = connection.Exec("CREATE TABLE IF NOT EXISTS _persisto_init (id INTEGER PRIMARY KEY)")
-		if err != nil {
-			utils.Logger.Error("Database initialization failed - failed to create init table in remote storage", zap.String("connectionString", connectionString), zap.String("name", database.Name), zap.Error(err))
-			return err
+	return nil
+}
+
+// enter keeps the database on its stage until the returned function is called and returns the connection string of the
+// stage, waiting for the stage operation in progress if any. A request meeting a database moving between stages retries
+// for SETTINGS_MOVE_WAIT_MILLISECONDS, then fails with a retryable error rather than blocking until the end of the move.
+// Reads meeting a database promoted to the local stage are served from its remote copy right away. Requests to a database
+// served from the remote stage fail right away while the circuit breaker of the remote storage is open.
+func (database *Database) enter(ctx context.Context, readOnly bool) (string, func(), error) {
+	since := time.Now()
+	deadline := since.Add(time.Duration(utils.Config.Settings.MoveWaitMilliseconds) * time.Millisecond)
+	contended := false
+	for !database.mutex.TryRLock() {
+		contended = true
+		targetStage := database.GetMovingTo()
+		if targetStage == 0 {
+			// NOTE: the wait is recorded once for the whole loop
+			database.mutex.RWMutex.RLock()
+			break
 		}
+		// NOTE: the promotion only reads the remote copy and the writes wait for its end, the copy stays current. It is
+		// opened read-only, a write sent as a query would otherwise be lost with the remote copy once promoted. A remote
+		// copy missing writes waits for the promotion like the writes do.
+		if readOnly && utils.IsClosestStage(targetStage) && database.holdsWrites(utils.GetRemoteStage()) {
+			if remotevfs.CircuitOpen() {
+				return "", nil, remoteUnavailable(database.Name)
+			}
+			connectionString, err := stages.ConnectionString(database.Name, utils.GetRemoteStage(), stages.ConnectionOptions{ReadOnly: true})
+			return connectionString, func() {}, err
+		}
+		if time.Now().After(deadline) {
+			return "", nil, utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("database %s is moving to stage %d, retry later", database.Name, targetStage), nil)
+		}
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if contended {
+		database.mutex.RecordWait(since)
+	}
 
-		// NOTE: clean up the init table - this ensures the file exists and is properly initialized
-		_, err = connection.Exec("DROP TABLE IF EXISTS _persisto_init")
-		if err != nil {
-			utils.Logger.Error("Database initialization failed - failed to cleanup init table in remote storage", zap.String("connectionString", connectionString), zap.String("name", database.Name), zap.Error(err))
-			return err
+	if database.deleted.Load() {
+		database.mutex.RUnlock()
+		return "", nil, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("database %s was deleted", database.Name), nil)
+	}
+	if database.Stage == utils.GetRemoteStage() && remotevfs.CircuitOpen() {
+		database.mutex.RUnlock()
+		return "", nil, remoteUnavailable(database.Name)
+	}
+
+	// NOTE: fences the stage switches, a copy made before the last writes reached its source is never read
+	if readOnly && !database.holdsWrites(database.Stage) {
+		database.mutex.RUnlock()
+		database.GetLogger().Error("Copy of database misses writes, not serving reads from it.", zap.Uint64("copySequence", database.GetCopySequence(database.Stage)), zap.Uint64("writeSequence", database.writeSequence.Load()))
+		return "", nil, utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("the copy of database %s at stage %d misses writes, retry later", database.Name, database.Stage), nil)
+	}
+
+	connectionString, err := database.GetConnectionString()
+	if err != nil {
+		database.mutex.RUnlock()
+		return "", nil, err
+	}
+	if !readOnly {
+		if err := database.holdOfflineWrite(); err != nil {
+			database.mutex.RUnlock()
+			return "", nil, err
 		}
+		if database.tiered.Load() {
+			if err := database.holdTieredWrite(); err != nil {
+				database.mutex.RUnlock()
+				return "", nil, err
+			}
+		}
+		return connectionString, func() {
+			database.recordWrite()
+			database.mutex.RUnlock()
+			// NOTE: the first connection finds out the database is tiered, its write is held once made
+			if database.tiered.Load() {
+				if err := database.holdTieredWrite(); err != nil {
+					database.GetLogger().Error("Failed to journal a write to the tiered tables.", zap.Error(err))
+				}
+				database.scheduleCompanionUpload()
+			}
+		}, nil
+	}
+	return connectionString, database.mutex.RUnlock, nil
+}
 
-		utils.Logger.Debug("Successfully created database file in remote storage", zap.String("name", database.Name))
-	} else {
-		// NOTE: for non-remote databases, just test with a simple query
-		_, err = connection.Exec("SELECT 1")
-		if err != nil {
-			utils.Logger.Error("Database initialization failed - test query failed", zap.String("connectionString", connectionString), zap.String("name", database.Name), zap.Error(err))
-			return err
+func remoteUnavailable(name string) error {
+	return utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("database %s is served from the remote stage, which is failing, retry later", name), remotevfs.ErrRemoteUnavailable)
+}
+
+// acquireConnection waits until a connection to the database may be opened, or the context is done, and returns the
+// function releasing it.
+func (database *Database) acquireConnection(ctx context.Context) (func(), error) {
+	limit := utils.Config.Settings.MaxDatabaseConnections
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	database.connectionSlotsOnce.Do(func() {
+		database.connectionSlots = make(chan struct{}, limit)
+	})
+	select {
+	case database.connectionSlots <- struct{}{}:
+	default:
+		since := time.Now()
+		select {
+		case database.connectionSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
+		utils.RecordConnectionWait(database.Name, time.Since(since))
 	}
+	return func() { <-database.connectionSlots }, nil
+}
 
-	utils.Logger.Info("Database successfully initialized", zap.String("name", database.Name), zap.Uint("stage", database.Stage), zap.String("connectionString", connectionString))
+// Query runs the read query unrestricted, see QueryContext.
+func (database *Database) Query(query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, error) {
+	return database.QueryContext(context.Background(), query, parameters...)
+}
 
-	return nil
+// QueryContext runs the read query unrestricted, it is interrupted once the context is done.
+func (database *Database) QueryContext(ctx context.Context, query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, error) {
+	output, columns, _, err := database.QueryAs(ctx, "", "", utils.ResultWindow{}, query, parameters...)
+	return output, columns, err
 }
 
-func (database *Database) Query(query string) (utils.QueryResultType, error) {
-	utils.Logger.Debug("Database before request handling.", zap.Reflect("database", database))
+// QueryAs runs the read query restricted by the policies of the principal and the statement policy of the endpoint,
+// unrestricted for an empty principal and endpoint. It returns the rows of the window, and whether rows were left past
+// it. The waits for the database and the query are interrupted once the context is done.
+func (database *Database) QueryAs(ctx context.Context, principal string, endpoint string, window utils.ResultWindow, query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, bool, error) {
+	database.GetLogger().Debug("Database before request handling.")
 
 	err := database.handleAccess()
 	if err != nil {
-		utils.Logger.Warn("Failed to handle database request.", zap.Error(err))
+		database.GetLogger().Warn("Failed to handle database request.", zap.Error(err))
 	}
 
-	connectionString, err := database.GetConnectionString()
+	// NOTE: scheduled before running the query, which is served from the remote stage while the database is promoted
+	if utils.Config.Settings.AutoStageMovement && database.RequestCount >= utils.Config.Settings.RequestCountThreshold {
+		stages.PromoteInBackground(database)
+	}
+
+	connectionString, leave, err := database.enter(ctx, true)
 	if err != nil {
-		utils.Logger.Error("Failed to get connection string for database.", zap.Error(err), zap.Reflect("database", database))
-		return utils.QueryResultType{}, err
+		database.GetLogger().Warn("Failed to enter database.", zap.Error(err))
+		return utils.QueryResultType{}, nil, false, err
 	}
+	defer leave()
 
-	utils.Logger.Debug("Database after request handling.", zap.Reflect("database", database), zap.Reflect("connectionString", connectionString))
+	database.GetLogger().Debug("Database after request handling.", zap.Reflect("connectionString", connectionString))
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return utils.QueryResultType{}, nil, false, err
+	}
+	defer release()
 
 	connection, err := sql.Open("sqlite3", connectionString)
 	if err != nil {
-		return utils.QueryResultType{}, err
+		return utils.QueryResultType{}, nil, false, err
 	}
 	defer connection.Close()
 
-	err = connection.Ping()
+	err = connection.PingContext(ctx)
+	if err != nil {
+		database.GetLogger().Error("Database PING failed for connection.", zap.Error(err))
+		return utils.QueryResultType{}, nil, false, err
+	}
+	database.GetLogger().Debug("Database PING was successful.")
+
+	conn, session, statementPolicy, err := database.connect(ctx, connection, principal, endpoint)
 	if err != nil {
-		utils.Logger.Error("Database PING failed for connection.", zap.Error(err))
-		return utils.QueryResultType{}, err
+		return utils.QueryResultType{}, nil, false, err
 	}
-	utils.Logger.Debug("Database PING was successful.")
+	defer conn.Close()
 
-	rows, err := connection.Query(query)
+	// NOTE: the masks are those of the query as it runs, bounded for the ad-hoc principals
+	guardrails := statementPolicy.Guardrails()
+	query = guardrails.Rewrite(query)
+	masks, err := session.Masks(ctx, conn, query)
 	if err != nil {
-		utils.Logger.Error("Query failed.", zap.String("query", query), zap.Reflect("database", database))
-		return utils.QueryResultType{}, err
+		return utils.QueryResultType{}, nil, false, err
 	}
 
-	output, err := utils.QueryResultToMaps(rows)
+	ctx, cancel := guardrails.Bound(ctx)
+	defer cancel()
+
+	defer utils.CollectStats(conn, window.Stats)()
+	rows, err := conn.QueryContext(ctx, query, parameters...)
+	if err != nil {
+		database.GetLogger().Error("Query failed.", zap.String("query", query))
+		return utils.QueryResultType{}, nil, false, utils.RecordBusyError(database.Name, guardrails.Check(ctx, err))
+	}
+
+	window.MaxRows = statementPolicy.MaxRows
+	output, columns, truncated, err := utils.QueryResultToMapsMasked(rows, masks, window)
+	metering.RecordQuery(database.Name, len(output))
+
+	return output, columns, truncated, utils.RecordBusyError(database.Name, guardrails.Check(ctx, err))
+}
 
+// ExportAs runs the read query restricted like QueryAs and writes all of its rows in the columnar format as they are
+// read, see utils.WriteTabular.
+func (database *Database) ExportAs(ctx context.Context, principal string, endpoint string, format string, begin func(), w io.Writer, query string, parameters ...any) error {
+	return database.streamAs(ctx, principal, endpoint, func(rows *sql.Rows, masks []utils.ValueMask, maxRows int) (int, error) {
+		return utils.WriteTabular(rows, masks, maxRows, format, begin, w)
+	}, query, parameters...)
+}
+
+// QueryBatchAs runs the read queries restricted like QueryAs on a single connection and in a single read transaction, so
+// that all of them see the same snapshot of the database. A failing query is reported in its result.
+func (database *Database) QueryBatchAs(ctx context.Context, principal string, endpoint string, windows []utils.ResultWindow, queries []string, parameters [][]any) ([]utils.SnapshotResult, error) {
+	err := database.handleAccess()
+	if err != nil {
+		database.GetLogger().Warn("Failed to handle database request.", zap.Error(err))
+	}
+
+	// NOTE: scheduled before running the query, which is served from the remote stage while the database is promoted
 	if utils.Config.Settings.AutoStageMovement && database.RequestCount >= utils.Config.Settings.RequestCountThreshold {
-		utils.Logger.Info("Database stage promotion.", zap.Reflect("database", database))
-		go stages.PromoteToCloserStage(database)
+		stages.PromoteInBackground(database)
 	}
 
-	return output, err
+	connectionString, leave, err := database.enter(ctx, true)
+	if err != nil {
+		database.GetLogger().Warn("Failed to enter database.", zap.Error(err))
+		return nil, err
+	}
+	defer leave()
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	conn, session, statementPolicy, err := database.connect(ctx, connection, principal, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	masks := func(query string) ([]utils.ValueMask, error) {
+		return session.Masks(ctx, conn, query)
+	}
+	guardrails := statementPolicy.Guardrails()
+	ctx, cancel := guardrails.Bound(ctx)
+	defer cancel()
+
+	results, err := utils.ReadSnapshot(ctx, conn, masks, statementPolicy.MaxRows, windows, guardrails.RewriteAll(queries), parameters)
+	for index := range results {
+		results[index].Err = guardrails.Check(ctx, results[index].Err)
+		metering.RecordQuery(database.Name, len(results[index].Rows))
+		utils.RecordBusyError(database.Name, results[index].Err)
+	}
+
+	return results, utils.RecordBusyError(database.Name, guardrails.Check(ctx, err))
+}
+
+// Execute runs the write query unrestricted, see ExecuteContext.
+func (database *Database) Execute(query string, parameters ...any) (utils.ExecResultType, error) {
+	return database.ExecuteContext(context.Background(), query, parameters...)
+}
+
+// ExecuteContext runs the write query unrestricted, it is interrupted once the context is done.
+func (database *Database) ExecuteContext(ctx context.Context, query string, parameters ...any) (utils.ExecResultType, error) {
+	return database.ExecuteAs(ctx, "", "", query, parameters...)
 }
 
-func (database *Database) Execute(query string) (utils.ExecResultType, error) {
-	utils.Logger.Debug("Database before request handling.", zap.Reflect("database", database))
+// ExecuteAs runs the write query restricted by the policies of the principal and the statement policy of the endpoint,
+// unrestricted for an empty principal and endpoint.
+func (database *Database) ExecuteAs(ctx context.Context, principal string, endpoint string, query string, parameters ...any) (utils.ExecResultType, error) {
+	database.GetLogger().Debug("Database before request handling.")
+
+	if err := coordination.Acquire(database.Name); err != nil {
+		return utils.ExecResultType{}, err
+	}
 
 	err := database.handleAccess()
 	if err != nil {
-		utils.Logger.Warn("Failed to handle database request.", zap.Error(err))
+		database.GetLogger().Warn("Failed to handle database request.", zap.Error(err))
 	}
 
-	connectionString, err := database.GetConnectionString()
+	connectionString, leave, err := database.enter(ctx, false)
 	if err != nil {
-		utils.Logger.Error("Failed to get connection string for database.", zap.Error(err), zap.Reflect("database", database))
+		database.GetLogger().Warn("Failed to enter database.", zap.Error(err))
 		return utils.ExecResultType{}, err
 	}
+	defer leave()
 
-	utils.Logger.Debug("Database after request handling.", zap.Reflect("database", database), zap.Reflect("connectionString", connectionString))
+	database.GetLogger().Debug("Database after request handling.", zap.Reflect("connectionString", connectionString))
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return utils.ExecResultType{}, err
+	}
+	defer release()
 
 	connection, err := sql.Open("sqlite3", connectionString)
 	if err != nil {
@@ -241,61 +696,270 @@ func (database *Database) Execute(query string) (utils.ExecResultType, error) {
 	}
 	defer connection.Close()
 
-	result, err := connection.Exec(query)
+	conn, _, _, err := database.connect(ctx, connection, principal, endpoint)
 	if err != nil {
 		return utils.ExecResultType{}, err
 	}
+	defer conn.Close()
+
+	result, err := analytics.Exec(ctx, conn, database.Name, query, parameters...)
+	if err != nil {
+		// NOTE: the local stage budget is exhausted, free some capacity so later writes can succeed
+		if errors.Is(err, sqlite3.FULL) && utils.IsClosestStage(database.Stage) && !database.sizeQuotaReached() {
+			stages.RunInBackground(func() { stages.EvictForWrite(database) })
+		}
+		return utils.ExecResultType{}, utils.RecordBusyError(database.Name, err)
+	}
 
 	output, err := utils.ExecResultToMap(result)
+	if err == nil {
+		metering.RecordStatements(database.Name, 1, output["RowsAffected"].(int64))
+	}
 
 	if utils.Config.Settings.AutoStageMovement && database.RequestCount >= utils.Config.Settings.RequestCountThreshold {
-		utils.Logger.Info("Database stage promotion.", zap.Reflect("database", database))
-		go stages.PromoteToCloserStage(database)
+		stages.PromoteInBackground(database)
 	}
 
 	// NOTE: trigger sync to upper stages after write operations
 	if utils.Config.Settings.AutoSyncEnabled && utils.IsWriteOperation(query) {
-		go stages.SyncToUpperStages(database)
+		stages.SyncInBackground(database, utils.PriorityOf(ctx))
+	}
+	if utils.IsWriteOperation(query) {
+		hooks.Notify(database)
 	}
 
 	return output, err
 }
 
+// ExecuteTransaction runs the queries in a single transaction, either all of them are applied or none. On failure it
+// returns the index of the failing query, -1 when the transaction itself failed.
+func (database *Database) ExecuteTransaction(queries []string, parameters [][]any) ([]utils.ExecResultType, int, error) {
+	return database.ExecuteTransactionContext(context.Background(), queries, parameters)
+}
+
+// ExecuteTransactionContext runs the transaction like ExecuteTransaction, it is rolled back when the context is done
+// before it commits.
+func (database *Database) ExecuteTransactionContext(ctx context.Context, queries []string, parameters [][]any) ([]utils.ExecResultType, int, error) {
+	return database.ExecuteTransactionAs(ctx, "", "", queries, parameters)
+}
+
+// ExecuteTransactionAs runs the transaction restricted by the policies of the principal and the statement policy of the
+// endpoint, unrestricted for an empty principal and endpoint.
+func (database *Database) ExecuteTransactionAs(ctx context.Context, principal string, endpoint string, queries []string, parameters [][]any) ([]utils.ExecResultType, int, error) {
+	outputs, _, failedIndex, err := database.ExecuteTransactionWithOptionsAs(ctx, principal, endpoint, queries, parameters, TransactionOptions{})
+	return outputs, failedIndex, err
+}
+
+// ExecuteTransactionWithOptionsAs runs the transaction like ExecuteTransactionAs, the queries may open, release and roll
+// back to savepoints. With RollbackToSavepoint, the parts rolled back to a savepoint are returned and their queries have
+// no output.
+func (database *Database) ExecuteTransactionWithOptionsAs(ctx context.Context, principal string, endpoint string, queries []string, parameters [][]any, options TransactionOptions) ([]utils.ExecResultType, []SavepointRollback, int, error) {
+	for index, query := range queries {
+		if err := checkTransactionControl(query); err != nil {
+			return nil, nil, index, err
+		}
+	}
+	if err := database.checkAttachable(principal, options.Attach); err != nil {
+		return nil, nil, -1, err
+	}
+
+	for _, participant := range append([]*Database{database}, options.Attach...) {
+		if err := coordination.Acquire(participant.Name); err != nil {
+			return nil, nil, -1, err
+		}
+	}
+
+	err := database.handleAccess()
+	if err != nil {
+		database.GetLogger().Warn("Failed to handle database request.", zap.Error(err))
+	}
+
+	connectionString, leave, err := database.enterAll(ctx, options.Attach)
+	if err != nil {
+		database.GetLogger().Warn("Failed to enter database.", zap.Error(err))
+		return nil, nil, -1, err
+	}
+	defer leave()
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	defer release()
+
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	defer connection.Close()
+
+	conn, _, _, err := database.connectAttached(ctx, connection, principal, endpoint, options.Attach)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	defer conn.Close()
+
+	transaction, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, -1, utils.RecordBusyError(database.Name, err)
+	}
+	defer transaction.Rollback()
+
+	outputs := make([]utils.ExecResultType, len(queries))
+	var rollbacks []SavepointRollback
+	var open savepointStack
+	written := false
+	for index := 0; index < len(queries); index++ {
+		query := queries[index]
+		var queryParameters []any
+		if index < len(parameters) {
+			queryParameters = parameters[index]
+		}
+
+		result, err := analytics.Exec(ctx, transaction, database.Name, query, queryParameters...)
+		if err != nil {
+			if errors.Is(err, sqlite3.FULL) && utils.IsClosestStage(database.Stage) && !database.sizeQuotaReached() {
+				stages.RunInBackground(func() { stages.EvictForWrite(database) })
+			}
+			if !options.RollbackToSavepoint || len(open) == 0 {
+				return nil, nil, index, utils.RecordBusyError(database.Name, err)
+			}
+
+			// NOTE: the savepoint stays open, the queries up to its release are skipped and the RELEASE itself is run, the
+			// savepoint being the innermost one the open savepoints don't change
+			innermost := open[len(open)-1]
+			if _, rollbackErr := transaction.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+innermost.savepoint.Name); rollbackErr != nil {
+				return nil, nil, index, utils.RecordBusyError(database.Name, rollbackErr)
+			}
+			rollback := SavepointRollback{
+				Savepoint:   innermost.savepoint.Name,
+				Start:       innermost.index,
+				FailedIndex: index,
+				Release:     releaseIndex(queries, index, innermost.savepoint.key()),
+				Err:         utils.RecordBusyError(database.Name, err),
+			}
+			rollbacks = append(rollbacks, rollback)
+			for undone := rollback.Start + 1; undone < rollback.Release; undone++ {
+				outputs[undone] = nil
+			}
+			database.GetLogger().Info("Transaction rolled back to savepoint.", zap.String("savepoint", rollback.Savepoint), zap.Int("failedIndex", index), zap.Error(err))
+			index = rollback.Release - 1
+			continue
+		}
+
+		if outputs[index], err = utils.ExecResultToMap(result); err != nil {
+			return nil, nil, index, err
+		}
+		if savepoint, isSavepoint := ParseSavepoint(query); isSavepoint {
+			open = open.apply(savepoint, index)
+		}
+		written = written || utils.IsWriteOperation(query)
+	}
+
+	if err := transaction.Commit(); err != nil {
+		return nil, nil, -1, utils.RecordBusyError(database.Name, err)
+	}
+
+	var rowsAffected int64
+	for _, output := range outputs {
+		if affected, ok := output["RowsAffected"].(int64); ok {
+			rowsAffected += affected
+		}
+	}
+	metering.RecordStatements(database.Name, len(queries), rowsAffected)
+
+	if utils.Config.Settings.AutoStageMovement && database.RequestCount >= utils.Config.Settings.RequestCountThreshold {
+		stages.PromoteInBackground(database)
+	}
+
+	if utils.Config.Settings.AutoSyncEnabled && written {
+		if len(options.Attach) > 0 {
+			group := []stages.Database{database}
+			for _, other := range options.Attach {
+				group = append(group, other)
+			}
+			stages.SyncGroupInBackground(group)
+		} else {
+			stages.SyncInBackground(database, utils.PriorityOf(ctx))
+		}
+	}
+	if written {
+		hooks.Notify(database)
+		for _, other := range options.Attach {
+			hooks.Notify(other)
+		}
+	}
+
+	return outputs, rollbacks, -1, nil
+}
+
+// connect takes a connection of the pool and runs the connection hooks on it, which bound it by the quotas of the
+// database, restrict it by the policies of the principal and by the statement policy of the endpoint, and profile it
+// for analytics. The session is nil for requests
+// without principal, the statement policy is empty for the statements persisto runs itself.
+func (database *Database) connect(ctx context.Context, connection *sql.DB, principal string, endpoint string) (*sql.Conn, *policies.Session, statements.Rules, error) {
+	return database.connectAttached(ctx, connection, principal, endpoint, nil)
+}
+
+// connectAttached connects like connect, attaching the other databases to the connection under their name.
+func (database *Database) connectAttached(ctx context.Context, connection *sql.DB, principal string, endpoint string, attached []*Database) (*sql.Conn, *policies.Session, statements.Rules, error) {
+	conn, err := connection.Conn(ctx)
+	if err != nil {
+		return nil, nil, statements.Rules{}, err
+	}
+
+	opened := &connections.Connection{Conn: conn, Database: database.Name, Principal: principal, Endpoint: endpoint}
+	opened.SetValue(databaseKey{}, database)
+	if len(attached) > 0 {
+		opened.SetValue(attachedKey{}, attached)
+	}
+	if err := connections.Open(ctx, opened); err != nil {
+		conn.Close()
+		return nil, nil, statements.Rules{}, err
+	}
+	return conn, policies.SessionOf(opened), statements.RulesOf(opened), nil
+}
+
 func (database *Database) Delete() error {
-	utils.Logger.Info(
+	database.GetLogger().Info(
 		"Starting database deletion process",
 		zap.String("database", database.Name),
 		zap.Uint("currentStage", database.Stage),
 	)
 
+	if err := coordination.Acquire(database.Name); err != nil {
+		return err
+	}
+	defer coordination.Release(database.Name)
+	defer analytics.Forget(database.Name)
+
 	database.mutex.Lock()
 	defer database.mutex.Unlock()
 
-	persistentStage := utils.Config.Settings.PersistenceStage
+	// NOTE: the deletion is aborted rather than removing the only copy holding the last writes when the persisted one
+	// can't be confirmed
+	if err := stages.ConfirmPersisted(database); err != nil {
+		database.GetLogger().Error("Deletion aborted, the persisted copy of the database couldn't be confirmed.", zap.Error(err))
+		return utils.NewError(utils.ErrorCodeOf(err), "deletion aborted, the persisted copy of the database couldn't be confirmed", err)
+	}
 
-	// TODO: verify that databases are being synced before being deleted
-	for stage := persistentStage; stage >= database.Stage; stage-- {
-		err := stages.RemoveFromStage(database, stage)
-		if err != nil {
-			utils.Logger.Error(
-				"Failed to remove database from stage",
-				zap.String("database", database.Name),
-				zap.Uint("stage", stage),
-				zap.Error(err),
-			)
-		} else {
-			utils.Logger.Info(
-				"Successfully removed database from stage",
-				zap.String("database", database.Name),
-				zap.Uint("stage", stage),
-			)
-		}
+	id, err := journal.Begin(journal.Intent{Operation: journal.OperationDelete, Database: database.Name})
+	if err != nil {
+		database.GetLogger().Error("Deletion aborted, failed to journal it.", zap.Error(err))
+		return err
+	}
+	defer journal.End(id)
+
+	// NOTE: first phase, the intent is recorded before anything is removed and the database leaves the catalog
+	if err := recordDeletion(database.Name); err != nil {
+		database.GetLogger().Error("Deletion aborted, failed to record the deletion intent.", zap.Error(err))
+		return utils.NewError(utils.ErrorCodeStageUnavailable, "deletion aborted, failed to record the deletion intent", err)
 	}
+	database.deleted.Store(true)
 
-	// TODO: what if all removals fail ?
-	err := database.removeFromDatabasesList()
+	err = database.removeFromDatabasesList()
 	if err != nil {
-		utils.Logger.Error(
+		database.GetLogger().Error(
 			"Failed to remove database from list",
 			zap.String("database", database.Name),
 			zap.Error(err),
@@ -303,7 +967,13 @@ func (database *Database) Delete() error {
 		return fmt.Errorf("failed to remove database from list: %v", err)
 	}
 
-	utils.Logger.Info("Database deletion completed successfully", zap.String("database", database.Name))
+	// NOTE: second phase, the copies left behind by a failure are removed when the deletion is resumed
+	if err := completeDeletion(database.Name); err != nil {
+		database.GetLogger().Warn("Database deletion pending, its copies couldn't all be removed.", zap.Error(err))
+		return nil
+	}
+
+	database.GetLogger().Info("Database deletion completed successfully", zap.String("database", database.Name))
 	return nil
 }
 
@@ -314,8 +984,9 @@ func (database *Database) handleAccess() error {
 	prevCount := database.RequestCount
 	database.LastAccessed = time.Now()
 	database.RequestCount++
+	stages.RecordAccess(database.Name, database.Stage)
 
-	utils.Logger.Debug("Handling database request",
+	database.GetLogger().Debug("Handling database request",
 		zap.String("database", database.Name),
 		zap.Uint("previousCount", prevCount),
 		zap.Uint("currentCount", database.RequestCount),
@@ -325,12 +996,12 @@ func (database *Database) handleAccess() error {
 	return nil
 }
 
-func ListDatabases(stageIndex uint) (*Databases, error) {
+func ListDatabases(stageIndex uint) ([]*Database, error) {
 	var databases []*Database
 
 	switch stageIndex {
 	case utils.Config.Storage.Local.StageNumber:
-		files, err := localvfs.ListFiles(DEFAULT_DATABASE_PATH)
+		files, err := localvfs.ListFiles(utils.Config.Storage.Local.DirectoryPath)
 		if err != nil {
 			return nil, err
 		}
@@ -339,11 +1010,13 @@ func ListDatabases(stageIndex uint) (*Databases, error) {
 			if file.IsDir {
 				continue
 			}
-			if strings.HasSuffix(file.Name, ".db") {
-				baseName := strings.TrimSuffix(file.Name, ".db")
-
+			baseName, isDatabase := utils.DatabaseNameFromFileName(file.Name)
+			if !isDatabase && strings.HasSuffix(file.Name, utils.DatabaseFileExtension) {
+				utils.Logger.Warn("Ignoring local file whose name isn't a valid database name.", zap.String("path", file.FullPath))
+			}
+			if isDatabase {
 				databases = append(databases, &Database{
-					Path:         file.FullPath,
+					Path:         stages.LocalPath(baseName),
 					Name:         baseName,
 					Stage:        utils.Config.Storage.Local.StageNumber,
 					LastAccessed: time.Now(),
@@ -381,7 +1054,7 @@ func ListDatabases(stageIndex uint) (*Databases, error) {
 		zap.Reflect("databases", databases),
 	)
 
-	return &Databases{Items: databases}, nil
+	return databases, nil
 }
 
 func (database *Database) GetPath() string {
@@ -400,8 +1073,14 @@ func (database *Database) GetStage() uint {
 	return database.Stage
 }
 
+// SetStage serves the database from the stage, indexing it under the stage in the catalog.
 func (database *Database) SetStage(stage uint) {
 	database.Stage = stage
+	if Dbs != nil {
+		if err := Dbs.store.Restage(database); err != nil {
+			database.GetLogger().Warn("Failed to index the database under its new stage.", zap.Uint("stage", stage), zap.Error(err))
+		}
+	}
 }
 
 func (database *Database) GetLastAccessed() time.Time {
@@ -420,6 +1099,116 @@ func (database *Database) SetRequestCount(count uint) {
 	database.RequestCount = count
 }
 
-func (database *Database) GetMutex() *sync.RWMutex {
+// IsDegraded reports whether the local file awaits verification, or the database is served from the remote stage while
+// its circuit breaker is open.
+func (database *Database) IsDegraded() bool {
+	return database.Degraded || (database.Stage == utils.GetRemoteStage() && remotevfs.CircuitOpen())
+}
+
+// GetContention returns what the requests to the database spent waiting for each other since the start.
+func (database *Database) GetContention() utils.Contention {
+	contention := utils.ContentionOf(database.Name)
+	database.mutex.AddContention(&contention)
+	return contention
+}
+
+func (database *Database) GetMutex() *utils.CatalogMutex {
 	return &database.mutex
 }
+
+func (database *Database) GetMovingTo() uint {
+	return uint(database.movingTo.Load())
+}
+
+func (database *Database) SetMovingTo(stage uint) {
+	database.movingTo.Store(uint32(stage))
+}
+
+func (database *Database) GetMovedAt() time.Time {
+	movedAt := database.movedAt.Load()
+	if movedAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, movedAt)
+}
+
+func (database *Database) SetMovedAt(movedAt time.Time) {
+	database.movedAt.Store(movedAt.UnixNano())
+}
+
+// GetWriteSequence returns the writes counted since the database was loaded in the catalog.
+func (database *Database) GetWriteSequence() uint64 {
+	return database.writeSequence.Load()
+}
+
+func (database *Database) GetCopySequence(stage uint) uint64 {
+	database.copySequencesMutex.Lock()
+	defer database.copySequencesMutex.Unlock()
+	return database.copySequences[stage]
+}
+
+func (database *Database) SetCopySequence(stage uint, sequence uint64) {
+	database.copySequencesMutex.Lock()
+	defer database.copySequencesMutex.Unlock()
+	if database.copySequences == nil {
+		database.copySequences = make(map[uint]uint64)
+	}
+	database.copySequences[stage] = sequence
+}
+
+// recordWrite counts a write to the copy the database is served from, the database mutex must be held shared.
+func (database *Database) recordWrite() {
+	// NOTE: counted under the mutex of the copies, concurrent writers would otherwise store their sequences out of order
+	database.copySequencesMutex.Lock()
+	defer database.copySequencesMutex.Unlock()
+	if database.copySequences == nil {
+		database.copySequences = make(map[uint]uint64)
+	}
+	sequence := database.writeSequence.Add(1)
+	database.copySequences[database.Stage] = sequence
+	database.recordWriteTime(sequence)
+}
+
+// holdOfflineWrite records the write in the journal while the remote stage is offline, before the write is made: the
+// local copy of the database is then the only one holding it and is kept at the next startup to be uploaded, see
+// stages.RecoverOfflineWrite. The write is refused when it can't be recorded.
+func (database *Database) holdOfflineWrite() error {
+	if !utils.RemoteOffline() || database.offlineWriteHeld.Load() {
+		return nil
+	}
+	if err := journal.Hold(journal.Intent{Operation: journal.OperationOfflineWrite, Database: database.Name, SourceStage: utils.GetLocalStage(), TargetStage: utils.GetRemoteStage()}); err != nil {
+		return err
+	}
+	database.offlineWriteHeld.Store(true)
+	return nil
+}
+
+// holdsWrites reports whether the copy of the database at the stage holds every write recorded so far.
+func (database *Database) holdsWrites(stage uint) bool {
+	return database.GetCopySequence(stage) >= database.writeSequence.Load()
+}
+
+func (database *Database) GetPlacement() string {
+	if reason := database.placement.Load(); reason != nil {
+		return *reason
+	}
+	return stages.PlacementInitial
+}
+
+func (database *Database) SetPlacement(reason string) {
+	database.placement.Store(&reason)
+}
+
+// GetLogger returns a logger tagged with the database name and current stage, to be used instead of logging the whole
+// database.
+func (database *Database) GetLogger() *zap.Logger {
+	database.loggerMutex.Lock()
+	defer database.loggerMutex.Unlock()
+
+	stage := database.Stage
+	if database.logger == nil || database.loggerStage != stage {
+		database.logger = utils.Logger.With(zap.String("database", database.Name), zap.Uint("stage", stage))
+		database.loggerStage = stage
+	}
+	return database.logger
+}
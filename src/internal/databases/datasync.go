@@ -0,0 +1,377 @@
+package databases
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+
+	"persisto/src/internal/schemas"
+	"persisto/src/utils"
+)
+
+// NOTE: the data of two databases is compared table by table, in chunks of rows following the primary key. The rows of
+// a chunk of the source and those of the same key range of the target are hashed, and only the chunks whose digests
+// differ are compared row by row. Applying the comparison makes the target match the source one chunk at a time, each
+// in its own transaction, so an interrupted sync is resumed by running it again.
+
+const (
+	DefaultDataChunkRows = 500
+	// NOTE: differences returned per table, the others are only counted
+	dataDifferenceSamples = 20
+)
+
+// NOTE: change of a row of the target against the source
+const (
+	RowMissing = "missing"
+	RowExtra   = "extra"
+	RowChanged = "changed"
+)
+
+// DataComparisonRequest selects the tables compared, every table of both databases when empty, and whether the target
+// is made to match the source.
+type DataComparisonRequest struct {
+	Tables    []string
+	ChunkRows int
+	Apply     bool
+}
+
+// RowDifference is a row differing between the databases, given by its primary key.
+type RowDifference struct {
+	Change string `json:"change" enum:"missing,extra,changed"`
+	Key    []any  `json:"key"`
+}
+
+// TableDataComparison is the comparison of the rows of a table.
+type TableDataComparison struct {
+	Table          string          `json:"table"`
+	Skipped        string          `json:"skipped,omitempty" doc:"Why the table wasn't compared."`
+	Chunks         int             `json:"chunks"`
+	MatchingChunks int             `json:"matching_chunks"`
+	Missing        int             `json:"missing" doc:"Rows of the source missing from the target."`
+	Extra          int             `json:"extra" doc:"Rows of the target missing from the source."`
+	Changed        int             `json:"changed" doc:"Rows of both whose values differ."`
+	Samples        []RowDifference `json:"samples,omitempty" doc:"First differences found."`
+	Applied        int             `json:"applied,omitempty" doc:"Rows written to or deleted from the target."`
+}
+
+// DataComparison is the comparison of the rows of two databases.
+type DataComparison struct {
+	Source    string                `json:"source"`
+	Target    string                `json:"target"`
+	Identical bool                  `json:"identical" doc:"Set when the tables compared hold the same rows, none being skipped."`
+	Applied   bool                  `json:"applied"`
+	Tables    []TableDataComparison `json:"tables"`
+}
+
+// CompareData compares the rows of the tables of the source to those of the target, and with Apply writes the
+// differences to the target. The tables are compared by their primary key, the tables without one, the virtual tables
+// and the tables whose columns differ between the databases are skipped. The databases aren't read at a single point in
+// time, the rows written meanwhile may show as differences.
+func CompareData(ctx context.Context, source *Database, target *Database, request DataComparisonRequest) (DataComparison, error) {
+	comparison := DataComparison{Source: source.GetName(), Target: target.GetName(), Applied: request.Apply, Tables: []TableDataComparison{}}
+	if source == target {
+		return comparison, utils.NewError(utils.ErrorCodeInvalidInput, "the source and the target must be different databases", nil)
+	}
+	if request.ChunkRows <= 0 {
+		request.ChunkRows = DefaultDataChunkRows
+	}
+
+	sourceSchema, err := source.ReadSchema()
+	if err != nil {
+		return comparison, err
+	}
+	targetSchema, err := target.ReadSchema()
+	if err != nil {
+		return comparison, err
+	}
+
+	names := request.Tables
+	if len(names) == 0 {
+		for _, table := range slices.Concat(sourceSchema.Tables, targetSchema.Tables) {
+			if !slices.Contains(names, table.Name) {
+				names = append(names, table.Name)
+			}
+		}
+		slices.Sort(names)
+	}
+
+	comparison.Identical = true
+	for _, name := range names {
+		table := TableDataComparison{Table: name}
+		sourceTable, keys, skipped := comparedTable(sourceSchema, targetSchema, name)
+		if skipped != "" {
+			table.Skipped = skipped
+		} else if err := compareTable(ctx, source, target, sourceTable, keys, request, &table); err != nil {
+			// NOTE: returned along with the error, the chunks of the table already applied stay applied
+			comparison.Tables = append(comparison.Tables, table)
+			return comparison, fmt.Errorf("failed to compare table %s: %w", name, err)
+		}
+
+		if table.Skipped != "" || table.Missing+table.Extra+table.Changed > 0 {
+			comparison.Identical = false
+		}
+		comparison.Tables = append(comparison.Tables, table)
+	}
+	return comparison, nil
+}
+
+// comparedTable returns the table of the source and its primary key, or why it can't be compared.
+func comparedTable(source schemas.Schema, target schemas.Schema, name string) (schemas.Table, []string, string) {
+	find := func(schema schemas.Schema) (schemas.Table, bool) {
+		index := slices.IndexFunc(schema.Tables, func(table schemas.Table) bool { return table.Name == name })
+		if index < 0 {
+			return schemas.Table{}, false
+		}
+		return schema.Tables[index], true
+	}
+	sourceTable, inSource := find(source)
+	targetTable, inTarget := find(target)
+	switch {
+	case !inSource:
+		return sourceTable, nil, "missing from the source"
+	case !inTarget:
+		return sourceTable, nil, "missing from the target"
+	}
+
+	// NOTE: the content of a virtual table lives in its shadow tables, written by the module only
+	for _, table := range source.Tables {
+		if strings.HasPrefix(strings.ToUpper(table.SQL), "CREATE VIRTUAL TABLE") && (table.Name == name || strings.HasPrefix(name, table.Name+"_")) {
+			return sourceTable, nil, "virtual table or shadow table of one"
+		}
+	}
+
+	columnsOf := func(table schemas.Table) ([]string, []string) {
+		var columns []string
+		keys := map[int]string{}
+		for _, column := range table.Columns {
+			columns = append(columns, column.Name)
+			if column.PrimaryKey > 0 {
+				keys[column.PrimaryKey] = column.Name
+			}
+		}
+		ordered := make([]string, 0, len(keys))
+		for position := 1; position <= len(keys); position++ {
+			ordered = append(ordered, keys[position])
+		}
+		slices.Sort(columns)
+		return columns, ordered
+	}
+	sourceColumns, keys := columnsOf(sourceTable)
+	targetColumns, targetKeys := columnsOf(targetTable)
+	switch {
+	case !slices.Equal(sourceColumns, targetColumns):
+		return sourceTable, nil, "the columns differ, see the schema diff"
+	case !slices.Equal(keys, targetKeys):
+		return sourceTable, nil, "the primary keys differ, see the schema diff"
+	// NOTE: the rowids of two databases don't identify the same rows
+	case len(keys) == 0:
+		return sourceTable, nil, "no primary key"
+	}
+	return sourceTable, keys, ""
+}
+
+// compareTable compares the table chunk by chunk, the upper key of a chunk being the last key of the rows of the source
+// read for it, and applies the differences of every chunk found with Apply.
+func compareTable(ctx context.Context, source *Database, target *Database, table schemas.Table, keys []string, request DataComparisonRequest, comparison *TableDataComparison) error {
+	quotedColumns := make([]string, len(table.Columns))
+	for index, column := range table.Columns {
+		quotedColumns[index] = utils.QuoteIdentifier(column.Name)
+	}
+	quotedKeys := make([]string, len(keys))
+	keyIndexes := make([]int, len(keys))
+	for index, key := range keys {
+		quotedKeys[index] = utils.QuoteIdentifier(key)
+		keyIndexes[index] = slices.IndexFunc(table.Columns, func(column schemas.Column) bool { return column.Name == key })
+	}
+	keyTuple := "(" + strings.Join(quotedKeys, ", ") + ")"
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ") + ")"
+	selection := "SELECT " + strings.Join(quotedColumns, ", ") + " FROM " + utils.QuoteIdentifier(table.Name)
+	ordering := " ORDER BY " + strings.Join(quotedKeys, ", ")
+
+	keyOf := func(row []any) []any {
+		key := make([]any, len(keyIndexes))
+		for index, column := range keyIndexes {
+			key[index] = row[column]
+		}
+		return key
+	}
+
+	var lower []any
+	for {
+		var conditions []string
+		var parameters []any
+		if lower != nil {
+			conditions = append(conditions, keyTuple+" > "+placeholders)
+			parameters = append(parameters, lower...)
+		}
+
+		sourceRows, err := source.readRows(ctx, selection+where(conditions)+ordering+" LIMIT ?", append(slices.Clone(parameters), request.ChunkRows)...)
+		if err != nil {
+			return err
+		}
+		// NOTE: the last chunk reaches past the last row of the source, the rows of the target after it are extra
+		last := len(sourceRows) < request.ChunkRows
+		var upper []any
+		if !last {
+			upper = keyOf(sourceRows[len(sourceRows)-1])
+			conditions = append(conditions, keyTuple+" <= "+placeholders)
+			parameters = append(parameters, upper...)
+		}
+		targetRows, err := target.readRows(ctx, selection+where(conditions)+ordering, parameters...)
+		if err != nil {
+			return err
+		}
+
+		comparison.Chunks++
+		if digestOf(sourceRows) == digestOf(targetRows) {
+			comparison.MatchingChunks++
+		} else if err := compareChunk(ctx, target, table, quotedColumns, quotedKeys, keyOf, sourceRows, targetRows, request.Apply, comparison); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+		lower = upper
+	}
+}
+
+// compareChunk compares the rows of the chunk by their key and with apply writes the rows of the source missing from the
+// target or differing, and deletes the rows of the target missing from the source, in a single transaction.
+func compareChunk(ctx context.Context, target *Database, table schemas.Table, quotedColumns []string, quotedKeys []string, keyOf func([]any) []any, sourceRows [][]any, targetRows [][]any, apply bool, comparison *TableDataComparison) error {
+	targetByKey := map[string][]any{}
+	for _, row := range targetRows {
+		targetByKey[digestOf([][]any{keyOf(row)})] = row
+	}
+
+	var queries []string
+	var parameters [][]any
+	upsert := fmt.Sprintf("INSERT OR REPLACE INTO %s (%s) VALUES (%s)", utils.QuoteIdentifier(table.Name), strings.Join(quotedColumns, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(quotedColumns)), ", "))
+	remove := fmt.Sprintf("DELETE FROM %s WHERE %s = ?", utils.QuoteIdentifier(table.Name), strings.Join(quotedKeys, " = ? AND "))
+
+	record := func(change string, key []any) {
+		switch change {
+		case RowMissing:
+			comparison.Missing++
+		case RowExtra:
+			comparison.Extra++
+		case RowChanged:
+			comparison.Changed++
+		}
+		if len(comparison.Samples) < dataDifferenceSamples {
+			comparison.Samples = append(comparison.Samples, RowDifference{Change: change, Key: key})
+		}
+	}
+
+	for _, row := range sourceRows {
+		key := keyOf(row)
+		hashedKey := digestOf([][]any{key})
+		targetRow, exists := targetByKey[hashedKey]
+		delete(targetByKey, hashedKey)
+		switch {
+		case !exists:
+			record(RowMissing, key)
+		case digestOf([][]any{row}) != digestOf([][]any{targetRow}):
+			record(RowChanged, key)
+		default:
+			continue
+		}
+		queries = append(queries, upsert)
+		parameters = append(parameters, row)
+	}
+	// NOTE: in the order of the key, like the other differences
+	for _, row := range targetRows {
+		if _, extra := targetByKey[digestOf([][]any{keyOf(row)})]; extra {
+			record(RowExtra, keyOf(row))
+			queries = append(queries, remove)
+			parameters = append(parameters, keyOf(row))
+		}
+	}
+
+	if !apply || len(queries) == 0 {
+		return nil
+	}
+	if _, failedIndex, err := target.ExecuteTransactionContext(ctx, queries, parameters); err != nil {
+		if failedIndex >= 0 {
+			return fmt.Errorf("failed to apply the difference of key %v: %w", parameters[failedIndex], err)
+		}
+		return err
+	}
+	comparison.Applied += len(queries)
+	return nil
+}
+
+func where(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// digestOf returns the digest of the rows, see utils.HashValue.
+func digestOf(rows [][]any) string {
+	hash := sha256.New()
+	for _, row := range rows {
+		for _, value := range row {
+			utils.HashValue(hash, value)
+		}
+		hash.Write([]byte{'\n'})
+	}
+	return string(hash.Sum(nil))
+}
+
+// readRows runs the read query on the stage the database is served from and returns its rows as scanned, the blobs as
+// bytes and the integers exact. It doesn't count as an access to the database.
+func (database *Database) readRows(ctx context.Context, query string, parameters ...any) ([][]any, error) {
+	connectionString, leave, err := database.enter(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	connection, err := sql.Open("sqlite3", connectionString+"&mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	rows, err := connection.QueryContext(ctx, query, parameters...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var result [][]any
+	for rows.Next() {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for index := range values {
+			pointers[index] = &values[index]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		// NOTE: the driver reuses the buffers of the blobs once the next row is read
+		for index, value := range values {
+			if blob, ok := value.([]byte); ok {
+				values[index] = bytes.Clone(blob)
+			}
+		}
+		result = append(result, values)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,39 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+
+	"persisto/src/utils"
+)
+
+// StorageStats returns the size breakdown of the database by table and index, see utils.ReadStorageStats, as stored at
+// the stage it is served from. It doesn't count as an access to the database.
+func (database *Database) StorageStats(ctx context.Context) (utils.StorageStats, error) {
+	connectionString, leave, err := database.enter(ctx, true)
+	if err != nil {
+		return utils.StorageStats{}, err
+	}
+	defer leave()
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return utils.StorageStats{}, err
+	}
+	defer release()
+
+	// NOTE: opened for writing, the pages left in the WAL are checkpointed before the walk
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return utils.StorageStats{}, err
+	}
+	defer connection.Close()
+
+	conn, err := connection.Conn(ctx)
+	if err != nil {
+		return utils.StorageStats{}, err
+	}
+	defer conn.Close()
+
+	return utils.ReadStorageStats(ctx, conn)
+}
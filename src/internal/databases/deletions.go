@@ -0,0 +1,140 @@
+package databases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: a deletion is recorded as an intent object before the database leaves the catalog and its copies are removed,
+// so that a deletion interrupted by a crash or a failed removal is resumed rather than leaving untracked copies behind
+
+// deletionIntent is the content of the intent object of a pending deletion.
+type deletionIntent struct {
+	Name        string    `json:"name"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+func deletionKey(name string) string {
+	return utils.Config.Settings.DeletionPrefix + name + ".json"
+}
+
+// recordDeletion stores the intent to delete the database, its copies may only be removed once it is stored.
+func recordDeletion(name string) error {
+	body, err := json.Marshal(deletionIntent{Name: name, RequestedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return remotevfs.PutObject(context.Background(), deletionKey(name), body, "application/json")
+}
+
+// deletionPending reports whether the deletion of the database was recorded and not completed yet.
+func deletionPending(name string) (bool, error) {
+	// NOTE: the intents are stored in the bucket, whether one was recorded before the remote stage went offline is
+	// unknown, the name isn't reused until it can be checked
+	if utils.RemoteOffline() {
+		return false, remotevfs.ErrRemoteOffline
+	}
+	return remotevfs.ObjectExists(deletionKey(name))
+}
+
+// pendingDeletions returns the names of the databases whose deletion was recorded and not completed yet.
+func pendingDeletions() ([]string, error) {
+	files, _, err := remotevfs.ListFilesWithOptions(remotevfs.ListOptions{Prefix: utils.Config.Settings.DeletionPrefix})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		name, isIntent := strings.CutSuffix(strings.TrimPrefix(file.Key, utils.Config.Settings.DeletionPrefix), ".json")
+		if isIntent && utils.ValidateDatabaseName(name) == nil {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// completeDeletion removes the copies of the database from every stage, then its intent. The removals succeed when the
+// copies are already gone, so that the deletion can be completed any number of times.
+func completeDeletion(name string) error {
+	var failures []error
+
+	localPath := stages.LocalPath(name)
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm", tieredSuffix, tieredSuffix + "-journal", tieredSuffix + "-wal", tieredSuffix + "-shm"} {
+		if err := localvfs.Delete(localPath + suffix); err != nil {
+			failures = append(failures, fmt.Errorf("failed to remove %s from the local stage: %w", localPath+suffix, err))
+		}
+	}
+
+	key := utils.DatabaseFileName(name)
+	for _, suffix := range []string{"", "-journal", tieredSuffix} {
+		if err := remotevfs.Delete(key + suffix); err != nil {
+			failures = append(failures, fmt.Errorf("failed to remove %s from the remote stage: %w", key+suffix, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.Join(failures...)
+	}
+
+	if err := remotevfs.Delete(deletionKey(name)); err != nil {
+		return fmt.Errorf("failed to remove the deletion intent: %w", err)
+	}
+	return nil
+}
+
+// ResumeDeletion completes the deletion of the database when it is pending, and reports whether it was.
+func ResumeDeletion(name string) (bool, error) {
+	name = utils.NormalizeDatabaseName(name)
+	if utils.ValidateDatabaseName(name) != nil {
+		return false, nil
+	}
+
+	pending, err := deletionPending(name)
+	if err != nil || !pending {
+		return false, err
+	}
+
+	if err := completeDeletion(name); err != nil {
+		return true, utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to complete the deletion of database %s", name), err)
+	}
+	utils.Logger.Info("Completed pending database deletion.", zap.String("database", name))
+	return true, nil
+}
+
+// resumeDeletions completes the pending deletions found at startup and returns the databases still pending.
+func resumeDeletions(names []string) map[string]bool {
+	pending := map[string]bool{}
+	for _, name := range names {
+		if err := completeDeletion(name); err != nil {
+			utils.Logger.Warn("Failed to complete pending database deletion, it is resumed when the deletion is requested again.", zap.String("database", name), zap.Error(err))
+			pending[name] = true
+			continue
+		}
+		utils.Logger.Info("Completed pending database deletion.", zap.String("database", name))
+	}
+	return pending
+}
+
+// checkNoPendingDeletion refuses to bring back a database whose deletion is pending, the resumed cleanup would remove it.
+func checkNoPendingDeletion(name string) error {
+	pending, err := deletionPending(name)
+	if err != nil {
+		return utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to check whether the deletion of database %s is pending", name), err)
+	}
+	if pending {
+		return utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("the deletion of database %s is pending, delete it again to complete it before reusing the name", name), nil)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package databases
+
+import (
+	"path/filepath"
+
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// HandleRemoteObjectChange reacts to an object of the remote bucket being created, overwritten or removed outside
+// this process by invalidating the cached sectors and updating the catalog accordingly.
+func (databases *Databases) HandleRemoteObjectChange(key string, removed bool) {
+	remotevfs.InvalidateFile(key)
+
+	name, isDatabase := remotevfs.DatabaseNameFromKey(key)
+	if !isDatabase {
+		return
+	}
+
+	database, err := databases.FindByName(name)
+
+	switch {
+	case removed && err == nil:
+		if database.Stage != utils.GetRemoteStage() {
+			utils.Logger.Warn(
+				"Remote copy of a database removed externally, keeping the closer stage copy.",
+				zap.String("database", name),
+				zap.Uint("stage", database.Stage),
+			)
+			return
+		}
+
+		err = database.removeFromDatabasesList()
+		if err != nil {
+			utils.Logger.Error("Failed to remove externally deleted database from list.", zap.String("database", name), zap.Error(err))
+			return
+		}
+
+		utils.Logger.Info("Removed externally deleted database from catalog.", zap.String("database", name))
+
+	case !removed && err != nil:
+		if _, err := databases.AddRemoteDatabase(name); err != nil {
+			utils.Logger.Warn("Failed to add externally created database to catalog.", zap.String("database", name), zap.Error(err))
+			return
+		}
+
+		utils.Logger.Info("Added externally created database to catalog.", zap.String("database", name))
+
+	case !removed && database.Stage != utils.GetRemoteStage():
+		utils.Logger.Warn(
+			"Remote copy of a database modified externally while served from a closer stage.",
+			zap.String("database", name),
+			zap.Uint("stage", database.Stage),
+		)
+	}
+}
+
+// HandleLocalFileChange reacts to a local database file being modified or removed outside this process. The database is
+// marked degraded until its file is either verified or restored from the remote stage.
+func (databases *Databases) HandleLocalFileChange(path string, removed bool) {
+	var database *Database
+	for _, item := range databases.ListStage(utils.GetLocalStage()) {
+		itemPath, err := filepath.Abs(item.Path)
+		if err == nil && itemPath == path {
+			database = item
+			break
+		}
+	}
+
+	if database == nil {
+		utils.Logger.Debug("External change on a local file not tracked in catalog.", zap.String("path", path))
+		return
+	}
+
+	database.Degraded = true
+
+	if !removed {
+		database.mutex.RLock()
+		// NOTE: the tool that changed the file may still write to it, the check opens it read-only but not immutable
+		connectionString, err := stages.ConnectionString(database.Name, database.Stage, stages.ConnectionOptions{ReadOnly: true})
+		if err == nil {
+			err = utils.VerifyDatabaseIntegrity(connectionString)
+		}
+		database.mutex.RUnlock()
+		if err == nil {
+			database.Degraded = false
+			utils.Logger.Info("Externally modified local database passed verification.", zap.String("database", database.Name))
+			return
+		}
+
+		utils.Logger.Warn("Externally modified local database failed verification.", zap.String("database", database.Name), zap.Error(err))
+	}
+
+	err := stages.RestoreFromRemoteStage(database)
+	if err != nil {
+		utils.Logger.Error("Failed to restore degraded database from remote stage.", zap.String("database", database.Name), zap.Error(err))
+		return
+	}
+
+	database.Degraded = false
+	utils.Logger.Info("Restored degraded database from remote stage.", zap.String("database", database.Name))
+}
@@ -0,0 +1,296 @@
+package databases
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: an import copies the SQLite files of a bucket persisto doesn't manage into the managed layout and adopts them
+// into the catalog. Like the batch moves, the imports run one at a time on a single worker and are tracked by their
+// operation ID.
+
+const (
+	// NOTE: imports queued and not run yet, past which new ones are refused
+	importQueueSize = 8
+	// NOTE: finished imports kept to be tracked, the oldest ones are forgotten first
+	retainedImportOperations = 100
+)
+
+// NOTE: extensions of the files considered by an import, the other objects under the prefix are ignored
+var importedFileExtensions = []string{".db", ".sqlite", ".sqlite3"}
+
+// NOTE: the header every SQLite database starts with, see https://www.sqlite.org/fileformat.html
+const (
+	sqliteHeaderSize  = 100
+	sqliteHeaderMagic = "SQLite format 3\x00"
+)
+
+// NOTE: status of an import operation
+const (
+	ImportOperationQueued    = "queued"
+	ImportOperationRunning   = "running"
+	ImportOperationCompleted = "completed"
+)
+
+// NOTE: status of a file of an import operation
+const (
+	ImportQueued   = "queued"
+	ImportDone     = "imported"
+	ImportSkipped  = "skipped"
+	ImportFailed   = "failed"
+	ImportRejected = "rejected"
+)
+
+type ImportOperationItem struct {
+	Key    string `json:"key"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ImportOperation is the progress of the import of the SQLite files found under a prefix of a foreign bucket.
+type ImportOperation struct {
+	ID         string                `json:"id"`
+	Bucket     string                `json:"bucket"`
+	Prefix     string                `json:"prefix"`
+	Status     string                `json:"status"`
+	CreatedAt  time.Time             `json:"created_at"`
+	FinishedAt *time.Time            `json:"finished_at,omitempty"`
+	Imported   int                   `json:"imported"`
+	Remaining  int                   `json:"remaining"`
+	Databases  []ImportOperationItem `json:"databases"`
+
+	requestID string
+}
+
+var (
+	importOperations      = map[string]*ImportOperation{}
+	importOperationsOrder []string
+	importOperationsMutex sync.Mutex
+
+	importQueue          chan *ImportOperation
+	importQueueSetupOnce sync.Once
+)
+
+// QueueImport lists the SQLite files right under the prefix of the foreign bucket and queues their import, returning
+// the operation tracking it. A file is imported under its name without extension, the files whose name isn't a valid
+// database name or is already taken are skipped. requestID is recorded in the audit events of the imports.
+func (databases *Databases) QueueImport(bucket string, prefix string, requestID string) (ImportOperation, error) {
+	if bucket == "" {
+		return ImportOperation{}, utils.NewError(utils.ErrorCodeInvalidInput, "the bucket to import from is required", nil)
+	}
+
+	files, err := remotevfs.ListForeignObjects(bucket, prefix)
+	if err != nil {
+		return ImportOperation{}, utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to list bucket %s", bucket), err)
+	}
+
+	operation := &ImportOperation{Bucket: bucket, Prefix: prefix, Status: ImportOperationQueued, CreatedAt: time.Now().UTC(), requestID: requestID}
+	for _, file := range files {
+		base := strings.TrimPrefix(file.Key, prefix)
+		extension := importedFileExtension(base)
+		if extension == "" {
+			continue
+		}
+		operation.Databases = append(operation.Databases, ImportOperationItem{
+			Key:    file.Key,
+			Name:   utils.NormalizeDatabaseName(strings.TrimSuffix(base, extension)),
+			Size:   file.Size,
+			Status: ImportQueued,
+		})
+	}
+	if len(operation.Databases) == 0 {
+		return ImportOperation{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("no SQLite file under %s in bucket %s, the files must end with %s", prefix, bucket, strings.Join(importedFileExtensions, ", ")), nil)
+	}
+	operation.Remaining = len(operation.Databases)
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	operation.ID = hex.EncodeToString(id)
+
+	importQueueSetupOnce.Do(func() {
+		importQueue = make(chan *ImportOperation, importQueueSize)
+		go runImports(databases)
+	})
+
+	importOperationsMutex.Lock()
+	defer importOperationsMutex.Unlock()
+
+	select {
+	case importQueue <- operation:
+	default:
+		return ImportOperation{}, utils.NewError(utils.ErrorCodeBusy, fmt.Sprintf("%d imports are already queued, retry later", importQueueSize), nil)
+	}
+
+	importOperations[operation.ID] = operation
+	importOperationsOrder = append(importOperationsOrder, operation.ID)
+	forgetImportOperations()
+
+	utils.Logger.Info("Queued database import.", zap.String("operation", operation.ID), zap.String("bucket", bucket), zap.String("prefix", prefix), zap.Int("count", len(operation.Databases)))
+	return operation.snapshot(), nil
+}
+
+// GetImportOperation returns the progress of the import operation.
+func GetImportOperation(id string) (ImportOperation, error) {
+	importOperationsMutex.Lock()
+	defer importOperationsMutex.Unlock()
+
+	operation, found := importOperations[id]
+	if !found {
+		return ImportOperation{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("import operation %s not found", id), nil)
+	}
+	return operation.snapshot(), nil
+}
+
+func importedFileExtension(key string) string {
+	for _, extension := range importedFileExtensions {
+		if strings.HasSuffix(key, extension) {
+			return extension
+		}
+	}
+	return ""
+}
+
+// NOTE: the operations are updated by the worker while being read, they are only read through snapshots
+func (operation *ImportOperation) snapshot() ImportOperation {
+	snapshot := *operation
+	snapshot.Databases = slices.Clone(operation.Databases)
+	return snapshot
+}
+
+// NOTE: forgets the oldest finished operations past retainedImportOperations, importOperationsMutex must be held
+func forgetImportOperations() {
+	for len(importOperationsOrder) > retainedImportOperations {
+		oldest := importOperations[importOperationsOrder[0]]
+		if oldest.Status != ImportOperationCompleted {
+			return
+		}
+		delete(importOperations, oldest.ID)
+		importOperationsOrder = importOperationsOrder[1:]
+	}
+}
+
+func runImports(databases *Databases) {
+	for operation := range importQueue {
+		setImportOperationStatus(operation, ImportOperationRunning)
+
+		for index := range operation.Databases {
+			status, err := importQueued(databases, operation, operation.Databases[index])
+
+			importOperationsMutex.Lock()
+			operation.Databases[index].Status = status
+			if err != nil {
+				operation.Databases[index].Error = err.Error()
+			}
+			if status == ImportDone {
+				operation.Imported++
+			}
+			operation.Remaining--
+			importOperationsMutex.Unlock()
+		}
+
+		setImportOperationStatus(operation, ImportOperationCompleted)
+		utils.Logger.Info("Completed database import.", zap.String("operation", operation.ID), zap.Int("imported", operation.Imported), zap.Int("count", len(operation.Databases)))
+	}
+}
+
+// importQueued validates the file, copies it under the key of the database in the remote stage and adopts it. The
+// copy is removed when the adoption fails, nothing is left behind for a file that wasn't imported.
+func importQueued(databases *Databases, operation *ImportOperation, item ImportOperationItem) (string, error) {
+	if err := utils.ValidateDatabaseName(item.Name); err != nil {
+		return ImportSkipped, err
+	}
+	if err := validateSQLiteHeader(operation.Bucket, item.Key); err != nil {
+		if utils.ErrorCodeOf(err) == utils.ErrorCodeInvalidInput {
+			return ImportRejected, err
+		}
+		return ImportFailed, err
+	}
+
+	// NOTE: serialized with the provisioning, a database created meanwhile under the name would be overwritten
+	provisioningMutex.Lock()
+	defer provisioningMutex.Unlock()
+
+	if _, err := databases.FindByName(item.Name); err == nil {
+		return ImportSkipped, utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("database %s is already in the catalog", item.Name), nil)
+	}
+	if err := checkNoPendingDeletion(item.Name); err != nil {
+		return ImportSkipped, err
+	}
+	existing, err := ExistingStages(item.Name)
+	if err != nil {
+		return ImportFailed, err
+	}
+	if len(existing) > 0 {
+		return ImportSkipped, utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("database %s isn't in the catalog but already exists at stage %d, adopt it or rename the file", item.Name, existing[0]), nil)
+	}
+
+	key := utils.DatabaseFileName(item.Name)
+	if err := remotevfs.CopyForeignObject(context.TODO(), operation.Bucket, item.Key, key); err != nil {
+		utils.Logger.Warn("Failed to copy a file of an import.", zap.String("operation", operation.ID), zap.String("key", item.Key), zap.Error(err))
+		return ImportFailed, err
+	}
+
+	database, err := databases.AdoptDatabase(item.Name)
+	if err != nil {
+		utils.Logger.Warn("Failed to adopt an imported database.", zap.String("operation", operation.ID), zap.String("key", item.Key), zap.Error(err))
+		if removeErr := remotevfs.Delete(key); removeErr != nil {
+			utils.Logger.Error("Failed to remove the copy of a database that wasn't imported.", zap.String("key", key), zap.Error(removeErr))
+		}
+		return ImportFailed, err
+	}
+
+	database.GetLogger().Info("Database imported.", zap.String("operation", operation.ID), zap.String("bucket", operation.Bucket), zap.String("key", item.Key))
+	audit.Record(audit.Event{
+		Type:      audit.EventDatabaseImported,
+		Database:  item.Name,
+		RequestID: operation.requestID,
+		Details:   map[string]any{"bucket": operation.Bucket, "key": item.Key, "size": item.Size, "operation": operation.ID},
+	})
+	return ImportDone, nil
+}
+
+// validateSQLiteHeader checks that the object starts with the header of a SQLite database, without downloading it.
+func validateSQLiteHeader(bucket string, key string) error {
+	head, err := remotevfs.ReadForeignObjectHead(context.TODO(), bucket, key, sqliteHeaderSize)
+	if err != nil {
+		return err
+	}
+	if len(head) < sqliteHeaderSize || !bytes.HasPrefix(head, []byte(sqliteHeaderMagic)) {
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("%s doesn't hold a SQLite database, or an encrypted one", key), nil)
+	}
+
+	// NOTE: the page size is a power of two between 512 and 32768, 1 standing for 65536
+	pageSize := binary.BigEndian.Uint16(head[16:18])
+	if pageSize != 1 && (pageSize < 512 || pageSize&(pageSize-1) != 0) {
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("%s has an invalid page size %d", key, pageSize), nil)
+	}
+	return nil
+}
+
+func setImportOperationStatus(operation *ImportOperation, status string) {
+	importOperationsMutex.Lock()
+	defer importOperationsMutex.Unlock()
+
+	operation.Status = status
+	if status == ImportOperationCompleted {
+		finishedAt := time.Now().UTC()
+		operation.FinishedAt = &finishedAt
+		forgetImportOperations()
+	}
+}
@@ -0,0 +1,145 @@
+package databases
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: bumped whenever a field of the manifest changes meaning, the consumers comparing manifests check it first
+const manifestVersion = 1
+
+// Manifest is a machine-readable inventory of the databases of the catalog, e.g. for disaster recovery or to compare
+// environments.
+type Manifest struct {
+	Version     int                `json:"version"`
+	GeneratedAt time.Time          `json:"generated_at"`
+	Bucket      string             `json:"bucket"`
+	Databases   []ManifestDatabase `json:"databases"`
+}
+
+// ManifestDatabase is a database of the manifest. The fields that couldn't be read are left out and the reason is
+// reported in Error, a single unreadable database doesn't fail the manifest.
+type ManifestDatabase struct {
+	Name      string `json:"name"`
+	Stage     uint   `json:"stage"`
+	StageName string `json:"stage_name"`
+	Placement string `json:"placement"`
+	Degraded  bool   `json:"degraded"`
+	SizeBytes int64  `json:"size_bytes"`
+	// NOTE: digest of the schema and rows, equal for copies of the same content whatever their page layout
+	Checksum string `json:"checksum,omitempty"`
+	// NOTE: last write of the remote copy, i.e. the last sync of a database served from a closer stage
+	SyncedAt         *time.Time `json:"synced_at,omitempty"`
+	RemoteGeneration string     `json:"remote_generation,omitempty"`
+	// NOTE: set when the local copy was written after the remote one, the sync hasn't caught up yet
+	SyncPending bool   `json:"sync_pending,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Manifest returns the inventory of the databases of the catalog sorted by name, with the checksum of their content
+// when asked for. Checksums read every row of every database, those served from the remote stage are downloaded.
+func (databases *Databases) Manifest(withChecksums bool) Manifest {
+	manifest := Manifest{
+		Version:     manifestVersion,
+		GeneratedAt: time.Now().UTC(),
+		Bucket:      utils.Config.Storage.Remote.BucketName,
+		Databases:   []ManifestDatabase{},
+	}
+	for _, database := range databases.All() {
+		manifest.Databases = append(manifest.Databases, database.manifestEntry(withChecksums))
+	}
+	slices.SortFunc(manifest.Databases, func(a, b ManifestDatabase) int { return strings.Compare(a.Name, b.Name) })
+	return manifest
+}
+
+func (database *Database) manifestEntry(withChecksum bool) ManifestDatabase {
+	stage := database.GetStage()
+	entry := ManifestDatabase{
+		Name:      database.GetName(),
+		Stage:     stage,
+		StageName: stages.GetStageName(stage),
+		Placement: database.GetPlacement(),
+		Degraded:  database.IsDegraded(),
+	}
+	var errs []string
+
+	remote, err := remotevfs.StatObject(stages.GetRemoteKey(database))
+	switch {
+	case err == nil:
+		entry.RemoteGeneration = remote.Generation
+		if !remote.LastModified.IsZero() {
+			syncedAt := remote.LastModified.UTC()
+			entry.SyncedAt = &syncedAt
+		}
+		entry.SizeBytes = remote.Size
+	// NOTE: a database served from the local stage may not have been synced yet
+	case !errors.Is(err, remotevfs.ErrObjectNotFound) || !utils.IsClosestStage(stage):
+		errs = append(errs, "failed to read the remote copy: "+err.Error())
+	}
+
+	if utils.IsClosestStage(stage) {
+		info, err := os.Stat(database.GetPath())
+		if err != nil {
+			errs = append(errs, "failed to read the local copy: "+err.Error())
+		} else {
+			entry.SizeBytes = info.Size()
+			entry.SyncPending = entry.SyncedAt == nil || info.ModTime().After(*entry.SyncedAt)
+		}
+	}
+
+	if withChecksum {
+		checksum, err := database.checksum()
+		if err != nil {
+			database.GetLogger().Warn("Failed to checksum database for the manifest.", zap.Error(err))
+			errs = append(errs, "failed to checksum the database: "+err.Error())
+		}
+		entry.Checksum = checksum
+	}
+
+	entry.Error = strings.Join(errs, "; ")
+	return entry
+}
+
+// checksum returns the digest of the content of the database on the stage it is served from, see
+// utils.DatabaseChecksum. It doesn't count as an access to the database.
+func (database *Database) checksum() (string, error) {
+	connectionString, leave, err := database.enter(context.Background(), true)
+	if err != nil {
+		return "", err
+	}
+	defer leave()
+
+	release, err := database.acquireConnection(context.Background())
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	return utils.DatabaseChecksum(connectionString + "&mode=ro")
+}
+
+// SignManifest returns the HMAC-SHA256 of the serialized manifest keyed by MANIFEST_SIGNING_KEY, hex encoded, empty
+// when no key is configured.
+func SignManifest(body []byte) string {
+	key := utils.Config.Manifest.SigningKey.Value()
+	if key == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,178 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"persisto/src/internal/connections"
+	"persisto/src/internal/statements"
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+)
+
+// NOTE: the metadata is stored in the database it describes, like the policies it follows it across stages, backups and
+// replicas
+const MetadataTable = "_persisto_metadata"
+
+const (
+	metadataKeyQuotas = "quotas"
+	metadataKeyTags   = "tags"
+	// NOTE: read by the statements package when the connection of a client is restricted
+	metadataKeyStatements = statements.MetadataKey
+)
+
+// Quotas bound the resources of a database, zero meaning unlimited.
+type Quotas struct {
+	MaxSizeBytes int64 `json:"max_size_bytes"`
+	// NOTE: sync lag allowed to the database, zero to follow SETTINGS_SYNC_WINDOW_SECONDS, see SyncWindow
+	SyncWindowSeconds int64 `json:"sync_window_seconds,omitempty"`
+}
+
+// Metadata holds the settings of a database declared through its provisioning spec.
+type Metadata struct {
+	// NOTE: stored as the user_version of the database, so that the migration tools reading it agree with persisto
+	SchemaVersion int64
+	Quotas        Quotas
+	Tags          map[string]string
+	Statements    statements.Rules
+	// NOTE: set by the moves of the tables rather than by the spec, see PromoteTable
+	TieredTables []string
+}
+
+// Metadata returns the schema version, quotas, tags and statement policy of the database.
+func (database *Database) Metadata() (Metadata, error) {
+	metadata := Metadata{Tags: map[string]string{}}
+
+	rows, _, err := database.Query("PRAGMA user_version")
+	if err != nil {
+		return Metadata{}, err
+	}
+	if len(rows) > 0 {
+		metadata.SchemaVersion, _ = rows[0]["user_version"].(int64)
+	}
+
+	rows, _, err = database.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", MetadataTable)
+	if err != nil || len(rows) == 0 {
+		return metadata, err
+	}
+
+	rows, _, err = database.Query("SELECT key, value FROM " + MetadataTable)
+	if err != nil {
+		return Metadata{}, err
+	}
+	for _, row := range rows {
+		value, _ := row["value"].(string)
+		switch row["key"] {
+		case metadataKeyQuotas:
+			err = json.Unmarshal([]byte(value), &metadata.Quotas)
+		case metadataKeyTags:
+			err = json.Unmarshal([]byte(value), &metadata.Tags)
+		case metadataKeyStatements:
+			err = json.Unmarshal([]byte(value), &metadata.Statements)
+		case metadataKeyTieredTables:
+			err = json.Unmarshal([]byte(value), &metadata.TieredTables)
+		}
+		if err != nil {
+			return Metadata{}, fmt.Errorf("unreadable %v metadata: %w", row["key"], err)
+		}
+	}
+	return metadata, nil
+}
+
+// metadataQuery returns the statement and parameters storing the value under the key of the metadata table.
+func metadataQuery(key string, value any) (string, []any, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", nil, err
+	}
+	return "INSERT INTO " + MetadataTable + " (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", []any{key, string(encoded)}, nil
+}
+
+// NOTE: key of the database a connection is opened to by connect, the replicas of the followers have none
+type databaseKey struct{}
+
+func init() {
+	// NOTE: runs before the policies of a principal keep the connection from reading the metadata and changing its pragmas
+	connections.Register(connections.Hook{Name: "quotas", Order: connections.OrderSettings, Open: func(ctx context.Context, connection *connections.Connection) error {
+		database, isDatabase := connection.Value(databaseKey{}).(*Database)
+		if !isDatabase {
+			return nil
+		}
+		if err := database.applyQuotas(ctx, connection.Conn); err != nil {
+			return fmt.Errorf("failed to apply the quotas: %w", err)
+		}
+		return nil
+	}})
+}
+
+// applyQuotas bounds the connection by the quotas of the database.
+func (database *Database) applyQuotas(ctx context.Context, conn *sql.Conn) error {
+	var exists int
+	if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM main.sqlite_master WHERE type = 'table' AND name = ?", MetadataTable).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		database.sizeQuota.Store(0)
+		database.syncWindowQuota.Store(0)
+		return nil
+	}
+
+	var value string
+	err := conn.QueryRowContext(ctx, "SELECT value FROM "+MetadataTable+" WHERE key = ?", metadataKeyQuotas).Scan(&value)
+	if err == sql.ErrNoRows {
+		database.sizeQuota.Store(0)
+		database.syncWindowQuota.Store(0)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var quotas Quotas
+	if err := json.Unmarshal([]byte(value), &quotas); err != nil {
+		return fmt.Errorf("unreadable quotas: %w", err)
+	}
+	database.sizeQuota.Store(quotas.MaxSizeBytes)
+	database.syncWindowQuota.Store(quotas.SyncWindowSeconds)
+	if quotas.MaxSizeBytes <= 0 {
+		return nil
+	}
+
+	var pageSize int64
+	if err := conn.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+		return err
+	}
+	// NOTE: SQLite refuses to grow the file past the page count with SQLITE_FULL, a database already larger keeps its
+	// size and only accepts the writes not growing it
+	_, err = conn.ExecContext(ctx, fmt.Sprintf("PRAGMA max_page_count = %d", max(quotas.MaxSizeBytes/pageSize, 1)))
+	return err
+}
+
+// sizeQuotaReached reports whether a write refused for lack of space hit the size quota of the database rather than the
+// local stage budget, the budget must then be left as it is.
+func (database *Database) sizeQuotaReached() bool {
+	quota := database.sizeQuota.Load()
+	if quota <= 0 {
+		return false
+	}
+
+	info, err := os.Stat(database.Path)
+	if err != nil {
+		return false
+	}
+	// NOTE: the budget had room for the database to grow up to its quota, so the quota refused the write
+	return localvfs.Fits(quota - info.Size())
+}
+
+func validateQuotas(quotas Quotas) error {
+	if quotas.MaxSizeBytes < 0 {
+		return utils.NewError(utils.ErrorCodeInvalidInput, "the maximum size can't be negative", nil)
+	}
+	if quotas.SyncWindowSeconds < 0 {
+		return utils.NewError(utils.ErrorCodeInvalidInput, "the sync window can't be negative", nil)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package databases
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: the moves requested in batch, e.g. to evacuate a stage, run one at a time on a single worker so that they don't
+// saturate the disk and the bucket, the requests only queue them and track them by their operation ID
+
+const (
+	// NOTE: operations queued and not run yet, past which new ones are refused
+	moveQueueSize = 64
+	// NOTE: finished operations kept to be tracked, the oldest ones are forgotten first
+	retainedMoveOperations = 100
+)
+
+// NOTE: status of a move operation
+const (
+	MoveOperationQueued    = "queued"
+	MoveOperationRunning   = "running"
+	MoveOperationCompleted = "completed"
+)
+
+// NOTE: status of a database of a move operation
+const (
+	MoveQueued  = "queued"
+	MoveDone    = "moved"
+	MoveSkipped = "skipped"
+	MoveFailed  = "failed"
+)
+
+type MoveOperationItem struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// MoveOperation is the progress of the moves of a batch of databases to a stage.
+type MoveOperation struct {
+	ID          string              `json:"id"`
+	TargetStage uint                `json:"target_stage"`
+	Status      string              `json:"status"`
+	CreatedAt   time.Time           `json:"created_at"`
+	FinishedAt  *time.Time          `json:"finished_at,omitempty"`
+	Databases   []MoveOperationItem `json:"databases"`
+
+	requestID string
+}
+
+var (
+	moveOperations      = map[string]*MoveOperation{}
+	moveOperationsOrder []string
+	moveOperationsMutex sync.Mutex
+
+	moveQueue          chan *MoveOperation
+	moveQueueSetupOnce sync.Once
+)
+
+// QueueMoves queues the moves of the databases to the target stage and returns the operation tracking them. The
+// databases must all be in the catalog, requestID is recorded in the audit events of the moves.
+func (databases *Databases) QueueMoves(names []string, targetStage uint, requestID string) (MoveOperation, error) {
+	if !utils.IsValidStage(targetStage) {
+		minStage, maxStage := utils.GetValidStageRange()
+		return MoveOperation{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid stage %d, valid stages are %d-%d", targetStage, minStage, maxStage), nil)
+	}
+
+	operation := &MoveOperation{TargetStage: targetStage, Status: MoveOperationQueued, CreatedAt: time.Now().UTC(), requestID: requestID}
+	for _, name := range names {
+		name = utils.NormalizeDatabaseName(name)
+		if slices.ContainsFunc(operation.Databases, func(item MoveOperationItem) bool { return item.Name == name }) {
+			continue
+		}
+		if _, err := databases.FindByName(name); err != nil {
+			return MoveOperation{}, err
+		}
+		operation.Databases = append(operation.Databases, MoveOperationItem{Name: name, Status: MoveQueued})
+	}
+	if len(operation.Databases) == 0 {
+		return MoveOperation{}, utils.NewError(utils.ErrorCodeInvalidInput, "no database to move", nil)
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	operation.ID = hex.EncodeToString(id)
+
+	moveQueueSetupOnce.Do(func() {
+		moveQueue = make(chan *MoveOperation, moveQueueSize)
+		go runMoves(databases)
+	})
+
+	moveOperationsMutex.Lock()
+	defer moveOperationsMutex.Unlock()
+
+	select {
+	case moveQueue <- operation:
+	default:
+		return MoveOperation{}, utils.NewError(utils.ErrorCodeBusy, fmt.Sprintf("%d move operations are already queued, retry later", moveQueueSize), nil)
+	}
+
+	moveOperations[operation.ID] = operation
+	moveOperationsOrder = append(moveOperationsOrder, operation.ID)
+	forgetMoveOperations()
+
+	utils.StagesLogger.Info("Queued database moves.", zap.String("operation", operation.ID), zap.Int("count", len(operation.Databases)), zap.Uint("targetStage", targetStage))
+	return operation.snapshot(), nil
+}
+
+// Evacuate queues the moves of every database served from the stage to the target stage, the next farther stage when 0,
+// see QueueMoves.
+func (databases *Databases) Evacuate(stage uint, targetStage uint, requestID string) (MoveOperation, error) {
+	if !utils.IsValidStage(stage) {
+		minStage, maxStage := utils.GetValidStageRange()
+		return MoveOperation{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid stage %d, valid stages are %d-%d", stage, minStage, maxStage), nil)
+	}
+	if targetStage == 0 {
+		if targetStage = utils.GetNextFartherStage(stage); targetStage == 0 {
+			return MoveOperation{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("stage %d is the farthest stage, the target stage is required", stage), nil)
+		}
+	}
+	if stage == targetStage {
+		return MoveOperation{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("can't evacuate stage %d to itself", stage), nil)
+	}
+
+	var names []string
+	for _, database := range databases.ListStage(stage) {
+		names = append(names, database.GetName())
+	}
+	if len(names) == 0 {
+		return MoveOperation{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("no database is served from stage %d", stage), nil)
+	}
+	return databases.QueueMoves(names, targetStage, requestID)
+}
+
+// GetMoveOperation returns the progress of the move operation.
+func GetMoveOperation(id string) (MoveOperation, error) {
+	moveOperationsMutex.Lock()
+	defer moveOperationsMutex.Unlock()
+
+	operation, found := moveOperations[id]
+	if !found {
+		return MoveOperation{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("move operation %s not found", id), nil)
+	}
+	return operation.snapshot(), nil
+}
+
+// NOTE: the operations are updated by the worker while being read, they are only read through snapshots
+func (operation *MoveOperation) snapshot() MoveOperation {
+	snapshot := *operation
+	snapshot.Databases = slices.Clone(operation.Databases)
+	return snapshot
+}
+
+// NOTE: forgets the oldest finished operations past retainedMoveOperations, moveOperationsMutex must be held
+func forgetMoveOperations() {
+	for len(moveOperationsOrder) > retainedMoveOperations {
+		oldest := moveOperations[moveOperationsOrder[0]]
+		if oldest.Status != MoveOperationCompleted {
+			return
+		}
+		delete(moveOperations, oldest.ID)
+		moveOperationsOrder = moveOperationsOrder[1:]
+	}
+}
+
+func runMoves(databases *Databases) {
+	interval := time.Duration(utils.Config.Settings.MoveQueueIntervalMilliseconds) * time.Millisecond
+
+	for operation := range moveQueue {
+		setMoveOperationStatus(operation, MoveOperationRunning)
+
+		for index := range operation.Databases {
+			status, err := moveQueued(databases, operation, operation.Databases[index].Name)
+
+			moveOperationsMutex.Lock()
+			operation.Databases[index].Status = status
+			if err != nil {
+				operation.Databases[index].Error = err.Error()
+			}
+			moveOperationsMutex.Unlock()
+
+			if status == MoveDone && interval > 0 {
+				time.Sleep(interval)
+			}
+		}
+
+		setMoveOperationStatus(operation, MoveOperationCompleted)
+		utils.StagesLogger.Info("Completed database moves.", zap.String("operation", operation.ID), zap.Uint("targetStage", operation.TargetStage))
+	}
+}
+
+func moveQueued(databases *Databases, operation *MoveOperation, name string) (string, error) {
+	// NOTE: the database may have been deleted since it was queued
+	database, err := databases.FindByName(name)
+	if err != nil {
+		return MoveSkipped, err
+	}
+
+	previousStage := database.GetStage()
+	if previousStage == operation.TargetStage {
+		return MoveSkipped, nil
+	}
+
+	if err := stages.MoveDatabase(database, operation.TargetStage); err != nil {
+		database.GetLogger().Warn("Failed to move database of a move operation.", zap.String("operation", operation.ID), zap.Error(err))
+		return MoveFailed, err
+	}
+
+	audit.Record(audit.Event{
+		Type:      audit.EventDatabaseMoved,
+		Database:  name,
+		RequestID: operation.requestID,
+		Details:   map[string]any{"from": previousStage, "to": operation.TargetStage, "reason": stages.PlacementManual, "operation": operation.ID},
+	})
+	return MoveDone, nil
+}
+
+func setMoveOperationStatus(operation *MoveOperation, status string) {
+	moveOperationsMutex.Lock()
+	defer moveOperationsMutex.Unlock()
+
+	operation.Status = status
+	if status == MoveOperationCompleted {
+		finishedAt := time.Now().UTC()
+		operation.FinishedAt = &finishedAt
+		forgetMoveOperations()
+	}
+}
@@ -0,0 +1,264 @@
+package databases
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"persisto/src/internal/policies"
+	"persisto/src/internal/stages"
+	"persisto/src/internal/statements"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+// Spec is the desired state of a database, the fields left out aren't managed and keep their current value. Empty tags
+// and policies remove the existing ones, an empty statement policy allows every statement again.
+type Spec struct {
+	Stage         *uint             `json:"stage,omitempty"`
+	SchemaVersion *int64            `json:"schema_version,omitempty"`
+	Quotas        *Quotas           `json:"quotas,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+	Statements    *statements.Rules `json:"statements,omitempty"`
+	Policies      []policies.Policy `json:"policies,omitempty"`
+	// NOTE: only picks the stage of a missing database left without one, see stages.InitialStage, it isn't stored nor
+	// reported in its state
+	Workload string `json:"workload,omitempty"`
+}
+
+// State is the current state of a database, in the shape of its spec.
+type State struct {
+	Name  string `json:"name"`
+	Stage uint   `json:"stage"`
+	// NOTE: why the database is at its stage and since when, reported but not provisioned
+	Placement     string            `json:"placement"`
+	MovedAt       *time.Time        `json:"moved_at,omitempty"`
+	SchemaVersion int64             `json:"schema_version"`
+	Quotas        Quotas            `json:"quotas"`
+	Tags          map[string]string `json:"tags"`
+	Statements    statements.Rules  `json:"statements"`
+	Policies      []policies.Policy `json:"policies,omitempty"`
+	// NOTE: moved through the tier route of the tables, reported but not provisioned
+	TieredTables []string `json:"tiered_tables,omitempty"`
+}
+
+// NOTE: changes reported by Provision, in the order they are applied
+const (
+	ChangeCreated       = "created"
+	ChangeStage         = "stage"
+	ChangeSchemaVersion = "schema_version"
+	ChangeQuotas        = "quotas"
+	ChangeTags          = "tags"
+	ChangeStatements    = "statements"
+	ChangePolicies      = "policies"
+)
+
+// NOTE: serializes the provisioning, two specs applied at once to a missing database would both create it
+var provisioningMutex sync.Mutex
+
+// Provision converges the database towards the spec, creating it when missing. It returns the changes it applied, none
+// when the database already matched the spec, so that the same spec can be applied any number of times.
+func (databases *Databases) Provision(name string, spec Spec) (*Database, []string, error) {
+	if err := validateSpec(spec); err != nil {
+		return nil, nil, err
+	}
+
+	provisioningMutex.Lock()
+	defer provisioningMutex.Unlock()
+
+	changes := []string{}
+
+	database, err := databases.FindByName(name)
+	switch {
+	case err == nil:
+		if spec.Stage != nil && database.GetStage() != *spec.Stage {
+			if err := stages.MoveDatabase(database, *spec.Stage); err != nil {
+				return nil, nil, err
+			}
+			changes = append(changes, ChangeStage)
+		}
+	case utils.ErrorCodeOf(err) == utils.ErrorCodeNotFound:
+		stage := stages.InitialStage(0, spec.Workload)
+		if spec.Stage != nil {
+			stage = *spec.Stage
+		}
+		if database, err = databases.CreateDatabaseAndInitialize(name, stage); err != nil {
+			return nil, nil, err
+		}
+		changes = append(changes, ChangeCreated)
+	default:
+		return nil, nil, err
+	}
+
+	metadata, err := database.Metadata()
+	if err != nil {
+		return nil, changes, err
+	}
+
+	queries := []string{"CREATE TABLE IF NOT EXISTS " + MetadataTable + " (key TEXT PRIMARY KEY, value TEXT NOT NULL)"}
+	parameters := [][]any{nil}
+	store := func(change string, key string, value any) error {
+		query, values, err := metadataQuery(key, value)
+		if err != nil {
+			return err
+		}
+		queries = append(queries, query)
+		parameters = append(parameters, values)
+		changes = append(changes, change)
+		return nil
+	}
+
+	if spec.SchemaVersion != nil && *spec.SchemaVersion != metadata.SchemaVersion {
+		// NOTE: the schema was migrated past the spec, lowering the version would have the migrations applied twice
+		if *spec.SchemaVersion < metadata.SchemaVersion {
+			return nil, changes, utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("the schema version is %d, it can't be lowered to %d", metadata.SchemaVersion, *spec.SchemaVersion), nil)
+		}
+		queries = append(queries, fmt.Sprintf("PRAGMA user_version = %d", *spec.SchemaVersion))
+		parameters = append(parameters, nil)
+		changes = append(changes, ChangeSchemaVersion)
+	}
+	if spec.Quotas != nil && *spec.Quotas != metadata.Quotas {
+		if err := store(ChangeQuotas, metadataKeyQuotas, spec.Quotas); err != nil {
+			return nil, changes, err
+		}
+	}
+	if spec.Tags != nil && !maps.Equal(spec.Tags, metadata.Tags) {
+		if err := store(ChangeTags, metadataKeyTags, spec.Tags); err != nil {
+			return nil, changes, err
+		}
+	}
+	if spec.Statements != nil && !spec.Statements.Equal(metadata.Statements) {
+		if err := store(ChangeStatements, metadataKeyStatements, statements.Merge(statements.Rules{}, *spec.Statements)); err != nil {
+			return nil, changes, err
+		}
+	}
+
+	if len(queries) > 1 {
+		if _, _, err := database.ExecuteTransaction(queries, parameters); err != nil {
+			return nil, changes, err
+		}
+	}
+
+	if spec.Policies != nil {
+		changed, err := convergePolicies(database, spec.Policies)
+		if err != nil {
+			return nil, changes, err
+		}
+		if changed {
+			changes = append(changes, ChangePolicies)
+		}
+	}
+
+	if len(changes) > 0 {
+		database.GetLogger().Info("Database provisioned.", zap.Strings("changes", changes))
+	}
+	return database, changes, nil
+}
+
+// Describe returns the current state of the database, its policies are only included when asked for.
+func (database *Database) Describe(withPolicies bool) (State, error) {
+	metadata, err := database.Metadata()
+	if err != nil {
+		return State{}, err
+	}
+
+	state := State{
+		Name:          database.GetName(),
+		Stage:         database.GetStage(),
+		Placement:     database.GetPlacement(),
+		SchemaVersion: metadata.SchemaVersion,
+		Quotas:        metadata.Quotas,
+		Tags:          metadata.Tags,
+		Statements:    metadata.Statements,
+		TieredTables:  metadata.TieredTables,
+	}
+	if movedAt := database.GetMovedAt(); !movedAt.IsZero() {
+		movedAt = movedAt.UTC()
+		state.MovedAt = &movedAt
+	}
+	if withPolicies && utils.Config.Policies.Enabled {
+		if state.Policies, err = policies.List(database); err != nil {
+			return State{}, err
+		}
+	}
+	return state, nil
+}
+
+func validateSpec(spec Spec) error {
+	if spec.Stage != nil && !utils.IsValidStage(*spec.Stage) {
+		minStage, maxStage := utils.GetValidStageRange()
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid stage %d, valid stages are %d-%d", *spec.Stage, minStage, maxStage), nil)
+	}
+	if err := stages.ValidateWorkload(spec.Workload); err != nil {
+		return err
+	}
+	if spec.SchemaVersion != nil && (*spec.SchemaVersion < 0 || *spec.SchemaVersion > 1<<31-1) {
+		return utils.NewError(utils.ErrorCodeInvalidInput, "the schema version must be a positive 32 bits integer", nil)
+	}
+	if spec.Quotas != nil {
+		if err := validateQuotas(*spec.Quotas); err != nil {
+			return err
+		}
+	}
+	if spec.Statements != nil {
+		if err := statements.Validate(*spec.Statements); err != nil {
+			return err
+		}
+	}
+	for key := range spec.Tags {
+		if key == "" {
+			return utils.NewError(utils.ErrorCodeInvalidInput, "tags can't have an empty key", nil)
+		}
+	}
+	if spec.Policies != nil && !utils.Config.Policies.Enabled {
+		return utils.NewError(utils.ErrorCodeInvalidInput, "policies are disabled", nil)
+	}
+
+	seen := map[string]bool{}
+	for _, policy := range spec.Policies {
+		key := policy.Principal + "\x00" + policy.Table
+		if seen[key] {
+			return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("duplicate policy for principal %s on table %s", policy.Principal, policy.Table), nil)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// convergePolicies sets the policies of the spec differing from the current ones and removes those missing from it.
+func convergePolicies(database *Database, desired []policies.Policy) (bool, error) {
+	current, err := policies.List(database)
+	if err != nil {
+		return false, err
+	}
+
+	existing := map[string]policies.Policy{}
+	for _, policy := range current {
+		existing[policy.Principal+"\x00"+policy.Table] = policy
+	}
+
+	changed := false
+	for _, policy := range desired {
+		key := policy.Principal + "\x00" + policy.Table
+		previous, exists := existing[key]
+		delete(existing, key)
+		if exists && previous.Filter == policy.Filter && slices.Equal(previous.MaskedColumns, policy.MaskedColumns) {
+			continue
+		}
+		if err := policies.Set(database, policy); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	for _, policy := range existing {
+		if err := policies.Remove(database, policy.Principal, policy.Table); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
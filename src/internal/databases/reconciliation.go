@@ -0,0 +1,144 @@
+package databases
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/internal/gc"
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// NOTE: database added to the catalog
+	ReconciliationAdopted = "adopted"
+	// NOTE: object named like a database another object of the catalog already stands for once normalized
+	ReconciliationConflicting = "conflicting"
+	// NOTE: object ending in .db whose name isn't a valid database name
+	ReconciliationSkipped = "skipped"
+	// NOTE: journal or temporary object no database of the catalog owns
+	ReconciliationOrphaned = "orphaned"
+	// NOTE: file of the local storage directory removed at startup, the local stage only caches the databases
+	ReconciliationDiscarded = "discarded"
+	// NOTE: object of a database whose deletion is pending, kept out of the catalog
+	ReconciliationDeleting = "deleting"
+)
+
+// ReconciliationEntry is a file or an object found at startup and what was done with it.
+type ReconciliationEntry struct {
+	Stage    uint   `json:"stage"`
+	Name     string `json:"name" doc:"Path of the local file or key of the remote object"`
+	Database string `json:"database,omitempty"`
+	Status   string `json:"status" enum:"adopted,conflicting,skipped,orphaned,discarded,deleting"`
+	Detail   string `json:"detail,omitempty"`
+	Action   string `json:"action,omitempty" doc:"Suggested action, left out when there is nothing to do"`
+}
+
+// ReconciliationReport tells what the catalog was built from at startup.
+type ReconciliationReport struct {
+	Counts      map[string]int        `json:"counts"`
+	Entries     []ReconciliationEntry `json:"entries"`
+	Errors      []string              `json:"errors,omitempty"`
+	GeneratedAt time.Time             `json:"generated_at"`
+}
+
+var (
+	reconciliation      *ReconciliationReport
+	reconciliationMutex sync.Mutex
+)
+
+// Reconciliation returns the report of the reconciliation run at startup, nil before the catalog is setup.
+func Reconciliation() *ReconciliationReport {
+	reconciliationMutex.Lock()
+	defer reconciliationMutex.Unlock()
+	return reconciliation
+}
+
+// reconcile compares what the stages hold with the catalog built at startup and logs what needs attention, deleting
+// holds the databases whose pending deletion couldn't be completed.
+func reconcile(databases *Databases, deleting map[string]bool) {
+	report := &ReconciliationReport{Counts: map[string]int{}, Entries: []ReconciliationEntry{}, GeneratedAt: time.Now()}
+	add := func(entry ReconciliationEntry) {
+		report.Entries = append(report.Entries, entry)
+		report.Counts[entry.Status]++
+	}
+
+	catalog := map[string]bool{}
+	for _, database := range databases.All() {
+		catalog[database.Name] = true
+	}
+
+	for _, file := range localvfs.DiscardedAtStartup() {
+		entry := ReconciliationEntry{Stage: utils.GetLocalStage(), Name: file.FullPath, Status: ReconciliationDiscarded}
+		if name, isDatabase := utils.DatabaseNameFromFileName(file.Name); isDatabase {
+			entry.Database = name
+			if !catalog[name] {
+				entry.Detail = "the remote stage doesn't hold the database, its local copy was lost"
+				entry.Action = "set SETTINGS_AUTO_SYNC_ENABLED so that the local databases reach the remote stage before a restart"
+			}
+		}
+		add(entry)
+	}
+
+	var files []remotevfs.FileInfo
+	if utils.RemoteOffline() {
+		report.Errors = append(report.Errors, fmt.Sprintf("the remote stage is offline, the databases are served from the local stage only: %s", utils.RemoteOfflineReason()))
+		for _, database := range databases.All() {
+			add(ReconciliationEntry{Stage: utils.GetLocalStage(), Name: database.Path, Database: database.Name, Status: ReconciliationAdopted, Detail: "the local stage holds the only copy of the database"})
+		}
+	} else {
+		listed, _, err := remotevfs.ListFilesWithOptions(remotevfs.ListOptions{Delimiter: "/"})
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to list the remote bucket: %v", err))
+		}
+		files = listed
+	}
+	for _, file := range files {
+		entry := ReconciliationEntry{Stage: utils.GetRemoteStage(), Name: file.Key}
+
+		if name, isDatabase := remotevfs.DatabaseNameFromKey(file.Key); isDatabase {
+			entry.Database, entry.Status = name, ReconciliationAdopted
+			if deleting[name] {
+				entry.Status, entry.Detail = ReconciliationDeleting, "the deletion of the database is pending, its copies couldn't all be removed"
+				entry.Action = fmt.Sprintf("delete the database again with DELETE /databases/%s to complete it", name)
+			}
+			add(entry)
+			continue
+		}
+
+		if base, isDatabaseFile := strings.CutSuffix(file.Key, utils.DatabaseFileExtension); isDatabaseFile {
+			name := utils.NormalizeDatabaseName(base)
+			entry.Status, entry.Detail = ReconciliationSkipped, "the name of the object isn't a valid database name"
+			entry.Action = "rename the object to a valid database name, then adopt it by creating the database with adopt"
+			if catalog[name] {
+				entry.Database, entry.Status = name, ReconciliationConflicting
+				entry.Detail = fmt.Sprintf("the object stands for the database %s, which another object already holds", name)
+				entry.Action = "keep one of the two objects and delete or rename the other"
+			}
+			add(entry)
+			continue
+		}
+
+		if reason, orphaned := gc.Classify(file.Key, catalog); orphaned {
+			entry.Status, entry.Detail = ReconciliationOrphaned, fmt.Sprintf("%s object no database of the catalog owns", reason)
+			entry.Action = "collect it with POST /admin/gc or GC_ENABLED"
+			add(entry)
+		}
+	}
+
+	for _, entry := range report.Entries {
+		if entry.Action != "" {
+			utils.Logger.Warn("Reconciliation found a file needing attention.", zap.Uint("stage", entry.Stage), zap.String("name", entry.Name), zap.String("status", entry.Status), zap.String("detail", entry.Detail), zap.String("action", entry.Action))
+		}
+	}
+	utils.Logger.Info("Reconciled the catalog with the stages.", zap.Any("counts", report.Counts), zap.Int("errors", len(report.Errors)))
+
+	reconciliationMutex.Lock()
+	reconciliation = report
+	reconciliationMutex.Unlock()
+}
@@ -0,0 +1,106 @@
+package databases
+
+import (
+	"errors"
+	"fmt"
+
+	"persisto/src/internal/journal"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// recoverInterrupted replays the operations of the journal interrupted by a crash, see journal.Pending. Each one is
+// rolled forward or back, deferred or failed, see journal.Resolve, the outcomes are returned by journal.Recovered. The
+// failed ones of the previous startups are held for an operator and not replayed.
+func recoverInterrupted() {
+	intents, err := journal.Pending()
+	if err != nil {
+		utils.Logger.Error("Failed to read the journal, the operations interrupted by a crash aren't recovered.", zap.Error(err))
+		return
+	}
+	if len(intents) == 0 {
+		return
+	}
+
+	utils.Logger.Warn("Recovering the operations interrupted by a crash.", zap.Int("count", len(intents)))
+	for _, intent := range intents {
+		if intent.Status == journal.StatusFailed {
+			utils.Logger.Warn("Operation whose recovery failed held in the journal, retry or dismiss it.", zap.Int64("id", intent.ID), zap.String("operation", intent.Operation), zap.String("database", intent.Database), zap.String("error", intent.Error))
+			continue
+		}
+		outcome, err := recoverIntent(intent)
+		journal.Resolve(intent, outcome, err)
+	}
+}
+
+func recoverIntent(intent journal.Intent) (string, error) {
+	switch intent.Operation {
+	case journal.OperationMove:
+		return stages.RecoverMove(intent.Database, intent.SourceStage, intent.TargetStage)
+	case journal.OperationDelete:
+		return recoverDeletion(intent.Database)
+	case journal.OperationRestore:
+		return recoverRestoration(intent.Database)
+	case journal.OperationOfflineWrite:
+		return stages.RecoverOfflineWrite(intent.Database)
+	case journal.OperationTieredWrite:
+		return stages.RecoverTieredWrite(intent.Database)
+	case journal.OperationRestoreInPlace:
+		// NOTE: the pages are copied in a single write transaction, SQLite rolls it back from its journal the next time
+		// the database is opened
+		return journal.OutcomeRolledBack, nil
+	}
+	return journal.OutcomeFailed, fmt.Errorf("unknown operation %s", intent.Operation)
+}
+
+// recoverDeletion finds out how far the deletion of the database went. Once its intent object is stored, the deletion
+// is resumed with the pending ones, see resumeDeletions, before it nothing was removed.
+func recoverDeletion(name string) (string, error) {
+	if utils.RemoteOffline() {
+		return journal.OutcomeDeferred, remotevfs.ErrRemoteOffline
+	}
+
+	pending, err := deletionPending(name)
+	if err != nil {
+		return journal.OutcomeFailed, fmt.Errorf("failed to look up the deletion intent: %v", err)
+	}
+	if pending {
+		return journal.OutcomeRolledForward, nil
+	}
+
+	// NOTE: without an intent object the deletion either never started or completed
+	if _, err := remotevfs.FileSize(utils.DatabaseFileName(name)); err != nil {
+		return journal.OutcomeRolledForward, nil
+	}
+	return journal.OutcomeRolledBack, nil
+}
+
+// recoverRestoration keeps the database restored in the remote stage when its copy is whole, it is then adopted into
+// the catalog with the others, and removes the copy otherwise.
+func recoverRestoration(name string) (string, error) {
+	if utils.RemoteOffline() {
+		return journal.OutcomeDeferred, remotevfs.ErrRemoteOffline
+	}
+
+	key := utils.DatabaseFileName(name)
+	if _, err := remotevfs.FileSize(key); err != nil {
+		return journal.OutcomeRolledBack, nil
+	}
+	if err := stages.VerifyCopy(name, utils.GetRemoteStage()); err == nil {
+		return journal.OutcomeRolledForward, nil
+	}
+
+	var failures []error
+	for _, suffix := range []string{"", "-journal"} {
+		if err := remotevfs.Delete(key + suffix); err != nil {
+			failures = append(failures, err)
+		}
+	}
+	if err := errors.Join(failures...); err != nil {
+		return journal.OutcomeFailed, fmt.Errorf("failed to remove the half-restored copy: %v", err)
+	}
+	return journal.OutcomeRolledBack, nil
+}
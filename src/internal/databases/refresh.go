@@ -0,0 +1,99 @@
+package databases
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// CatalogChange is a database of the catalog whose entry was updated by a refresh.
+type CatalogChange struct {
+	Database string `json:"database"`
+	Detail   string `json:"detail"`
+	Error    string `json:"error,omitempty"`
+}
+
+// CatalogRefresh is what a refresh of the catalog found in the stages and merged into it.
+type CatalogRefresh struct {
+	Added       []string        `json:"added"`
+	Removed     []string        `json:"removed"`
+	Changed     []CatalogChange `json:"changed"`
+	RefreshedAt time.Time       `json:"refreshed_at"`
+}
+
+// Refresh runs the discovery of the startup again and merges it into the running catalog: the databases the bucket
+// holds and the catalog doesn't are adopted, those served from the remote stage whose object is gone leave the
+// catalog and those served from the local stage whose file is gone are restored from the remote stage. The databases
+// moving between stages are left for the next refresh.
+func (databases *Databases) Refresh() (CatalogRefresh, error) {
+	refresh := CatalogRefresh{Added: []string{}, Removed: []string{}, Changed: []CatalogChange{}, RefreshedAt: time.Now().UTC()}
+
+	files, _, err := remotevfs.ListFilesWithOptions(remotevfs.ListOptions{Delimiter: "/"})
+	if err != nil {
+		return refresh, utils.NewError(utils.ErrorCodeStageUnavailable, "failed to list the remote stage", err)
+	}
+	deleting, err := pendingDeletions()
+	if err != nil {
+		return refresh, utils.NewError(utils.ErrorCodeStageUnavailable, "failed to list the pending deletions", err)
+	}
+
+	listed := map[string]bool{}
+	for _, file := range files {
+		if name, isDatabase := remotevfs.DatabaseNameFromKey(file.Key); isDatabase {
+			listed[name] = true
+		}
+	}
+
+	for _, database := range databases.All() {
+		if database.GetMovingTo() != 0 {
+			continue
+		}
+
+		switch database.GetStage() {
+		case utils.GetRemoteStage():
+			if listed[database.Name] {
+				continue
+			}
+			// NOTE: the listing may predate the creation of the database, the object is checked again before it leaves
+			exists, err := remotevfs.ObjectExists(database.Path)
+			if err != nil {
+				refresh.Changed = append(refresh.Changed, CatalogChange{Database: database.Name, Detail: "failed to check the remote copy", Error: err.Error()})
+				continue
+			}
+			if exists {
+				continue
+			}
+			if err := database.removeFromDatabasesList(); err != nil {
+				refresh.Changed = append(refresh.Changed, CatalogChange{Database: database.Name, Detail: "failed to remove the database from the catalog", Error: err.Error()})
+				continue
+			}
+			refresh.Removed = append(refresh.Removed, database.Name)
+			database.GetLogger().Info("Removed database missing from the remote stage from the catalog.")
+
+		case utils.GetLocalStage():
+			if _, err := os.Stat(database.Path); err == nil || !os.IsNotExist(err) {
+				continue
+			}
+			change := CatalogChange{Database: database.Name, Detail: "the local copy is missing, restored from the remote stage"}
+			database.Degraded = true
+			if err := stages.RestoreFromRemoteStage(database); err != nil {
+				change.Error = fmt.Sprintf("failed to restore the database: %v", err)
+				database.GetLogger().Error("Failed to restore database missing from the local stage.", zap.Error(err))
+			} else {
+				database.Degraded = false
+			}
+			refresh.Changed = append(refresh.Changed, change)
+		}
+	}
+
+	refresh.Added = databases.adopt(files, deleting)
+
+	utils.Logger.Info("Refreshed the catalog.", zap.Strings("added", refresh.Added), zap.Strings("removed", refresh.Removed), zap.Int("changed", len(refresh.Changed)))
+	return refresh, nil
+}
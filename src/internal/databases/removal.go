@@ -13,19 +13,21 @@ func (database *Database) removeFromDatabasesList() error {
 		return fmt.Errorf("databases list is not initialized")
 	}
 
-	for i, db := range Dbs.Items {
-		if db.Name == database.Name {
-			Dbs.Items = append(Dbs.Items[:i], Dbs.Items[i+1:]...)
-			utils.Logger.Info(
-				"Successfully removed database from list",
-				zap.String("database", database.Name),
-				zap.Int("remainingDatabases", len(Dbs.Items)),
-			)
-			return nil
-		}
+	removed, err := Dbs.store.Remove(database.Name)
+	if err != nil {
+		return err
+	}
+	if removed {
+		utils.ForgetContention(database.Name)
+		database.GetLogger().Info(
+			"Successfully removed database from list",
+			zap.String("database", database.Name),
+			zap.Int("remainingDatabases", Dbs.Len()),
+		)
+		return nil
 	}
 
-	utils.Logger.Warn(
+	database.GetLogger().Warn(
 		"Database not found in list during deletion",
 		zap.String("database", database.Name),
 	)
@@ -0,0 +1,84 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"persisto/src/internal/checks"
+	"persisto/src/internal/coordination"
+	"persisto/src/internal/journal"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/driver"
+	"go.uber.org/zap"
+)
+
+// RestoreFrom replaces the content of the database, on whichever stage it is on, by the database opened by the source
+// URI, e.g. a snapshot. The pages are copied with the SQLite backup API while the database is locked, concurrent
+// requests wait for the copy and then see the restored content. It returns the results of the checks the restored
+// content holds, see checks.Run.
+func (database *Database) RestoreFrom(sourceURI string) ([]checks.CheckResult, error) {
+	if err := coordination.Acquire(database.Name); err != nil {
+		return nil, err
+	}
+
+	id, err := journal.Begin(journal.Intent{Operation: journal.OperationRestoreInPlace, Database: database.Name})
+	if err != nil {
+		return nil, err
+	}
+	defer journal.End(id)
+
+	// NOTE: not interrupted by the caller, the database would be left half-restored
+	ctx := context.Background()
+	connectionString, leave, err := database.enter(ctx, false)
+	if err != nil {
+		database.GetLogger().Warn("Failed to enter database.", zap.Error(err))
+		return nil, err
+	}
+	defer leave()
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	conn, err := connection.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = conn.Raw(func(driverConn any) error {
+		return driverConn.(driver.Conn).Raw().Restore("main", sourceURI)
+	})
+	if err != nil {
+		if errors.Is(err, sqlite3.FULL) && utils.IsClosestStage(database.Stage) && !database.sizeQuotaReached() {
+			stages.RunInBackground(func() { stages.EvictForWrite(database) })
+		}
+		return nil, err
+	}
+	database.GetLogger().Info("Database restored in place.", zap.String("source", sourceURI))
+
+	// NOTE: the content is restored whatever the checks return, the caller reports the failures
+	results, err := checks.Run(ctx, conn)
+	if err != nil {
+		database.GetLogger().Warn("Failed to run the checks of the restored database.", zap.Error(err))
+	} else if err := checks.Failed(results); err != nil {
+		database.GetLogger().Warn("Restored database failed its checks.", zap.Error(err))
+	}
+
+	if utils.Config.Settings.AutoSyncEnabled {
+		stages.RunInBackground(func() { stages.SyncToUpperStages(database) })
+	}
+	return results, nil
+}
@@ -0,0 +1,141 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"persisto/src/internal/coordination"
+	"persisto/src/internal/hooks"
+	"persisto/src/internal/metering"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+
+	"github.com/ncruces/go-sqlite3"
+	"go.uber.org/zap"
+)
+
+// ReadRowAs reads the row of the table with the given key and its version, see utils.ReadRow. It is restricted like
+// QueryAs.
+func (database *Database) ReadRowAs(ctx context.Context, principal string, endpoint string, table string, key string) (utils.Row, error) {
+	err := database.handleAccess()
+	if err != nil {
+		database.GetLogger().Warn("Failed to handle database request.", zap.Error(err))
+	}
+
+	if utils.Config.Settings.AutoStageMovement && database.RequestCount >= utils.Config.Settings.RequestCountThreshold {
+		stages.PromoteInBackground(database)
+	}
+
+	connectionString, leave, err := database.enter(ctx, true)
+	if err != nil {
+		database.GetLogger().Warn("Failed to enter database.", zap.Error(err))
+		return utils.Row{}, err
+	}
+	defer leave()
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return utils.Row{}, err
+	}
+	defer release()
+
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return utils.Row{}, err
+	}
+	defer connection.Close()
+
+	conn, session, _, err := database.connect(ctx, connection, principal, endpoint)
+	if err != nil {
+		return utils.Row{}, err
+	}
+	defer conn.Close()
+
+	masks := func(query string) ([]utils.ValueMask, error) {
+		return session.Masks(ctx, conn, query)
+	}
+	row, err := utils.ReadRow(ctx, conn, masks, table, key)
+	if err != nil {
+		return utils.Row{}, err
+	}
+	metering.RecordQuery(database.Name, 1)
+	return row, nil
+}
+
+// UpdateRowAs sets the values of the columns of the row of the table with the given key while its version matches
+// ifMatch, see utils.UpdateRow. It is restricted like ExecuteAs.
+func (database *Database) UpdateRowAs(ctx context.Context, principal string, endpoint string, table string, key string, values map[string]any, ifMatch string) (utils.Row, error) {
+	var row utils.Row
+	err := database.writeRow(ctx, principal, endpoint, func(conn *sql.Conn, masks func(query string) ([]utils.ValueMask, error)) error {
+		var err error
+		row, err = utils.UpdateRow(ctx, conn, masks, table, key, values, ifMatch)
+		return err
+	})
+	return row, err
+}
+
+// DeleteRowAs deletes the row of the table with the given key while its version matches ifMatch, see utils.DeleteRow.
+// It is restricted like ExecuteAs.
+func (database *Database) DeleteRowAs(ctx context.Context, principal string, endpoint string, table string, key string, ifMatch string) error {
+	return database.writeRow(ctx, principal, endpoint, func(conn *sql.Conn, masks func(query string) ([]utils.ValueMask, error)) error {
+		return utils.DeleteRow(ctx, conn, masks, table, key, ifMatch)
+	})
+}
+
+func (database *Database) writeRow(ctx context.Context, principal string, endpoint string, write func(conn *sql.Conn, masks func(query string) ([]utils.ValueMask, error)) error) error {
+	if err := coordination.Acquire(database.Name); err != nil {
+		return err
+	}
+
+	err := database.handleAccess()
+	if err != nil {
+		database.GetLogger().Warn("Failed to handle database request.", zap.Error(err))
+	}
+
+	connectionString, leave, err := database.enter(ctx, false)
+	if err != nil {
+		database.GetLogger().Warn("Failed to enter database.", zap.Error(err))
+		return err
+	}
+	defer leave()
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	conn, session, _, err := database.connect(ctx, connection, principal, endpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	masks := func(query string) ([]utils.ValueMask, error) {
+		return session.Masks(ctx, conn, query)
+	}
+	if err := write(conn, masks); err != nil {
+		if errors.Is(err, sqlite3.FULL) && utils.IsClosestStage(database.Stage) && !database.sizeQuotaReached() {
+			stages.RunInBackground(func() { stages.EvictForWrite(database) })
+		}
+		return err
+	}
+	metering.RecordStatements(database.Name, 1, 1)
+
+	if utils.Config.Settings.AutoStageMovement && database.RequestCount >= utils.Config.Settings.RequestCountThreshold {
+		stages.PromoteInBackground(database)
+	}
+
+	if utils.Config.Settings.AutoSyncEnabled {
+		stages.SyncInBackground(database, utils.PriorityOf(ctx))
+	}
+	hooks.Notify(database)
+	return nil
+}
@@ -0,0 +1,178 @@
+package databases
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"persisto/src/utils"
+)
+
+const (
+	SavepointKindCreate   = "create"
+	SavepointKindRelease  = "release"
+	SavepointKindRollback = "rollback"
+)
+
+// Savepoint is a savepoint statement of a transaction: SAVEPOINT name, RELEASE [SAVEPOINT] name or
+// ROLLBACK [TRANSACTION] TO [SAVEPOINT] name.
+type Savepoint struct {
+	Kind string
+	// NOTE: as written in the statement, quotes included
+	Name string
+}
+
+// NOTE: names are kept to plain or double quoted identifiers, they are written back into the ROLLBACK TO statements
+var savepointNamePattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*|"[^"]+")$`)
+
+// key identifies the savepoint, SQLite compares their names case-insensitively.
+func (savepoint Savepoint) key() string {
+	return strings.ToLower(strings.Trim(savepoint.Name, `"`))
+}
+
+// TransactionOptions changes how a transaction handles its failing queries.
+type TransactionOptions struct {
+	// RollbackToSavepoint rolls a failing query back to the innermost open savepoint and carries on from the RELEASE of
+	// that savepoint, rather than rolling back the whole transaction. Without open savepoint the transaction is rolled
+	// back.
+	RollbackToSavepoint bool
+	// Attach attaches the databases to the transaction under their name, its changes to all of them are committed or
+	// rolled back together. They must be served from the same stage as the database, see attach.go.
+	Attach []*Database
+}
+
+// SavepointRollback is a part of a transaction rolled back to a savepoint, the queries from Savepoint, excluded, to
+// Release, excluded, are undone or weren't run. Release is the number of queries when the savepoint isn't released.
+type SavepointRollback struct {
+	Savepoint   string
+	Start       int
+	FailedIndex int
+	Release     int
+	Err         error
+}
+
+// Covers reports whether the query at index was rolled back or skipped by the rollback.
+func (rollback SavepointRollback) Covers(index int) bool {
+	return index > rollback.Start && index < rollback.Release
+}
+
+// ParseSavepoint returns the savepoint statement the query is, false for any other query.
+func ParseSavepoint(query string) (Savepoint, bool) {
+	fields := strings.Fields(strings.TrimRight(strings.TrimSpace(query), ";"))
+	words := make([]string, len(fields))
+	for i, field := range fields {
+		words[i] = strings.ToUpper(field)
+	}
+
+	if len(fields) < 2 || !savepointNamePattern.MatchString(fields[len(fields)-1]) {
+		return Savepoint{}, false
+	}
+
+	switch {
+	case len(words) == 2 && words[0] == "SAVEPOINT":
+		return Savepoint{Kind: SavepointKindCreate, Name: fields[1]}, true
+	case words[0] == "RELEASE":
+		rest := fields[1:]
+		if strings.EqualFold(rest[0], "SAVEPOINT") {
+			rest = rest[1:]
+		}
+		if len(rest) == 1 {
+			return Savepoint{Kind: SavepointKindRelease, Name: rest[0]}, true
+		}
+	case words[0] == "ROLLBACK":
+		rest := fields[1:]
+		if strings.EqualFold(rest[0], "TRANSACTION") {
+			rest = rest[1:]
+		}
+		if len(rest) < 2 || !strings.EqualFold(rest[0], "TO") {
+			return Savepoint{}, false
+		}
+		rest = rest[1:]
+		if len(rest) == 2 && strings.EqualFold(rest[0], "SAVEPOINT") {
+			rest = rest[1:]
+		}
+		if len(rest) == 1 {
+			return Savepoint{Kind: SavepointKindRollback, Name: rest[0]}, true
+		}
+	}
+	return Savepoint{}, false
+}
+
+// checkTransactionControl refuses the statements ending or nesting the transaction the queries run in, savepoints
+// being the way to nest them.
+func checkTransactionControl(query string) error {
+	if _, isSavepoint := ParseSavepoint(query); isSavepoint {
+		return nil
+	}
+
+	fields := strings.Fields(strings.TrimSpace(query))
+	if len(fields) == 0 {
+		return nil
+	}
+	switch keyword := strings.ToUpper(strings.TrimRight(fields[0], ";")); keyword {
+	case "SAVEPOINT", "RELEASE":
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid %s statement, the savepoint must be named with a single identifier", keyword), nil)
+	case "BEGIN", "COMMIT", "END", "ROLLBACK":
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("%s can't be run within a transaction, use SAVEPOINT, RELEASE and ROLLBACK TO to nest them", keyword), nil)
+	}
+	return nil
+}
+
+// savepointStack tracks the savepoints open at each point of a transaction.
+type savepointStack []openSavepoint
+
+type openSavepoint struct {
+	savepoint Savepoint
+	index     int
+}
+
+// apply updates the open savepoints once the savepoint statement at index succeeded.
+func (stack savepointStack) apply(savepoint Savepoint, index int) savepointStack {
+	switch savepoint.Kind {
+	case SavepointKindCreate:
+		return append(stack, openSavepoint{savepoint: savepoint, index: index})
+	case SavepointKindRelease:
+		// NOTE: releasing a savepoint releases every savepoint opened after it as well
+		if position := stack.find(savepoint); position >= 0 {
+			return stack[:position]
+		}
+	case SavepointKindRollback:
+		// NOTE: the savepoint rolled back to stays open, those opened after it are gone
+		if position := stack.find(savepoint); position >= 0 {
+			return stack[:position+1]
+		}
+	}
+	return stack
+}
+
+// find returns the position of the innermost savepoint with the same name, -1 when it isn't open.
+func (stack savepointStack) find(savepoint Savepoint) int {
+	for position := len(stack) - 1; position >= 0; position-- {
+		if stack[position].savepoint.key() == savepoint.key() {
+			return position
+		}
+	}
+	return -1
+}
+
+// releaseIndex returns the index of the query releasing the open savepoint after the query at from, len(queries) when
+// none does.
+func releaseIndex(queries []string, from int, name string) int {
+	depth := 0
+	for index := from + 1; index < len(queries); index++ {
+		savepoint, isSavepoint := ParseSavepoint(queries[index])
+		if !isSavepoint || savepoint.key() != name {
+			continue
+		}
+		switch savepoint.Kind {
+		case SavepointKindCreate:
+			depth++
+		case SavepointKindRelease:
+			if depth == 0 {
+				return index
+			}
+			depth--
+		}
+	}
+	return len(queries)
+}
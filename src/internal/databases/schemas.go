@@ -0,0 +1,25 @@
+package databases
+
+import (
+	"context"
+
+	"persisto/src/internal/schemas"
+)
+
+// ReadSchema returns the schema of the database on the stage it is served from. It doesn't count as an access to the
+// database.
+func (database *Database) ReadSchema() (schemas.Schema, error) {
+	connectionString, leave, err := database.enter(context.Background(), true)
+	if err != nil {
+		return schemas.Schema{}, err
+	}
+	defer leave()
+
+	release, err := database.acquireConnection(context.Background())
+	if err != nil {
+		return schemas.Schema{}, err
+	}
+	defer release()
+
+	return schemas.Read(connectionString + "&mode=ro")
+}
@@ -0,0 +1,284 @@
+package databases
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: the catalog is held by a CatalogStore, picked with CATALOG_STORE. The databases are indexed by name, by the
+// stage serving them and by the tenant owning their remote copy, see STORAGE_REMOTE_TENANTS, and every store is safe
+// for concurrent use: the requests and the monitor look the databases up while the reconciliation, the adoptions, the
+// moves and the deletions change the catalog.
+const (
+	CatalogStoreMemory = "memory"
+	CatalogStoreSQLite = "sqlite"
+)
+
+// CatalogStore holds the databases of the catalog.
+type CatalogStore interface {
+	// Get returns the database under the normalized name.
+	Get(name string) (*Database, bool)
+	// Add adds the database, failing with a conflict when the catalog already holds one under its name.
+	Add(database *Database) error
+	// Remove removes the database under the name, it reports whether the catalog held it.
+	Remove(name string) (bool, error)
+	// List returns the databases sorted by name.
+	List() []*Database
+	// ListStage returns the databases served from the stage sorted by name.
+	ListStage(stage uint) []*Database
+	// ListTenant returns the databases of the tenant sorted by name, those of the shared bucket for an empty tenant.
+	ListTenant(tenant string) []*Database
+	// Restage indexes the database under the stage it moved to, see Database.SetStage.
+	Restage(database *Database) error
+	Len() int
+}
+
+// NewCatalogStore returns the store of CATALOG_STORE, empty.
+func NewCatalogStore() (CatalogStore, error) {
+	switch utils.Config.Catalog.Store {
+	case CatalogStoreSQLite:
+		return newSQLiteStore(utils.Config.Catalog.StorePath)
+	default:
+		return newMemoryStore(), nil
+	}
+}
+
+// tenantOf returns the tenant owning the remote copy of the database, empty for the shared bucket.
+func tenantOf(name string) string {
+	return remotevfs.TenantOf(utils.DatabaseFileName(name))
+}
+
+type memoryStore struct {
+	mtx sync.RWMutex
+
+	byName   map[string]*Database
+	byStage  map[uint]map[string]*Database
+	byTenant map[string]map[string]*Database
+	// NOTE: stage each database is indexed under, the database itself already moved when it is restaged
+	stageOf map[string]uint
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		byName:   map[string]*Database{},
+		byStage:  map[uint]map[string]*Database{},
+		byTenant: map[string]map[string]*Database{},
+		stageOf:  map[string]uint{},
+	}
+}
+
+func (store *memoryStore) Get(name string) (*Database, bool) {
+	store.mtx.RLock()
+	defer store.mtx.RUnlock()
+
+	database, found := store.byName[name]
+	return database, found
+}
+
+func (store *memoryStore) Add(database *Database) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	return store.add(database)
+}
+
+// NOTE: mtx must be held
+func (store *memoryStore) add(database *Database) error {
+	if _, found := store.byName[database.Name]; found {
+		return utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("database %s is already in the catalog", database.Name), nil)
+	}
+
+	store.byName[database.Name] = database
+	store.index(database, database.Stage)
+	tenant := tenantOf(database.Name)
+	if store.byTenant[tenant] == nil {
+		store.byTenant[tenant] = map[string]*Database{}
+	}
+	store.byTenant[tenant][database.Name] = database
+	return nil
+}
+
+// NOTE: mtx must be held
+func (store *memoryStore) index(database *Database, stage uint) {
+	if store.byStage[stage] == nil {
+		store.byStage[stage] = map[string]*Database{}
+	}
+	store.byStage[stage][database.Name] = database
+	store.stageOf[database.Name] = stage
+}
+
+// NOTE: mtx must be held
+func (store *memoryStore) unindex(name string) {
+	stage := store.stageOf[name]
+	delete(store.byStage[stage], name)
+	if len(store.byStage[stage]) == 0 {
+		delete(store.byStage, stage)
+	}
+	delete(store.stageOf, name)
+}
+
+func (store *memoryStore) Remove(name string) (bool, error) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	return store.remove(name), nil
+}
+
+// NOTE: mtx must be held
+func (store *memoryStore) remove(name string) bool {
+	if _, found := store.byName[name]; !found {
+		return false
+	}
+
+	delete(store.byName, name)
+	store.unindex(name)
+	tenant := tenantOf(name)
+	delete(store.byTenant[tenant], name)
+	if len(store.byTenant[tenant]) == 0 {
+		delete(store.byTenant, tenant)
+	}
+	return true
+}
+
+func (store *memoryStore) List() []*Database {
+	store.mtx.RLock()
+	defer store.mtx.RUnlock()
+
+	return sortedByName(store.byName)
+}
+
+func (store *memoryStore) ListStage(stage uint) []*Database {
+	store.mtx.RLock()
+	defer store.mtx.RUnlock()
+
+	return sortedByName(store.byStage[stage])
+}
+
+func (store *memoryStore) ListTenant(tenant string) []*Database {
+	store.mtx.RLock()
+	defer store.mtx.RUnlock()
+
+	return sortedByName(store.byTenant[tenant])
+}
+
+func (store *memoryStore) Restage(database *Database) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	store.restage(database)
+	return nil
+}
+
+// NOTE: mtx must be held, it reports whether the database was indexed under another stage
+func (store *memoryStore) restage(database *Database) bool {
+	// NOTE: a database out of the catalog, e.g. deleted meanwhile, isn't indexed
+	if store.byName[database.Name] != database || store.stageOf[database.Name] == database.Stage {
+		return false
+	}
+	store.unindex(database.Name)
+	store.index(database, database.Stage)
+	return true
+}
+
+func (store *memoryStore) Len() int {
+	store.mtx.RLock()
+	defer store.mtx.RUnlock()
+
+	return len(store.byName)
+}
+
+func sortedByName(databases map[string]*Database) []*Database {
+	list := make([]*Database, 0, len(databases))
+	for _, database := range databases {
+		list = append(list, database)
+	}
+	slices.SortFunc(list, func(a, b *Database) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+// NOTE: the databases are live objects holding their mutexes and counters, the SQLite store keeps them in memory like
+// the memory store and writes the catalog through to the catalog table of CATALOG_STORE_PATH, indexed by name, stage
+// and tenant. The table is rebuilt at startup with the catalog, it lets other processes read which databases the
+// instance serves and from which stage without going through the API.
+type sqliteStore struct {
+	*memoryStore
+
+	db *sql.DB
+}
+
+const catalogStoreSchema = `
+DROP TABLE IF EXISTS catalog;
+CREATE TABLE catalog (
+	name     TEXT PRIMARY KEY,
+	stage    INTEGER NOT NULL,
+	tenant   TEXT NOT NULL,
+	added_at TEXT NOT NULL
+) WITHOUT ROWID;
+CREATE INDEX catalog_stage ON catalog (stage, name);
+CREATE INDEX catalog_tenant ON catalog (tenant, name);
+`
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_pragma=journal_mode(wal)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the catalog store %s: %v", path, err)
+	}
+	// NOTE: the writes go through the store mutex, one connection is enough
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(catalogStoreSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to setup the catalog store %s: %v", path, err)
+	}
+
+	utils.Logger.Info("Catalog stored in SQLite.", zap.String("path", path))
+	return &sqliteStore{memoryStore: newMemoryStore(), db: db}, nil
+}
+
+func (store *sqliteStore) Add(database *Database) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	if _, found := store.byName[database.Name]; found {
+		return store.memoryStore.add(database)
+	}
+	if _, err := store.db.Exec("INSERT INTO catalog (name, stage, tenant, added_at) VALUES (?, ?, ?, ?)", database.Name, database.Stage, tenantOf(database.Name), time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+		return utils.NewError(utils.ErrorCodeInternal, fmt.Sprintf("failed to add database %s to the catalog store", database.Name), err)
+	}
+	return store.memoryStore.add(database)
+}
+
+func (store *sqliteStore) Remove(name string) (bool, error) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	if _, found := store.byName[name]; !found {
+		return false, nil
+	}
+	if _, err := store.db.Exec("DELETE FROM catalog WHERE name = ?", name); err != nil {
+		return false, utils.NewError(utils.ErrorCodeInternal, fmt.Sprintf("failed to remove database %s from the catalog store", name), err)
+	}
+	return store.memoryStore.remove(name), nil
+}
+
+func (store *sqliteStore) Restage(database *Database) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	if !store.memoryStore.restage(database) {
+		return nil
+	}
+	if _, err := store.db.Exec("UPDATE catalog SET stage = ? WHERE name = ?", database.Stage, database.Name); err != nil {
+		return utils.NewError(utils.ErrorCodeInternal, fmt.Sprintf("failed to restage database %s in the catalog store", database.Name), err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"iter"
+
+	"persisto/src/internal/metering"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: returned by the callback of QueryRows once the loop over the rows stopped early
+var errRowsStopped = errors.New("rows no longer read")
+
+// QueryEach runs the read query unrestricted and passes its rows to fn one at a time, see QueryEachAs.
+func (database *Database) QueryEach(ctx context.Context, fn func(columns []utils.QueryColumn, values []any) error, query string, parameters ...any) error {
+	return database.QueryEachAs(ctx, "", "", fn, query, parameters...)
+}
+
+// QueryEachAs runs the read query restricted like QueryAs and passes its rows to fn one at a time as they are read,
+// rather than materializing them, so that results of any size are processed in constant memory, see utils.EachRow. The
+// database stays on its stage until the last row was passed, the first error of fn stops the query and is returned.
+func (database *Database) QueryEachAs(ctx context.Context, principal string, endpoint string, fn func(columns []utils.QueryColumn, values []any) error, query string, parameters ...any) error {
+	return database.streamAs(ctx, principal, endpoint, func(rows *sql.Rows, masks []utils.ValueMask, maxRows int) (int, error) {
+		return utils.EachRow(rows, masks, maxRows, fn)
+	}, query, parameters...)
+}
+
+// QueryRows runs the read query unrestricted and returns an iterator over its rows, see QueryEach. The values of a row
+// are only valid until the next one, an error ends the iteration.
+func (database *Database) QueryRows(ctx context.Context, query string, parameters ...any) iter.Seq2[[]any, error] {
+	return func(yield func([]any, error) bool) {
+		err := database.QueryEach(ctx, func(_ []utils.QueryColumn, values []any) error {
+			if !yield(values, nil) {
+				return errRowsStopped
+			}
+			return nil
+		}, query, parameters...)
+		if err != nil && !errors.Is(err, errRowsStopped) {
+			yield(nil, err)
+		}
+	}
+}
+
+// streamAs runs the read query restricted like QueryAs and passes its rows, along with the masks of its columns and
+// the rows allowed by the statement policy, to read, which returns the rows it read.
+func (database *Database) streamAs(ctx context.Context, principal string, endpoint string, read func(rows *sql.Rows, masks []utils.ValueMask, maxRows int) (int, error), query string, parameters ...any) error {
+	err := database.handleAccess()
+	if err != nil {
+		database.GetLogger().Warn("Failed to handle database request.", zap.Error(err))
+	}
+
+	// NOTE: scheduled before running the query, which is served from the remote stage while the database is promoted
+	if utils.Config.Settings.AutoStageMovement && database.RequestCount >= utils.Config.Settings.RequestCountThreshold {
+		stages.PromoteInBackground(database)
+	}
+
+	connectionString, leave, err := database.enter(ctx, true)
+	if err != nil {
+		database.GetLogger().Warn("Failed to enter database.", zap.Error(err))
+		return err
+	}
+	defer leave()
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	conn, session, statementPolicy, err := database.connect(ctx, connection, principal, endpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	guardrails := statementPolicy.Guardrails()
+	query = guardrails.Rewrite(query)
+	masks, err := session.Masks(ctx, conn, query)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := guardrails.Bound(ctx)
+	defer cancel()
+
+	rows, err := conn.QueryContext(ctx, query, parameters...)
+	if err != nil {
+		database.GetLogger().Error("Query failed.", zap.String("query", query))
+		return utils.RecordBusyError(database.Name, guardrails.Check(ctx, err))
+	}
+
+	count, err := read(rows, masks, statementPolicy.MaxRows)
+	metering.RecordQuery(database.Name, count)
+	return utils.RecordBusyError(database.Name, guardrails.Check(ctx, err))
+}
@@ -0,0 +1,180 @@
+package databases
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: the sync lag of a database is the time since the oldest write its copy at the persistence stage misses, zero
+// once the sync caught up. The sync window bounds it, SETTINGS_SYNC_WINDOW_SECONDS for every database unless its quotas
+// set its own, and the databases lagging past it are reported through the logs, the audit events, the metrics and the
+// sync window webhook.
+
+// NOTE: the writes within a second share their time, past maxWriteTimes every other one is merged with the previous,
+// which only ever makes the lag look older than it is
+const (
+	writeTimeResolution = time.Second
+	maxWriteTimes       = 1024
+)
+
+type writeTime struct {
+	sequence uint64
+	at       time.Time
+}
+
+var (
+	syncWindowSetupOnce sync.Once
+
+	syncWindowClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// recordWriteTime remembers when the write was made while the persistence stage may miss it, copySequencesMutex must
+// be held.
+func (database *Database) recordWriteTime(sequence uint64) {
+	if database.Stage >= utils.Config.Settings.PersistenceStage {
+		return
+	}
+
+	now := time.Now()
+	if count := len(database.writeTimes); count > 0 && now.Sub(database.writeTimes[count-1].at) < writeTimeResolution {
+		return
+	}
+	database.writeTimes = append(database.writeTimes, writeTime{sequence: sequence, at: now})
+
+	if len(database.writeTimes) > maxWriteTimes {
+		compacted := database.writeTimes[:0]
+		for index, entry := range database.writeTimes {
+			if index%2 == 0 {
+				compacted = append(compacted, entry)
+			}
+		}
+		database.writeTimes = compacted
+	}
+}
+
+// SyncLag returns the time since the oldest write the copy of the database at the persistence stage misses, zero when
+// it holds them all or when the database is served from that stage or a farther one. The writes the remote copy of the
+// companion misses are counted when the persistence stage is the remote one, wherever the database is served from.
+func (database *Database) SyncLag() time.Duration {
+	lag := database.databaseLag()
+	if utils.Config.Settings.PersistenceStage == utils.GetRemoteStage() {
+		lag = max(lag, database.tieredLag())
+	}
+	return lag
+}
+
+func (database *Database) databaseLag() time.Duration {
+	persistenceStage := utils.Config.Settings.PersistenceStage
+
+	database.copySequencesMutex.Lock()
+	defer database.copySequencesMutex.Unlock()
+
+	persisted := database.copySequences[persistenceStage]
+	if database.Stage >= persistenceStage || persisted >= database.writeSequence.Load() {
+		database.writeTimes = nil
+		return 0
+	}
+
+	// NOTE: an entry stands for the writes up to the next one, it is dropped once the persistence stage holds them all
+	firstMissed := 0
+	for firstMissed+1 < len(database.writeTimes) && database.writeTimes[firstMissed+1].sequence <= persisted+1 {
+		firstMissed++
+	}
+	database.writeTimes = slices.Delete(database.writeTimes, 0, firstMissed)
+	if len(database.writeTimes) == 0 {
+		return 0
+	}
+	return time.Since(database.writeTimes[0].at)
+}
+
+// SyncWindow returns the sync lag allowed to the database, zero when it has no sync window.
+func (database *Database) SyncWindow() time.Duration {
+	seconds := database.syncWindowQuota.Load()
+	if seconds <= 0 {
+		seconds = int64(utils.Config.Settings.SyncWindowSeconds)
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// SyncWindowExceeded reports whether the database lagged past its sync window at the last check.
+func (database *Database) SyncWindowExceeded() bool {
+	return database.syncWindowExceeded.Load()
+}
+
+// SetupSyncWindowMonitor periodically checks the sync lag of the databases against their sync window.
+func SetupSyncWindowMonitor() {
+	syncWindowSetupOnce.Do(func() {
+		go func() {
+			interval := time.Duration(utils.Config.Settings.SyncWindowCheckIntervalSeconds) * time.Second
+			utils.StagesLogger.Info("Starting sync window monitor.", zap.Duration("interval", interval), zap.Int("windowSeconds", utils.Config.Settings.SyncWindowSeconds))
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				if Dbs != nil {
+					CheckSyncWindows(Dbs.All())
+				}
+			}
+		}()
+	})
+}
+
+// CheckSyncWindows compares the sync lag of the databases with their sync window, reporting those starting to lag
+// past it and those back within it.
+func CheckSyncWindows(items []*Database) {
+	for _, database := range items {
+		lag, window := database.SyncLag(), database.SyncWindow()
+		exceeded := window > 0 && lag > window
+		if database.syncWindowExceeded.Swap(exceeded) == exceeded {
+			continue
+		}
+
+		eventType := audit.EventSyncWindowRecovered
+		if exceeded {
+			eventType = audit.EventSyncWindowExceeded
+			database.GetLogger().Warn("Database lags past its sync window.", zap.Duration("lag", lag), zap.Duration("window", window))
+		} else {
+			database.GetLogger().Info("Database back within its sync window.", zap.Duration("lag", lag), zap.Duration("window", window))
+		}
+
+		details := map[string]any{"lag_ms": lag.Milliseconds(), "window_seconds": int64(window.Seconds())}
+		audit.Record(audit.Event{Type: eventType, Database: database.GetName(), Details: details})
+		notifySyncWindow(database.GetName(), eventType, details)
+	}
+}
+
+// NOTE: posts the change to the sync window webhook in the background, failing to deliver it is only logged
+func notifySyncWindow(database string, eventType string, details map[string]any) {
+	url := utils.Config.Settings.SyncWindowWebhookURL
+	if url == "" {
+		return
+	}
+
+	body, err := json.Marshal(map[string]any{"database": database, "event": eventType, "details": details, "at": time.Now().UTC()})
+	if err != nil {
+		utils.Logger.Warn("Failed to encode sync window alert.", zap.Error(err))
+		return
+	}
+
+	go func() {
+		response, err := syncWindowClient.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			utils.Logger.Warn("Failed to send sync window alert.", zap.String("database", database), zap.Error(err))
+			return
+		}
+		response.Body.Close()
+		if response.StatusCode >= http.StatusBadRequest {
+			utils.Logger.Warn("Sync window webhook responded with an error.", zap.String("database", database), zap.Int("status", response.StatusCode))
+		}
+	}()
+}
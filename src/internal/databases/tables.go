@@ -0,0 +1,287 @@
+package databases
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"persisto/src/utils"
+)
+
+// Reader runs a read query through the window, e.g. Database.QueryAs for a principal or the replica of a follower.
+type Reader func(window utils.ResultWindow, query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, bool, error)
+
+// RowsRequest describes a page of rows read from a table, in the order of its key.
+type RowsRequest struct {
+	Table string
+	// NOTE: every column of the table when empty
+	Columns []string
+	Filters []Filter
+	// NOTE: the key of the table breaks the ties of the column, which is then part of the keyset
+	OrderBy    string
+	Descending bool
+	Limit      int
+	// NOTE: cursor of the previous page, empty for the first one
+	After string
+}
+
+// Filter keeps the rows whose column compares to the value with the operator.
+type Filter struct {
+	Column   string
+	Operator string
+	Value    string
+}
+
+// RowsPage is a page of rows read from a table, NextCursor is empty for the last one.
+type RowsPage struct {
+	Rows       utils.QueryResultType
+	Columns    []utils.QueryColumn
+	NextCursor string
+}
+
+// NOTE: SQL of the filter operators, in is given the values separated by |
+var filterOperators = map[string]string{
+	"eq": "=", "ne": "<>", "lt": "<", "lte": "<=", "gt": ">", "gte": ">=", "like": "LIKE", "in": "IN", "null": "IS NULL", "notnull": "IS NOT NULL",
+}
+
+// NOTE: prefix of the key columns selected along with the requested ones, removed from the rows returned
+const keyColumnPrefix = "_persisto_key_"
+
+// ParseFilter decodes a <column>:<operator>[:<value>] filter, the null and notnull operators take no value.
+func ParseFilter(expression string) (Filter, error) {
+	fields := strings.SplitN(expression, ":", 3)
+	if len(fields) < 2 || fields[0] == "" {
+		return Filter{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid filter %q, expected <column>:<operator>[:<value>]", expression), nil)
+	}
+
+	filter := Filter{Column: fields[0], Operator: fields[1]}
+	if len(fields) == 3 {
+		filter.Value = fields[2]
+	}
+	if _, known := filterOperators[filter.Operator]; !known {
+		return Filter{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("unknown operator %s in filter %q, the operators are eq, ne, lt, lte, gt, gte, like, in, null and notnull", filter.Operator, expression), nil)
+	}
+	if (filter.Operator == "null" || filter.Operator == "notnull") != (len(fields) == 2) {
+		return Filter{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid filter %q, only the null and notnull operators take no value", expression), nil)
+	}
+	return filter, nil
+}
+
+// ReadRows reads a page of rows of the table with keyset pagination, so that reading a page costs the same however
+// deep it is and rows written in between don't shift the pages. The statement is built from the names of the table
+// and its columns, every value is bound as a parameter. schema reads the structure of the table, read runs the
+// statement on behalf of the client.
+func ReadRows(schema Reader, read Reader, request RowsRequest, window utils.ResultWindow) (RowsPage, error) {
+	if strings.HasPrefix(strings.ToLower(request.Table), "_persisto_") {
+		return RowsPage{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("table %s not found", request.Table), nil)
+	}
+
+	tables, _, _, err := schema(utils.ResultWindow{}, "SELECT type FROM pragma_table_list WHERE schema IN ('main', '"+TieredSchema+"') AND type IN ('table', 'view') AND name = ?", request.Table)
+	if err != nil {
+		return RowsPage{}, err
+	}
+	if len(tables) == 0 {
+		return RowsPage{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("table %s not found", request.Table), nil)
+	}
+	if tables[0]["type"] != "table" {
+		return RowsPage{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("%s is a view, only the rows of tables can be paged", request.Table), nil)
+	}
+
+	info, _, _, err := schema(utils.ResultWindow{}, "SELECT name, pk, \"notnull\" FROM pragma_table_info(?) ORDER BY cid", request.Table)
+	if err != nil {
+		return RowsPage{}, err
+	}
+
+	var columns, keys []string
+	notNull := map[string]bool{}
+	primaryKey := map[int64]string{}
+	for _, column := range info {
+		name, _ := column["name"].(string)
+		columns = append(columns, name)
+		if position, _ := column["pk"].(int64); position > 0 {
+			primaryKey[position] = name
+			notNull[name] = true
+		}
+		if flag, _ := column["notnull"].(int64); flag == 1 {
+			notNull[name] = true
+		}
+	}
+	for position := int64(1); position <= int64(len(primaryKey)); position++ {
+		keys = append(keys, primaryKey[position])
+	}
+	if len(keys) == 0 {
+		// NOTE: the rowid of the tables without primary key, the views of the restricted principals don't have one
+		keys = []string{"rowid"}
+	}
+
+	if request.OrderBy != "" && !slices.Equal(keys, []string{request.OrderBy}) {
+		if !slices.Contains(columns, request.OrderBy) {
+			return RowsPage{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("unknown column %s", request.OrderBy), nil)
+		}
+		// NOTE: rows holding NULL can't be compared to the cursor, they would be skipped
+		if !notNull[request.OrderBy] {
+			return RowsPage{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("column %s must be NOT NULL to order the rows by it", request.OrderBy), nil)
+		}
+		keys = append([]string{request.OrderBy}, slices.DeleteFunc(keys, func(key string) bool { return key == request.OrderBy })...)
+	}
+
+	selected := request.Columns
+	if len(selected) == 0 {
+		selected = columns
+	}
+	expressions := make([]string, 0, len(selected)+len(keys))
+	for _, column := range selected {
+		if !slices.Contains(columns, column) {
+			return RowsPage{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("unknown column %s", column), nil)
+		}
+		expressions = append(expressions, utils.QuoteIdentifier(column))
+	}
+	quotedKeys := make([]string, len(keys))
+	for index, key := range keys {
+		quotedKeys[index] = utils.QuoteIdentifier(key)
+		expressions = append(expressions, quotedKeys[index]+" AS "+utils.QuoteIdentifier(fmt.Sprintf("%s%d", keyColumnPrefix, index)))
+	}
+
+	var conditions []string
+	var parameters []any
+	for _, filter := range request.Filters {
+		if !slices.Contains(columns, filter.Column) {
+			return RowsPage{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("unknown column %s", filter.Column), nil)
+		}
+		condition := utils.QuoteIdentifier(filter.Column) + " " + filterOperators[filter.Operator]
+		switch filter.Operator {
+		case "null", "notnull":
+		case "in":
+			values := strings.Split(filter.Value, "|")
+			condition += " (" + strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ") + ")"
+			for _, value := range values {
+				parameters = append(parameters, value)
+			}
+		default:
+			condition += " ?"
+			parameters = append(parameters, filter.Value)
+		}
+		conditions = append(conditions, condition)
+	}
+
+	ordering := orderingOf(keys, request.Descending)
+	comparison, direction := ">", ""
+	if request.Descending {
+		comparison, direction = "<", " DESC"
+	}
+	if request.After != "" {
+		after, err := decodeCursor(request.After, ordering, len(keys))
+		if err != nil {
+			return RowsPage{}, err
+		}
+		conditions = append(conditions, "("+strings.Join(quotedKeys, ", ")+") "+comparison+" ("+strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ")+")")
+		parameters = append(parameters, after...)
+	}
+
+	statement := "SELECT " + strings.Join(expressions, ", ") + " FROM " + utils.QuoteIdentifier(request.Table)
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += " ORDER BY " + strings.Join(quotedKeys, direction+", ") + direction
+	// NOTE: one more row tells whether there is a next page
+	statement += " LIMIT ?"
+	parameters = append(parameters, request.Limit+1)
+
+	window.PageRows = request.Limit
+	rows, resultColumns, truncated, err := read(window, statement, parameters...)
+	if err != nil {
+		return RowsPage{}, err
+	}
+
+	page := RowsPage{Rows: rows, Columns: resultColumns[:min(len(selected), len(resultColumns))]}
+	if page.Rows == nil {
+		page.Rows = utils.QueryResultType{}
+	}
+	if truncated && len(rows) > 0 {
+		last := make([]any, len(keys))
+		for index := range keys {
+			last[index] = rows[len(rows)-1][fmt.Sprintf("%s%d", keyColumnPrefix, index)]
+		}
+		if page.NextCursor, err = encodeCursor(ordering, last); err != nil {
+			return RowsPage{}, err
+		}
+	}
+	for _, row := range page.Rows {
+		for index := range keys {
+			delete(row, fmt.Sprintf("%s%d", keyColumnPrefix, index))
+		}
+	}
+	return page, nil
+}
+
+// orderingOf describes the order of the pages, a cursor only continues the pages of the same order.
+func orderingOf(keys []string, descending bool) string {
+	ordering := strings.Join(keys, ",")
+	if descending {
+		ordering += " desc"
+	}
+	return ordering
+}
+
+type cursor struct {
+	Ordering string `json:"o"`
+	After    []any  `json:"a"`
+}
+
+// encodeCursor encodes the key of the last row of a page, blobs are encoded like the blob parameters of the queries.
+func encodeCursor(ordering string, after []any) (string, error) {
+	values := make([]any, len(after))
+	for index, value := range after {
+		if blob, isBlob := value.([]byte); isBlob {
+			value = map[string]any{utils.BlobParameterKey: base64.StdEncoding.EncodeToString(blob)}
+		}
+		values[index] = value
+	}
+
+	encoded, err := json.Marshal(cursor{Ordering: ordering, After: values})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded), nil
+}
+
+// decodeCursor returns the key values the next page starts after, keeping the integers exact.
+func decodeCursor(token string, ordering string, keys int) ([]any, error) {
+	invalid := utils.NewError(utils.ErrorCodeInvalidInput, "the cursor doesn't continue these pages", nil)
+
+	encoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, invalid
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var decoded cursor
+	if err := decoder.Decode(&decoded); err != nil || decoded.Ordering != ordering || len(decoded.After) != keys {
+		return nil, invalid
+	}
+
+	values := make([]any, len(decoded.After))
+	for index, value := range decoded.After {
+		if number, isNumber := value.(json.Number); isNumber {
+			if integer, err := number.Int64(); err == nil {
+				values[index] = integer
+				continue
+			}
+			float, err := number.Float64()
+			if err != nil {
+				return nil, invalid
+			}
+			value = float
+		}
+		converted, err := utils.QueryParameters([]any{value})
+		if err != nil {
+			return nil, invalid
+		}
+		values[index] = converted[0]
+	}
+	return values, nil
+}
@@ -0,0 +1,431 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"persisto/src/internal/connections"
+	"persisto/src/internal/coordination"
+	"persisto/src/internal/journal"
+	"persisto/src/internal/policies"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: the hot tables of a database are moved into a companion database kept on the local storage and attached to
+// every connection under TieredSchema. The unqualified names of the tables missing from the main database resolve to
+// the attached one, so the statements reach a tiered table without being changed.
+const (
+	TieredSchema = stages.TieredSchema
+	tieredSuffix = stages.TieredSuffix
+
+	metadataKeyTieredTables = stages.MetadataKeyTieredTables
+)
+
+func init() {
+	// NOTE: runs after the quotas and before the restrictions, which would refuse the ATTACH of a client
+	connections.Register(connections.Hook{Name: "tiering", Order: connections.OrderExtensions, Open: func(ctx context.Context, connection *connections.Connection) error {
+		database, isDatabase := connection.Value(databaseKey{}).(*Database)
+		if !isDatabase {
+			return nil
+		}
+		tables, err := stages.ReadTieredTables(ctx, connection.Conn)
+		if err != nil {
+			return fmt.Errorf("failed to read the tiered tables: %w", err)
+		}
+		database.tiered.Store(len(tables) > 0)
+		if len(tables) == 0 {
+			return nil
+		}
+		if err := database.attachCompanion(ctx, connection.Conn, false); err != nil {
+			return fmt.Errorf("failed to attach the tiered tables: %w", err)
+		}
+		return nil
+	}})
+}
+
+// attachCompanion attaches the companion of the database to the connection, fetching it from the remote stage when the
+// local storage misses it, e.g. on a new instance. create allows starting an empty companion when there is none.
+func (database *Database) attachCompanion(ctx context.Context, conn *sql.Conn, create bool) error {
+	var attached int
+	if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM pragma_database_list WHERE name = ?", TieredSchema).Scan(&attached); err != nil {
+		return err
+	}
+	if attached > 0 {
+		return nil
+	}
+
+	if err := database.fetchCompanion(create); err != nil {
+		return err
+	}
+	_, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS "+TieredSchema, stages.LocalConnectionString(stages.TieredPath(database.Name), stages.ConnectionOptions{WithoutPragmas: true}))
+	return err
+}
+
+func (database *Database) fetchCompanion(create bool) error {
+	// NOTE: looked up before taking the mutex, which an upload holds until the bucket answered
+	path := stages.TieredPath(database.Name)
+	if _, err := os.Stat(path); err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	database.companionMutex.Lock()
+	defer database.companionMutex.Unlock()
+
+	if _, err := os.Stat(path); err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	exists, err := remotevfs.ObjectExists(stages.TieredKey(database.Name))
+	if err != nil {
+		return utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to look up the tiered tables of database %s", database.Name), err)
+	}
+	if !exists {
+		if create {
+			return nil
+		}
+		return utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("the tiered tables of database %s are missing from the remote stage", database.Name), nil)
+	}
+
+	source, err := sql.Open("sqlite3", stages.RemoteConnectionString(stages.TieredKey(database.Name), stages.ConnectionOptions{ReadOnly: true, WithoutPragmas: true}))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	// NOTE: the copy is written aside through the VFS of the local stage then renamed, a connection never attaches a
+	// partial companion, and it is accounted, encrypted and known to the watcher like the databases of the local stage
+	temporaryPath := path + ".temp_download"
+	if err := localvfs.Delete(temporaryPath); err != nil {
+		return err
+	}
+	if _, err := source.Exec("VACUUM INTO ?", stages.LocalConnectionString(temporaryPath, stages.ConnectionOptions{WithoutPragmas: true})); err != nil {
+		localvfs.Delete(temporaryPath)
+		return utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to fetch the tiered tables of database %s", database.Name), err)
+	}
+	if err := os.Rename(temporaryPath, path); err != nil {
+		localvfs.Delete(temporaryPath)
+		return err
+	}
+
+	database.GetLogger().Info("Fetched the tiered tables from the remote stage.")
+	return nil
+}
+
+// scheduleCompanionUpload persists the companion in the background once written, the writes made while an upload is
+// scheduled are carried by it.
+func (database *Database) scheduleCompanionUpload() {
+	if database.companionUploadPending.Swap(true) {
+		return
+	}
+	stages.RunInBackground(func() {
+		if err := database.uploadCompanion(); err != nil {
+			database.GetLogger().Error("Failed to persist the tiered tables.", zap.Error(err))
+		}
+	})
+}
+
+// uploadCompanion writes a consistent copy of the companion to the remote stage, where the copies of the database are
+// persisted. The writes held in the journal are released once it holds them all, see holdTieredWrite.
+func (database *Database) uploadCompanion() error {
+	database.companionMutex.Lock()
+	defer database.companionMutex.Unlock()
+	database.companionUploadPending.Store(false)
+
+	// NOTE: a write made from now on may be missed by the copy, it is set again by the writes entering or leaving
+	database.tieredWritesMutex.Lock()
+	database.tieredWritten = false
+	database.tieredWritesMutex.Unlock()
+
+	size, err := stages.UploadCompanion(database.Name)
+	if err != nil {
+		return err
+	}
+	database.GetLogger().Debug("Persisted the tiered tables.", zap.Int("size", size))
+
+	database.tieredWritesMutex.Lock()
+	defer database.tieredWritesMutex.Unlock()
+	if database.tieredWriteHeld && !database.tieredWritten {
+		journal.Release(journal.OperationTieredWrite, database.Name)
+		database.tieredWriteHeld = false
+		database.tieredMissedSince = time.Time{}
+	}
+	return nil
+}
+
+// holdTieredWrite records the write to the tiered database in the journal unless the journal already holds one since
+// the last upload of the companion: the local companion is then the only copy holding it and is kept at the next
+// startup to be uploaded, see stages.RecoverTieredWrite. The write is refused when it can't be recorded.
+func (database *Database) holdTieredWrite() error {
+	database.tieredWritesMutex.Lock()
+	defer database.tieredWritesMutex.Unlock()
+
+	database.tieredWritten = true
+	if database.tieredWriteHeld {
+		return nil
+	}
+	if err := journal.Hold(journal.Intent{Operation: journal.OperationTieredWrite, Database: database.Name, SourceStage: utils.GetLocalStage(), TargetStage: utils.GetRemoteStage()}); err != nil {
+		return err
+	}
+	database.tieredWriteHeld = true
+	database.tieredMissedSince = time.Now()
+	return nil
+}
+
+// tieredLag returns the time since the oldest write the remote copy of the companion misses, zero when it holds them all.
+func (database *Database) tieredLag() time.Duration {
+	database.tieredWritesMutex.Lock()
+	defer database.tieredWritesMutex.Unlock()
+
+	if !database.tieredWriteHeld {
+		return 0
+	}
+	return time.Since(database.tieredMissedSince)
+}
+
+// PersistCompanion uploads the companion when its remote copy misses writes, the syncs to the remote stage persist the
+// tiered tables along with the database.
+func (database *Database) PersistCompanion() error {
+	database.tieredWritesMutex.Lock()
+	held := database.tieredWriteHeld
+	database.tieredWritesMutex.Unlock()
+
+	if !held {
+		return nil
+	}
+	return database.uploadCompanion()
+}
+
+// PromoteTable moves the table into the companion of the database on the local storage, the other tables staying at the
+// stage of the database. The companion is persisted to the remote stage before the table leaves the database, and the
+// writes to the tiered tables are persisted in the background and by the syncs to the remote stage. It returns the
+// tiered tables.
+func (database *Database) PromoteTable(table string) ([]string, error) {
+	return database.tier(table, true)
+}
+
+// DemoteTable moves the table back from the companion into the database, see PromoteTable.
+func (database *Database) DemoteTable(table string) ([]string, error) {
+	return database.tier(table, false)
+}
+
+func (database *Database) tier(table string, promote bool) ([]string, error) {
+	if err := coordination.Acquire(database.Name); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	connectionString, leave, err := database.enter(ctx, false)
+	if err != nil {
+		database.GetLogger().Warn("Failed to enter database.", zap.Error(err))
+		return nil, err
+	}
+	defer leave()
+
+	// NOTE: a single table moves at a time, the list of the tiered tables is read and written by each move
+	database.tieringMutex.Lock()
+	defer database.tieringMutex.Unlock()
+
+	release, err := database.acquireConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	conn, _, _, err := database.connect(ctx, connection, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	tables, err := stages.ReadTieredTables(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := database.attachCompanion(ctx, conn, true); err != nil {
+		return nil, err
+	}
+
+	if promote {
+		tables, err = database.promoteTable(ctx, conn, tables, table)
+	} else {
+		tables, err = database.demoteTable(ctx, conn, tables, table)
+	}
+	if err != nil {
+		return nil, utils.RecordBusyError(database.Name, err)
+	}
+	database.tiered.Store(len(tables) > 0)
+
+	database.GetLogger().Info("Moved table between tiers.", zap.String("table", table), zap.Bool("promoted", promote), zap.Strings("tieredTables", tables))
+	if utils.Config.Settings.AutoSyncEnabled {
+		stages.RunInBackground(func() { stages.SyncToUpperStages(database) })
+	}
+	return tables, nil
+}
+
+func (database *Database) promoteTable(ctx context.Context, conn *sql.Conn, tables []string, table string) ([]string, error) {
+	if err := checkTierable(ctx, conn, table); err != nil {
+		return nil, err
+	}
+	quoted := utils.QuoteIdentifier(table)
+
+	// NOTE: a copy left in the companion by an interrupted move isn't listed, the table of the database is the reference
+	if _, err := conn.ExecContext(ctx, "DROP TABLE IF EXISTS "+TieredSchema+"."+quoted); err != nil {
+		return nil, err
+	}
+	definitions, err := stages.TableDefinitions(ctx, conn, "main", table)
+	if err != nil {
+		return nil, err
+	}
+	if err := database.createInCompanion(definitions); err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "INSERT INTO "+TieredSchema+"."+quoted+" SELECT * FROM main."+quoted); err != nil {
+		return nil, fmt.Errorf("failed to copy the rows of table %s: %w", table, err)
+	}
+	// NOTE: the rows only leave the database once the companion holding them is persisted
+	if err := database.uploadCompanion(); err != nil {
+		return nil, utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to persist table %s, it stays in the database", table), err)
+	}
+
+	tables = append(slices.Clone(tables), table)
+	err = database.updateTieredTables(ctx, conn, tables, "DROP TABLE main."+quoted)
+	return tables, err
+}
+
+func (database *Database) demoteTable(ctx context.Context, conn *sql.Conn, tables []string, table string) ([]string, error) {
+	if !slices.Contains(tables, table) {
+		return nil, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("table %s isn't tiered", table), nil)
+	}
+	quoted := utils.QuoteIdentifier(table)
+
+	definitions, err := stages.TableDefinitions(ctx, conn, TieredSchema, table)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: the unqualified definitions are created in the main database, the indexes on the table just created there
+	statements := append(definitions, "INSERT INTO main."+quoted+" SELECT * FROM "+TieredSchema+"."+quoted)
+	tables = slices.DeleteFunc(slices.Clone(tables), func(tiered string) bool { return tiered == table })
+	if err := database.updateTieredTables(ctx, conn, tables, statements...); err != nil {
+		return nil, err
+	}
+
+	// NOTE: the table is back in the database, a copy left in the companion by a failure is dropped by the next move
+	if _, err := conn.ExecContext(ctx, "DROP TABLE "+TieredSchema+"."+quoted); err != nil {
+		database.GetLogger().Warn("Failed to drop the demoted table from the companion.", zap.String("table", table), zap.Error(err))
+		return tables, nil
+	}
+	database.scheduleCompanionUpload()
+	return tables, nil
+}
+
+// checkTierable refuses the tables whose move would break the schema: SQLite doesn't let the triggers, views and foreign
+// keys of a database reach the tables of another one. The tables restricted by a policy are refused too, the views
+// restricting the principals read them from the main database.
+func checkTierable(ctx context.Context, conn *sql.Conn, table string) error {
+	lowered := strings.ToLower(table)
+	if strings.HasPrefix(lowered, "sqlite_") || strings.HasPrefix(lowered, "_persisto_") {
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("table %s is internal, it can't be tiered", table), nil)
+	}
+
+	var kind string
+	err := conn.QueryRowContext(ctx, "SELECT type FROM main.sqlite_master WHERE name = ?", table).Scan(&kind)
+	if err == sql.ErrNoRows {
+		return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("table %s not found", table), nil)
+	}
+	if err != nil {
+		return err
+	}
+	if kind != "table" {
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("%s is a %s, only tables can be tiered", table, kind), nil)
+	}
+
+	var dependents int
+	err = conn.QueryRowContext(ctx, `SELECT
+		(SELECT count(*) FROM main.sqlite_master WHERE type = 'trigger' AND tbl_name = ?1) +
+		(SELECT count(*) FROM main.sqlite_master WHERE type = 'view' AND sql LIKE '%' || ?1 || '%') +
+		(SELECT count(*) FROM pragma_foreign_key_list(?1, 'main')) +
+		(SELECT count(*) FROM main.sqlite_master AS m, pragma_foreign_key_list(m.name, 'main') AS f
+			WHERE m.type = 'table' AND m.name <> ?1 AND f."table" = ?1 COLLATE NOCASE)`, table).Scan(&dependents)
+	if err != nil {
+		return err
+	}
+	if dependents > 0 {
+		return utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("table %s has triggers, foreign keys or views depending on it, it can't be tiered", table), nil)
+	}
+
+	restricted, err := policies.Restricts(ctx, conn, table)
+	if err != nil {
+		return err
+	}
+	if restricted {
+		return utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("table %s is restricted by a policy, it can't be tiered", table), nil)
+	}
+	return nil
+}
+
+// createInCompanion runs the definitions on a connection of the companion alone, where their unqualified names create
+// the table and its indexes.
+func (database *Database) createInCompanion(definitions []string) error {
+	connection, err := sql.Open("sqlite3", stages.LocalConnectionString(stages.TieredPath(database.Name), stages.ConnectionOptions{WithoutPragmas: true}))
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	transaction, err := connection.Begin()
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+	for _, definition := range definitions {
+		if _, err := transaction.Exec(definition); err != nil {
+			return fmt.Errorf("failed to create the table in the companion: %w", err)
+		}
+	}
+	return transaction.Commit()
+}
+
+// updateTieredTables runs the statements and records the tiered tables in a single transaction of the database.
+func (database *Database) updateTieredTables(ctx context.Context, conn *sql.Conn, tables []string, statements ...string) error {
+	transaction, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+
+	for _, statement := range statements {
+		if _, err := transaction.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	// NOTE: the companion has no metadata table, the unqualified names reach the one of the database
+	if _, err := transaction.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+MetadataTable+" (key TEXT PRIMARY KEY, value TEXT NOT NULL)"); err != nil {
+		return err
+	}
+	query, parameters, err := metadataQuery(metadataKeyTieredTables, tables)
+	if err != nil {
+		return err
+	}
+	if _, err := transaction.ExecContext(ctx, query, parameters...); err != nil {
+		return err
+	}
+	return transaction.Commit()
+}
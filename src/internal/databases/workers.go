@@ -0,0 +1,68 @@
+package databases
+
+import (
+	"sync"
+
+	"persisto/src/utils"
+)
+
+var (
+	workerJobs map[utils.Priority]chan func()
+
+	workersSetupOnce sync.Once
+)
+
+// RunOnWorker runs the job on the worker pool shared by every request, waiting for a worker to be free. The pool has
+// SETTINGS_QUERY_WORKERS workers, so that concurrent requests can't open more connections than that between them. A free
+// worker takes the most urgent job waiting, and SETTINGS_INTERACTIVE_RESERVED_PERCENT of the workers only take the
+// interactive ones.
+func RunOnWorker(priority utils.Priority, job func()) {
+	workersSetupOnce.Do(func() {
+		workerJobs = make(map[utils.Priority]chan func())
+		for _, priority := range utils.Priorities {
+			workerJobs[priority] = make(chan func())
+		}
+
+		workers := utils.Config.Settings.QueryWorkers
+		reserved := workers * utils.Config.Settings.InteractiveReservedPercent / 100
+		for worker := range workers {
+			go work(worker < reserved)
+		}
+	})
+	workerJobs[priority] <- job
+}
+
+func work(interactiveOnly bool) {
+	interactive, batch, maintenance := workerJobs[utils.PriorityInteractive], workerJobs[utils.PriorityBatch], workerJobs[utils.PriorityMaintenance]
+	if interactiveOnly {
+		batch, maintenance = nil, nil
+	}
+
+	for {
+		// NOTE: select picks at random among the ready channels, the more urgent ones are tried first
+		select {
+		case job := <-interactive:
+			job()
+			continue
+		default:
+		}
+		select {
+		case job := <-interactive:
+			job()
+			continue
+		case job := <-batch:
+			job()
+			continue
+		default:
+		}
+
+		select {
+		case job := <-interactive:
+			job()
+		case job := <-batch:
+			job()
+		case job := <-maintenance:
+			job()
+		}
+	}
+}
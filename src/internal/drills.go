@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"sync"
+
+	"persisto/src/internal/databases"
+	"persisto/src/internal/drills"
+	"persisto/src/internal/stages"
+)
+
+var (
+	drillsSetupOnce sync.Once
+)
+
+func SetupDrills() {
+	drillsSetupOnce.Do(func() {
+		getDatabases := func() []stages.Database {
+			if databases.Dbs == nil {
+				return []stages.Database{}
+			}
+
+			all := databases.Dbs.All()
+			result := make([]stages.Database, len(all))
+			for i, database := range all {
+				result[i] = database
+			}
+			return result
+		}
+
+		drills.SetupDrills(getDatabases)
+	})
+}
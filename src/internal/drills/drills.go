@@ -0,0 +1,353 @@
+package drills
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/backups"
+	"persisto/src/internal/checks"
+	"persisto/src/internal/replication"
+	"persisto/src/internal/stages"
+	"persisto/src/internal/telemetry"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+)
+
+const (
+	StatusPassed = "passed"
+	StatusFailed = "failed"
+)
+
+const (
+	// SourceAuto restores the latest backup of the database, or its remote copy when it has none.
+	SourceAuto   = ""
+	SourceBackup = "backup"
+	SourceRemote = "remote"
+)
+
+// VerificationResult is the outcome of a verification query, it passes when its first value is neither NULL, 0, false
+// nor empty.
+type VerificationResult struct {
+	Query  string `json:"query"`
+	Passed bool   `json:"passed"`
+	Value  string `json:"value,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// DrillReport is the outcome of the last drill of a database.
+type DrillReport struct {
+	Database             string               `json:"database"`
+	Status               string               `json:"status"`
+	Source               string               `json:"source,omitempty"`
+	Key                  string               `json:"key,omitempty"`
+	CopyCreatedAt        *time.Time           `json:"copy_created_at,omitempty"`
+	SizeBytes            int64                `json:"size_bytes"`
+	RestoreMilliseconds  int64                `json:"restore_milliseconds"`
+	Integrity            string               `json:"integrity,omitempty"`
+	ForeignKeyViolations int64                `json:"foreign_key_violations"`
+	Checksum             string               `json:"checksum,omitempty"`
+	Queries              []VerificationResult `json:"queries,omitempty"`
+	Checks               []checks.CheckResult `json:"checks,omitempty"`
+	Error                string               `json:"error,omitempty"`
+	StartedAt            time.Time            `json:"started_at"`
+	FinishedAt           time.Time            `json:"finished_at"`
+}
+
+var (
+	// NOTE: returns the databases currently managed, set when the drills are setup
+	listDatabases = func() []stages.Database { return []stages.Database{} }
+
+	reports      = map[string]DrillReport{}
+	reportsMutex sync.Mutex
+)
+
+// SetupDrills periodically restores the latest persistent copy of the selected databases into a scratch directory and
+// checks it can be recovered from.
+func SetupDrills(getDatabases func() []stages.Database) {
+	listDatabases = getDatabases
+
+	if !utils.Config.Drills.Enabled {
+		utils.StagesLogger.Info("Disaster recovery drills disabled, not starting them.")
+		return
+	}
+
+	go func() {
+		interval := time.Duration(utils.Config.Drills.IntervalSeconds) * time.Second
+		utils.StagesLogger.Info("Starting disaster recovery drills.", zap.Duration("interval", interval), zap.Strings("databases", utils.Config.Drills.Databases))
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			// NOTE: the copies are shared by every instance, a single one drills them
+			if !replication.IsPrimary() {
+				continue
+			}
+			DrillAll()
+		}
+	}()
+}
+
+// DrillAll drills the selected databases one after the other, failures are reported and don't stop the other drills.
+func DrillAll() {
+	for _, database := range selectedDatabases() {
+		report := Drill(database.GetName(), SourceAuto, nil)
+		audit.Record(audit.Event{
+			Type:     audit.EventDatabaseDrilled,
+			Database: report.Database,
+			Details:  map[string]any{"status": report.Status, "source": report.Source, "key": report.Key, "scheduled": true},
+		})
+	}
+}
+
+func selectedDatabases() []stages.Database {
+	databases := listDatabases()
+	if len(utils.Config.Drills.Databases) == 0 {
+		return databases
+	}
+
+	selected := make(map[string]bool, len(utils.Config.Drills.Databases))
+	for _, name := range utils.Config.Drills.Databases {
+		selected[strings.TrimSpace(name)] = true
+	}
+
+	var result []stages.Database
+	for _, database := range databases {
+		if selected[database.GetName()] {
+			result = append(result, database)
+		}
+	}
+	return result
+}
+
+// ValidateSource returns an error when the source isn't one a drill restores from.
+func ValidateSource(source string) error {
+	switch source {
+	case SourceAuto, SourceBackup, SourceRemote:
+		return nil
+	}
+	return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("unknown drill source %q, expected %s or %s", source, SourceBackup, SourceRemote), nil)
+}
+
+// Drill restores a persistent copy of the database into a scratch directory, checks its integrity and runs the
+// verification queries and the checks of the database against it. The live copies are only read, the restored one is removed once checked.
+func Drill(name string, source string, queries []string) DrillReport {
+	report := DrillReport{Database: name, StartedAt: time.Now()}
+
+	if err := drill(&report, source, queries); err != nil {
+		report.Status, report.Error = StatusFailed, err.Error()
+		utils.StagesLogger.Error("Disaster recovery drill failed.", zap.String("database", name), zap.String("source", report.Source), zap.String("key", report.Key), zap.Error(err))
+	} else {
+		report.Status = StatusPassed
+		utils.StagesLogger.Info("Disaster recovery drill passed.", zap.String("database", name), zap.String("source", report.Source), zap.String("key", report.Key), zap.Int64("restoreMilliseconds", report.RestoreMilliseconds))
+	}
+	report.FinishedAt = time.Now()
+	telemetry.RecordDrill(context.Background(), report.Status)
+
+	reportsMutex.Lock()
+	reports[report.Database] = report
+	reportsMutex.Unlock()
+
+	return report
+}
+
+func drill(report *DrillReport, source string, queries []string) error {
+	if err := ValidateSource(source); err != nil {
+		return err
+	}
+	if err := locateCopy(report, source); err != nil {
+		return err
+	}
+
+	scratch, err := os.MkdirTemp(utils.Config.Drills.ScratchDirectory, "persisto-drill-*")
+	if err != nil {
+		return fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	path := filepath.Join(scratch, utils.DatabaseFileName(report.Database))
+	start := time.Now()
+	if report.SizeBytes, err = restore(report, path); err != nil {
+		return err
+	}
+	report.RestoreMilliseconds = time.Since(start).Milliseconds()
+
+	connectionString := fmt.Sprintf("file:%s?mode=ro", path)
+	db, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return fmt.Errorf("failed to open restored copy: %w", err)
+	}
+	defer db.Close()
+
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&report.Integrity); err != nil {
+		return fmt.Errorf("failed to run integrity check: %w", err)
+	}
+	if report.Integrity != "ok" {
+		return fmt.Errorf("integrity check failed: %s", report.Integrity)
+	}
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_foreign_key_check").Scan(&report.ForeignKeyViolations); err != nil {
+		return fmt.Errorf("failed to run foreign key check: %w", err)
+	}
+	if report.ForeignKeyViolations > 0 {
+		return fmt.Errorf("%d foreign key violations", report.ForeignKeyViolations)
+	}
+
+	if report.Checksum, err = utils.DatabaseChecksum(connectionString); err != nil {
+		return fmt.Errorf("failed to checksum restored copy: %w", err)
+	}
+
+	failed := 0
+	for _, query := range queries {
+		result := verify(db, query)
+		if !result.Passed {
+			failed++
+		}
+		report.Queries = append(report.Queries, result)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d verification queries failed", failed, len(queries))
+	}
+
+	// NOTE: the checks registered on the database travel with its copies, see checks.Table
+	if report.Checks, err = checks.Verify(context.Background(), db); err != nil {
+		return err
+	}
+	return nil
+}
+
+// locateCopy picks the persistent copy the drill restores: the latest backup, or the copy in the remote stage.
+func locateCopy(report *DrillReport, source string) error {
+	if source != SourceRemote {
+		list, err := backups.List(report.Database)
+		if err != nil {
+			return fmt.Errorf("failed to list backups: %w", err)
+		}
+		if len(list) > 0 {
+			report.Source, report.Key = SourceBackup, list[0].Key
+			report.CopyCreatedAt = &list[0].CreatedAt
+			return nil
+		}
+		if source == SourceBackup {
+			return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("database %s has no backup", report.Database), nil)
+		}
+	}
+
+	key := utils.DatabaseFileName(report.Database)
+	stat, err := remotevfs.StatObject(key)
+	if errors.Is(err, remotevfs.ErrObjectNotFound) {
+		return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("database %s has no persistent copy", report.Database), err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read remote copy: %w", err)
+	}
+	report.Source, report.Key = SourceRemote, key
+	if !stat.LastModified.IsZero() {
+		createdAt := stat.LastModified.UTC()
+		report.CopyCreatedAt = &createdAt
+	}
+	return nil
+}
+
+func restore(report *DrillReport, path string) (int64, error) {
+	// NOTE: the backups are checked against their manifest and decrypted as they are restored
+	if report.Source == SourceBackup {
+		backup, err := backups.Find(report.Database, report.Key)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := backups.Download(backup, path); err != nil {
+			return 0, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+
+	key := report.Key
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create restored copy: %w", err)
+	}
+	defer file.Close()
+
+	size, err := remotevfs.DownloadObject(context.Background(), key, file)
+	if err != nil {
+		return 0, utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to download %s", key), err)
+	}
+	return size, file.Close()
+}
+
+func verify(db *sql.DB, query string) VerificationResult {
+	result := VerificationResult{Query: query}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer rows.Close()
+
+	// NOTE: only the first value of the first row counts, e.g. SELECT COUNT(*) > 0 FROM users
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Error = "no rows returned"
+		}
+		return result
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	values := make([]sql.NullString, len(columns))
+	destinations := make([]any, len(columns))
+	for i := range values {
+		destinations[i] = &values[i]
+	}
+	if err := rows.Scan(destinations...); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Value = values[0].String
+	switch strings.ToLower(strings.TrimSpace(values[0].String)) {
+	case "", "0", "false":
+	default:
+		result.Passed = values[0].Valid
+	}
+	return result
+}
+
+// Reports returns the outcome of the last drill of every database.
+func Reports() []DrillReport {
+	reportsMutex.Lock()
+	defer reportsMutex.Unlock()
+
+	result := make([]DrillReport, 0, len(reports))
+	for _, report := range reports {
+		result = append(result, report)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Database < result[j].Database
+	})
+	return result
+}
@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"sync"
+
+	"persisto/src/internal/databases"
+	"persisto/src/internal/gc"
+	"persisto/src/internal/stages"
+)
+
+var (
+	gcSetupOnce sync.Once
+)
+
+func SetupGarbageCollection() {
+	gcSetupOnce.Do(func() {
+		getDatabases := func() []stages.Database {
+			if databases.Dbs == nil {
+				return []stages.Database{}
+			}
+
+			all := databases.Dbs.All()
+			result := make([]stages.Database, len(all))
+			for i, database := range all {
+				result[i] = database
+			}
+			return result
+		}
+
+		gc.SetupCollector(getDatabases)
+	})
+}
@@ -0,0 +1,259 @@
+package gc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/replication"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// NOTE: journal, -wal or -shm file of a database missing from the catalog
+	ReasonJournal = "journal"
+	// NOTE: temporary file or staging object, e.g. left by an interrupted sync
+	ReasonTemporary = "temporary"
+	// NOTE: database file or object missing from the catalog, e.g. left by a failed deletion
+	ReasonUncataloged = "uncataloged"
+)
+
+// Orphan is a file of the storage that no database of the catalog owns.
+type Orphan struct {
+	Stage        uint      `json:"stage"`
+	Name         string    `json:"name" doc:"Path of the local file or key of the remote object"`
+	Reason       string    `json:"reason" enum:"journal,temporary,uncataloged"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	Deleted      bool      `json:"deleted"`
+	Detail       string    `json:"detail,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// CollectionReport is the outcome of a collection, only the orphans older than the safety window are reported.
+type CollectionReport struct {
+	Orphans        []Orphan  `json:"orphans"`
+	ReclaimedBytes int64     `json:"reclaimed_bytes"`
+	Errors         []string  `json:"errors,omitempty"`
+	CollectedAt    time.Time `json:"collected_at"`
+}
+
+var (
+	// NOTE: returns the databases currently managed, set when the collector is setup
+	listDatabases = func() []stages.Database { return []stages.Database{} }
+
+	lastReport      *CollectionReport
+	lastReportMutex sync.Mutex
+	// NOTE: keeps a scheduled collection and one requested through the API from racing each other
+	collectMutex sync.Mutex
+)
+
+// SetupCollector periodically collects the files of the storage left behind by failed operations.
+func SetupCollector(getDatabases func() []stages.Database) {
+	listDatabases = getDatabases
+
+	if !utils.Config.GC.Enabled {
+		utils.StagesLogger.Info("Storage garbage collection disabled, not starting it.")
+		return
+	}
+
+	go func() {
+		interval := time.Duration(utils.Config.GC.IntervalSeconds) * time.Second
+		utils.StagesLogger.Info("Starting storage garbage collection.", zap.Duration("interval", interval), zap.Bool("delete", utils.Config.GC.Delete))
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			Collect(utils.Config.GC.Delete)
+		}
+	}()
+}
+
+// Collect scans the local storage directory and the root of the remote bucket for the files no database of the catalog
+// owns and which weren't modified during the safety window, deleting them when asked. The nested objects of the bucket
+// belong to the backups, leases, reports and audit logs and are never looked at.
+func Collect(remove bool) CollectionReport {
+	collectMutex.Lock()
+	defer collectMutex.Unlock()
+
+	report := CollectionReport{Orphans: []Orphan{}, CollectedAt: time.Now()}
+	cutoff := report.CollectedAt.Add(-time.Duration(utils.Config.GC.SafetyWindowSeconds) * time.Second)
+
+	// NOTE: the files of the followers and standbys are written by the primary, only it knows which ones are in use
+	if !replication.IsPrimary() {
+		report.Errors = append(report.Errors, "not collected, only the primary instance collects the storage")
+		return saveReport(report)
+	}
+
+	catalog := map[string]bool{}
+	for _, database := range listDatabases() {
+		catalog[database.GetName()] = true
+	}
+
+	local, err := localOrphans(catalog, cutoff)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to list the local storage: %v", err))
+	}
+	remote, err := remoteOrphans(catalog, cutoff)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to list the remote bucket: %v", err))
+	}
+
+	for _, orphan := range append(local, remote...) {
+		if remove && orphan.Detail == "" {
+			deleteOrphan(&orphan)
+			if orphan.Deleted {
+				report.ReclaimedBytes += orphan.Size
+			}
+		}
+		report.Orphans = append(report.Orphans, orphan)
+	}
+
+	deleted := 0
+	for _, orphan := range report.Orphans {
+		if orphan.Deleted {
+			deleted++
+		}
+	}
+	if len(report.Orphans) > 0 {
+		utils.StagesLogger.Info("Storage garbage collection found orphaned files.", zap.Int("orphans", len(report.Orphans)), zap.Int("deleted", deleted), zap.Int64("reclaimedBytes", report.ReclaimedBytes))
+	}
+	if deleted > 0 {
+		audit.Record(audit.Event{
+			Type:    audit.EventStorageCollected,
+			Details: map[string]any{"deleted": deleted, "reclaimed_bytes": report.ReclaimedBytes},
+		})
+	}
+
+	return saveReport(report)
+}
+
+// localOrphans returns the orphaned files of the local storage directory, the temporary directory is cleaned on its own.
+func localOrphans(catalog map[string]bool, cutoff time.Time) ([]Orphan, error) {
+	files, err := localvfs.ListFiles(utils.Config.Storage.Local.DirectoryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+	for _, file := range files {
+		if file.IsDir || file.ModTime.After(cutoff) {
+			continue
+		}
+		reason, orphaned := Classify(file.Name, catalog)
+		if !orphaned {
+			continue
+		}
+		orphans = append(orphans, Orphan{
+			Stage:        utils.GetLocalStage(),
+			Name:         file.FullPath,
+			Reason:       reason,
+			Size:         file.Size,
+			LastModified: file.ModTime,
+		})
+	}
+	return orphans, nil
+}
+
+// remoteOrphans returns the orphaned objects at the root of the remote bucket.
+func remoteOrphans(catalog map[string]bool, cutoff time.Time) ([]Orphan, error) {
+	files, _, err := remotevfs.ListFilesWithOptions(remotevfs.ListOptions{Delimiter: "/"})
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+	for _, file := range files {
+		// NOTE: objects whose age is unknown are kept, they might have just been written
+		if file.LastModified == nil || file.LastModified.After(cutoff) {
+			continue
+		}
+		reason, orphaned := Classify(file.Key, catalog)
+		if !orphaned {
+			continue
+		}
+
+		orphan := Orphan{
+			Stage:        utils.GetRemoteStage(),
+			Name:         file.Key,
+			Reason:       reason,
+			Size:         file.Size,
+			LastModified: *file.LastModified,
+		}
+		// NOTE: the catalog is listed at startup, the databases other instances created since are missing from it
+		if reason == ReasonUncataloged && utils.Config.Coordination.Enabled {
+			orphan.Detail = "not deleted, it might belong to another instance while coordination is enabled"
+		}
+		orphans = append(orphans, orphan)
+	}
+	return orphans, nil
+}
+
+// Classify tells why the file is orphaned, files that aren't databases, journals nor temporary files are never orphaned.
+func Classify(name string, catalog map[string]bool) (string, bool) {
+	if database, isDatabase := utils.DatabaseNameFromFileName(name); isDatabase {
+		return ReasonUncataloged, !catalog[database]
+	}
+
+	// NOTE: the journals of a database of the catalog are kept, a hot journal is needed to recover it
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if base, isJournal := strings.CutSuffix(name, suffix); isJournal {
+			if database, isDatabase := utils.DatabaseNameFromFileName(base); isDatabase {
+				return ReasonJournal, !catalog[database]
+			}
+		}
+	}
+
+	// NOTE: the names of the databases can't hold a dot, only the files derived from them can contain temp_ past it
+	if _, derived, hasDot := strings.Cut(name, "."); hasDot && strings.Contains(derived, "temp_") {
+		return ReasonTemporary, true
+	}
+	return "", false
+}
+
+func deleteOrphan(orphan *Orphan) {
+	var err error
+	if orphan.Stage == utils.GetLocalStage() {
+		err = localvfs.Delete(orphan.Name)
+	} else {
+		err = remotevfs.Delete(orphan.Name)
+	}
+
+	if err != nil {
+		orphan.Error = fmt.Sprintf("delete failed: %v", err)
+		utils.StagesLogger.Error("Failed to delete orphaned file.", zap.Uint("stage", orphan.Stage), zap.String("name", orphan.Name), zap.Error(err))
+		return
+	}
+	orphan.Deleted = true
+	utils.StagesLogger.Info("Deleted orphaned file.", zap.Uint("stage", orphan.Stage), zap.String("name", orphan.Name), zap.String("reason", orphan.Reason), zap.Int64("size", orphan.Size))
+}
+
+func saveReport(report CollectionReport) CollectionReport {
+	sort.SliceStable(report.Orphans, func(i, j int) bool {
+		if report.Orphans[i].Stage != report.Orphans[j].Stage {
+			return report.Orphans[i].Stage < report.Orphans[j].Stage
+		}
+		return report.Orphans[i].Name < report.Orphans[j].Name
+	})
+
+	lastReportMutex.Lock()
+	lastReport = &report
+	lastReportMutex.Unlock()
+	return report
+}
+
+// LastReport returns the report of the last collection, nil before the first one.
+func LastReport() *CollectionReport {
+	lastReportMutex.Lock()
+	defer lastReportMutex.Unlock()
+	return lastReport
+}
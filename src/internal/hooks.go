@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"sync"
+
+	"persisto/src/internal/databases"
+	"persisto/src/internal/hooks"
+)
+
+var (
+	hooksSetupOnce sync.Once
+)
+
+func SetupHooks() {
+	hooksSetupOnce.Do(func() {
+		getDatabases := func() []hooks.Database {
+			if databases.Dbs == nil {
+				return []hooks.Database{}
+			}
+
+			all := databases.Dbs.All()
+			result := make([]hooks.Database, len(all))
+			for i, database := range all {
+				result[i] = database
+			}
+			return result
+		}
+
+		hooks.SetupDispatcher(getDatabases)
+	})
+}
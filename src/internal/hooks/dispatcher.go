@@ -0,0 +1,337 @@
+package hooks
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/internal/replication"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: events buffered per subscriber, a subscriber falling further behind misses the next ones
+const subscriberBuffer = 256
+
+var (
+	// NOTE: databases having hooks, by name, kept in sync with the tables of the databases by Set and Remove
+	watched      = map[string]bool{}
+	pending      = map[string]Database{}
+	watchedMutex sync.Mutex
+
+	wake = make(chan struct{}, 1)
+
+	// NOTE: subscribers of the events of every hook, by database then hook
+	subscribers      = map[string]map[string]map[chan Change]bool{}
+	subscribersMutex sync.Mutex
+
+	deliveryClient = &http.Client{}
+)
+
+// SetupDispatcher loads the hooks of every database and delivers their changes as they are written, the changes left
+// undelivered, e.g. while the server was down, are delivered right away.
+func SetupDispatcher(getDatabases func() []Database) {
+	if !utils.Config.Hooks.Enabled {
+		utils.Logger.Info("Hooks disabled, not starting dispatcher.")
+		return
+	}
+	deliveryClient.Timeout = time.Duration(utils.Config.Hooks.TimeoutMilliseconds) * time.Millisecond
+
+	loaded := 0
+	for _, database := range getDatabases() {
+		hooks, err := load(database)
+		if err != nil {
+			database.GetLogger().Warn("Failed to load the hooks of the database.", zap.Error(err))
+			continue
+		}
+		if len(hooks) > 0 {
+			watch(database)
+			loaded += len(hooks)
+		}
+	}
+
+	go func() {
+		utils.Logger.Info("Starting hooks dispatcher.", zap.Int("hooks", loaded))
+
+		ticker := time.NewTicker(time.Duration(utils.Config.Hooks.RetryIntervalSeconds) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-wake:
+			case <-ticker.C:
+			}
+			// NOTE: followers and standbys never write, the changes are delivered once the standby is promoted
+			if !replication.IsPrimary() {
+				continue
+			}
+
+			watchedMutex.Lock()
+			due := pending
+			pending = map[string]Database{}
+			watchedMutex.Unlock()
+
+			for name, database := range due {
+				drained, err := dispatch(database)
+				if err != nil {
+					database.GetLogger().Warn("Failed to deliver the changes of the hooks, retrying later.", zap.Error(err))
+				}
+				if err != nil || !drained {
+					watchedMutex.Lock()
+					if watched[name] {
+						pending[name] = database
+					}
+					watchedMutex.Unlock()
+				}
+				if err == nil && !drained {
+					signal()
+				}
+			}
+		}
+	}()
+}
+
+// Notify tells the dispatcher the database was written, the changes recorded for its hooks are delivered in the
+// background.
+func Notify(database Database) {
+	watchedMutex.Lock()
+	defer watchedMutex.Unlock()
+
+	if !watched[database.GetName()] {
+		return
+	}
+	pending[database.GetName()] = database
+	signal()
+}
+
+// Reload delivers the changes of the hooks of the database as they are stored, once its content was replaced, e.g. by
+// restoring a snapshot.
+func Reload(database Database) error {
+	hooks, err := load(database)
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		unwatch(database.GetName())
+		return nil
+	}
+	watch(database)
+	return nil
+}
+
+func watch(database Database) {
+	watchedMutex.Lock()
+	defer watchedMutex.Unlock()
+
+	watched[database.GetName()] = true
+	pending[database.GetName()] = database
+	signal()
+}
+
+func unwatch(name string) {
+	watchedMutex.Lock()
+	defer watchedMutex.Unlock()
+
+	delete(watched, name)
+	delete(pending, name)
+}
+
+func signal() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Subscribe returns the events of the hook from now on and the function ending the subscription. The events are only
+// streamed once delivered to the webhook of the hook if it has one, and the subscribers too slow to keep up miss some.
+func Subscribe(database string, hook string) (<-chan Change, func()) {
+	events := make(chan Change, subscriberBuffer)
+
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+	if subscribers[database] == nil {
+		subscribers[database] = map[string]map[chan Change]bool{}
+	}
+	if subscribers[database][hook] == nil {
+		subscribers[database][hook] = map[chan Change]bool{}
+	}
+	subscribers[database][hook][events] = true
+
+	return events, func() {
+		subscribersMutex.Lock()
+		defer subscribersMutex.Unlock()
+		delete(subscribers[database][hook], events)
+	}
+}
+
+func publish(database string, hook string, changes []Change) {
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+
+	for events := range subscribers[database][hook] {
+		for _, change := range changes {
+			select {
+			case events <- change:
+			default:
+			}
+		}
+	}
+}
+
+// dispatch delivers the changes of the database to its hooks, a batch per hook from its cursor, then moves the cursors
+// of the hooks delivered and prunes the changes every hook delivered. A hook failing to deliver doesn't hold back the
+// others. It reports whether every change was delivered.
+func dispatch(database Database) (bool, error) {
+	batches, err := read(database)
+	if err != nil {
+		return false, err
+	}
+
+	drained := true
+	var queries []string
+	var parameters [][]any
+	var failures []error
+	for _, batch := range batches {
+		if len(batch.changes) > 0 {
+			if err := deliver(database.GetName(), batch.hook, batch.changes); err != nil {
+				failures = append(failures, fmt.Errorf("hook %s: %w", batch.hook.Name, err))
+				continue
+			}
+			publish(database.GetName(), batch.hook.Name, batch.changes)
+		}
+		if batch.cursor > batch.hook.Cursor {
+			queries = append(queries, "UPDATE "+Table+" SET cursor = ? WHERE name = ? AND cursor < ?")
+			parameters = append(parameters, []any{batch.cursor, batch.hook.Name, batch.cursor})
+		}
+		drained = drained && !batch.full
+	}
+
+	if len(queries) > 0 {
+		queries = append(queries, pruneStatement)
+		parameters = append(parameters, nil)
+		if _, _, err := database.ExecuteTransaction(queries, parameters); err != nil {
+			return false, err
+		}
+	}
+	if len(failures) > 0 {
+		return false, failures[0]
+	}
+	return drained, nil
+}
+
+// deliver posts the changes to the webhook of the hook, a response other than 2xx fails the delivery.
+func deliver(database string, hook Hook, changes []Change) error {
+	if hook.URL == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(map[string]any{"database": database, "hook": hook.Name, "changes": changes})
+	if err != nil {
+		return err
+	}
+	response, err := deliveryClient.Post(hook.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// batch is the changes of a hook read from its cursor, cursor is where the hook is once they are delivered.
+type batch struct {
+	hook    Hook
+	changes []Change
+	cursor  int64
+	full    bool
+}
+
+// NOTE: reads the hooks and the changes left to deliver to them without going through the request path, like load
+func read(database Database) ([]batch, error) {
+	hooks, err := load(database)
+	if err != nil || len(hooks) == 0 {
+		return nil, err
+	}
+
+	database.GetMutex().RLock()
+	defer database.GetMutex().RUnlock()
+
+	connectionString, err := database.GetConnectionString()
+	if err != nil {
+		return nil, err
+	}
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	// NOTE: a single read transaction, the changes recorded meanwhile are left to the next round
+	transaction, err := connection.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer transaction.Rollback()
+
+	var last sql.NullInt64
+	if err := transaction.QueryRow("SELECT MAX(id) FROM " + ChangesTable).Scan(&last); err != nil {
+		return nil, err
+	}
+
+	batches := make([]batch, 0, len(hooks))
+	for _, hook := range hooks {
+		changes, err := readChanges(transaction, hook)
+		if err != nil {
+			return nil, err
+		}
+		current := batch{hook: hook, changes: changes, cursor: max(hook.Cursor, last.Int64)}
+		// NOTE: the hook only moves past the changes of the batch, those of its table after them are delivered next
+		if len(changes) == utils.Config.Hooks.BatchSize {
+			current.cursor, current.full = changes[len(changes)-1].ID, true
+		}
+		batches = append(batches, current)
+	}
+	return batches, nil
+}
+
+func readChanges(transaction *sql.Tx, hook Hook) ([]Change, error) {
+	parameters := []any{hook.Cursor, hook.Table}
+	for _, operation := range hook.Operations {
+		parameters = append(parameters, operation)
+	}
+	parameters = append(parameters, utils.Config.Hooks.BatchSize)
+
+	rows, err := transaction.Query("SELECT id, table_name, operation, row, old_row, changed_at FROM "+ChangesTable+" WHERE id > ? AND table_name = ? AND operation IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(hook.Operations)), ", ")+") ORDER BY id LIMIT ?", parameters...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []Change
+	for rows.Next() {
+		var change Change
+		var row, oldRow sql.NullString
+		var changedAt string
+		if err := rows.Scan(&change.ID, &change.Table, &change.Operation, &row, &oldRow, &changedAt); err != nil {
+			return nil, err
+		}
+		if row.Valid {
+			change.Row = json.RawMessage(row.String)
+		}
+		if oldRow.Valid {
+			change.OldRow = json.RawMessage(oldRow.String)
+		}
+		change.ChangedAt, _ = time.Parse(time.RFC3339Nano, changedAt)
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
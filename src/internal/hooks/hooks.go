@@ -0,0 +1,337 @@
+package hooks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+)
+
+// NOTE: the hooks and the changes they deliver are stored in the database they watch, they follow it across stages,
+// backups and replicas. The changes are recorded by triggers in the transaction of the write, a change is never
+// delivered for a write rolled back nor lost for a write committed.
+const (
+	Table        = "_persisto_hooks"
+	ChangesTable = "_persisto_changes"
+	// NOTE: the statement policies let the triggers named with this prefix record the changes, see statements.guard
+	TriggerPrefix = "_persisto_hook_"
+)
+
+// NOTE: operations of the changes, those a hook watches
+const (
+	OperationInsert = "insert"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+// Operations are the operations a hook may watch.
+var Operations = []string{OperationInsert, OperationUpdate, OperationDelete}
+
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Hook delivers the changes of a table to its webhook and to the subscribers of its events.
+type Hook struct {
+	Name       string   `json:"name"`
+	Table      string   `json:"table"`
+	Operations []string `json:"operations"`
+	// NOTE: the changes are only streamed to the subscribers of the hook when empty
+	URL string `json:"url,omitempty"`
+	// NOTE: ID of the last change delivered
+	Cursor int64 `json:"cursor"`
+}
+
+// Change is a row inserted, updated or deleted in a table watched by a hook.
+type Change struct {
+	ID        int64           `json:"id"`
+	Table     string          `json:"table"`
+	Operation string          `json:"operation" enum:"insert,update,delete"`
+	Row       json.RawMessage `json:"row,omitempty" doc:"Row after the change, left out for a delete. The blobs are hex encoded."`
+	OldRow    json.RawMessage `json:"old_row,omitempty" doc:"Row before the change, left out for an insert."`
+	ChangedAt time.Time       `json:"changed_at"`
+}
+
+// Executor runs the statements managing the hooks of a database.
+type Executor interface {
+	Query(query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, error)
+	ExecuteTransaction(queries []string, parameters [][]any) ([]utils.ExecResultType, int, error)
+}
+
+// Database is a database whose tables are watched by hooks.
+type Database interface {
+	stages.Database
+	Executor
+}
+
+// List returns the hooks of the database.
+func List(database Executor) ([]Hook, error) {
+	exists, err := tableExists(database, Table)
+	if err != nil || !exists {
+		return []Hook{}, err
+	}
+
+	rows, _, err := database.Query("SELECT name, table_name, operations, url, cursor FROM " + Table + " ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make([]Hook, 0, len(rows))
+	for _, row := range rows {
+		hook, err := hookFrom(row["name"], row["table_name"], row["operations"], row["url"], row["cursor"])
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// Find returns the hook of the database.
+func Find(database Executor, name string) (Hook, error) {
+	hooks, err := List(database)
+	if err != nil {
+		return Hook{}, err
+	}
+	for _, hook := range hooks {
+		if hook.Name == name {
+			return hook, nil
+		}
+	}
+	return Hook{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("hook %s not found", name), nil)
+}
+
+// Set creates or replaces the hook and the triggers recording the changes of its table. A new hook delivers the changes
+// made from then on, a hook replaced keeps its cursor.
+func Set(database Database, hook Hook) (Hook, error) {
+	if !namePattern.MatchString(hook.Name) {
+		return Hook{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid hook name %s, it must match %s", hook.Name, namePattern), nil)
+	}
+	if len(hook.Operations) == 0 {
+		hook.Operations = Operations
+	}
+	for _, operation := range hook.Operations {
+		if !slices.Contains(Operations, operation) {
+			return Hook{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("unknown operation %s, the operations are insert, update and delete", operation), nil)
+		}
+	}
+	hook.Operations = slices.DeleteFunc(slices.Clone(Operations), func(operation string) bool { return !slices.Contains(hook.Operations, operation) })
+
+	if strings.HasPrefix(strings.ToLower(hook.Table), "_persisto_") || strings.HasPrefix(strings.ToLower(hook.Table), "sqlite_") {
+		return Hook{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("table %s is internal, it can't be watched", hook.Table), nil)
+	}
+	tables, _, err := database.Query("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", hook.Table)
+	if err != nil {
+		return Hook{}, err
+	}
+	if len(tables) == 0 {
+		return Hook{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("table %s not found", hook.Table), nil)
+	}
+	// NOTE: SQLite doesn't fire triggers on the virtual tables
+	if statement, _ := tables[0]["sql"].(string); strings.HasPrefix(strings.ToUpper(statement), "CREATE VIRTUAL TABLE") {
+		return Hook{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("table %s is a virtual table, it can't be watched", hook.Table), nil)
+	}
+
+	operations, err := json.Marshal(hook.Operations)
+	if err != nil {
+		return Hook{}, err
+	}
+
+	hooks, err := List(database)
+	if err != nil {
+		return Hook{}, err
+	}
+	watched := []string{hook.Table}
+	hooks = slices.DeleteFunc(hooks, func(existing Hook) bool {
+		if existing.Name == hook.Name && existing.Table != hook.Table {
+			watched = append(watched, existing.Table)
+		}
+		return existing.Name == hook.Name
+	})
+	hooks = append(hooks, hook)
+
+	queries := []string{
+		"CREATE TABLE IF NOT EXISTS " + Table + " (name TEXT PRIMARY KEY, table_name TEXT NOT NULL, operations TEXT NOT NULL, url TEXT, cursor INTEGER NOT NULL)",
+		// NOTE: AUTOINCREMENT never reuses the IDs of the changes pruned, the cursors only move forward
+		"CREATE TABLE IF NOT EXISTS " + ChangesTable + " (id INTEGER PRIMARY KEY AUTOINCREMENT, table_name TEXT NOT NULL, operation TEXT NOT NULL, row TEXT, old_row TEXT, changed_at TEXT NOT NULL)",
+		"INSERT INTO " + Table + " (name, table_name, operations, url, cursor) VALUES (?, ?, ?, ?, (SELECT COALESCE(MAX(seq), 0) FROM sqlite_sequence WHERE name = '" + ChangesTable + "')) ON CONFLICT (name) DO UPDATE SET table_name = excluded.table_name, operations = excluded.operations, url = excluded.url",
+	}
+	parameters := [][]any{nil, nil, {hook.Name, hook.Table, string(operations), nullable(hook.URL)}}
+	for _, table := range watched {
+		statements, err := triggerStatements(database, table, hooks)
+		if err != nil {
+			return Hook{}, err
+		}
+		queries = append(queries, statements...)
+		parameters = append(parameters, make([][]any, len(statements))...)
+	}
+	if _, _, err := database.ExecuteTransaction(queries, parameters); err != nil {
+		return Hook{}, err
+	}
+
+	watch(database)
+	return Find(database, hook.Name)
+}
+
+// Remove deletes the hook and the triggers of its table no other hook needs. The changes left to deliver to it are
+// pruned once the other hooks delivered them.
+func Remove(database Database, name string) error {
+	hook, err := Find(database, name)
+	if err != nil {
+		return err
+	}
+	hooks, err := List(database)
+	if err != nil {
+		return err
+	}
+	hooks = slices.DeleteFunc(hooks, func(existing Hook) bool { return existing.Name == name })
+
+	statements, err := triggerStatements(database, hook.Table, hooks)
+	if err != nil {
+		return err
+	}
+	queries := append([]string{"DELETE FROM " + Table + " WHERE name = ?"}, statements...)
+	queries = append(queries, pruneStatement)
+	parameters := append([][]any{{name}}, make([][]any, len(statements)+1)...)
+	if _, _, err := database.ExecuteTransaction(queries, parameters); err != nil {
+		return err
+	}
+
+	if len(hooks) == 0 {
+		unwatch(database.GetName())
+	}
+	return nil
+}
+
+// NOTE: the changes every hook delivered, all of them once no hook is left
+var pruneStatement = "DELETE FROM " + ChangesTable + " WHERE id <= (SELECT COALESCE(MIN(cursor), (SELECT MAX(id) FROM " + ChangesTable + ")) FROM " + Table + ")"
+
+// triggerStatements drops the triggers recording the changes of the table and creates those the hooks watching it need.
+// The rows are recorded as JSON objects of their columns as they are when the triggers are created, a hook is set
+// again to record the columns added since.
+func triggerStatements(database Executor, table string, hooks []Hook) ([]string, error) {
+	var statements []string
+	var needed []string
+	for _, operation := range Operations {
+		statements = append(statements, "DROP TRIGGER IF EXISTS "+utils.QuoteIdentifier(triggerName(table, operation)))
+		for _, hook := range hooks {
+			if hook.Table == table && slices.Contains(hook.Operations, operation) && !slices.Contains(needed, operation) {
+				needed = append(needed, operation)
+			}
+		}
+	}
+	if len(needed) == 0 {
+		return statements, nil
+	}
+
+	columns, _, err := database.Query("SELECT name FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return nil, err
+	}
+	rowOf := func(alias string) string {
+		var arguments []string
+		for _, column := range columns {
+			name := fmt.Sprint(column["name"])
+			value := alias + "." + utils.QuoteIdentifier(name)
+			// NOTE: JSON can't hold a blob
+			arguments = append(arguments, quoteLiteral(name), "CASE WHEN typeof("+value+") = 'blob' THEN hex("+value+") ELSE "+value+" END")
+		}
+		return "json_object(" + strings.Join(arguments, ", ") + ")"
+	}
+
+	for _, operation := range needed {
+		row, oldRow := "NULL", "NULL"
+		if operation != OperationDelete {
+			row = rowOf("NEW")
+		}
+		if operation != OperationInsert {
+			oldRow = rowOf("OLD")
+		}
+		statements = append(statements, fmt.Sprintf(
+			"CREATE TRIGGER %s AFTER %s ON %s BEGIN INSERT INTO %s (table_name, operation, row, old_row, changed_at) VALUES (%s, '%s', %s, %s, strftime('%%Y-%%m-%%dT%%H:%%M:%%fZ', 'now')); END",
+			utils.QuoteIdentifier(triggerName(table, operation)), strings.ToUpper(operation), utils.QuoteIdentifier(table), ChangesTable, quoteLiteral(table), operation, row, oldRow,
+		))
+	}
+	return statements, nil
+}
+
+func triggerName(table string, operation string) string {
+	return TriggerPrefix + table + "_" + operation
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// NOTE: reads the hooks without going through the request path, loading them doesn't count as an access to the database
+func load(database stages.Database) ([]Hook, error) {
+	database.GetMutex().RLock()
+	defer database.GetMutex().RUnlock()
+
+	connectionString, err := database.GetConnectionString()
+	if err != nil {
+		return nil, err
+	}
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	var exists int
+	if err := connection.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", Table).Scan(&exists); err != nil || exists == 0 {
+		return nil, err
+	}
+
+	rows, err := connection.Query("SELECT name, table_name, operations, url, cursor FROM " + Table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []Hook
+	for rows.Next() {
+		var name, table, operations string
+		var url sql.NullString
+		var cursor int64
+		if err := rows.Scan(&name, &table, &operations, &url, &cursor); err != nil {
+			return nil, err
+		}
+		hook, err := hookFrom(name, table, operations, url.String, cursor)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func hookFrom(name, table, operations, url, cursor any) (Hook, error) {
+	hook := Hook{Name: fmt.Sprint(name), Table: fmt.Sprint(table)}
+	if err := json.Unmarshal([]byte(fmt.Sprint(operations)), &hook.Operations); err != nil {
+		return Hook{}, fmt.Errorf("unreadable operations for hook %s: %w", hook.Name, err)
+	}
+	if value, isString := url.(string); isString {
+		hook.URL = value
+	}
+	if value, isInteger := cursor.(int64); isInteger {
+		hook.Cursor = value
+	}
+	return hook, nil
+}
+
+func nullable(value string) any {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+func tableExists(database Executor, table string) (bool, error) {
+	rows, _, err := database.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", table)
+	return len(rows) > 0, err
+}
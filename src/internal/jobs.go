@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"sync"
+
+	"persisto/src/internal/databases"
+	"persisto/src/internal/jobs"
+)
+
+var (
+	jobsSetupOnce sync.Once
+)
+
+func SetupJobs() {
+	jobsSetupOnce.Do(func() {
+		getDatabases := func() []jobs.Database {
+			if databases.Dbs == nil {
+				return []jobs.Database{}
+			}
+
+			all := databases.Dbs.All()
+			result := make([]jobs.Database, len(all))
+			for i, database := range all {
+				result[i] = database
+			}
+			return result
+		}
+
+		jobs.SetupScheduler(getDatabases)
+	})
+}
@@ -0,0 +1,300 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+
+	"github.com/robfig/cron/v3"
+)
+
+// NOTE: jobs are stored in the database they run on, they follow it across stages, backups and replicas
+const (
+	Table     = "_persisto_jobs"
+	RunsTable = "_persisto_job_runs"
+)
+
+// NOTE: status of a run
+const (
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// NOTE: what started a run
+const (
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+)
+
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Job runs its statements in a single transaction on every occurrence of its schedule.
+type Job struct {
+	Name string `json:"name"`
+	// NOTE: standard 5 fields cron expression evaluated in UTC, or a descriptor such as @daily or @every 1h
+	Schedule   string     `json:"schedule"`
+	Statements []string   `json:"statements"`
+	Enabled    bool       `json:"enabled"`
+	NextRunAt  *time.Time `json:"next_run_at,omitempty"`
+	LastRun    *Run       `json:"last_run,omitempty"`
+}
+
+// Run is an execution of a job, kept in the history of the job.
+type Run struct {
+	ID           int64     `json:"id"`
+	Job          string    `json:"job"`
+	Trigger      string    `json:"trigger"`
+	Status       string    `json:"status"`
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+	RowsAffected int64     `json:"rows_affected"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Executor runs the statements managing the jobs of a database.
+type Executor interface {
+	Query(query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, error)
+	ExecuteTransaction(queries []string, parameters [][]any) ([]utils.ExecResultType, int, error)
+}
+
+// Database is a database the jobs run on.
+type Database interface {
+	stages.Database
+	Executor
+	ExecuteTransactionContext(ctx context.Context, queries []string, parameters [][]any) ([]utils.ExecResultType, int, error)
+}
+
+func parseSchedule(schedule string) (cron.Schedule, error) {
+	parsed, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return nil, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid schedule %q", schedule), err)
+	}
+	return parsed, nil
+}
+
+// List returns the jobs of the database with their last run.
+func List(database Executor) ([]Job, error) {
+	exists, err := tableExists(database, Table)
+	if err != nil || !exists {
+		return []Job{}, err
+	}
+
+	rows, _, err := database.Query("SELECT name, schedule, statements, enabled, next_run_at FROM " + Table + " ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]Job, 0, len(rows))
+	for _, row := range rows {
+		job, err := jobFrom(row["name"], row["schedule"], row["statements"], row["enabled"], row["next_run_at"])
+		if err != nil {
+			return nil, err
+		}
+
+		runs, err := Runs(database, job.Name, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(runs) > 0 {
+			job.LastRun = &runs[0]
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// Find returns the job of the database with its last run.
+func Find(database Executor, name string) (Job, error) {
+	jobs, err := List(database)
+	if err != nil {
+		return Job{}, err
+	}
+	for _, job := range jobs {
+		if job.Name == name {
+			return job, nil
+		}
+	}
+	return Job{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("job %s not found", name), nil)
+}
+
+// Set creates or replaces the job, its statements are compiled against the database before it is stored and it is
+// scheduled right away.
+func Set(database Database, job Job) (Job, error) {
+	if !namePattern.MatchString(job.Name) {
+		return Job{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid job name %s, it must match %s", job.Name, namePattern), nil)
+	}
+	schedule, err := parseSchedule(job.Schedule)
+	if err != nil {
+		return Job{}, err
+	}
+	if len(job.Statements) == 0 {
+		return Job{}, utils.NewError(utils.ErrorCodeInvalidInput, "a job needs at least one statement", nil)
+	}
+	for index, statement := range job.Statements {
+		// NOTE: compiled without being run, the invalid statements are rejected before their first scheduled run
+		if _, _, err := database.Query("EXPLAIN " + statement); err != nil {
+			return Job{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid statement %d", index), err)
+		}
+	}
+
+	statements, err := json.Marshal(job.Statements)
+	if err != nil {
+		return Job{}, err
+	}
+
+	job.NextRunAt = nil
+	if job.Enabled {
+		next := schedule.Next(time.Now().UTC())
+		job.NextRunAt = &next
+	}
+
+	queries := []string{
+		"CREATE TABLE IF NOT EXISTS " + Table + " (name TEXT PRIMARY KEY, schedule TEXT NOT NULL, statements TEXT NOT NULL, enabled INTEGER NOT NULL, next_run_at TEXT)",
+		"CREATE TABLE IF NOT EXISTS " + RunsTable + " (id INTEGER PRIMARY KEY, job TEXT NOT NULL, trigger TEXT NOT NULL, status TEXT NOT NULL, started_at TEXT NOT NULL, finished_at TEXT NOT NULL, rows_affected INTEGER NOT NULL, error TEXT)",
+		"CREATE INDEX IF NOT EXISTS " + RunsTable + "_job ON " + RunsTable + " (job, id)",
+		"INSERT INTO " + Table + " (name, schedule, statements, enabled, next_run_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT (name) DO UPDATE SET schedule = excluded.schedule, statements = excluded.statements, enabled = excluded.enabled, next_run_at = excluded.next_run_at",
+	}
+	parameters := [][]any{nil, nil, nil, {job.Name, job.Schedule, string(statements), job.Enabled, formatTime(job.NextRunAt)}}
+	if _, _, err := database.ExecuteTransaction(queries, parameters); err != nil {
+		return Job{}, err
+	}
+
+	register(database.GetName(), job, schedule)
+	return Find(database, job.Name)
+}
+
+// Remove deletes the job and its history.
+func Remove(database Database, name string) error {
+	exists, err := tableExists(database, Table)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("job %s not found", name), nil)
+	}
+
+	results, _, err := database.ExecuteTransaction(
+		[]string{"DELETE FROM " + Table + " WHERE name = ?", "DELETE FROM " + RunsTable + " WHERE job = ?"},
+		[][]any{{name}, {name}},
+	)
+	if err != nil {
+		return err
+	}
+	if results[0]["RowsAffected"].(int64) == 0 {
+		return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("job %s not found", name), nil)
+	}
+
+	unregister(database.GetName(), name)
+	return nil
+}
+
+// Runs returns the last runs of the job, newest first.
+func Runs(database Executor, name string, limit int) ([]Run, error) {
+	exists, err := tableExists(database, RunsTable)
+	if err != nil || !exists {
+		return []Run{}, err
+	}
+
+	rows, _, err := database.Query("SELECT id, job, trigger, status, started_at, finished_at, rows_affected, error FROM "+RunsTable+" WHERE job = ? ORDER BY id DESC LIMIT ?", name, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]Run, 0, len(rows))
+	for _, row := range rows {
+		run := Run{
+			ID:           row["id"].(int64),
+			Job:          fmt.Sprint(row["job"]),
+			Trigger:      fmt.Sprint(row["trigger"]),
+			Status:       fmt.Sprint(row["status"]),
+			RowsAffected: row["rows_affected"].(int64),
+		}
+		run.StartedAt, _ = time.Parse(time.RFC3339Nano, fmt.Sprint(row["started_at"]))
+		run.FinishedAt, _ = time.Parse(time.RFC3339Nano, fmt.Sprint(row["finished_at"]))
+		if message, isString := row["error"].(string); isString {
+			run.Error = message
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// NOTE: reads the jobs without going through the request path, loading them doesn't count as an access to the database
+func load(database stages.Database) ([]Job, error) {
+	database.GetMutex().RLock()
+	defer database.GetMutex().RUnlock()
+
+	connectionString, err := database.GetConnectionString()
+	if err != nil {
+		return nil, err
+	}
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	var exists int
+	if err := connection.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", Table).Scan(&exists); err != nil || exists == 0 {
+		return nil, err
+	}
+
+	rows, err := connection.Query("SELECT name, schedule, statements, enabled, next_run_at FROM " + Table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		var name, schedule, statements string
+		var enabled bool
+		var nextRunAt sql.NullString
+		if err := rows.Scan(&name, &schedule, &statements, &enabled, &nextRunAt); err != nil {
+			return nil, err
+		}
+		job, err := jobFrom(name, schedule, statements, enabled, nextRunAt.String)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func jobFrom(name, schedule, statements, enabled, nextRunAt any) (Job, error) {
+	job := Job{Name: fmt.Sprint(name), Schedule: fmt.Sprint(schedule)}
+	if err := json.Unmarshal([]byte(fmt.Sprint(statements)), &job.Statements); err != nil {
+		return Job{}, fmt.Errorf("unreadable statements for job %s: %w", job.Name, err)
+	}
+	switch enabled := enabled.(type) {
+	case bool:
+		job.Enabled = enabled
+	case int64:
+		job.Enabled = enabled != 0
+	}
+	if value, isString := nextRunAt.(string); isString && value != "" {
+		if next, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			job.NextRunAt = &next
+		}
+	}
+	return job, nil
+}
+
+func formatTime(value *time.Time) any {
+	if value == nil {
+		return nil
+	}
+	return value.UTC().Format(time.RFC3339Nano)
+}
+
+func tableExists(database Executor, table string) (bool, error) {
+	rows, _, err := database.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", table)
+	return len(rows) > 0, err
+}
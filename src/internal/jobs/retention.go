@@ -0,0 +1,227 @@
+package jobs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"persisto/src/utils"
+)
+
+// NOTE: retention rules are stored next to the jobs enforcing them, a rule owns the job named after its table
+const RetentionTable = "_persisto_retention"
+
+// NOTE: how the timestamps of a retention rule are stored
+const (
+	// NOTE: text understood by the SQLite date functions, e.g. 2006-01-02 15:04:05 or 2006-01-02T15:04:05Z
+	TimestampText = "text"
+	// NOTE: seconds since the epoch
+	TimestampUnix = "unixepoch"
+	// NOTE: milliseconds since the epoch
+	TimestampUnixMilliseconds = "unixepoch_ms"
+)
+
+const defaultRetentionSchedule = "@daily"
+
+var unsafeJobNameCharacters = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// RetentionRule deletes the rows of a table whose timestamp column is older than the given number of days, enforced
+// by a job on its schedule.
+type RetentionRule struct {
+	Table    string `json:"table"`
+	Column   string `json:"column"`
+	Days     int    `json:"days"`
+	Format   string `json:"format"`
+	Schedule string `json:"schedule"`
+	// NOTE: the job enforcing the rule, nil once it was removed on its own
+	Job *Job `json:"job,omitempty"`
+}
+
+// RetentionPreview tells what a retention rule deletes when it runs now.
+type RetentionPreview struct {
+	Cutoff string `json:"cutoff" doc:"Timestamp the rows older than are deleted, as stored in the column."`
+	Rows   int64  `json:"rows" doc:"Rows deleted."`
+	Oldest any    `json:"oldest,omitempty" doc:"Oldest timestamp deleted."`
+}
+
+func retentionJobName(table string) string {
+	name := "retention-" + unsafeJobNameCharacters.ReplaceAllString(strings.ToLower(table), "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// NOTE: the text timestamps are normalized before being compared, the formats accepted by SQLite don't sort together
+func (rule RetentionRule) cutoff() string {
+	modifier := fmt.Sprintf("'now', '-%d days'", rule.Days)
+	switch rule.Format {
+	case TimestampUnix:
+		return "CAST(strftime('%s', " + modifier + ") AS INTEGER)"
+	case TimestampUnixMilliseconds:
+		return "CAST(strftime('%s', " + modifier + ") AS INTEGER) * 1000"
+	default:
+		return "datetime(" + modifier + ")"
+	}
+}
+
+func (rule RetentionRule) condition() string {
+	column := utils.QuoteIdentifier(rule.Column)
+	if rule.Format == TimestampText {
+		column = "datetime(" + column + ")"
+	}
+	return column + " < " + rule.cutoff()
+}
+
+func (rule RetentionRule) statement() string {
+	return "DELETE FROM " + utils.QuoteIdentifier(rule.Table) + " WHERE " + rule.condition()
+}
+
+func checkRetentionRule(database Executor, rule *RetentionRule) error {
+	if strings.HasPrefix(strings.ToLower(rule.Table), "_persisto_") || strings.HasPrefix(strings.ToLower(rule.Table), "sqlite_") {
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("table %s can't have a retention rule", rule.Table), nil)
+	}
+	if rule.Days <= 0 {
+		return utils.NewError(utils.ErrorCodeInvalidInput, "the retention must be at least 1 day", nil)
+	}
+	if rule.Format == "" {
+		rule.Format = TimestampText
+	}
+	if rule.Format != TimestampText && rule.Format != TimestampUnix && rule.Format != TimestampUnixMilliseconds {
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("unknown timestamp format %s", rule.Format), nil)
+	}
+	if rule.Schedule == "" {
+		rule.Schedule = defaultRetentionSchedule
+	}
+
+	rows, _, err := database.Query("SELECT name FROM pragma_table_info(?)", rule.Table)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("table %s not found", rule.Table), nil)
+	}
+	for _, row := range rows {
+		if strings.EqualFold(fmt.Sprint(row["name"]), rule.Column) {
+			return nil
+		}
+	}
+	return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("table %s has no column %s", rule.Table, rule.Column), nil)
+}
+
+// PreviewRetention checks the rule and tells what it deletes when it runs now, without deleting anything.
+func PreviewRetention(database Executor, rule RetentionRule) (RetentionPreview, error) {
+	if err := checkRetentionRule(database, &rule); err != nil {
+		return RetentionPreview{}, err
+	}
+
+	rows, _, err := database.Query("SELECT " + rule.cutoff() + " AS cutoff, (SELECT count(*) FROM " + utils.QuoteIdentifier(rule.Table) + " WHERE " + rule.condition() + ") AS rows, (SELECT min(" + utils.QuoteIdentifier(rule.Column) + ") FROM " + utils.QuoteIdentifier(rule.Table) + " WHERE " + rule.condition() + ") AS oldest")
+	if err != nil {
+		return RetentionPreview{}, err
+	}
+
+	preview := RetentionPreview{Cutoff: fmt.Sprint(rows[0]["cutoff"]), Oldest: rows[0]["oldest"]}
+	if count, isInt := rows[0]["rows"].(int64); isInt {
+		preview.Rows = count
+	}
+	return preview, nil
+}
+
+// ListRetention returns the retention rules of the database with the jobs enforcing them.
+func ListRetention(database Executor) ([]RetentionRule, error) {
+	exists, err := tableExists(database, RetentionTable)
+	if err != nil || !exists {
+		return []RetentionRule{}, err
+	}
+
+	rows, _, err := database.Query("SELECT table_name, column_name, days, format, schedule FROM " + RetentionTable + " ORDER BY table_name")
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, err := List(database)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]RetentionRule, 0, len(rows))
+	for _, row := range rows {
+		rule := RetentionRule{
+			Table:    fmt.Sprint(row["table_name"]),
+			Column:   fmt.Sprint(row["column_name"]),
+			Format:   fmt.Sprint(row["format"]),
+			Schedule: fmt.Sprint(row["schedule"]),
+		}
+		if days, isInt := row["days"].(int64); isInt {
+			rule.Days = int(days)
+		}
+		for index := range jobs {
+			if jobs[index].Name == retentionJobName(rule.Table) {
+				rule.Job = &jobs[index]
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// SetRetention creates or replaces the retention rule of the table and the job enforcing it.
+func SetRetention(database Database, rule RetentionRule) (RetentionRule, error) {
+	if err := checkRetentionRule(database, &rule); err != nil {
+		return RetentionRule{}, err
+	}
+
+	// NOTE: the names of the jobs are derived from the tables, tables differing only by their special characters would
+	// share one
+	name := retentionJobName(rule.Table)
+	rules, err := ListRetention(database)
+	if err != nil {
+		return RetentionRule{}, err
+	}
+	for _, existing := range rules {
+		if existing.Table != rule.Table && retentionJobName(existing.Table) == name {
+			return RetentionRule{}, utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("job %s already enforces the retention of table %s", name, existing.Table), nil)
+		}
+	}
+
+	job, err := Set(database, Job{Name: name, Schedule: rule.Schedule, Statements: []string{rule.statement()}, Enabled: true})
+	if err != nil {
+		return RetentionRule{}, err
+	}
+
+	queries := []string{
+		"CREATE TABLE IF NOT EXISTS " + RetentionTable + " (table_name TEXT PRIMARY KEY, column_name TEXT NOT NULL, days INTEGER NOT NULL, format TEXT NOT NULL, schedule TEXT NOT NULL)",
+		"INSERT INTO " + RetentionTable + " (table_name, column_name, days, format, schedule) VALUES (?, ?, ?, ?, ?) ON CONFLICT (table_name) DO UPDATE SET column_name = excluded.column_name, days = excluded.days, format = excluded.format, schedule = excluded.schedule",
+	}
+	parameters := [][]any{nil, {rule.Table, rule.Column, rule.Days, rule.Format, rule.Schedule}}
+	if _, _, err := database.ExecuteTransaction(queries, parameters); err != nil {
+		return RetentionRule{}, err
+	}
+
+	rule.Job = &job
+	return rule, nil
+}
+
+// RemoveRetention deletes the retention rule of the table and the job enforcing it.
+func RemoveRetention(database Database, table string) error {
+	exists, err := tableExists(database, RetentionTable)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("no retention rule for table %s", table), nil)
+	}
+
+	results, _, err := database.ExecuteTransaction([]string{"DELETE FROM " + RetentionTable + " WHERE table_name = ?"}, [][]any{{table}})
+	if err != nil {
+		return err
+	}
+	if results[0]["RowsAffected"].(int64) == 0 {
+		return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("no retention rule for table %s", table), nil)
+	}
+
+	if err := Remove(database, retentionJobName(table)); err != nil && utils.ErrorCodeOf(err) != utils.ErrorCodeNotFound {
+		return err
+	}
+	return nil
+}
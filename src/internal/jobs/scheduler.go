@@ -0,0 +1,333 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"persisto/src/internal/admission"
+	"persisto/src/internal/audit"
+	"persisto/src/internal/replication"
+	"persisto/src/utils"
+
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+// NOTE: the due jobs are looked for at this interval, a run starts at most this late
+const tickInterval = 10 * time.Second
+
+const alertTimeout = 5 * time.Second
+
+type entry struct {
+	job      Job
+	schedule cron.Schedule
+	running  bool
+}
+
+var (
+	// NOTE: returns the databases currently managed, set when the scheduler is setup
+	listDatabases = func() []Database { return []Database{} }
+
+	// NOTE: jobs by database and name, kept in sync with the tables of the databases by Set and Remove
+	registry      = map[string]map[string]*entry{}
+	registryMutex sync.Mutex
+
+	alertClient = &http.Client{Timeout: alertTimeout}
+)
+
+// SetupScheduler loads the jobs of every database and runs them on their schedules. The jobs of the databases added
+// later, e.g. restored from a backup, are scheduled once they are set again or the server restarts.
+func SetupScheduler(getDatabases func() []Database) {
+	listDatabases = getDatabases
+
+	if !utils.Config.Jobs.Enabled {
+		utils.Logger.Info("Scheduled jobs disabled, not starting scheduler.")
+		return
+	}
+
+	loaded := 0
+	for _, database := range listDatabases() {
+		jobs, err := load(database)
+		if err != nil {
+			database.GetLogger().Warn("Failed to load the jobs of the database.", zap.Error(err))
+			continue
+		}
+		for _, job := range jobs {
+			schedule, err := parseSchedule(job.Schedule)
+			if err != nil {
+				database.GetLogger().Warn("Ignoring job with an invalid schedule.", zap.String("job", job.Name), zap.Error(err))
+				continue
+			}
+			register(database.GetName(), job, schedule)
+			loaded++
+		}
+	}
+
+	go func() {
+		utils.Logger.Info("Starting job scheduler.", zap.Int("jobs", loaded))
+
+		ticker := time.NewTicker(tickInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			// NOTE: followers and standbys never write, the jobs run once the standby is promoted
+			if !replication.IsPrimary() {
+				continue
+			}
+			runDueJobs(time.Now().UTC())
+		}
+	}()
+}
+
+// Reload schedules the jobs of the database as they are stored, once its content was replaced, e.g. by restoring a
+// snapshot. The jobs it no longer has are unscheduled.
+func Reload(database Database) error {
+	jobs, err := load(database)
+	if err != nil {
+		return err
+	}
+
+	entries := map[string]*entry{}
+	for _, job := range jobs {
+		schedule, err := parseSchedule(job.Schedule)
+		if err != nil {
+			database.GetLogger().Warn("Ignoring job with an invalid schedule.", zap.String("job", job.Name), zap.Error(err))
+			continue
+		}
+		entries[job.Name] = &entry{job: job, schedule: schedule}
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	// NOTE: the runs in progress keep their entries, they finish on them
+	for name, existing := range registry[database.GetName()] {
+		if replacement, found := entries[name]; found && existing.running {
+			existing.job, existing.schedule = replacement.job, replacement.schedule
+			entries[name] = existing
+		}
+	}
+	registry[database.GetName()] = entries
+	return nil
+}
+
+func register(database string, job Job, schedule cron.Schedule) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if registry[database] == nil {
+		registry[database] = map[string]*entry{}
+	}
+	if existing, found := registry[database][job.Name]; found {
+		existing.job, existing.schedule = job, schedule
+		return
+	}
+	registry[database][job.Name] = &entry{job: job, schedule: schedule}
+}
+
+func unregister(database string, name string) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	delete(registry[database], name)
+}
+
+// NOTE: missed occurrences, e.g. while the server was down, are caught up with a single run
+func runDueJobs(now time.Time) {
+	databases := map[string]Database{}
+	for _, database := range listDatabases() {
+		databases[database.GetName()] = database
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	for name, entries := range registry {
+		database, found := databases[name]
+		if !found {
+			// NOTE: the database was deleted, its jobs went with it
+			delete(registry, name)
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.running || !entry.job.Enabled || entry.job.NextRunAt == nil || entry.job.NextRunAt.After(now) {
+				continue
+			}
+			entry.running = true
+			go runScheduled(database, entry, now)
+		}
+	}
+}
+
+func runScheduled(database Database, entry *entry, now time.Time) {
+	registryMutex.Lock()
+	job, schedule := entry.job, entry.schedule
+	registryMutex.Unlock()
+
+	defer func() {
+		registryMutex.Lock()
+		entry.running = false
+		registryMutex.Unlock()
+	}()
+
+	// NOTE: advancing the next run only if it wasn't already keeps the instances sharing the database from running the
+	// same occurrence twice
+	next := schedule.Next(now)
+	results, _, err := database.ExecuteTransaction(
+		[]string{"UPDATE " + Table + " SET next_run_at = ? WHERE name = ? AND enabled = 1 AND next_run_at = ?"},
+		[][]any{{formatTime(&next), job.Name, formatTime(job.NextRunAt)}},
+	)
+	if err != nil {
+		database.GetLogger().Warn("Failed to claim the run of a job.", zap.String("job", job.Name), zap.Error(err))
+		return
+	}
+
+	claimed := results[0]["RowsAffected"].(int64) > 0
+	if !claimed {
+		// NOTE: run by another instance or changed since it was loaded, the stored job is the current one
+		stored, err := Find(database, job.Name)
+		if err != nil {
+			database.GetLogger().Warn("Failed to reload a job.", zap.String("job", job.Name), zap.Error(err))
+			return
+		}
+		registryMutex.Lock()
+		entry.job = stored
+		registryMutex.Unlock()
+		return
+	}
+
+	registryMutex.Lock()
+	entry.job.NextRunAt = &next
+	registryMutex.Unlock()
+
+	execute(database, job, TriggerSchedule)
+}
+
+// RunNow runs the job right away, outside of its schedule, and returns its run.
+func RunNow(database Database, name string) (Run, error) {
+	job, err := Find(database, name)
+	if err != nil {
+		return Run{}, err
+	}
+
+	registryMutex.Lock()
+	entry := registry[database.GetName()][name]
+	if entry != nil {
+		if entry.running {
+			registryMutex.Unlock()
+			return Run{}, utils.NewError(utils.ErrorCodeBusy, fmt.Sprintf("job %s is already running", name), nil)
+		}
+		entry.running = true
+	}
+	registryMutex.Unlock()
+
+	if entry != nil {
+		defer func() {
+			registryMutex.Lock()
+			entry.running = false
+			registryMutex.Unlock()
+		}()
+	}
+
+	return execute(database, job, TriggerManual), nil
+}
+
+// NOTE: runs the statements of the job in a single transaction and records the run in its history. The jobs are
+// maintenance work, they wait behind the interactive queries at admission and the syncs of their writes wait for each
+// other.
+func execute(database Database, job Job, trigger string) Run {
+	run := Run{Job: job.Name, Trigger: trigger, Status: RunSucceeded, StartedAt: time.Now().UTC()}
+
+	ctx := utils.WithPriority(context.Background(), utils.PriorityMaintenance)
+	var results []utils.ExecResultType
+	failedIndex := -1
+	release, err := admission.Admit(ctx, database.GetName())
+	if err == nil {
+		results, failedIndex, err = database.ExecuteTransactionContext(ctx, job.Statements, nil)
+		release()
+	}
+	run.FinishedAt = time.Now().UTC()
+	if err != nil {
+		run.Status = RunFailed
+		run.Error = err.Error()
+		if failedIndex >= 0 {
+			run.Error = fmt.Sprintf("statement %d: %v", failedIndex, err)
+		}
+	}
+	for _, result := range results {
+		if affected, isInt := result["RowsAffected"].(int64); isInt {
+			run.RowsAffected += affected
+		}
+	}
+
+	recorded, _, recordErr := database.ExecuteTransactionContext(
+		ctx,
+		[]string{
+			"INSERT INTO " + RunsTable + " (job, trigger, status, started_at, finished_at, rows_affected, error) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			"DELETE FROM " + RunsTable + " WHERE job = ? AND id NOT IN (SELECT id FROM " + RunsTable + " WHERE job = ? ORDER BY id DESC LIMIT ?)",
+		},
+		[][]any{
+			{run.Job, run.Trigger, run.Status, run.StartedAt.Format(time.RFC3339Nano), run.FinishedAt.Format(time.RFC3339Nano), run.RowsAffected, nullable(run.Error)},
+			{run.Job, run.Job, utils.Config.Jobs.HistorySize},
+		},
+	)
+	if recordErr != nil {
+		database.GetLogger().Warn("Failed to record the run of a job.", zap.String("job", job.Name), zap.Error(recordErr))
+	} else if id, isInt := recorded[0]["LastInsertID"].(int64); isInt {
+		run.ID = id
+	}
+
+	audit.Record(audit.Event{
+		Type:     audit.EventJobRun,
+		Database: database.GetName(),
+		Details:  map[string]any{"job": run.Job, "trigger": run.Trigger, "status": run.Status, "rows_affected": run.RowsAffected, "error": run.Error},
+	})
+
+	if run.Status == RunFailed {
+		// NOTE: logged as an error, it is sent to the error reporting too when configured
+		database.GetLogger().Error("Job failed.", zap.String("job", job.Name), zap.String("trigger", trigger), zap.String("error", run.Error))
+		alert(database.GetName(), run)
+	} else {
+		database.GetLogger().Info("Job succeeded.", zap.String("job", job.Name), zap.String("trigger", trigger), zap.Int64("rowsAffected", run.RowsAffected), zap.Duration("duration", run.FinishedAt.Sub(run.StartedAt)))
+	}
+	return run
+}
+
+// NOTE: posts the failed run to the alert webhook in the background, failing to deliver it is only logged
+func alert(database string, run Run) {
+	url := utils.Config.Jobs.AlertWebhookURL
+	if url == "" {
+		return
+	}
+
+	body, err := json.Marshal(map[string]any{"database": database, "job": run.Job, "run": run})
+	if err != nil {
+		utils.Logger.Warn("Failed to encode job alert.", zap.Error(err))
+		return
+	}
+
+	go func() {
+		response, err := alertClient.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			utils.Logger.Warn("Failed to send job alert.", zap.String("job", run.Job), zap.Error(err))
+			return
+		}
+		response.Body.Close()
+		if response.StatusCode >= http.StatusBadRequest {
+			utils.Logger.Warn("Job alert webhook responded with an error.", zap.String("job", run.Job), zap.Int("status", response.StatusCode))
+		}
+	}()
+}
+
+func nullable(value string) any {
+	if value == "" {
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,317 @@
+package journal
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"go.uber.org/zap"
+)
+
+// NOTE: the operations leaving the stages inconsistent when the process dies half-way are recorded as intents in the
+// journal table of the catalog database at CATALOG_STORE_PATH before they start, and removed once they end. The intents
+// left at startup are those of the operations interrupted by a crash, they are replayed before the catalog is built to
+// roll each operation forward or back. The table is kept across restarts, unlike the catalog table.
+const (
+	// NOTE: copy of a database to another stage, see stages.MoveToStage
+	OperationMove = "move"
+	// NOTE: removal of a database from the catalog and the stages
+	OperationDelete = "delete"
+	// NOTE: copy of a backup or a snapshot to the remote stage under a new database name
+	OperationRestore = "restore"
+	// NOTE: replacement of the content of a database by a snapshot, see databases.Database.RestoreFrom
+	OperationRestoreInPlace = "restore_in_place"
+	// NOTE: write to a database while the remote stage is offline, its local copy is the only one holding the write
+	// until it is uploaded once the remote stage is back, see Hold
+	OperationOfflineWrite = "offline_write"
+	// NOTE: write to a database with tiered tables, the local companion holding them is the only copy holding the write
+	// until it is uploaded, see Hold and Release
+	OperationTieredWrite = "tiered_write"
+)
+
+// NOTE: outcomes of the replay of an interrupted operation
+const (
+	// NOTE: the operation was completed, the database is where it was going
+	OutcomeRolledForward = "rolled_forward"
+	// NOTE: what the operation left behind was removed, the database is where it was
+	OutcomeRolledBack = "rolled_back"
+	// NOTE: the replay needs the remote stage, which is offline, the intent is replayed at the next startup
+	OutcomeDeferred = "deferred"
+	// NOTE: neither could be done, the database is left as the operation left it for an operator to look into
+	OutcomeFailed = "failed"
+)
+
+// NOTE: statuses of the intents of the journal
+const (
+	// NOTE: the operation runs, or was interrupted and is replayed at the next startup
+	StatusPending = "pending"
+	// NOTE: the replay of the operation failed, the intent is held for an operator rather than replayed again, the
+	// database may have been written since and a second replay would undo it, see Retry and Dismiss
+	StatusFailed = "failed"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS journal (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	operation TEXT NOT NULL,
+	name TEXT NOT NULL,
+	source_stage INTEGER NOT NULL DEFAULT 0,
+	target_stage INTEGER NOT NULL DEFAULT 0,
+	started_at TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	error TEXT,
+	failed_at TEXT
+);
+`
+
+// Intent is an operation recorded in the journal while it runs.
+type Intent struct {
+	ID        int64  `json:"id"`
+	Operation string `json:"operation"`
+	Database  string `json:"database"`
+	// NOTE: stages of a move, 0 for the other operations
+	SourceStage uint      `json:"source_stage,omitempty"`
+	TargetStage uint      `json:"target_stage,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	Status      string    `json:"status"`
+	// NOTE: why the replay of a failed intent failed
+	Error    string     `json:"error,omitempty"`
+	FailedAt *time.Time `json:"failed_at,omitempty"`
+}
+
+// Recovery is the replay of an intent found in the journal at startup.
+type Recovery struct {
+	Intent      Intent    `json:"intent"`
+	Outcome     string    `json:"outcome"`
+	Error       string    `json:"error,omitempty"`
+	RecoveredAt time.Time `json:"recovered_at"`
+}
+
+var (
+	db      *sql.DB
+	openErr error
+	openDb  sync.Once
+
+	recoveriesMtx sync.Mutex
+	recoveries    []Recovery
+)
+
+// Enabled reports whether the operations are journaled, see CATALOG_JOURNAL_ENABLED.
+func Enabled() bool {
+	return utils.Config.Catalog.JournalEnabled
+}
+
+// open opens the catalog database holding the journal the first time it is called, it is opened as soon as the local
+// stage is setup, before the catalog store.
+func open() (*sql.DB, error) {
+	openDb.Do(func() {
+		path := utils.Config.Catalog.StorePath
+		connection, err := sql.Open("sqlite3", "file:"+path+"?_pragma=journal_mode(wal)&_pragma=busy_timeout(5000)")
+		if err != nil {
+			openErr = fmt.Errorf("failed to open the journal %s: %v", path, err)
+			return
+		}
+		// NOTE: the intents are written one at a time, one connection is enough
+		connection.SetMaxOpenConns(1)
+
+		if _, err := connection.Exec(schema); err != nil {
+			connection.Close()
+			openErr = fmt.Errorf("failed to setup the journal %s: %v", path, err)
+			return
+		}
+		db = connection
+	})
+	return db, openErr
+}
+
+// Begin records the intent before its operation starts, the operation must not start when it fails. It returns the id
+// the operation ends with, 0 when the journal is disabled.
+func Begin(intent Intent) (int64, error) {
+	if !Enabled() {
+		return 0, nil
+	}
+	connection, err := open()
+	if err != nil {
+		return 0, utils.NewError(utils.ErrorCodeInternal, "failed to open the journal", err)
+	}
+
+	result, err := connection.Exec(
+		"INSERT INTO journal (operation, name, source_stage, target_stage, started_at) VALUES (?, ?, ?, ?, ?)",
+		intent.Operation, intent.Database, intent.SourceStage, intent.TargetStage, time.Now().UTC().Format(time.RFC3339Nano),
+	)
+	if err != nil {
+		return 0, utils.NewError(utils.ErrorCodeInternal, fmt.Sprintf("failed to journal the %s of database %s", intent.Operation, intent.Database), err)
+	}
+	return result.LastInsertId()
+}
+
+// Hold records the intent unless the journal already holds one of the same operation for the database. It is recorded
+// whether the operations are journaled or not, see OperationOfflineWrite and OperationTieredWrite, the operation must not
+// start when it fails.
+func Hold(intent Intent) error {
+	connection, err := open()
+	if err != nil {
+		return utils.NewError(utils.ErrorCodeInternal, "failed to open the journal", err)
+	}
+
+	_, err = connection.Exec(
+		"INSERT INTO journal (operation, name, source_stage, target_stage, started_at) SELECT ?, ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM journal WHERE operation = ? AND name = ?)",
+		intent.Operation, intent.Database, intent.SourceStage, intent.TargetStage, time.Now().UTC().Format(time.RFC3339Nano), intent.Operation, intent.Database,
+	)
+	if err != nil {
+		return utils.NewError(utils.ErrorCodeInternal, fmt.Sprintf("failed to journal the %s of database %s", intent.Operation, intent.Database), err)
+	}
+	return nil
+}
+
+// End removes the intent of an operation once it ended, whether it succeeded or not: a failed operation cleans up after
+// itself, only a crash leaves its intent behind.
+func End(id int64) {
+	if id == 0 {
+		return
+	}
+	connection, err := open()
+	if err == nil {
+		_, err = connection.Exec("DELETE FROM journal WHERE id = ?", id)
+	}
+	if err != nil {
+		// NOTE: the operation is replayed at the next startup, the replays leave a completed operation as it is
+		utils.Logger.Warn("Failed to remove an intent from the journal.", zap.Int64("id", id), zap.Error(err))
+	}
+}
+
+// Release removes the pending intent of the operation recorded for the database by Hold, once what it held is
+// persisted. A failed one is kept for an operator.
+func Release(operation string, name string) {
+	connection, err := open()
+	if err == nil {
+		_, err = connection.Exec("DELETE FROM journal WHERE operation = ? AND name = ? AND status = ?", operation, name, StatusPending)
+	}
+	if err != nil {
+		utils.Logger.Warn("Failed to remove an intent from the journal.", zap.String("operation", operation), zap.String("database", name), zap.Error(err))
+	}
+}
+
+// Pending returns the intents of the journal in the order they were recorded, those of the operations running or
+// interrupted by a crash when called at startup, along with the failed ones held for an operator. Only the offline
+// and tiered writes are returned when the operations aren't journaled, see Hold.
+func Pending() ([]Intent, error) {
+	connection, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT id, operation, name, source_stage, target_stage, started_at, status, COALESCE(error, ''), COALESCE(failed_at, '') FROM journal"
+	if !Enabled() {
+		query += " WHERE operation IN ('" + OperationOfflineWrite + "', '" + OperationTieredWrite + "')"
+	}
+	rows, err := connection.Query(query + " ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the journal: %v", err)
+	}
+	defer rows.Close()
+
+	intents := []Intent{}
+	for rows.Next() {
+		var intent Intent
+		var startedAt, failedAt string
+		if err := rows.Scan(&intent.ID, &intent.Operation, &intent.Database, &intent.SourceStage, &intent.TargetStage, &startedAt, &intent.Status, &intent.Error, &failedAt); err != nil {
+			return nil, fmt.Errorf("failed to read the journal: %v", err)
+		}
+		intent.StartedAt, _ = time.Parse(time.RFC3339Nano, startedAt)
+		if parsed, err := time.Parse(time.RFC3339Nano, failedAt); err == nil {
+			intent.FailedAt = &parsed
+		}
+		intents = append(intents, intent)
+	}
+	return intents, rows.Err()
+}
+
+// Resolve records the outcome of the replay of the intent. The intent is removed from the journal once rolled forward
+// or back, kept pending when the replay is deferred and marked failed when it failed: a failed replay isn't tried again
+// at the next startup, the database may have been written since and the replay would undo it, but what the operation
+// left behind is kept, e.g. the local copy of an interrupted demotion, until an operator retries or dismisses it.
+func Resolve(intent Intent, outcome string, err error) Recovery {
+	recovery := Recovery{Intent: intent, Outcome: outcome, RecoveredAt: time.Now().UTC()}
+	if err != nil {
+		recovery.Error = err.Error()
+	}
+
+	logger := utils.Logger.With(zap.Int64("id", intent.ID), zap.String("operation", intent.Operation), zap.String("database", intent.Database), zap.String("outcome", outcome))
+	switch outcome {
+	case OutcomeFailed:
+		logger.Error("Failed to recover an interrupted operation, it is held in the journal for an operator.", zap.Error(err))
+		if markErr := markFailed(intent.ID, recovery.Error, recovery.RecoveredAt); markErr != nil {
+			logger.Error("Failed to mark the intent as failed in the journal, it is replayed again at the next startup.", zap.Error(markErr))
+		}
+	case OutcomeDeferred:
+		logger.Warn("Deferred the recovery of an interrupted operation to the next startup with the remote stage.", zap.Error(err))
+	default:
+		logger.Warn("Recovered an interrupted operation.", zap.Error(err))
+		End(intent.ID)
+	}
+
+	recoveriesMtx.Lock()
+	recoveries = append(recoveries, recovery)
+	recoveriesMtx.Unlock()
+	return recovery
+}
+
+func markFailed(id int64, reason string, failedAt time.Time) error {
+	connection, err := open()
+	if err != nil {
+		return err
+	}
+	_, err = connection.Exec("UPDATE journal SET status = ?, error = ?, failed_at = ? WHERE id = ?", StatusFailed, reason, failedAt.Format(time.RFC3339Nano), id)
+	return err
+}
+
+// Retry marks the failed intent pending again, it is replayed at the next startup.
+func Retry(id int64) (Intent, error) {
+	return update(id, "UPDATE journal SET status = ?, error = NULL, failed_at = NULL WHERE id = ? AND status = ?", StatusPending, id, StatusFailed)
+}
+
+// Dismiss removes the failed intent from the journal, what its operation left behind is discarded like any other copy
+// at the next startup.
+func Dismiss(id int64) (Intent, error) {
+	return update(id, "DELETE FROM journal WHERE id = ? AND status = ?", id, StatusFailed)
+}
+
+// update runs the statement on the failed intent and returns it as it was, failing when the journal holds no failed
+// intent with the id.
+func update(id int64, statement string, arguments ...any) (Intent, error) {
+	intents, err := Pending()
+	if err != nil {
+		return Intent{}, err
+	}
+	for _, intent := range intents {
+		if intent.ID != id {
+			continue
+		}
+		if intent.Status != StatusFailed {
+			return Intent{}, utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("intent %d is %s, only the failed ones are retried or dismissed", id, intent.Status), nil)
+		}
+		connection, err := open()
+		if err != nil {
+			return Intent{}, err
+		}
+		if _, err := connection.Exec(statement, arguments...); err != nil {
+			return Intent{}, utils.NewError(utils.ErrorCodeInternal, fmt.Sprintf("failed to update intent %d", id), err)
+		}
+		return intent, nil
+	}
+	return Intent{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("intent %d not found", id), nil)
+}
+
+// Recovered returns the replays of the intents found in the journal at startup.
+func Recovered() []Recovery {
+	recoveriesMtx.Lock()
+	defer recoveriesMtx.Unlock()
+
+	return append([]Recovery{}, recoveries...)
+}
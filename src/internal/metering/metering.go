@@ -0,0 +1,305 @@
+package metering
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: sortable and free of characters needing escaping in object keys
+const timestampLayout = "20060102T150405Z"
+
+// Usage is the consumption of a database over a metering period, stored bytes are measured at the end of the period.
+type Usage struct {
+	Tenant          string    `json:"tenant"`
+	Database        string    `json:"database"`
+	PeriodStart     time.Time `json:"period_start"`
+	PeriodEnd       time.Time `json:"period_end"`
+	Queries         int64     `json:"queries"`
+	Statements      int64     `json:"statements"`
+	RowsRead        int64     `json:"rows_read"`
+	RowsWritten     int64     `json:"rows_written"`
+	BytesDownloaded int64     `json:"bytes_downloaded"`
+	BytesUploaded   int64     `json:"bytes_uploaded"`
+	LocalBytes      int64     `json:"local_bytes"`
+	RemoteBytes     int64     `json:"remote_bytes"`
+	LocalSeconds    float64   `json:"local_seconds"`
+	RemoteSeconds   float64   `json:"remote_seconds"`
+}
+
+var (
+	// NOTE: returns the databases currently managed, set when metering is setup
+	listDatabases = func() []stages.Database { return []stages.Database{} }
+
+	usages      = map[string]*Usage{}
+	periodStart = time.Now().UTC()
+	usagesMutex sync.Mutex
+)
+
+// SetupMetering samples the stage residency of the databases and exports the usage of every period to the bucket.
+func SetupMetering(getDatabases func() []stages.Database) {
+	listDatabases = getDatabases
+
+	if !utils.Config.Metering.Enabled {
+		utils.StagesLogger.Info("Usage metering disabled, not starting it.")
+		return
+	}
+
+	go func() {
+		sampleInterval := time.Duration(utils.Config.Metering.SampleIntervalSeconds) * time.Second
+		interval := time.Duration(utils.Config.Metering.IntervalSeconds) * time.Second
+		utils.StagesLogger.Info("Starting usage metering.", zap.Duration("interval", interval), zap.Duration("sampleInterval", sampleInterval))
+
+		sampler := time.NewTicker(sampleInterval)
+		defer sampler.Stop()
+		exporter := time.NewTicker(interval)
+		defer exporter.Stop()
+
+		for {
+			select {
+			case <-sampler.C:
+				sampleResidency(sampleInterval)
+			case <-exporter.C:
+				if _, err := Export(); err != nil {
+					utils.StagesLogger.Error("Failed to export usage report.", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// Tenant returns the tenant owning the database, the part of its name before the configured separator. Every database
+// is its own tenant without separator.
+func Tenant(name string) string {
+	separator := utils.Config.Metering.TenantSeparator
+	if separator == "" {
+		return name
+	}
+	if tenant, _, found := strings.Cut(name, separator); found {
+		return tenant
+	}
+	return name
+}
+
+// usageOf returns the usage of the database for the current period, usagesMutex must be held.
+func usageOf(name string) *Usage {
+	usage, exists := usages[name]
+	if !exists {
+		usage = &Usage{Tenant: Tenant(name), Database: name}
+		usages[name] = usage
+	}
+	return usage
+}
+
+// RecordQuery meters a read query and the rows it returned.
+func RecordQuery(name string, rows int) {
+	if !utils.Config.Metering.Enabled {
+		return
+	}
+
+	usagesMutex.Lock()
+	defer usagesMutex.Unlock()
+
+	usage := usageOf(name)
+	usage.Queries++
+	usage.RowsRead += int64(rows)
+}
+
+// RecordStatements meters write statements and the rows they affected.
+func RecordStatements(name string, statements int, rowsAffected int64) {
+	if !utils.Config.Metering.Enabled {
+		return
+	}
+
+	usagesMutex.Lock()
+	defer usagesMutex.Unlock()
+
+	usage := usageOf(name)
+	usage.Statements += int64(statements)
+	usage.RowsWritten += rowsAffected
+}
+
+func sampleResidency(interval time.Duration) {
+	databases := listDatabases()
+
+	usagesMutex.Lock()
+	defer usagesMutex.Unlock()
+
+	for _, database := range databases {
+		usage := usageOf(database.GetName())
+		if database.GetStage() == utils.GetLocalStage() {
+			usage.LocalSeconds += interval.Seconds()
+		} else {
+			usage.RemoteSeconds += interval.Seconds()
+		}
+	}
+}
+
+// Current returns the usage metered since the start of the current period, stored bytes and transfers are only
+// measured when the period ends.
+func Current() []Usage {
+	usagesMutex.Lock()
+	defer usagesMutex.Unlock()
+
+	now := time.Now().UTC()
+	result := make([]Usage, 0, len(usages))
+	for _, usage := range usages {
+		current := *usage
+		current.PeriodStart, current.PeriodEnd = periodStart, now
+		result = append(result, current)
+	}
+	sortUsages(result)
+	return result
+}
+
+// Export closes the current period and writes its usage report to the bucket, returning the report key.
+func Export() (string, error) {
+	databases := listDatabases()
+	transfers := remotevfs.TakeTransfers()
+
+	usagesMutex.Lock()
+	start, end := periodStart, time.Now().UTC()
+	for _, database := range databases {
+		usageOf(database.GetName())
+	}
+	period := usages
+	usages = map[string]*Usage{}
+	periodStart = end
+	usagesMutex.Unlock()
+
+	for key, transfer := range transfers {
+		name, isDatabase := remotevfs.DatabaseNameFromKey(key)
+		if !isDatabase {
+			continue
+		}
+		usage, exists := period[name]
+		if !exists {
+			usage = &Usage{Tenant: Tenant(name), Database: name}
+			period[name] = usage
+		}
+		usage.BytesDownloaded += transfer.Downloaded
+		usage.BytesUploaded += transfer.Uploaded
+	}
+
+	for _, database := range databases {
+		usage := period[database.GetName()]
+		usage.LocalBytes, usage.RemoteBytes = storedBytes(database)
+	}
+
+	report := make([]Usage, 0, len(period))
+	for _, usage := range period {
+		usage.PeriodStart, usage.PeriodEnd = start, end
+		report = append(report, *usage)
+	}
+	sortUsages(report)
+
+	body, contentType, err := encode(report)
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("%s%s.%s", utils.Config.Metering.Prefix, start.Format(timestampLayout), utils.Config.Metering.Format)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := remotevfs.PutObject(ctx, key, body, contentType); err != nil {
+		// NOTE: the period is merged back into the current one so that its usage is exported with the next report
+		restore(report, start)
+		return "", fmt.Errorf("failed to write usage report %s: %w", key, err)
+	}
+
+	utils.StagesLogger.Info("Usage report exported.", zap.String("key", key), zap.Int("databases", len(report)))
+	return key, nil
+}
+
+func restore(report []Usage, start time.Time) {
+	usagesMutex.Lock()
+	defer usagesMutex.Unlock()
+
+	periodStart = start
+	for _, previous := range report {
+		usage := usageOf(previous.Database)
+		usage.Queries += previous.Queries
+		usage.Statements += previous.Statements
+		usage.RowsRead += previous.RowsRead
+		usage.RowsWritten += previous.RowsWritten
+		usage.BytesDownloaded += previous.BytesDownloaded
+		usage.BytesUploaded += previous.BytesUploaded
+		usage.LocalSeconds += previous.LocalSeconds
+		usage.RemoteSeconds += previous.RemoteSeconds
+	}
+}
+
+func storedBytes(database stages.Database) (int64, int64) {
+	var local, remote int64
+
+	if database.GetStage() == utils.GetLocalStage() {
+		if info, err := os.Stat(database.GetPath()); err == nil {
+			local = info.Size()
+		}
+	}
+
+	// NOTE: local databases are synced to the remote stage, both copies are billed
+	size, err := remotevfs.FileSize(stages.GetRemoteKey(database))
+	if err == nil {
+		remote = size
+	}
+
+	return local, remote
+}
+
+func sortUsages(usages []Usage) {
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Tenant != usages[j].Tenant {
+			return usages[i].Tenant < usages[j].Tenant
+		}
+		return usages[i].Database < usages[j].Database
+	})
+}
+
+func encode(report []Usage) ([]byte, string, error) {
+	if utils.Config.Metering.Format != "csv" {
+		body, err := json.Marshal(report)
+		return body, "application/json", err
+	}
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Write([]string{
+		"tenant", "database", "period_start", "period_end", "queries", "statements", "rows_read", "rows_written",
+		"bytes_downloaded", "bytes_uploaded", "local_bytes", "remote_bytes", "local_seconds", "remote_seconds",
+	})
+	for _, usage := range report {
+		writer.Write([]string{
+			usage.Tenant,
+			usage.Database,
+			usage.PeriodStart.Format(time.RFC3339),
+			usage.PeriodEnd.Format(time.RFC3339),
+			strconv.FormatInt(usage.Queries, 10),
+			strconv.FormatInt(usage.Statements, 10),
+			strconv.FormatInt(usage.RowsRead, 10),
+			strconv.FormatInt(usage.RowsWritten, 10),
+			strconv.FormatInt(usage.BytesDownloaded, 10),
+			strconv.FormatInt(usage.BytesUploaded, 10),
+			strconv.FormatInt(usage.LocalBytes, 10),
+			strconv.FormatInt(usage.RemoteBytes, 10),
+			strconv.FormatFloat(usage.LocalSeconds, 'f', 0, 64),
+			strconv.FormatFloat(usage.RemoteSeconds, 'f', 0, 64),
+		})
+	}
+	writer.Flush()
+	return buffer.Bytes(), "text/csv", writer.Error()
+}
@@ -0,0 +1,22 @@
+package internal
+
+import (
+	"sync"
+
+	"persisto/src/internal/pgwire"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+var (
+	pgwireSetupOnce sync.Once
+)
+
+func SetupPgwire() {
+	pgwireSetupOnce.Do(func() {
+		if err := pgwire.Setup(); err != nil {
+			utils.Logger.Fatal("Failed to setup the PostgreSQL front-end.", zap.Error(err))
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package pgwire
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"persisto/src/internal/statements"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: the statement policies restrict the sessions as the endpoint they are reached through
+const endpoint = statements.EndpointPgwire
+
+var (
+	tlsConfig *tls.Config
+
+	// NOTE: sessions currently open, bounded by PGWIRE_MAX_CONNECTIONS
+	openSessions atomic.Int64
+)
+
+// Setup starts listening for the PostgreSQL clients, nothing is done when the front-end is disabled.
+func Setup() error {
+	if !utils.Config.Pgwire.Enabled {
+		return nil
+	}
+
+	if utils.Config.Pgwire.TLSCertPath != "" {
+		certificate, err := tls.LoadX509KeyPair(utils.Config.Pgwire.TLSCertPath, utils.Config.Pgwire.TLSKeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to load the TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", utils.Config.Pgwire.Port))
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	utils.PgwireLogger.Info("PostgreSQL front-end listening.", zap.Int("port", utils.Config.Pgwire.Port), zap.Bool("tls", tlsConfig != nil))
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				utils.PgwireLogger.Warn("Failed to accept connection.", zap.Error(err))
+				continue
+			}
+
+			go serve(conn)
+		}
+	}()
+
+	return nil
+}
+
+func serve(conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if openSessions.Add(1) > int64(utils.Config.Pgwire.MaxConnections) {
+		openSessions.Add(-1)
+		session := newSession(ctx, conn)
+		session.fatal(stateTooManyConnections, "sorry, too many clients already")
+		return
+	}
+	defer openSessions.Add(-1)
+
+	session := newSession(ctx, conn)
+	if err := session.run(); err != nil {
+		utils.PgwireLogger.Debug("Session ended.", zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+	}
+}
@@ -0,0 +1,198 @@
+package pgwire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"persisto/src/utils"
+
+	"github.com/ncruces/go-sqlite3"
+)
+
+const (
+	protocolVersion = 196608
+	sslRequestCode  = 80877103
+	gssRequestCode  = 80877104
+	cancelRequest   = 80877102
+
+	// NOTE: bounds the memory a client can make the server allocate with a single message
+	maxMessageLength = 16 << 20
+)
+
+// NOTE: types of the messages sent by the clients
+const (
+	messageQuery     = 'Q'
+	messagePassword  = 'p'
+	messageTerminate = 'X'
+	messageSync      = 'S'
+	messageFlush     = 'H'
+)
+
+// NOTE: identifiers of the PostgreSQL types the SQLite storage classes are described as
+const (
+	oidBytea  = 17
+	oidInt8   = 20
+	oidText   = 25
+	oidFloat8 = 701
+)
+
+// NOTE: SQLSTATE codes of the errors reported to the clients
+const (
+	stateFeatureNotSupported  = "0A000"
+	stateInvalidPassword      = "28P01"
+	stateInvalidAuthorization = "28000"
+	stateInvalidCatalogName   = "3D000"
+	stateInvalidParameter     = "22023"
+	stateReadOnlyTransaction  = "25006"
+	stateProtocolViolation    = "08P01"
+	stateIntegrityViolation   = "23000"
+	stateInsufficientPrivs    = "42501"
+	stateSyntaxOrAccess       = "42000"
+	stateUndefinedObject      = "42704"
+	stateLockNotAvailable     = "55P03"
+	stateDiskFull             = "53100"
+	stateProgramLimitExceeded = "54000"
+	stateTooManyConnections   = "53300"
+	stateSystemError          = "58000"
+	stateInternalError        = "XX000"
+)
+
+// NOTE: reported with its own state, the clients are expected to narrow the query rather than retry it
+var errResultTooLarge = errors.New("the result exceeds SETTINGS_MAX_RESULT_ROWS or SETTINGS_MAX_RESULT_BYTES, narrow it with LIMIT and OFFSET")
+
+// message is a message of the client, its type is zero for the startup messages which have none.
+type message struct {
+	kind byte
+	body []byte
+}
+
+func readStartup(reader *bufio.Reader) (uint32, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length < 8 || length > maxMessageLength {
+		return 0, nil, fmt.Errorf("invalid startup message length %d", length)
+	}
+
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(body[:4]), body[4:], nil
+}
+
+func readMessage(reader *bufio.Reader) (message, error) {
+	kind, err := reader.ReadByte()
+	if err != nil {
+		return message{}, err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return message{}, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length < 4 || length > maxMessageLength {
+		return message{}, fmt.Errorf("invalid message length %d", length)
+	}
+
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return message{}, err
+	}
+	return message{kind: kind, body: body}, nil
+}
+
+// parseParameters decodes the null terminated key and value pairs of a startup message.
+func parseParameters(body []byte) map[string]string {
+	parameters := map[string]string{}
+	for {
+		key, rest, found := cutString(body)
+		if !found || key == "" {
+			return parameters
+		}
+		value, rest, found := cutString(rest)
+		if !found {
+			return parameters
+		}
+		parameters[key] = value
+		body = rest
+	}
+}
+
+func cutString(body []byte) (string, []byte, bool) {
+	for index, character := range body {
+		if character == 0 {
+			return string(body[:index]), body[index+1:], true
+		}
+	}
+	return "", nil, false
+}
+
+// buffer builds a message of the server, its length is filled in once complete.
+type buffer struct {
+	bytes []byte
+	start int
+}
+
+func (b *buffer) begin(kind byte) {
+	b.bytes = append(b.bytes, kind, 0, 0, 0, 0)
+	b.start = len(b.bytes) - 4
+}
+
+func (b *buffer) end() {
+	binary.BigEndian.PutUint32(b.bytes[b.start:], uint32(len(b.bytes)-b.start))
+}
+
+func (b *buffer) int16(value int) {
+	b.bytes = binary.BigEndian.AppendUint16(b.bytes, uint16(value))
+}
+
+func (b *buffer) int32(value int) {
+	b.bytes = binary.BigEndian.AppendUint32(b.bytes, uint32(value))
+}
+
+func (b *buffer) string(value string) {
+	b.bytes = append(b.bytes, value...)
+	b.bytes = append(b.bytes, 0)
+}
+
+func (b *buffer) raw(value []byte) {
+	b.bytes = append(b.bytes, value...)
+}
+
+// stateOf returns the SQLSTATE closest to the error, following its persisto error code.
+func stateOf(err error) string {
+	if errors.Is(err, errResultTooLarge) {
+		return stateProgramLimitExceeded
+	}
+	if errors.Is(err, sqlite3.CONSTRAINT) {
+		return stateIntegrityViolation
+	}
+
+	switch utils.ErrorCodeOf(err) {
+	case utils.ErrorCodeNotFound:
+		return stateUndefinedObject
+	case utils.ErrorCodeUnauthorized:
+		return stateInvalidAuthorization
+	case utils.ErrorCodeForbidden:
+		return stateInsufficientPrivs
+	case utils.ErrorCodeReadOnly:
+		return stateReadOnlyTransaction
+	case utils.ErrorCodeBusy:
+		return stateLockNotAvailable
+	case utils.ErrorCodeQuotaExceeded:
+		return stateDiskFull
+	case utils.ErrorCodeStageUnavailable, utils.ErrorCodeSyncFailed:
+		return stateSystemError
+	case utils.ErrorCodeInvalidInput, utils.ErrorCodeQueryFailed, utils.ErrorCodeConflict:
+		return stateSyntaxOrAccess
+	default:
+		return stateInternalError
+	}
+}
@@ -0,0 +1,561 @@
+package pgwire
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"persisto/src/internal/admission"
+	"persisto/src/internal/audit"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/policies"
+	"persisto/src/internal/replication"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: version announced to the clients, some of them parse it to pick the features they use
+const serverVersion = "14.0 (persisto)"
+
+// session is a connection of a PostgreSQL client, bound to a single database for its whole life.
+type session struct {
+	// NOTE: done once the session ends, the statements of the session run with it
+	ctx    context.Context
+	conn   net.Conn
+	reader *bufio.Reader
+	output buffer
+
+	database  string
+	user      string
+	principal string
+	// NOTE: parameters reported to the client, answered by SHOW
+	parameters map[string]string
+}
+
+func newSession(ctx context.Context, conn net.Conn) *session {
+	return &session{ctx: ctx, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (session *session) run() error {
+	if err := session.startup(); err != nil {
+		return err
+	}
+
+	// NOTE: set once a message of the extended query protocol was refused, the following ones are ignored until Sync
+	skipping := false
+	for {
+		if err := session.waitForMessage(); err != nil {
+			return err
+		}
+		message, err := readMessage(session.reader)
+		if err != nil {
+			return err
+		}
+
+		switch message.kind {
+		case messageQuery:
+			text, _, _ := cutString(message.body)
+			session.query(text)
+			session.readyForQuery()
+		case messageTerminate:
+			return nil
+		case messageSync:
+			skipping = false
+			session.readyForQuery()
+		case messageFlush:
+		default:
+			if !skipping {
+				session.error(stateFeatureNotSupported, "only the simple query protocol is supported")
+				skipping = true
+			}
+		}
+
+		if err := session.flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// startup negotiates the encryption, authenticates the client and reports the session parameters.
+func (session *session) startup() error {
+	var parameters map[string]string
+	for parameters == nil {
+		if err := session.waitForMessage(); err != nil {
+			return err
+		}
+		code, body, err := readStartup(session.reader)
+		if err != nil {
+			return err
+		}
+
+		switch code {
+		case sslRequestCode:
+			if tlsConfig == nil {
+				if _, err := session.conn.Write([]byte{'N'}); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := session.conn.Write([]byte{'S'}); err != nil {
+				return err
+			}
+			upgraded := tls.Server(session.conn, tlsConfig)
+			if err := upgraded.Handshake(); err != nil {
+				return fmt.Errorf("TLS handshake failed: %w", err)
+			}
+			session.conn = upgraded
+			session.reader = bufio.NewReader(upgraded)
+		case gssRequestCode:
+			if _, err := session.conn.Write([]byte{'N'}); err != nil {
+				return err
+			}
+		case cancelRequest:
+			// NOTE: statements aren't cancellable, the request is dropped like PostgreSQL drops unknown keys
+			return nil
+		case protocolVersion:
+			parameters = parseParameters(body)
+		default:
+			session.fatal(stateProtocolViolation, fmt.Sprintf("unsupported frontend protocol %d.%d", code>>16, code&0xffff))
+			return fmt.Errorf("unsupported protocol %d", code)
+		}
+	}
+
+	if _, encrypted := session.conn.(*tls.Conn); tlsConfig != nil && !encrypted {
+		session.fatal(stateInvalidAuthorization, "TLS is required")
+		return fmt.Errorf("client didn't upgrade to TLS")
+	}
+
+	session.user = parameters["user"]
+	session.database = parameters["database"]
+	if session.database == "" {
+		session.database = session.user
+	}
+
+	priority, err := utils.ParsePriority(priorityOf(parameters))
+	if err != nil {
+		session.fatal(stateInvalidParameter, err.Error())
+		return err
+	}
+	session.ctx = utils.WithPriority(session.ctx, priority)
+
+	if err := session.authenticate(); err != nil {
+		return err
+	}
+
+	if _, err := databases.Dbs.FindByName(session.database); err != nil {
+		session.fatal(stateInvalidCatalogName, fmt.Sprintf("database \"%s\" does not exist", session.database))
+		return err
+	}
+
+	session.parameters = map[string]string{
+		"server_version":              serverVersion,
+		"server_encoding":             "UTF8",
+		"client_encoding":             "UTF8",
+		"DateStyle":                   "ISO, MDY",
+		"TimeZone":                    "UTC",
+		"integer_datetimes":           "on",
+		"standard_conforming_strings": "on",
+		"application_name":            parameters["application_name"],
+	}
+
+	session.output.begin('R')
+	session.output.int32(0)
+	session.output.end()
+	for name, value := range session.parameters {
+		session.output.begin('S')
+		session.output.string(name)
+		session.output.string(value)
+		session.output.end()
+	}
+
+	// NOTE: cancel requests are ignored, the key only has to look like one
+	key := make([]byte, 8)
+	rand.Read(key)
+	session.output.begin('K')
+	session.output.raw(key)
+	session.output.end()
+
+	session.readyForQuery()
+
+	utils.PgwireLogger.Info(
+		"Session started.",
+		zap.String("remote", session.conn.RemoteAddr().String()),
+		zap.String("database", session.database),
+		zap.String("user", session.user),
+		zap.String("principal", session.principal),
+	)
+	return session.flush()
+}
+
+// authenticate asks for the password in clear, the principals send their token and the other users the shared
+// PGWIRE_PASSWORD. Both are only safe over TLS or a trusted network.
+func (session *session) authenticate() error {
+	session.output.begin('R')
+	session.output.int32(3)
+	session.output.end()
+	if err := session.flush(); err != nil {
+		return err
+	}
+
+	if err := session.waitForMessage(); err != nil {
+		return err
+	}
+	message, err := readMessage(session.reader)
+	if err != nil {
+		return err
+	}
+	if message.kind != messagePassword {
+		session.fatal(stateProtocolViolation, "expected a password message")
+		return fmt.Errorf("unexpected message %q during authentication", message.kind)
+	}
+	password, _, _ := cutString(message.body)
+
+	if utils.Config.Policies.Enabled && password != "" {
+		if principal, err := policies.Authenticate(password); err == nil && principal != "" {
+			// NOTE: the user name must match so that the logs and the client show who is connected
+			if principal != session.user {
+				session.fatal(stateInvalidPassword, fmt.Sprintf("password authentication failed for user \"%s\"", session.user))
+				return fmt.Errorf("token of principal %s used by user %s", principal, session.user)
+			}
+			session.principal = principal
+			return nil
+		}
+	}
+
+	shared := utils.Config.Pgwire.Password.Value()
+	if shared == "" || subtle.ConstantTimeCompare([]byte(password), []byte(shared)) != 1 {
+		session.fatal(stateInvalidPassword, fmt.Sprintf("password authentication failed for user \"%s\"", session.user))
+		return fmt.Errorf("invalid password for user %s", session.user)
+	}
+	if utils.Config.Policies.Enabled && utils.Config.Policies.RequirePrincipal {
+		session.fatal(stateInvalidAuthorization, "a principal is required, connect with the name and token of a principal")
+		return fmt.Errorf("principal required for user %s", session.user)
+	}
+	return nil
+}
+
+// query runs the statements of a simple query one after the other, stopping at the first failing one. Statements
+// wrapped in BEGIN and COMMIT are run in a single transaction.
+func (session *session) query(text string) {
+	statements := splitStatements(text)
+	if len(statements) == 0 {
+		session.output.begin('I')
+		session.output.end()
+		return
+	}
+
+	database, err := databases.Dbs.FindByName(session.database)
+	if err != nil {
+		session.error(stateInvalidCatalogName, fmt.Sprintf("database \"%s\" does not exist anymore", session.database))
+		return
+	}
+
+	release, err := admission.Admit(session.ctx, session.database)
+	if err != nil {
+		session.error(stateOf(err), err.Error())
+		return
+	}
+	defer release()
+
+	if len(statements) >= 2 && isBegin(statements[0]) && isCommit(statements[len(statements)-1]) {
+		session.transaction(database, statements)
+		return
+	}
+
+	for _, statement := range statements {
+		var err error
+		switch keyword := keywordOf(statement); {
+		case isTransactionControl(keyword):
+			session.error(stateFeatureNotSupported, "transactions must be sent as a single query, e.g. BEGIN; ...; COMMIT;")
+			return
+		case keyword == "SET":
+			// NOTE: session settings sent by the drivers on connection, SQLite has none of them
+			session.complete("SET")
+		case keyword == "SHOW":
+			err = session.show(statement)
+		case utils.IsWriteOperation(statement):
+			err = session.execute(database, statement)
+		default:
+			err = session.read(database, statement)
+		}
+		if err != nil {
+			session.error(stateOf(err), err.Error())
+			return
+		}
+	}
+}
+
+func (session *session) execute(database *databases.Database, statement string) error {
+	if !replication.IsPrimary() {
+		return utils.NewError(utils.ErrorCodeReadOnly, "instance is a read replica, writes must be sent to the primary instance", nil)
+	}
+
+	result, err := database.ExecuteAs(session.ctx, session.principal, endpoint, statement)
+	session.recordExecuted(database, []string{statement}, err, false)
+	if err != nil {
+		return err
+	}
+
+	session.complete(commandTag(statement, result["RowsAffected"].(int64)))
+	return nil
+}
+
+func (session *session) transaction(database *databases.Database, statements []string) {
+	if !replication.IsPrimary() {
+		session.error(stateReadOnlyTransaction, "instance is a read replica, writes must be sent to the primary instance")
+		return
+	}
+
+	writes := statements[1 : len(statements)-1]
+	for _, statement := range writes {
+		// NOTE: savepoints nest within the transaction, a failing statement still rolls back all of them
+		if _, isSavepoint := databases.ParseSavepoint(statement); isSavepoint {
+			continue
+		}
+		if keyword := keywordOf(statement); isTransactionControl(keyword) || !utils.IsWriteOperation(statement) {
+			session.error(stateFeatureNotSupported, "transactions may only hold INSERT, UPDATE, DELETE, CREATE, DROP and ALTER statements, and savepoints")
+			return
+		}
+	}
+
+	results, _, err := database.ExecuteTransactionAs(session.ctx, session.principal, endpoint, writes, make([][]any, len(writes)))
+	session.recordExecuted(database, writes, err, true)
+	if err != nil {
+		session.error(stateOf(err), err.Error())
+		return
+	}
+
+	session.complete("BEGIN")
+	for index, statement := range writes {
+		session.complete(commandTag(statement, results[index]["RowsAffected"].(int64)))
+	}
+	session.complete("COMMIT")
+}
+
+func (session *session) read(database *databases.Database, statement string) error {
+	// NOTE: PostgreSQL clients have no way to continue a truncated result, results past the limits are refused instead
+	window := utils.ResultWindow{PageRows: utils.Config.Settings.MaxResultRows, PageBytes: utils.Config.Settings.MaxResultBytes}
+
+	var rows utils.QueryResultType
+	var columns []utils.QueryColumn
+	var truncated bool
+	var err error
+	if replication.IsFollower() {
+		// NOTE: followers answer from their local replica rather than reading the remote object
+		rows, columns, truncated, err = replication.Query(session.ctx, database.Name, session.principal, endpoint, window, statement)
+	} else {
+		rows, columns, truncated, err = database.QueryAs(session.ctx, session.principal, endpoint, window, statement)
+	}
+	if err != nil {
+		return err
+	}
+	if truncated {
+		return errResultTooLarge
+	}
+
+	if len(columns) == 0 {
+		session.complete(keywordOf(statement))
+		return nil
+	}
+
+	session.output.begin('T')
+	session.output.int16(len(columns))
+	for _, column := range columns {
+		session.output.string(column.Name)
+		session.output.int32(0)
+		session.output.int16(0)
+		session.output.int32(oidOf(column.Type))
+		session.output.int16(-1)
+		session.output.int32(-1)
+		session.output.int16(0)
+	}
+	session.output.end()
+
+	for _, row := range rows {
+		session.output.begin('D')
+		session.output.int16(len(columns))
+		for _, column := range columns {
+			value, isNull := formatValue(row[column.Name])
+			if isNull {
+				session.output.int32(-1)
+				continue
+			}
+			session.output.int32(len(value))
+			session.output.raw(value)
+		}
+		session.output.end()
+	}
+
+	session.complete(fmt.Sprintf("SELECT %d", len(rows)))
+	return nil
+}
+
+func (session *session) show(statement string) error {
+	name := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(statement[len("SHOW"):]), ";"))
+	for parameter, value := range session.parameters {
+		if strings.EqualFold(parameter, name) {
+			session.output.begin('T')
+			session.output.int16(1)
+			session.output.string(strings.ToLower(parameter))
+			session.output.int32(0)
+			session.output.int16(0)
+			session.output.int32(oidText)
+			session.output.int16(-1)
+			session.output.int32(-1)
+			session.output.int16(0)
+			session.output.end()
+
+			session.output.begin('D')
+			session.output.int16(1)
+			session.output.int32(len(value))
+			session.output.raw([]byte(value))
+			session.output.end()
+
+			session.complete("SHOW")
+			return nil
+		}
+	}
+	return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("unrecognized configuration parameter \"%s\"", name), nil)
+}
+
+func (session *session) recordExecuted(database *databases.Database, statements []string, err error, transaction bool) {
+	failed := 0
+	if err != nil {
+		failed = len(statements)
+	}
+
+	details := map[string]any{"queries": statements, "failed": failed, "protocol": "pgwire", "user": session.user}
+	if transaction {
+		details["transaction"] = true
+	}
+	if session.principal != "" {
+		details["principal"] = session.principal
+	}
+	audit.Record(audit.Event{Type: audit.EventDatabaseExecuted, Database: database.Name, Details: details})
+}
+
+func (session *session) complete(tag string) {
+	session.output.begin('C')
+	session.output.string(tag)
+	session.output.end()
+}
+
+func (session *session) readyForQuery() {
+	session.output.begin('Z')
+	session.output.raw([]byte{'I'})
+	session.output.end()
+}
+
+func (session *session) error(state string, text string) {
+	session.report("ERROR", state, text)
+}
+
+// fatal reports an error ending the session and sends it right away.
+func (session *session) fatal(state string, text string) {
+	session.report("FATAL", state, text)
+	session.flush()
+}
+
+func (session *session) report(severity string, state string, text string) {
+	session.output.begin('E')
+	session.output.raw([]byte{'S'})
+	session.output.string(severity)
+	session.output.raw([]byte{'V'})
+	session.output.string(severity)
+	session.output.raw([]byte{'C'})
+	session.output.string(state)
+	session.output.raw([]byte{'M'})
+	session.output.string(text)
+	session.output.raw([]byte{0})
+	session.output.end()
+}
+
+func (session *session) flush() error {
+	if len(session.output.bytes) == 0 {
+		return nil
+	}
+	_, err := session.conn.Write(session.output.bytes)
+	session.output.bytes = session.output.bytes[:0]
+	return err
+}
+
+// waitForMessage bounds the time a client may stay idle before its session is closed.
+func (session *session) waitForMessage() error {
+	if utils.Config.Pgwire.IdleTimeoutSeconds == 0 {
+		return session.conn.SetReadDeadline(time.Time{})
+	}
+	return session.conn.SetReadDeadline(time.Now().Add(time.Duration(utils.Config.Pgwire.IdleTimeoutSeconds) * time.Second))
+}
+
+// oidOf returns the PostgreSQL type the values of a column of the given storage class are described as, mixed and
+// NULL columns are described as text.
+func oidOf(columnType string) int {
+	switch columnType {
+	case utils.ColumnTypeInteger:
+		return oidInt8
+	case utils.ColumnTypeReal:
+		return oidFloat8
+	case utils.ColumnTypeBlob:
+		return oidBytea
+	default:
+		return oidText
+	}
+}
+
+// formatValue encodes the value in the text format of the type of its column.
+func formatValue(value any) ([]byte, bool) {
+	switch value := value.(type) {
+	case nil:
+		return nil, true
+	case int64:
+		return strconv.AppendInt(nil, value, 10), false
+	case float64:
+		return strconv.AppendFloat(nil, value, 'g', -1, 64), false
+	case bool:
+		if value {
+			return []byte("t"), false
+		}
+		return []byte("f"), false
+	case []byte:
+		return []byte(`\x` + hex.EncodeToString(value)), false
+	case time.Time:
+		return []byte(value.Format("2006-01-02 15:04:05.999999Z07:00")), false
+	case string:
+		return []byte(value), false
+	default:
+		return []byte(fmt.Sprint(value)), false
+	}
+}
+
+func isBegin(statement string) bool {
+	keyword := keywordOf(statement)
+	return keyword == "BEGIN" || keyword == "START"
+}
+
+func isCommit(statement string) bool {
+	keyword := keywordOf(statement)
+	return keyword == "COMMIT" || keyword == "END"
+}
+
+// priorityOf returns the priority class the client asked for in its startup parameters, either as the persisto.priority
+// parameter or as -c persisto.priority=<class> in its options, as libpq sends those of PGOPTIONS.
+func priorityOf(parameters map[string]string) string {
+	if priority, set := parameters["persisto.priority"]; set {
+		return priority
+	}
+	for _, option := range strings.Fields(parameters["options"]) {
+		if priority, isPriority := strings.CutPrefix(strings.TrimPrefix(option, "-c"), "persisto.priority="); isPriority {
+			return priority
+		}
+	}
+	return ""
+}
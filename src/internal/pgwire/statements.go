@@ -0,0 +1,149 @@
+package pgwire
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// splitStatements splits the text of a simple query into its statements, the semicolons inside literals, quoted
+// identifiers, comments and trigger bodies don't end a statement. Empty statements are dropped.
+func splitStatements(text string) []string {
+	var statements []string
+
+	start := 0
+	// NOTE: trigger bodies hold statements of their own, they only end with the END keyword
+	inTrigger := false
+	lastWord := ""
+	words := 0
+
+	flush := func(end int) {
+		if statement := strings.TrimSpace(text[start:end]); statement != "" {
+			statements = append(statements, statement)
+		}
+		start = end + 1
+		inTrigger, lastWord, words = false, "", 0
+	}
+
+	for index := 0; index < len(text); index++ {
+		character := text[index]
+		switch {
+		case character == '\'' || character == '"' || character == '`':
+			index = skipQuoted(text, index, character)
+		case character == '[':
+			index = skipQuoted(text, index, ']')
+		case character == '-' && strings.HasPrefix(text[index:], "--"):
+			if end := strings.IndexByte(text[index:], '\n'); end >= 0 {
+				index += end
+			} else {
+				index = len(text)
+			}
+		case character == '/' && strings.HasPrefix(text[index:], "/*"):
+			if end := strings.Index(text[index+2:], "*/"); end >= 0 {
+				index += end + 3
+			} else {
+				index = len(text)
+			}
+		case character == ';':
+			if !inTrigger || lastWord == "END" {
+				flush(index)
+			}
+		case isWordCharacter(character):
+			end := index
+			for end < len(text) && isWordCharacter(text[end]) {
+				end++
+			}
+			lastWord = strings.ToUpper(text[index:end])
+			words++
+			// NOTE: CREATE [TEMP|TEMPORARY] TRIGGER
+			if lastWord == "TRIGGER" && words <= 3 && strings.HasPrefix(strings.ToUpper(strings.TrimSpace(text[start:index])), "CREATE") {
+				inTrigger = true
+			}
+			index = end - 1
+		}
+	}
+	flush(len(text))
+
+	return statements
+}
+
+func skipQuoted(text string, index int, closing byte) int {
+	for index++; index < len(text); index++ {
+		if text[index] != closing {
+			continue
+		}
+		// NOTE: doubled quotes are escaped quotes
+		if closing != ']' && index+1 < len(text) && text[index+1] == closing {
+			index++
+			continue
+		}
+		return index
+	}
+	return len(text)
+}
+
+func isWordCharacter(character byte) bool {
+	return character == '_' || character > unicode.MaxASCII || unicode.IsLetter(rune(character)) || unicode.IsDigit(rune(character))
+}
+
+// keywordOf returns the first keyword of the statement in upper case, ignoring the leading comments.
+func keywordOf(statement string) string {
+	for {
+		statement = strings.TrimSpace(statement)
+		switch {
+		case strings.HasPrefix(statement, "--"):
+			end := strings.IndexByte(statement, '\n')
+			if end < 0 {
+				return ""
+			}
+			statement = statement[end:]
+		case strings.HasPrefix(statement, "/*"):
+			end := strings.Index(statement, "*/")
+			if end < 0 {
+				return ""
+			}
+			statement = statement[end+2:]
+		default:
+			end := 0
+			for end < len(statement) && isWordCharacter(statement[end]) {
+				end++
+			}
+			return strings.ToUpper(statement[:end])
+		}
+	}
+}
+
+// commandTag returns the tag completing a write, e.g. INSERT 0 1 or CREATE TABLE, clients read the affected rows from it.
+func commandTag(statement string, rowsAffected int64) string {
+	fields := strings.Fields(strings.ToUpper(statement))
+	if len(fields) == 0 {
+		return ""
+	}
+
+	switch keyword := keywordOf(statement); keyword {
+	case "INSERT", "REPLACE":
+		return fmt.Sprintf("INSERT 0 %d", rowsAffected)
+	case "UPDATE", "DELETE":
+		return fmt.Sprintf("%s %d", keyword, rowsAffected)
+	case "CREATE", "DROP", "ALTER":
+		tag := keyword
+		for _, field := range fields[1:] {
+			if field == "TEMP" || field == "TEMPORARY" || field == "UNIQUE" || field == "VIRTUAL" {
+				continue
+			}
+			return tag + " " + strings.Trim(field, "(;")
+		}
+		return tag
+	default:
+		return keyword
+	}
+}
+
+func isTransactionControl(keyword string) bool {
+	switch keyword {
+	case "BEGIN", "START", "COMMIT", "END", "ROLLBACK", "SAVEPOINT", "RELEASE":
+		return true
+	default:
+		return false
+	}
+}
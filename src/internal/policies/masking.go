@@ -0,0 +1,245 @@
+package policies
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"persisto/src/utils"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/driver"
+)
+
+// NOTE: like the policies, the sensitive columns are stored in the database they belong to
+const SensitiveTable = "_persisto_sensitive_columns"
+
+const (
+	// NOTE: values are replaced by a fixed placeholder
+	MaskRedact = "redact"
+	// NOTE: only the last characters of long values are kept, e.g. for phone or card numbers
+	MaskPartial = "partial"
+	// NOTE: values are replaced by a keyed hash, equal values keep equal hashes so they can still be joined and counted
+	MaskHash = "hash"
+)
+
+const redacted = "****"
+
+// SensitiveColumn is a column whose values are masked for the principals without the unmasked permission.
+type SensitiveColumn struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	Mode   string `json:"mode"`
+}
+
+// ListSensitive returns the sensitive columns of the database.
+func ListSensitive(database Executor) ([]SensitiveColumn, error) {
+	exists, err := tableExists(database, SensitiveTable)
+	if err != nil || !exists {
+		return []SensitiveColumn{}, err
+	}
+
+	rows, _, err := database.Query("SELECT table_name, column_name, mode FROM " + SensitiveTable + " ORDER BY table_name, column_name")
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]SensitiveColumn, 0, len(rows))
+	for _, row := range rows {
+		columns = append(columns, SensitiveColumn{
+			Table:  fmt.Sprint(row["table_name"]),
+			Column: fmt.Sprint(row["column_name"]),
+			Mode:   fmt.Sprint(row["mode"]),
+		})
+	}
+	return columns, nil
+}
+
+// MarkSensitive marks the column as sensitive or changes its masking mode.
+func MarkSensitive(database Executor, column SensitiveColumn) error {
+	switch column.Mode {
+	case MaskRedact, MaskPartial:
+	case MaskHash:
+		if utils.Config.Policies.MaskingKey.Value() == "" {
+			return utils.NewError(utils.ErrorCodeInvalidInput, "hash masking requires POLICIES_MASKING_KEY", nil)
+		}
+	default:
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("unknown masking mode %s, expected %s, %s or %s", column.Mode, MaskRedact, MaskPartial, MaskHash), nil)
+	}
+	if isInternal(column.Table) || strings.HasPrefix(column.Table, "sqlite_") {
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("table %s can't hold sensitive columns", column.Table), nil)
+	}
+
+	columns, err := tableColumns(database, column.Table)
+	if err != nil {
+		return err
+	}
+	if !contains(columns, column.Column) {
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("table %s has no column %s", column.Table, column.Column), nil)
+	}
+
+	_, _, err = database.ExecuteTransaction(
+		[]string{
+			"CREATE TABLE IF NOT EXISTS " + SensitiveTable + " (table_name TEXT NOT NULL COLLATE NOCASE, column_name TEXT NOT NULL COLLATE NOCASE, mode TEXT NOT NULL, PRIMARY KEY (table_name, column_name))",
+			"INSERT INTO " + SensitiveTable + " (table_name, column_name, mode) VALUES (?, ?, ?) ON CONFLICT (table_name, column_name) DO UPDATE SET mode = excluded.mode",
+		},
+		[][]any{nil, {column.Table, column.Column, column.Mode}},
+	)
+	return err
+}
+
+// UnmarkSensitive returns the column to being read as is by every principal.
+func UnmarkSensitive(database Executor, table string, column string) error {
+	exists, err := tableExists(database, SensitiveTable)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("column %s of table %s is not sensitive", column, table), nil)
+	}
+
+	results, _, err := database.ExecuteTransaction(
+		[]string{"DELETE FROM " + SensitiveTable + " WHERE table_name = ? AND column_name = ?"},
+		[][]any{{table, column}},
+	)
+	if err != nil {
+		return err
+	}
+	if results[0]["RowsAffected"].(int64) == 0 {
+		return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("column %s of table %s is not sensitive", column, table), nil)
+	}
+	return nil
+}
+
+// Masks analyzes the query before it is run and returns the mask of every result column, nil for the columns read as
+// is. Sensitive columns may only be selected as they are: a query using them in an expression, a filter, a join or an
+// ordering would reveal them and is refused.
+func (session *Session) Masks(ctx context.Context, conn *sql.Conn, query string) ([]utils.ValueMask, error) {
+	if session == nil || len(session.sensitive) == 0 {
+		return nil, nil
+	}
+
+	var masks []utils.ValueMask
+	err := conn.Raw(func(driverConn any) error {
+		raw := driverConn.(driver.Conn).Raw()
+
+		// NOTE: the authorizer counts the reads of the sensitive columns while the statement is compiled
+		session.reads = map[string]int{}
+		statement, _, err := raw.Prepare(query)
+		reads := session.reads
+		session.reads = nil
+		if err != nil {
+			return err
+		}
+		defer statement.Close()
+
+		masks = make([]utils.ValueMask, statement.ColumnCount())
+		for index := range masks {
+			key := columnKey(statement.ColumnTableName(index), statement.ColumnOriginName(index))
+			if mode, sensitive := session.sensitive[key]; sensitive {
+				masks[index] = maskOf(mode)
+				reads[key]--
+			}
+		}
+		for key, count := range reads {
+			if count > 0 {
+				return utils.NewError(utils.ErrorCodeForbidden, fmt.Sprintf("sensitive column %s can only be selected as is", key), nil)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	session.allowSensitive = true
+	return masks, nil
+}
+
+// authorizeSensitiveRead counts the read while a query is analyzed, the reads of queries that weren't analyzed, e.g.
+// writes copying the column elsewhere, are refused.
+func (session *Session) authorizeSensitiveRead(key string) sqlite3.AuthorizerReturnCode {
+	switch {
+	case session.reads != nil:
+		session.reads[key]++
+		return sqlite3.AUTH_OK
+	case session.allowSensitive:
+		return sqlite3.AUTH_OK
+	default:
+		return sqlite3.AUTH_DENY
+	}
+}
+
+func maskOf(mode string) utils.ValueMask {
+	return func(value any) any {
+		if value == nil {
+			return nil
+		}
+
+		text := fmt.Sprint(value)
+		if bytes, isBlob := value.([]byte); isBlob {
+			text = string(bytes)
+		}
+
+		switch mode {
+		case MaskHash:
+			mac := hmac.New(sha256.New, []byte(utils.Config.Policies.MaskingKey.Value()))
+			mac.Write([]byte(text))
+			return hex.EncodeToString(mac.Sum(nil))
+		case MaskPartial:
+			// NOTE: short values are fully redacted, their last characters would give most of them away
+			if characters := []rune(text); len(characters) > 8 {
+				return redacted + string(characters[len(characters)-4:])
+			}
+			return redacted
+		default:
+			return redacted
+		}
+	}
+}
+
+func sensitiveModes(ctx context.Context, conn *sql.Conn) (map[string]string, error) {
+	modes := map[string]string{}
+
+	exists, err := connectionTableExists(ctx, conn, SensitiveTable)
+	if err != nil || !exists {
+		return modes, err
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT table_name, column_name, mode FROM "+SensitiveTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table, column, mode string
+		if err := rows.Scan(&table, &column, &mode); err != nil {
+			return nil, err
+		}
+		modes[columnKey(table, column)] = mode
+	}
+	return modes, rows.Err()
+}
+
+func isUnmasked(principal string) bool {
+	for _, unmasked := range utils.Config.Policies.UnmaskedPrincipals {
+		if unmasked == principal {
+			return true
+		}
+	}
+	return false
+}
+
+// NOTE: covers every table persisto stores in the databases, e.g. their metadata besides the policies
+func isInternal(table string) bool {
+	return strings.HasPrefix(strings.ToLower(table), "_persisto_")
+}
+
+func columnKey(table string, column string) string {
+	return strings.ToLower(table) + "." + strings.ToLower(column)
+}
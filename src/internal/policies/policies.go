@@ -0,0 +1,514 @@
+package policies
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"persisto/src/internal/connections"
+	"persisto/src/internal/statements"
+	"persisto/src/utils"
+
+	"github.com/ncruces/go-sqlite3"
+)
+
+// NOTE: policies are stored in the database they apply to, they follow it across stages, backups and replicas
+const Table = "_persisto_policies"
+
+// Policy restricts a principal to the rows of a table matching the filter, the masked columns are read as NULL.
+type Policy struct {
+	Principal     string   `json:"principal"`
+	Table         string   `json:"table"`
+	Filter        string   `json:"filter,omitempty"`
+	MaskedColumns []string `json:"masked_columns,omitempty"`
+}
+
+// Executor runs the statements managing the policies of a database.
+type Executor interface {
+	Query(query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, error)
+	ExecuteTransaction(queries []string, parameters [][]any) ([]utils.ExecResultType, int, error)
+}
+
+// Principals returns the names of the configured principals.
+func Principals() []string {
+	principals := make([]string, 0, len(utils.Config.Policies.Principals))
+	for _, entry := range utils.Config.Policies.Principals {
+		name, _, _ := strings.Cut(strings.TrimSpace(entry.Value()), ":")
+		principals = append(principals, name)
+	}
+	sort.Strings(principals)
+	return principals
+}
+
+// Authenticate returns the principal the token belongs to. Requests without token are unrestricted, unless a principal
+// is required, and an empty principal is returned for them.
+func Authenticate(token string) (string, error) {
+	if !utils.Config.Policies.Enabled {
+		return "", nil
+	}
+
+	if token == "" {
+		if utils.Config.Policies.RequirePrincipal {
+			return "", utils.NewError(utils.ErrorCodeUnauthorized, "a principal token is required", nil)
+		}
+		return "", nil
+	}
+
+	principal := ""
+	for _, entry := range utils.Config.Policies.Principals {
+		name, secret, _ := strings.Cut(strings.TrimSpace(entry.Value()), ":")
+		// NOTE: every entry is compared so that the duration doesn't tell which principal matched
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+			principal = name
+		}
+	}
+	if principal == "" {
+		return "", utils.NewError(utils.ErrorCodeUnauthorized, "invalid principal token", nil)
+	}
+	return principal, nil
+}
+
+// AuthorizeCopy returns the principal the token belongs to when it may be handed a copy of the whole database, e.g. a
+// presigned URL to its object. The policies can't restrict the file itself, the copy is refused when a principal is
+// required and to the principals restricted by a policy of the database, to its templates or, unless unmasked, by its
+// sensitive columns. Like on the queries, requests without a token are not restricted.
+func AuthorizeCopy(database Executor, token string) (string, error) {
+	principal, err := Authenticate(token)
+	if err != nil || !utils.Config.Policies.Enabled {
+		return principal, err
+	}
+
+	if utils.Config.Policies.RequirePrincipal {
+		return "", utils.NewError(utils.ErrorCodeForbidden, "the policies can't restrict a copy of the whole database while a principal is required", nil)
+	}
+	if isTemplateOnly(principal) {
+		return "", utils.NewError(utils.ErrorCodeForbidden, fmt.Sprintf("principal %s may only run the templates of the database", principal), nil)
+	}
+
+	list, err := List(database)
+	if err != nil {
+		return "", fmt.Errorf("failed to load the policies: %w", err)
+	}
+	for _, policy := range list {
+		if principal != "" && policy.Principal == principal {
+			return "", utils.NewError(utils.ErrorCodeForbidden, fmt.Sprintf("principal %s is restricted by the policies of the database, it can't be handed a copy of it", principal), nil)
+		}
+	}
+
+	if principal != "" && !isUnmasked(principal) {
+		sensitive, err := ListSensitive(database)
+		if err != nil {
+			return "", fmt.Errorf("failed to load the sensitive columns: %w", err)
+		}
+		if len(sensitive) > 0 {
+			return "", utils.NewError(utils.ErrorCodeForbidden, "the database has sensitive columns, only the unmasked principals can be handed a copy of it", nil)
+		}
+	}
+	return principal, nil
+}
+
+// List returns the policies of the database.
+func List(database Executor) ([]Policy, error) {
+	exists, err := tableExists(database, Table)
+	if err != nil || !exists {
+		return []Policy{}, err
+	}
+
+	rows, _, err := database.Query("SELECT principal, table_name, filter, masked_columns FROM " + Table + " ORDER BY principal, table_name")
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make([]Policy, 0, len(rows))
+	for _, row := range rows {
+		policy := Policy{Principal: fmt.Sprint(row["principal"]), Table: fmt.Sprint(row["table_name"])}
+		if filter, isString := row["filter"].(string); isString {
+			policy.Filter = filter
+		}
+		if masked, isString := row["masked_columns"].(string); isString {
+			if err := json.Unmarshal([]byte(masked), &policy.MaskedColumns); err != nil {
+				return nil, fmt.Errorf("unreadable masked columns for principal %s on table %s: %w", policy.Principal, policy.Table, err)
+			}
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// Set creates or replaces the policy of the principal on the table, the filter is checked against the table before
+// being stored.
+func Set(database Executor, policy Policy) error {
+	if !isPrincipal(policy.Principal) {
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("unknown principal %s", policy.Principal), nil)
+	}
+	if isInternal(policy.Table) || strings.HasPrefix(policy.Table, "sqlite_") {
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("table %s can't be restricted", policy.Table), nil)
+	}
+
+	columns, err := tableColumns(database, policy.Table)
+	if err != nil {
+		return err
+	}
+	for _, masked := range policy.MaskedColumns {
+		if !contains(columns, masked) {
+			return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("table %s has no column %s", policy.Table, masked), nil)
+		}
+	}
+
+	// NOTE: the views restricting the principal read the table from the main database, a tiered table would break them
+	inMain, err := tableExists(database, policy.Table)
+	if err != nil {
+		return err
+	}
+	if !inMain {
+		return utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("table %s is tiered, move it back into the database before restricting it", policy.Table), nil)
+	}
+
+	masked, err := json.Marshal(policy.MaskedColumns)
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		"CREATE TABLE IF NOT EXISTS " + Table + " (principal TEXT NOT NULL, table_name TEXT NOT NULL, filter TEXT, masked_columns TEXT, PRIMARY KEY (principal, table_name))",
+		// NOTE: compiling the filter against the table rejects the invalid ones before they lock the principal out
+		"SELECT 1 FROM " + utils.QuoteIdentifier(policy.Table) + " WHERE " + filterOf(policy) + " LIMIT 0",
+		"INSERT INTO " + Table + " (principal, table_name, filter, masked_columns) VALUES (?, ?, ?, ?) ON CONFLICT (principal, table_name) DO UPDATE SET filter = excluded.filter, masked_columns = excluded.masked_columns",
+	}
+	parameters := [][]any{nil, nil, {policy.Principal, policy.Table, nullable(policy.Filter), string(masked)}}
+
+	if _, failedIndex, err := database.ExecuteTransaction(queries, parameters); err != nil {
+		if failedIndex == 1 {
+			return utils.NewError(utils.ErrorCodeInvalidInput, "invalid filter", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Restricts reports whether a policy of the database, read from the connection, restricts the table to some principal.
+func Restricts(ctx context.Context, conn *sql.Conn, table string) (bool, error) {
+	exists, err := connectionTableExists(ctx, conn, Table)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	var count int
+	err = conn.QueryRowContext(ctx, "SELECT count(*) FROM main."+Table+" WHERE table_name = ? COLLATE NOCASE", table).Scan(&count)
+	return count > 0, err
+}
+
+// Remove deletes the policy of the principal on the table, giving the principal full access to it again.
+func Remove(database Executor, principal string, table string) error {
+	exists, err := tableExists(database, Table)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("no policy for principal %s on table %s", principal, table), nil)
+	}
+
+	results, _, err := database.ExecuteTransaction(
+		[]string{"DELETE FROM " + Table + " WHERE principal = ? AND table_name = ?"},
+		[][]any{{principal, table}},
+	)
+	if err != nil {
+		return err
+	}
+	if results[0]["RowsAffected"].(int64) == 0 {
+		return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("no policy for principal %s on table %s", principal, table), nil)
+	}
+	return nil
+}
+
+// Session holds the restrictions applied to the connection of a principal.
+type Session struct {
+	restricted map[string]bool
+	// NOTE: masking mode of the sensitive columns by table and column, empty when the principal reads them unmasked
+	sensitive map[string]string
+	// NOTE: reads of the sensitive columns counted while a query is analyzed, nil otherwise
+	reads map[string]int
+	// NOTE: set once the query was analyzed and its sensitive columns masked
+	allowSensitive bool
+}
+
+// NOTE: key of the session of a connection, see SessionOf
+type sessionKey struct{}
+
+// NOTE: key marking the contexts of the statements of a template, see WithinTemplate
+type templateKey struct{}
+
+func init() {
+	// NOTE: runs after the statement policy, whose authorizer denies the statements it refuses first
+	connections.Register(connections.Hook{Name: "policies", Order: connections.OrderRestrictions + 10, Open: open})
+}
+
+// WithinTemplate marks the statements run with the context as those of a template, the only ones the principals of
+// POLICIES_TEMPLATE_PRINCIPALS may run.
+func WithinTemplate(ctx context.Context) context.Context {
+	return context.WithValue(ctx, templateKey{}, true)
+}
+
+// open restricts the connection to what its principal is allowed to see, see apply.
+func open(ctx context.Context, connection *connections.Connection) error {
+	// NOTE: refused before anything is set up, whatever the endpoint, the PostgreSQL sessions included
+	if isTemplateOnly(connection.Principal) && ctx.Value(templateKey{}) == nil {
+		return utils.NewError(utils.ErrorCodeForbidden, fmt.Sprintf("principal %s may only run the templates of the database", connection.Principal), nil)
+	}
+
+	session, err := apply(ctx, connection.Conn, connection.Principal)
+	if err != nil {
+		return err
+	}
+	connection.Authorize(session.Authorizer())
+	connection.SetValue(sessionKey{}, session)
+	return nil
+}
+
+// SessionOf returns the session of the principal of the connection, nil for requests without principal.
+func SessionOf(connection *connections.Connection) *Session {
+	session, _ := connection.Value(sessionKey{}).(*Session)
+	return session
+}
+
+// apply restricts the connection to what the principal is allowed to see, nothing is done and a nil session is returned
+// for requests without principal. Every restricted table is shadowed by a temporary view filtering and masking it, and
+// the authorizer of the session keeps the principal from reaching the table other than through its view, from writing
+// it and from reading the policies.
+func apply(ctx context.Context, conn *sql.Conn, principal string) (*Session, error) {
+	if !utils.Config.Policies.Enabled || principal == "" {
+		return nil, nil
+	}
+
+	policies, err := principalPolicies(ctx, conn, principal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the policies of principal %s: %w", principal, err)
+	}
+
+	session := &Session{restricted: map[string]bool{}, sensitive: map[string]string{}}
+	if !isUnmasked(principal) {
+		if session.sensitive, err = sensitiveModes(ctx, conn); err != nil {
+			return nil, fmt.Errorf("failed to load the sensitive columns: %w", err)
+		}
+	}
+
+	// NOTE: the temporary views must not be written through the stage VFS
+	if _, err := conn.ExecContext(ctx, "PRAGMA temp_store = MEMORY"); err != nil {
+		return nil, err
+	}
+
+	for _, policy := range policies {
+		view, err := viewStatement(ctx, conn, policy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply the policy of principal %s on table %s: %w", principal, policy.Table, err)
+		}
+		if _, err := conn.ExecContext(ctx, view); err != nil {
+			return nil, fmt.Errorf("failed to apply the policy of principal %s on table %s: %w", principal, policy.Table, err)
+		}
+		session.restricted[strings.ToLower(policy.Table)] = true
+	}
+	return session, nil
+}
+
+// NOTE: pragmas taking a table or index name as argument, they only describe the schema
+var schemaPragmas = map[string]bool{
+	"table_info": true, "table_xinfo": true, "index_list": true, "index_info": true, "index_xinfo": true, "foreign_key_list": true,
+}
+
+// Authorizer returns the authorizer restricting the connection of the principal, nil without session, so that it can
+// be chained behind another one.
+func (session *Session) Authorizer() func(action sqlite3.AuthorizerActionCode, name3rd, name4th, schema, inner string) sqlite3.AuthorizerReturnCode {
+	if session == nil {
+		return nil
+	}
+	return session.authorize
+}
+
+// CheckStreaming refuses to stream the values of the column of the table when the session restricts them, they can then
+// only be reached through the statements of the session, incremental blob I/O bypasses its views and masks.
+func (session *Session) CheckStreaming(table string, column string) error {
+	if session == nil {
+		return nil
+	}
+	_, sensitive := session.sensitive[columnKey(table, column)]
+	if isInternal(table) || session.restricted[strings.ToLower(table)] || sensitive {
+		return utils.NewError(utils.ErrorCodeForbidden, fmt.Sprintf("column %s of table %s is restricted by a policy, it can only be reached through statements", column, table), nil)
+	}
+	return nil
+}
+
+func (session *Session) authorize(action sqlite3.AuthorizerActionCode, name3rd, name4th, schema, inner string) sqlite3.AuthorizerReturnCode {
+	restricted := func(name string) bool {
+		return isInternal(name) || session.restricted[strings.ToLower(name)]
+	}
+	if statements.RecordsChange(action, name3rd, inner) {
+		return sqlite3.AUTH_OK
+	}
+
+	switch action {
+	case sqlite3.AUTH_READ:
+		if isInternal(name3rd) {
+			return sqlite3.AUTH_DENY
+		}
+		// NOTE: the view shadowing a restricted table has its name, reads from anywhere else bypass the policy
+		if session.restricted[strings.ToLower(name3rd)] && schema != "temp" && !strings.EqualFold(inner, name3rd) {
+			return sqlite3.AUTH_DENY
+		}
+		// NOTE: the views shadowing restricted tables read every column of their table, the columns used by the statement
+		// are read again from the view
+		if _, sensitive := session.sensitive[columnKey(name3rd, name4th)]; sensitive && !session.restricted[strings.ToLower(inner)] {
+			return session.authorizeSensitiveRead(columnKey(name3rd, name4th))
+		}
+	case sqlite3.AUTH_INSERT, sqlite3.AUTH_UPDATE, sqlite3.AUTH_DELETE, sqlite3.AUTH_DROP_TABLE, sqlite3.AUTH_ANALYZE:
+		if restricted(name3rd) {
+			return sqlite3.AUTH_DENY
+		}
+	case sqlite3.AUTH_ALTER_TABLE, sqlite3.AUTH_CREATE_INDEX:
+		if restricted(name4th) {
+			return sqlite3.AUTH_DENY
+		}
+	case sqlite3.AUTH_CREATE_TRIGGER, sqlite3.AUTH_CREATE_TEMP_TRIGGER:
+		// NOTE: a trigger named after a restricted table would pass for its view, one named like the triggers of the hooks
+		// would write their changes
+		if restricted(name3rd) || restricted(name4th) {
+			return sqlite3.AUTH_DENY
+		}
+	case sqlite3.AUTH_DROP_TEMP_VIEW, sqlite3.AUTH_ATTACH, sqlite3.AUTH_DETACH:
+		return sqlite3.AUTH_DENY
+	case sqlite3.AUTH_PRAGMA:
+		// NOTE: pragmas changing a setting could lift the restrictions, e.g. writable_schema
+		if name4th != "" && !schemaPragmas[strings.ToLower(name3rd)] {
+			return sqlite3.AUTH_DENY
+		}
+	}
+	return sqlite3.AUTH_OK
+}
+
+func principalPolicies(ctx context.Context, conn *sql.Conn, principal string) ([]Policy, error) {
+	exists, err := connectionTableExists(ctx, conn, Table)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT table_name, filter, masked_columns FROM "+Table+" WHERE principal = ?", principal)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var policies []Policy
+	for rows.Next() {
+		policy := Policy{Principal: principal}
+		var filter, masked sql.NullString
+		if err := rows.Scan(&policy.Table, &filter, &masked); err != nil {
+			return nil, err
+		}
+		policy.Filter = filter.String
+		if masked.Valid {
+			if err := json.Unmarshal([]byte(masked.String), &policy.MaskedColumns); err != nil {
+				return nil, err
+			}
+		}
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+func viewStatement(ctx context.Context, conn *sql.Conn, policy Policy) (string, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", policy.Table)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return "", err
+		}
+		if contains(policy.MaskedColumns, column) {
+			columns = append(columns, "NULL AS "+utils.QuoteIdentifier(column))
+		} else {
+			columns = append(columns, utils.QuoteIdentifier(column))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	// NOTE: a restricted table that no longer exists is hidden rather than left open
+	if len(columns) == 0 {
+		return "CREATE TEMP VIEW " + utils.QuoteIdentifier(policy.Table) + " AS SELECT NULL WHERE 0", nil
+	}
+
+	quoted := utils.QuoteIdentifier(policy.Table)
+	return "CREATE TEMP VIEW " + quoted + " AS SELECT " + strings.Join(columns, ", ") + " FROM main." + quoted + " WHERE " + filterOf(policy), nil
+}
+
+func filterOf(policy Policy) string {
+	if strings.TrimSpace(policy.Filter) == "" {
+		return "1"
+	}
+	return "(" + policy.Filter + ")"
+}
+
+func connectionTableExists(ctx context.Context, conn *sql.Conn, table string) (bool, error) {
+	var exists int
+	err := conn.QueryRowContext(ctx, "SELECT count(*) FROM main.sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&exists)
+	return exists > 0, err
+}
+
+func tableExists(database Executor, table string) (bool, error) {
+	rows, _, err := database.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", table)
+	return len(rows) > 0, err
+}
+
+func tableColumns(database Executor, table string) ([]string, error) {
+	rows, _, err := database.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("table %s not found", table), nil)
+	}
+
+	columns := make([]string, 0, len(rows))
+	for _, row := range rows {
+		columns = append(columns, fmt.Sprint(row["name"]))
+	}
+	return columns, nil
+}
+
+func isPrincipal(name string) bool {
+	for _, principal := range Principals() {
+		if principal == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isTemplateOnly(principal string) bool {
+	return principal != "" && utils.Config.Policies.Enabled && slices.Contains(utils.Config.Policies.TemplatePrincipals, principal)
+}
+
+func contains(names []string, name string) bool {
+	for _, candidate := range names {
+		if strings.EqualFold(candidate, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func nullable(value string) any {
+	if value == "" {
+		return nil
+	}
+	return value
+}
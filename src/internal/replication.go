@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+
+	"persisto/src/internal/databases"
+	"persisto/src/internal/replication"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+var (
+	replicationSetupOnce sync.Once
+)
+
+func SetupReplication() {
+	replicationSetupOnce.Do(func() {
+		onChange := func(key string, removed bool) {
+			if databases.Dbs == nil {
+				return
+			}
+
+			databases.Dbs.HandleRemoteObjectChange(key, removed)
+		}
+
+		if err := replication.SetupFollower(onChange); err != nil {
+			utils.Logger.Fatal("Failed to setup replication follower.", zap.Error(err))
+		}
+
+		err := replication.SetupStandby(onChange, func(name string, path string) error {
+			if databases.Dbs == nil {
+				return fmt.Errorf("databases catalog not ready")
+			}
+
+			database, err := databases.Dbs.FindByName(name)
+			if err != nil {
+				return err
+			}
+
+			return stages.AdoptLocalCopy(database, path)
+		})
+		if err != nil {
+			utils.Logger.Fatal("Failed to setup replication standby.", zap.Error(err))
+		}
+
+		replication.SetupActive()
+		replication.SetupCatalog(catalogEntries)
+	})
+}
+
+// catalogEntries returns the state of every database of the catalog, as published to the followers and standbys.
+func catalogEntries() []replication.ReplicatedDatabase {
+	if databases.Dbs == nil {
+		return nil
+	}
+
+	all := databases.Dbs.All()
+	entries := make([]replication.ReplicatedDatabase, 0, len(all))
+	for _, database := range all {
+		entry := replication.ReplicatedDatabase{
+			Name:              database.GetName(),
+			Stage:             database.GetStage(),
+			Placement:         database.GetPlacement(),
+			Degraded:          database.IsDegraded(),
+			WriteSequence:     database.GetWriteSequence(),
+			PersistedSequence: database.GetCopySequence(utils.GetRemoteStage()),
+			SyncLagMs:         database.SyncLag().Milliseconds(),
+		}
+		if movedAt := database.GetMovedAt(); !movedAt.IsZero() {
+			movedAt = movedAt.UTC()
+			entry.MovedAt = &movedAt
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,533 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"persisto/src/internal/coordination"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: protocol keeping the followers and standbys in step with the catalog of the primary. The primary publishes its
+// catalog and the sync state of its databases as a manifest object in the bucket, every REPLICATION_CATALOG_INTERVAL_SECONDS
+// when it changed, and streams every change as it happens on GET /replication/catalog/events. The secondaries read the
+// manifest object at every poll and, with REPLICATION_PRIMARY_URL, follow the stream in between. Every manifest and
+// change carries a sequence which only grows, even across restarts of the primary, a secondary ignores whatever is older
+// than what it holds so that neither source takes it backwards.
+const CatalogProtocolVersion = 1
+
+// NOTE: events of the catalog stream, a subscriber first receives the whole manifest then the changes made to it
+const (
+	CatalogEventManifest = "manifest"
+	CatalogEventUpsert   = "upsert"
+	CatalogEventRemove   = "remove"
+)
+
+// NOTE: sources of the catalog held by an instance
+const (
+	CatalogSourcePublished = "published"
+	CatalogSourceManifest  = "manifest"
+	CatalogSourceFeed      = "feed"
+)
+
+const (
+	// NOTE: interval between two comparisons of the catalog of the primary with the one it published
+	catalogCheckInterval = time.Second
+	// NOTE: the manifest object is written again that long after the previous one even when nothing changed, so that
+	// its publication time tells the secondaries the primary is alive and its sync lags are fresh
+	catalogHeartbeat = time.Minute
+	// NOTE: interval between two keep-alive comments of the stream, a secondary reconnects after three missed ones
+	CatalogKeepAlive   = 15 * time.Second
+	catalogFeedTimeout = 3 * CatalogKeepAlive
+	// NOTE: changes buffered for a subscriber, one falling further behind is disconnected and starts over from the
+	// manifest rather than missing changes
+	catalogSubscriberBuffer = 256
+	// NOTE: longest line of the stream, a manifest is sent on a single line
+	catalogFeedMaxLine = 64 << 20
+)
+
+// ReplicatedDatabase is the state of a database in the catalog of the primary. The sequences count the writes made by the
+// primary since it started, the database holds writes the remote stage doesn't while the persisted one is behind.
+type ReplicatedDatabase struct {
+	Name              string     `json:"name"`
+	Stage             uint       `json:"stage"`
+	Placement         string     `json:"placement"`
+	MovedAt           *time.Time `json:"moved_at,omitempty"`
+	Degraded          bool       `json:"degraded,omitempty"`
+	WriteSequence     uint64     `json:"write_sequence"`
+	PersistedSequence uint64     `json:"persisted_sequence"`
+	SyncLagMs         int64      `json:"sync_lag_ms"`
+}
+
+// CatalogManifest is the catalog of the primary as published to the secondaries, its databases sorted by name.
+type CatalogManifest struct {
+	Version     int                  `json:"version"`
+	Instance    string               `json:"instance,omitempty"`
+	Sequence    uint64               `json:"sequence"`
+	PublishedAt time.Time            `json:"published_at"`
+	Databases   []ReplicatedDatabase `json:"databases"`
+}
+
+// CatalogEvent is an event of the catalog stream, holding the manifest, the entry upserted or the name of the database
+// removed depending on its type.
+type CatalogEvent struct {
+	Type     string              `json:"type"`
+	Sequence uint64              `json:"sequence"`
+	Manifest *CatalogManifest    `json:"manifest,omitempty"`
+	Entry    *ReplicatedDatabase `json:"entry,omitempty"`
+	Database string              `json:"database,omitempty"`
+}
+
+// CatalogStatus describes the catalog held by the instance, published by a primary or mirrored by a secondary.
+type CatalogStatus struct {
+	Source      string    `json:"source,omitempty"`
+	Sequence    uint64    `json:"sequence"`
+	PublishedAt time.Time `json:"published_at"`
+	// NOTE: last time a secondary received a manifest or a change newer than the one it held
+	ReceivedAt    time.Time `json:"received_at"`
+	Databases     int       `json:"databases"`
+	FeedConnected bool      `json:"feed_connected,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+var (
+	catalog       = CatalogManifest{Version: CatalogProtocolVersion, Databases: []ReplicatedDatabase{}}
+	catalogSource string
+	receivedAt    time.Time
+	catalogError  string
+	// NOTE: the published catalog changed since the manifest object was last written
+	catalogDirty bool
+	catalogMutex sync.Mutex
+
+	catalogSubscribers = map[chan CatalogEvent]bool{}
+	subscribersMutex   sync.Mutex
+
+	feedConnected atomic.Bool
+	feedClient    = &http.Client{}
+
+	// NOTE: wakes the refresh of the replicas up when the mirrored catalog tells a remote object changed
+	refreshWake = make(chan struct{}, 1)
+)
+
+// SetupCatalog publishes the catalog returned by snapshot while the instance is a primary, and mirrors the catalog of
+// the primary while it is a follower or a standby.
+func SetupCatalog(snapshot func() []ReplicatedDatabase) {
+	go func() {
+		interval := time.Duration(utils.Config.Replication.CatalogIntervalSeconds) * time.Second
+		var writtenAt time.Time
+
+		ticker := time.NewTicker(catalogCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			// NOTE: a standby starts publishing once promoted
+			if !IsPrimary() {
+				continue
+			}
+			publishCatalog(snapshot())
+
+			catalogMutex.Lock()
+			due := catalogDirty && time.Since(writtenAt) >= interval || time.Since(writtenAt) >= catalogHeartbeat
+			catalogMutex.Unlock()
+			// NOTE: among several primaries sharing the bucket, the active one publishes the manifest object
+			if !due || utils.Config.Coordination.Enabled && !coordination.Holds(coordination.ActiveLease) {
+				continue
+			}
+			if err := writeCatalog(); err != nil {
+				utils.StagesLogger.Warn("Failed to write the catalog manifest.", zap.String("key", utils.Config.Replication.CatalogKey), zap.Error(err))
+				continue
+			}
+			writtenAt = time.Now()
+		}
+	}()
+
+	if IsPrimary() {
+		return
+	}
+
+	go func() {
+		interval := time.Duration(utils.Config.Replication.PollIntervalSeconds) * time.Second
+		for !IsPrimary() {
+			if err := readCatalog(); err != nil {
+				utils.StagesLogger.Warn("Failed to read the catalog manifest.", zap.String("key", utils.Config.Replication.CatalogKey), zap.Error(err))
+				setCatalogError(err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+
+	if utils.Config.Replication.PrimaryURL != "" {
+		go followCatalogFeed(utils.Config.Replication.PrimaryURL)
+	}
+}
+
+// Catalog returns the catalog held by the instance, published by a primary or mirrored by a secondary.
+func Catalog() CatalogManifest {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	return copyManifest(catalog)
+}
+
+// GetCatalogStatus returns the status of the catalog held by the instance.
+func GetCatalogStatus() CatalogStatus {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	return CatalogStatus{
+		Source:        catalogSource,
+		Sequence:      catalog.Sequence,
+		PublishedAt:   catalog.PublishedAt,
+		ReceivedAt:    receivedAt,
+		Databases:     len(catalog.Databases),
+		FeedConnected: feedConnected.Load(),
+		LastError:     catalogError,
+	}
+}
+
+// SubscribeCatalog returns the catalog published by the primary and its changes from now on, and the function ending
+// the subscription. The channel is closed when the subscriber falls too far behind, it must then subscribe again.
+func SubscribeCatalog() (CatalogManifest, <-chan CatalogEvent, func(), error) {
+	if !IsPrimary() {
+		return CatalogManifest{}, nil, nil, utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("instance is a %s, only a primary publishes its catalog", Role()), nil)
+	}
+
+	events := make(chan CatalogEvent, catalogSubscriberBuffer)
+
+	// NOTE: subscribed under the catalog mutex, no change is published between the manifest and the subscription
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	subscribersMutex.Lock()
+	catalogSubscribers[events] = true
+	subscribersMutex.Unlock()
+
+	return copyManifest(catalog), events, func() {
+		subscribersMutex.Lock()
+		defer subscribersMutex.Unlock()
+		if catalogSubscribers[events] {
+			delete(catalogSubscribers, events)
+			close(events)
+		}
+	}, nil
+}
+
+// UnsyncedDatabases returns the databases of the catalog holding writes their remote copy doesn't, as last known.
+func UnsyncedDatabases() []string {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+
+	unsynced := []string{}
+	for _, entry := range catalog.Databases {
+		if entry.WriteSequence > entry.PersistedSequence {
+			unsynced = append(unsynced, entry.Name)
+		}
+	}
+	return unsynced
+}
+
+// publishCatalog compares the catalog of the primary with the published one, and publishes the changes under a new
+// sequence. The sync lags are refreshed without being published as changes, they change all the time.
+func publishCatalog(entries []ReplicatedDatabase) {
+	slices.SortFunc(entries, func(a, b ReplicatedDatabase) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+
+	previous := make(map[string]ReplicatedDatabase, len(catalog.Databases))
+	for _, entry := range catalog.Databases {
+		previous[entry.Name] = entry
+	}
+
+	var changes []CatalogEvent
+	for _, entry := range entries {
+		if current, exists := previous[entry.Name]; !exists || entryChanged(current, entry) {
+			changes = append(changes, CatalogEvent{Type: CatalogEventUpsert, Entry: &entry})
+		}
+		delete(previous, entry.Name)
+	}
+	for name := range previous {
+		changes = append(changes, CatalogEvent{Type: CatalogEventRemove, Database: name})
+	}
+
+	catalog.Databases = entries
+	catalog.Instance = coordination.InstanceID()
+	catalogSource = CatalogSourcePublished
+	if len(changes) == 0 && catalog.Sequence > 0 {
+		return
+	}
+
+	catalog.Sequence = max(catalog.Sequence+1, uint64(time.Now().UnixNano()))
+	catalog.PublishedAt = time.Now().UTC()
+	catalogDirty = true
+
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+	for events := range catalogSubscribers {
+		for _, change := range changes {
+			change.Sequence = catalog.Sequence
+			select {
+			case events <- change:
+				continue
+			default:
+			}
+			delete(catalogSubscribers, events)
+			close(events)
+			break
+		}
+	}
+}
+
+func entryChanged(current ReplicatedDatabase, entry ReplicatedDatabase) bool {
+	current.SyncLagMs, entry.SyncLagMs = 0, 0
+	if (current.MovedAt == nil) != (entry.MovedAt == nil) || current.MovedAt != nil && !current.MovedAt.Equal(*entry.MovedAt) {
+		return true
+	}
+	current.MovedAt, entry.MovedAt = nil, nil
+	return current != entry
+}
+
+func writeCatalog() error {
+	catalogMutex.Lock()
+	catalog.PublishedAt = time.Now().UTC()
+	body, err := json.Marshal(catalog)
+	catalogDirty = false
+	catalogMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := remotevfs.PutObject(ctx, utils.Config.Replication.CatalogKey, body, "application/json"); err != nil {
+		catalogMutex.Lock()
+		catalogDirty = true
+		catalogMutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// readCatalog mirrors the manifest object written by the primary, none being written yet isn't an error.
+func readCatalog() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	body, _, err := remotevfs.GetObjectWithGeneration(ctx, utils.Config.Replication.CatalogKey)
+	if errors.Is(err, remotevfs.ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var manifest CatalogManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return fmt.Errorf("unreadable catalog manifest: %w", err)
+	}
+	return mirrorManifest(manifest, CatalogSourceManifest)
+}
+
+// mirrorManifest replaces the mirrored catalog by the manifest when it is newer.
+func mirrorManifest(manifest CatalogManifest, source string) error {
+	if manifest.Version != CatalogProtocolVersion {
+		return fmt.Errorf("catalog manifest of version %d, this instance reads version %d", manifest.Version, CatalogProtocolVersion)
+	}
+
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	// NOTE: a manifest of the same sequence is the same catalog written again, with fresher sync lags
+	if manifest.Sequence < catalog.Sequence || IsPrimary() {
+		return nil
+	}
+
+	if manifest.Databases == nil {
+		manifest.Databases = []ReplicatedDatabase{}
+	}
+	if remoteObjectsChanged(catalog.Databases, manifest.Databases) {
+		wakeRefresh()
+	}
+	catalog = manifest
+	catalogReceived(source)
+	return nil
+}
+
+// mirrorChange applies a change of the stream to the mirrored catalog when it is newer.
+func mirrorChange(event CatalogEvent) {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	if event.Sequence < catalog.Sequence || IsPrimary() {
+		return
+	}
+
+	name := event.Database
+	if event.Entry != nil {
+		name = event.Entry.Name
+	}
+	databases := slices.Clone(catalog.Databases)
+	index := slices.IndexFunc(databases, func(entry ReplicatedDatabase) bool {
+		return entry.Name == name
+	})
+	switch {
+	case event.Type == CatalogEventRemove && index >= 0:
+		databases = slices.Delete(databases, index, index+1)
+	case event.Type == CatalogEventUpsert && index >= 0:
+		databases[index] = *event.Entry
+	case event.Type == CatalogEventUpsert:
+		databases = append(databases, *event.Entry)
+		slices.SortFunc(databases, func(a, b ReplicatedDatabase) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+	}
+
+	if remoteObjectsChanged(catalog.Databases, databases) {
+		wakeRefresh()
+	}
+	catalog.Databases = databases
+	catalog.Sequence = event.Sequence
+	catalogReceived(CatalogSourceFeed)
+}
+
+func catalogReceived(source string) {
+	catalogSource = source
+	receivedAt = time.Now()
+	catalogError = ""
+}
+
+func setCatalogError(err error) {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	catalogError = err.Error()
+}
+
+// remoteObjectsChanged reports whether a database appeared, disappeared or had writes persisted to the remote stage.
+func remoteObjectsChanged(previous []ReplicatedDatabase, current []ReplicatedDatabase) bool {
+	if len(previous) != len(current) {
+		return true
+	}
+	for index := range current {
+		if previous[index].Name != current[index].Name || previous[index].PersistedSequence != current[index].PersistedSequence {
+			return true
+		}
+	}
+	return false
+}
+
+func wakeRefresh() {
+	select {
+	case refreshWake <- struct{}{}:
+	default:
+	}
+}
+
+// waitForRefresh waits for the next refresh of the replicas, the interval or until the mirrored catalog tells a remote
+// object changed.
+func waitForRefresh(interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-refreshWake:
+	}
+}
+
+// followCatalogFeed streams the catalog events of the primary until the instance is promoted, connecting again one
+// poll after the stream ended.
+func followCatalogFeed(primaryURL string) {
+	interval := time.Duration(utils.Config.Replication.PollIntervalSeconds) * time.Second
+	url := strings.TrimSuffix(primaryURL, "/") + "/replication/catalog/events"
+	utils.StagesLogger.Info("Following the catalog events of the primary.", zap.String("url", url))
+
+	for !IsPrimary() {
+		err := readCatalogFeed(url)
+		feedConnected.Store(false)
+		if err != nil && !IsPrimary() {
+			utils.StagesLogger.Warn("Catalog events of the primary interrupted.", zap.String("url", url), zap.Error(err))
+			setCatalogError(err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func readCatalogFeed(url string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// NOTE: a connection gone silent is dropped, a half-open one would otherwise never end
+	watchdog := time.AfterFunc(catalogFeedTimeout, cancel)
+	defer watchdog.Stop()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "text/event-stream")
+
+	response, err := feedClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("catalog events answered with status %d", response.StatusCode)
+	}
+	feedConnected.Store(true)
+
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), catalogFeedMaxLine)
+	var data strings.Builder
+	for scanner.Scan() {
+		watchdog.Reset(catalogFeedTimeout)
+		if IsPrimary() {
+			return nil
+		}
+
+		line := scanner.Text()
+		if value, found := strings.CutPrefix(line, "data:"); found {
+			data.WriteString(strings.TrimPrefix(value, " "))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+
+		var event CatalogEvent
+		if err := json.Unmarshal([]byte(data.String()), &event); err != nil {
+			return fmt.Errorf("unreadable catalog event: %w", err)
+		}
+		data.Reset()
+
+		switch event.Type {
+		case CatalogEventManifest:
+			if event.Manifest == nil {
+				return errors.New("catalog event without its manifest")
+			}
+			if err := mirrorManifest(*event.Manifest, CatalogSourceFeed); err != nil {
+				return err
+			}
+		case CatalogEventUpsert, CatalogEventRemove:
+			if event.Type == CatalogEventUpsert && event.Entry == nil {
+				return errors.New("catalog event without its entry")
+			}
+			mirrorChange(event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("catalog events ended by the primary")
+}
+
+func copyManifest(manifest CatalogManifest) CatalogManifest {
+	manifest.Databases = slices.Clone(manifest.Databases)
+	return manifest
+}
@@ -0,0 +1,471 @@
+package replication
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"persisto/src/internal/connections"
+	"persisto/src/internal/metering"
+	"persisto/src/internal/policies"
+	"persisto/src/internal/stages"
+	"persisto/src/internal/statements"
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+)
+
+const (
+	RolePrimary  = "primary"
+	RoleFollower = "follower"
+	RoleStandby  = "standby"
+)
+
+// ReplicaStatus describes a replica kept by a follower, its staleness is the time since it was last known to match the
+// remote object.
+type ReplicaStatus struct {
+	Database         string    `json:"database"`
+	Generation       string    `json:"generation"`
+	SyncedAt         time.Time `json:"synced_at"`
+	CheckedAt        time.Time `json:"checked_at"`
+	StalenessSeconds float64   `json:"staleness_seconds"`
+	Stale            bool      `json:"stale"`
+	LastError        string    `json:"last_error,omitempty"`
+}
+
+// replica is a local read-only copy of a remote database, its fields other than the key and path are guarded by replicasMutex.
+type replica struct {
+	database   string
+	key        string
+	path       string
+	generation string
+	syncedAt   time.Time
+	// NOTE: last time the replica was known to match the remote object
+	checkedAt time.Time
+	lastError string
+
+	// NOTE: held for reading by the queries, for writing while the replica file is swapped
+	fileMutex sync.RWMutex
+}
+
+var (
+	replicas = map[string]*replica{}
+	// NOTE: keys of the remote databases mirrored in the catalog, a standby only keeps replicas of some of them
+	mirrored      = map[string]string{}
+	replicasMutex sync.RWMutex
+)
+
+// Role returns the current role of the instance, a promoted standby is a primary.
+func Role() string {
+	if promoted.Load() {
+		return RolePrimary
+	}
+	return utils.Config.Replication.Role
+}
+
+func IsPrimary() bool {
+	return Role() == RolePrimary
+}
+
+func IsFollower() bool {
+	return Role() == RoleFollower
+}
+
+func IsStandby() bool {
+	return Role() == RoleStandby
+}
+
+// SetupFollower keeps local replicas of every remote database up to date, polling the generation of the remote objects.
+// onChange is called with the keys of the databases appearing in or disappearing from the bucket so the catalog follows
+// the primary.
+func SetupFollower(onChange func(key string, removed bool)) error {
+	if !IsFollower() {
+		return nil
+	}
+
+	if err := os.MkdirAll(utils.Config.Replication.DirectoryPath, 0o755); err != nil {
+		return fmt.Errorf("failed to create replicas directory: %w", err)
+	}
+
+	go func() {
+		interval := time.Duration(utils.Config.Replication.PollIntervalSeconds) * time.Second
+		utils.StagesLogger.Info("Starting replication follower.", zap.Duration("pollInterval", interval), zap.String("directory", utils.Config.Replication.DirectoryPath))
+
+		for {
+			refreshReplicas(onChange, 0)
+			waitForRefresh(interval)
+		}
+	}()
+
+	return nil
+}
+
+// refreshReplicas mirrors the remote databases in the catalog and keeps replicas of the limit most recently written
+// ones, of all of them when limit is zero.
+func refreshReplicas(onChange func(key string, removed bool), limit int) {
+	remoteDatabases, err := remotevfs.ListDatabases()
+	if err != nil {
+		utils.StagesLogger.Warn("Failed to list remote databases for replication.", zap.Error(err))
+		return
+	}
+
+	if limit > 0 {
+		sort.SliceStable(remoteDatabases, func(i, j int) bool {
+			return remoteDatabases[i].LastModified.After(remoteDatabases[j].LastModified)
+		})
+	}
+
+	listed := make(map[string]bool, len(remoteDatabases))
+	kept := make(map[string]bool, len(remoteDatabases))
+	for index, remoteDatabase := range remoteDatabases {
+		listed[remoteDatabase.Name] = true
+		keep := limit == 0 || index < limit
+		kept[remoteDatabase.Name] = keep
+
+		replicasMutex.Lock()
+		_, known := mirrored[remoteDatabase.Name]
+		mirrored[remoteDatabase.Name] = remoteDatabase.Path
+		current, exists := replicas[remoteDatabase.Name]
+		if !exists && keep {
+			current = &replica{
+				database: remoteDatabase.Name,
+				key:      remoteDatabase.Path,
+				path:     filepath.Join(utils.Config.Replication.DirectoryPath, remoteDatabase.Name+".db"),
+			}
+			replicas[remoteDatabase.Name] = current
+		}
+		replicasMutex.Unlock()
+
+		if !known {
+			onChange(remoteDatabase.Path, false)
+		}
+
+		if !keep {
+			continue
+		}
+		if err := current.refresh(); err != nil {
+			utils.StagesLogger.Warn("Failed to refresh replica.", zap.String("database", remoteDatabase.Name), zap.Error(err))
+		}
+	}
+
+	replicasMutex.Lock()
+	var dropped []*replica
+	for name, replica := range replicas {
+		if !kept[name] {
+			delete(replicas, name)
+			dropped = append(dropped, replica)
+		}
+	}
+	var removed []string
+	for name, key := range mirrored {
+		if !listed[name] {
+			delete(mirrored, name)
+			removed = append(removed, key)
+		}
+	}
+	replicasMutex.Unlock()
+
+	for _, replica := range dropped {
+		utils.StagesLogger.Info("Dropping replica of a database removed from the bucket or no longer written recently.", zap.String("database", replica.database))
+		replica.drop()
+	}
+	for _, key := range removed {
+		onChange(key, true)
+	}
+}
+
+func (replica *replica) drop() {
+	replica.fileMutex.Lock()
+	defer replica.fileMutex.Unlock()
+
+	if err := localvfs.Delete(replica.path); err != nil {
+		utils.StagesLogger.Warn("Failed to delete replica.", zap.String("path", replica.path), zap.Error(err))
+	}
+}
+
+// refresh copies the remote object again when its generation changed since the last copy.
+func (replica *replica) refresh() error {
+	checkedAt := time.Now()
+
+	generation, err := replica.objectGeneration()
+	if err != nil {
+		replica.setError(err)
+		return err
+	}
+
+	replicasMutex.RLock()
+	upToDate := generation == replica.generation
+	replicasMutex.RUnlock()
+
+	if !upToDate {
+		if err := replica.copy(); err != nil {
+			replica.setError(err)
+			return err
+		}
+		utils.StagesLogger.Debug("Replica synced.", zap.String("database", replica.database), zap.String("generation", generation))
+	}
+
+	replicasMutex.Lock()
+	// NOTE: the object may have changed during the copy, its generation read before the copy makes the next poll copy it again
+	replica.generation = generation
+	if !upToDate {
+		replica.syncedAt = checkedAt
+	}
+	replica.checkedAt = checkedAt
+	replica.lastError = ""
+	replicasMutex.Unlock()
+
+	return nil
+}
+
+// objectGeneration returns the generation of the remote object along with the one of its companion holding the tiered
+// tables, when it has one, a write to either is copied again.
+func (replica *replica) objectGeneration() (string, error) {
+	generation, err := remotevfs.ObjectGeneration(replica.key)
+	if err != nil {
+		return "", err
+	}
+	companion, err := remotevfs.ObjectGeneration(replica.key + stages.TieredSuffix)
+	if errors.Is(err, remotevfs.ErrObjectNotFound) {
+		return generation, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return generation + "+" + companion, nil
+}
+
+func (replica *replica) setError(err error) {
+	replicasMutex.Lock()
+	replica.lastError = err.Error()
+	replicasMutex.Unlock()
+}
+
+// copy writes a consistent copy of the remote database next to the replica then swaps it in.
+func (replica *replica) copy() error {
+	source, err := sql.Open("sqlite3", stages.RemoteConnectionString(replica.key, stages.ConnectionOptions{ReadOnly: true, WithoutPragmas: true}))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	temporaryPath := replica.path + ".sync"
+	if err := localvfs.Delete(temporaryPath); err != nil && !os.IsNotExist(err) {
+		utils.StagesLogger.Debug("Failed to delete previous replica copy (may not exist).", zap.String("path", temporaryPath), zap.Error(err))
+	}
+
+	if _, err := source.Exec("VACUUM INTO ?", stages.LocalConnectionString(temporaryPath, stages.ConnectionOptions{WithoutPragmas: true})); err != nil {
+		return fmt.Errorf("failed to copy remote database: %w", err)
+	}
+	// NOTE: the follower has no companion to attach, the replica holds the tiered tables itself
+	if err := stages.InlineTieredTables(stages.LocalConnectionString(temporaryPath, stages.ConnectionOptions{WithoutPragmas: true}), replica.key+stages.TieredSuffix, ""); err != nil {
+		return fmt.Errorf("failed to copy the tiered tables of the remote database: %w", err)
+	}
+
+	replica.fileMutex.Lock()
+	defer replica.fileMutex.Unlock()
+
+	return os.Rename(temporaryPath, replica.path)
+}
+
+// Query runs a read query on the replica of the database, restricted by the policies of the principal and the statement
+// policy of the endpoint. It returns the rows of the window, and whether rows were left past it.
+func Query(ctx context.Context, name string, principal string, endpoint string, window utils.ResultWindow, query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, bool, error) {
+	var output utils.QueryResultType
+	var columns []utils.QueryColumn
+	var truncated bool
+	err := readReplica(ctx, name, principal, endpoint, func(conn *sql.Conn, session *policies.Session, statementPolicy statements.Rules) error {
+		guardrails := statementPolicy.Guardrails()
+		query := guardrails.Rewrite(query)
+		masks, err := session.Masks(ctx, conn, query)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := guardrails.Bound(ctx)
+		defer cancel()
+
+		defer utils.CollectStats(conn, window.Stats)()
+		rows, err := conn.QueryContext(ctx, query, parameters...)
+		if err != nil {
+			return guardrails.Check(ctx, err)
+		}
+
+		window.MaxRows = statementPolicy.MaxRows
+		output, columns, truncated, err = utils.QueryResultToMapsMasked(rows, masks, window)
+		metering.RecordQuery(name, len(output))
+		return guardrails.Check(ctx, err)
+	})
+	return output, columns, truncated, err
+}
+
+// Export runs the read query on the replica of the database and writes its rows in the columnar format like
+// databases.Database.ExportAs.
+func Export(ctx context.Context, name string, principal string, endpoint string, format string, begin func(), w io.Writer, query string, parameters ...any) error {
+	return readReplica(ctx, name, principal, endpoint, func(conn *sql.Conn, session *policies.Session, statementPolicy statements.Rules) error {
+		guardrails := statementPolicy.Guardrails()
+		query := guardrails.Rewrite(query)
+		masks, err := session.Masks(ctx, conn, query)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := guardrails.Bound(ctx)
+		defer cancel()
+
+		rows, err := conn.QueryContext(ctx, query, parameters...)
+		if err != nil {
+			return guardrails.Check(ctx, err)
+		}
+
+		count, err := utils.WriteTabular(rows, masks, statementPolicy.MaxRows, format, begin, w)
+		metering.RecordQuery(name, count)
+		return guardrails.Check(ctx, err)
+	})
+}
+
+// ReadBlob passes the value of the column of the row of the replica of the database to read like
+// databases.Database.ReadBlobAs.
+func ReadBlob(ctx context.Context, name string, principal string, endpoint string, table string, column string, rowid int64, read func(size int64, blob io.Reader) error) error {
+	return readReplica(ctx, name, principal, endpoint, func(conn *sql.Conn, session *policies.Session, statementPolicy statements.Rules) error {
+		if err := session.CheckStreaming(table, column); err != nil {
+			return err
+		}
+		if err := utils.ReadBlob(ctx, conn, table, column, rowid, read); err != nil {
+			return err
+		}
+		metering.RecordQuery(name, 1)
+		return nil
+	})
+}
+
+// ReadRow reads the row of the table of the replica of the database with the given key like
+// databases.Database.ReadRowAs.
+func ReadRow(ctx context.Context, name string, principal string, endpoint string, table string, key string) (utils.Row, error) {
+	var row utils.Row
+	err := readReplica(ctx, name, principal, endpoint, func(conn *sql.Conn, session *policies.Session, statementPolicy statements.Rules) error {
+		masks := func(query string) ([]utils.ValueMask, error) {
+			return session.Masks(ctx, conn, query)
+		}
+
+		var err error
+		if row, err = utils.ReadRow(ctx, conn, masks, table, key); err != nil {
+			return err
+		}
+		metering.RecordQuery(name, 1)
+		return nil
+	})
+	return row, err
+}
+
+// QueryBatch runs the read queries on the replica of the database like Query, in a single read transaction so that all
+// of them see the same snapshot. A failing query is reported in its result.
+func QueryBatch(ctx context.Context, name string, principal string, endpoint string, windows []utils.ResultWindow, queries []string, parameters [][]any) ([]utils.SnapshotResult, error) {
+	var results []utils.SnapshotResult
+	err := readReplica(ctx, name, principal, endpoint, func(conn *sql.Conn, session *policies.Session, statementPolicy statements.Rules) error {
+		masks := func(query string) ([]utils.ValueMask, error) {
+			return session.Masks(ctx, conn, query)
+		}
+
+		guardrails := statementPolicy.Guardrails()
+		ctx, cancel := guardrails.Bound(ctx)
+		defer cancel()
+
+		var err error
+		results, err = utils.ReadSnapshot(ctx, conn, masks, statementPolicy.MaxRows, windows, guardrails.RewriteAll(queries), parameters)
+		for index := range results {
+			results[index].Err = guardrails.Check(ctx, results[index].Err)
+			metering.RecordQuery(name, len(results[index].Rows))
+		}
+		return guardrails.Check(ctx, err)
+	})
+	return results, err
+}
+
+// readReplica opens a connection to the replica of the database restricted for the principal and the endpoint, and
+// passes it to read while the replica can't be replaced.
+func readReplica(ctx context.Context, name string, principal string, endpoint string, read func(conn *sql.Conn, session *policies.Session, statementPolicy statements.Rules) error) error {
+	replicasMutex.RLock()
+	replica, exists := replicas[name]
+	var generation string
+	var checkedAt time.Time
+	if exists {
+		generation, checkedAt = replica.generation, replica.checkedAt
+	}
+	replicasMutex.RUnlock()
+
+	if !exists || generation == "" {
+		return utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("replica of database %s is not synced yet", name), nil)
+	}
+
+	maxStaleness := time.Duration(utils.Config.Replication.MaxStalenessSeconds) * time.Second
+	if staleness := time.Since(checkedAt); maxStaleness > 0 && staleness > maxStaleness {
+		return utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("replica of database %s is %s stale, more than the allowed %s", name, staleness.Round(time.Second), maxStaleness), nil)
+	}
+
+	replica.fileMutex.RLock()
+	defer replica.fileMutex.RUnlock()
+
+	// NOTE: the replica is replaced by a rename while no read holds it, never written in place, it is read immutable
+	connection, err := sql.Open("sqlite3", stages.LocalConnectionString(replica.path, stages.ConnectionOptions{ReadOnly: true, Immutable: true, WithoutPragmas: true}))
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	conn, err := connection.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	opened := &connections.Connection{Conn: conn, Database: name, Principal: principal, Endpoint: endpoint, Replica: true}
+	if err := connections.Open(ctx, opened); err != nil {
+		return err
+	}
+	return read(conn, policies.SessionOf(opened), statements.RulesOf(opened))
+}
+
+// Status returns the replicas kept by the follower or standby with their staleness.
+func Status() []ReplicaStatus {
+	replicasMutex.RLock()
+	defer replicasMutex.RUnlock()
+
+	maxStaleness := time.Duration(utils.Config.Replication.MaxStalenessSeconds) * time.Second
+
+	result := make([]ReplicaStatus, 0, len(replicas))
+	for _, replica := range replicas {
+		status := ReplicaStatus{
+			Database:   replica.database,
+			Generation: replica.generation,
+			SyncedAt:   replica.syncedAt,
+			CheckedAt:  replica.checkedAt,
+			LastError:  replica.lastError,
+		}
+		if !replica.checkedAt.IsZero() {
+			staleness := time.Since(replica.checkedAt)
+			status.StalenessSeconds = staleness.Seconds()
+			status.Stale = maxStaleness > 0 && staleness > maxStaleness
+		} else {
+			status.Stale = true
+		}
+		result = append(result, status)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Database < result[j].Database
+	})
+	return result
+}
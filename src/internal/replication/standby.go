@@ -0,0 +1,213 @@
+package replication
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/coordination"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+const (
+	PromotionRequested    = "requested"
+	PromotionLeaseExpired = "lease_expired"
+)
+
+// Promotion describes the takeover of a standby, the adopted databases are served from their prefetched local copy
+// right away while the others are served from the remote stage until they are promoted again.
+type Promotion struct {
+	Reason     string    `json:"reason"`
+	Forced     bool      `json:"forced"`
+	PromotedAt time.Time `json:"promoted_at"`
+	Adopted    []string  `json:"adopted"`
+	Cold       []string  `json:"cold"`
+	// NOTE: databases the mirrored catalog last knew to hold writes the previous active instance hadn't synced to the
+	// remote stage, those writes are lost
+	Unsynced []string `json:"unsynced"`
+}
+
+var (
+	promoted atomic.Bool
+
+	// NOTE: held while the standby refreshes its replicas and while it is promoted, so a promotion never sees a replica
+	// being swapped
+	standbyMutex  sync.Mutex
+	adoptReplica  func(name string, path string) error
+	lastPromotion atomic.Pointer[Promotion]
+)
+
+// SetupStandby mirrors the catalog of the active instance and keeps local copies of its most recently written
+// databases until the standby is promoted. adopt is called on promotion with the path of every local copy matching the
+// remote object, it is expected to move the file and serve the database from the local stage.
+func SetupStandby(onChange func(key string, removed bool), adopt func(name string, path string) error) error {
+	if !IsStandby() {
+		return nil
+	}
+
+	if err := os.MkdirAll(utils.Config.Replication.DirectoryPath, 0o755); err != nil {
+		return fmt.Errorf("failed to create replicas directory: %w", err)
+	}
+	adoptReplica = adopt
+
+	go func() {
+		interval := time.Duration(utils.Config.Replication.PollIntervalSeconds) * time.Second
+		utils.StagesLogger.Info(
+			"Starting replication standby.",
+			zap.Duration("pollInterval", interval),
+			zap.Int("prefetchCount", utils.Config.Replication.StandbyPrefetchCount),
+			zap.Bool("autoPromote", utils.Config.Replication.StandbyAutoPromote),
+		)
+
+		for {
+			standbyMutex.Lock()
+			if !IsStandby() {
+				standbyMutex.Unlock()
+				return
+			}
+			// NOTE: a zero count keeps a copy of every database like a follower
+			refreshReplicas(onChange, utils.Config.Replication.StandbyPrefetchCount)
+			standbyMutex.Unlock()
+
+			if utils.Config.Replication.StandbyAutoPromote {
+				promoteIfActiveExpired()
+			}
+			waitForRefresh(interval)
+		}
+	}()
+
+	return nil
+}
+
+// SetupActive keeps the active lease held while the instance is a primary, so standbys can tell when it stops. Among
+// several primaries sharing the bucket, a single one holds it.
+func SetupActive() {
+	if !utils.Config.Coordination.Enabled || IsFollower() {
+		return
+	}
+
+	go func() {
+		interval := time.Duration(utils.Config.Coordination.RenewIntervalSeconds) * time.Second
+
+		for {
+			if IsPrimary() && !coordination.Holds(coordination.ActiveLease) {
+				if err := coordination.Acquire(coordination.ActiveLease); err != nil {
+					utils.StagesLogger.Debug("Active lease held elsewhere.", zap.Error(err))
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// promoteIfActiveExpired promotes the standby once the lease of the active instance expired. A missing lease isn't
+// enough, the standby would otherwise take over before the active instance first started.
+func promoteIfActiveExpired() {
+	lease, exists, err := coordination.Lookup(coordination.ActiveLease)
+	if err != nil {
+		utils.StagesLogger.Warn("Failed to check the lease of the active instance.", zap.Error(err))
+		return
+	}
+	if !exists || lease.Holder == coordination.InstanceID() || time.Now().Before(lease.ExpiresAt) {
+		return
+	}
+
+	utils.StagesLogger.Warn("Lease of the active instance expired, promoting the standby.", zap.String("active", lease.Holder), zap.Time("expiredAt", lease.ExpiresAt))
+	promotion, err := Promote(PromotionLeaseExpired, false)
+	if err != nil {
+		utils.StagesLogger.Error("Failed to promote the standby.", zap.Error(err))
+		return
+	}
+
+	audit.Record(audit.Event{
+		Type:    audit.EventInstancePromoted,
+		Details: map[string]any{"reason": promotion.Reason, "forced": false, "adopted": promotion.Adopted, "cold": promotion.Cold, "unsynced": promotion.Unsynced, "previous": lease.Holder},
+	})
+}
+
+// Promote turns the standby into the active instance. The active lease is acquired first, when forced it is taken over
+// even though the previous active instance still holds it, which must then be stopped. Every prefetched database whose
+// lease is acquired and whose local copy still matches the remote object is served from the local stage right away.
+func Promote(reason string, force bool) (Promotion, error) {
+	standbyMutex.Lock()
+	defer standbyMutex.Unlock()
+
+	if !IsStandby() {
+		return Promotion{}, utils.NewError(utils.ErrorCodeConflict, fmt.Sprintf("instance is a %s, only a standby can be promoted", Role()), nil)
+	}
+
+	acquire := coordination.Acquire
+	if force {
+		acquire = coordination.TakeOver
+	}
+
+	if err := acquire(coordination.ActiveLease); err != nil {
+		if utils.ErrorCodeOf(err) == utils.ErrorCodeReadOnly {
+			return Promotion{}, utils.NewError(utils.ErrorCodeConflict, "the active instance still holds its lease, stop it and wait for the lease to expire or force the promotion", err)
+		}
+		return Promotion{}, err
+	}
+
+	replicasMutex.Lock()
+	prefetched := make([]*replica, 0, len(replicas))
+	for _, replica := range replicas {
+		prefetched = append(prefetched, replica)
+	}
+	replicas = map[string]*replica{}
+	replicasMutex.Unlock()
+
+	sort.Slice(prefetched, func(i, j int) bool {
+		return prefetched[i].database < prefetched[j].database
+	})
+
+	promotion := Promotion{Reason: reason, Forced: force, PromotedAt: time.Now(), Adopted: []string{}, Cold: []string{}, Unsynced: UnsyncedDatabases()}
+	for _, replica := range prefetched {
+		if err := replica.adopt(acquire); err != nil {
+			utils.StagesLogger.Warn("Prefetched database left on the remote stage.", zap.String("database", replica.database), zap.Error(err))
+			replica.drop()
+			promotion.Cold = append(promotion.Cold, replica.database)
+			continue
+		}
+		promotion.Adopted = append(promotion.Adopted, replica.database)
+	}
+
+	promoted.Store(true)
+	lastPromotion.Store(&promotion)
+
+	utils.StagesLogger.Warn(
+		"Standby promoted to active.",
+		zap.String("reason", reason),
+		zap.Bool("forced", force),
+		zap.Strings("adopted", promotion.Adopted),
+		zap.Strings("cold", promotion.Cold),
+		zap.Strings("unsynced", promotion.Unsynced),
+	)
+	return promotion, nil
+}
+
+// LastPromotion returns the promotion of the instance, nil when it was never promoted.
+func LastPromotion() *Promotion {
+	return lastPromotion.Load()
+}
+
+// adopt hands the local copy over to the local stage once the lease of the database is held and the copy is known to
+// match the remote object, writes the previous active instance had not synced yet are lost.
+func (replica *replica) adopt(acquire func(name string) error) error {
+	if err := acquire(replica.database); err != nil {
+		return err
+	}
+	if err := replica.refresh(); err != nil {
+		return err
+	}
+
+	replica.fileMutex.Lock()
+	defer replica.fileMutex.Unlock()
+
+	return adoptReplica(replica.database, replica.path)
+}
@@ -0,0 +1,299 @@
+package schemas
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"persisto/src/utils"
+)
+
+const (
+	KindTable   = "table"
+	KindColumn  = "column"
+	KindIndex   = "index"
+	KindTrigger = "trigger"
+	KindView    = "view"
+)
+
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// NOTE: a table whose change ALTER TABLE can't make is rebuilt under this prefix, then renamed, the prefix keeps it out
+// of the schemas while it exists
+const rebuildPrefix = "_persisto_rebuild_"
+
+// Change is a difference between two schemas. From and To are the definitions of the column or the statements of the
+// other objects, on the side they exist.
+type Change struct {
+	Kind   string `json:"kind" enum:"table,column,index,trigger,view"`
+	Change string `json:"change" enum:"added,removed,changed"`
+	Table  string `json:"table,omitempty" doc:"Table of the column, index or trigger."`
+	Name   string `json:"name"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+// Diff is the structural difference from a schema to another, with the statements migrating a database from the
+// first to the second.
+type Diff struct {
+	Identical bool     `json:"identical"`
+	Changes   []Change `json:"changes"`
+	Migration []string `json:"migration,omitempty" doc:"Statements turning the first schema into the second, in order."`
+	Warnings  []string `json:"warnings,omitempty" doc:"What to check before running the migration."`
+}
+
+// definition returns the column as it is declared in a CREATE TABLE or ALTER TABLE ADD COLUMN statement, without its
+// constraints beyond NOT NULL and DEFAULT.
+func (column Column) definition() string {
+	parts := []string{utils.QuoteIdentifier(column.Name)}
+	if column.Type != "" {
+		parts = append(parts, column.Type)
+	}
+	if column.PrimaryKey > 0 {
+		parts = append(parts, "PRIMARY KEY")
+	}
+	if column.NotNull {
+		parts = append(parts, "NOT NULL")
+	}
+	if column.Default != nil {
+		parts = append(parts, "DEFAULT "+*column.Default)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (column Column) equal(other Column) bool {
+	return column.Name == other.Name && strings.EqualFold(column.Type, other.Type) && column.NotNull == other.NotNull &&
+		column.PrimaryKey == other.PrimaryKey && (column.Default == nil) == (other.Default == nil) &&
+		(column.Default == nil || *column.Default == *other.Default)
+}
+
+// addable reports whether ALTER TABLE ADD COLUMN can add the column: it must not be part of the primary key, a NOT NULL
+// column needs a default and the default must be a constant.
+func (column Column) addable() bool {
+	if column.PrimaryKey > 0 || (column.NotNull && column.Default == nil) {
+		return false
+	}
+	if column.Default != nil {
+		value := strings.ToUpper(strings.TrimSpace(*column.Default))
+		if strings.HasPrefix(value, "(") || strings.HasPrefix(value, "CURRENT_") {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare returns the differences from the schema from to the schema to, and the migration turning the first into the
+// second. ALTER TABLE adds the new columns it can add, the other changes of a table rebuild it: a new table is created
+// with the statement of the second schema, the rows of the shared columns are copied to it and it replaces the old one.
+func Compare(from Schema, to Schema) Diff {
+	diff := Diff{Changes: []Change{}, Migration: []string{}}
+
+	fromTables := map[string]Table{}
+	for _, table := range from.Tables {
+		fromTables[table.Name] = table
+	}
+	toTables := map[string]Table{}
+	for _, table := range to.Tables {
+		toTables[table.Name] = table
+	}
+
+	var dropped, created, altered, rebuilt []string
+	for _, table := range from.Tables {
+		if _, exists := toTables[table.Name]; !exists {
+			diff.Changes = append(diff.Changes, Change{Kind: KindTable, Change: ChangeRemoved, Name: table.Name, From: table.SQL})
+			dropped = append(dropped, "DROP TABLE "+utils.QuoteIdentifier(table.Name))
+		}
+	}
+	for _, table := range to.Tables {
+		previous, exists := fromTables[table.Name]
+		if !exists {
+			diff.Changes = append(diff.Changes, Change{Kind: KindTable, Change: ChangeAdded, Name: table.Name, To: table.SQL})
+			created = append(created, table.SQL)
+			continue
+		}
+
+		changes, additions, rebuild := compareColumns(previous, table)
+		diff.Changes = append(diff.Changes, changes...)
+		if !rebuild && len(changes) == 0 && normalized(previous.SQL) != normalized(table.SQL) {
+			// NOTE: the same columns under other constraints, e.g. a CHECK or a foreign key
+			diff.Changes = append(diff.Changes, Change{Kind: KindTable, Change: ChangeChanged, Name: table.Name, From: previous.SQL, To: table.SQL})
+			rebuild = true
+		}
+		if rebuild {
+			rebuilt = append(rebuilt, table.Name)
+			diff.Migration = append(diff.Migration, rebuildStatements(previous, table)...)
+			diff.Warnings = append(diff.Warnings, rebuildWarnings(previous, table)...)
+			continue
+		}
+		for _, column := range additions {
+			altered = append(altered, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", utils.QuoteIdentifier(table.Name), column.definition()))
+		}
+	}
+	rebuilds := diff.Migration
+
+	// NOTE: the views are recreated around the rebuilds, renaming a table checks the views referencing it
+	viewsRecreated := len(rebuilt) > 0
+	var objectDrops, objectCreates []string
+	for _, objects := range []struct {
+		kind     string
+		from, to []Object
+		recreate func(Object) bool
+	}{
+		{KindIndex, from.Indexes, to.Indexes, func(index Object) bool { return slices.Contains(rebuilt, index.Table) }},
+		{KindView, from.Views, to.Views, func(Object) bool { return viewsRecreated }},
+		{KindTrigger, from.Triggers, to.Triggers, func(trigger Object) bool {
+			return slices.Contains(rebuilt, trigger.Table) || (viewsRecreated && slices.ContainsFunc(to.Views, func(view Object) bool { return view.Name == trigger.Table }))
+		}},
+	} {
+		changes, drops, creates := compareObjects(objects.kind, objects.from, objects.to, objects.recreate)
+		diff.Changes = append(diff.Changes, changes...)
+		objectDrops = append(objectDrops, drops...)
+		objectCreates = append(objectCreates, creates...)
+	}
+
+	// NOTE: the objects go before their tables and come back after them, the triggers and views last as they may read
+	// any table
+	diff.Migration = slices.Concat(objectDrops, dropped, created, altered, rebuilds, objectCreates)
+	diff.Identical = len(diff.Changes) == 0
+	if len(rebuilt) > 0 {
+		diff.Warnings = append(diff.Warnings, "the migration rebuilds tables, run it with PRAGMA foreign_keys=OFF so that the rows referencing them are kept")
+	}
+	return diff
+}
+
+// compareColumns returns the changes of the columns of the table, the columns ALTER TABLE adds and whether the table must
+// be rebuilt.
+func compareColumns(from Table, to Table) ([]Change, []Column, bool) {
+	var changes []Change
+	var additions []Column
+	rebuild := false
+
+	fromColumns := map[string]Column{}
+	for _, column := range from.Columns {
+		fromColumns[column.Name] = column
+	}
+	toColumns := map[string]Column{}
+	for _, column := range to.Columns {
+		toColumns[column.Name] = column
+	}
+
+	for _, column := range from.Columns {
+		if _, exists := toColumns[column.Name]; !exists {
+			changes = append(changes, Change{Kind: KindColumn, Change: ChangeRemoved, Table: to.Name, Name: column.Name, From: column.definition()})
+			rebuild = true
+		}
+	}
+	for index, column := range to.Columns {
+		previous, exists := fromColumns[column.Name]
+		switch {
+		case !exists:
+			changes = append(changes, Change{Kind: KindColumn, Change: ChangeAdded, Table: to.Name, Name: column.Name, To: column.definition()})
+			// NOTE: ADD COLUMN appends, a column added before the existing ones needs a rebuild
+			if !column.addable() || index < len(from.Columns) {
+				rebuild = true
+			}
+			additions = append(additions, column)
+		case !previous.equal(column):
+			changes = append(changes, Change{Kind: KindColumn, Change: ChangeChanged, Table: to.Name, Name: column.Name, From: previous.definition(), To: column.definition()})
+			rebuild = true
+		}
+	}
+
+	// NOTE: the columns kept in another order
+	if !rebuild {
+		for index, column := range from.Columns {
+			if to.Columns[index].Name != column.Name {
+				changes = append(changes, Change{Kind: KindTable, Change: ChangeChanged, Name: to.Name, From: from.SQL, To: to.SQL})
+				rebuild = true
+				break
+			}
+		}
+	}
+	return changes, additions, rebuild
+}
+
+// rebuildStatements creates the table of the second schema under a temporary name, copies the rows of the shared
+// columns to it and replaces the table with it.
+func rebuildStatements(from Table, to Table) []string {
+	temporary := utils.QuoteIdentifier(rebuildPrefix + to.Name)
+
+	var shared []string
+	for _, column := range to.Columns {
+		if slices.ContainsFunc(from.Columns, func(previous Column) bool { return previous.Name == column.Name }) {
+			shared = append(shared, utils.QuoteIdentifier(column.Name))
+		}
+	}
+
+	// NOTE: the statement is kept from its column list on, only the name of the table is replaced
+	statements := []string{"CREATE TABLE " + temporary + " " + to.SQL[strings.Index(to.SQL, "("):]}
+	if len(shared) > 0 {
+		columns := strings.Join(shared, ", ")
+		statements = append(statements, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", temporary, columns, columns, utils.QuoteIdentifier(to.Name)))
+	}
+	return append(statements,
+		"DROP TABLE "+utils.QuoteIdentifier(to.Name),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", temporary, utils.QuoteIdentifier(to.Name)),
+	)
+}
+
+// rebuildWarnings returns what may fail when the table is rebuilt: the rows of the dropped columns are lost and the
+// new NOT NULL columns without default can't receive the existing rows.
+func rebuildWarnings(from Table, to Table) []string {
+	var warnings []string
+	for _, column := range from.Columns {
+		if !slices.ContainsFunc(to.Columns, func(kept Column) bool { return kept.Name == column.Name }) {
+			warnings = append(warnings, fmt.Sprintf("the values of column %s of table %s are lost", column.Name, to.Name))
+		}
+	}
+	for _, column := range to.Columns {
+		added := !slices.ContainsFunc(from.Columns, func(previous Column) bool { return previous.Name == column.Name })
+		if added && column.NotNull && column.Default == nil {
+			warnings = append(warnings, fmt.Sprintf("column %s of table %s is NOT NULL without default, copying the existing rows fails unless the table is empty", column.Name, to.Name))
+		}
+	}
+	return warnings
+}
+
+// compareObjects returns the changes of the indexes, triggers or views, the statements dropping the ones removed or
+// changed, and those creating the ones added, changed or to recreate as their table is rebuilt.
+func compareObjects(kind string, from []Object, to []Object, recreate func(Object) bool) ([]Change, []string, []string) {
+	var changes []Change
+	var drops, creates []string
+	keyword := strings.ToUpper(kind)
+
+	fromObjects := map[string]Object{}
+	for _, object := range from {
+		fromObjects[object.Name] = object
+	}
+	toObjects := map[string]Object{}
+	for _, object := range to {
+		toObjects[object.Name] = object
+	}
+
+	for _, object := range from {
+		current, exists := toObjects[object.Name]
+		if !exists {
+			changes = append(changes, Change{Kind: kind, Change: ChangeRemoved, Table: object.Table, Name: object.Name, From: object.SQL})
+		}
+		if !exists || normalized(current.SQL) != normalized(object.SQL) || recreate(current) {
+			drops = append(drops, fmt.Sprintf("DROP %s IF EXISTS %s", keyword, utils.QuoteIdentifier(object.Name)))
+		}
+	}
+	for _, object := range to {
+		previous, exists := fromObjects[object.Name]
+		switch {
+		case !exists:
+			changes = append(changes, Change{Kind: kind, Change: ChangeAdded, Table: object.Table, Name: object.Name, To: object.SQL})
+		case normalized(previous.SQL) != normalized(object.SQL):
+			changes = append(changes, Change{Kind: kind, Change: ChangeChanged, Table: object.Table, Name: object.Name, From: previous.SQL, To: object.SQL})
+		case !recreate(object):
+			continue
+		}
+		creates = append(creates, object.SQL)
+	}
+	return changes, drops, creates
+}
@@ -0,0 +1,147 @@
+package schemas
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+)
+
+// NOTE: the tables of SQLite and of persisto, e.g. the metadata, jobs and policies, aren't part of the schema of a
+// database, they are managed along with it
+var internalPrefixes = []string{"sqlite_", "_persisto"}
+
+var (
+	whitespace  = regexp.MustCompile(`\s+`)
+	punctuation = regexp.MustCompile(`\s*([(),;])\s*`)
+)
+
+// Schema is the structure of a database: its tables with their columns, its indexes, triggers and views, sorted by name.
+type Schema struct {
+	Tables   []Table  `json:"tables"`
+	Indexes  []Object `json:"indexes"`
+	Triggers []Object `json:"triggers"`
+	Views    []Object `json:"views"`
+}
+
+// Table is a table of a schema, SQL is its CREATE TABLE statement.
+type Table struct {
+	Name    string   `json:"name"`
+	SQL     string   `json:"sql"`
+	Columns []Column `json:"columns"`
+}
+
+// Column is a column of a table as PRAGMA table_info reports it, PrimaryKey is its position in the primary key, 0 when
+// it isn't part of it.
+type Column struct {
+	Name       string  `json:"name"`
+	Type       string  `json:"type"`
+	NotNull    bool    `json:"not_null"`
+	Default    *string `json:"default,omitempty"`
+	PrimaryKey int     `json:"primary_key"`
+}
+
+// Object is an index, a trigger or a view of a schema, SQL is the statement creating it.
+type Object struct {
+	Name  string `json:"name"`
+	Table string `json:"table"`
+	SQL   string `json:"sql"`
+}
+
+func internal(name string) bool {
+	for _, prefix := range internalPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalized returns the statement with its whitespace collapsed and its identifiers unquoted, the statements differing
+// only by their layout are the same. SQLite rewrites the statements of the tables it alters, e.g. quoting the names of
+// the columns added, a table migrated is the same as the one it was migrated to.
+func normalized(statement string) string {
+	statement = strings.NewReplacer(`"`, "", "`", "").Replace(strings.TrimSpace(statement))
+	return punctuation.ReplaceAllString(whitespace.ReplaceAllString(statement, " "), "$1")
+}
+
+// Read returns the schema of the database opened by the connection string, read in a single transaction.
+func Read(connectionString string) (Schema, error) {
+	schema := Schema{Tables: []Table{}, Indexes: []Object{}, Triggers: []Object{}, Views: []Object{}}
+
+	db, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return schema, fmt.Errorf("failed to open database for its schema: %v", err)
+	}
+	defer db.Close()
+
+	transaction, err := db.Begin()
+	if err != nil {
+		return schema, err
+	}
+	defer transaction.Rollback()
+
+	// NOTE: the automatic indexes of the constraints have no statement, they follow their table
+	rows, err := transaction.Query("SELECT type, name, tbl_name, sql FROM sqlite_master WHERE sql IS NOT NULL ORDER BY name")
+	if err != nil {
+		return schema, fmt.Errorf("failed to read schema: %v", err)
+	}
+	for rows.Next() {
+		var objectType, name, table, statement string
+		if err := rows.Scan(&objectType, &name, &table, &statement); err != nil {
+			rows.Close()
+			return schema, err
+		}
+		if internal(name) || internal(table) {
+			continue
+		}
+
+		object := Object{Name: name, Table: table, SQL: statement}
+		switch objectType {
+		case "table":
+			schema.Tables = append(schema.Tables, Table{Name: name, SQL: statement})
+		case "index":
+			schema.Indexes = append(schema.Indexes, object)
+		case "trigger":
+			schema.Triggers = append(schema.Triggers, object)
+		case "view":
+			schema.Views = append(schema.Views, object)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return schema, err
+	}
+
+	for i := range schema.Tables {
+		if schema.Tables[i].Columns, err = readColumns(transaction, schema.Tables[i].Name); err != nil {
+			return schema, fmt.Errorf("failed to read the columns of table %s: %v", schema.Tables[i].Name, err)
+		}
+	}
+	return schema, nil
+}
+
+func readColumns(transaction *sql.Tx, table string) ([]Column, error) {
+	rows, err := transaction.Query(`SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info(?) ORDER BY cid`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := []Column{}
+	for rows.Next() {
+		var column Column
+		var defaultValue sql.NullString
+		if err := rows.Scan(&column.Name, &column.Type, &column.NotNull, &defaultValue, &column.PrimaryKey); err != nil {
+			return nil, err
+		}
+		if defaultValue.Valid {
+			column.Default = &defaultValue.String
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"sync"
+
+	"persisto/src/internal/databases"
+	"persisto/src/internal/scrubber"
+	"persisto/src/internal/stages"
+)
+
+var (
+	scrubberSetupOnce sync.Once
+)
+
+func SetupScrubber() {
+	scrubberSetupOnce.Do(func() {
+		getDatabases := func() []stages.Database {
+			if databases.Dbs == nil {
+				return []stages.Database{}
+			}
+
+			all := databases.Dbs.All()
+			result := make([]stages.Database, len(all))
+			for i, database := range all {
+				result[i] = database
+			}
+			return result
+		}
+
+		scrubber.SetupScrubber(getDatabases)
+	})
+}
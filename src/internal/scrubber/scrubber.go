@@ -0,0 +1,233 @@
+package scrubber
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/coordination"
+	"persisto/src/internal/stages"
+	"persisto/src/internal/telemetry"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+const (
+	StatusConsistent   = "consistent"
+	StatusRemoteStale  = "remote_stale"
+	StatusLocalCorrupt = "local_corrupt"
+	StatusSkipped      = "skipped"
+	StatusFailed       = "failed"
+)
+
+// Report is the outcome of the last scrub of a database.
+type Report struct {
+	Database       string    `json:"database"`
+	Status         string    `json:"status"`
+	LocalChecksum  string    `json:"local_checksum,omitempty"`
+	RemoteChecksum string    `json:"remote_checksum,omitempty"`
+	Repaired       bool      `json:"repaired"`
+	Detail         string    `json:"detail,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	ScrubbedAt     time.Time `json:"scrubbed_at"`
+}
+
+// Diverged reports whether the copies of the database were found to differ.
+func (report Report) Diverged() bool {
+	return report.Status == StatusRemoteStale || report.Status == StatusLocalCorrupt
+}
+
+var (
+	// NOTE: returns the databases currently managed, set when the scrubber is setup
+	listDatabases = func() []stages.Database { return []stages.Database{} }
+
+	reports      = map[string]Report{}
+	reportsMutex sync.Mutex
+)
+
+// SetupScrubber periodically compares the copies of the databases across stages and repairs the stale ones.
+func SetupScrubber(getDatabases func() []stages.Database) {
+	listDatabases = getDatabases
+	remotevfs.OnCorruption(repairCorrupted)
+
+	if !utils.Config.Scrub.Enabled {
+		utils.StagesLogger.Info("Scrubber disabled, not starting it.")
+		return
+	}
+
+	go func() {
+		interval := time.Duration(utils.Config.Scrub.IntervalSeconds) * time.Second
+		utils.StagesLogger.Info("Starting scrubber.", zap.Duration("interval", interval), zap.Bool("repair", utils.Config.Scrub.Repair))
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			ScrubAll()
+		}
+	}()
+}
+
+// ScrubAll scrubs the databases one after the other, pausing in between so that requests keep priority.
+func ScrubAll() {
+	pause := time.Duration(utils.Config.Scrub.PauseMilliseconds) * time.Millisecond
+
+	for _, database := range listDatabases() {
+		report := Scrub(database, utils.Config.Scrub.Repair)
+		if report.Status == StatusSkipped {
+			continue
+		}
+		if report.Diverged() {
+			audit.Record(audit.Event{
+				Type:     audit.EventDatabaseScrubbed,
+				Database: report.Database,
+				Details:  map[string]any{"status": report.Status, "repaired": report.Repaired, "scheduled": true},
+			})
+		}
+		time.Sleep(pause)
+	}
+}
+
+// Scrub compares the copy the database is served from with its remote copy. The served copy is authoritative: a stale or
+// missing remote copy is synced again, a local copy failing its integrity check is restored from the remote stage.
+func Scrub(database stages.Database, repair bool) Report {
+	report := Report{Database: database.GetName(), ScrubbedAt: time.Now()}
+
+	// NOTE: databases served from the remote stage have a single copy, those written by another instance are its own
+	if database.GetStage() != utils.GetLocalStage() {
+		report.Status, report.Detail = StatusSkipped, "served from the remote stage, it has a single copy"
+		return report
+	}
+	if !coordination.Holds(database.GetName()) {
+		report.Status, report.Detail = StatusSkipped, "written by another instance"
+		return report
+	}
+
+	// NOTE: busy databases are left for the next run rather than delaying their operations
+	if !database.GetMutex().TryRLock() {
+		report.Status, report.Detail = StatusSkipped, "busy with another operation"
+		return report
+	}
+	report.Status = compare(database, &report)
+	database.GetMutex().RUnlock()
+
+	if report.Diverged() {
+		database.GetLogger().Warn("Scrubber found diverging copies.", zap.String("status", report.Status), zap.String("localChecksum", report.LocalChecksum), zap.String("remoteChecksum", report.RemoteChecksum))
+		telemetry.RecordScrubDiscrepancy(context.Background(), report.Status)
+
+		switch {
+		case !repair:
+		// NOTE: without auto sync the remote copy is expected to lag behind until the next explicit sync
+		case report.Status == StatusRemoteStale && !utils.Config.Settings.AutoSyncEnabled:
+			report.Detail = "not repaired, auto sync is disabled"
+		default:
+			if err := repairCopies(database, report.Status); err != nil {
+				report.Error = fmt.Sprintf("repair failed: %v", err)
+				database.GetLogger().Error("Scrubber failed to repair database.", zap.String("status", report.Status), zap.Error(err))
+			} else {
+				report.Repaired = true
+				database.GetLogger().Info("Scrubber repaired database.", zap.String("status", report.Status))
+			}
+		}
+	}
+
+	reportsMutex.Lock()
+	reports[report.Database] = report
+	reportsMutex.Unlock()
+
+	return report
+}
+
+// repairCorrupted records the corrupted sector found in the remote copy of a database and scrubs it right away, so that
+// the copy it is served from is synced over it. A database served from the remote stage has no other copy, it is left
+// for a restore from its backups.
+func repairCorrupted(key string, sectorNum int64) {
+	name, isDatabase := remotevfs.DatabaseNameFromKey(key)
+	if !isDatabase {
+		return
+	}
+
+	for _, database := range listDatabases() {
+		if database.GetName() != name {
+			continue
+		}
+
+		report := Scrub(database, utils.Config.Scrub.Repair)
+		audit.Record(audit.Event{
+			Type:     audit.EventCorruptionDetected,
+			Database: name,
+			Details:  map[string]any{"key": key, "sector": sectorNum, "status": report.Status, "repaired": report.Repaired},
+		})
+		return
+	}
+}
+
+// compare checksums both copies of the database, the database mutex must be held.
+func compare(database stages.Database, report *Report) string {
+	localConnection, err := stages.ConnectionString(database.GetName(), database.GetStage(), stages.ConnectionOptions{ReadOnly: true})
+	if err != nil {
+		report.Error = err.Error()
+		return StatusFailed
+	}
+
+	if err := utils.VerifyDatabaseIntegrity(localConnection); err != nil {
+		report.Error = err.Error()
+		return StatusLocalCorrupt
+	}
+
+	localReadOnly, err := stages.ConnectionString(database.GetName(), database.GetStage(), stages.ConnectionOptions{ReadOnly: true})
+	if err != nil {
+		report.Error = err.Error()
+		return StatusFailed
+	}
+	report.LocalChecksum, err = utils.DatabaseChecksum(localReadOnly)
+	if err != nil {
+		report.Error = err.Error()
+		return StatusFailed
+	}
+
+	remoteConnection, err := stages.ConnectionString(database.GetName(), utils.GetRemoteStage(), stages.ConnectionOptions{ReadOnly: true})
+	if err != nil {
+		report.Error = err.Error()
+		return StatusFailed
+	}
+
+	// NOTE: a remote copy missing or unreadable is as stale as one with a different content
+	report.RemoteChecksum, err = utils.DatabaseChecksum(remoteConnection)
+	if err != nil {
+		report.Error = fmt.Sprintf("remote copy unreadable: %v", err)
+		return StatusRemoteStale
+	}
+
+	if report.LocalChecksum != report.RemoteChecksum {
+		return StatusRemoteStale
+	}
+	return StatusConsistent
+}
+
+func repairCopies(database stages.Database, status string) error {
+	if status == StatusLocalCorrupt {
+		return stages.RestoreFromRemoteStage(database)
+	}
+	return stages.SyncToRemoteStage(database)
+}
+
+// Reports returns the outcome of the last scrub of every database.
+func Reports() []Report {
+	reportsMutex.Lock()
+	defer reportsMutex.Unlock()
+
+	result := make([]Report, 0, len(reports))
+	for _, report := range reports {
+		result = append(result, report)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Database < result[j].Database
+	})
+	return result
+}
@@ -0,0 +1,39 @@
+//go:build unix
+
+package internal
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"persisto/src/utils"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	logLevelSignalsSetupOnce sync.Once
+)
+
+// SetupLogLevelSignals switches every logger to debug on SIGUSR1 and back to the configured level on SIGUSR2.
+func SetupLogLevelSignals() {
+	logLevelSignalsSetupOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+		go func() {
+			for received := range signals {
+				switch received {
+				case syscall.SIGUSR1:
+					utils.SetLogLevel("", zapcore.DebugLevel)
+					utils.Logger.Info("Log level set to debug on signal.")
+				case syscall.SIGUSR2:
+					utils.ResetLogLevels()
+					utils.Logger.Info("Log level reset on signal.")
+				}
+			}
+		}()
+	})
+}
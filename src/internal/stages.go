@@ -18,8 +18,9 @@ func SetupStagesMonitoring() {
 				return []stages.Database{}
 			}
 
-			result := make([]stages.Database, len(databases.Dbs.Items))
-			for i, database := range databases.Dbs.Items {
+			all := databases.Dbs.All()
+			result := make([]stages.Database, len(all))
+			for i, database := range all {
 				result[i] = database
 			}
 			return result
@@ -0,0 +1,97 @@
+package stages
+
+import (
+	"fmt"
+	"net/url"
+
+	"persisto/src/utils"
+)
+
+// NOTE: VFS serving the files of each stage, registered by the localvfs and remotevfs packages
+const (
+	vfsLocal  = "disk"
+	vfsRemote = "r2"
+)
+
+// ConnectionOptions are the parameters of a connection string besides its file and VFS.
+type ConnectionOptions struct {
+	// NOTE: mode=ro, the writes are refused
+	ReadOnly bool
+	// NOTE: immutable=1, SQLite takes no lock and never checks the file for changes, only for files nothing writes to
+	Immutable bool
+	// NOTE: cache=shared, the connections of the process share their page cache
+	SharedCache bool
+	// NOTE: the pragmas of the stage are set on the connections to the databases it serves, they are left out for the
+	// other files opened through its VFS, e.g. backups, snapshots and the targets of VACUUM INTO
+	WithoutPragmas bool
+}
+
+// LocalPath returns the path of the file of the database at the local stage.
+func LocalPath(name string) string {
+	return fmt.Sprintf("%s/%s", utils.Config.Storage.Local.DirectoryPath, utils.DatabaseFileName(name))
+}
+
+// Path returns where the database is stored at the stage, the path of its file at the local stage and the key of its
+// object at the remote stage.
+func Path(name string, stage uint) (string, error) {
+	switch stage {
+	case utils.GetLocalStage():
+		return LocalPath(name), nil
+	case utils.GetRemoteStage():
+		return utils.DatabaseFileName(name), nil
+	default:
+		minStage, maxStage := utils.GetValidStageRange()
+		return "", fmt.Errorf("invalid stage: %d. Valid stages are %d-%d", stage, minStage, maxStage)
+	}
+}
+
+// ConnectionString returns the connection string of the database at the stage.
+func ConnectionString(name string, stage uint, options ConnectionOptions) (string, error) {
+	path, err := Path(name, stage)
+	if err != nil {
+		return "", err
+	}
+	return FileConnectionString(path, stage, options)
+}
+
+// FileConnectionString returns the connection string of a file opened through the VFS of the stage, a path for the
+// local stage and a key for the remote stage.
+func FileConnectionString(path string, stage uint, options ConnectionOptions) (string, error) {
+	switch stage {
+	case utils.GetLocalStage():
+		return LocalConnectionString(path, options), nil
+	case utils.GetRemoteStage():
+		return RemoteConnectionString(path, options), nil
+	default:
+		return "", fmt.Errorf("invalid stage: %d", stage)
+	}
+}
+
+// LocalConnectionString returns the connection string of a file of the local storage.
+func LocalConnectionString(path string, options ConnectionOptions) string {
+	return connectionString(path, vfsLocal, utils.GetLocalStage(), options)
+}
+
+// RemoteConnectionString returns the connection string of an object of the bucket.
+func RemoteConnectionString(key string, options ConnectionOptions) string {
+	return connectionString(key, vfsRemote, utils.GetRemoteStage(), options)
+}
+
+func connectionString(path string, vfs string, stage uint, options ConnectionOptions) string {
+	parameters := url.Values{"vfs": {vfs}}
+	if options.ReadOnly {
+		parameters.Set("mode", "ro")
+	}
+	if options.Immutable {
+		parameters.Set("immutable", "1")
+	}
+	if options.SharedCache {
+		parameters.Set("cache", "shared")
+	}
+
+	connectionString := "file:" + path + "?" + parameters.Encode()
+	if !options.WithoutPragmas {
+		connectionString += utils.StageConnectionParameters(stage)
+	}
+	return connectionString
+}
@@ -0,0 +1,187 @@
+package stages
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/coordination"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: once the circuit breaker of the remote storage closes, the databases whose syncs failed meanwhile, retrying or
+// dead-lettered, are synced to the remote stage right away. A remote copy written after the first failed sync of a
+// database, e.g. by another instance during the outage, diverged from it and is resolved per
+// SETTINGS_FAILBACK_CONFLICT_POLICY.
+const (
+	// NOTE: the local copy overwrites the remote one, the writes made to the remote copy meanwhile are lost
+	FailbackPolicyLocal = "local"
+	// NOTE: the remote copy replaces the local one, the writes made locally meanwhile are lost
+	FailbackPolicyRemote = "remote"
+	// NOTE: both copies are left as they are and the database dead-lettered for an operator
+	FailbackPolicyManual = "manual"
+)
+
+const (
+	FailbackSynced      = "synced"
+	FailbackRestored    = "restored"
+	FailbackConflicting = "conflicting"
+	FailbackFailed      = "failed"
+)
+
+// FailbackReport is the outcome of the reconciliation of the databases once the remote storage was healthy again.
+type FailbackReport struct {
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Downtime   string            `json:"downtime" doc:"How long the circuit breaker stayed open."`
+	Policy     string            `json:"policy"`
+	Databases  []FailbackOutcome `json:"databases"`
+}
+
+// FailbackOutcome is the outcome of the reconciliation of a database, one of synced, restored, conflicting or failed.
+type FailbackOutcome struct {
+	Database string `json:"database"`
+	Outcome  string `json:"outcome" enum:"synced,restored,conflicting,failed"`
+	Diverged bool   `json:"diverged" doc:"Whether the remote copy was written after the first failed sync."`
+	Error    string `json:"error,omitempty"`
+}
+
+var (
+	lastFailback      *FailbackReport
+	lastFailbackMutex sync.Mutex
+	// NOTE: a single reconciliation at a time, the circuit may close again while one is running
+	failbackLane sync.Mutex
+)
+
+func setupFailback() {
+	remotevfs.OnCircuitClosed(func(downtime time.Duration) {
+		RunInBackground(func() { Failback(downtime) })
+	})
+}
+
+// LastFailback returns the report of the last reconciliation, nil when the remote storage didn't fail since the start.
+func LastFailback() *FailbackReport {
+	lastFailbackMutex.Lock()
+	defer lastFailbackMutex.Unlock()
+	return lastFailback
+}
+
+// Failback reconciles the databases whose syncs failed with their remote copies, one after the other, and records the
+// report of the outcomes.
+func Failback(downtime time.Duration) FailbackReport {
+	failbackLane.Lock()
+	defer failbackLane.Unlock()
+
+	report := FailbackReport{
+		StartedAt: time.Now().UTC(),
+		Downtime:  downtime.Round(time.Second).String(),
+		Policy:    utils.Config.Settings.FailbackConflictPolicy,
+		Databases: []FailbackOutcome{},
+	}
+
+	syncFailuresMutex.Lock()
+	failedSince := make(map[string]time.Time, len(syncFailures))
+	for name, failure := range syncFailures {
+		failedSince[name] = failure.firstFailedAt
+	}
+	syncFailuresMutex.Unlock()
+
+	counts := map[string]int{}
+	for _, database := range listDatabases() {
+		firstFailedAt, failed := failedSince[database.GetName()]
+		// NOTE: the databases leased by another instance are reconciled by it
+		if !failed || !coordination.Holds(database.GetName()) {
+			continue
+		}
+		outcome := failback(database, firstFailedAt, report.Policy)
+		counts[outcome.Outcome]++
+		report.Databases = append(report.Databases, outcome)
+	}
+	slices.SortFunc(report.Databases, func(a, b FailbackOutcome) int { return strings.Compare(a.Database, b.Database) })
+	report.FinishedAt = time.Now().UTC()
+
+	lastFailbackMutex.Lock()
+	lastFailback = &report
+	lastFailbackMutex.Unlock()
+
+	utils.StagesLogger.Info(
+		"Reconciled databases with the remote stage after its outage.",
+		zap.String("downtime", report.Downtime),
+		zap.Int("synced", counts[FailbackSynced]),
+		zap.Int("restored", counts[FailbackRestored]),
+		zap.Int("conflicting", counts[FailbackConflicting]),
+		zap.Int("failed", counts[FailbackFailed]),
+	)
+	audit.Record(audit.Event{
+		Type: audit.EventStorageFailedBack,
+		Details: map[string]any{
+			"downtime":    report.Downtime,
+			"policy":      report.Policy,
+			"synced":      counts[FailbackSynced],
+			"restored":    counts[FailbackRestored],
+			"conflicting": counts[FailbackConflicting],
+			"failed":      counts[FailbackFailed],
+		},
+	})
+	return report
+}
+
+func failback(database Database, firstFailedAt time.Time, policy string) FailbackOutcome {
+	outcome := FailbackOutcome{Database: database.GetName()}
+
+	// NOTE: the failed syncs never reached the bucket, a remote copy written since was written by someone else
+	stat, err := remotevfs.StatObject(GetRemoteKey(database))
+	if err != nil && !errors.Is(err, remotevfs.ErrObjectNotFound) {
+		outcome.Outcome, outcome.Error = FailbackFailed, err.Error()
+		return outcome
+	}
+	outcome.Diverged = err == nil && stat.LastModified.After(firstFailedAt)
+
+	switch {
+	case outcome.Diverged && policy == FailbackPolicyManual:
+		diverged(database, firstFailedAt)
+		outcome.Outcome = FailbackConflicting
+	case outcome.Diverged && policy == FailbackPolicyRemote:
+		if err := RestoreFromRemoteStage(database); err != nil {
+			outcome.Outcome, outcome.Error = FailbackFailed, err.Error()
+			break
+		}
+		syncSucceeded(database)
+		outcome.Outcome = FailbackRestored
+	default:
+		if err := SyncToRemoteStage(database); err != nil {
+			outcome.Outcome, outcome.Error = FailbackFailed, err.Error()
+			break
+		}
+		outcome.Outcome = FailbackSynced
+	}
+
+	if outcome.Error != "" {
+		database.GetLogger().Warn("Failed to reconcile database with the remote stage.", zap.Bool("diverged", outcome.Diverged), zap.String("error", outcome.Error))
+	} else {
+		database.GetLogger().Info("Reconciled database with the remote stage.", zap.Bool("diverged", outcome.Diverged), zap.String("outcome", outcome.Outcome))
+	}
+	return outcome
+}
+
+// diverged dead-letters the database whose remote copy diverged, it is no longer retried until resolved by hand.
+func diverged(database Database, firstFailedAt time.Time) {
+	syncFailuresMutex.Lock()
+	defer syncFailuresMutex.Unlock()
+
+	failure, exists := syncFailures[database.GetName()]
+	if !exists {
+		failure = &syncFailure{firstFailedAt: firstFailedAt}
+		syncFailures[database.GetName()] = failure
+	}
+	failure.deadLettered = true
+	failure.lastFailedAt = time.Now().UTC()
+	failure.lastError = fmt.Sprintf("the remote copy was written since %s, resolve the conflict by hand", firstFailedAt.Format(time.RFC3339))
+}
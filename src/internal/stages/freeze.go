@@ -0,0 +1,111 @@
+package stages
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: while frozen, the automatic promotions, demotions, evictions and syncs are held back, e.g. during an incident or
+// a maintenance of the bucket. The promotions and syncs triggered meanwhile are queued and run once unfrozen, the
+// inactive databases are demoted by the first monitoring run after it. The moves requested through the API and the
+// explicit syncs still run.
+
+// FreezeStatus tells whether the automatic movements are frozen and what waits for them to resume.
+type FreezeStatus struct {
+	Frozen            bool       `json:"frozen"`
+	Since             *time.Time `json:"since,omitempty"`
+	Reason            string     `json:"reason,omitempty"`
+	PendingPromotions []string   `json:"pending_promotions" doc:"Databases whose promotion is queued until the movements resume."`
+	PendingSyncs      []string   `json:"pending_syncs" doc:"Databases whose sync is queued until the movements resume."`
+}
+
+var (
+	freezeMutex  sync.Mutex
+	frozen       bool
+	frozenSince  time.Time
+	freezeReason string
+
+	queuedPromotions = map[string]Database{}
+	queuedSyncs      = map[string]Database{}
+)
+
+// Frozen reports whether the automatic movements are frozen.
+func Frozen() bool {
+	freezeMutex.Lock()
+	defer freezeMutex.Unlock()
+	return frozen
+}
+
+func freeze(reason string) {
+	freezeMutex.Lock()
+	defer freezeMutex.Unlock()
+	if !frozen {
+		frozen, frozenSince = true, time.Now().UTC()
+	}
+	freezeReason = reason
+}
+
+// Freeze holds back the automatic movements until Unfreeze is called.
+func Freeze(reason string) FreezeStatus {
+	freeze(reason)
+	utils.StagesLogger.Warn("Automatic movements frozen.", zap.String("reason", reason))
+	return GetFreezeStatus()
+}
+
+// Unfreeze resumes the automatic movements and runs the promotions and syncs queued while frozen.
+func Unfreeze() FreezeStatus {
+	freezeMutex.Lock()
+	wasFrozen := frozen
+	frozen, frozenSince, freezeReason = false, time.Time{}, ""
+	promotions, syncs := queuedPromotions, queuedSyncs
+	queuedPromotions, queuedSyncs = map[string]Database{}, map[string]Database{}
+	freezeMutex.Unlock()
+
+	if wasFrozen {
+		utils.StagesLogger.Info("Automatic movements resumed.", zap.Int("queuedPromotions", len(promotions)), zap.Int("queuedSyncs", len(syncs)))
+	}
+	for _, database := range syncs {
+		RunInBackground(func() { SyncToUpperStages(database) })
+	}
+	for _, database := range promotions {
+		PromoteInBackground(database)
+	}
+	return GetFreezeStatus()
+}
+
+// GetFreezeStatus returns whether the automatic movements are frozen and the operations queued meanwhile.
+func GetFreezeStatus() FreezeStatus {
+	freezeMutex.Lock()
+	defer freezeMutex.Unlock()
+
+	status := FreezeStatus{Frozen: frozen, Reason: freezeReason, PendingPromotions: []string{}, PendingSyncs: []string{}}
+	if frozen {
+		since := frozenSince
+		status.Since = &since
+	}
+	for name := range queuedPromotions {
+		status.PendingPromotions = append(status.PendingPromotions, name)
+	}
+	for name := range queuedSyncs {
+		status.PendingSyncs = append(status.PendingSyncs, name)
+	}
+	slices.Sort(status.PendingPromotions)
+	slices.Sort(status.PendingSyncs)
+	return status
+}
+
+// heldBack queues the operation of the database while the movements are frozen, it reports whether it was queued.
+func heldBack(queue map[string]Database, database Database) bool {
+	freezeMutex.Lock()
+	defer freezeMutex.Unlock()
+	if !frozen {
+		return false
+	}
+	queue[database.GetName()] = database
+	return true
+}
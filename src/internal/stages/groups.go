@@ -0,0 +1,69 @@
+package stages
+
+import (
+	"slices"
+	"strings"
+
+	"persisto/src/internal/coordination"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: the databases written by a transaction spanning several of them are synced as a group. Their mutexes are held
+// together, taken in the order of their names so that two groups never wait for each other, while each one is synced:
+// no write lands between the syncs and the upper stages receive the copies of the same commit. The bucket stores the
+// objects one by one, a group failing halfway is retried database by database like the other syncs, the copies then
+// converge to the last writes rather than to the same commit.
+
+// SyncGroupInBackground syncs the databases to the upper stages as a group in the background.
+func SyncGroupInBackground(group []Database) {
+	RunInBackground(func() { SyncGroupToUpperStages(group) })
+}
+
+// SyncGroupToUpperStages syncs the databases to the upper stages as a group, see SyncToUpperStages.
+func SyncGroupToUpperStages(group []Database) {
+	if !utils.Config.Settings.AutoSyncEnabled {
+		return
+	}
+	for _, database := range group {
+		if !coordination.Holds(database.GetName()) {
+			return
+		}
+	}
+	// NOTE: while frozen the databases are queued one by one, the group is synced on its own once unfrozen
+	if Frozen() {
+		for _, database := range group {
+			heldBack(queuedSyncs, database)
+		}
+		return
+	}
+
+	sorted := slices.SortedFunc(slices.Values(group), func(a, b Database) int { return strings.Compare(a.GetName(), b.GetName()) })
+
+	pendingSyncs.Add(int64(len(sorted)))
+	defer pendingSyncs.Add(-int64(len(sorted)))
+
+	for _, database := range sorted {
+		database.GetMutex().Lock()
+		defer database.GetMutex().Unlock()
+	}
+
+	utils.StagesLogger.Debug("Syncing group of databases to upper stages.", zap.Int("databases", len(sorted)))
+
+	for _, database := range sorted {
+		for stage := utils.GetNextFartherStage(database.GetStage()); stage != 0 && stage <= utils.GetFarthestStage(); stage = utils.GetNextFartherStage(stage) {
+			if err := syncToStage(database, stage); err != nil {
+				database.GetLogger().Error("Failed to sync database of a group to upper stage.", zap.Uint("stage", stage), zap.Error(err))
+				recordFailure(operationSync, database.GetName(), err)
+				for _, member := range sorted {
+					syncFailed(member, err)
+				}
+				return
+			}
+		}
+	}
+	for _, database := range sorted {
+		syncSucceeded(database)
+	}
+}
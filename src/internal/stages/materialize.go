@@ -0,0 +1,123 @@
+package stages
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"persisto/src/utils"
+
+	"github.com/ncruces/go-sqlite3/vfs"
+	"go.uber.org/zap"
+)
+
+// NOTE: page size of the materialized databases, the default of SQLite
+const emptyDatabasePageSize = 4096
+
+// NOTE: version of SQLite recorded in the header of the materialized databases, it is informational only
+const emptyDatabaseSQLiteVersion = 3046000
+
+// Materialize creates the file of the database at the stage as a valid empty database, doing nothing when it already
+// exists. The file is written through the VFS of the stage rather than by running a statement, so that nothing but the
+// file is created and a stage the credentials can only read is left untouched when the database is already there.
+func Materialize(database Database, stage uint) error {
+	vfsName, name, err := stageFile(database, stage)
+	if err != nil {
+		return err
+	}
+
+	backend := vfs.Find(vfsName)
+	if backend == nil {
+		return fmt.Errorf("vfs %s isn't registered", vfsName)
+	}
+
+	existed, err := backend.Access(name, vfs.ACCESS_EXISTS)
+	if err != nil {
+		return fmt.Errorf("failed to check the database file: %w", err)
+	}
+
+	file, _, err := backend.Open(name, vfs.OPEN_MAIN_DB|vfs.OPEN_READWRITE|vfs.OPEN_CREATE)
+	if err != nil {
+		return fmt.Errorf("failed to open the database file: %w", err)
+	}
+
+	written, err := writeEmptyDatabase(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// NOTE: the file created here is removed so that a failed initialization leaves nothing behind
+		if !existed {
+			if deleteErr := backend.Delete(name, false); deleteErr != nil {
+				database.GetLogger().Warn("Failed to remove the partially materialized database file.", zap.String("name", name), zap.Error(deleteErr))
+			}
+		}
+		return fmt.Errorf("failed to materialize the database file: %w", err)
+	}
+
+	if written {
+		database.GetLogger().Debug("Materialized database file.", zap.Uint("stage", stage), zap.String("name", name))
+	}
+	return nil
+}
+
+// writeEmptyDatabase writes an empty database to the file unless it already holds one, locking it the way SQLite does
+// before writing.
+func writeEmptyDatabase(file vfs.File) (bool, error) {
+	for _, lock := range []vfs.LockLevel{vfs.LOCK_SHARED, vfs.LOCK_RESERVED, vfs.LOCK_EXCLUSIVE} {
+		if err := file.Lock(lock); err != nil {
+			file.Unlock(vfs.LOCK_NONE)
+			return false, err
+		}
+	}
+	defer file.Unlock(vfs.LOCK_NONE)
+
+	size, err := file.Size()
+	if err != nil || size > 0 {
+		return false, err
+	}
+
+	if _, err := file.WriteAt(emptyDatabase(), 0); err != nil {
+		return false, err
+	}
+	return true, file.Sync(vfs.SYNC_FULL)
+}
+
+// emptyDatabase returns the single page of an empty database: the database header followed by the empty leaf page of
+// the schema table, see https://www.sqlite.org/fileformat2.html.
+func emptyDatabase() []byte {
+	page := make([]byte, emptyDatabasePageSize)
+
+	copy(page, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(page[16:], emptyDatabasePageSize)
+	// NOTE: legacy file format versions, SQLite switches them itself when the journal mode is set to WAL
+	page[18], page[19] = 1, 1
+	// NOTE: maximum and minimum embedded payload fractions and leaf payload fraction, fixed by the file format
+	page[21], page[22], page[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(page[24:], 1) // file change counter
+	binary.BigEndian.PutUint32(page[28:], 1) // size of the database in pages
+	binary.BigEndian.PutUint32(page[44:], 4) // schema format number
+	binary.BigEndian.PutUint32(page[56:], 1) // UTF-8 text encoding
+	binary.BigEndian.PutUint32(page[92:], 1) // version valid for, matching the change counter
+	binary.BigEndian.PutUint32(page[96:], emptyDatabaseSQLiteVersion)
+
+	// NOTE: the schema table is an empty table b-tree leaf whose cell content area starts at the end of the page
+	page[100] = 0x0d
+	binary.BigEndian.PutUint16(page[105:], emptyDatabasePageSize)
+
+	return page
+}
+
+// stageFile returns the VFS and the name of the file of the database at the stage.
+func stageFile(database Database, stage uint) (string, string, error) {
+	switch stage {
+	case utils.GetLocalStage():
+		if database.GetStage() == stage {
+			return vfsLocal, database.GetPath(), nil
+		}
+		return vfsLocal, LocalPath(database.GetName()), nil
+	case utils.GetRemoteStage():
+		return vfsRemote, GetRemoteKey(database), nil
+	default:
+		return "", "", fmt.Errorf("invalid stage: %d", stage)
+	}
+}
@@ -5,18 +5,34 @@ import (
 	"time"
 
 	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
 
 	"go.uber.org/zap"
 )
 
+var (
+	// NOTE: returns the databases currently managed, set when the stage monitor is setup
+	listDatabases = func() []Database { return []Database{} }
+	// NOTE: the time the inactivity and the residency of the databases are measured against, see SetMonitorClock
+	monitorNow = time.Now
+)
+
+// SetMonitorClock replaces the clock of the stage monitor, e.g. by a fake one driving the demotions of a test.
+func SetMonitorClock(now func() time.Time) {
+	monitorNow = now
+}
+
 func SetupStageMonitor(getDatabases func() []Database) {
+	listDatabases = getDatabases
+	setupFailback()
+
 	if !utils.Config.Settings.AutoStageMovement {
-		utils.Logger.Info("Auto stage movements disabled, not starting monitoring.")
+		utils.StagesLogger.Info("Auto stage movements disabled, not starting monitoring.")
 		return
 	}
 
 	go func() {
-		utils.Logger.Info(
+		utils.StagesLogger.Info(
 			"Starting stage monitor service.",
 			zap.Int("timeout", utils.Config.Settings.StageTimeoutSeconds),
 		)
@@ -26,14 +42,31 @@ func SetupStageMonitor(getDatabases func() []Database) {
 		defer ticker.Stop()
 
 		for range ticker.C {
-			databases := getDatabases()
-			MonitorAndDemoteDatabases(databases)
+			MonitorOnce()
 		}
 	}()
 }
 
+// MonitorOnce runs a round of the stage monitor, the demotions of the inactive databases run in the background.
+func MonitorOnce() {
+	if _, err := localvfs.ReconcileUsage(); err != nil {
+		utils.StagesLogger.Warn("Failed to reconcile local stage usage.", zap.Error(err))
+		recordFailure(operationScan, "", err)
+	}
+
+	MonitorAndDemoteDatabases(listDatabases())
+}
+
 func MonitorAndDemoteDatabases(databases []Database) {
-	utils.Logger.Debug("Checking databases for inactivity.", zap.Int("#databases", len(databases)))
+	if Frozen() {
+		utils.StagesLogger.Debug("Automatic movements frozen, not checking databases for inactivity.")
+		return
+	}
+
+	utils.StagesLogger.Debug("Checking databases for inactivity.", zap.Int("#databases", len(databases)))
+
+	start, demotions := time.Now(), 0
+	defer func() { recordScan(start, len(databases), demotions) }()
 
 	for _, database := range databases {
 		// NOTE: database is already on furthest stage, no demoting possible
@@ -43,19 +76,23 @@ func MonitorAndDemoteDatabases(databases []Database) {
 
 		database.GetMutex().RLock()
 
-		timeSinceAccess := time.Since(database.GetLastAccessed())
+		now := monitorNow()
+		timeSinceAccess := now.Sub(database.GetLastAccessed())
 		timeoutDuration := time.Duration(utils.Config.Settings.StageTimeoutSeconds) * time.Second
-		shouldDemote := timeSinceAccess >= timeoutDuration
+		residency := time.Duration(utils.Config.Settings.MinStageResidencySeconds) * time.Second
+		shouldDemote := timeSinceAccess >= timeoutDuration && now.Sub(database.GetMovedAt()) >= residency
 
 		database.GetMutex().RUnlock()
 
 		if shouldDemote {
-			utils.Logger.Debug(
+			utils.StagesLogger.Debug(
 				fmt.Sprintf("Stage Monitoring - Database '%s' inactive for %v, demoting.", database.GetName(), timeSinceAccess),
 				zap.Uint("currentStage", database.GetStage()),
 				zap.Duration("inactiveDuration", timeSinceAccess),
 			)
-			go demoteToFartherStage(database)
+			if runOnce(operationDemotion, database, func() { demoteToFartherStage(database) }) {
+				demotions++
+			}
 		}
 	}
 }
@@ -0,0 +1,60 @@
+package stages
+
+import (
+	"fmt"
+
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+)
+
+// NOTE: workloads a database may be declared with when it is created, restored or cloned, they pick its initial stage
+// together with its size rather than SETTINGS_DEFAULT_DATABASE_CREATION_STAGE alone
+const (
+	// NOTE: mostly read, placed in the local stage when it fits
+	WorkloadReadHeavy = "read_heavy"
+	// NOTE: mostly written, placed in the local stage when it fits, every write to the remote stage being a round trip
+	WorkloadWriteHeavy = "write_heavy"
+	// NOTE: rarely accessed, placed in the farthest stage whatever its size
+	WorkloadArchival = "archival"
+)
+
+// ValidateWorkload checks the workload is one of the declared ones, an empty workload declaring none.
+func ValidateWorkload(workload string) error {
+	switch workload {
+	case "", WorkloadReadHeavy, WorkloadWriteHeavy, WorkloadArchival:
+		return nil
+	}
+	return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid workload %s, valid workloads are %s, %s and %s", workload, WorkloadReadHeavy, WorkloadWriteHeavy, WorkloadArchival), nil)
+}
+
+// InitialStage returns the stage a new database of the size, 0 when empty, is placed at for the workload. A database
+// declaring no workload is placed at the default stage, unless it is too large for the local stage. The local stage is
+// only picked when the database fits in SETTINGS_LOCAL_PLACEMENT_MAX_BYTES and in what is left of the local stage
+// budget, no database is evicted to make room for a new one.
+func InitialStage(sizeBytes int64, workload string) uint {
+	fitsLocally := (utils.Config.Settings.LocalPlacementMaxBytes <= 0 || sizeBytes <= utils.Config.Settings.LocalPlacementMaxBytes) && localvfs.Fits(sizeBytes)
+
+	var stage uint
+	switch {
+	case workload == WorkloadArchival:
+		stage = utils.GetFarthestStage()
+	case workload == WorkloadReadHeavy || workload == WorkloadWriteHeavy:
+		stage = utils.GetClosestStage()
+		if !fitsLocally {
+			stage = utils.GetFarthestStage()
+		}
+	default:
+		stage = GetConfigDefaultStage()
+		if utils.IsClosestStage(stage) && !fitsLocally {
+			stage = utils.GetFarthestStage()
+		}
+	}
+	// NOTE: the farthest stage is the local one while the remote stage is offline, it then holds every database
+	return stage
+}
+
+// PlaceDatabase moves a database just added to the catalog to its initial stage, see InitialStage. The move is recorded
+// as its initial placement rather than as a move requested through the API.
+func PlaceDatabase(database Database, targetStage uint) error {
+	return moveDatabase(database, targetStage, PlacementInitial)
+}
@@ -0,0 +1,104 @@
+package stages
+
+import (
+	"sort"
+
+	"persisto/src/internal/coordination"
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+	"persisto/src/vfs/remotevfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: ensurePromotionCapacity makes room in the local stage for the database about to be promoted, the database mutex must be held
+func ensurePromotionCapacity(database Database) bool {
+	if localvfs.MaxBytes() <= 0 {
+		return true
+	}
+
+	size, err := remotevfs.FileSize(GetRemoteKey(database))
+	if err != nil {
+		database.GetLogger().Warn("Failed to get remote size of database before promotion.", zap.Error(err))
+		return false
+	}
+
+	return EnsureLocalCapacity(size, database)
+}
+
+// NOTE: share of the local stage budget freed when a write hits the budget
+const writeEvictionHeadroomRatio = 10
+
+// EvictForWrite frees part of the local stage budget after a write of the given database was refused for lack of space.
+func EvictForWrite(database Database) {
+	if localvfs.MaxBytes() <= 0 {
+		return
+	}
+
+	if !EnsureLocalCapacity(localvfs.MaxBytes()/writeEvictionHeadroomRatio, database) {
+		database.GetLogger().Warn("Failed to free local stage capacity after a refused write.", zap.String("database", database.GetName()))
+	}
+}
+
+// EnsureLocalCapacity evicts the least recently accessed local databases, other than exclude, to the farther stage
+// until required bytes fit in the local stage budget. It reports whether the required bytes fit.
+func EnsureLocalCapacity(required int64, exclude Database) bool {
+	if localvfs.Fits(required) {
+		return true
+	}
+
+	if Frozen() {
+		utils.StagesLogger.Warn("Automatic movements frozen, not evicting databases from the local stage.", zap.Int64("required", required))
+		return false
+	}
+
+	if required > localvfs.MaxBytes() {
+		utils.StagesLogger.Warn("Required bytes exceed the whole local stage budget.", zap.Int64("required", required), zap.Int64("maxBytes", localvfs.MaxBytes()))
+		return false
+	}
+
+	var candidates []Database
+	for _, database := range listDatabases() {
+		if database != exclude && utils.IsClosestStage(database.GetStage()) && coordination.Holds(database.GetName()) {
+			candidates = append(candidates, database)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].GetLastAccessed().Before(candidates[j].GetLastAccessed())
+	})
+
+	for _, candidate := range candidates {
+		if localvfs.Fits(required) {
+			break
+		}
+
+		// NOTE: skip databases busy with another operation, waiting could deadlock with a concurrent eviction
+		if !candidate.GetMutex().TryLock() {
+			continue
+		}
+
+		if utils.IsClosestStage(candidate.GetStage()) {
+			utils.StagesLogger.Info(
+				"Evicting database from local stage to free capacity.",
+				zap.String("database", candidate.GetName()),
+				zap.Int64("required", required),
+				zap.Int64("usedBytes", localvfs.UsedBytes()),
+				zap.Int64("maxBytes", localvfs.MaxBytes()),
+			)
+			localPath := candidate.GetPath()
+			moveToFartherStage(candidate, PlacementEviction)
+
+			// NOTE: demotion leaves the local copy behind, it has to be removed to actually free capacity
+			if !utils.IsClosestStage(candidate.GetStage()) {
+				if err := localvfs.Delete(localPath); err != nil {
+					utils.StagesLogger.Warn("Failed to remove evicted database from local stage.", zap.String("database", candidate.GetName()), zap.String("path", localPath), zap.Error(err))
+				}
+			}
+		}
+
+		candidate.GetMutex().Unlock()
+	}
+
+	return localvfs.Fits(required)
+}
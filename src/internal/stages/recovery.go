@@ -0,0 +1,155 @@
+package stages
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"persisto/src/internal/journal"
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+
+	"go.uber.org/zap"
+)
+
+// journalMove records the move of the database to the target stage in the journal, the move must not start when it
+// fails. The returned function removes the intent once the move ended.
+func journalMove(database Database, targetStage uint) (func(), error) {
+	id, err := journal.Begin(journal.Intent{Operation: journal.OperationMove, Database: database.GetName(), SourceStage: database.GetStage(), TargetStage: targetStage})
+	if err != nil {
+		return nil, err
+	}
+	return func() { journal.End(id) }, nil
+}
+
+// VerifyCopy checks the copy of the database at the stage opens and passes the SQLite integrity check, it is opened
+// read-only and immutable.
+func VerifyCopy(name string, stage uint) error {
+	connectionString, err := ConnectionString(name, stage, ConnectionOptions{ReadOnly: true, Immutable: true, WithoutPragmas: true})
+	if err != nil {
+		return err
+	}
+	return utils.VerifyDatabaseIntegrity(connectionString)
+}
+
+// RecoverMove replays the move of the database from the source stage to the target stage interrupted by a crash, see
+// journal.Pending, before the catalog is built. It returns the outcome of the replay.
+//
+// The copy of a move is made with the database mutex held and the intent is removed before the mutex is released, so
+// nothing was written to the database since the move was interrupted: the copy at the source stage holds its last
+// writes, the one at the target stage may be missing or half-written.
+func RecoverMove(name string, sourceStage, targetStage uint) (string, error) {
+	local, remote := utils.GetLocalStage(), utils.GetRemoteStage()
+
+	if utils.RemoteOffline() {
+		// NOTE: the catalog is built from the local stage, the local copy left by a promotion is only discarded when it
+		// isn't whole. The moves are replayed at the next startup with the remote stage, whose copy is then checked.
+		if sourceStage != local {
+			if err := VerifyCopy(name, local); err != nil {
+				return journal.OutcomeRolledBack, removeLocalCopy(name)
+			}
+		}
+		return journal.OutcomeDeferred, nil
+	}
+
+	// NOTE: the local storage directory was emptied at startup, the promoted copy went with it and the database is
+	// served from the remote stage again
+	if targetStage == local {
+		return journal.OutcomeRolledBack, nil
+	}
+
+	if sourceStage != local || targetStage != remote {
+		return journal.OutcomeFailed, fmt.Errorf("unsupported move from stage %d to stage %d", sourceStage, targetStage)
+	}
+
+	// NOTE: the local copy was kept at startup, see localvfs.RegisterLocalVfs, it holds the last writes while the remote
+	// copy may be whole but older, e.g. when the crash hit the sync before the demotion. A whole remote copy is only kept
+	// when the local one is gone or isn't whole, the move had then ended and only its intent was left behind.
+	if _, err := os.Stat(LocalPath(name)); err != nil || VerifyCopy(name, local) != nil {
+		if err := VerifyCopy(name, remote); err == nil {
+			return journal.OutcomeRolledForward, removeLocalCopy(name)
+		}
+	}
+	return uploadLocalCopy(name)
+}
+
+// RecoverOfflineWrite uploads the local copy of the database written while the remote stage was offline, see
+// journal.OperationOfflineWrite, it is the only copy holding those writes. The upload is deferred while the remote stage
+// is still offline, the database is then served from its local copy.
+func RecoverOfflineWrite(name string) (string, error) {
+	if utils.RemoteOffline() {
+		return journal.OutcomeDeferred, nil
+	}
+	return uploadLocalCopy(name)
+}
+
+// RecoverTieredWrite uploads the companion of the database written since its last upload, see
+// journal.OperationTieredWrite, it was kept at startup and is the only copy holding those writes. The upload is deferred
+// while the remote stage is offline, the companion is then attached as it is.
+func RecoverTieredWrite(name string) (string, error) {
+	if utils.RemoteOffline() {
+		return journal.OutcomeDeferred, nil
+	}
+	if _, err := os.Stat(TieredPath(name)); err != nil {
+		return journal.OutcomeFailed, fmt.Errorf("the local companion is gone: %v", err)
+	}
+	if _, err := UploadCompanion(name); err != nil {
+		return journal.OutcomeFailed, err
+	}
+	return journal.OutcomeRolledForward, nil
+}
+
+// uploadLocalCopy replaces the remote copy of the database by its local copy, kept at startup, and removes the local
+// copy once the remote one is verified.
+func uploadLocalCopy(name string) (string, error) {
+	if _, err := os.Stat(LocalPath(name)); err != nil {
+		return journal.OutcomeFailed, fmt.Errorf("the local copy is gone: %v", err)
+	}
+	if err := VerifyCopy(name, utils.GetLocalStage()); err != nil {
+		return journal.OutcomeFailed, fmt.Errorf("the local copy isn't whole: %v", err)
+	}
+
+	if err := copyLocalToRemote(name); err != nil {
+		return journal.OutcomeFailed, err
+	}
+	if err := VerifyCopy(name, utils.GetRemoteStage()); err != nil {
+		return journal.OutcomeFailed, fmt.Errorf("failed to verify the remote copy: %v", err)
+	}
+	return journal.OutcomeRolledForward, removeLocalCopy(name)
+}
+
+// copyLocalToRemote replaces the remote copy of the database by its local copy.
+func copyLocalToRemote(name string) error {
+	if err := deleteTargetFile(name, utils.GetRemoteStage()); err != nil {
+		return err
+	}
+
+	sourceDB, err := sql.Open("sqlite3", LocalConnectionString(LocalPath(name), ConnectionOptions{ReadOnly: true}))
+	if err != nil {
+		return fmt.Errorf("failed to open the local copy: %v", err)
+	}
+	defer sourceDB.Close()
+
+	targetConnection, err := ConnectionString(name, utils.GetRemoteStage(), ConnectionOptions{})
+	if err != nil {
+		return err
+	}
+	return executeDatabaseCopy(sourceDB, targetConnection)
+}
+
+// removeLocalCopy removes the local copy of the database along with its journals.
+func removeLocalCopy(name string) error {
+	var failures []error
+	localPath := LocalPath(name)
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		if err := localvfs.Delete(localPath + suffix); err != nil {
+			failures = append(failures, err)
+		}
+	}
+	if err := errors.Join(failures...); err != nil {
+		utils.StagesLogger.Warn("Failed to remove the local copy of a database.", zap.String("database", name), zap.Error(err))
+		return fmt.Errorf("failed to remove the local copy: %v", err)
+	}
+	return nil
+}
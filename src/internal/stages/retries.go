@@ -0,0 +1,160 @@
+package stages
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: a failed background sync is retried SETTINGS_SYNC_MAX_RETRIES times, waiting twice as long before every retry
+// up to maxSyncRetryInterval. A database still failing afterwards is dead-lettered: it is left for an operator until its
+// next successful sync, whether triggered by a write, a manual sync or a retry through the API.
+const maxSyncRetryInterval = 5 * time.Minute
+
+// DeadLetter is a database whose background syncs kept failing after all of their retries.
+type DeadLetter struct {
+	Database      string    `json:"database"`
+	Failures      int       `json:"failures" doc:"Failed syncs, the first one included."`
+	FirstFailedAt time.Time `json:"first_failed_at"`
+	LastFailedAt  time.Time `json:"last_failed_at"`
+	Error         string    `json:"error" doc:"Error of the last failed sync."`
+}
+
+// syncFailure tracks the failed syncs of a database since its last successful one.
+type syncFailure struct {
+	failures      int
+	firstFailedAt time.Time
+	// NOTE: set once the retries are exhausted, the database is then no longer retried automatically
+	deadLettered bool
+	lastFailedAt time.Time
+	lastError    string
+}
+
+var (
+	syncFailures      = map[string]*syncFailure{}
+	syncFailuresMutex sync.Mutex
+)
+
+// syncRetryDelay returns how long to wait before the retry following the given failures.
+func syncRetryDelay(failures int) time.Duration {
+	delay := time.Duration(utils.Config.Settings.SyncRetryIntervalMilliseconds) * time.Millisecond
+	for range failures - 1 {
+		if delay *= 2; delay >= maxSyncRetryInterval {
+			return maxSyncRetryInterval
+		}
+	}
+	return delay
+}
+
+// syncFailed schedules a retry of the failed sync of the database, or dead-letters it once its retries are exhausted.
+func syncFailed(database Database, err error) {
+	name := database.GetName()
+	now := time.Now().UTC()
+
+	syncFailuresMutex.Lock()
+	failure, exists := syncFailures[name]
+	if !exists {
+		failure = &syncFailure{firstFailedAt: now}
+		syncFailures[name] = failure
+	}
+	failure.failures++
+	failure.lastFailedAt, failure.lastError = now, err.Error()
+	failures, deadLettered := failure.failures, failure.deadLettered
+	exhausted := !deadLettered && failures > utils.Config.Settings.SyncMaxRetries
+	if exhausted {
+		failure.deadLettered = true
+	}
+	syncFailuresMutex.Unlock()
+
+	switch {
+	case deadLettered:
+		return
+	case exhausted:
+		database.GetLogger().Error("Sync of database kept failing, dead-lettering it.", zap.Int("failures", failures), zap.Error(err))
+		audit.Record(audit.Event{
+			Type:     audit.EventSyncDeadLettered,
+			Database: name,
+			Details:  map[string]any{"failures": failures, "error": err.Error()},
+		})
+	default:
+		delay := syncRetryDelay(failures)
+		database.GetLogger().Warn("Retrying failed sync of database.", zap.Int("failures", failures), zap.Duration("delay", delay))
+		time.AfterFunc(delay, func() {
+			// NOTE: a sync succeeding meanwhile cancels the retry, a newer failure schedules its own
+			syncFailuresMutex.Lock()
+			current, pending := syncFailures[name]
+			pending = pending && current == failure && current.failures == failures
+			syncFailuresMutex.Unlock()
+			if pending {
+				RunInBackground(func() { SyncToUpperStages(database) })
+			}
+		})
+	}
+}
+
+// syncSucceeded forgets the failed syncs of the database, taking it out of the dead letters.
+func syncSucceeded(database Database) {
+	syncFailuresMutex.Lock()
+	failure, exists := syncFailures[database.GetName()]
+	delete(syncFailures, database.GetName())
+	syncFailuresMutex.Unlock()
+
+	if exists {
+		database.GetLogger().Info("Sync of database succeeded after failing.", zap.Int("failures", failure.failures), zap.Bool("deadLettered", failure.deadLettered))
+	}
+}
+
+// DeadLetters returns the databases whose background syncs kept failing, sorted by name.
+func DeadLetters() []DeadLetter {
+	syncFailuresMutex.Lock()
+	defer syncFailuresMutex.Unlock()
+
+	deadLetters := []DeadLetter{}
+	for name, failure := range syncFailures {
+		if failure.deadLettered {
+			deadLetters = append(deadLetters, DeadLetter{
+				Database:      name,
+				Failures:      failure.failures,
+				FirstFailedAt: failure.firstFailedAt,
+				LastFailedAt:  failure.lastFailedAt,
+				Error:         failure.lastError,
+			})
+		}
+	}
+	slices.SortFunc(deadLetters, func(a, b DeadLetter) int { return strings.Compare(a.Database, b.Database) })
+	return deadLetters
+}
+
+// SyncRetryCounts returns the databases whose failed sync waits for a retry and the dead-lettered ones.
+func SyncRetryCounts() (retrying int, deadLettered int) {
+	syncFailuresMutex.Lock()
+	defer syncFailuresMutex.Unlock()
+
+	for _, failure := range syncFailures {
+		if failure.deadLettered {
+			deadLettered++
+		} else {
+			retrying++
+		}
+	}
+	return retrying, deadLettered
+}
+
+// DismissDeadLetter takes the database out of the dead letters without syncing it, it reports whether it was in them.
+func DismissDeadLetter(name string) bool {
+	syncFailuresMutex.Lock()
+	defer syncFailuresMutex.Unlock()
+
+	failure, exists := syncFailures[name]
+	if !exists || !failure.deadLettered {
+		return false
+	}
+	delete(syncFailures, name)
+	return true
+}
@@ -0,0 +1,217 @@
+package stages
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+)
+
+// NOTE: the accesses of every database over the last SETTINGS_ACCESS_HISTORY_SECONDS are kept so that the promotions
+// and demotions other settings would have caused can be replayed without moving anything. The replay follows the
+// request counts and the monitor ticks, it leaves out the local capacity, the freezes and the moves requested through
+// the API, and the oldest accesses of a database are dropped past maxRecordedAccesses.
+const maxRecordedAccesses = 10000
+
+// SimulationSettings are the settings of the automatic movements a simulation replays the accesses against.
+type SimulationSettings struct {
+	RequestCountThreshold    uint `json:"request_count_threshold" minimum:"1" doc:"See SETTINGS_REQUEST_COUNT_THRESHOLD."`
+	StageTimeoutSeconds      int  `json:"stage_timeout_seconds" minimum:"1" doc:"See SETTINGS_STAGE_TIMEOUT_SECONDS."`
+	MinStageResidencySeconds int  `json:"min_stage_residency_seconds" minimum:"0" doc:"See SETTINGS_MIN_STAGE_RESIDENCY_SECONDS."`
+	MoveCooldownSeconds      int  `json:"move_cooldown_seconds" minimum:"0" doc:"See SETTINGS_MOVE_COOLDOWN_SECONDS."`
+}
+
+// CurrentSimulationSettings returns the settings the automatic movements run with.
+func CurrentSimulationSettings() SimulationSettings {
+	return SimulationSettings{
+		RequestCountThreshold:    utils.Config.Settings.RequestCountThreshold,
+		StageTimeoutSeconds:      utils.Config.Settings.StageTimeoutSeconds,
+		MinStageResidencySeconds: utils.Config.Settings.MinStageResidencySeconds,
+		MoveCooldownSeconds:      utils.Config.Settings.MoveCooldownSeconds,
+	}
+}
+
+// SimulatedMove is a move a simulation found the settings would have caused.
+type SimulatedMove struct {
+	At     time.Time `json:"at"`
+	From   uint      `json:"from"`
+	To     uint      `json:"to"`
+	Reason string    `json:"reason" doc:"promotion or demotion."`
+}
+
+// SimulatedOutcome is what the accesses of a database would have caused under some settings.
+type SimulatedOutcome struct {
+	Promotions int             `json:"promotions"`
+	Demotions  int             `json:"demotions"`
+	FinalStage uint            `json:"final_stage"`
+	Moves      []SimulatedMove `json:"moves,omitempty"`
+}
+
+// DatabaseSimulation compares what the accesses of a database would have caused under the current and the proposed
+// settings.
+type DatabaseSimulation struct {
+	Database     string           `json:"database"`
+	InitialStage uint             `json:"initial_stage"`
+	Accesses     int              `json:"accesses"`
+	Current      SimulatedOutcome `json:"current" doc:"Moves under the current settings, without their details."`
+	Proposed     SimulatedOutcome `json:"proposed"`
+}
+
+// Simulation is the replay of the recorded accesses against the current and the proposed settings.
+type Simulation struct {
+	From               time.Time            `json:"from"`
+	To                 time.Time            `json:"to"`
+	Current            SimulationSettings   `json:"current"`
+	Proposed           SimulationSettings   `json:"proposed"`
+	CurrentPromotions  int                  `json:"current_promotions"`
+	CurrentDemotions   int                  `json:"current_demotions"`
+	ProposedPromotions int                  `json:"proposed_promotions"`
+	ProposedDemotions  int                  `json:"proposed_demotions"`
+	Databases          []DatabaseSimulation `json:"databases"`
+}
+
+type access struct {
+	at    time.Time
+	stage uint
+}
+
+var (
+	accesses      = map[string][]access{}
+	accessesMutex sync.Mutex
+	// NOTE: nothing is recorded before the start of the process, the replays don't go past it
+	accessesSince = time.Now()
+)
+
+func accessHistory() time.Duration {
+	return time.Duration(utils.Config.Settings.AccessHistorySeconds) * time.Second
+}
+
+// pruneAccesses drops the accesses older than the history, accessesMutex must be held.
+func pruneAccesses(recorded []access, now time.Time) []access {
+	index := sort.Search(len(recorded), func(i int) bool { return now.Sub(recorded[i].at) < accessHistory() })
+	return recorded[index:]
+}
+
+// RecordAccess adds an access to the database served from the stage to the history the simulations replay.
+func RecordAccess(name string, stage uint) {
+	if utils.Config.Settings.AccessHistorySeconds == 0 {
+		return
+	}
+
+	now := time.Now()
+	accessesMutex.Lock()
+	defer accessesMutex.Unlock()
+
+	recorded := append(pruneAccesses(accesses[name], now), access{at: now, stage: stage})
+	if len(recorded) > maxRecordedAccesses {
+		recorded = recorded[len(recorded)-maxRecordedAccesses:]
+	}
+	accesses[name] = recorded
+}
+
+// Simulate replays the accesses recorded for the databases of the catalog against the current and the proposed
+// settings and reports the promotions and demotions each would have caused, without moving anything.
+func Simulate(proposed SimulationSettings) Simulation {
+	now := time.Now()
+	from := now.Add(-accessHistory())
+	if from.Before(accessesSince) {
+		from = accessesSince
+	}
+
+	simulation := Simulation{From: from.UTC(), To: now.UTC(), Current: CurrentSimulationSettings(), Proposed: proposed, Databases: []DatabaseSimulation{}}
+
+	history := map[string][]access{}
+	accessesMutex.Lock()
+	for name, recorded := range accesses {
+		if recorded = pruneAccesses(recorded, now); len(recorded) == 0 {
+			delete(accesses, name)
+			continue
+		}
+		accesses[name] = recorded
+		history[name] = recorded
+	}
+	accessesMutex.Unlock()
+
+	for _, database := range listDatabases() {
+		recorded := history[database.GetName()]
+		stage := database.GetStage()
+		if len(recorded) > 0 {
+			stage = recorded[0].stage
+		}
+
+		current := replay(stage, recorded, from, now, simulation.Current)
+		current.Moves = nil
+		result := DatabaseSimulation{
+			Database:     database.GetName(),
+			InitialStage: stage,
+			Accesses:     len(recorded),
+			Current:      current,
+			Proposed:     replay(stage, recorded, from, now, proposed),
+		}
+
+		simulation.CurrentPromotions += result.Current.Promotions
+		simulation.CurrentDemotions += result.Current.Demotions
+		simulation.ProposedPromotions += result.Proposed.Promotions
+		simulation.ProposedDemotions += result.Proposed.Demotions
+		simulation.Databases = append(simulation.Databases, result)
+	}
+
+	sort.Slice(simulation.Databases, func(i, j int) bool { return simulation.Databases[i].Database < simulation.Databases[j].Database })
+	return simulation
+}
+
+// replay runs the automatic movements of a database starting at the stage over the accesses: it is promoted once its
+// requests since its last move reach the threshold and demoted by the first monitor tick finding it idle for the
+// timeout, as MonitorAndDemoteDatabases and the requests do.
+func replay(stage uint, recorded []access, from time.Time, to time.Time, settings SimulationSettings) SimulatedOutcome {
+	outcome := SimulatedOutcome{Moves: []SimulatedMove{}}
+	timeout := time.Duration(settings.StageTimeoutSeconds) * time.Second
+	residency := time.Duration(settings.MinStageResidencySeconds) * time.Second
+	cooldown := time.Duration(settings.MoveCooldownSeconds) * time.Second
+	interval := max(timeout/2, time.Second)
+
+	var requests uint
+	// NOTE: the database is taken as accessed at the start of the replay and as not moved for long before it
+	lastAccess, movedAt := from, from.Add(-max(residency, cooldown))
+
+	move := func(at time.Time, target uint, reason string) {
+		outcome.Moves = append(outcome.Moves, SimulatedMove{At: at.UTC(), From: stage, To: target, Reason: reason})
+		if reason == PlacementPromotion {
+			outcome.Promotions++
+		} else {
+			outcome.Demotions++
+		}
+		stage, movedAt, requests = target, at, 0
+	}
+
+	// NOTE: demotes the database on the monitor ticks until the time, the ticks being every half timeout from the start
+	demoteUntil := func(until time.Time) {
+		for !utils.IsFarthestStage(stage) {
+			due := lastAccess.Add(timeout)
+			if settled := movedAt.Add(residency); settled.After(due) {
+				due = settled
+			}
+			ticks := (due.Sub(from) + interval - 1) / interval
+			tick := from.Add(ticks * interval)
+			if tick.After(until) {
+				return
+			}
+			move(tick, utils.GetNextFartherStage(stage), PlacementDemotion)
+		}
+	}
+
+	for _, recorded := range recorded {
+		demoteUntil(recorded.at)
+
+		lastAccess = recorded.at
+		requests++
+		if requests >= settings.RequestCountThreshold && !utils.IsClosestStage(stage) && recorded.at.Sub(movedAt) >= cooldown {
+			move(recorded.at, utils.GetNextCloserStage(stage), PlacementPromotion)
+		}
+	}
+	demoteUntil(to)
+
+	outcome.FinalStage = stage
+	return outcome
+}
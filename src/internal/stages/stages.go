@@ -1,12 +1,20 @@
 package stages
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"persisto/src/internal/audit"
+	"persisto/src/internal/checks"
+	"persisto/src/internal/coordination"
 	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+	"persisto/src/vfs/remotevfs"
 
 	"go.uber.org/zap"
 
@@ -25,9 +33,42 @@ type Database = interface {
 	SetLastAccessed(time.Time)
 	GetRequestCount() uint
 	SetRequestCount(uint)
-	GetMutex() *sync.RWMutex
+	GetMutex() *utils.CatalogMutex
+	GetLogger() *zap.Logger
+	// NOTE: stage the database is moving to, 0 when it isn't moving
+	GetMovingTo() uint
+	SetMovingTo(stage uint)
+	// NOTE: time of the last move, zero when the database never moved
+	GetMovedAt() time.Time
+	SetMovedAt(time.Time)
+	// NOTE: why the database is at its current stage, one of the Placement constants
+	GetPlacement() string
+	SetPlacement(reason string)
+	// NOTE: last write the copy of the database at the stage holds, the reads are only served from copies holding them all
+	GetCopySequence(stage uint) uint64
+	SetCopySequence(stage uint, sequence uint64)
+	// NOTE: uploads the companion holding the tiered tables when its remote copy misses writes, see TieredPath
+	PersistCompanion() error
 }
 
+// NOTE: reasons a database is at its current stage, reported in the catalog and the database.moved audit events
+const (
+	// NOTE: the database is at the stage it was loaded or created at and never moved since
+	PlacementInitial = "initial"
+	// NOTE: moved through the API
+	PlacementManual = "manual"
+	// NOTE: promoted after reaching SETTINGS_PROMOTION_THRESHOLD
+	PlacementPromotion = "promotion"
+	// NOTE: demoted after SETTINGS_STAGE_TIMEOUT_SECONDS without access
+	PlacementDemotion = "demotion"
+	// NOTE: demoted to free local capacity for another database
+	PlacementEviction = "eviction"
+	// NOTE: local copy dropped once this instance lost the lease of the database
+	PlacementLeaseLost = "lease_lost"
+	// NOTE: local copy adopted from the standby being promoted
+	PlacementStandbyPromoted = "standby_promoted"
+)
+
 type Stage struct {
 	Index uint
 	Name  string
@@ -41,59 +82,92 @@ var (
 
 func SetupStages() {
 	setupStageOnce.Do(func() {
-		utils.Logger.Info("Setting up stages configuration.")
+		utils.StagesLogger.Info("Setting up stages configuration.")
 
 		Stages = []Stage{
 			{Index: utils.Config.Storage.Local.StageNumber, Name: utils.Config.Storage.Local.Name},
 			{Index: utils.Config.Storage.Remote.StageNumber, Name: utils.Config.Storage.Remote.Name},
 		}
 
-		utils.Logger.Info("Stages configuration loaded.", zap.Int("count", len(Stages)), zap.Reflect("stages", Stages))
+		utils.StagesLogger.Info("Stages configuration loaded.", zap.Int("count", len(Stages)), zap.Reflect("stages", Stages))
+
+		if utils.Config.Settings.FreezeMovement {
+			Freeze("frozen by SETTINGS_FREEZE_MOVEMENT")
+		}
 	})
 }
 
-func MoveToStage(database Database, targetStage uint) error {
-	utils.Logger.Debug("Moving database to different stage.", zap.Uint("currentStage", database.GetStage()), zap.Uint("targetStage", targetStage), zap.Reflect("database", database))
+// MoveToStage copies the database to the target stage and serves it from there, recording reason as its placement. The
+// database mutex must be held, the requests hold it shared while their connection is open, so the move waited for them
+// to end and none of them sees the database half-moved.
+func MoveToStage(database Database, targetStage uint, reason string) error {
+	return moveToStage(database, targetStage, reason, false)
+}
+
+// moveToStage is MoveToStage, the move being recorded in the journal by the caller when journaled is set.
+func moveToStage(database Database, targetStage uint, reason string, journaled bool) error {
+	database.GetLogger().Debug("Moving database to different stage.", zap.Uint("currentStage", database.GetStage()), zap.Uint("targetStage", targetStage))
 	if !utils.IsValidStage(targetStage) {
 		minStage, maxStage := utils.GetValidStageRange()
-		utils.Logger.Error("Invalid targetStage.", zap.Uint("targetStage", targetStage))
+		database.GetLogger().Error("Invalid targetStage.", zap.Uint("targetStage", targetStage))
 		return fmt.Errorf("invalid stage: %d. Valid stages are %d-%d", targetStage, minStage, maxStage)
 	}
 
 	if database.GetStage() == targetStage {
-		utils.Logger.Error("Database already at targetStage.", zap.Uint("targetStage", targetStage), zap.Reflect("database", database))
+		database.GetLogger().Error("Database already at targetStage.", zap.Uint("targetStage", targetStage))
 		return nil
 	}
 
+	// NOTE: a demotion is journaled before its copies are synced, see moveToFartherStage
+	if !journaled {
+		end, err := journalMove(database, targetStage)
+		if err != nil {
+			database.GetLogger().Error("Failed to journal the move, not moving the database.", zap.Uint("targetStage", targetStage), zap.Error(err))
+			return fmt.Errorf("failed to journal the move: %v", err)
+		}
+		defer end()
+	}
+
 	originalStage := database.GetStage()
 
+	// NOTE: tells the requests waiting for the database that it is moving, so that they retry rather than block
+	database.SetMovingTo(targetStage)
+	defer database.SetMovingTo(0)
+
 	// Sync data to target stage
 	err := syncToStage(database, targetStage)
 	if err != nil {
-		utils.Logger.Error("Failed to sync database to target stage.", zap.Uint("targetStage", targetStage), zap.Reflect("database", database), zap.Error(err))
+		database.GetLogger().Error("Failed to sync database to target stage.", zap.Uint("targetStage", targetStage), zap.Error(err))
 		return fmt.Errorf("failed to sync database to target stage: %v", err)
 	}
 
 	// Update database stage and path
 	database.SetStage(targetStage)
 	updateDatabasePath(database, targetStage)
+	placed(database, originalStage, reason)
 
 	// Verify database integrity for downward moves (closer to user)
 	if targetStage < originalStage {
-		connectionString, err := database.GetConnectionString()
+		connectionString, err := ConnectionString(database.GetName(), targetStage, ConnectionOptions{ReadOnly: true, Immutable: true, WithoutPragmas: true})
 		if err != nil {
 			database.SetStage(originalStage)
 			updateDatabasePath(database, originalStage)
-			utils.Logger.Error("Failed to get connection string after move, restoring originalStage.", zap.Uint("targetStage", targetStage), zap.Reflect("database", database), zap.Error(err))
+			database.GetLogger().Error("Failed to get connection string after move, restoring originalStage.", zap.Uint("targetStage", targetStage), zap.Error(err))
 			return fmt.Errorf("failed to get connection string after move: %v", err)
 		}
 		err = utils.VerifyDatabaseIntegrity(connectionString)
 		if err != nil {
 			// TODO: might rollback syncing and return error ?
-			utils.Logger.Warn("Database integrity check failed.", zap.Reflect("database", database), zap.Error(err))
+			database.GetLogger().Error("Database integrity check failed.", zap.Error(err))
 		}
 	}
 
+	// NOTE: the database is already served from the target stage, a failing check is reported rather than undone
+	if err := verifyChecksAtStage(database, targetStage); err != nil {
+		database.GetLogger().Error("Database failed its checks after the move.", zap.Uint("targetStage", targetStage), zap.Error(err))
+		recordFailure(operationVerification, database.GetName(), err)
+	}
+
 	return nil
 }
 
@@ -101,39 +175,39 @@ func MoveToStage(database Database, targetStage uint) error {
 func syncToStage(database Database, targetStage uint) error {
 	sourceConnection, err := database.GetConnectionString()
 	if err != nil {
-		utils.Logger.Error("Failed to get source connection string.", zap.Reflect("database", database), zap.Error(err))
+		database.GetLogger().Error("Failed to get source connection string.", zap.Error(err))
 		return fmt.Errorf("failed to get source connection string: %v", err)
 	}
 
 	sourceDB, err := sql.Open("sqlite3", sourceConnection)
 	if err != nil {
-		utils.Logger.Error("Failed to open source database.", zap.Error(err))
+		database.GetLogger().Error("Failed to open source database.", zap.Error(err))
 		return fmt.Errorf("failed to open source database: %v", err)
 	}
 	defer sourceDB.Close()
 
 	err = sourceDB.Ping()
 	if err != nil {
-		utils.Logger.Error("Source database ping failed.", zap.Reflect("database", database), zap.String("connectionString", sourceConnection))
+		database.GetLogger().Error("Source database ping failed.", zap.String("connectionString", sourceConnection))
 		return fmt.Errorf("source database ping failed: %v", err)
 	}
 
 	targetConn, err := GetConnectionStringForStage(database, targetStage)
 	if err != nil {
-		utils.Logger.Error("Failed to get target connection string.", zap.Uint("targetStage", targetStage), zap.Reflect("database", database), zap.Error(err))
+		database.GetLogger().Error("Failed to get target connection string.", zap.Uint("targetStage", targetStage), zap.Error(err))
 		return fmt.Errorf("failed to get target connection string: %v", err)
 	}
 
 	targetDB, err := sql.Open("sqlite3", targetConn)
 	if err != nil {
-		utils.Logger.Error("Failed to open target database.", zap.Uint("targetStage", targetStage), zap.Reflect("database", database))
+		database.GetLogger().Error("Failed to open target database.", zap.Uint("targetStage", targetStage))
 		return fmt.Errorf("failed to open target database: %v", err)
 	}
 	defer targetDB.Close()
 
 	err = targetDB.Ping()
 	if err != nil {
-		utils.Logger.Error("Target database ping failed.", zap.Uint("targetStage", targetStage), zap.Reflect("database", database))
+		database.GetLogger().Error("Target database ping failed.", zap.Uint("targetStage", targetStage))
 		return fmt.Errorf("target database ping failed: %v", err)
 	}
 
@@ -142,10 +216,17 @@ func syncToStage(database Database, targetStage uint) error {
 	err = copyDataBetweenStages(database, originalStage, targetStage)
 
 	if err != nil {
-		utils.Logger.Error("Failed to copy database data.", zap.Uint("sourceStage", originalStage), zap.Uint("targetStage", targetStage), zap.Reflect("database", database))
+		database.GetLogger().Error("Failed to copy database data.", zap.Uint("sourceStage", originalStage), zap.Uint("targetStage", targetStage))
 		return fmt.Errorf("failed to copy database data: %v", err)
 	}
 
+	// NOTE: the tiered tables are persisted with the database, a sync to the remote stage covers both
+	if targetStage == utils.GetRemoteStage() {
+		if err := database.PersistCompanion(); err != nil {
+			database.GetLogger().Error("Failed to persist the tiered tables.", zap.Error(err))
+			return fmt.Errorf("failed to persist the tiered tables: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -174,23 +255,83 @@ func GetConfigRequestThreshold() uint {
 	return utils.Config.Settings.RequestCountThreshold
 }
 
+const (
+	operationPromotion = "promotion"
+	operationDemotion  = "demotion"
+	// NOTE: kinds of the failures reported by the monitor status besides the operations above
+	operationSync         = "sync"
+	operationScan         = "scan"
+	operationVerification = "verification"
+)
+
+// NOTE: stage operations scheduled or running, keyed by operation and database, a burst of requests or monitoring ticks
+// meeting one of them doesn't schedule another one
+var pendingOperations sync.Map
+
+// runOnce runs the stage operation of the database in the background, unless the same operation is already pending for
+// it. It reports whether the operation was scheduled.
+func runOnce(kind string, database Database, operation func()) bool {
+	key := kind + "/" + database.GetName()
+	if _, pending := pendingOperations.LoadOrStore(key, struct{}{}); pending {
+		database.GetLogger().Debug("Stage operation already pending, not scheduling it again.", zap.String("operation", kind))
+		return false
+	}
+	RunInBackground(func() {
+		defer pendingOperations.Delete(key)
+		operation()
+	})
+	return true
+}
+
+// PromoteInBackground promotes the database to the closer stage in the background, unless its promotion is already
+// pending, the requests meeting it meanwhile go on at the current stage.
+func PromoteInBackground(database Database) {
+	if utils.IsClosestStage(database.GetStage()) || !settled(database, utils.Config.Settings.MoveCooldownSeconds) {
+		return
+	}
+	if heldBack(queuedPromotions, database) {
+		return
+	}
+	if runOnce(operationPromotion, database, func() { PromoteToCloserStage(database) }) {
+		database.GetLogger().Info("Database stage promotion.")
+	}
+}
+
+// PromoteToCloserStage moves the database one stage closer. The reads meeting it meanwhile are served from the stage it
+// is promoted from, the writes wait for the promotion to end.
 func PromoteToCloserStage(database Database) {
+	// NOTE: databases written by another instance are served from the remote stage, a local copy would go stale
+	if !coordination.Holds(database.GetName()) {
+		return
+	}
+
+	// NOTE: announced before waiting for the mutex, the requests arriving meanwhile would otherwise block until the end
+	// of the promotion
+	if !utils.IsClosestStage(database.GetStage()) {
+		database.SetMovingTo(utils.GetNextCloserStage(database.GetStage()))
+		defer database.SetMovingTo(0)
+	}
+
 	database.GetMutex().Lock()
 	defer database.GetMutex().Unlock()
 
 	if utils.IsClosestStage(database.GetStage()) {
-		utils.Logger.Warn("Database already at closest stage, no promotion needed.", zap.Reflect("database", database))
+		database.GetLogger().Warn("Database already at closest stage, no promotion needed.")
+		return
+	}
+
+	if !settled(database, utils.Config.Settings.MoveCooldownSeconds) {
+		database.GetLogger().Debug("Database moved recently, not promoting it yet.", zap.Time("movedAt", database.GetMovedAt()))
 		return
 	}
 
 	targetStage := utils.GetNextCloserStage(database.GetStage())
 	if targetStage == 0 {
-		utils.Logger.Warn("Cannot promote database further, already at closest stage.", zap.Reflect("database", database))
+		database.GetLogger().Warn("Cannot promote database further, already at closest stage.")
 		return
 	}
-	utils.Logger.Debug(
+	database.GetLogger().Debug(
 		"Checking if database should be promoted to closer stage.",
-		zap.Reflect("database", database),
 		zap.Uint("currentStage", database.GetStage()),
 		zap.Uint("targetStage", targetStage),
 		zap.Uint("requestCount", database.GetRequestCount()),
@@ -198,185 +339,416 @@ func PromoteToCloserStage(database Database) {
 
 	database.SetRequestCount(0)
 
+	if utils.IsClosestStage(targetStage) && !ensurePromotionCapacity(database) {
+		database.GetLogger().Warn(
+			"Not enough local capacity to promote database, keeping it at its current stage.",
+			zap.Uint("targetStage", targetStage),
+		)
+		return
+	}
+
 	sourceConn, err := database.GetConnectionString()
 	if err != nil {
-		utils.Logger.Error("Failed to get source connection for promotion",
-			zap.Reflect("database", database),
+		database.GetLogger().Error("Failed to get source connection for promotion",
 			zap.Error(err))
 		return
 	}
 
 	sourceDB, err := sql.Open("sqlite3", sourceConn)
 	if err != nil {
-		utils.Logger.Error("Failed to open source database for promotion",
-			zap.Reflect("database", database),
+		database.GetLogger().Error("Failed to open source database for promotion",
 			zap.Error(err))
 		return
 	}
 
 	if err := sourceDB.Ping(); err != nil {
-		utils.Logger.Error("Source database not accessible for promotion",
-			zap.Reflect("database", database),
+		database.GetLogger().Error("Source database not accessible for promotion",
 			zap.Error(err))
 		return
 	}
 
 	sourceDB.Close()
 
-	err = MoveToStage(database, targetStage)
+	err = MoveToStage(database, targetStage, PlacementPromotion)
 	if err != nil {
-		utils.Logger.Error(
+		database.GetLogger().Error(
 			"Failed to auto-promote database to closer stage.",
-			zap.Reflect("database", database),
 			zap.Uint("targetStage", targetStage),
 			zap.Error(err),
 		)
+		recordFailure(operationPromotion, database.GetName(), err)
 	} else {
-		utils.Logger.Info("Successfully promoted database to closer stage.",
-			zap.Reflect("database", database),
+		database.GetLogger().Info("Successfully promoted database to closer stage.",
 			zap.Uint("targetStage", targetStage),
 		)
 	}
 }
 
 func demoteToFartherStage(database Database) {
+	if !coordination.Holds(database.GetName()) {
+		return
+	}
+
 	database.GetMutex().Lock()
 	defer database.GetMutex().Unlock()
 
 	if utils.IsFarthestStage(database.GetStage()) {
-		utils.Logger.Warn(
+		database.GetLogger().Warn(
 			"Database already at farthest stage, no demotion needed.",
-			zap.Reflect("database", database),
 		)
 		return
 	}
 
-	timeSinceAccess := time.Since(database.GetLastAccessed())
+	// NOTE: checked again against the clock of the monitor, the database may have been accessed since it was scheduled
+	now := monitorNow()
+	if now.Sub(database.GetMovedAt()) < time.Duration(utils.Config.Settings.MinStageResidencySeconds)*time.Second {
+		database.GetLogger().Debug("Database reached its stage recently, not demoting it yet.", zap.Time("movedAt", database.GetMovedAt()))
+		return
+	}
+
+	timeSinceAccess := now.Sub(database.GetLastAccessed())
 	timeoutDuration := time.Duration(utils.Config.Settings.StageTimeoutSeconds) * time.Second
 
 	if timeSinceAccess < timeoutDuration {
-		utils.Logger.Debug(
+		database.GetLogger().Debug(
 			"Database not ready for demotion due to recent access.",
-			zap.Reflect("database", database),
 			zap.Duration("timeSinceAccess", timeSinceAccess),
 			zap.Duration("timeoutDuration", timeoutDuration),
 		)
 		return
 	}
 
-	targetStage := utils.GetNextFartherStage(database.GetStage())
-	if targetStage == 0 {
-		utils.Logger.Warn("Cannot demote database further, already at farthest stage.", zap.Reflect("database", database))
-		return
-	}
-	utils.Logger.Info(
+	database.GetLogger().Info(
 		"Auto-demoting database to farther stage due to inactivity.",
-		zap.Reflect("database", database),
 		zap.Uint("currentStage", database.GetStage()),
-		zap.Uint("targetStage", targetStage),
 		zap.Duration("timeSinceAccess", timeSinceAccess),
 	)
 
-	if utils.Config.Settings.AutoSyncEnabled && !utils.IsFarthestStage(database.GetStage()) {
-		utils.Logger.Debug(
-			"Syncing database to upper stages before demotion.",
-			zap.Reflect("database", database),
-		)
-		// TODO: i think we should sync only to one stage up and not loop over everything
-		for stage := utils.GetNextFartherStage(database.GetStage()); stage != 0 && stage <= utils.GetFarthestStage(); stage = utils.GetNextFartherStage(stage) {
-			err := syncToStage(database, stage)
-			if err != nil {
-				utils.Logger.Error(
-					"Failed to sync database to upper stage before demotion.",
-					zap.Reflect("database", database),
-					zap.Uint("stage", stage),
-					zap.Error(err),
-				)
-				// TODO: is this the right behavior?
-				// NOTE: we continue with demotion even if sync fails, but log the error
-			} else {
-				err = verifyDatabaseAtStage(database, stage)
-				if err != nil {
-					// TODO: we should handle this error properly here and maybe rollback the sync
-					utils.Logger.Warn(
-						"Database verification failed after sync to upper stage.",
-						zap.Reflect("database", database),
-						zap.Uint("stage", stage),
-						zap.Error(err),
-					)
-				} else {
-					utils.Logger.Debug(
-						"Database successfully verified at upper stage.",
-						zap.Reflect("database", database),
-						zap.Uint("stage", stage),
-					)
-				}
-			}
-		}
-		utils.Logger.Debug("Pre-demotion sync completed.", zap.Reflect("database", database))
+	moveToFartherStage(database, PlacementDemotion)
+}
+
+// NOTE: moveToFartherStage syncs the database to the upper stages and moves it one stage farther, the database mutex must be held.
+// The database stays at its stage when the upper stages miss a verified copy of its writes, see syncBeforeDemotion.
+func moveToFartherStage(database Database, reason string) {
+	targetStage := utils.GetNextFartherStage(database.GetStage())
+	if targetStage == 0 {
+		database.GetLogger().Warn("Cannot demote database further, already at farthest stage.")
+		return
+	}
+
+	// NOTE: the sync replaces the copies at the upper stages, a crash while it runs leaves the local copy as the only
+	// whole one, it is recovered at startup from the journal
+	end, err := journalMove(database, targetStage)
+	if err != nil {
+		database.GetLogger().Error("Failed to journal the demotion, not demoting the database.", zap.Uint("targetStage", targetStage), zap.Error(err))
+		recordFailure(operationDemotion, database.GetName(), err)
+		return
+	}
+	defer end()
+
+	// NOTE: the copy the database leaves behind is removed once demoted, see EnsureLocalCapacity, it may be the only one
+	// holding its last writes
+	if err := syncBeforeDemotion(database, targetStage); err != nil {
+		database.GetLogger().Error("Database misses a verified copy at the upper stages, not demoting it.", zap.Uint("targetStage", targetStage), zap.Error(err))
+		recordFailure(operationDemotion, database.GetName(), err)
+		return
 	}
 
 	database.SetRequestCount(0)
 
-	err := MoveToStage(database, targetStage)
+	err = moveToStage(database, targetStage, reason, true)
 
 	if err != nil {
-		utils.Logger.Error(
+		database.GetLogger().Error(
 			"Failed to auto-demote database to farther stage.",
-			zap.Reflect("database", database),
 			zap.Uint("targetStage", targetStage),
 			zap.Error(err),
 		)
+		recordFailure(operationDemotion, database.GetName(), err)
+	}
+}
+
+// syncBeforeDemotion syncs the database to the upper stages, only to the target stage when SETTINGS_AUTO_SYNC_ENABLED is
+// disabled, and verifies the copies. It fails when a copy couldn't be made or verified, or when the copy at the target
+// stage misses writes of the database, the database mutex must be held exclusively.
+func syncBeforeDemotion(database Database, targetStage uint) error {
+	database.GetLogger().Debug("Syncing database to upper stages before demotion.")
+	for stage := targetStage; stage != 0 && stage <= utils.GetFarthestStage(); stage = utils.GetNextFartherStage(stage) {
+		if err := syncToStage(database, stage); err != nil {
+			recordFailure(operationSync, database.GetName(), err)
+			return fmt.Errorf("failed to sync to stage %d: %w", stage, err)
+		}
+		if err := verifyDatabaseAtStage(database, stage); err != nil {
+			// NOTE: a database without tables has nothing to lose, its copies hold none either
+			if tables, countErr := countTables(database); countErr != nil || tables > 0 {
+				return fmt.Errorf("failed to verify the copy at stage %d: %w", stage, err)
+			}
+		}
+		if !utils.Config.Settings.AutoSyncEnabled {
+			break
+		}
+	}
+
+	if copied, written := database.GetCopySequence(targetStage), database.GetCopySequence(database.GetStage()); copied < written {
+		return fmt.Errorf("the copy at stage %d holds the writes up to %d, the database up to %d", targetStage, copied, written)
+	}
+	return nil
+}
+
+// countTables returns the number of tables of the database at the stage it is served from.
+func countTables(database Database) (int, error) {
+	connectionString, err := database.GetConnectionString()
+	if err != nil {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var tables int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'").Scan(&tables)
+	return tables, err
+}
+
+// placed records why the database left its previous stage, the moves requested through the API are recorded by the route
+// with the caller.
+func placed(database Database, previousStage uint, reason string) {
+	database.SetMovedAt(time.Now())
+	database.SetPlacement(reason)
+
+	if reason != PlacementManual {
+		audit.Record(audit.Event{
+			Type:     audit.EventDatabaseMoved,
+			Database: database.GetName(),
+			Details:  map[string]any{"from": previousStage, "to": database.GetStage(), "reason": reason},
+		})
 	}
 }
 
+// settled reports whether the database didn't move during the last seconds, see SETTINGS_MOVE_COOLDOWN_SECONDS.
+func settled(database Database, seconds int) bool {
+	return time.Since(database.GetMovedAt()) >= time.Duration(seconds)*time.Second
+}
+
+// NOTE: stage operations triggered by requests run in the background, they are counted to spot leaks
+var backgroundOperations atomic.Int64
+
+// RunInBackground runs a stage operation asynchronously.
+func RunInBackground(operation func()) {
+	backgroundOperations.Add(1)
+	go func() {
+		defer backgroundOperations.Add(-1)
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				utils.StagesLogger.Error("Background stage operation panicked.", zap.Error(fmt.Errorf("panic: %v", recovered)), zap.Stack("stack"))
+			}
+		}()
+		operation()
+	}()
+}
+
+// NOTE: the syncs following the batch and maintenance writes run one at a time, a database waiting for its turn isn't
+// queued twice as the sync taking its turn uploads every write made until then
+var (
+	deferredSyncs    sync.Map
+	deferredSyncLane sync.Mutex
+)
+
+// SyncInBackground syncs the database to the upper stages in the background after a write made at the priority. The
+// syncs following the interactive writes start right away, those following the other writes wait for each other rather
+// than competing with them for the bandwidth to the bucket.
+func SyncInBackground(database Database, priority utils.Priority) {
+	if priority == utils.PriorityInteractive {
+		RunInBackground(func() { SyncToUpperStages(database) })
+		return
+	}
+
+	if _, waiting := deferredSyncs.LoadOrStore(database.GetName(), struct{}{}); waiting {
+		return
+	}
+	RunInBackground(func() {
+		deferredSyncLane.Lock()
+		defer deferredSyncLane.Unlock()
+		// NOTE: the writes made from now on schedule a sync of their own
+		deferredSyncs.Delete(database.GetName())
+		SyncToUpperStages(database)
+	})
+}
+
+// BackgroundOperations returns the number of stage operations still running in the background.
+func BackgroundOperations() int64 {
+	return backgroundOperations.Load()
+}
+
 func SyncToUpperStages(database Database) {
-	if !utils.Config.Settings.AutoSyncEnabled {
+	if !utils.Config.Settings.AutoSyncEnabled || !coordination.Holds(database.GetName()) {
+		return
+	}
+	if heldBack(queuedSyncs, database) {
 		return
 	}
 
+	pendingSyncs.Add(1)
+	defer pendingSyncs.Add(-1)
+
 	// NOTE: prevent concurrent sync operations on the same database
 	database.GetMutex().Lock()
 	defer database.GetMutex().Unlock()
 
-	utils.Logger.Debug("Syncing database to upper stages.", zap.Reflect("database", database), zap.Uint("currentStage", database.GetStage()))
+	database.GetLogger().Debug("Syncing database to upper stages.", zap.Uint("currentStage", database.GetStage()))
 
 	// TODO: rather than syncing to all existing upper stages, we should sync up to the next persistent stage and stop
 	// NOTE: sync to each upper stages
 	for stage := utils.GetNextFartherStage(database.GetStage()); stage != 0 && stage <= utils.GetFarthestStage(); stage = utils.GetNextFartherStage(stage) {
 		err := syncToStage(database, stage)
 		if err != nil {
-			utils.Logger.Error(
+			database.GetLogger().Error(
 				"Failed to sync database to upper stage.",
-				zap.Reflect("database", database),
 				zap.Uint("stage", stage),
 				zap.Error(err),
 			)
-			break
+			recordFailure(operationSync, database.GetName(), err)
+			syncFailed(database, err)
+			return
 		}
 	}
+	syncSucceeded(database)
 
-	utils.Logger.Debug("Sync completed for database.", zap.Reflect("database", database), zap.Uint("currentStage", database.GetStage()))
+	database.GetLogger().Debug("Sync completed for database.", zap.Uint("currentStage", database.GetStage()))
 }
 
-func updateDatabasePath(database Database, targetStage uint) {
-	name := database.GetName()
+// SyncToRemoteStage forces the database content to be synced to the remote stage, regardless of the auto sync setting.
+func SyncToRemoteStage(database Database) error {
+	if err := remoteOfflineError(); err != nil {
+		return err
+	}
+	if err := coordination.Acquire(database.GetName()); err != nil {
+		return err
+	}
+
+	database.GetMutex().Lock()
+	defer database.GetMutex().Unlock()
+
+	// NOTE: remote files are synced on close, only the tiered tables are left to persist when the database is already
+	// served from the remote stage
+	if database.GetStage() == utils.GetRemoteStage() {
+		if err := database.PersistCompanion(); err != nil {
+			return utils.NewError(utils.ErrorCodeSyncFailed, "failed to persist the tiered tables to the remote stage", err)
+		}
+		return nil
+	}
 
-	switch targetStage {
-	case utils.GetLocalStage():
-		database.SetPath(fmt.Sprintf("%s/%s.db", utils.Config.Storage.Local.DirectoryPath, name))
-	case utils.GetRemoteStage():
-		database.SetPath(name)
+	err := syncToStage(database, utils.GetRemoteStage())
+	if err != nil {
+		return utils.NewError(utils.ErrorCodeSyncFailed, "failed to sync the database to the remote stage", err)
 	}
+	syncSucceeded(database)
+	return nil
 }
 
-func verifyDatabaseAtStage(database Database, stage uint) error {
-	// NOTE: temporarily set stage to target one (where the database have supposedly been copied to) check the connection.
-	originalStage := database.GetStage()
-	database.SetStage(stage)
-	defer database.SetStage(originalStage)
+// ConfirmPersisted makes sure the copy of the database at the persistence stage is current, syncing it first when the
+// database is served from a closer stage and comparing the checksums of both copies. The database mutex must be held.
+func ConfirmPersisted(database Database) error {
+	persistenceStage := utils.Config.Settings.PersistenceStage
+	if database.GetStage() >= persistenceStage {
+		return nil
+	}
+
+	if err := syncToStage(database, persistenceStage); err != nil {
+		return utils.NewError(utils.ErrorCodeSyncFailed, fmt.Sprintf("failed to sync the database to the persistence stage %d", persistenceStage), err)
+	}
+
+	sourceConnection, err := ConnectionString(database.GetName(), database.GetStage(), ConnectionOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	persistedConnection, err := ConnectionString(database.GetName(), persistenceStage, ConnectionOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+
+	sourceChecksum, err := utils.DatabaseChecksum(sourceConnection)
+	if err != nil {
+		return utils.NewError(utils.ErrorCodeSyncFailed, "failed to checksum the database", err)
+	}
+	persistedChecksum, err := utils.DatabaseChecksum(persistedConnection)
+	if err != nil {
+		return utils.NewError(utils.ErrorCodeSyncFailed, fmt.Sprintf("failed to checksum the copy of the persistence stage %d", persistenceStage), err)
+	}
+	if sourceChecksum != persistedChecksum {
+		return utils.NewError(utils.ErrorCodeSyncFailed, fmt.Sprintf("the copy of the persistence stage %d differs from the database after the sync", persistenceStage), nil)
+	}
+	return nil
+}
+
+// MoveDatabase moves the database to the given stage on request, one stage at a time like the automatic movements.
+func MoveDatabase(database Database, targetStage uint) error {
+	return moveDatabase(database, targetStage, PlacementManual)
+}
+
+func moveDatabase(database Database, targetStage uint, reason string) error {
+	if targetStage == utils.GetRemoteStage() {
+		if err := remoteOfflineError(); err != nil {
+			return err
+		}
+	}
+	if !utils.IsValidStage(targetStage) {
+		minStage, maxStage := utils.GetValidStageRange()
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid stage %d, valid stages are %d-%d", targetStage, minStage, maxStage), nil)
+	}
+
+	if err := coordination.Acquire(database.GetName()); err != nil {
+		return err
+	}
+
+	database.GetMutex().Lock()
+	defer database.GetMutex().Unlock()
+
+	for database.GetStage() != targetStage {
+		nextStage := utils.GetNextFartherStage(database.GetStage())
+		if targetStage < database.GetStage() {
+			nextStage = utils.GetNextCloserStage(database.GetStage())
+			if utils.IsClosestStage(nextStage) && !ensurePromotionCapacity(database) {
+				return utils.NewError(utils.ErrorCodeQuotaExceeded, "not enough local capacity to move the database", nil)
+			}
+		}
+
+		if err := MoveToStage(database, nextStage, reason); err != nil {
+			return utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("failed to move the database to stage %d", nextStage), err)
+		}
+		database.SetRequestCount(0)
+	}
+
+	database.GetLogger().Info("Database moved on request.", zap.Uint("targetStage", targetStage), zap.String("reason", reason))
+	return nil
+}
+
+// remoteOfflineError returns the error of the operations which need the remote stage while the server runs without it.
+func remoteOfflineError() error {
+	if !utils.RemoteOffline() {
+		return nil
+	}
+	return utils.NewError(utils.ErrorCodeStageUnavailable, "the remote stage is offline: "+utils.RemoteOfflineReason(), remotevfs.ErrRemoteOffline)
+}
+
+// GetRemoteKey returns the key under which the database is stored in the remote stage.
+func GetRemoteKey(database Database) string {
+	return utils.DatabaseFileName(database.GetName())
+}
+
+func updateDatabasePath(database Database, targetStage uint) {
+	if path, err := Path(database.GetName(), targetStage); err == nil {
+		database.SetPath(path)
+	}
+}
 
-	connStr, err := GetConnectionStringForStage(database, stage)
+// verifyDatabaseAtStage checks the copy of the database at the stage holds its tables, the database mutex must be held
+// exclusively. The copy is opened read-only and immutable, nothing writes to it meanwhile so the check takes no lock and
+// leaves no journal next to it.
+func verifyDatabaseAtStage(database Database, stage uint) error {
+	connStr, err := ConnectionString(database.GetName(), stage, ConnectionOptions{ReadOnly: true, Immutable: true, WithoutPragmas: true})
 	if err != nil {
 		return fmt.Errorf("failed to get connection string for stage %d: %v", stage, err)
 	}
@@ -402,11 +774,120 @@ func verifyDatabaseAtStage(database Database, stage uint) error {
 		return fmt.Errorf("database at stage %d exists but has no tables (possible data loss)", stage)
 	}
 
-	utils.Logger.Debug(
+	if _, err := checks.Verify(context.Background(), db); err != nil {
+		return fmt.Errorf("database at stage %d failed its checks: %w", stage, err)
+	}
+
+	database.GetLogger().Debug(
 		"Database verification successful",
 		zap.Uint("stage", stage),
 		zap.Int("tableCount", tableCount),
-		zap.Reflect("database", database),
 	)
 	return nil
 }
+
+// verifyChecksAtStage runs the checks the copy of the database at the stage holds, see checks.Verify.
+func verifyChecksAtStage(database Database, stage uint) error {
+	connectionString, err := ConnectionString(database.GetName(), stage, ConnectionOptions{ReadOnly: true, Immutable: true, WithoutPragmas: true})
+	if err != nil {
+		return fmt.Errorf("failed to get connection string for stage %d: %v", stage, err)
+	}
+
+	db, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return fmt.Errorf("failed to open database at stage %d: %v", stage, err)
+	}
+	defer db.Close()
+
+	if _, err := checks.Verify(context.Background(), db); err != nil {
+		return fmt.Errorf("database at stage %d failed its checks: %w", stage, err)
+	}
+	return nil
+}
+
+// DropLocalCopy serves the database from the remote stage again without syncing its local copy, used once this
+// instance lost the lease of the database and another instance may have written the remote copy since.
+func DropLocalCopy(database Database) error {
+	database.GetMutex().Lock()
+	defer database.GetMutex().Unlock()
+
+	if database.GetStage() != utils.GetLocalStage() {
+		return nil
+	}
+
+	localPath := database.GetPath()
+	// NOTE: the writes the remote copy misses are discarded with the local copy, it becomes the reference
+	database.SetCopySequence(utils.GetRemoteStage(), database.GetCopySequence(utils.GetLocalStage()))
+	database.SetStage(utils.GetRemoteStage())
+	updateDatabasePath(database, utils.GetRemoteStage())
+	database.SetRequestCount(0)
+	placed(database, utils.GetLocalStage(), PlacementLeaseLost)
+
+	if err := localvfs.Delete(localPath); err != nil {
+		return fmt.Errorf("failed to remove local copy: %v", err)
+	}
+
+	database.GetLogger().Warn("Dropped local copy of database, writes not synced before the lease was lost are discarded.", zap.String("path", localPath))
+	return nil
+}
+
+// AdoptLocalCopy serves the database from the local stage using the file at path, a copy of its remote stage made
+// beforehand, e.g. by a standby being promoted. The file is moved into the local stage directory.
+func AdoptLocalCopy(database Database, path string) error {
+	database.GetMutex().Lock()
+	defer database.GetMutex().Unlock()
+
+	if database.GetStage() != utils.GetRemoteStage() {
+		return fmt.Errorf("database %s is not served from the remote stage", database.GetName())
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat local copy: %v", err)
+	}
+	if !EnsureLocalCapacity(info.Size(), database) {
+		return fmt.Errorf("local stage has no room left for database %s", database.GetName())
+	}
+
+	localPath := LocalPath(database.GetName())
+	if err := os.Rename(path, localPath); err != nil {
+		return fmt.Errorf("failed to move local copy: %v", err)
+	}
+	// NOTE: the file was moved in behind the disk VFS, its size isn't accounted for yet
+	if _, err := localvfs.ReconcileUsage(); err != nil {
+		database.GetLogger().Warn("Failed to reconcile local stage usage after adopting a local copy.", zap.Error(err))
+	}
+
+	database.SetCopySequence(utils.GetLocalStage(), database.GetCopySequence(utils.GetRemoteStage()))
+	database.SetStage(utils.GetLocalStage())
+	updateDatabasePath(database, utils.GetLocalStage())
+	database.SetRequestCount(0)
+	placed(database, utils.GetRemoteStage(), PlacementStandbyPromoted)
+
+	database.GetLogger().Info("Adopted local copy of database.", zap.String("path", localPath))
+	return nil
+}
+
+// RestoreFromRemoteStage replaces the local copy of the database with the one stored in the remote stage.
+func RestoreFromRemoteStage(database Database) error {
+	if err := remoteOfflineError(); err != nil {
+		return err
+	}
+	database.GetMutex().Lock()
+	defer database.GetMutex().Unlock()
+
+	if database.GetStage() != utils.GetLocalStage() {
+		return fmt.Errorf("database %s is not served from the local stage", database.GetName())
+	}
+
+	// NOTE: the writes the remote copy misses are discarded with the local copy, the restored copy becomes the reference
+	sequence := database.GetCopySequence(utils.GetLocalStage())
+	database.SetCopySequence(utils.GetRemoteStage(), sequence)
+
+	err := copyDataBetweenStages(database, utils.GetRemoteStage(), utils.GetLocalStage())
+	if err != nil {
+		return fmt.Errorf("failed to restore database from remote stage: %v", err)
+	}
+
+	return verifyDatabaseAtStage(database, utils.GetLocalStage())
+}
@@ -0,0 +1,114 @@
+package stages
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"persisto/src/utils"
+)
+
+// NOTE: the last failures of the background stage operations, the oldest one is dropped once full
+const maxMonitorErrors = 20
+
+// MonitorError is a failure of a background stage operation.
+type MonitorError struct {
+	At        time.Time `json:"at"`
+	Operation string    `json:"operation" doc:"Operation that failed: scan, promotion, demotion, sync or verification."`
+	Database  string    `json:"database,omitempty"`
+	Error     string    `json:"error"`
+}
+
+// MonitorStatus summarizes the stage monitor and the stage operations running in the background.
+type MonitorStatus struct {
+	Enabled            bool           `json:"enabled" doc:"Whether the stage monitor runs, see SETTINGS_AUTO_STAGE_MOVEMENT."`
+	Frozen             bool           `json:"frozen" doc:"Whether the automatic movements are frozen, see GET /admin/freeze."`
+	IntervalSeconds    int            `json:"interval_seconds"`
+	Scans              int64          `json:"scans" doc:"Scans run since the start."`
+	LastScanAt         *time.Time     `json:"last_scan_at,omitempty"`
+	LastScanDurationMs int64          `json:"last_scan_duration_ms"`
+	DatabasesScanned   int            `json:"databases_scanned" doc:"Databases checked for inactivity by the last scan."`
+	DemotionsTriggered int            `json:"demotions_triggered" doc:"Demotions scheduled by the last scan."`
+	TotalDemotions     int64          `json:"total_demotions" doc:"Demotions scheduled by the scans since the start."`
+	PendingPromotions  int            `json:"pending_promotions" doc:"Promotions scheduled or running."`
+	PendingDemotions   int            `json:"pending_demotions" doc:"Demotions scheduled or running."`
+	PendingSyncs       int64          `json:"pending_syncs" doc:"Syncs to the farther stages waiting for their database or running."`
+	QueuedSyncs        int            `json:"queued_syncs" doc:"Syncs queued until the automatic movements resume."`
+	Background         int64          `json:"background_operations" doc:"Stage operations running in the background."`
+	RecentErrors       []MonitorError `json:"recent_errors" doc:"Last failures of the background stage operations, newest first."`
+}
+
+var (
+	statusMutex        sync.Mutex
+	scans              int64
+	lastScanAt         time.Time
+	lastScanDuration   time.Duration
+	databasesScanned   int
+	demotionsTriggered int
+	totalDemotions     int64
+	monitorErrors      []MonitorError
+
+	pendingSyncs atomic.Int64
+)
+
+// recordScan records the outcome of a run of the stage monitor.
+func recordScan(start time.Time, scanned int, demotions int) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	scans++
+	lastScanAt, lastScanDuration = start, time.Since(start)
+	databasesScanned, demotionsTriggered = scanned, demotions
+	totalDemotions += int64(demotions)
+}
+
+// recordFailure remembers the failure of a background stage operation for the monitor status.
+func recordFailure(operation string, database string, err error) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	monitorErrors = append(monitorErrors, MonitorError{At: time.Now().UTC(), Operation: operation, Database: database, Error: err.Error()})
+	if len(monitorErrors) > maxMonitorErrors {
+		monitorErrors = monitorErrors[len(monitorErrors)-maxMonitorErrors:]
+	}
+}
+
+// GetMonitorStatus returns the state of the stage monitor and of the stage operations running in the background.
+func GetMonitorStatus() MonitorStatus {
+	status := MonitorStatus{
+		Enabled:         utils.Config.Settings.AutoStageMovement,
+		Frozen:          Frozen(),
+		IntervalSeconds: utils.Config.Settings.StageTimeoutSeconds / 2,
+		PendingSyncs:    pendingSyncs.Load(),
+		QueuedSyncs:     len(GetFreezeStatus().PendingSyncs),
+		Background:      BackgroundOperations(),
+	}
+
+	pendingOperations.Range(func(key, _ any) bool {
+		switch kind, _, _ := strings.Cut(key.(string), "/"); kind {
+		case operationPromotion:
+			status.PendingPromotions++
+		case operationDemotion:
+			status.PendingDemotions++
+		}
+		return true
+	})
+
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	status.Scans = scans
+	if !lastScanAt.IsZero() {
+		at := lastScanAt.UTC()
+		status.LastScanAt = &at
+	}
+	status.LastScanDurationMs = lastScanDuration.Milliseconds()
+	status.DatabasesScanned, status.DemotionsTriggered, status.TotalDemotions = databasesScanned, demotionsTriggered, totalDemotions
+
+	status.RecentErrors = make([]MonitorError, 0, len(monitorErrors))
+	for index := len(monitorErrors) - 1; index >= 0; index-- {
+		status.RecentErrors = append(status.RecentErrors, monitorErrors[index])
+	}
+	return status
+}
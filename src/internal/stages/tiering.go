@@ -0,0 +1,223 @@
+package stages
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+)
+
+// NOTE: the hot tables of a database can be moved into a companion database, see databases.PromoteTable. The copies of
+// the database taken outside of its stages, the backups, snapshots and replicas, only read its main file: they carry the
+// tiered tables back into it, see InlineTieredTables.
+const (
+	TieredSchema = "tiered"
+	// NOTE: appended to the file name of the database for the local file and the remote object of the companion, which
+	// are then neither listed as databases nor collected as orphans
+	TieredSuffix = ".tiered"
+
+	// NOTE: the tiered tables are listed in the metadata table of the database, see databases.MetadataTable
+	MetadataKeyTieredTables = "tiered_tables"
+	metadataTable           = "_persisto_metadata"
+)
+
+// TieredPath returns the path of the companion of the database on the local storage.
+func TieredPath(name string) string {
+	return LocalPath(name) + TieredSuffix
+}
+
+// TieredKey returns the key of the companion of the database on the remote stage.
+func TieredKey(name string) string {
+	return utils.DatabaseFileName(name) + TieredSuffix
+}
+
+// ReadTieredTables returns the tables of the database moved into its companion, read from the connection.
+func ReadTieredTables(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	var exists int
+	if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM main.sqlite_master WHERE type = 'table' AND name = ?", metadataTable).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, nil
+	}
+
+	var value string
+	err := conn.QueryRowContext(ctx, "SELECT value FROM main."+metadataTable+" WHERE key = ?", MetadataKeyTieredTables).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []string
+	if err := json.Unmarshal([]byte(value), &tables); err != nil {
+		return nil, fmt.Errorf("unreadable tiered tables: %w", err)
+	}
+	return tables, nil
+}
+
+// TableDefinitions returns the statements creating the table and its indexes as stored in the schema.
+func TableDefinitions(ctx context.Context, conn *sql.Conn, schema string, table string) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT sql FROM "+schema+".sqlite_master WHERE tbl_name = ? AND type IN ('table', 'index') AND sql IS NOT NULL ORDER BY type = 'index'", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var definitions []string
+	for rows.Next() {
+		var definition string
+		if err := rows.Scan(&definition); err != nil {
+			return nil, err
+		}
+		definitions = append(definitions, definition)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(definitions) == 0 {
+		return nil, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("table %s not found", table), nil)
+	}
+	return definitions, nil
+}
+
+// UploadCompanion writes a consistent copy of the companion of the database on the local storage to the remote stage,
+// where the copies of the database are persisted. It returns the size of the copy.
+func UploadCompanion(name string) (int, error) {
+	directory, err := os.MkdirTemp("", "persisto-tiered-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(directory)
+
+	connection, err := sql.Open("sqlite3", LocalConnectionString(TieredPath(name), ConnectionOptions{ReadOnly: true, WithoutPragmas: true}))
+	if err != nil {
+		return 0, err
+	}
+	defer connection.Close()
+
+	// NOTE: VACUUM INTO copies the companion as of a single read transaction, the writes running meanwhile are left out
+	// NOTE: written through the VFS of the operating system, the copy would otherwise go through the one of the local
+	// stage and be encrypted, the remote objects of the databases are stored in plaintext
+	snapshot := filepath.Join(directory, "companion.db")
+	if _, err := connection.Exec("VACUUM INTO ?", "file:"+snapshot+"?vfs=os"); err != nil {
+		return 0, fmt.Errorf("failed to copy the tiered tables: %w", err)
+	}
+	body, err := os.ReadFile(snapshot)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	if err := remotevfs.PutObject(ctx, TieredKey(name), body, "application/vnd.sqlite3"); err != nil {
+		return 0, fmt.Errorf("failed to write the tiered tables: %w", err)
+	}
+	return len(body), nil
+}
+
+// InlineTieredTables copies the tiered tables listed by the copy of a database opened by the target connection string
+// into it, from the companion on the local storage when path is set and the file exists, from the one of the remote
+// stage under key otherwise. The copy then holds every table and lists none as tiered, it is opened like any database.
+func InlineTieredTables(target string, key string, path string) error {
+	connection, err := sql.Open("sqlite3", target)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	ctx := context.Background()
+	conn, err := connection.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tables, err := ReadTieredTables(ctx, conn)
+	if err != nil || len(tables) == 0 {
+		return err
+	}
+
+	companion, err := companionConnectionString(key, path)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS "+TieredSchema, companion); err != nil {
+		return fmt.Errorf("failed to attach the tiered tables: %w", err)
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE "+TieredSchema)
+
+	transaction, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+
+	for _, table := range tables {
+		definitions, err := TableDefinitions(ctx, conn, TieredSchema, table)
+		if err != nil {
+			return fmt.Errorf("failed to read tiered table %s: %w", table, err)
+		}
+		quoted := utils.QuoteIdentifier(table)
+		// NOTE: the unqualified definitions are created in the main database, the indexes on the table just created there
+		for _, statement := range append(definitions, "INSERT INTO main."+quoted+" SELECT * FROM "+TieredSchema+"."+quoted) {
+			if _, err := transaction.ExecContext(ctx, statement); err != nil {
+				return fmt.Errorf("failed to copy tiered table %s: %w", table, err)
+			}
+		}
+	}
+	if _, err := transaction.ExecContext(ctx, "DELETE FROM main."+metadataTable+" WHERE key = ?", MetadataKeyTieredTables); err != nil {
+		return err
+	}
+	return transaction.Commit()
+}
+
+// ListsTieredTables reports whether the database opened by the connection string lists tiered tables, which a copy
+// holding only its main file would miss.
+func ListsTieredTables(connectionString string) (bool, error) {
+	connection, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return false, err
+	}
+	defer connection.Close()
+
+	ctx := context.Background()
+	conn, err := connection.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	tables, err := ReadTieredTables(ctx, conn)
+	return len(tables) > 0, err
+}
+
+func companionConnectionString(key string, path string) (string, error) {
+	if path != "" {
+		_, err := os.Stat(path)
+		if err == nil {
+			return LocalConnectionString(path, ConnectionOptions{ReadOnly: true, WithoutPragmas: true}), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	exists, err := remotevfs.ObjectExists(key)
+	if err != nil {
+		return "", utils.NewError(utils.ErrorCodeStageUnavailable, "failed to look up the tiered tables", err)
+	}
+	if !exists {
+		return "", utils.NewError(utils.ErrorCodeStageUnavailable, fmt.Sprintf("the tiered tables are missing from the remote stage under %s", key), nil)
+	}
+	return RemoteConnectionString(key, ConnectionOptions{ReadOnly: true, WithoutPragmas: true}), nil
+}
@@ -0,0 +1,86 @@
+package stages
+
+import (
+	"fmt"
+	"os"
+
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+	"persisto/src/vfs/remotevfs"
+)
+
+// NOTE: storage backing a stage
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+)
+
+// StageInfo describes a configured stage and its current state.
+type StageInfo struct {
+	Stage       uint   `json:"stage"`
+	Name        string `json:"name"`
+	Backend     string `json:"backend"`
+	Location    string `json:"location" doc:"Directory of the local stage or bucket of the remote stage."`
+	Persistence bool   `json:"persistence" doc:"Whether the databases are persisted once synced to this stage, see SETTINGS_PERSISTENCE_STAGE."`
+	Databases   int    `json:"databases" doc:"Databases of the catalog served from this stage."`
+	UsedBytes   int64  `json:"used_bytes"`
+	MaxBytes    int64  `json:"max_bytes" doc:"Budget of the stage, 0 means unlimited."`
+	// NOTE: -1 when the stage is unlimited
+	AvailableBytes int64  `json:"available_bytes" doc:"Bytes left in the budget, -1 means unlimited."`
+	Healthy        bool   `json:"healthy"`
+	Error          string `json:"error,omitempty" doc:"Why the stage is unhealthy."`
+}
+
+// Topology describes the configured stages from the closest to the farthest. The local stage is healthy when its
+// directory is reachable and the remote stage when its bucket can be listed, the remote usage is the size of the
+// databases stored at the root of the bucket.
+func Topology() []StageInfo {
+	counts := map[uint]int{}
+	for _, database := range listDatabases() {
+		counts[database.GetStage()]++
+	}
+
+	local := StageInfo{
+		Stage:          utils.GetLocalStage(),
+		Name:           utils.Config.Storage.Local.Name,
+		Backend:        BackendLocal,
+		Location:       utils.Config.Storage.Local.DirectoryPath,
+		UsedBytes:      localvfs.UsedBytes(),
+		MaxBytes:       localvfs.MaxBytes(),
+		AvailableBytes: localvfs.AvailableBytes(),
+	}
+	if info, err := os.Stat(local.Location); err != nil {
+		local.Error = err.Error()
+	} else if !info.IsDir() {
+		local.Error = fmt.Sprintf("%s is not a directory", local.Location)
+	} else {
+		local.Healthy = true
+	}
+
+	remote := StageInfo{
+		Stage:          utils.GetRemoteStage(),
+		Name:           utils.Config.Storage.Remote.Name,
+		Backend:        BackendS3,
+		Location:       utils.Config.Storage.Remote.BucketName,
+		AvailableBytes: -1,
+	}
+	if utils.RemoteOffline() {
+		remote.Error = "offline since the startup: " + utils.RemoteOfflineReason()
+	} else if files, _, err := remotevfs.ListFilesWithOptions(remotevfs.ListOptions{Delimiter: "/"}); err != nil {
+		remote.Error = err.Error()
+	} else {
+		remote.Healthy = true
+		for _, file := range files {
+			if _, isDatabase := remotevfs.DatabaseNameFromKey(file.Key); isDatabase {
+				remote.UsedBytes += file.Size
+			}
+		}
+	}
+
+	topology := []StageInfo{local, remote}
+	for index := range topology {
+		topology[index].Persistence = topology[index].Stage >= utils.Config.Settings.PersistenceStage
+		topology[index].Databases = counts[topology[index].Stage]
+	}
+	return topology
+}
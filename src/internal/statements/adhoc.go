@@ -0,0 +1,115 @@
+package statements
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"persisto/src/utils"
+)
+
+// Guardrails bound the reads of the ad-hoc principals, e.g. analysts exploring the data through the query endpoint. The
+// zero value leaves the reads unbounded, as for the trusted principals.
+type Guardrails struct {
+	// NOTE: injected as the LIMIT of the SELECTs, the rows past it are left out rather than refused
+	MaxRows int
+	// NOTE: the reads of a request are interrupted once they ran for longer
+	Budget time.Duration
+}
+
+// IsZero reports whether the reads are unbounded.
+func (guardrails Guardrails) IsZero() bool {
+	return guardrails.MaxRows == 0 && guardrails.Budget == 0
+}
+
+// IsAdhoc reports whether the principal is designated by STATEMENTS_ADHOC_PRINCIPALS, the requests without principal are
+// trusted.
+func IsAdhoc(principal string) bool {
+	if principal == "" {
+		return false
+	}
+	return slices.Contains(utils.Config.Statements.AdhocPrincipals, principal) || slices.Contains(utils.Config.Statements.AdhocPrincipals, "*")
+}
+
+// guardrailsOf returns the bounds of the reads of the principal through the endpoint, none for the trusted principals
+// and the statements persisto runs itself.
+func guardrailsOf(principal string, endpoint string) Guardrails {
+	if endpoint == "" || !IsAdhoc(principal) {
+		return Guardrails{}
+	}
+	return Guardrails{
+		MaxRows: utils.Config.Statements.AdhocMaxRows,
+		Budget:  time.Duration(utils.Config.Statements.AdhocMaxMilliseconds) * time.Millisecond,
+	}
+}
+
+// Rewrite returns the query bounded by the row limit when it is a SELECT, other statements are returned as they are.
+func (guardrails Guardrails) Rewrite(query string) string {
+	if guardrails.MaxRows <= 0 {
+		return query
+	}
+
+	trimmed := strings.TrimRight(strings.TrimSpace(query), "; \t\r\n")
+	keyword := firstKeyword(trimmed)
+	if keyword != "SELECT" && keyword != "WITH" {
+		return query
+	}
+	// NOTE: wrapped rather than edited, the limit applies whatever the query ends with, its own LIMIT included, and the
+	// line breaks keep a trailing comment from commenting the limit out
+	return fmt.Sprintf("SELECT * FROM (\n%s\n) LIMIT %d", trimmed, guardrails.MaxRows)
+}
+
+// RewriteAll returns the queries bounded like Rewrite.
+func (guardrails Guardrails) RewriteAll(queries []string) []string {
+	if guardrails.MaxRows <= 0 {
+		return queries
+	}
+	rewritten := make([]string, len(queries))
+	for index, query := range queries {
+		rewritten[index] = guardrails.Rewrite(query)
+	}
+	return rewritten
+}
+
+// NOTE: cause of the contexts interrupted by the budget, told apart from the requests canceled by their client
+var errBudgetSpent = errors.New("ad-hoc query budget spent")
+
+// Bound returns the context the reads run with, interrupted once the budget is spent.
+func (guardrails Guardrails) Bound(ctx context.Context) (context.Context, context.CancelFunc) {
+	if guardrails.Budget <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, guardrails.Budget, errBudgetSpent)
+}
+
+// Check returns a forbidden error in place of err when the reads were interrupted because they ran past the budget.
+func (guardrails Guardrails) Check(ctx context.Context, err error) error {
+	if err == nil || guardrails.Budget <= 0 || !errors.Is(context.Cause(ctx), errBudgetSpent) {
+		return err
+	}
+	return utils.NewError(utils.ErrorCodeForbidden, fmt.Sprintf("the query ran for longer than the %s allowed to ad-hoc principals", guardrails.Budget), err)
+}
+
+// firstKeyword returns the first keyword of the statement in upper case, past its leading comments.
+func firstKeyword(statement string) string {
+	for {
+		statement = strings.TrimSpace(statement)
+		switch {
+		case strings.HasPrefix(statement, "--"):
+			_, statement, _ = strings.Cut(statement, "\n")
+		case strings.HasPrefix(statement, "/*"):
+			_, statement, _ = strings.Cut(statement, "*/")
+		default:
+			end := strings.IndexFunc(statement, func(r rune) bool {
+				return !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z')
+			})
+			if end < 0 {
+				end = len(statement)
+			}
+			return strings.ToUpper(statement[:end])
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package statements
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"persisto/src/internal/connections"
+	"persisto/src/utils"
+
+	"github.com/ncruces/go-sqlite3"
+)
+
+// NOTE: endpoints the statements of the clients reach a database through
+const (
+	EndpointQuery   = "query"
+	EndpointExecute = "execute"
+	EndpointPgwire  = "pgwire"
+)
+
+// NOTE: the policy declared for a database is stored in its metadata table, see databases.MetadataTable
+const (
+	metadataTable  = "_persisto_metadata"
+	MetadataKey    = "statements"
+	internalPrefix = "_persisto_"
+)
+
+// NOTE: the triggers of the hooks record the changes of the tables they watch in an internal table, see hooks.Set
+const (
+	hookTriggerPrefix = "_persisto_hook_"
+	changesTable      = "_persisto_changes"
+)
+
+// Rules are the statement policy of a database, restricting the statements its clients may run. The zero value allows
+// all of them.
+type Rules struct {
+	DenyDDL    bool `json:"deny_ddl,omitempty" doc:"Refuse creating, altering and dropping tables, indexes, views and triggers."`
+	DenyAttach bool `json:"deny_attach,omitempty" doc:"Refuse attaching and detaching databases."`
+	DenyPragma bool `json:"deny_pragma,omitempty" doc:"Refuse every pragma, including those only reading a setting."`
+	// NOTE: endpoints only running reads, e.g. the query endpoint handed to semi-trusted clients
+	ReadOnly []string `json:"read_only,omitempty" doc:"Endpoints only allowed to read, among query, execute and pgwire."`
+	MaxRows  int      `json:"max_rows,omitempty" minimum:"0" doc:"Maximum number of rows a query may return, zero meaning unlimited."`
+
+	// NOTE: bounds of the principal of the connection rather than rules of the database, see RulesOf
+	guardrails Guardrails
+}
+
+// Guardrails returns the bounds of the reads of the ad-hoc principal the policy is enforced on, see IsAdhoc.
+func (policy Rules) Guardrails() Guardrails {
+	return policy.guardrails
+}
+
+// IsZero reports whether the policy allows every statement.
+func (policy Rules) IsZero() bool {
+	return !policy.DenyDDL && !policy.DenyAttach && !policy.DenyPragma && len(policy.ReadOnly) == 0 && policy.MaxRows == 0
+}
+
+// Equal reports whether both policies enforce the same rules.
+func (policy Rules) Equal(other Rules) bool {
+	first, second := Merge(Rules{}, policy), Merge(Rules{}, other)
+	return first.DenyDDL == second.DenyDDL && first.DenyAttach == second.DenyAttach && first.DenyPragma == second.DenyPragma &&
+		slices.Equal(first.ReadOnly, second.ReadOnly) && first.MaxRows == second.MaxRows
+}
+
+// Merge returns the policy enforcing the rules of both, the lowest row limit applies.
+func Merge(first Rules, second Rules) Rules {
+	merged := Rules{
+		DenyDDL:    first.DenyDDL || second.DenyDDL,
+		DenyAttach: first.DenyAttach || second.DenyAttach,
+		DenyPragma: first.DenyPragma || second.DenyPragma,
+		MaxRows:    first.MaxRows,
+	}
+	if second.MaxRows > 0 && (merged.MaxRows == 0 || second.MaxRows < merged.MaxRows) {
+		merged.MaxRows = second.MaxRows
+	}
+	for _, endpoint := range slices.Concat(first.ReadOnly, second.ReadOnly) {
+		if !slices.Contains(merged.ReadOnly, endpoint) {
+			merged.ReadOnly = append(merged.ReadOnly, endpoint)
+		}
+	}
+	slices.Sort(merged.ReadOnly)
+	return merged
+}
+
+// Validate checks the policy declared for a database.
+func Validate(policy Rules) error {
+	for _, endpoint := range policy.ReadOnly {
+		if endpoint != EndpointQuery && endpoint != EndpointExecute && endpoint != EndpointPgwire {
+			return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("unknown endpoint %s, the endpoints are query, execute and pgwire", endpoint), nil)
+		}
+	}
+	if policy.MaxRows < 0 {
+		return utils.NewError(utils.ErrorCodeInvalidInput, "the maximum number of rows can't be negative", nil)
+	}
+	return nil
+}
+
+// Tenant returns the tenant owning the database, the part of its name before the configured separator. Every database
+// is its own tenant without separator.
+func Tenant(name string) string {
+	separator := utils.Config.Statements.TenantSeparator
+	if separator == "" {
+		return name
+	}
+	if tenant, _, found := strings.Cut(name, separator); found {
+		return tenant
+	}
+	return name
+}
+
+// Configured returns the policy STATEMENTS_POLICIES sets for the database, merging the one of every database with the
+// one of its tenant.
+func Configured(name string) Rules {
+	tenant := Tenant(name)
+
+	var policy Rules
+	for _, entry := range utils.Config.Statements.Policies {
+		owner, rules, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		if owner == "*" || owner == tenant {
+			policy = Merge(policy, parseRules(rules))
+		}
+	}
+	return policy
+}
+
+// parseRules decodes the rules of a STATEMENTS_POLICIES entry, the configuration validation refuses the invalid ones.
+func parseRules(rules string) Rules {
+	var policy Rules
+	for _, rule := range strings.Split(rules, "+") {
+		name, value, _ := strings.Cut(rule, "=")
+		switch name {
+		case "deny_ddl":
+			policy.DenyDDL = true
+		case "deny_attach":
+			policy.DenyAttach = true
+		case "deny_pragma":
+			policy.DenyPragma = true
+		case "read_only":
+			policy.ReadOnly = strings.Split(value, "|")
+		case "max_rows":
+			policy.MaxRows, _ = strconv.Atoi(value)
+		}
+	}
+	return Merge(Rules{}, policy)
+}
+
+// Declared returns the policy declared for the database through its provisioning spec, read from the connection so
+// that the replicas enforce it as well.
+func Declared(ctx context.Context, conn *sql.Conn) (Rules, error) {
+	var exists int
+	if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM main.sqlite_master WHERE type = 'table' AND name = ?", metadataTable).Scan(&exists); err != nil {
+		return Rules{}, err
+	}
+	if exists == 0 {
+		return Rules{}, nil
+	}
+
+	var value string
+	err := conn.QueryRowContext(ctx, "SELECT value FROM main."+metadataTable+" WHERE key = ?", MetadataKey).Scan(&value)
+	if err == sql.ErrNoRows {
+		return Rules{}, nil
+	}
+	if err != nil {
+		return Rules{}, err
+	}
+
+	var policy Rules
+	if err := json.Unmarshal([]byte(value), &policy); err != nil {
+		return Rules{}, fmt.Errorf("unreadable statement policy: %w", err)
+	}
+	return policy, nil
+}
+
+// NOTE: key of the policy enforced on a connection, see RulesOf
+type rulesKey struct{}
+
+func init() {
+	// NOTE: runs before the policies of the principal, so that a statement the policy refuses is denied before the
+	// principal's authorizer can ignore it
+	connections.Register(connections.Hook{Name: "statements", Order: connections.OrderRestrictions, Open: open})
+}
+
+// open restricts the connection of a client reaching the database through an endpoint to the statements allowed by the
+// configured and declared policies. Nothing is done for the statements persisto runs itself, which have no endpoint.
+func open(ctx context.Context, connection *connections.Connection) error {
+	if connection.Endpoint == "" {
+		return nil
+	}
+
+	declared, err := Declared(ctx, connection.Conn)
+	if err != nil {
+		return fmt.Errorf("failed to load the statement policy: %w", err)
+	}
+
+	policy := Merge(Configured(connection.Database), declared)
+	if !policy.IsZero() {
+		guard := guard{policy: policy, readOnly: slices.Contains(policy.ReadOnly, connection.Endpoint)}
+		connection.Authorize(guard.authorize)
+	}
+	policy.guardrails = guardrailsOf(connection.Principal, connection.Endpoint)
+	connection.SetValue(rulesKey{}, policy)
+	return nil
+}
+
+// RulesOf returns the statement policy enforced on the connection, so that the rows returned can be bounded. It allows
+// every statement on the connections without endpoint.
+func RulesOf(connection *connections.Connection) Rules {
+	policy, _ := connection.Value(rulesKey{}).(Rules)
+	return policy
+}
+
+type guard struct {
+	policy   Rules
+	readOnly bool
+}
+
+func (guard guard) authorize(action sqlite3.AuthorizerActionCode, name3rd, name4th, schema, inner string) sqlite3.AuthorizerReturnCode {
+	if !guard.allows(action, name3rd, name4th) && !RecordsChange(action, name3rd, inner) {
+		return sqlite3.AUTH_DENY
+	}
+	return sqlite3.AUTH_OK
+}
+
+// RecordsChange reports whether the action is a trigger of a hook recording a change. The internal tables are denied to
+// the clients, the triggers of the hooks write one on their behalf.
+func RecordsChange(action sqlite3.AuthorizerActionCode, table string, inner string) bool {
+	return action == sqlite3.AUTH_INSERT && strings.EqualFold(table, changesTable) && strings.HasPrefix(strings.ToLower(inner), hookTriggerPrefix)
+}
+
+func (guard guard) allows(action sqlite3.AuthorizerActionCode, name3rd, name4th string) bool {
+	// NOTE: the declared policy is stored in the database, a client writing the internal tables could lift it
+	internal := strings.HasPrefix(strings.ToLower(name3rd), internalPrefix) || strings.HasPrefix(strings.ToLower(name4th), internalPrefix)
+
+	switch action {
+	case sqlite3.AUTH_SELECT, sqlite3.AUTH_READ, sqlite3.AUTH_FUNCTION, sqlite3.AUTH_RECURSIVE, sqlite3.AUTH_TRANSACTION, sqlite3.AUTH_SAVEPOINT:
+		return true
+	case sqlite3.AUTH_ATTACH, sqlite3.AUTH_DETACH:
+		return !guard.policy.DenyAttach && !guard.readOnly
+	case sqlite3.AUTH_PRAGMA:
+		// NOTE: a pragma without value only reads the setting
+		return !guard.policy.DenyPragma && (!guard.readOnly || name4th == "")
+	case sqlite3.AUTH_INSERT, sqlite3.AUTH_UPDATE, sqlite3.AUTH_DELETE, sqlite3.AUTH_ANALYZE, sqlite3.AUTH_REINDEX:
+		return !guard.readOnly && !internal
+	default:
+		// NOTE: every other action creates, alters or drops a schema object
+		return !guard.policy.DenyDDL && !guard.readOnly && !internal
+	}
+}
@@ -0,0 +1,122 @@
+package telemetry
+
+import (
+	"sort"
+
+	"persisto/src/internal/databases"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	LabelDatabase = "database"
+	LabelTenant   = "tenant"
+	LabelStage    = "stage"
+)
+
+// NOTE: value of the database label the databases outside of the top ones are summed under
+const otherDatabases = "_other"
+
+// databaseSeries is the contention of the databases sharing the same labels.
+type databaseSeries struct {
+	attributes []attribute.KeyValue
+	contention utils.Contention
+}
+
+func labelEnabled(label string) bool {
+	for _, enabled := range utils.Config.Logging.MetricsDatabaseLabels {
+		if enabled == label {
+			return true
+		}
+	}
+	return false
+}
+
+// seriesOf groups the databases by the labels their metrics are emitted with, see LOGGING_METRICS_DATABASE_LABELS. With
+// LOGGING_METRICS_TOP_DATABASES, only the databases with the most contention keep their own database label.
+func seriesOf(items []*databases.Database) []databaseSeries {
+	withDatabase, withTenant, withStage := labelEnabled(LabelDatabase), labelEnabled(LabelTenant), labelEnabled(LabelStage)
+	named := topDatabases(items, utils.Config.Logging.MetricsTopDatabases)
+
+	series := map[attribute.Distinct]*databaseSeries{}
+	var order []attribute.Distinct
+	for _, database := range items {
+		var attributes []attribute.KeyValue
+		if withDatabase {
+			name := database.GetName()
+			if named != nil && !named[name] {
+				name = otherDatabases
+			}
+			attributes = append(attributes, attribute.String(LabelDatabase, name))
+		}
+		if withTenant {
+			attributes = append(attributes, attribute.String(LabelTenant, remotevfs.TenantOf(utils.DatabaseFileName(database.GetName()))))
+		}
+		if withStage {
+			attributes = append(attributes, attribute.Int(LabelStage, int(database.GetStage())))
+		}
+
+		set := attribute.NewSet(attributes...)
+		key := set.Equivalent()
+		entry, found := series[key]
+		if !found {
+			entry = &databaseSeries{attributes: attributes}
+			series[key] = entry
+			order = append(order, key)
+		}
+		addContention(&entry.contention, database.GetContention())
+	}
+
+	result := make([]databaseSeries, 0, len(order))
+	for _, key := range order {
+		result = append(result, *series[key])
+	}
+	return result
+}
+
+// topDatabases returns the names of the limit databases with the most time spent waiting or holding the catalog, nil
+// when every database keeps its name.
+func topDatabases(items []*databases.Database, limit int) map[string]bool {
+	if limit <= 0 || len(items) <= limit {
+		return nil
+	}
+
+	type scored struct {
+		name  string
+		score float64
+	}
+	scores := make([]scored, len(items))
+	for i, database := range items {
+		contention := database.GetContention()
+		busy := contention.BusyShared + contention.BusyReserved + contention.BusyExclusive + contention.BusyErrors
+		scores[i] = scored{
+			name:  database.GetName(),
+			score: contention.CatalogWaitMs + contention.ConnectionWaitMs + contention.LockWaitMs + contention.CatalogHoldMs + float64(busy),
+		}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].score != scores[j].score {
+			return scores[i].score > scores[j].score
+		}
+		return scores[i].name < scores[j].name
+	})
+
+	named := make(map[string]bool, limit)
+	for _, entry := range scores[:limit] {
+		named[entry.name] = true
+	}
+	return named
+}
+
+func addContention(total *utils.Contention, contention utils.Contention) {
+	total.BusyShared += contention.BusyShared
+	total.BusyReserved += contention.BusyReserved
+	total.BusyExclusive += contention.BusyExclusive
+	total.BusyErrors += contention.BusyErrors
+	total.CatalogWaitMs += contention.CatalogWaitMs
+	total.ConnectionWaitMs += contention.ConnectionWaitMs
+	total.LockWaitMs += contention.LockWaitMs
+	total.CatalogHoldMs += contention.CatalogHoldMs
+}
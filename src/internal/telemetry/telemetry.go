@@ -0,0 +1,298 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"persisto/src/internal/admission"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+	"persisto/src/vfs/remotevfs"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	MetricsExporterNone = "none"
+	MetricsExporterOTLP = "otlp"
+)
+
+var (
+	requests           metric.Int64Counter
+	requestDuration    metric.Float64Histogram
+	scrubDiscrepancies metric.Int64Counter
+	drills             metric.Int64Counter
+
+	metricsSetupOnce sync.Once
+)
+
+// SetupMetrics starts pushing the metrics to the configured OTLP endpoint, metrics are not collected otherwise.
+func SetupMetrics() error {
+	var setupError error
+
+	metricsSetupOnce.Do(func() {
+		if utils.Config.Logging.MetricsExporter != MetricsExporterOTLP {
+			return
+		}
+
+		options := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpointURL(utils.Config.Logging.MetricsEndpoint)}
+		if len(utils.Config.Logging.MetricsHeaders) > 0 {
+			options = append(options, otlpmetrichttp.WithHeaders(utils.Config.Logging.MetricsHeaders))
+		}
+
+		exporter, err := otlpmetrichttp.New(context.Background(), options...)
+		if err != nil {
+			setupError = fmt.Errorf("failed to create OTLP metrics exporter: %w", err)
+			return
+		}
+
+		provider := sdkmetric.NewMeterProvider(
+			sdkmetric.WithResource(metricsResource()),
+			sdkmetric.WithReader(sdkmetric.NewPeriodicReader(
+				exporter,
+				sdkmetric.WithInterval(time.Duration(utils.Config.Logging.MetricsIntervalSeconds)*time.Second),
+			)),
+		)
+
+		if err := registerInstruments(provider.Meter("persisto")); err != nil {
+			setupError = fmt.Errorf("failed to register metrics: %w", err)
+			return
+		}
+
+		utils.Logger.Info("Pushing metrics over OTLP.")
+	})
+
+	return setupError
+}
+
+func metricsResource() *resource.Resource {
+	instance := utils.Config.Logging.MetricsInstance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	stage := utils.Config.Logging.MetricsStage
+	if stage == "" {
+		stage = utils.ActiveProfile()
+	}
+
+	attributes := []attribute.KeyValue{
+		semconv.ServiceName("persisto"),
+		semconv.ServiceVersion(utils.Config.Server.Version),
+		semconv.ServiceInstanceID(instance),
+	}
+	if stage != "" {
+		attributes = append(attributes, semconv.DeploymentEnvironment(stage))
+	}
+	if utils.Config.Logging.MetricsTenant != "" {
+		attributes = append(attributes, attribute.String("tenant", utils.Config.Logging.MetricsTenant))
+	}
+	for key, value := range utils.Config.Logging.MetricsResourceAttributes {
+		attributes = append(attributes, attribute.String(key, value))
+	}
+
+	return resource.NewSchemaless(attributes...)
+}
+
+func registerInstruments(meter metric.Meter) error {
+	var err error
+
+	requests, err = meter.Int64Counter("persisto.http.requests", metric.WithDescription("HTTP requests handled."))
+	if err != nil {
+		return err
+	}
+	requestDuration, err = meter.Float64Histogram("persisto.http.request.duration", metric.WithUnit("s"), metric.WithDescription("Time spent handling HTTP requests."))
+	if err != nil {
+		return err
+	}
+
+	scrubDiscrepancies, err = meter.Int64Counter("persisto.scrub.discrepancies", metric.WithDescription("Diverging copies found by the scrubber."))
+	if err != nil {
+		return err
+	}
+	drills, err = meter.Int64Counter("persisto.drills", metric.WithDescription("Disaster recovery drills by status."))
+	if err != nil {
+		return err
+	}
+
+	databaseCount, err := meter.Int64ObservableGauge("persisto.databases", metric.WithDescription("Databases by stage."))
+	if err != nil {
+		return err
+	}
+	goroutines, err := meter.Int64ObservableGauge("persisto.runtime.goroutines")
+	if err != nil {
+		return err
+	}
+	heap, err := meter.Int64ObservableGauge("persisto.runtime.heap", metric.WithUnit("By"))
+	if err != nil {
+		return err
+	}
+	backgroundOperations, err := meter.Int64ObservableGauge("persisto.stages.background_operations", metric.WithDescription("Stage operations running in the background."))
+	if err != nil {
+		return err
+	}
+	pendingSyncs, err := meter.Int64ObservableGauge("persisto.local.pending_syncs", metric.WithDescription("Local files waiting for the batched flusher."))
+	if err != nil {
+		return err
+	}
+	localUsage, err := meter.Int64ObservableGauge("persisto.local.usage", metric.WithUnit("By"))
+	if err != nil {
+		return err
+	}
+	cachedSectors, err := meter.Int64ObservableGauge("persisto.remote.cache.sectors", metric.WithDescription("Remote sectors cached by the open files."))
+	if err != nil {
+		return err
+	}
+	circuitOpen, err := meter.Int64ObservableGauge("persisto.remote.circuit.open", metric.WithDescription("Whether the remote operations fail right away, 1 while the circuit breaker is open."))
+	if err != nil {
+		return err
+	}
+	circuitRejected, err := meter.Int64ObservableCounter("persisto.remote.circuit.rejected", metric.WithDescription("Remote operations failed right away by the circuit breaker."))
+	if err != nil {
+		return err
+	}
+	syncLag, err := meter.Int64ObservableGauge("persisto.sync.lag", metric.WithUnit("ms"), metric.WithDescription("Largest time since the oldest write the copy of a database at the persistence stage misses."))
+	if err != nil {
+		return err
+	}
+	syncWindowExceeded, err := meter.Int64ObservableGauge("persisto.sync.window.exceeded", metric.WithDescription("Databases lagging past their sync window."))
+	if err != nil {
+		return err
+	}
+	syncFailing, err := meter.Int64ObservableGauge("persisto.sync.failing", metric.WithDescription("Databases whose last background sync failed, by state: retrying or dead_lettered."))
+	if err != nil {
+		return err
+	}
+	admissionQueries, err := meter.Int64ObservableGauge("persisto.admission.queries", metric.WithDescription("Queries running and waiting for a slot."))
+	if err != nil {
+		return err
+	}
+	admissionShed, err := meter.Int64ObservableCounter("persisto.admission.shed", metric.WithDescription("Queries shed by the admission control."))
+	if err != nil {
+		return err
+	}
+	admissionWait, err := meter.Int64ObservableCounter("persisto.admission.wait", metric.WithUnit("ms"), metric.WithDescription("Time the admitted queries spent waiting for a slot."))
+	if err != nil {
+		return err
+	}
+	lockBusy, err := meter.Int64ObservableCounter("persisto.database.lock.busy", metric.WithDescription("File locks refused with BUSY and queries failed as the database was busy, by database."))
+	if err != nil {
+		return err
+	}
+	lockWait, err := meter.Float64ObservableCounter("persisto.database.lock.wait", metric.WithUnit("ms"), metric.WithDescription("Time spent waiting for the catalog mutex, a connection slot and the file locks, by database."))
+	if err != nil {
+		return err
+	}
+	catalogHold, err := meter.Float64ObservableCounter("persisto.database.catalog.hold", metric.WithUnit("ms"), metric.WithDescription("Time the catalog mutex was held exclusively by the stage operations, by database."))
+	if err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(ctx context.Context, observer metric.Observer) error {
+		if databases.Dbs != nil {
+			all := databases.Dbs.All()
+			counts := make(map[uint]int64)
+			var maxLag, exceeded int64
+			for _, database := range all {
+				counts[database.GetStage()]++
+				maxLag = max(maxLag, database.SyncLag().Milliseconds())
+				if database.SyncWindowExceeded() {
+					exceeded++
+				}
+			}
+			observer.ObserveInt64(syncLag, maxLag)
+			observer.ObserveInt64(syncWindowExceeded, exceeded)
+			for _, series := range seriesOf(all) {
+				contention, labels := series.contention, series.attributes
+				with := func(extra ...attribute.KeyValue) metric.MeasurementOption {
+					return metric.WithAttributes(append(append([]attribute.KeyValue{}, labels...), extra...)...)
+				}
+				observer.ObserveInt64(lockBusy, contention.BusyShared, with(attribute.String("lock", "shared")))
+				observer.ObserveInt64(lockBusy, contention.BusyReserved, with(attribute.String("lock", "reserved")))
+				observer.ObserveInt64(lockBusy, contention.BusyExclusive, with(attribute.String("lock", "exclusive")))
+				observer.ObserveInt64(lockBusy, contention.BusyErrors, with(attribute.String("lock", "query")))
+				observer.ObserveFloat64(lockWait, contention.CatalogWaitMs, with(attribute.String("kind", "catalog")))
+				observer.ObserveFloat64(lockWait, contention.ConnectionWaitMs, with(attribute.String("kind", "connection")))
+				observer.ObserveFloat64(lockWait, contention.LockWaitMs, with(attribute.String("kind", "file")))
+				observer.ObserveFloat64(catalogHold, contention.CatalogHoldMs, with())
+			}
+			for _, stage := range utils.GetAllStageNumbers() {
+				observer.ObserveInt64(databaseCount, counts[stage], metric.WithAttributes(attribute.Int("stage", int(stage))))
+			}
+		}
+
+		var memory runtime.MemStats
+		runtime.ReadMemStats(&memory)
+		observer.ObserveInt64(goroutines, int64(runtime.NumGoroutine()))
+		observer.ObserveInt64(heap, int64(memory.HeapAlloc))
+
+		observer.ObserveInt64(backgroundOperations, stages.BackgroundOperations())
+		retrying, deadLettered := stages.SyncRetryCounts()
+		observer.ObserveInt64(syncFailing, int64(retrying), metric.WithAttributes(attribute.String("state", "retrying")))
+		observer.ObserveInt64(syncFailing, int64(deadLettered), metric.WithAttributes(attribute.String("state", "dead_lettered")))
+		observer.ObserveInt64(pendingSyncs, int64(localvfs.PendingSyncs()))
+		observer.ObserveInt64(localUsage, localvfs.UsedBytes())
+
+		cache := remotevfs.GetCacheStats()
+		observer.ObserveInt64(cachedSectors, int64(cache.CachedSectors-cache.DirtySectors), metric.WithAttributes(attribute.String("state", "clean")))
+		observer.ObserveInt64(cachedSectors, int64(cache.DirtySectors), metric.WithAttributes(attribute.String("state", "dirty")))
+
+		circuit := remotevfs.GetCircuitStats()
+		open := int64(0)
+		if circuit.Open {
+			open = 1
+		}
+		observer.ObserveInt64(circuitOpen, open)
+		observer.ObserveInt64(circuitRejected, circuit.Rejected)
+
+		admitted := admission.GetStats()
+		observer.ObserveInt64(admissionQueries, int64(admitted.Running), metric.WithAttributes(attribute.String("state", "running")))
+		observer.ObserveInt64(admissionQueries, int64(admitted.Queued), metric.WithAttributes(attribute.String("state", "queued")))
+		observer.ObserveInt64(admissionShed, admitted.Rejected, metric.WithAttributes(attribute.String("reason", "queue_full")))
+		observer.ObserveInt64(admissionShed, admitted.TimedOut, metric.WithAttributes(attribute.String("reason", "timeout")))
+		observer.ObserveInt64(admissionWait, admitted.WaitedMs)
+		return nil
+	}, databaseCount, goroutines, heap, backgroundOperations, pendingSyncs, localUsage, cachedSectors, circuitOpen, circuitRejected, syncLag, syncWindowExceeded, syncFailing, admissionQueries, admissionShed, admissionWait, lockBusy, lockWait, catalogHold)
+	return err
+}
+
+// RecordRequest records a handled HTTP request, route is the matched route pattern.
+func RecordRequest(ctx context.Context, method, route string, status int, duration time.Duration) {
+	if requests == nil {
+		return
+	}
+
+	attributes := metric.WithAttributes(
+		attribute.String("method", method),
+		attribute.String("route", route),
+		attribute.Int("status", status),
+	)
+	requests.Add(ctx, 1, attributes)
+	requestDuration.Record(ctx, duration.Seconds(), attributes)
+}
+
+// RecordDrill records the outcome of a disaster recovery drill.
+func RecordDrill(ctx context.Context, status string) {
+	if drills == nil {
+		return
+	}
+	drills.Add(ctx, 1, metric.WithAttributes(attribute.String("status", status)))
+}
+
+// RecordScrubDiscrepancy records diverging copies of a database found by the scrubber.
+func RecordScrubDiscrepancy(ctx context.Context, status string) {
+	if scrubDiscrepancies == nil {
+		return
+	}
+	scrubDiscrepancies.Add(ctx, 1, metric.WithAttributes(attribute.String("status", status)))
+}
@@ -0,0 +1,210 @@
+package templates
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"persisto/src/utils"
+)
+
+// NOTE: the templates are stored in the database they run on, they follow it across stages, backups and replicas. Every
+// change of a template is stored as a new version, the callers run the latest one unless they pin another.
+const Table = "_persisto_templates"
+
+var (
+	namePattern      = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+	parameterPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+)
+
+// Template is a named query run with the values of its parameters, e.g. SELECT * FROM orders WHERE customer = :customer.
+type Template struct {
+	Name    string `json:"name"`
+	Version int64  `json:"version"`
+	Query   string `json:"query"`
+	// NOTE: names of the parameters, bound to the :name, @name or $name placeholders of the query
+	Parameters  []string  `json:"parameters,omitempty"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Executor runs the statements managing the templates of a database.
+type Executor interface {
+	Query(query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, error)
+	ExecuteTransaction(queries []string, parameters [][]any) ([]utils.ExecResultType, int, error)
+}
+
+// List returns the latest version of every template of the database.
+func List(database Executor) ([]Template, error) {
+	exists, err := tableExists(database)
+	if err != nil || !exists {
+		return []Template{}, err
+	}
+
+	rows, _, err := database.Query("SELECT name, version, query, parameters, description, created_at FROM " + Table + " AS template WHERE version = (SELECT MAX(version) FROM " + Table + " WHERE name = template.name) ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	return templatesOf(rows)
+}
+
+// Versions returns every version of the template, the latest first.
+func Versions(database Executor, name string) ([]Template, error) {
+	exists, err := tableExists(database)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, notFound(name)
+	}
+
+	rows, _, err := database.Query("SELECT name, version, query, parameters, description, created_at FROM "+Table+" WHERE name = ? ORDER BY version DESC", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, notFound(name)
+	}
+	return templatesOf(rows)
+}
+
+// Find returns the version of the template, the latest one for version 0.
+func Find(database Executor, name string, version int64) (Template, error) {
+	versions, err := Versions(database, name)
+	if err != nil {
+		return Template{}, err
+	}
+	if version == 0 {
+		return versions[0], nil
+	}
+	for _, template := range versions {
+		if template.Version == version {
+			return template, nil
+		}
+	}
+	return Template{}, utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("template %s has no version %d", name, version), nil)
+}
+
+// Set stores the template as a new version once its query compiled against the database, it returns the version.
+func Set(database Executor, template Template) (Template, error) {
+	if !namePattern.MatchString(template.Name) {
+		return Template{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid template name %s, it must match %s", template.Name, namePattern), nil)
+	}
+	if strings.TrimSpace(template.Query) == "" {
+		return Template{}, utils.NewError(utils.ErrorCodeInvalidInput, "the query of a template can't be empty", nil)
+	}
+	for index, parameter := range template.Parameters {
+		if !parameterPattern.MatchString(parameter) {
+			return Template{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("invalid parameter name %s, it must match %s", parameter, parameterPattern), nil)
+		}
+		if slices.Contains(template.Parameters[:index], parameter) {
+			return Template{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("parameter %s is declared more than once", parameter), nil)
+		}
+		if !regexp.MustCompile(`[:@$]` + parameter + `\b`).MatchString(template.Query) {
+			return Template{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("the query has no :%s placeholder", parameter), nil)
+		}
+	}
+
+	// NOTE: compiled without running it, the placeholders are left unbound
+	if _, _, err := database.Query("EXPLAIN " + template.Query); err != nil {
+		return Template{}, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("the query of template %s doesn't compile", template.Name), err)
+	}
+
+	parameters, err := json.Marshal(template.Parameters)
+	if err != nil {
+		return Template{}, err
+	}
+
+	queries := []string{
+		"CREATE TABLE IF NOT EXISTS " + Table + " (name TEXT NOT NULL, version INTEGER NOT NULL, query TEXT NOT NULL, parameters TEXT, description TEXT, created_at TEXT NOT NULL, PRIMARY KEY (name, version))",
+		"INSERT INTO " + Table + " (name, version, query, parameters, description, created_at) SELECT ?, COALESCE(MAX(version), 0) + 1, ?, ?, ?, ? FROM " + Table + " WHERE name = ?",
+	}
+	arguments := [][]any{nil, {template.Name, template.Query, string(parameters), nullable(template.Description), time.Now().UTC().Format(time.RFC3339Nano), template.Name}}
+	if _, _, err := database.ExecuteTransaction(queries, arguments); err != nil {
+		return Template{}, err
+	}
+	return Find(database, template.Name, 0)
+}
+
+// Remove deletes every version of the template.
+func Remove(database Executor, name string) error {
+	if _, err := Versions(database, name); err != nil {
+		return err
+	}
+	_, _, err := database.ExecuteTransaction([]string{"DELETE FROM " + Table + " WHERE name = ?"}, [][]any{{name}})
+	return err
+}
+
+// Bind returns the values bound to the placeholders of the template, decoded like the parameters of the queries, see
+// utils.QueryParameters. Every parameter of the template must be given a value, and only those.
+func (template Template) Bind(values map[string]any) ([]any, error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !slices.Contains(template.Parameters, name) {
+			return nil, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("template %s has no parameter %s", template.Name, name), nil)
+		}
+	}
+
+	ordered := make([]any, len(template.Parameters))
+	for index, parameter := range template.Parameters {
+		value, given := values[parameter]
+		if !given {
+			return nil, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("missing value of parameter %s", parameter), nil)
+		}
+		ordered[index] = value
+	}
+	decoded, err := utils.QueryParameters(ordered)
+	if err != nil {
+		return nil, err
+	}
+
+	bound := make([]any, len(decoded))
+	for index, value := range decoded {
+		bound[index] = sql.Named(template.Parameters[index], value)
+	}
+	return bound, nil
+}
+
+func templatesOf(rows utils.QueryResultType) ([]Template, error) {
+	templates := make([]Template, 0, len(rows))
+	for _, row := range rows {
+		template := Template{Name: fmt.Sprint(row["name"]), Query: fmt.Sprint(row["query"])}
+		template.Version, _ = row["version"].(int64)
+		template.Description, _ = row["description"].(string)
+		if parameters, isString := row["parameters"].(string); isString {
+			if err := json.Unmarshal([]byte(parameters), &template.Parameters); err != nil {
+				return nil, fmt.Errorf("unreadable parameters of template %s: %w", template.Name, err)
+			}
+		}
+		if createdAt, isString := row["created_at"].(string); isString {
+			template.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+		}
+		templates = append(templates, template)
+	}
+	return templates, nil
+}
+
+func tableExists(database Executor) (bool, error) {
+	rows, _, err := database.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", Table)
+	return len(rows) > 0, err
+}
+
+func notFound(name string) error {
+	return utils.NewError(utils.ErrorCodeNotFound, fmt.Sprintf("template %s not found", name), nil)
+}
+
+func nullable(value string) any {
+	if value == "" {
+		return nil
+	}
+	return value
+}
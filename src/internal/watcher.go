@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"sync"
+
+	"persisto/src/internal/databases"
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+
+	"go.uber.org/zap"
+)
+
+var (
+	localFileWatcherSetupOnce sync.Once
+)
+
+func SetupLocalFileWatcher() {
+	localFileWatcherSetupOnce.Do(func() {
+		err := localvfs.WatchExternalChanges(func(path string, removed bool) {
+			if databases.Dbs == nil {
+				return
+			}
+
+			databases.Dbs.HandleLocalFileChange(path, removed)
+		})
+
+		if err != nil {
+			utils.Logger.Error("Failed to watch local storage directory.", zap.Error(err))
+		}
+	})
+}
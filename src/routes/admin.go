@@ -0,0 +1,458 @@
+package routes
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/budgets"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/policies"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// ManifestSignatureHeader carries the HMAC-SHA256 of the manifest body, see databases.SignManifest.
+const ManifestSignatureHeader = "X-Persisto-Manifest-Signature"
+
+func authorizeAdmin(token string) error {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(utils.Config.Server.AdminToken.Value())) != 1 {
+		return newErrorModel(utils.ErrorCodeUnauthorized, "Invalid admin token.", "The provided admin token is invalid.")
+	}
+	return nil
+}
+
+func RegisterAdminRoutes(api huma.API) {
+	// NOTE: admin routes are only exposed once a token protects them
+	if utils.Config.Server.AdminToken.Value() == "" {
+		return
+	}
+
+	type ConfigurationInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type ConfigurationOutput struct {
+		Body struct {
+			Entries []utils.ConfigurationEntry `json:"entries"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-configuration",
+			Method:      http.MethodGet,
+			Path:        "/admin/configuration",
+			Summary:     "Get the effective configuration.",
+			Description: "Get the fully resolved configuration with the source of every value (default, profile, file, env or flag), secrets are redacted.",
+			Tags:        []string{"admin"},
+		},
+		func(ctx context.Context, input *ConfigurationInput) (*ConfigurationOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			recordAudit(ctx, audit.Event{Type: audit.EventConfigurationRead})
+
+			response := &ConfigurationOutput{}
+			response.Body.Entries = utils.EffectiveConfiguration()
+			return response, nil
+		},
+	)
+
+	type LogLevelsOutput struct {
+		Body struct {
+			Level      string            `json:"level" doc:"Level of the logs outside of any subsystem"`
+			Subsystems map[string]string `json:"subsystems"`
+		}
+	}
+	logLevels := func() *LogLevelsOutput {
+		response := &LogLevelsOutput{}
+		response.Body.Subsystems = make(map[string]string)
+		for subsystem, level := range utils.LogLevels() {
+			if subsystem == "" {
+				response.Body.Level = level.String()
+			} else {
+				response.Body.Subsystems[subsystem] = level.String()
+			}
+		}
+		return response
+	}
+
+	type GetLogLevelsInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-log-levels",
+			Method:      http.MethodGet,
+			Path:        "/admin/log-level",
+			Summary:     "Get the log levels.",
+			Description: "Get the current log level and the level of every subsystem.",
+			Tags:        []string{"admin"},
+		},
+		func(ctx context.Context, input *GetLogLevelsInput) (*LogLevelsOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			return logLevels(), nil
+		},
+	)
+
+	type SetLogLevelInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+		Body  struct {
+			Level     string `json:"level" enum:"debug,info,warn,error" doc:"New level"`
+			Subsystem string `json:"subsystem,omitempty" enum:"vfs,stages,http,pgwire" doc:"Subsystem to change, every logger when omitted"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-set-log-level",
+			Method:      http.MethodPut,
+			Path:        "/admin/log-level",
+			Summary:     "Change the log level.",
+			Description: "Change the log level at runtime, of every logger or of a single subsystem. The change isn't persisted and is lost on restart.",
+			Tags:        []string{"admin"},
+		},
+		func(ctx context.Context, input *SetLogLevelInput) (*LogLevelsOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			level, err := zapcore.ParseLevel(input.Body.Level)
+			if err != nil {
+				return nil, newErrorModel(utils.ErrorCodeInvalidInput, "Invalid log level.", err.Error())
+			}
+			if err := utils.SetLogLevel(input.Body.Subsystem, level); err != nil {
+				return nil, newErrorModel(utils.ErrorCodeInvalidInput, "Invalid subsystem.", err.Error())
+			}
+
+			utils.Logger.Info("Log level changed.", zap.String("subsystem", input.Body.Subsystem), zap.String("level", level.String()))
+			recordAudit(ctx, audit.Event{
+				Type:    audit.EventLogLevelChanged,
+				Details: map[string]any{"subsystem": input.Body.Subsystem, "level": level.String()},
+			})
+			return logLevels(), nil
+		},
+	)
+
+	type FreezeInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type FreezeOutput struct {
+		Body stages.FreezeStatus
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-freeze",
+			Method:      http.MethodGet,
+			Path:        "/admin/freeze",
+			Summary:     "Get whether the automatic movements are frozen.",
+			Description: "Get whether the automatic promotions, demotions and syncs are frozen, since when and why, and the promotions and syncs queued until they resume.",
+			Tags:        []string{"admin", "stages"},
+		},
+		func(ctx context.Context, input *FreezeInput) (*FreezeOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			return &FreezeOutput{Body: stages.GetFreezeStatus()}, nil
+		},
+	)
+
+	type SetFreezeInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+		Body  struct {
+			Frozen bool   `json:"frozen" doc:"Freeze the automatic movements, or resume them and run the operations queued meanwhile."`
+			Reason string `json:"reason,omitempty" maxLength:"256" example:"bucket maintenance" doc:"Why the movements are frozen, reported with the status."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-set-freeze",
+			Method:      http.MethodPut,
+			Path:        "/admin/freeze",
+			Summary:     "Freeze or resume the automatic movements.",
+			Description: "Pause the automatic promotions, demotions, evictions and syncs, e.g. during an incident or a maintenance of the bucket, or resume them. The promotions and syncs triggered while frozen are queued and run once resumed. Moves requested through the API still run. The freeze isn't persisted, SETTINGS_FREEZE_MOVEMENT starts the server frozen.",
+			Tags:        []string{"admin", "stages"},
+		},
+		func(ctx context.Context, input *SetFreezeInput) (*FreezeOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			var status stages.FreezeStatus
+			if input.Body.Frozen {
+				reason := input.Body.Reason
+				if reason == "" {
+					reason = "frozen through the API"
+				}
+				status = stages.Freeze(reason)
+				recordAudit(ctx, audit.Event{Type: audit.EventMovementsFrozen, Details: map[string]any{"reason": reason}})
+			} else {
+				queued := stages.GetFreezeStatus()
+				status = stages.Unfreeze()
+				recordAudit(ctx, audit.Event{
+					Type:    audit.EventMovementsResumed,
+					Details: map[string]any{"promotions": queued.PendingPromotions, "syncs": queued.PendingSyncs},
+				})
+			}
+			return &FreezeOutput{Body: status}, nil
+		},
+	)
+
+	type MonitorInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type MonitorOutput struct {
+		Body stages.MonitorStatus
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-monitor",
+			Method:      http.MethodGet,
+			Path:        "/admin/monitor",
+			Summary:     "Get the state of the stage monitor.",
+			Description: "Get when the stage monitor last scanned the databases, how many it checked and demoted, the promotions, demotions and syncs pending and the last failures of the background stage operations. The counters are kept in memory and reset on restart.",
+			Tags:        []string{"admin", "stages"},
+		},
+		func(ctx context.Context, input *MonitorInput) (*MonitorOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			return &MonitorOutput{Body: stages.GetMonitorStatus()}, nil
+		},
+	)
+
+	type DeadLettersInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type DeadLettersOutput struct {
+		Body struct {
+			DeadLetters []stages.DeadLetter `json:"dead_letters"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-sync-dead-letters",
+			Method:      http.MethodGet,
+			Path:        "/admin/sync/dead-letters",
+			Summary:     "List the databases whose syncs kept failing.",
+			Description: "List the databases whose background syncs still failed after SETTINGS_SYNC_MAX_RETRIES retries, with their failures and last error. A database leaves the list once a sync succeeds.",
+			Tags:        []string{"admin", "stages"},
+		},
+		func(ctx context.Context, input *DeadLettersInput) (*DeadLettersOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			output := &DeadLettersOutput{}
+			output.Body.DeadLetters = stages.DeadLetters()
+			return output, nil
+		},
+	)
+
+	type DeadLetterInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+		Name  string `path:"name"`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-retry-sync-dead-letter",
+			Method:      http.MethodPost,
+			Path:        "/admin/sync/dead-letters/{name}/retry",
+			Summary:     "Retry the sync of a dead-lettered database.",
+			Description: "Sync the database to the remote stage right away, it leaves the dead letters once the sync succeeds.",
+			Tags:        []string{"admin", "stages"},
+		},
+		func(ctx context.Context, input *DeadLetterInput) (*DeadLettersOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+			if err := stages.SyncToRemoteStage(database); err != nil {
+				return nil, errorFrom(err, "Failed to sync the database.")
+			}
+			recordAudit(ctx, audit.Event{Type: audit.EventDatabaseSynced, Database: database.Name, Details: map[string]any{"dead_letter": true}})
+
+			output := &DeadLettersOutput{}
+			output.Body.DeadLetters = stages.DeadLetters()
+			return output, nil
+		},
+	)
+
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-dismiss-sync-dead-letter",
+			Method:      http.MethodDelete,
+			Path:        "/admin/sync/dead-letters/{name}",
+			Summary:     "Dismiss a dead-lettered database.",
+			Description: "Take the database out of the dead letters without syncing it, e.g. once it was handled by hand. Its next failed sync is retried again.",
+			Tags:        []string{"admin", "stages"},
+		},
+		func(ctx context.Context, input *DeadLetterInput) (*DeadLettersOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !stages.DismissDeadLetter(input.Name) {
+				return nil, newErrorModel(utils.ErrorCodeNotFound, "Dead letter not found.", fmt.Sprintf("database %s isn't dead-lettered", input.Name))
+			}
+			recordAudit(ctx, audit.Event{Type: audit.EventDeadLetterDismissed, Database: input.Name})
+
+			output := &DeadLettersOutput{}
+			output.Body.DeadLetters = stages.DeadLetters()
+			return output, nil
+		},
+	)
+
+	type FailbackInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type FailbackOutput struct {
+		Body *stages.FailbackReport
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-sync-failback",
+			Method:      http.MethodGet,
+			Path:        "/admin/sync/failback",
+			Summary:     "Get the last reconciliation after a remote outage.",
+			Description: "Get how the databases whose syncs failed while the remote storage was down were reconciled with their remote copies once it was healthy again, per SETTINGS_FAILBACK_CONFLICT_POLICY.",
+			Tags:        []string{"admin", "stages"},
+		},
+		func(ctx context.Context, input *FailbackInput) (*FailbackOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			report := stages.LastFailback()
+			if report == nil {
+				return nil, newErrorModel(utils.ErrorCodeNotFound, "No failback yet.", "the remote storage didn't fail since the start")
+			}
+			return &FailbackOutput{Body: report}, nil
+		},
+	)
+
+	type SimulateInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+		Body  struct {
+			RequestCountThreshold    *uint    `json:"request_count_threshold,omitempty" minimum:"1" doc:"Defaults to SETTINGS_REQUEST_COUNT_THRESHOLD."`
+			StageTimeoutSeconds      *int     `json:"stage_timeout_seconds,omitempty" minimum:"1" doc:"Defaults to SETTINGS_STAGE_TIMEOUT_SECONDS."`
+			MinStageResidencySeconds *int     `json:"min_stage_residency_seconds,omitempty" minimum:"0" doc:"Defaults to SETTINGS_MIN_STAGE_RESIDENCY_SECONDS."`
+			MoveCooldownSeconds      *int     `json:"move_cooldown_seconds,omitempty" minimum:"0" doc:"Defaults to SETTINGS_MOVE_COOLDOWN_SECONDS."`
+			BudgetsLimits            []string `json:"budgets_limits,omitempty" example:"[\"*:daily_queries=10000\"]" doc:"Budgets in the format of BUDGETS_LIMITS, defaults to the configured ones."`
+		}
+	}
+	type SimulateOutput struct {
+		Body struct {
+			stages.Simulation
+			Budgets []budgets.BudgetReport `json:"budgets" doc:"Consumption of the principals over the current day and month against the proposed budgets."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-simulate",
+			Method:      http.MethodPost,
+			Path:        "/admin/simulate",
+			Summary:     "Simulate settings of the automatic movements and budgets.",
+			Description: "Replay the accesses recorded over the last SETTINGS_ACCESS_HISTORY_SECONDS against the current and the proposed thresholds and timeouts, and report the promotions and demotions each would have caused, along with the principals the proposed budgets would refuse. Nothing is moved and the settings are left unchanged. The replay leaves out the local capacity, the freezes and the moves requested through the API.",
+			Tags:        []string{"admin", "stages"},
+		},
+		func(ctx context.Context, input *SimulateInput) (*SimulateOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			proposed := stages.CurrentSimulationSettings()
+			if input.Body.RequestCountThreshold != nil {
+				proposed.RequestCountThreshold = *input.Body.RequestCountThreshold
+			}
+			if input.Body.StageTimeoutSeconds != nil {
+				proposed.StageTimeoutSeconds = *input.Body.StageTimeoutSeconds
+			}
+			if input.Body.MinStageResidencySeconds != nil {
+				proposed.MinStageResidencySeconds = *input.Body.MinStageResidencySeconds
+			}
+			if input.Body.MoveCooldownSeconds != nil {
+				proposed.MoveCooldownSeconds = *input.Body.MoveCooldownSeconds
+			}
+
+			principals := policies.Principals()
+			limits := utils.Config.Budgets.Limits
+			if input.Body.BudgetsLimits != nil {
+				known := map[string]bool{}
+				for _, principal := range principals {
+					known[principal] = true
+				}
+				if problems := utils.BudgetLimitsProblems(input.Body.BudgetsLimits, known); len(problems) > 0 {
+					return nil, newErrorModel(utils.ErrorCodeInvalidInput, "Invalid budgets.", strings.Join(problems, "; "))
+				}
+				limits = input.Body.BudgetsLimits
+			}
+
+			output := &SimulateOutput{}
+			output.Body.Simulation = stages.Simulate(proposed)
+			output.Body.Budgets = budgets.Simulate(limits, principals)
+			return output, nil
+		},
+	)
+
+	type ManifestInput struct {
+		Token     string `header:"X-Persisto-Admin-Token"`
+		Checksums bool   `query:"checksums" default:"true" doc:"Include the checksum of the content of every database, which reads all of their rows."`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-manifest",
+			Method:      http.MethodGet,
+			Path:        "/admin/manifest",
+			Summary:     "Get the manifest of the databases.",
+			Description: "Get a JSON inventory of every database of the catalog with its stage, size, checksum and the last sync of its remote copy. With MANIFEST_SIGNING_KEY, the HMAC-SHA256 of the body is sent in the X-Persisto-Manifest-Signature header.",
+			Tags:        []string{"admin"},
+			Responses: map[string]*huma.Response{
+				"200": {Description: "Manifest of the databases.", Content: map[string]*huma.MediaType{"application/json": {}}},
+			},
+		},
+		func(ctx context.Context, input *ManifestInput) (*huma.StreamResponse, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			// NOTE: signed as sent, the consumers verify the exact bytes they received
+			body, err := json.Marshal(databases.Dbs.Manifest(input.Checksums))
+			if err != nil {
+				return nil, errorFrom(err, "Failed to build the manifest.")
+			}
+			signature := databases.SignManifest(body)
+
+			return &huma.StreamResponse{
+				Body: func(ctx huma.Context) {
+					ctx.SetHeader("Content-Type", "application/json")
+					if signature != "" {
+						ctx.SetHeader(ManifestSignatureHeader, signature)
+					}
+					ctx.BodyWriter().Write(body)
+				},
+			}, nil
+		},
+	)
+}
@@ -0,0 +1,99 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"persisto/src/internal/analytics"
+	"persisto/src/internal/databases"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterAnalyticsRoutes(api huma.API) {
+	type DatabaseAnalyticsInput struct {
+		Name   string `path:"name"`
+		Window string `query:"window" default:"1h" doc:"Rolling window the statements are aggregated over, e.g. 5m, 1h or 24h."`
+		Limit  int    `query:"limit" minimum:"0" doc:"Number of statements per ranking, defaults to ANALYTICS_DEFAULT_LIMIT."`
+	}
+	type DatabaseAnalyticsOutput struct {
+		Body struct {
+			Database     string                `json:"database"`
+			Window       string                `json:"window"`
+			Slowest      []analytics.Statement `json:"slowest"`
+			MostFrequent []analytics.Statement `json:"most_frequent"`
+			MostScanned  []analytics.Statement `json:"most_scanned"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-analytics",
+			Method:      http.MethodGet,
+			Path:        "/databases/{name}/analytics",
+			Summary:     "Get the top statements of a database.",
+			Description: "Get the statements of the database ranked by mean duration, executions and rows scanned over a rolling window, statements differing only by their literals are aggregated together.",
+			Tags:        []string{"analytics"},
+		},
+		func(ctx context.Context, input *DatabaseAnalyticsInput) (*DatabaseAnalyticsOutput, error) {
+			if !utils.Config.Analytics.Enabled {
+				return nil, newErrorModel(utils.ErrorCodeStageUnavailable, "Analytics disabled.", "Set ANALYTICS_ENABLED to collect statement statistics.")
+			}
+
+			retention := time.Duration(utils.Config.Analytics.RetentionMinutes) * time.Minute
+			window, err := time.ParseDuration(input.Window)
+			if err != nil || window < time.Minute || window > retention {
+				return nil, newErrorModel(utils.ErrorCodeInvalidInput, "Invalid window.", fmt.Sprintf("Window must be a duration between 1m and %s.", retention))
+			}
+
+			if _, err := databases.Dbs.FindByName(input.Name); err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			limit := input.Limit
+			if limit == 0 {
+				limit = utils.Config.Analytics.DefaultLimit
+			}
+
+			response := &DatabaseAnalyticsOutput{}
+			response.Body.Database = input.Name
+			response.Body.Window = window.String()
+			response.Body.Slowest = analytics.Top(input.Name, window, analytics.OrderSlowest, limit)
+			response.Body.MostFrequent = analytics.Top(input.Name, window, analytics.OrderFrequent, limit)
+			response.Body.MostScanned = analytics.Top(input.Name, window, analytics.OrderScanned, limit)
+			return response, nil
+		},
+	)
+	type DatabaseStorageInput struct {
+		Name string `path:"name"`
+	}
+	type DatabaseStorageOutput struct {
+		Body utils.StorageStats
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-storage",
+			Method:      http.MethodGet,
+			Path:        "/databases/{name}/storage",
+			Summary:     "Get the size breakdown of a database.",
+			Description: "Get the pages, payload and unused bytes of every table and index of the database, as the DBSTAT virtual table reports them, with their fragmentation and the bytes a VACUUM would reclaim. The b-trees are walked page by page at the stage the database is served from, which reads the whole database.",
+			Tags:        []string{"analytics"},
+		},
+		func(ctx context.Context, input *DatabaseStorageInput) (*DatabaseStorageOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			stats, err := database.StorageStats(ctx)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to read the size breakdown of the database.")
+			}
+			return &DatabaseStorageOutput{Body: stats}, nil
+		},
+	)
+}
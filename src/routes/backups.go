@@ -0,0 +1,462 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/backups"
+	"persisto/src/internal/checks"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/hooks"
+	"persisto/src/internal/jobs"
+	"persisto/src/internal/journal"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	huma "github.com/danielgtaylor/huma/v2"
+	"go.uber.org/zap"
+)
+
+func RegisterBackupsRoutes(api huma.API) {
+	type ListBackupsInput struct {
+		Name string `path:"name"`
+	}
+	type ListBackupsOutput struct {
+		Body struct {
+			Backups []backups.Backup `json:"backups"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-backups-list",
+			Method:      http.MethodGet,
+			Path:        "/databases/{name}/backups",
+			Summary:     "List the backups of a database.",
+			Description: "List the backups of a database, newest first.",
+			Tags:        []string{"backups"},
+		},
+		func(ctx context.Context, input *ListBackupsInput) (*ListBackupsOutput, error) {
+			list, err := backups.List(input.Name)
+			if err != nil {
+				return nil, newErrorModel(utils.ErrorCodeStageUnavailable, "Failed to list backups.", err.Error())
+			}
+
+			response := &ListBackupsOutput{}
+			response.Body.Backups = list
+			return response, nil
+		},
+	)
+
+	type CreateBackupInput struct {
+		Name string `path:"name"`
+	}
+	type BackupOutput struct {
+		Body backups.Backup
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "database-backups-create",
+			Method:        http.MethodPost,
+			Path:          "/databases/{name}/backups",
+			Summary:       "Back up a database.",
+			Description:   "Take a consistent snapshot of the database to the backup prefix right away, outside of the schedule.",
+			Tags:          []string{"backups"},
+			DefaultStatus: http.StatusCreated,
+		},
+		func(ctx context.Context, input *CreateBackupInput) (*BackupOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			backup, err := backups.Create(database)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to back up the database.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventDatabaseBackedUp,
+				Database: database.Name,
+				Details:  map[string]any{"key": backup.Key, "sizeBytes": backup.SizeBytes},
+			})
+
+			return &BackupOutput{Body: backup}, nil
+		},
+	)
+
+	type RestoreBackupInput struct {
+		Name string `path:"name"`
+		Body struct {
+			Key      string    `json:"key,omitempty" doc:"Key of the backup to restore, as listed"`
+			At       time.Time `json:"at,omitempty" doc:"Restore the newest backup taken at or before this time instead of a given key"`
+			Target   string    `json:"target" minLength:"1" maxLength:"128" example:"production-db-restored" doc:"Name of the database created from the backup, following the same naming scheme as the created databases"`
+			Workload string    `json:"workload,omitempty" enum:"read_heavy,write_heavy,archival" doc:"Expected workload of the database, picking its initial stage with its size, see the create endpoint."`
+		}
+	}
+	type RestoreBackupOutput struct {
+		Body struct {
+			Name     string               `json:"name"`
+			Stage    uint                 `json:"stage"`
+			Manifest *backups.Manifest    `json:"manifest,omitempty" doc:"Manifest the backup was checked against, left out for the backups taken without one."`
+			Checks   []checks.CheckResult `json:"checks,omitempty" doc:"Results of the checks the restored database holds, the database is restored even when some fail."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "database-backups-restore",
+			Method:        http.MethodPost,
+			Path:          "/databases/{name}/backups/restore",
+			Summary:       "Restore a backup of a database.",
+			Description:   "Create a new database from a backup of the database, either given by its key or as the newest one taken at or before a point in time. The database is placed at the stage its size and declared workload call for. The backup is checked against its manifest first. The database the backup was taken from is left untouched.",
+			Tags:          []string{"backups"},
+			DefaultStatus: http.StatusCreated,
+		},
+		func(ctx context.Context, input *RestoreBackupInput) (*RestoreBackupOutput, error) {
+			target := utils.NormalizeDatabaseName(input.Body.Target)
+			if err := utils.ValidateDatabaseName(target); err != nil {
+				return nil, errorFrom(err, "Invalid target name.")
+			}
+
+			if (input.Body.Key == "") == input.Body.At.IsZero() {
+				return nil, newErrorModel(utils.ErrorCodeInvalidInput, "Invalid backup selection.", "Exactly one of key and at must be given.")
+			}
+
+			if _, err := databases.Dbs.FindByName(target); err == nil {
+				return nil, newErrorModel(utils.ErrorCodeConflict, "Database already exists.", "A database with the target name already exists.")
+			}
+			// NOTE: an object not in the catalog yet would be overwritten by the restoration
+			if _, err := remotevfs.FileSize(utils.DatabaseFileName(target)); err == nil {
+				return nil, newErrorModel(utils.ErrorCodeConflict, "Database already exists.", "The remote stage already holds a database with the target name.")
+			}
+
+			var backup backups.Backup
+			var err error
+			if input.Body.Key != "" {
+				backup, err = backups.Find(input.Name, input.Body.Key)
+			} else {
+				backup, err = backups.FindAt(input.Name, input.Body.At)
+			}
+			if err != nil {
+				return nil, errorFrom(err, "Backup not found.")
+			}
+
+			// NOTE: a restoration interrupted by a crash would leave a half-written copy adopted as the target at startup
+			id, err := journal.Begin(journal.Intent{Operation: journal.OperationRestore, Database: target})
+			if err != nil {
+				return nil, errorFrom(err, "Failed to restore the backup.")
+			}
+			defer journal.End(id)
+
+			manifest, err := backups.RestoreTo(backup, target)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to restore the backup.")
+			}
+
+			database, err := databases.Dbs.AddRemoteDatabase(target)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to add the restored database to the catalog.")
+			}
+			placeRestored(database, input.Body.Workload)
+
+			results, err := database.RunChecks(ctx)
+			if err != nil {
+				database.GetLogger().Warn("Failed to run the checks of the restored database.", zap.Error(err))
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventDatabaseRestored,
+				Database: database.Name,
+				Details:  map[string]any{"source": input.Name, "key": backup.Key, "at": input.Body.At, "verified": manifest != nil},
+			})
+
+			response := &RestoreBackupOutput{}
+			response.Body.Name = database.Name
+			response.Body.Stage = database.Stage
+			response.Body.Manifest = manifest
+			response.Body.Checks = results
+			return response, nil
+		},
+	)
+
+	type VerifyBackupInput struct {
+		Name string `path:"name"`
+		Body struct {
+			Key string `json:"key" minLength:"1" doc:"Key of the backup to verify, as listed"`
+		}
+	}
+	type VerifyBackupOutput struct {
+		Body backups.Manifest
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-backups-verify",
+			Method:      http.MethodPost,
+			Path:        "/databases/{name}/backups/verify",
+			Summary:     "Verify a backup of a database.",
+			Description: "Download the backup, decrypted when it is encrypted, and check its size and SHA-256 digest against its manifest. A backup not matching its manifest fails with `corrupted`, and the backups taken without manifest with `not_found`.",
+			Tags:        []string{"backups"},
+		},
+		func(ctx context.Context, input *VerifyBackupInput) (*VerifyBackupOutput, error) {
+			backup, err := backups.Find(input.Name, input.Body.Key)
+			if err != nil {
+				return nil, errorFrom(err, "Backup not found.")
+			}
+
+			manifest, err := backups.Verify(backup)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to verify the backup.")
+			}
+			return &VerifyBackupOutput{Body: manifest}, nil
+		},
+	)
+
+	type ListSnapshotsInput struct {
+		Name string `path:"name"`
+	}
+	type ListSnapshotsOutput struct {
+		Body struct {
+			Snapshots []backups.Snapshot `json:"snapshots"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-snapshots-list",
+			Method:      http.MethodGet,
+			Path:        "/databases/{name}/snapshots",
+			Summary:     "List the snapshots of a database.",
+			Description: "List the named snapshots of a database, newest first.",
+			Tags:        []string{"backups"},
+		},
+		func(ctx context.Context, input *ListSnapshotsInput) (*ListSnapshotsOutput, error) {
+			list, err := backups.ListSnapshots(input.Name)
+			if err != nil {
+				return nil, newErrorModel(utils.ErrorCodeStageUnavailable, "Failed to list snapshots.", err.Error())
+			}
+
+			response := &ListSnapshotsOutput{}
+			response.Body.Snapshots = list
+			return response, nil
+		},
+	)
+
+	type CreateSnapshotInput struct {
+		Name string `path:"name"`
+		Body struct {
+			Tag string `json:"tag" minLength:"1" maxLength:"64" example:"before-migration-42" doc:"Name of the snapshot, letters, digits, dots, dashes and underscores"`
+		}
+	}
+	type SnapshotOutput struct {
+		Body backups.Snapshot
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "database-snapshots-create",
+			Method:        http.MethodPost,
+			Path:          "/databases/{name}/snapshots",
+			Summary:       "Take a snapshot of a database.",
+			Description:   "Take a consistent snapshot of the database named by a tag, e.g. before a risky migration. Snapshots are independent of the scheduled backups, they are kept until deleted and a tag can't be reused while its snapshot exists.",
+			Tags:          []string{"backups"},
+			DefaultStatus: http.StatusCreated,
+		},
+		func(ctx context.Context, input *CreateSnapshotInput) (*SnapshotOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			snapshot, err := backups.CreateSnapshot(database, input.Body.Tag)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to take the snapshot.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventSnapshotCreated,
+				Database: database.Name,
+				Details:  map[string]any{"tag": snapshot.Tag, "key": snapshot.Key, "sizeBytes": snapshot.SizeBytes},
+			})
+
+			return &SnapshotOutput{Body: snapshot}, nil
+		},
+	)
+
+	type SnapshotInput struct {
+		Name string `path:"name"`
+		Tag  string `path:"tag"`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "database-snapshots-delete",
+			Method:        http.MethodDelete,
+			Path:          "/databases/{name}/snapshots/{tag}",
+			Summary:       "Delete a snapshot of a database.",
+			Description:   "Delete the snapshot of a database named by the tag, the tag can be used again afterwards.",
+			Tags:          []string{"backups"},
+			DefaultStatus: http.StatusNoContent,
+		},
+		func(ctx context.Context, input *SnapshotInput) (*struct{}, error) {
+			if err := backups.DeleteSnapshot(input.Name, input.Tag); err != nil {
+				return nil, errorFrom(err, "Failed to delete the snapshot.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventSnapshotDeleted,
+				Database: input.Name,
+				Details:  map[string]any{"tag": input.Tag},
+			})
+			return nil, nil
+		},
+	)
+
+	type RestoreSnapshotOutput struct {
+		Body struct {
+			Name   string               `json:"name"`
+			Stage  uint                 `json:"stage"`
+			Checks []checks.CheckResult `json:"checks" doc:"Results of the checks the restored content holds, the content is restored even when some fail."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-snapshots-restore",
+			Method:      http.MethodPost,
+			Path:        "/databases/{name}/snapshots/{tag}/restore",
+			Summary:     "Restore a database from one of its snapshots.",
+			Description: "Replace the content of the database by the snapshot named by the tag, in place and on whichever stage the database is on. The writes made since the snapshot was taken are lost, take another snapshot first to keep them. The requests sent during the restoration wait for it.",
+			Tags:        []string{"backups"},
+		},
+		func(ctx context.Context, input *SnapshotInput) (*RestoreSnapshotOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			snapshot, err := backups.FindSnapshot(input.Name, input.Tag)
+			if err != nil {
+				return nil, errorFrom(err, "Snapshot not found.")
+			}
+
+			results, err := database.RestoreFrom(snapshot.URI())
+			if err != nil {
+				return nil, errorFrom(err, "Failed to restore the snapshot.")
+			}
+
+			// NOTE: the jobs are stored in the database, the restored content may schedule other ones
+			if utils.Config.Jobs.Enabled {
+				if err := jobs.Reload(database); err != nil {
+					database.GetLogger().Warn("Failed to reload the jobs of the restored database.", zap.Error(err))
+				}
+			}
+			if utils.Config.Hooks.Enabled {
+				if err := hooks.Reload(database); err != nil {
+					database.GetLogger().Warn("Failed to reload the hooks of the restored database.", zap.Error(err))
+				}
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventDatabaseRestored,
+				Database: database.Name,
+				Details:  map[string]any{"source": input.Name, "snapshot": snapshot.Tag, "key": snapshot.Key, "inPlace": true, "checksPassed": checks.Failed(results) == nil},
+			})
+
+			response := &RestoreSnapshotOutput{}
+			response.Body.Name = database.Name
+			response.Body.Stage = database.Stage
+			response.Body.Checks = results
+			return response, nil
+		},
+	)
+
+	type CloneSnapshotInput struct {
+		Name string `path:"name"`
+		Tag  string `path:"tag"`
+		Body struct {
+			Target   string `json:"target" minLength:"1" maxLength:"128" example:"production-db-clone" doc:"Name of the database created from the snapshot, following the same naming scheme as the created databases"`
+			Workload string `json:"workload,omitempty" enum:"read_heavy,write_heavy,archival" doc:"Expected workload of the database, picking its initial stage with its size, see the create endpoint."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "database-snapshots-clone",
+			Method:        http.MethodPost,
+			Path:          "/databases/{name}/snapshots/{tag}/clone",
+			Summary:       "Clone a snapshot of a database.",
+			Description:   "Create a new database from the snapshot named by the tag, placed at the stage its size and declared workload call for. The database the snapshot was taken from is left untouched.",
+			Tags:          []string{"backups"},
+			DefaultStatus: http.StatusCreated,
+		},
+		func(ctx context.Context, input *CloneSnapshotInput) (*RestoreSnapshotOutput, error) {
+			target := utils.NormalizeDatabaseName(input.Body.Target)
+			if err := utils.ValidateDatabaseName(target); err != nil {
+				return nil, errorFrom(err, "Invalid target name.")
+			}
+
+			if _, err := databases.Dbs.FindByName(target); err == nil {
+				return nil, newErrorModel(utils.ErrorCodeConflict, "Database already exists.", "A database with the target name already exists.")
+			}
+			// NOTE: an object not in the catalog yet would be overwritten by the clone
+			if _, err := remotevfs.FileSize(utils.DatabaseFileName(target)); err == nil {
+				return nil, newErrorModel(utils.ErrorCodeConflict, "Database already exists.", "The remote stage already holds a database with the target name.")
+			}
+
+			snapshot, err := backups.FindSnapshot(input.Name, input.Tag)
+			if err != nil {
+				return nil, errorFrom(err, "Snapshot not found.")
+			}
+
+			id, err := journal.Begin(journal.Intent{Operation: journal.OperationRestore, Database: target})
+			if err != nil {
+				return nil, errorFrom(err, "Failed to clone the snapshot.")
+			}
+			defer journal.End(id)
+
+			if err := backups.CloneSnapshotTo(snapshot, target); err != nil {
+				return nil, errorFrom(err, "Failed to clone the snapshot.")
+			}
+
+			database, err := databases.Dbs.AddRemoteDatabase(target)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to add the restored database to the catalog.")
+			}
+			placeRestored(database, input.Body.Workload)
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventDatabaseRestored,
+				Database: database.Name,
+				Details:  map[string]any{"source": input.Name, "snapshot": snapshot.Tag, "key": snapshot.Key},
+			})
+
+			response := &RestoreSnapshotOutput{}
+			response.Body.Name = database.Name
+			response.Body.Stage = database.Stage
+			return response, nil
+		},
+	)
+}
+
+// placeRestored moves a database restored in the remote stage to the stage its size and workload call for, see
+// stages.InitialStage. The database stays in the remote stage when the move fails, it is restored either way.
+func placeRestored(database *databases.Database, workload string) {
+	size, err := remotevfs.FileSize(utils.DatabaseFileName(database.Name))
+	if err != nil {
+		database.GetLogger().Warn("Failed to get the size of the restored database, placing it as an empty one.", zap.Error(err))
+	}
+
+	stage := stages.InitialStage(size, workload)
+	if stage == database.GetStage() {
+		return
+	}
+	if err := stages.PlaceDatabase(database, stage); err != nil {
+		database.GetLogger().Warn("Failed to place the restored database at its initial stage.", zap.Uint("stage", stage), zap.Error(err))
+	}
+}
@@ -0,0 +1,154 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/policies"
+	"persisto/src/internal/replication"
+	"persisto/src/internal/statements"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+	"go.uber.org/zap"
+)
+
+func RegisterBlobsRoutes(api huma.API) {
+	type ReadBlobInput struct {
+		Name           string `path:"name"`
+		PrincipalToken string `header:"X-Persisto-Principal-Token" doc:"Token of the principal whose policies restrict the blob."`
+		Table          string `query:"table" required:"true" minLength:"1"`
+		Column         string `query:"column" required:"true" minLength:"1"`
+		RowID          int64  `query:"rowid" required:"true"`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-blob-read",
+			Method:      http.MethodGet,
+			Path:        "/databases/{name}/blob",
+			Summary:     "Read a blob.",
+			Description: "Stream the blob or text stored in the column of the row with the given rowid as raw bytes, without loading it in memory nor encoding it in JSON.",
+			Tags:        []string{"databases"},
+			Responses: map[string]*huma.Response{
+				"200": {Description: "Content of the blob.", Content: map[string]*huma.MediaType{"application/octet-stream": {}}},
+			},
+		},
+		func(ctx context.Context, input *ReadBlobInput) (*huma.StreamResponse, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			principal, err := policies.Authenticate(input.PrincipalToken)
+			if err != nil {
+				return nil, errorFrom(err, "Invalid principal.")
+			}
+
+			read := func(read func(size int64, blob io.Reader) error) error {
+				return database.ReadBlobAs(ctx, principal, statements.EndpointQuery, input.Table, input.Column, input.RowID, read)
+			}
+			if replication.IsFollower() {
+				// NOTE: followers answer from their local replica rather than reading the remote object
+				read = func(read func(size int64, blob io.Reader) error) error {
+					return replication.ReadBlob(ctx, database.Name, principal, statements.EndpointQuery, input.Table, input.Column, input.RowID, read)
+				}
+			}
+
+			return &huma.StreamResponse{
+				Body: func(ctx huma.Context) {
+					started := false
+					err := read(func(size int64, blob io.Reader) error {
+						started = true
+						ctx.SetHeader("Content-Type", "application/octet-stream")
+						ctx.SetHeader("Content-Length", strconv.FormatInt(size, 10))
+						_, err := io.Copy(ctx.BodyWriter(), blob)
+						return err
+					})
+					if err == nil {
+						return
+					}
+
+					// NOTE: once the blob started being sent the error can only cut the response short
+					if started {
+						utils.HTTPLogger.Warn("Failed to stream blob.", zap.String("database", database.Name), zap.Error(err))
+						return
+					}
+					writeStreamError(ctx, errorFrom(err, "Failed to read the blob."))
+				},
+			}, nil
+		},
+	)
+
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-blob-write",
+			Method:      http.MethodPut,
+			Path:        "/databases/{name}/blob",
+			Summary:     "Write a blob.",
+			Description: "Replace the value stored in the column of the row with the given rowid by the raw bytes of the body, streamed into the database without loading them in memory. The Content-Length header is required, the value is resized to it before the bytes are written.",
+			Tags:        []string{"databases"},
+			RequestBody: &huma.RequestBody{
+				Description: "Content of the blob.",
+				Required:    true,
+				Content:     map[string]*huma.MediaType{"application/octet-stream": {}},
+			},
+		},
+		func(ctx context.Context, input *WriteBlobInput) (*struct{}, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			principal, err := policies.Authenticate(input.PrincipalToken)
+			if err != nil {
+				return nil, errorFrom(err, "Invalid principal.")
+			}
+
+			err = database.WriteBlobAs(ctx, principal, statements.EndpointExecute, input.Table, input.Column, input.RowID, input.size, input.body)
+
+			details := map[string]any{"blob": fmt.Sprintf("%s.%s", input.Table, input.Column), "rowid": input.RowID, "bytes": input.size}
+			if err != nil {
+				details["error"] = err.Error()
+			}
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventDatabaseExecuted,
+				Database: database.Name,
+				Details:  executedDetails(principal, details),
+			})
+
+			if err != nil {
+				return nil, errorFrom(err, "Failed to write the blob.")
+			}
+			return nil, nil
+		},
+	)
+}
+
+// WriteBlobInput takes the body as is, it is streamed into the database rather than read by huma.
+type WriteBlobInput struct {
+	Name           string `path:"name"`
+	PrincipalToken string `header:"X-Persisto-Principal-Token" doc:"Token of the principal whose policies restrict the blob."`
+	Table          string `query:"table" required:"true" minLength:"1"`
+	Column         string `query:"column" required:"true" minLength:"1"`
+	RowID          int64  `query:"rowid" required:"true"`
+
+	size int64
+	body io.Reader
+}
+
+func (input *WriteBlobInput) Resolve(ctx huma.Context) []error {
+	size, err := strconv.ParseInt(ctx.Header("Content-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return []error{&huma.ErrorDetail{Location: "header.Content-Length", Message: "the size of the blob is required, chunked bodies can't be streamed"}}
+	}
+	input.size = size
+	input.body = ctx.BodyReader()
+	return nil
+}
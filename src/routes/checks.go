@@ -0,0 +1,200 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/checks"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/replication"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterChecksRoutes(api huma.API) {
+	// NOTE: the checks run arbitrary queries on the copies of the database, the routes are only exposed once a token
+	// protects them
+	if utils.Config.Server.AdminToken.Value() == "" {
+		return
+	}
+
+	type ListChecksInput struct {
+		Name  string `path:"name"`
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type ListChecksOutput struct {
+		Body struct {
+			Checks []checks.Check `json:"checks"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-checks-list",
+			Method:      http.MethodGet,
+			Path:        "/admin/databases/{name}/checks",
+			Summary:     "List the checks of a database.",
+			Description: "List the queries verifying the copies of the database after its stage moves, restores and drills.",
+			Tags:        []string{"admin", "checks"},
+		},
+		func(ctx context.Context, input *ListChecksInput) (*ListChecksOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			list, err := checks.List(database)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to list the checks.")
+			}
+
+			response := &ListChecksOutput{}
+			response.Body.Checks = list
+			return response, nil
+		},
+	)
+
+	type SetCheckInput struct {
+		Name  string `path:"name"`
+		Check string `path:"check"`
+		Token string `header:"X-Persisto-Admin-Token"`
+		Body  struct {
+			Query      string `json:"query" minLength:"1" example:"SELECT count(*) FROM orders" doc:"Query whose first value is asserted."`
+			Comparison string `json:"comparison,omitempty" enum:"eq,ne,gt,gte,lt,lte" doc:"Comparison of the first value with the expected one, eq when only the expected value is given."`
+			Expected   string `json:"expected,omitempty" example:"0" doc:"Expected value, compared as numbers when both are. The first value must be neither NULL, 0, false nor empty when left out."`
+		}
+	}
+	type SetCheckOutput struct {
+		Body struct {
+			Check  checks.Check       `json:"check"`
+			Result checks.CheckResult `json:"result" doc:"Result of the check on the current content of the database."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-check-set",
+			Method:      http.MethodPut,
+			Path:        "/admin/databases/{name}/checks/{check}",
+			Summary:     "Set a check of a database.",
+			Description: "Create or replace a query asserting an invariant of the database. The check is stored in the database, it runs on every copy the database is moved to, restored to or drilled from. A demotion is refused while the copy at the upper stage fails a check. The query must run on the current content, which needn't pass it.",
+			Tags:        []string{"admin", "checks"},
+		},
+		func(ctx context.Context, input *SetCheckInput) (*SetCheckOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Checks must be set on the primary instance.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			check, result, err := checks.Set(database, checks.Check{Name: input.Check, Query: input.Body.Query, Comparison: input.Body.Comparison, Expected: input.Body.Expected})
+			if err != nil {
+				return nil, errorFrom(err, "Failed to set the check.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventCheckSet,
+				Database: database.Name,
+				Details:  map[string]any{"check": check.Name, "query": check.Query, "comparison": check.Comparison, "expected": check.Expected},
+			})
+
+			response := &SetCheckOutput{}
+			response.Body.Check = check
+			response.Body.Result = result
+			return response, nil
+		},
+	)
+
+	type CheckInput struct {
+		Name  string `path:"name"`
+		Check string `path:"check"`
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "admin-check-remove",
+			Method:        http.MethodDelete,
+			Path:          "/admin/databases/{name}/checks/{check}",
+			Summary:       "Remove a check of a database.",
+			Description:   "Remove the check, the copies taken before keep it until they are replaced.",
+			Tags:          []string{"admin", "checks"},
+			DefaultStatus: http.StatusNoContent,
+		},
+		func(ctx context.Context, input *CheckInput) (*struct{}, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Checks must be removed on the primary instance.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			if err := checks.Remove(database, input.Check); err != nil {
+				return nil, errorFrom(err, "Failed to remove the check.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventCheckRemoved,
+				Database: database.Name,
+				Details:  map[string]any{"check": input.Check},
+			})
+
+			return nil, nil
+		},
+	)
+
+	type RunChecksOutput struct {
+		Body struct {
+			Passed  bool                 `json:"passed"`
+			Results []checks.CheckResult `json:"results"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-checks-run",
+			Method:      http.MethodPost,
+			Path:        "/admin/databases/{name}/checks/run",
+			Summary:     "Run the checks of a database.",
+			Description: "Run the checks on the copy the database is served from, read-only, and return their results.",
+			Tags:        []string{"admin", "checks"},
+		},
+		func(ctx context.Context, input *ListChecksInput) (*RunChecksOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			results, err := database.RunChecks(ctx)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to run the checks.")
+			}
+
+			response := &RunChecksOutput{}
+			response.Body.Passed = checks.Failed(results) == nil
+			response.Body.Results = results
+			return response, nil
+		},
+	)
+}
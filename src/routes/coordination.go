@@ -0,0 +1,39 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/coordination"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterCoordinationRoutes(api huma.API) {
+	type CoordinationOutput struct {
+		Body struct {
+			Enabled  bool                 `json:"enabled"`
+			Instance string               `json:"instance"`
+			Leases   []coordination.Lease `json:"leases"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "coordination-status",
+			Method:      http.MethodGet,
+			Path:        "/coordination",
+			Summary:     "Get the leases held by the instance.",
+			Description: "Get the identifier of the instance and the databases it currently writes, the other instances refuse writes to them.",
+			Tags:        []string{"coordination"},
+		},
+		func(ctx context.Context, input *struct{}) (*CoordinationOutput, error) {
+			response := &CoordinationOutput{}
+			response.Body.Enabled = utils.Config.Coordination.Enabled
+			response.Body.Instance = coordination.InstanceID()
+			response.Body.Leases = coordination.Leases()
+			return response, nil
+		},
+	)
+}
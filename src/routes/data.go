@@ -0,0 +1,82 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/policies"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterDataRoutes(api huma.API) {
+	type CompareDataInput struct {
+		Name           string `path:"name"`
+		PrincipalToken string `header:"X-Persisto-Principal-Token" doc:"Token of the principal comparing the databases, refused when the policies of the source restrict it."`
+		Body           struct {
+			Source    string   `json:"source" minLength:"1" doc:"Name of the database compared to this one, whose rows are copied to it with apply."`
+			Tables    []string `json:"tables,omitempty" doc:"Tables compared, every table of both databases when left out."`
+			ChunkRows int      `json:"chunk_rows,omitempty" minimum:"0" maximum:"10000" doc:"Rows hashed per chunk, 500 when left out."`
+			Apply     bool     `json:"apply,omitempty" doc:"Write the differences to this database so that it matches the source."`
+		}
+	}
+	type CompareDataOutput struct {
+		Body databases.DataComparison
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-data-compare",
+			Method:      http.MethodPost,
+			Path:        "/databases/{name}/data/compare",
+			Summary:     "Compare the rows of two databases.",
+			Description: "Compare the rows of the tables of the database to those of a source database by their primary key, in chunks hashed on both sides so that only the chunks differing are compared row by row. With apply, the rows of the source missing from the database or differing are written to it and the rows missing from the source are deleted from it, one chunk per transaction, so that the database matches the source, e.g. to seed an environment or repair a drift.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *CompareDataInput) (*CompareDataOutput, error) {
+			target, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+			source, err := databases.Dbs.FindByName(input.Body.Source)
+			if err != nil {
+				return nil, errorFrom(err, "Source database not found.")
+			}
+
+			if _, err := policies.Authenticate(input.PrincipalToken); err != nil {
+				return nil, errorFrom(err, "Comparison refused.")
+			}
+			// NOTE: the rows are read from the whole source, copied with apply and their keys sampled, none of the policies
+			// of the source apply to them
+			if _, err := policies.AuthorizeCopy(source, input.PrincipalToken); err != nil {
+				return nil, errorFrom(err, "Comparison refused.")
+			}
+
+			comparison, err := databases.CompareData(ctx, source, target, databases.DataComparisonRequest{
+				Tables:    input.Body.Tables,
+				ChunkRows: input.Body.ChunkRows,
+				Apply:     input.Body.Apply,
+			})
+			if input.Body.Apply {
+				applied := 0
+				for _, table := range comparison.Tables {
+					applied += table.Applied
+				}
+				// NOTE: the chunks applied before a failure stay applied, they are recorded as well
+				if applied > 0 {
+					recordAudit(ctx, audit.Event{
+						Type:     audit.EventDataSynced,
+						Database: target.Name,
+						Details:  map[string]any{"source": source.Name, "rows": applied, "failed": err != nil},
+					})
+				}
+			}
+			if err != nil {
+				return nil, errorFrom(err, "Failed to compare the data.")
+			}
+			return &CompareDataOutput{Body: comparison}, nil
+		},
+	)
+}
@@ -2,20 +2,37 @@ package routes
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"persisto/src/internal/audit"
+	"persisto/src/internal/budgets"
+	"persisto/src/internal/coordination"
 	"persisto/src/internal/databases"
+	"persisto/src/internal/policies"
+	"persisto/src/internal/replication"
 	"persisto/src/internal/stages"
+	"persisto/src/internal/statements"
 	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
 
 	huma "github.com/danielgtaylor/huma/v2"
+	"go.uber.org/zap"
 )
 
 func RegisterHealthRoutes(api huma.API) {
 	type HealthOutput struct {
 		Body struct {
-			Status  string `json:"status" example:"ok"`
-			Version string `json:"version,omitempty" example:"1.0.0"`
+			Status        string `json:"status" enum:"ok,degraded" example:"ok" doc:"degraded while the server runs without its remote stage."`
+			Version       string `json:"version,omitempty" example:"1.0.0"`
+			OfflineReason string `json:"offline_reason,omitempty" doc:"Why the remote stage is offline, see STORAGE_REMOTE_REQUIRED."`
 		}
 	}
 	huma.Register(
@@ -31,6 +48,10 @@ func RegisterHealthRoutes(api huma.API) {
 		func(ctx context.Context, input *struct{}) (*HealthOutput, error) {
 			resp := &HealthOutput{}
 			resp.Body.Status = "ok"
+			if utils.RemoteOffline() {
+				resp.Body.Status = "degraded"
+				resp.Body.OfflineReason = utils.RemoteOfflineReason()
+			}
 			if utils.Config != nil && utils.Config.Server.Version != "" {
 				resp.Body.Version = utils.Config.Server.Version
 			}
@@ -40,12 +61,20 @@ func RegisterHealthRoutes(api huma.API) {
 }
 
 func RegisterDatabasesRoutes(api huma.API) {
-	type ListDatabasesInput struct{}
+	type ListDatabasesInput struct {
+		Tenant string `query:"tenant" doc:"Only list the databases of the tenant, see STORAGE_REMOTE_TENANTS."`
+		Stage  uint   `query:"stage" doc:"Only list the databases served from the stage."`
+	}
 	type DatabaseInfo struct {
-		Name           string `json:"name"`
-		Stage          uint   `json:"stage"`
-		LastAccessedAt string `json:"last_accessed_at"`
-		RequestCount   uint   `json:"request_count"`
+		Name               string `json:"name"`
+		Stage              uint   `json:"stage"`
+		LastAccessedAt     string `json:"last_accessed_at"`
+		RequestCount       uint   `json:"request_count"`
+		Degraded           bool   `json:"degraded"`
+		MovingToStage      uint   `json:"moving_to_stage,omitempty" doc:"Stage the database is moving to, requests meeting it retry for a while"`
+		Placement          string `json:"placement" enum:"initial,manual,promotion,demotion,eviction,lease_lost,standby_promoted" doc:"Why the database is at its stage"`
+		SyncLagMs          int64  `json:"sync_lag_ms" doc:"Time since the oldest write the copy at the persistence stage misses, 0 once it holds them all"`
+		SyncWindowExceeded bool   `json:"sync_window_exceeded,omitempty" doc:"Whether the sync lag exceeds the sync window of the database"`
 	}
 	type ListDatabasesOutput struct {
 		Body struct {
@@ -59,28 +88,39 @@ func RegisterDatabasesRoutes(api huma.API) {
 			Method:      http.MethodGet,
 			Path:        "/databases",
 			Summary:     "List databases.",
-			Description: "List all the available databases.",
+			Description: "List all the available databases, sorted by name.",
 			Tags:        []string{"databases"},
 		},
 		func(ctx context.Context, input *ListDatabasesInput) (*ListDatabasesOutput, error) {
 			databases := databases.Dbs
 
 			if databases == nil {
-				return nil, &huma.ErrorModel{
-					Status: http.StatusInternalServerError,
-					Title:  "Initialization Error",
-					Detail: "Databases weren't initialized.",
-				}
+				return nil, newErrorModel(utils.ErrorCodeInternal, "Initialization Error", "Databases weren't initialized.")
 			}
 
 			response := &ListDatabasesOutput{}
 
-			for _, db := range databases.Items {
+			listed := databases.All()
+			switch {
+			case input.Tenant != "":
+				listed = databases.ListTenant(input.Tenant)
+			case input.Stage != 0:
+				listed = databases.ListStage(input.Stage)
+			}
+			for _, db := range listed {
+				if input.Stage != 0 && db.GetStage() != input.Stage {
+					continue
+				}
 				dbInfo := DatabaseInfo{
-					Name:           db.GetName(),
-					Stage:          db.GetStage(),
-					LastAccessedAt: db.GetLastAccessed().Format("2006-01-02T15:04:05Z07:00"),
-					RequestCount:   db.GetRequestCount(),
+					Name:               db.GetName(),
+					Stage:              db.GetStage(),
+					LastAccessedAt:     db.GetLastAccessed().Format("2006-01-02T15:04:05Z07:00"),
+					RequestCount:       db.GetRequestCount(),
+					Degraded:           db.IsDegraded(),
+					MovingToStage:      db.GetMovingTo(),
+					Placement:          db.GetPlacement(),
+					SyncLagMs:          db.SyncLag().Milliseconds(),
+					SyncWindowExceeded: db.SyncWindowExceeded(),
 				}
 				response.Body.Databases = append(response.Body.Databases, dbInfo)
 			}
@@ -91,7 +131,9 @@ func RegisterDatabasesRoutes(api huma.API) {
 
 	type CreateDatabaseInput struct {
 		Body struct {
-			Name string `json:"name" minLength:"1"  maxLength:"128" example:"production-db" doc:"Database name"`
+			Name     string `json:"name" minLength:"1"  maxLength:"128" example:"production-db" doc:"Database name, trimmed and lowercased. Lowercase letters, digits, _ and -, starting with a letter or a digit and not with temp_."`
+			Adopt    bool   `json:"adopt,omitempty" doc:"Adopt the database when a stage already holds it without it being in the catalog, the remote copy first, rather than failing with a conflict."`
+			Workload string `json:"workload,omitempty" enum:"read_heavy,write_heavy,archival" doc:"Expected workload of the database, picking its initial stage instead of SETTINGS_DEFAULT_DATABASE_CREATION_STAGE. Read and write heavy databases start in the local stage, archival ones in the remote stage."`
 		}
 	}
 	type CreateDatabaseOutput struct {
@@ -106,7 +148,7 @@ func RegisterDatabasesRoutes(api huma.API) {
 			Method:      http.MethodPost,
 			Path:        "/databases",
 			Summary:     "Create a database.",
-			Description: "Create a database.",
+			Description: "Create a database. Every stage is checked for a database with the same name, which is either adopted or reported as a conflict. The database is created at the stage its declared workload calls for, the default one when it declares none.",
 			Tags:        []string{"databases"},
 		},
 		func(ctx context.Context, input *CreateDatabaseInput) (*CreateDatabaseOutput, error) {
@@ -115,23 +157,30 @@ func RegisterDatabasesRoutes(api huma.API) {
 			_, err := databases.Dbs.FindByName(name)
 
 			if err == nil {
-				return nil, &huma.ErrorModel{
-					Status: http.StatusConflict,
-					Title:  "Database already exists.",
-					Detail: "A database with this name already exists.",
-				}
+				return nil, newErrorModel(utils.ErrorCodeConflict, "Database already exists.", "A database with this name already exists.")
 			}
 
-			database, err := databases.Dbs.CreateDatabaseAndInitialize(name, stages.GetConfigDefaultStage())
+			var database *databases.Database
+			adopted := false
+			if input.Body.Adopt {
+				database, err = databases.Dbs.AdoptDatabase(name)
+				adopted = err == nil
+			}
+			// NOTE: a database no stage holds is created, even when asked to adopt it
+			if !input.Body.Adopt || utils.ErrorCodeOf(err) == utils.ErrorCodeNotFound {
+				database, err = databases.Dbs.CreateDatabaseAndInitialize(name, stages.InitialStage(0, input.Body.Workload))
+			}
 
 			if err != nil {
-				return nil, &huma.ErrorModel{
-					Status: http.StatusInternalServerError,
-					Title:  "Failed to create the Database.",
-					Detail: "Failed to create the database.",
-				}
+				return nil, errorFrom(err, "Failed to create the Database.")
 			}
 
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventDatabaseCreated,
+				Database: database.Name,
+				Details:  map[string]any{"stage": database.Stage, "adopted": adopted, "workload": input.Body.Workload},
+			})
+
 			response := &CreateDatabaseOutput{}
 
 			response.Body.Database = database
@@ -141,21 +190,213 @@ func RegisterDatabasesRoutes(api huma.API) {
 	)
 
 	type QueryDatabaseInput struct {
-		Name string `path:"name"`
-		Body struct {
-			Queries []string `json:"queries" minItems:"1" maxItems:"16" example:"INSERT INTO users (name) VALUES ('Alice');"`
+		Name           string `path:"name"`
+		PrincipalToken string `header:"X-Persisto-Principal-Token" doc:"Token of the principal whose policies restrict the queries."`
+		Body           struct {
+			Queries    []string `json:"queries" minItems:"1" example:"SELECT id, name FROM users;" doc:"Queries of the batch, at most SETTINGS_MAX_BATCH_QUERIES"`
+			Parameters [][]any  `json:"parameters,omitempty" doc:"Values bound to the placeholders of every query, blobs are passed as {\"base64\": \"...\"}"`
+			Typed      bool     `json:"typed,omitempty" doc:"Include the type of every column in the results"`
+			RowTypes   bool     `json:"row_types,omitempty" doc:"Include the columns, and the type of every value in the results with a column holding values of several types"`
+			Arrays     bool     `json:"arrays,omitempty" doc:"Return the rows as arrays of values in the order of the columns, which are included, rather than as objects whose keys are sorted"`
+			PageSize   int      `json:"page_size,omitempty" minimum:"0" doc:"Maximum rows of every result, bounded by SETTINGS_MAX_RESULT_ROWS"`
+			PageTokens []string `json:"page_tokens,omitempty" doc:"Next page token of every query continuing a truncated result, empty for the queries read from their start"`
+			Workers    int      `json:"workers,omitempty" minimum:"0" doc:"Maximum queries run in parallel, bounded by SETTINGS_QUERY_WORKERS"`
+			Consistent bool     `json:"consistent,omitempty" doc:"Run the queries one after the other in a single read transaction, so that all of them see the same snapshot of the database"`
+			Debug      bool     `json:"debug,omitempty" doc:"Include the SQLite status counters of every query in its result, e.g. the rows stepped through by full scans and the pages read"`
 		}
 	}
 	type QueryResult struct {
-		Success bool                  `json:"success"`
-		Data    utils.QueryResultType `json:"data,omitempty"`
-		Error   string                `json:"error,omitempty"`
+		Success       bool                  `json:"success"`
+		Data          utils.QueryResultType `json:"data,omitempty"`
+		Rows          [][]any               `json:"rows,omitempty" doc:"Values of every row in the order of the columns, when the rows are asked for as arrays"`
+		Columns       []utils.QueryColumn   `json:"columns,omitempty"`
+		Types         [][]string            `json:"types,omitempty" doc:"Storage class of every value, row by row in the order of the columns, when a column is mixed"`
+		Truncated     bool                  `json:"truncated,omitempty" doc:"Rows were left past the limits, they are read by sending the query again with its next page token"`
+		NextPageToken string                `json:"next_page_token,omitempty"`
+		Error         string                `json:"error,omitempty"`
+		Code          utils.ErrorCode       `json:"code,omitempty"`
+		SQLite        *utils.SQLiteError    `json:"sqlite,omitempty" doc:"Result codes of the failure when SQLite reported it"`
+		Debug         *utils.QueryStats     `json:"debug,omitempty"`
 	}
 	type QueryDatabaseOutput struct {
 		Body struct {
 			Results []QueryResult `json:"results"`
 		}
 	}
+
+	// NOTE: checks the request and returns the function running its queries, which reports every result as soon as its
+	// query completes
+	prepareQueries := func(ctx context.Context, input *QueryDatabaseInput) (func(report func(index int, result QueryResult)), error) {
+		name := input.Name
+
+		if err := checkBatchSize(input.Body.Queries); err != nil {
+			return nil, errorFrom(err, "Too many queries.")
+		}
+		if err := checkStatementSize(input.Body.Queries); err != nil {
+			return nil, errorFrom(err, "Query too large.")
+		}
+		budgets.CountQueries(ctx, len(input.Body.Queries))
+
+		database, err := databases.Dbs.FindByName(name)
+		if err != nil {
+			return nil, errorFrom(err, "Database not found.")
+		}
+
+		parameters, err := queryParameters(input.Body.Queries, input.Body.Parameters)
+		if err != nil {
+			return nil, errorFrom(err, "Invalid query parameters.")
+		}
+
+		windows, err := pageWindows(input.Body.Queries, input.Body.Parameters, input.Body.PageTokens, input.Body.PageSize)
+		if err != nil {
+			return nil, errorFrom(err, "Invalid page tokens.")
+		}
+		if input.Body.Debug {
+			for index := range windows {
+				windows[index].Stats = &utils.QueryStats{}
+			}
+		}
+		if input.Body.Arrays || input.Body.RowTypes {
+			for index := range windows {
+				windows[index].Values = &[][]any{}
+			}
+		}
+
+		principal, err := policies.Authenticate(input.PrincipalToken)
+		if err != nil {
+			return nil, errorFrom(err, "Invalid principal.")
+		}
+
+		query := func(window utils.ResultWindow, query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, bool, error) {
+			return database.QueryAs(ctx, principal, statements.EndpointQuery, window, query, parameters...)
+		}
+		if replication.IsFollower() {
+			// NOTE: followers answer from their local replica rather than reading the remote object
+			query = func(window utils.ResultWindow, query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, bool, error) {
+				return replication.Query(ctx, name, principal, statements.EndpointQuery, window, query, parameters...)
+			}
+		}
+
+		return func(report func(index int, result QueryResult)) {
+			type queryResponse struct {
+				index     int
+				result    utils.QueryResultType
+				columns   []utils.QueryColumn
+				truncated bool
+				err       error
+			}
+
+			responses := make(chan queryResponse, len(input.Body.Queries))
+
+			receive := func(resp queryResponse) {
+				if resp.err != nil {
+					report(resp.index, QueryResult{
+						Success: false,
+						Error:   resp.err.Error(),
+						Code:    utils.ErrorCodeOf(resp.err),
+						SQLite:  utils.SQLiteErrorOf(resp.err, resp.index, input.Body.Queries[resp.index]),
+					})
+					return
+				}
+
+				result := QueryResult{
+					Success:   true,
+					Data:      resp.result,
+					Truncated: resp.truncated,
+					Debug:     windows[resp.index].Stats,
+				}
+				if input.Body.Typed || input.Body.RowTypes || input.Body.Arrays {
+					result.Columns = resp.columns
+				}
+				if input.Body.Arrays {
+					result.Data, result.Rows = nil, *windows[resp.index].Values
+				}
+				if input.Body.RowTypes {
+					result.Types = utils.ValueTypes(*windows[resp.index].Values, resp.columns)
+				}
+				if resp.truncated {
+					offset := windows[resp.index].Offset + len(resp.result)
+					result.NextPageToken = pageToken(input.Body.Queries[resp.index], parameterValues(input.Body.Parameters, resp.index), offset)
+				}
+				report(resp.index, result)
+			}
+
+			if input.Body.Consistent {
+				batch := func() ([]utils.SnapshotResult, error) {
+					return database.QueryBatchAs(ctx, principal, statements.EndpointQuery, windows, input.Body.Queries, parameters)
+				}
+				if replication.IsFollower() {
+					batch = func() ([]utils.SnapshotResult, error) {
+						return replication.QueryBatch(ctx, name, principal, statements.EndpointQuery, windows, input.Body.Queries, parameters)
+					}
+				}
+
+				// NOTE: a single connection reads the snapshot, the queries run one after the other on one worker
+				var results []utils.SnapshotResult
+				var err error
+				done := make(chan struct{})
+				databases.RunOnWorker(utils.PriorityOf(ctx), func() {
+					defer close(done)
+					results, err = batch()
+				})
+				<-done
+
+				for index := range input.Body.Queries {
+					if err != nil {
+						receive(queryResponse{index: index, err: err})
+						continue
+					}
+					receive(queryResponse{
+						index:     index,
+						result:    results[index].Rows,
+						columns:   results[index].Columns,
+						truncated: results[index].Truncated,
+						err:       results[index].Err,
+					})
+				}
+				return
+			}
+
+			// NOTE: the queries run on the workers shared by every request, a request can ask to run fewer of them at once
+			workers := utils.Config.Settings.QueryWorkers
+			if input.Body.Workers > 0 && input.Body.Workers < workers {
+				workers = input.Body.Workers
+			}
+			slots := make(chan struct{}, workers)
+
+			// NOTE: the results are reported while the next queries wait for a slot rather than once all of them started
+			received := 0
+			for i, statement := range input.Body.Queries {
+				for submitted := false; !submitted; {
+					select {
+					case slots <- struct{}{}:
+						submitted = true
+					case resp := <-responses:
+						receive(resp)
+						received++
+					}
+				}
+
+				bound, window := parameters[i], windows[i]
+				databases.RunOnWorker(utils.PriorityOf(ctx), func() {
+					defer func() { <-slots }()
+					result, columns, truncated, err := query(window, statement, bound...)
+					responses <- queryResponse{
+						index:     i,
+						result:    result,
+						columns:   columns,
+						truncated: truncated,
+						err:       err,
+					}
+				})
+			}
+
+			for ; received < len(input.Body.Queries); received++ {
+				receive(<-responses)
+			}
+		}, nil
+	}
+
 	huma.Register(
 		api,
 		huma.Operation{
@@ -163,99 +404,342 @@ func RegisterDatabasesRoutes(api huma.API) {
 			Method:      http.MethodPost,
 			Path:        "/databases/{name}/query",
 			Summary:     "Execute a read query on a database.",
-			Description: "Execute a read query on a database.",
+			Description: "Execute a read query on a database. Results past SETTINGS_MAX_RESULT_ROWS rows or SETTINGS_MAX_RESULT_BYTES bytes are truncated, the next page is read by sending the query again with the next page token of its result.",
 			Tags:        []string{"databases"},
 		},
 		func(ctx context.Context, input *QueryDatabaseInput) (*QueryDatabaseOutput, error) {
-			name := input.Name
-
-			database, err := databases.Dbs.FindByName(name)
+			run, err := prepareQueries(ctx, input)
 			if err != nil {
-				return nil, &huma.ErrorModel{
-					Status: http.StatusInternalServerError,
-					Title:  "Database not found.",
-					Detail: "Invalid database name provided.",
-				}
+				return nil, err
 			}
 
 			response := &QueryDatabaseOutput{}
-			results := make([]QueryResult, len(input.Body.Queries))
+			response.Body.Results = make([]QueryResult, len(input.Body.Queries))
+			run(func(index int, result QueryResult) {
+				response.Body.Results[index] = result
+			})
+			return response, nil
+		},
+	)
 
-			type queryJob struct {
-				index int
-				query string
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-query-stream",
+			Method:      http.MethodPost,
+			Path:        "/databases/{name}/query/stream",
+			Summary:     "Stream the results of read queries on a database.",
+			Description: "Execute read queries on a database like the query endpoint, writing the result of every query as a JSON line {\"index\": ..., \"result\": ...} as soon as it completes, in the order they complete.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *QueryDatabaseInput) (*huma.StreamResponse, error) {
+			run, err := prepareQueries(ctx, input)
+			if err != nil {
+				return nil, err
 			}
+			return streamResults(run), nil
+		},
+	)
 
-			type queryResponse struct {
-				index  int
-				result utils.QueryResultType
-				err    error
+	type ExportDatabaseInput struct {
+		Name           string `path:"name"`
+		PrincipalToken string `header:"X-Persisto-Principal-Token" doc:"Token of the principal whose policies restrict the query."`
+		Accept         string `header:"Accept" doc:"application/vnd.apache.arrow.stream for an Arrow IPC stream, application/vnd.apache.parquet for a Parquet file or text/csv for CSV."`
+		AcceptEncoding string `header:"Accept-Encoding" doc:"zstd or gzip to compress the response as it is streamed."`
+		Body           struct {
+			Query      string `json:"query" minLength:"1" example:"SELECT id, name FROM users;"`
+			Parameters []any  `json:"parameters,omitempty" doc:"Values bound to the placeholders of the query, blobs are passed as {\"base64\": \"...\"}"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-query-export",
+			Method:      http.MethodPost,
+			Path:        "/databases/{name}/query/export",
+			Summary:     "Export the results of a read query on a database.",
+			Description: "Execute a read query on a database and stream all of its rows as an Apache Arrow IPC stream, a Parquet file or CSV, as requested by the Accept header. The rows are encoded as they are read rather than paged, the column types are taken from their declared types or from the first rows. The response is compressed with zstd or gzip as it is streamed when the Accept-Encoding header accepts either.",
+			Tags:        []string{"databases"},
+			Responses: map[string]*huma.Response{
+				"200": {Description: "Rows of the query.", Content: map[string]*huma.MediaType{utils.ContentTypeArrow: {}, utils.ContentTypeParquet: {}, utils.ContentTypeCSV: {}}},
+			},
+		},
+		func(ctx context.Context, input *ExportDatabaseInput) (*huma.StreamResponse, error) {
+			format := utils.TabularFormatFromAccept(input.Accept)
+			if format == "" {
+				return nil, newErrorModel(utils.ErrorCodeInvalidInput, "Unsupported export format.", fmt.Sprintf("the Accept header must request %s, %s or %s", utils.ContentTypeArrow, utils.ContentTypeParquet, utils.ContentTypeCSV))
 			}
 
-			jobs := make(chan queryJob, len(input.Body.Queries))
-			responses := make(chan queryResponse, len(input.Body.Queries))
+			if err := checkStatementSize([]string{input.Body.Query}); err != nil {
+				return nil, errorFrom(err, "Query too large.")
+			}
 
-			// TODO: make number of workers configurable
-			numWorkers := 10
-			if len(input.Body.Queries) < numWorkers {
-				numWorkers = len(input.Body.Queries)
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
 			}
 
-			for w := 0; w < numWorkers; w++ {
-				go func() {
-					for job := range jobs {
-						result, err := database.Query(job.query)
-						responses <- queryResponse{
-							index:  job.index,
-							result: result,
-							err:    err,
-						}
-					}
-				}()
+			parameters, err := queryParameters([]string{input.Body.Query}, [][]any{input.Body.Parameters})
+			if err != nil {
+				return nil, errorFrom(err, "Invalid query parameters.")
 			}
 
-			for i, query := range input.Body.Queries {
-				jobs <- queryJob{index: i, query: query}
+			principal, err := policies.Authenticate(input.PrincipalToken)
+			if err != nil {
+				return nil, errorFrom(err, "Invalid principal.")
 			}
-			close(jobs)
 
-			for i := 0; i < len(input.Body.Queries); i++ {
-				resp := <-responses
-				if resp.err != nil {
-					results[resp.index] = QueryResult{
-						Success: false,
-						Error:   resp.err.Error(),
+			encoding := utils.EncodingFromAccept(input.AcceptEncoding)
+
+			return &huma.StreamResponse{
+				Body: func(ctx huma.Context) {
+					started := false
+					begin := func() {
+						started = true
+						ctx.SetHeader("Content-Type", utils.TabularContentType(format))
+						if encoding != "" {
+							ctx.SetHeader("Content-Encoding", encoding)
+						}
 					}
-				} else {
-					results[resp.index] = QueryResult{
-						Success: true,
-						Data:    resp.result,
+					ctx.SetHeader("Vary", "Accept-Encoding")
+
+					// NOTE: compressed as the rows are encoded, an error sent before the first row is sent as is
+					writer := utils.NewEncodingWriter(ctx.BodyWriter(), encoding)
+					if replication.IsFollower() {
+						// NOTE: followers answer from their local replica rather than reading the remote object
+						err = replication.Export(ctx.Context(), database.Name, principal, statements.EndpointQuery, format, begin, writer, input.Body.Query, parameters[0]...)
+					} else {
+						err = database.ExportAs(ctx.Context(), principal, statements.EndpointQuery, format, begin, writer, input.Body.Query, parameters[0]...)
+					}
+					if closeErr := writer.Close(); err == nil {
+						err = closeErr
+					}
+					if err == nil {
+						return
 					}
-				}
-			}
 
-			response.Body.Results = results
-			return response, nil
+					// NOTE: once the rows started being sent the error can only cut the response short
+					if started {
+						utils.HTTPLogger.Warn("Failed to export query results.", zap.String("database", database.Name), zap.Error(err))
+						return
+					}
+					writeStreamError(ctx, errorFrom(err, "Failed to export the query results."))
+				},
+			}, nil
 		},
 	)
 
 	type ExecuteDatabaseInput struct {
-		Name string `path:"name"`
-		Body struct {
-			// TODO: make minItems and maxItems configurable
-			Queries []string `json:"queries" minItems:"1" maxItems:"16" example:"INSERT INTO users (name) VALUES ('Alice');"`
+		Name           string `path:"name"`
+		PrincipalToken string `header:"X-Persisto-Principal-Token" doc:"Token of the principal whose policies restrict the queries."`
+		Body           struct {
+			Queries     []string `json:"queries" minItems:"1" example:"INSERT INTO users (name) VALUES ('Alice');" doc:"Queries of the batch, at most SETTINGS_MAX_BATCH_QUERIES"`
+			Parameters  [][]any  `json:"parameters,omitempty" doc:"Values bound to the placeholders of every query, blobs are passed as {\"base64\": \"...\"}"`
+			Transaction bool     `json:"transaction,omitempty" doc:"Run the queries in a single transaction, a failing query rolls back all of them"`
+			OnError     string   `json:"on_error,omitempty" enum:"rollback,rollback_to_savepoint" default:"rollback" doc:"What a failing query of a transaction rolls back, the whole transaction (rollback) or the queries since the innermost open savepoint, carrying on from its RELEASE (rollback_to_savepoint)"`
+			Ack         string   `json:"ack,omitempty" enum:"local,persistent" default:"local" doc:"Acknowledge the writes once committed at the stage the database is served from (local) or once synced to the persistence stage (persistent)"`
+			Attach      []string `json:"attach,omitempty" maxItems:"8" doc:"Other databases attached to the transaction under their name, e.g. INSERT INTO \"audit-log\".events ..., the transaction commits or rolls back its changes to all of them. They must be served from the same stage and use a rollback journal, requires transaction and no principal."`
 		}
 	}
 	type ExecuteResult struct {
 		Success bool                 `json:"success"`
 		Data    utils.ExecResultType `json:"data,omitempty"`
+		Ack     string               `json:"ack,omitempty" enum:"local,persistent" doc:"Level the write reached, set when it succeeded"`
 		Error   string               `json:"error,omitempty"`
+		Code    utils.ErrorCode      `json:"code,omitempty"`
+		SQLite  *utils.SQLiteError   `json:"sqlite,omitempty" doc:"Result codes of the failure when SQLite reported it"`
+	}
+
+	// NOTE: wraps report so that the successful results carry the level they reached. With the persistent level they are
+	// held back until flush synced the databases written to the persistence stage, a failed sync leaves them at the local
+	// level with the sync error.
+	acknowledge := func(written []*databases.Database, input *ExecuteDatabaseInput, report func(index int, result ExecuteResult)) (func(index int, result ExecuteResult), func()) {
+		if input.Body.Ack != ackPersistent {
+			return func(index int, result ExecuteResult) {
+				if result.Success {
+					result.Ack = ackLocal
+				}
+				report(index, result)
+			}, func() {}
+		}
+
+		type heldResult struct {
+			index  int
+			result ExecuteResult
+		}
+		var held []heldResult
+		hold := func(index int, result ExecuteResult) {
+			held = append(held, heldResult{index: index, result: result})
+		}
+		flush := func() {
+			wrote := false
+			for _, entry := range held {
+				wrote = wrote || (entry.result.Success && utils.IsWriteOperation(input.Body.Queries[entry.index]))
+			}
+
+			var err error
+			if wrote {
+				for _, database := range written {
+					if err = stages.SyncToRemoteStage(database); err != nil {
+						break
+					}
+				}
+			}
+			for _, entry := range held {
+				if entry.result.Success {
+					entry.result.Ack = ackPersistent
+					if err != nil {
+						entry.result.Ack = ackLocal
+						entry.result.Error, entry.result.Code = fmt.Sprintf("written locally but not acknowledged as persistent: %v", err), utils.ErrorCodeOf(err)
+					}
+				}
+				report(entry.index, entry.result)
+			}
+		}
+		return hold, flush
 	}
 	type ExecuteDatabaseOutput struct {
 		Body struct {
 			Results []ExecuteResult `json:"results"`
 		}
 	}
+
+	// NOTE: checks the request and returns the function running its queries in order, which reports every result as soon
+	// as its query completes, or all of them once a transaction is committed or rolled back
+	prepareExecutes := func(ctx context.Context, input *ExecuteDatabaseInput) (func(report func(index int, result ExecuteResult)), error) {
+		name := input.Name
+
+		if err := checkBatchSize(input.Body.Queries); err != nil {
+			return nil, errorFrom(err, "Too many queries.")
+		}
+		if err := checkStatementSize(input.Body.Queries); err != nil {
+			return nil, errorFrom(err, "Query too large.")
+		}
+		budgets.CountQueries(ctx, len(input.Body.Queries))
+
+		database, err := databases.Dbs.FindByName(name)
+		if err != nil {
+			return nil, errorFrom(err, "Database not found.")
+		}
+
+		parameters, err := queryParameters(input.Body.Queries, input.Body.Parameters)
+		if err != nil {
+			return nil, errorFrom(err, "Invalid query parameters.")
+		}
+
+		principal, err := policies.Authenticate(input.PrincipalToken)
+		if err != nil {
+			return nil, errorFrom(err, "Invalid principal.")
+		}
+
+		// NOTE: refused as a whole rather than query by query when another instance writes the database
+		if err := coordination.Acquire(name); err != nil {
+			return nil, errorFrom(err, "Database written by another instance.")
+		}
+
+		if len(input.Body.Attach) > 0 && !input.Body.Transaction {
+			return nil, newErrorModel(utils.ErrorCodeInvalidInput, "Invalid attach.", "Databases can only be attached to a transaction.")
+		}
+		attached := make([]*databases.Database, len(input.Body.Attach))
+		for index, attachedName := range input.Body.Attach {
+			if attached[index], err = databases.Dbs.FindByName(attachedName); err != nil {
+				return nil, errorFrom(err, "Attached database not found.")
+			}
+		}
+
+		if input.Body.Transaction {
+			return func(report func(index int, result ExecuteResult)) {
+				report, flush := acknowledge(append([]*databases.Database{database}, attached...), input, report)
+				defer flush()
+
+				options := databases.TransactionOptions{RollbackToSavepoint: input.Body.OnError == onErrorRollbackToSavepoint, Attach: attached}
+				results, rollbacks, failedIndex, err := database.ExecuteTransactionWithOptionsAs(ctx, principal, statements.EndpointExecute, input.Body.Queries, parameters, options)
+
+				// NOTE: every result of a rolled back transaction points at the query which failed
+				sqliteError := utils.SQLiteErrorOf(err, failedIndex, "")
+				if failedIndex >= 0 {
+					sqliteError = utils.SQLiteErrorOf(err, failedIndex, input.Body.Queries[failedIndex])
+				}
+
+				// NOTE: the queries rolled back to a savepoint point at the query which failed, or carry its error
+				undone := make(map[int]ExecuteResult)
+				for _, rollback := range rollbacks {
+					for index := rollback.Start + 1; index < rollback.Release; index++ {
+						undone[index] = ExecuteResult{
+							Error:  fmt.Sprintf(savepointRolledBackError, rollback.Savepoint),
+							Code:   utils.ErrorCodeOf(rollback.Err),
+							SQLite: utils.SQLiteErrorOf(rollback.Err, rollback.FailedIndex, input.Body.Queries[rollback.FailedIndex]),
+						}
+					}
+				}
+				for _, rollback := range rollbacks {
+					failure := undone[rollback.FailedIndex]
+					failure.Error = rollback.Err.Error()
+					undone[rollback.FailedIndex] = failure
+				}
+
+				failed := 0
+				for index := range input.Body.Queries {
+					result, isUndone := undone[index]
+					switch {
+					case err == nil && isUndone:
+						failed++
+						report(index, result)
+					case err == nil:
+						report(index, ExecuteResult{Success: true, Data: results[index]})
+					case index == failedIndex || failedIndex < 0:
+						failed++
+						report(index, ExecuteResult{Success: false, Error: err.Error(), Code: utils.ErrorCodeOf(err), SQLite: sqliteError})
+					default:
+						failed++
+						report(index, ExecuteResult{Success: false, Error: transactionRolledBackError, Code: utils.ErrorCodeOf(err), SQLite: sqliteError})
+					}
+				}
+
+				transactionDetails := map[string]any{"queries": input.Body.Queries, "failed": failed, "transaction": true}
+				if len(input.Body.Attach) > 0 {
+					transactionDetails["attached"] = input.Body.Attach
+				}
+				recordAudit(ctx, audit.Event{
+					Type:     audit.EventDatabaseExecuted,
+					Database: database.Name,
+					Details:  executedDetails(principal, transactionDetails),
+				})
+			}, nil
+		}
+
+		return func(report func(index int, result ExecuteResult)) {
+			report, flush := acknowledge([]*databases.Database{database}, input, report)
+			defer flush()
+
+			failed := 0
+			for index, query := range input.Body.Queries {
+				result, err := database.ExecuteAs(ctx, principal, statements.EndpointExecute, query, parameters[index]...)
+
+				if err != nil {
+					failed++
+					report(index, ExecuteResult{
+						Success: false,
+						Error:   err.Error(),
+						Code:    utils.ErrorCodeOf(err),
+						SQLite:  utils.SQLiteErrorOf(err, index, query),
+					})
+				} else {
+					report(index, ExecuteResult{
+						Success: true,
+						Data:    result,
+					})
+				}
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventDatabaseExecuted,
+				Database: database.Name,
+				Details:  executedDetails(principal, map[string]any{"queries": input.Body.Queries, "failed": failed}),
+			})
+		}, nil
+	}
+
 	huma.Register(
 		api,
 		huma.Operation{
@@ -267,36 +751,330 @@ func RegisterDatabasesRoutes(api huma.API) {
 			Tags:        []string{"databases"},
 		},
 		func(ctx context.Context, input *ExecuteDatabaseInput) (*ExecuteDatabaseOutput, error) {
-			name := input.Name
-
-			database, err := databases.Dbs.FindByName(name)
+			run, err := prepareExecutes(ctx, input)
 			if err != nil {
-				return nil, &huma.ErrorModel{
-					Status: http.StatusInternalServerError,
-					Title:  "Database not found.",
-					Detail: "Invalid database name provided.",
-				}
+				return nil, err
 			}
 
 			response := &ExecuteDatabaseOutput{}
+			response.Body.Results = make([]ExecuteResult, len(input.Body.Queries))
+			run(func(index int, result ExecuteResult) {
+				response.Body.Results[index] = result
+			})
+			return response, nil
+		},
+	)
 
-			for _, query := range input.Body.Queries {
-				result, err := database.Execute(query)
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-execute-stream",
+			Method:      http.MethodPost,
+			Path:        "/databases/{name}/execute/stream",
+			Summary:     "Stream the results of write queries on a database.",
+			Description: "Execute write queries on a database like the execute endpoint, writing the result of every query as a JSON line {\"index\": ..., \"result\": ...} as soon as it completes. The results of a transaction are written once it is committed or rolled back, and the results of a persistent ack once the database is synced to the persistence stage.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *ExecuteDatabaseInput) (*huma.StreamResponse, error) {
+			run, err := prepareExecutes(ctx, input)
+			if err != nil {
+				return nil, err
+			}
+			return streamResults(run), nil
+		},
+	)
 
-				if err != nil {
-					response.Body.Results = append(response.Body.Results, ExecuteResult{
-						Success: false,
-						Error:   err.Error(),
-					})
-				} else {
-					response.Body.Results = append(response.Body.Results, ExecuteResult{
-						Success: true,
-						Data:    result,
-					})
-				}
+	type DownloadURLInput struct {
+		Name           string `path:"name"`
+		ExpiresIn      int    `query:"expires_in" minimum:"1" doc:"Validity of the URL in seconds, defaults to the configured presign expiry."`
+		PrincipalToken string `header:"X-Persisto-Principal-Token" doc:"Token of the principal the URL is issued to, refused when the policies of the database restrict it."`
+	}
+	type DownloadURLOutput struct {
+		Body struct {
+			URL       string `json:"url"`
+			ExpiresAt string `json:"expires_at"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-download-url",
+			Method:      http.MethodGet,
+			Path:        "/databases/{name}/download-url",
+			Summary:     "Get a download URL for a database.",
+			Description: "Sync the database to the remote stage and return a time-limited presigned URL to download it directly from remote storage.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *DownloadURLInput) (*DownloadURLOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			// NOTE: the URL hands out the whole object, none of the policies of the database apply to it
+			principal, err := policies.AuthorizeCopy(database, input.PrincipalToken)
+			if err != nil {
+				return nil, errorFrom(err, "Download refused.")
+			}
+
+			expiresIn := utils.Config.Storage.Remote.PresignExpirySeconds
+			if input.ExpiresIn > 0 {
+				expiresIn = input.ExpiresIn
+			}
+			if expiresIn > utils.Config.Storage.Remote.PresignMaxExpirySeconds {
+				return nil, newErrorModel(utils.ErrorCodeInvalidInput, "Invalid expiry.", fmt.Sprintf("Expiry can't exceed %d seconds.", utils.Config.Storage.Remote.PresignMaxExpirySeconds))
 			}
 
+			err = stages.SyncToRemoteStage(database)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to sync the database.")
+			}
+
+			url, expiresAt, err := remotevfs.PresignDownloadURL(stages.GetRemoteKey(database), time.Duration(expiresIn)*time.Second)
+			if err != nil {
+				return nil, newErrorModel(utils.ErrorCodeStageUnavailable, "Failed to generate download URL.", "Failed to presign the remote object.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventDownloadURLIssued,
+				Database: database.Name,
+				Details:  map[string]any{"expiresAt": expiresAt, "principal": principal},
+			})
+
+			response := &DownloadURLOutput{}
+			response.Body.URL = url
+			response.Body.ExpiresAt = expiresAt.Format("2006-01-02T15:04:05Z07:00")
+
 			return response, nil
 		},
 	)
+
+	type SyncDatabaseInput struct {
+		Name string `path:"name"`
+	}
+	type DatabaseStageOutput struct {
+		Body struct {
+			Name  string `json:"name"`
+			Stage uint   `json:"stage"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-sync",
+			Method:      http.MethodPost,
+			Path:        "/databases/{name}/sync",
+			Summary:     "Sync a database to the remote stage.",
+			Description: "Sync the database content to the remote stage right away, regardless of the auto sync setting.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *SyncDatabaseInput) (*DatabaseStageOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			if err := stages.SyncToRemoteStage(database); err != nil {
+				return nil, errorFrom(err, "Failed to sync the database.")
+			}
+
+			recordAudit(ctx, audit.Event{Type: audit.EventDatabaseSynced, Database: database.Name})
+
+			response := &DatabaseStageOutput{}
+			response.Body.Name = database.GetName()
+			response.Body.Stage = database.GetStage()
+			return response, nil
+		},
+	)
+
+	type MoveDatabaseInput struct {
+		Name string `path:"name"`
+		Body struct {
+			Stage uint `json:"stage" minimum:"1" doc:"Stage to move the database to"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-move",
+			Method:      http.MethodPost,
+			Path:        "/databases/{name}/move",
+			Summary:     "Move a database to another stage.",
+			Description: "Move the database to the given stage, bypassing the automatic stage movements.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *MoveDatabaseInput) (*DatabaseStageOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			previousStage := database.GetStage()
+			if err := stages.MoveDatabase(database, input.Body.Stage); err != nil {
+				return nil, errorFrom(err, "Failed to move the database.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventDatabaseMoved,
+				Database: database.Name,
+				Details:  map[string]any{"from": previousStage, "to": input.Body.Stage, "reason": stages.PlacementManual},
+			})
+
+			response := &DatabaseStageOutput{}
+			response.Body.Name = database.GetName()
+			response.Body.Stage = database.GetStage()
+			return response, nil
+		},
+	)
+}
+
+// NOTE: error of the queries of a failed transaction other than the failing one, clients compare against it
+const transactionRolledBackError = "Transaction rolled back."
+
+// NOTE: error of the queries rolled back to a savepoint other than the failing one, formatted with its name
+const savepointRolledBackError = "Rolled back to savepoint %s."
+
+const (
+	// NOTE: the write is committed at the stage the database is served from
+	ackLocal = "local"
+	// NOTE: the write is synced to the persistence stage, it survives the loss of the local stage
+	ackPersistent = "persistent"
+)
+
+// NOTE: on_error of the transactions rolling a failing query back to the innermost open savepoint
+const onErrorRollbackToSavepoint = "rollback_to_savepoint"
+
+// checkBatchSize refuses the batches of more than SETTINGS_MAX_BATCH_QUERIES queries.
+func checkBatchSize(queries []string) error {
+	if maxQueries := utils.Config.Settings.MaxBatchQueries; len(queries) > maxQueries {
+		return utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("%d queries sent, a batch holds at most %d", len(queries), maxQueries), nil)
+	}
+	return nil
+}
+
+// checkStatementSize refuses the statements longer than SETTINGS_MAX_STATEMENT_BYTES.
+func checkStatementSize(statements []string) error {
+	maxBytes := utils.Config.Settings.MaxStatementBytes
+	if maxBytes == 0 {
+		return nil
+	}
+	for index, statement := range statements {
+		if len(statement) > maxBytes {
+			return utils.NewError(utils.ErrorCodeTooLarge, fmt.Sprintf("statement %d is %d bytes long, a statement holds at most %d", index, len(statement), maxBytes), nil)
+		}
+	}
+	return nil
+}
+
+// streamedResult is a line of a streamed response, the result of the query at the index of the batch.
+type streamedResult[T any] struct {
+	Index  int `json:"index"`
+	Result T   `json:"result"`
+}
+
+// streamResults writes the results reported by run as JSON lines, flushing every line so that the client reads the
+// results as soon as their query completes.
+func streamResults[T any](run func(report func(index int, result T))) *huma.StreamResponse {
+	return &huma.StreamResponse{
+		Body: func(ctx huma.Context) {
+			ctx.SetHeader("Content-Type", "application/x-ndjson")
+			writer := ctx.BodyWriter()
+			encoder := json.NewEncoder(writer)
+			run(func(index int, result T) {
+				if err := encoder.Encode(streamedResult[T]{Index: index, Result: result}); err != nil {
+					utils.HTTPLogger.Warn("Failed to stream a query result.", zap.Int("index", index), zap.Error(err))
+					return
+				}
+				if flusher, ok := writer.(http.Flusher); ok {
+					flusher.Flush()
+				}
+			})
+		},
+	}
+}
+
+// queryParameters returns the values bound to every query, parameters must be empty or hold the values of every query.
+func queryParameters(queries []string, parameters [][]any) ([][]any, error) {
+	if len(parameters) != 0 && len(parameters) != len(queries) {
+		return nil, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("expected parameters for %d queries, got %d", len(queries), len(parameters)), nil)
+	}
+
+	values := make([][]any, len(queries))
+	for index := range parameters {
+		queryValues, err := utils.QueryParameters(parameters[index])
+		if err != nil {
+			return nil, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("query %d", index+1), err)
+		}
+		values[index] = queryValues
+	}
+	return values, nil
+}
+
+// pageWindows returns the window every query is read through, starting after the rows already returned when the query
+// has a page token. tokens must be empty or hold a token, possibly empty, for every query.
+func pageWindows(queries []string, parameters [][]any, tokens []string, pageSize int) ([]utils.ResultWindow, error) {
+	if len(tokens) != 0 && len(tokens) != len(queries) {
+		return nil, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("expected page tokens for %d queries, got %d", len(queries), len(tokens)), nil)
+	}
+
+	pageRows := utils.Config.Settings.MaxResultRows
+	if pageSize > 0 && (pageRows == 0 || pageSize < pageRows) {
+		pageRows = pageSize
+	}
+
+	windows := make([]utils.ResultWindow, len(queries))
+	for index := range queries {
+		windows[index] = utils.ResultWindow{PageRows: pageRows, PageBytes: utils.Config.Settings.MaxResultBytes}
+		if index >= len(tokens) || tokens[index] == "" {
+			continue
+		}
+
+		offset, valid := pageOffset(tokens[index], queries[index], parameterValues(parameters, index))
+		if !valid {
+			return nil, utils.NewError(utils.ErrorCodeInvalidInput, fmt.Sprintf("the page token of query %d doesn't continue it", index+1), nil)
+		}
+		windows[index].Offset = offset
+	}
+	return windows, nil
+}
+
+// pageToken encodes the offset the next page of the query starts at. It is tied to the query and its parameters, so
+// that it can't be used to continue another one.
+func pageToken(query string, parameters []any, offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", offset, queryFingerprint(query, parameters))))
+}
+
+// pageOffset decodes a token returned by pageToken, it is invalid when it was returned for another query.
+func pageOffset(token string, query string, parameters []any) (int, bool) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, false
+	}
+	value, fingerprint, found := strings.Cut(string(decoded), ":")
+	offset, err := strconv.Atoi(value)
+	if !found || err != nil || offset < 0 || fingerprint != queryFingerprint(query, parameters) {
+		return 0, false
+	}
+	return offset, true
+}
+
+func queryFingerprint(query string, parameters []any) string {
+	encoded, _ := json.Marshal(parameters)
+	sum := sha256.Sum256(append([]byte(query+"\x00"), encoded...))
+	return hex.EncodeToString(sum[:8])
+}
+
+func parameterValues(parameters [][]any, index int) []any {
+	if index < len(parameters) {
+		return parameters[index]
+	}
+	return nil
+}
+
+// executedDetails adds the principal the queries were restricted to, if any, to the details of the audit event.
+func executedDetails(principal string, details map[string]any) map[string]any {
+	if principal != "" {
+		details["principal"] = principal
+	}
+	return details
 }
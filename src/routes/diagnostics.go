@@ -0,0 +1,231 @@
+package routes
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"persisto/src/internal/admission"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/stages"
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+	"persisto/src/vfs/remotevfs"
+
+	huma "github.com/danielgtaylor/huma/v2"
+	chi "github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+var openConnections atomic.Int64
+
+// TrackConnection keeps count of the open client connections, it is meant to be used as the server ConnState hook.
+func TrackConnection(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		openConnections.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		openConnections.Add(-1)
+	}
+}
+
+// MountProfiler exposes net/http/pprof under /admin/debug/pprof, behind the admin token.
+func MountProfiler(router chi.Router) {
+	if utils.Config.Server.AdminToken.Value() == "" {
+		return
+	}
+
+	router.Route("/admin/debug", func(debug chi.Router) {
+		debug.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := authorizeAdmin(r.Header.Get("X-Persisto-Admin-Token")); err != nil {
+					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+		debug.Mount("/", middleware.Profiler())
+	})
+}
+
+func RegisterDiagnosticsRoutes(api huma.API) {
+	if utils.Config.Server.AdminToken.Value() == "" {
+		return
+	}
+
+	type DiagnosticsInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type DiagnosticsOutput struct {
+		Body struct {
+			Goroutines           int                           `json:"goroutines"`
+			OpenConnections      int64                         `json:"open_connections"`
+			BackgroundOperations int64                         `json:"background_operations" doc:"Stage operations, e.g. syncs, still running in the background."`
+			PendingLocalSyncs    int                           `json:"pending_local_syncs" doc:"Local files waiting for the batched flusher."`
+			RemoteCache          remotevfs.CacheStats          `json:"remote_cache"`
+			RemoteCircuit        remotevfs.CircuitStats        `json:"remote_circuit"`
+			UploadThrottle       remotevfs.UploadThrottleStats `json:"upload_throttle"`
+			RemoteChecksums      remotevfs.ChecksumStats       `json:"remote_checksums"`
+			Admission            admission.Stats               `json:"admission"`
+			Memory               struct {
+				HeapAllocBytes  uint64    `json:"heap_alloc_bytes"`
+				HeapInuseBytes  uint64    `json:"heap_inuse_bytes"`
+				SysBytes        uint64    `json:"sys_bytes"`
+				NumGC           uint32    `json:"num_gc"`
+				LastGC          time.Time `json:"last_gc"`
+				PauseTotalNanos uint64    `json:"pause_total_ns"`
+				// NOTE: the buffers accounted against the memory limit, see MEMORY_LIMIT_BYTES
+				Accountant utils.MemoryStats `json:"accountant"`
+			} `json:"memory"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-diagnostics",
+			Method:      http.MethodGet,
+			Path:        "/admin/diagnostics",
+			Summary:     "Get runtime diagnostics.",
+			Description: "Get goroutine, memory and GC statistics along with the open connections, the remote sector cache sizes, the state of the remote circuit breaker, the uploads slowed down by the bandwidth budgets, the sectors checked against their checksums, the pending syncs, the queries running and queued by the admission control and the buffers accounted against the memory limit.",
+			Tags:        []string{"admin"},
+		},
+		func(ctx context.Context, input *DiagnosticsInput) (*DiagnosticsOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			var memory runtime.MemStats
+			runtime.ReadMemStats(&memory)
+
+			response := &DiagnosticsOutput{}
+			response.Body.Goroutines = runtime.NumGoroutine()
+			response.Body.OpenConnections = openConnections.Load()
+			response.Body.BackgroundOperations = stages.BackgroundOperations()
+			response.Body.PendingLocalSyncs = localvfs.PendingSyncs()
+			response.Body.RemoteCache = remotevfs.GetCacheStats()
+			response.Body.RemoteCircuit = remotevfs.GetCircuitStats()
+			response.Body.UploadThrottle = remotevfs.GetUploadThrottleStats()
+			response.Body.RemoteChecksums = remotevfs.GetChecksumStats()
+			response.Body.Admission = admission.GetStats()
+
+			response.Body.Memory.HeapAllocBytes = memory.HeapAlloc
+			response.Body.Memory.HeapInuseBytes = memory.HeapInuse
+			response.Body.Memory.SysBytes = memory.Sys
+			response.Body.Memory.NumGC = memory.NumGC
+			response.Body.Memory.LastGC = time.Unix(0, int64(memory.LastGC))
+			response.Body.Memory.PauseTotalNanos = memory.PauseTotalNs
+			response.Body.Memory.Accountant = utils.GetMemoryStats()
+			return response, nil
+		},
+	)
+
+	type DatabaseContention struct {
+		Name  string `json:"name"`
+		Stage uint   `json:"stage"`
+		utils.Contention
+	}
+	type ContentionOutput struct {
+		Body struct {
+			Databases []DatabaseContention `json:"databases"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-diagnostics-contention",
+			Method:      http.MethodGet,
+			Path:        "/admin/diagnostics/contention",
+			Summary:     "Get the lock contention by database.",
+			Description: "Get what the requests to each database spent waiting for each other since the start: the waits for the catalog mutex and its exclusive holds by the stage operations, the waits for a connection slot, the waits and BUSY of the file locks and the queries failed as the database was busy. The databases which failed the most queries come first, then those which waited the longest.",
+			Tags:        []string{"admin"},
+		},
+		func(ctx context.Context, input *DiagnosticsInput) (*ContentionOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if databases.Dbs == nil {
+				return nil, newErrorModel(utils.ErrorCodeInternal, "Initialization Error", "Databases weren't initialized.")
+			}
+
+			response := &ContentionOutput{}
+			response.Body.Databases = []DatabaseContention{}
+			for _, database := range databases.Dbs.All() {
+				response.Body.Databases = append(response.Body.Databases, DatabaseContention{
+					Name:       database.GetName(),
+					Stage:      database.GetStage(),
+					Contention: database.GetContention(),
+				})
+			}
+
+			waited := func(contention utils.Contention) float64 {
+				return contention.CatalogWaitMs + contention.ConnectionWaitMs + contention.LockWaitMs
+			}
+			sort.SliceStable(response.Body.Databases, func(i, j int) bool {
+				a, b := response.Body.Databases[i].Contention, response.Body.Databases[j].Contention
+				if a.BusyErrors != b.BusyErrors {
+					return a.BusyErrors > b.BusyErrors
+				}
+				return waited(a) > waited(b)
+			})
+			return response, nil
+		},
+	)
+
+	type RemoteTraceInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+		Key   string `query:"key" doc:"Key of the object to get the trace of, every object when empty" example:"production-db.db"`
+	}
+	type RemoteTraceOutput struct {
+		Body struct {
+			Enabled bool                    `json:"enabled" doc:"Whether the operations are traced, STORAGE_REMOTE_TRACE_ENABLED."`
+			Objects []remotevfs.ObjectTrace `json:"objects"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-diagnostics-remote-trace",
+			Method:      http.MethodGet,
+			Path:        "/admin/diagnostics/remote-trace",
+			Summary:     "Get the trace of the remote VFS.",
+			Description: "Get the last operations of the remote VFS on the objects, oldest first: opens, reads and writes by range, truncations, syncs, the sectors fetched from the bucket or the disk cache and the sectors evicted.",
+			Tags:        []string{"admin"},
+		},
+		func(ctx context.Context, input *RemoteTraceInput) (*RemoteTraceOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			response := &RemoteTraceOutput{}
+			response.Body.Enabled = utils.Config.Storage.Remote.TraceEnabled
+			response.Body.Objects = remotevfs.Trace(input.Key)
+			return response, nil
+		},
+	)
+
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "admin-diagnostics-remote-trace-clear",
+			Method:        http.MethodDelete,
+			Path:          "/admin/diagnostics/remote-trace",
+			Summary:       "Clear the trace of the remote VFS.",
+			Description:   "Drop the operations traced on the objects, of a single object when its key is given.",
+			Tags:          []string{"admin"},
+			DefaultStatus: http.StatusNoContent,
+		},
+		func(ctx context.Context, input *RemoteTraceInput) (*struct{}, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			remotevfs.ClearTrace(input.Key)
+			return nil, nil
+		},
+	)
+}
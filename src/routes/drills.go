@@ -0,0 +1,76 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/drills"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterDrillsRoutes(api huma.API) {
+	type ListDrillReportsOutput struct {
+		Body struct {
+			Reports []drills.DrillReport `json:"reports"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "drill-reports",
+			Method:      http.MethodGet,
+			Path:        "/drills",
+			Summary:     "List the drill reports.",
+			Description: "List the outcome of the last disaster recovery drill of every database drilled since startup.",
+			Tags:        []string{"drills"},
+		},
+		func(ctx context.Context, input *struct{}) (*ListDrillReportsOutput, error) {
+			response := &ListDrillReportsOutput{}
+			response.Body.Reports = drills.Reports()
+			return response, nil
+		},
+	)
+
+	type DrillDatabaseInput struct {
+		Name string `path:"name"`
+		Body struct {
+			Source  string   `json:"source,omitempty" enum:"backup,remote" doc:"Copy to restore, the latest backup or the remote copy, the latest backup and the remote copy without backups when omitted."`
+			Queries []string `json:"queries,omitempty" doc:"Verification queries run against the restored copy, each passes when the first value it returns is neither NULL, 0, false nor empty."`
+		}
+	}
+	type DrillDatabaseOutput struct {
+		Body drills.DrillReport
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-drill",
+			Method:      http.MethodPost,
+			Path:        "/databases/{name}/drill",
+			Summary:     "Drill the recovery of a database.",
+			Description: "Restore the latest persistent copy of the database into a scratch directory, check its integrity and run the verification queries against it. The live copies are only read and the restored one is removed once checked.",
+			Tags:        []string{"drills"},
+		},
+		func(ctx context.Context, input *DrillDatabaseInput) (*DrillDatabaseOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+			if err := drills.ValidateSource(input.Body.Source); err != nil {
+				return nil, errorFrom(err, "Invalid drill source.")
+			}
+
+			report := drills.Drill(database.GetName(), input.Body.Source, input.Body.Queries)
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventDatabaseDrilled,
+				Database: report.Database,
+				Details:  map[string]any{"status": report.Status, "source": report.Source, "key": report.Key},
+			})
+
+			return &DrillDatabaseOutput{Body: report}, nil
+		},
+	)
+}
@@ -0,0 +1,86 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+	"go.uber.org/zap"
+)
+
+// ErrorModel is the body of every error response, code identifies the failure so clients don't have to parse titles.
+type ErrorModel struct {
+	huma.ErrorModel
+	Code utils.ErrorCode `json:"code" example:"not_found" doc:"Stable error code"`
+}
+
+// RegisterErrorModel makes huma generated errors, e.g. request validation failures, carry an error code too. It must
+// be called before the routes are registered.
+func RegisterErrorModel() {
+	newHumaError := huma.NewError
+	huma.NewError = func(status int, message string, errs ...error) huma.StatusError {
+		base, ok := newHumaError(status, message, errs...).(*huma.ErrorModel)
+		if !ok {
+			base = &huma.ErrorModel{Status: status, Title: http.StatusText(status), Detail: message}
+		}
+		return &ErrorModel{ErrorModel: *base, Code: statusErrorCode(status)}
+	}
+}
+
+func statusErrorCode(status int) utils.ErrorCode {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return utils.ErrorCodeInvalidInput
+	case http.StatusRequestEntityTooLarge:
+		return utils.ErrorCodeTooLarge
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return utils.ErrorCodeUnauthorized
+	case http.StatusNotFound:
+		return utils.ErrorCodeNotFound
+	case http.StatusConflict:
+		return utils.ErrorCodeConflict
+	case http.StatusTooManyRequests:
+		return utils.ErrorCodeBusy
+	case http.StatusServiceUnavailable:
+		return utils.ErrorCodeStageUnavailable
+	case http.StatusInsufficientStorage:
+		return utils.ErrorCodeQuotaExceeded
+	default:
+		return utils.ErrorCodeInternal
+	}
+}
+
+// newErrorModel builds an error response for the given code and logs it.
+func newErrorModel(code utils.ErrorCode, title, detail string) *ErrorModel {
+	status := code.HTTPStatus()
+
+	fields := []zap.Field{zap.String("code", string(code)), zap.Int("status", status), zap.String("detail", detail)}
+	if status >= http.StatusInternalServerError {
+		utils.Logger.Error(title, fields...)
+	} else {
+		utils.Logger.Debug(title, fields...)
+	}
+
+	return &ErrorModel{
+		ErrorModel: huma.ErrorModel{
+			Status: status,
+			Title:  title,
+			Detail: detail,
+		},
+		Code: code,
+	}
+}
+
+// errorFrom builds an error response classifying err.
+func errorFrom(err error, title string) *ErrorModel {
+	return newErrorModel(utils.ErrorCodeOf(err), title, err.Error())
+}
+
+// writeStreamError writes the error response of a streamed response which failed before sending anything.
+func writeStreamError(ctx huma.Context, model *ErrorModel) {
+	ctx.SetHeader("Content-Type", "application/problem+json")
+	ctx.SetStatus(model.Status)
+	json.NewEncoder(ctx.BodyWriter()).Encode(model)
+}
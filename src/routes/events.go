@@ -0,0 +1,101 @@
+package routes
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"persisto/src/internal/databases"
+	"persisto/src/utils"
+	"persisto/src/vfs/remotevfs"
+
+	huma "github.com/danielgtaylor/huma/v2"
+	"go.uber.org/zap"
+)
+
+func RegisterEventsRoutes(api huma.API) {
+	if !utils.Config.Storage.Remote.EventsEnabled {
+		return
+	}
+	// NOTE: the events drop the caches and catalog entries of the databases, the route isn't served to anonymous callers
+	if utils.Config.Storage.Remote.EventsToken.Value() == "" {
+		utils.Logger.Warn("Remote storage events enabled without STORAGE_REMOTE_EVENTS_TOKEN, not accepting them.")
+		return
+	}
+
+	type BucketEventRecord struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	}
+	type StorageEventsInput struct {
+		Token string `header:"X-Persisto-Events-Token"`
+		Body  struct {
+			Records []BucketEventRecord `json:"Records"`
+		}
+	}
+	type StorageEventsOutput struct {
+		Body struct {
+			Processed int `json:"processed"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "storage-events",
+			Method:      http.MethodPost,
+			Path:        "/events/storage",
+			Summary:     "Receive remote storage events.",
+			Description: "Receive S3 compatible bucket notification events for objects changed outside of the server and invalidate the corresponding caches and catalog entries.",
+			Tags:        []string{"events"},
+		},
+		func(ctx context.Context, input *StorageEventsInput) (*StorageEventsOutput, error) {
+			if subtle.ConstantTimeCompare([]byte(input.Token), []byte(utils.Config.Storage.Remote.EventsToken.Value())) != 1 {
+				return nil, newErrorModel(utils.ErrorCodeUnauthorized, "Invalid events token.", "The provided events token is invalid.")
+			}
+
+			if databases.Dbs == nil {
+				return nil, newErrorModel(utils.ErrorCodeInternal, "Initialization Error", "Databases weren't initialized.")
+			}
+
+			response := &StorageEventsOutput{}
+
+			for _, record := range input.Body.Records {
+				// NOTE: object keys are url encoded in bucket notifications
+				key, err := url.QueryUnescape(record.S3.Object.Key)
+				if err != nil {
+					utils.Logger.Warn("Invalid object key in storage event.", zap.String("key", record.S3.Object.Key), zap.Error(err))
+					continue
+				}
+
+				// NOTE: the key is stored in another bucket, e.g. a copy left in the shared bucket by a tenant configured since
+				if bucket := record.S3.Bucket.Name; bucket != "" && bucket != remotevfs.BucketOf(key) {
+					utils.Logger.Debug("Ignoring storage event of another bucket.", zap.String("bucket", bucket), zap.String("key", key))
+					continue
+				}
+
+				switch {
+				case strings.HasPrefix(record.EventName, "ObjectCreated:"), strings.HasPrefix(record.EventName, "s3:ObjectCreated:"):
+					databases.Dbs.HandleRemoteObjectChange(key, false)
+				case strings.HasPrefix(record.EventName, "ObjectRemoved:"), strings.HasPrefix(record.EventName, "s3:ObjectRemoved:"):
+					databases.Dbs.HandleRemoteObjectChange(key, true)
+				default:
+					utils.Logger.Debug("Ignoring storage event.", zap.String("eventName", record.EventName), zap.String("key", key))
+					continue
+				}
+
+				response.Body.Processed++
+			}
+
+			return response, nil
+		},
+	)
+}
@@ -0,0 +1,77 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/gc"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterGCRoutes(api huma.API) {
+	// NOTE: the collection deletes files, it is only exposed once a token protects it
+	if utils.Config.Server.AdminToken.Value() == "" {
+		return
+	}
+
+	type GCReportInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type GCReportOutput struct {
+		Body gc.CollectionReport
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-gc-report",
+			Method:      http.MethodGet,
+			Path:        "/admin/gc",
+			Summary:     "Get the last storage garbage collection report.",
+			Description: "Get the orphaned files found by the last collection of the local storage and the remote bucket.",
+			Tags:        []string{"admin", "gc"},
+		},
+		func(ctx context.Context, input *GCReportInput) (*GCReportOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			report := gc.LastReport()
+			if report == nil {
+				return nil, newErrorModel(utils.ErrorCodeNotFound, "No collection yet.", "The storage wasn't collected since startup.")
+			}
+			return &GCReportOutput{Body: *report}, nil
+		},
+	)
+
+	type CollectInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+		Body  struct {
+			Delete *bool `json:"delete,omitempty" doc:"Delete the orphaned files rather than only reporting them, defaults to GC_DELETE."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-gc",
+			Method:      http.MethodPost,
+			Path:        "/admin/gc",
+			Summary:     "Collect the storage.",
+			Description: "Scan the local storage and the remote bucket for orphaned files right away, outside of the schedule. Only the files older than GC_SAFETY_WINDOW_SECONDS are reported and deleted.",
+			Tags:        []string{"admin", "gc"},
+		},
+		func(ctx context.Context, input *CollectInput) (*GCReportOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			remove := utils.Config.GC.Delete
+			if input.Body.Delete != nil {
+				remove = *input.Body.Delete
+			}
+
+			return &GCReportOutput{Body: gc.Collect(remove)}, nil
+		},
+	)
+}
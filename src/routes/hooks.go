@@ -0,0 +1,226 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/hooks"
+	"persisto/src/internal/replication"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+	"go.uber.org/zap"
+)
+
+// NOTE: a comment is sent on the idle event streams at this interval, so that the proxies don't close them
+const hookEventsKeepAlive = 15 * time.Second
+
+func RegisterHooksRoutes(api huma.API) {
+	// NOTE: the hooks send the rows unrestricted by the policies, the routes are only exposed once a token protects them
+	if utils.Config.Server.AdminToken.Value() == "" || !utils.Config.Hooks.Enabled {
+		return
+	}
+
+	type ListHooksInput struct {
+		Name  string `path:"name"`
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type ListHooksOutput struct {
+		Body struct {
+			Hooks []hooks.Hook `json:"hooks"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-hooks-list",
+			Method:      http.MethodGet,
+			Path:        "/admin/databases/{name}/hooks",
+			Summary:     "List the hooks of a database.",
+			Description: "List the hooks delivering the changes of the tables of the database, with the ID of the last change each one delivered.",
+			Tags:        []string{"admin", "hooks"},
+		},
+		func(ctx context.Context, input *ListHooksInput) (*ListHooksOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			list, err := hooks.List(database)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to list the hooks.")
+			}
+
+			response := &ListHooksOutput{}
+			response.Body.Hooks = list
+			return response, nil
+		},
+	)
+
+	type SetHookInput struct {
+		Name  string `path:"name"`
+		Hook  string `path:"hook"`
+		Token string `header:"X-Persisto-Admin-Token"`
+		Body  struct {
+			Table      string   `json:"table" minLength:"1" example:"orders" doc:"Table whose changes are delivered."`
+			Operations []string `json:"operations,omitempty" example:"[\"insert\"]" doc:"Operations delivered among insert, update and delete, all of them when left out."`
+			URL        string   `json:"url,omitempty" format:"uri" example:"https://example.com/hooks/orders" doc:"Webhook the changes are posted to, the changes are only streamed to the subscribers of the hook when left out."`
+		}
+	}
+	type HookOutput struct {
+		Body hooks.Hook
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-hook-set",
+			Method:      http.MethodPut,
+			Path:        "/admin/databases/{name}/hooks/{hook}",
+			Summary:     "Set a hook of a database.",
+			Description: "Create or replace a hook delivering the rows inserted, updated or deleted in a table to a webhook and to the subscribers of its events. The changes are recorded by triggers in the transaction of the write, a new hook delivers the changes made from then on.",
+			Tags:        []string{"admin", "hooks"},
+		},
+		func(ctx context.Context, input *SetHookInput) (*HookOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Hooks must be set on the primary instance.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			hook, err := hooks.Set(database, hooks.Hook{Name: input.Hook, Table: input.Body.Table, Operations: input.Body.Operations, URL: input.Body.URL})
+			if err != nil {
+				return nil, errorFrom(err, "Failed to set the hook.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventHookSet,
+				Database: database.Name,
+				Details:  map[string]any{"hook": hook.Name, "table": hook.Table, "operations": hook.Operations, "url": hook.URL},
+			})
+
+			return &HookOutput{Body: hook}, nil
+		},
+	)
+
+	type HookInput struct {
+		Name  string `path:"name"`
+		Hook  string `path:"hook"`
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "admin-hook-remove",
+			Method:        http.MethodDelete,
+			Path:          "/admin/databases/{name}/hooks/{hook}",
+			Summary:       "Remove a hook of a database.",
+			Description:   "Remove the hook and the triggers of its table no other hook needs, the changes it didn't deliver are dropped.",
+			Tags:          []string{"admin", "hooks"},
+			DefaultStatus: http.StatusNoContent,
+		},
+		func(ctx context.Context, input *HookInput) (*struct{}, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Hooks must be removed on the primary instance.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			if err := hooks.Remove(database, input.Hook); err != nil {
+				return nil, errorFrom(err, "Failed to remove the hook.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventHookRemoved,
+				Database: database.Name,
+				Details:  map[string]any{"hook": input.Hook},
+			})
+
+			return nil, nil
+		},
+	)
+
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-hook-events",
+			Method:      http.MethodGet,
+			Path:        "/admin/databases/{name}/hooks/{hook}/events",
+			Summary:     "Stream the events of a hook.",
+			Description: "Stream the changes delivered by the hook as server-sent events from now on, the event ID being the ID of the change. The changes of a hook with a webhook are streamed once posted to it, and a subscriber too slow to keep up misses some, the webhook is the reliable delivery.",
+			Tags:        []string{"admin", "hooks"},
+			Responses: map[string]*huma.Response{
+				"200": {Description: "Events of the hook.", Content: map[string]*huma.MediaType{"text/event-stream": {}}},
+			},
+		},
+		func(ctx context.Context, input *HookInput) (*huma.StreamResponse, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+			if _, err := hooks.Find(database, input.Hook); err != nil {
+				return nil, errorFrom(err, "Hook not found.")
+			}
+
+			return &huma.StreamResponse{
+				Body: func(ctx huma.Context) {
+					events, unsubscribe := hooks.Subscribe(database.Name, input.Hook)
+					defer unsubscribe()
+
+					ctx.SetHeader("Content-Type", "text/event-stream")
+					ctx.SetHeader("Cache-Control", "no-cache")
+					writer := ctx.BodyWriter()
+					flush := func() {
+						if flusher, ok := writer.(http.Flusher); ok {
+							flusher.Flush()
+						}
+					}
+					flush()
+
+					keepAlive := time.NewTicker(hookEventsKeepAlive)
+					defer keepAlive.Stop()
+					for {
+						select {
+						case <-ctx.Context().Done():
+							return
+						case <-keepAlive.C:
+							fmt.Fprint(writer, ": keep-alive\n\n")
+						case change := <-events:
+							data, err := json.Marshal(change)
+							if err != nil {
+								utils.HTTPLogger.Warn("Failed to encode a change of a hook.", zap.String("hook", input.Hook), zap.Error(err))
+								continue
+							}
+							fmt.Fprintf(writer, "id: %d\nevent: %s\ndata: %s\n\n", change.ID, change.Operation, data)
+						}
+						flush()
+					}
+				},
+			}, nil
+		},
+	)
+}
@@ -0,0 +1,133 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// NOTE: long enough to cover the retries of a client, short enough to keep the stored responses bounded
+	idempotencyKeyTTL          = 10 * time.Minute
+	idempotencyKeyMaxLength    = 255
+	idempotencyMaxStoredBodies = 1 << 20
+)
+
+type idempotentResponse struct {
+	// NOTE: closed once the first request carrying the key completed
+	done    chan struct{}
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+var (
+	idempotentResponses      = map[string]*idempotentResponse{}
+	idempotentResponsesMutex sync.Mutex
+)
+
+// Idempotency replays the response of a POST request when it is retried with the same Idempotency-Key header, so that
+// retrying a request whose response was lost doesn't apply it twice. Retries arriving while the first request is still
+// being handled are rejected with a conflict.
+func Idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > idempotencyKeyMaxLength {
+			writeErrorModel(w, newErrorModel(utils.ErrorCodeInvalidInput, "Invalid idempotency key.", "Idempotency keys are limited to 255 characters."))
+			return
+		}
+
+		// NOTE: keys are scoped to the path, the same key used against another database is another request
+		storeKey := r.URL.Path + "\x00" + key
+
+		idempotentResponsesMutex.Lock()
+		pruneIdempotentResponses()
+		stored, exists := idempotentResponses[storeKey]
+		if !exists {
+			stored = &idempotentResponse{done: make(chan struct{})}
+			idempotentResponses[storeKey] = stored
+		}
+		idempotentResponsesMutex.Unlock()
+
+		if exists {
+			select {
+			case <-stored.done:
+				// NOTE: the first request failed and wasn't stored, this one is handled as a fresh request
+				if stored.status == 0 {
+					next.ServeHTTP(w, r)
+					return
+				}
+				utils.HTTPLogger.Debug("Replaying idempotent response.", zap.String("requestId", middleware.GetReqID(r.Context())), zap.String("path", r.URL.Path))
+				for name, values := range stored.header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.status)
+				w.Write(stored.body)
+			default:
+				writeErrorModel(w, newErrorModel(utils.ErrorCodeConflict, "Request already in progress.", "A request with this idempotency key is still being handled."))
+			}
+			return
+		}
+
+		recorder := &bytes.Buffer{}
+		writer := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		writer.Tee(recorder)
+
+		defer func() {
+			status := writer.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			idempotentResponsesMutex.Lock()
+			// NOTE: server failures are not stored so that the retry gets another chance
+			if status >= http.StatusInternalServerError || recorder.Len() > idempotencyMaxStoredBodies {
+				delete(idempotentResponses, storeKey)
+			} else {
+				stored.status = status
+				stored.header = writer.Header().Clone()
+				stored.body = recorder.Bytes()
+				stored.expires = time.Now().Add(idempotencyKeyTTL)
+			}
+			close(stored.done)
+			idempotentResponsesMutex.Unlock()
+		}()
+
+		next.ServeHTTP(writer, r)
+	})
+}
+
+// NOTE: the mutex must be held
+func pruneIdempotentResponses() {
+	now := time.Now()
+	for key, stored := range idempotentResponses {
+		select {
+		case <-stored.done:
+			if now.After(stored.expires) {
+				delete(idempotentResponses, key)
+			}
+		default:
+		}
+	}
+}
+
+func writeErrorModel(w http.ResponseWriter, model *ErrorModel) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(model.Status)
+	json.NewEncoder(w).Encode(model)
+}
@@ -0,0 +1,81 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/databases"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func RegisterImportsRoutes(api huma.API) {
+	// NOTE: imports read any bucket the shared credentials reach, the routes are only exposed once a token protects them
+	if utils.Config.Server.AdminToken.Value() == "" {
+		return
+	}
+
+	type ImportOperationOutput struct {
+		Body databases.ImportOperation
+	}
+
+	type ImportDatabasesInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+		Body  struct {
+			Bucket string `json:"bucket" minLength:"1" doc:"Bucket holding the SQLite files, reached with the shared credentials."`
+			Prefix string `json:"prefix,omitempty" doc:"Prefix of the keys of the files, e.g. fleet/, the nested keys aren't imported."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "admin-databases-import",
+			Method:        http.MethodPost,
+			Path:          "/admin/imports",
+			Summary:       "Import databases from a bucket.",
+			Description:   "Queue the import of the SQLite files (.db, .sqlite, .sqlite3) found right under the prefix of a bucket persisto doesn't manage. Each file is validated, copied into the remote stage under its name without extension and adopted into the catalog, the names already taken are skipped. The imports run in the background, the returned operation tracks their progress.",
+			Tags:          []string{"admin", "databases"},
+			DefaultStatus: http.StatusAccepted,
+		},
+		func(ctx context.Context, input *ImportDatabasesInput) (*ImportOperationOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			operation, err := databases.Dbs.QueueImport(input.Body.Bucket, input.Body.Prefix, middleware.GetReqID(ctx))
+			if err != nil {
+				return nil, errorFrom(err, "Failed to queue the import.")
+			}
+			return &ImportOperationOutput{Body: operation}, nil
+		},
+	)
+
+	type GetImportOperationInput struct {
+		ID    string `path:"id"`
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-import-operation",
+			Method:      http.MethodGet,
+			Path:        "/admin/imports/{id}",
+			Summary:     "Get an import operation.",
+			Description: "Get the progress of an import, with the outcome of every file. The operations are kept until 100 newer ones finished or the server restarts.",
+			Tags:        []string{"admin", "databases"},
+		},
+		func(ctx context.Context, input *GetImportOperationInput) (*ImportOperationOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			operation, err := databases.GetImportOperation(input.ID)
+			if err != nil {
+				return nil, errorFrom(err, "Import operation not found.")
+			}
+			return &ImportOperationOutput{Body: operation}, nil
+		},
+	)
+}
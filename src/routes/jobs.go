@@ -0,0 +1,394 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/jobs"
+	"persisto/src/internal/replication"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterJobsRoutes(api huma.API) {
+	// NOTE: jobs run unrestricted SQL, the routes are only exposed once a token protects them
+	if utils.Config.Server.AdminToken.Value() == "" || !utils.Config.Jobs.Enabled {
+		return
+	}
+
+	type ListJobsInput struct {
+		Name  string `path:"name"`
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type ListJobsOutput struct {
+		Body struct {
+			Jobs []jobs.Job `json:"jobs"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-jobs-list",
+			Method:      http.MethodGet,
+			Path:        "/admin/databases/{name}/jobs",
+			Summary:     "List the jobs of a database.",
+			Description: "List the scheduled SQL jobs of the database with their next and last runs.",
+			Tags:        []string{"admin", "jobs"},
+		},
+		func(ctx context.Context, input *ListJobsInput) (*ListJobsOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			list, err := jobs.List(database)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to list the jobs.")
+			}
+
+			response := &ListJobsOutput{}
+			response.Body.Jobs = list
+			return response, nil
+		},
+	)
+
+	type JobOutput struct {
+		Body jobs.Job
+	}
+
+	type SetJobInput struct {
+		Name  string `path:"name"`
+		Job   string `path:"job"`
+		Token string `header:"X-Persisto-Admin-Token"`
+		Body  struct {
+			Schedule   string   `json:"schedule" minLength:"1" example:"0 3 * * *" doc:"Cron expression evaluated in UTC, e.g. 0 3 * * * for every day at 03:00, or a descriptor such as @hourly or @every 30m."`
+			Statements []string `json:"statements" minItems:"1" example:"DELETE FROM events WHERE created_at < datetime('now', '-30 days');" doc:"Statements run in a single transaction, a failing statement rolls back all of them."`
+			Enabled    *bool    `json:"enabled,omitempty" doc:"Whether the job runs on its schedule, defaults to true."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-job-set",
+			Method:      http.MethodPut,
+			Path:        "/admin/databases/{name}/jobs/{job}",
+			Summary:     "Set a job of a database.",
+			Description: "Create or replace a job running SQL statements on the database on a schedule, e.g. rollups, cleanups or retention deletes. The statements are compiled against the database before the job is stored.",
+			Tags:        []string{"admin", "jobs"},
+		},
+		func(ctx context.Context, input *SetJobInput) (*JobOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Jobs must be set on the primary instance.")
+			}
+			if err := checkStatementSize(input.Body.Statements); err != nil {
+				return nil, errorFrom(err, "Statement too large.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			job := jobs.Job{Name: input.Job, Schedule: input.Body.Schedule, Statements: input.Body.Statements, Enabled: true}
+			if input.Body.Enabled != nil {
+				job.Enabled = *input.Body.Enabled
+			}
+			job, err = jobs.Set(database, job)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to set the job.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventJobSet,
+				Database: database.Name,
+				Details:  map[string]any{"job": job.Name, "schedule": job.Schedule, "statements": job.Statements, "enabled": job.Enabled},
+			})
+
+			return &JobOutput{Body: job}, nil
+		},
+	)
+
+	type JobInput struct {
+		Name  string `path:"name"`
+		Job   string `path:"job"`
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "admin-job-remove",
+			Method:        http.MethodDelete,
+			Path:          "/admin/databases/{name}/jobs/{job}",
+			Summary:       "Remove a job of a database.",
+			Description:   "Remove the job and its history, a run in progress completes.",
+			Tags:          []string{"admin", "jobs"},
+			DefaultStatus: http.StatusNoContent,
+		},
+		func(ctx context.Context, input *JobInput) (*struct{}, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Jobs must be removed on the primary instance.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			if err := jobs.Remove(database, input.Job); err != nil {
+				return nil, errorFrom(err, "Failed to remove the job.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventJobRemoved,
+				Database: database.Name,
+				Details:  map[string]any{"job": input.Job},
+			})
+
+			return nil, nil
+		},
+	)
+
+	type JobRunOutput struct {
+		Body jobs.Run
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-job-run",
+			Method:      http.MethodPost,
+			Path:        "/admin/databases/{name}/jobs/{job}/run",
+			Summary:     "Run a job now.",
+			Description: "Run the job right away, outside of its schedule, and return its run. A failed run is returned like a successful one, with its error.",
+			Tags:        []string{"admin", "jobs"},
+		},
+		func(ctx context.Context, input *JobInput) (*JobRunOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Jobs must be run on the primary instance.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			run, err := jobs.RunNow(database, input.Job)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to run the job.")
+			}
+			return &JobRunOutput{Body: run}, nil
+		},
+	)
+
+	type ListJobRunsInput struct {
+		Name  string `path:"name"`
+		Job   string `path:"job"`
+		Token string `header:"X-Persisto-Admin-Token"`
+		Limit int    `query:"limit" minimum:"1" default:"20" doc:"Runs returned, at most JOBS_HISTORY_SIZE are kept."`
+	}
+	type ListJobRunsOutput struct {
+		Body struct {
+			Runs []jobs.Run `json:"runs"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-job-runs",
+			Method:      http.MethodGet,
+			Path:        "/admin/databases/{name}/jobs/{job}/runs",
+			Summary:     "List the runs of a job.",
+			Description: "List the last runs of the job, newest first, with their status, the rows they affected and their error.",
+			Tags:        []string{"admin", "jobs"},
+		},
+		func(ctx context.Context, input *ListJobRunsInput) (*ListJobRunsOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			if _, err := jobs.Find(database, input.Job); err != nil {
+				return nil, errorFrom(err, "Job not found.")
+			}
+			runs, err := jobs.Runs(database, input.Job, input.Limit)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to list the runs.")
+			}
+
+			response := &ListJobRunsOutput{}
+			response.Body.Runs = runs
+			return response, nil
+		},
+	)
+
+	type ListRetentionInput struct {
+		Name  string `path:"name"`
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type ListRetentionOutput struct {
+		Body struct {
+			Rules []jobs.RetentionRule `json:"rules"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-retention-list",
+			Method:      http.MethodGet,
+			Path:        "/admin/databases/{name}/retention",
+			Summary:     "List the retention rules of a database.",
+			Description: "List the retention rules of the tables of the database with the jobs enforcing them.",
+			Tags:        []string{"admin", "jobs"},
+		},
+		func(ctx context.Context, input *ListRetentionInput) (*ListRetentionOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			rules, err := jobs.ListRetention(database)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to list the retention rules.")
+			}
+
+			response := &ListRetentionOutput{}
+			response.Body.Rules = rules
+			return response, nil
+		},
+	)
+
+	type SetRetentionInput struct {
+		Name   string `path:"name"`
+		Table  string `path:"table"`
+		Token  string `header:"X-Persisto-Admin-Token"`
+		DryRun bool   `query:"dry_run" doc:"Preview the rows the rule deletes when it runs now without storing it."`
+		Body   struct {
+			Column   string `json:"column" minLength:"1" example:"created_at" doc:"Column holding the timestamp of the rows."`
+			Days     int    `json:"days" minimum:"1" example:"30" doc:"Rows older than this many days are deleted."`
+			Format   string `json:"format,omitempty" enum:"text,unixepoch,unixepoch_ms" default:"text" doc:"How the timestamps are stored: text understood by the SQLite date functions, seconds or milliseconds since the epoch."`
+			Schedule string `json:"schedule,omitempty" default:"@daily" doc:"Cron expression the rule is enforced on, see the jobs."`
+		}
+	}
+	type SetRetentionOutput struct {
+		Body struct {
+			Rule    *jobs.RetentionRule    `json:"rule,omitempty" doc:"The stored rule, unset for a dry run."`
+			Preview *jobs.RetentionPreview `json:"preview,omitempty" doc:"What the rule deletes when it runs now, set for a dry run."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-retention-set",
+			Method:      http.MethodPut,
+			Path:        "/admin/databases/{name}/retention/{table}",
+			Summary:     "Set the retention rule of a table.",
+			Description: "Delete the rows of the table whose timestamp column is older than the given number of days, on the schedule of the job enforcing the rule. With dry_run, return what the rule deletes when it runs now instead of storing it.",
+			Tags:        []string{"admin", "jobs"},
+		},
+		func(ctx context.Context, input *SetRetentionInput) (*SetRetentionOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !input.DryRun && !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Retention rules must be set on the primary instance.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			rule := jobs.RetentionRule{Table: input.Table, Column: input.Body.Column, Days: input.Body.Days, Format: input.Body.Format, Schedule: input.Body.Schedule}
+			response := &SetRetentionOutput{}
+
+			if input.DryRun {
+				preview, err := jobs.PreviewRetention(database, rule)
+				if err != nil {
+					return nil, errorFrom(err, "Failed to preview the retention rule.")
+				}
+				response.Body.Preview = &preview
+				return response, nil
+			}
+
+			rule, err = jobs.SetRetention(database, rule)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to set the retention rule.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventRetentionSet,
+				Database: database.Name,
+				Details:  map[string]any{"table": rule.Table, "column": rule.Column, "days": rule.Days, "format": rule.Format, "schedule": rule.Schedule},
+			})
+
+			response.Body.Rule = &rule
+			return response, nil
+		},
+	)
+
+	type RemoveRetentionInput struct {
+		Name  string `path:"name"`
+		Table string `path:"table"`
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "admin-retention-remove",
+			Method:        http.MethodDelete,
+			Path:          "/admin/databases/{name}/retention/{table}",
+			Summary:       "Remove the retention rule of a table.",
+			Description:   "Remove the retention rule of the table and the job enforcing it, the rows are kept from then on.",
+			Tags:          []string{"admin", "jobs"},
+			DefaultStatus: http.StatusNoContent,
+		},
+		func(ctx context.Context, input *RemoveRetentionInput) (*struct{}, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Retention rules must be removed on the primary instance.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			if err := jobs.RemoveRetention(database, input.Table); err != nil {
+				return nil, errorFrom(err, "Failed to remove the retention rule.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventRetentionRemoved,
+				Database: database.Name,
+				Details:  map[string]any{"table": input.Table},
+			})
+
+			return nil, nil
+		},
+	)
+}
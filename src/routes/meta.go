@@ -0,0 +1,34 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/capabilities"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterMetaRoutes(api huma.API) {
+	type CapabilitiesOutput struct {
+		Body capabilities.Capabilities
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "get-capabilities",
+			Method:      http.MethodGet,
+			Path:        "/meta/capabilities",
+			Summary:     "Get the capabilities of the embedded SQLite.",
+			Description: "Get the version of the embedded SQLite, the options it was compiled with, its extensions, modules and functions, and the VFSes the databases are opened through with their characteristics, so that clients know which SQL features they can rely on. The OpenAPI description holds them too under x-persisto-capabilities.",
+			Tags:        []string{"meta"},
+		},
+		func(ctx context.Context, input *struct{}) (*CapabilitiesOutput, error) {
+			read, err := capabilities.Read()
+			if err != nil {
+				return nil, errorFrom(err, "Failed to read the capabilities.")
+			}
+			return &CapabilitiesOutput{Body: read}, nil
+		},
+	)
+}
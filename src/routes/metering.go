@@ -0,0 +1,148 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/budgets"
+	"persisto/src/internal/metering"
+	"persisto/src/internal/policies"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterMeteringRoutes(api huma.API) {
+	type UsageInput struct {
+		Tenant string `query:"tenant" doc:"Only return the usage of the databases of this tenant."`
+	}
+	type UsageOutput struct {
+		Body struct {
+			Usage []metering.Usage `json:"usage"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "usage-current",
+			Method:      http.MethodGet,
+			Path:        "/usage",
+			Summary:     "Get the usage of the current period.",
+			Description: "Get the usage metered per database since the start of the current period, stored bytes and transfers are only measured when the period is exported.",
+			Tags:        []string{"metering"},
+		},
+		func(ctx context.Context, input *UsageInput) (*UsageOutput, error) {
+			response := &UsageOutput{}
+			response.Body.Usage = []metering.Usage{}
+			for _, usage := range metering.Current() {
+				if input.Tenant == "" || usage.Tenant == input.Tenant {
+					response.Body.Usage = append(response.Body.Usage, usage)
+				}
+			}
+			return response, nil
+		},
+	)
+
+	type BudgetInput struct {
+		PrincipalToken string `header:"X-Persisto-Principal-Token" required:"true" doc:"Token of the principal whose consumption is returned."`
+	}
+	type BudgetOutput struct {
+		Body budgets.BudgetReport
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "budget-current",
+			Method:      http.MethodGet,
+			Path:        "/budget",
+			Summary:     "Get the consumption of the principal.",
+			Description: "Get what the principal of the token consumed over the current UTC day and month, queries, bytes transferred and estimated cost, along with its budgets. Once a budget is exhausted the requests of the principal are refused with a 429 until the end of its period.",
+			Tags:        []string{"metering"},
+		},
+		func(ctx context.Context, input *BudgetInput) (*BudgetOutput, error) {
+			if !utils.Config.Budgets.Enabled {
+				return nil, newErrorModel(utils.ErrorCodeInvalidInput, "Usage budgets disabled.", "Set BUDGETS_ENABLED=true to budget the consumption of the principals.")
+			}
+			principal, err := policies.Authenticate(input.PrincipalToken)
+			if err != nil {
+				return nil, errorFrom(err, "Invalid principal.")
+			}
+
+			return &BudgetOutput{Body: budgets.ReportOf(principal)}, nil
+		},
+	)
+
+	// NOTE: exporting closes the current period, it is restricted like the other admin routes
+	if utils.Config.Server.AdminToken.Value() == "" {
+		return
+	}
+
+	type BudgetsInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type BudgetsOutput struct {
+		Body struct {
+			Budgets []budgets.BudgetReport `json:"budgets"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-budgets",
+			Method:      http.MethodGet,
+			Path:        "/admin/budgets",
+			Summary:     "Get the consumption of every principal.",
+			Description: "Get what every principal consumed over the current UTC day and month along with its budgets.",
+			Tags:        []string{"admin", "metering"},
+		},
+		func(ctx context.Context, input *BudgetsInput) (*BudgetsOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !utils.Config.Budgets.Enabled {
+				return nil, newErrorModel(utils.ErrorCodeInvalidInput, "Usage budgets disabled.", "Set BUDGETS_ENABLED=true to budget the consumption of the principals.")
+			}
+
+			response := &BudgetsOutput{}
+			response.Body.Budgets = budgets.Reports(policies.Principals())
+			return response, nil
+		},
+	)
+
+	type ExportUsageInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type ExportUsageOutput struct {
+		Body struct {
+			Key string `json:"key"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-usage-export",
+			Method:      http.MethodPost,
+			Path:        "/admin/usage/export",
+			Summary:     "Export the usage report now.",
+			Description: "Close the current metering period and write its usage report to the bucket right away, outside of the schedule.",
+			Tags:        []string{"admin", "metering"},
+		},
+		func(ctx context.Context, input *ExportUsageInput) (*ExportUsageOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !utils.Config.Metering.Enabled {
+				return nil, newErrorModel(utils.ErrorCodeInvalidInput, "Usage metering disabled.", "Set METERING_ENABLED=true to meter and export the usage.")
+			}
+
+			key, err := metering.Export()
+			if err != nil {
+				return nil, newErrorModel(utils.ErrorCodeStageUnavailable, "Failed to export the usage report.", err.Error())
+			}
+
+			response := &ExportUsageOutput{}
+			response.Body.Key = key
+			return response, nil
+		},
+	)
+}
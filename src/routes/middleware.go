@@ -0,0 +1,233 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"persisto/src/internal/admission"
+	"persisto/src/internal/audit"
+	"persisto/src/internal/budgets"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/policies"
+	"persisto/src/internal/telemetry"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+	chi "github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+)
+
+// recordAudit records an audit event tagged with the ID of the request it originates from.
+func recordAudit(ctx context.Context, event audit.Event) {
+	event.RequestID = middleware.GetReqID(ctx)
+	audit.Record(event)
+}
+
+// Recoverer turns handler panics into 500 responses, the panics are logged as errors and thus reported.
+func Recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			utils.HTTPLogger.Error(
+				"Request handler panicked.",
+				zap.Error(fmt.Errorf("panic: %v", recovered)),
+				zap.String("requestId", middleware.GetReqID(r.Context())),
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.Stack("stack"),
+			)
+
+			w.WriteHeader(http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LimitRequestBodies bounds the bodies decoded by the operations to SERVER_MAX_BODY_BYTES, the requests whose
+// Content-Length exceeds it are refused before their body is read and the others stop being read past it, both with a
+// 413. The bodies streamed by the operations themselves, e.g. blobs, are left to them. It must be called before the
+// routes are registered.
+func LimitRequestBodies(api huma.API) {
+	maxBytes := utils.Config.Server.MaxBodyBytes
+	oapi := api.OpenAPI()
+	oapi.OnAddOperation = append(oapi.OnAddOperation, func(oapi *huma.OpenAPI, op *huma.Operation) {
+		if op.MaxBodyBytes <= 0 {
+			return
+		}
+		op.MaxBodyBytes = maxBytes
+		op.Middlewares = append(op.Middlewares, func(ctx huma.Context, next func(huma.Context)) {
+			if size, err := strconv.ParseInt(ctx.Header("Content-Length"), 10, 64); err == nil && size > maxBytes {
+				huma.WriteErr(api, ctx, http.StatusRequestEntityTooLarge, fmt.Sprintf("the request body is %d bytes, at most %d are accepted", size, maxBytes))
+				return
+			}
+			next(ctx)
+		})
+	})
+}
+
+// RecordMetrics records the count and duration of the requests by route and status.
+func RecordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		writer := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(writer, r)
+
+		status := writer.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		// NOTE: the route pattern rather than the path keeps the number of series bounded
+		route := ""
+		if routeContext := chi.RouteContext(r.Context()); routeContext != nil {
+			route = routeContext.RoutePattern()
+		}
+		telemetry.RecordRequest(r.Context(), r.Method, route, status, time.Since(start))
+	})
+}
+
+// PriorityHeader carries the priority class of the request, see utils.Priority, interactive when absent.
+const PriorityHeader = "X-Persisto-Priority"
+
+// Prioritize tags the context of the request with the priority class of its PriorityHeader, the requests naming an
+// unknown class are refused with a 400.
+func Prioritize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		priority, err := utils.ParsePriority(strings.ToLower(strings.TrimSpace(r.Header.Get(PriorityHeader))))
+		if err != nil {
+			writeErrorModel(w, errorFrom(err, "Invalid priority."))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(utils.WithPriority(r.Context(), priority)))
+	})
+}
+
+// NOTE: the routes of a database running statements on it, by the first segment of the path after the database name
+var admittedRoutes = map[string]bool{"query": true, "execute": true, "tables": true, "blob": true, "analytics": true}
+
+// AdmissionControl holds the requests running statements on a database until admission lets them run, those shed are
+// answered with a 429.
+func AdmissionControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(segments) < 3 || segments[0] != "databases" || !admittedRoutes[segments[2]] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		release, err := admission.Admit(r.Context(), segments[1])
+		if err != nil {
+			// NOTE: the client went away while queued, there is no one to answer
+			if r.Context().Err() != nil {
+				return
+			}
+			w.Header().Set("Retry-After", "1")
+			writeErrorModel(w, errorFrom(err, "Server overloaded."))
+			return
+		}
+		defer release()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// EnforceBudgets refuses with a 429 the requests running statements on a database for a principal having exhausted its
+// daily or monthly budget, and charges the others to their principal once answered. The requests without principal
+// aren't budgeted.
+func EnforceBudgets(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(segments) < 3 || segments[0] != "databases" || !admittedRoutes[segments[2]] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// NOTE: the handler refuses the invalid tokens itself
+		principal, err := policies.Authenticate(r.Header.Get("X-Persisto-Principal-Token"))
+		if err != nil || principal == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if until, err := budgets.Check(principal); err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+			writeErrorModel(w, errorFrom(err, "Budget exhausted."))
+			return
+		}
+
+		ctx, queries := budgets.WithQueries(r.Context())
+		writer := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(writer, r.WithContext(ctx))
+
+		charge := budgets.Charge{Queries: max(*queries, 1), Bytes: max(r.ContentLength, 0) + int64(writer.BytesWritten())}
+		// NOTE: only the databases served from the remote stage cost R2 operations, the reads of the query routes and of
+		// the GETs are class B and the rest class A
+		if database, err := databases.Dbs.FindByName(segments[1]); err == nil && database.GetStage() == utils.GetRemoteStage() {
+			if segments[2] == "query" || r.Method == http.MethodGet {
+				charge.ClassB = charge.Queries
+			} else {
+				charge.ClassA = charge.Queries
+			}
+		}
+		budgets.Record(principal, charge)
+	})
+}
+
+// AccessLog logs every request once its response is written, it expects the request ID and real IP middlewares to run
+// first.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		writer := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		requestID := middleware.GetReqID(r.Context())
+		if requestID != "" {
+			writer.Header().Set("X-Request-Id", requestID)
+		}
+
+		defer func() {
+			status := writer.Status()
+			// NOTE: handlers writing a body without an explicit header implicitly respond with a 200
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			fields := []zap.Field{
+				zap.String("requestId", requestID),
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.Int("status", status),
+				zap.Duration("latency", time.Since(start)),
+				zap.String("caller", r.RemoteAddr),
+				zap.String("userAgent", r.UserAgent()),
+				zap.Int64("requestBytes", r.ContentLength),
+				zap.Int("responseBytes", writer.BytesWritten()),
+			}
+			if routeContext := chi.RouteContext(r.Context()); routeContext != nil {
+				fields = append(fields, zap.String("route", routeContext.RoutePattern()))
+			}
+
+			if status >= http.StatusInternalServerError {
+				utils.HTTPLogger.Warn("Request handled.", fields...)
+			} else {
+				utils.HTTPLogger.Info("Request handled.", fields...)
+			}
+		}()
+
+		next.ServeHTTP(writer, r)
+	})
+}
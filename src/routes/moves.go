@@ -0,0 +1,96 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/databases"
+
+	huma "github.com/danielgtaylor/huma/v2"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func RegisterMovesRoutes(api huma.API) {
+	type MoveOperationOutput struct {
+		Body databases.MoveOperation
+	}
+
+	type MoveDatabasesInput struct {
+		Body struct {
+			Names []string `json:"names" minItems:"1" doc:"Names of the databases to move."`
+			Stage uint     `json:"stage" minimum:"1" doc:"Stage to move the databases to."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "databases-move",
+			Method:        http.MethodPost,
+			Path:          "/databases/move",
+			Summary:       "Move databases to another stage.",
+			Description:   "Queue the moves of the databases to the given stage, bypassing the automatic stage movements. The moves run one at a time in the background, the returned operation tracks their progress.",
+			Tags:          []string{"databases"},
+			DefaultStatus: http.StatusAccepted,
+		},
+		func(ctx context.Context, input *MoveDatabasesInput) (*MoveOperationOutput, error) {
+			operation, err := databases.Dbs.QueueMoves(input.Body.Names, input.Body.Stage, middleware.GetReqID(ctx))
+			if err != nil {
+				return nil, errorFrom(err, "Failed to queue the moves.")
+			}
+			return &MoveOperationOutput{Body: operation}, nil
+		},
+	)
+
+	type EvacuateStageInput struct {
+		Stage uint `path:"stage" minimum:"1"`
+		Body  struct {
+			TargetStage *uint `json:"target_stage,omitempty" minimum:"1" doc:"Stage to move the databases to, defaults to the next farther stage."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "stage-evacuate",
+			Method:        http.MethodPost,
+			Path:          "/stages/{stage}/evacuate",
+			Summary:       "Evacuate a stage.",
+			Description:   "Queue the moves of every database served from the stage to another stage, e.g. to clear the local disk before decommissioning the node. The moves run one at a time in the background, the returned operation tracks their progress.",
+			Tags:          []string{"stages"},
+			DefaultStatus: http.StatusAccepted,
+		},
+		func(ctx context.Context, input *EvacuateStageInput) (*MoveOperationOutput, error) {
+			var targetStage uint
+			if input.Body.TargetStage != nil {
+				targetStage = *input.Body.TargetStage
+			}
+
+			operation, err := databases.Dbs.Evacuate(input.Stage, targetStage, middleware.GetReqID(ctx))
+			if err != nil {
+				return nil, errorFrom(err, "Failed to evacuate the stage.")
+			}
+			return &MoveOperationOutput{Body: operation}, nil
+		},
+	)
+
+	type GetMoveOperationInput struct {
+		ID string `path:"id"`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "move-operation",
+			Method:      http.MethodGet,
+			Path:        "/moves/{id}",
+			Summary:     "Get a move operation.",
+			Description: "Get the progress of the moves queued by a batch move or a stage evacuation. The operations are kept until 100 newer ones finished or the server restarts.",
+			Tags:        []string{"stages"},
+		},
+		func(ctx context.Context, input *GetMoveOperationInput) (*MoveOperationOutput, error) {
+			operation, err := databases.GetMoveOperation(input.ID)
+			if err != nil {
+				return nil, errorFrom(err, "Move operation not found.")
+			}
+			return &MoveOperationOutput{Body: operation}, nil
+		},
+	)
+}
@@ -0,0 +1,297 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/policies"
+	"persisto/src/internal/replication"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterPoliciesRoutes(api huma.API) {
+	// NOTE: policies are managed by the admins, the routes are only exposed once a token protects them
+	if utils.Config.Server.AdminToken.Value() == "" || !utils.Config.Policies.Enabled {
+		return
+	}
+
+	type ListPoliciesInput struct {
+		Name  string `path:"name"`
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type ListPoliciesOutput struct {
+		Body struct {
+			Principals []string          `json:"principals"`
+			Policies   []policies.Policy `json:"policies"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-policies-list",
+			Method:      http.MethodGet,
+			Path:        "/admin/databases/{name}/policies",
+			Summary:     "List the policies of a database.",
+			Description: "List the row filters and column masks restricting the principals on the tables of the database, along with the configured principals.",
+			Tags:        []string{"admin", "policies"},
+		},
+		func(ctx context.Context, input *ListPoliciesInput) (*ListPoliciesOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			list, err := policies.List(database)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to list the policies.")
+			}
+
+			response := &ListPoliciesOutput{}
+			response.Body.Principals = policies.Principals()
+			response.Body.Policies = list
+			return response, nil
+		},
+	)
+
+	type SetPolicyInput struct {
+		Name      string `path:"name"`
+		Principal string `path:"principal"`
+		Table     string `path:"table"`
+		Token     string `header:"X-Persisto-Admin-Token"`
+		Body      struct {
+			Filter        string   `json:"filter,omitempty" doc:"SQL expression the rows visible to the principal match, e.g. tenant_id = 'acme'. All rows are visible when empty." example:"tenant_id = 'acme'"`
+			MaskedColumns []string `json:"masked_columns,omitempty" doc:"Columns read as NULL by the principal."`
+		}
+	}
+	type SetPolicyOutput struct {
+		Body policies.Policy
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-policy-set",
+			Method:      http.MethodPut,
+			Path:        "/admin/databases/{name}/policies/{principal}/{table}",
+			Summary:     "Set the policy of a principal on a table.",
+			Description: "Restrict the principal to the rows of the table matching the filter and mask the given columns, replacing its previous policy on the table. The table becomes read only for the principal.",
+			Tags:        []string{"admin", "policies"},
+		},
+		func(ctx context.Context, input *SetPolicyInput) (*SetPolicyOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Policies must be set on the primary instance.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			policy := policies.Policy{
+				Principal:     input.Principal,
+				Table:         input.Table,
+				Filter:        input.Body.Filter,
+				MaskedColumns: input.Body.MaskedColumns,
+			}
+			if err := policies.Set(database, policy); err != nil {
+				return nil, errorFrom(err, "Failed to set the policy.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventPolicySet,
+				Database: database.Name,
+				Details:  map[string]any{"principal": policy.Principal, "table": policy.Table, "filter": policy.Filter, "masked_columns": policy.MaskedColumns},
+			})
+
+			return &SetPolicyOutput{Body: policy}, nil
+		},
+	)
+
+	type RemovePolicyInput struct {
+		Name      string `path:"name"`
+		Principal string `path:"principal"`
+		Table     string `path:"table"`
+		Token     string `header:"X-Persisto-Admin-Token"`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "admin-policy-remove",
+			Method:        http.MethodDelete,
+			Path:          "/admin/databases/{name}/policies/{principal}/{table}",
+			Summary:       "Remove the policy of a principal on a table.",
+			Description:   "Remove the policy of the principal on the table, giving it full access to the table again.",
+			Tags:          []string{"admin", "policies"},
+			DefaultStatus: http.StatusNoContent,
+		},
+		func(ctx context.Context, input *RemovePolicyInput) (*struct{}, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Policies must be removed on the primary instance.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			if err := policies.Remove(database, input.Principal, input.Table); err != nil {
+				return nil, errorFrom(err, "Failed to remove the policy.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventPolicyRemoved,
+				Database: database.Name,
+				Details:  map[string]any{"principal": input.Principal, "table": input.Table},
+			})
+
+			return nil, nil
+		},
+	)
+
+	type ListSensitiveColumnsInput struct {
+		Name  string `path:"name"`
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type ListSensitiveColumnsOutput struct {
+		Body struct {
+			Columns []policies.SensitiveColumn `json:"columns"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-sensitive-columns-list",
+			Method:      http.MethodGet,
+			Path:        "/admin/databases/{name}/sensitive-columns",
+			Summary:     "List the sensitive columns of a database.",
+			Description: "List the columns masked for the principals without the unmasked permission, with their masking mode.",
+			Tags:        []string{"admin", "policies"},
+		},
+		func(ctx context.Context, input *ListSensitiveColumnsInput) (*ListSensitiveColumnsOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			columns, err := policies.ListSensitive(database)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to list the sensitive columns.")
+			}
+
+			response := &ListSensitiveColumnsOutput{}
+			response.Body.Columns = columns
+			return response, nil
+		},
+	)
+
+	type MarkSensitiveInput struct {
+		Name   string `path:"name"`
+		Table  string `path:"table"`
+		Column string `path:"column"`
+		Token  string `header:"X-Persisto-Admin-Token"`
+		Body   struct {
+			Mode string `json:"mode,omitempty" enum:"redact,partial,hash" default:"redact" doc:"How the values are masked: replaced by a placeholder, reduced to their last characters or replaced by a keyed hash."`
+		}
+	}
+	type MarkSensitiveOutput struct {
+		Body policies.SensitiveColumn
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-sensitive-column-mark",
+			Method:      http.MethodPut,
+			Path:        "/admin/databases/{name}/sensitive-columns/{table}/{column}",
+			Summary:     "Mark a column as sensitive.",
+			Description: "Mask the values of the column in the query results of the principals without the unmasked permission, replacing its previous masking mode.",
+			Tags:        []string{"admin", "policies"},
+		},
+		func(ctx context.Context, input *MarkSensitiveInput) (*MarkSensitiveOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Sensitive columns must be marked on the primary instance.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			column := policies.SensitiveColumn{Table: input.Table, Column: input.Column, Mode: input.Body.Mode}
+			if err := policies.MarkSensitive(database, column); err != nil {
+				return nil, errorFrom(err, "Failed to mark the column as sensitive.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventColumnMasked,
+				Database: database.Name,
+				Details:  map[string]any{"table": column.Table, "column": column.Column, "mode": column.Mode},
+			})
+
+			return &MarkSensitiveOutput{Body: column}, nil
+		},
+	)
+
+	type UnmarkSensitiveInput struct {
+		Name   string `path:"name"`
+		Table  string `path:"table"`
+		Column string `path:"column"`
+		Token  string `header:"X-Persisto-Admin-Token"`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "admin-sensitive-column-unmark",
+			Method:        http.MethodDelete,
+			Path:          "/admin/databases/{name}/sensitive-columns/{table}/{column}",
+			Summary:       "Unmark a sensitive column.",
+			Description:   "Return the column to being read as is by every principal.",
+			Tags:          []string{"admin", "policies"},
+			DefaultStatus: http.StatusNoContent,
+		},
+		func(ctx context.Context, input *UnmarkSensitiveInput) (*struct{}, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Sensitive columns must be unmarked on the primary instance.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			if err := policies.UnmarkSensitive(database, input.Table, input.Column); err != nil {
+				return nil, errorFrom(err, "Failed to unmark the column.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventColumnUnmasked,
+				Database: database.Name,
+				Details:  map[string]any{"table": input.Table, "column": input.Column},
+			})
+
+			return nil, nil
+		},
+	)
+}
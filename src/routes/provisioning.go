@@ -0,0 +1,153 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/databases"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterProvisioningRoutes(api huma.API) {
+	type ProvisionDatabaseInput struct {
+		Name       string `path:"name" minLength:"1" maxLength:"128"`
+		AdminToken string `header:"X-Persisto-Admin-Token" doc:"Admin token, required when the spec holds policies or a statement policy."`
+		Body       databases.Spec
+	}
+	type ProvisionDatabaseOutput struct {
+		Body struct {
+			databases.State
+			Changes []string `json:"changes" doc:"Changes applied to converge the database, empty when it already matched the spec."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-provision",
+			Method:      http.MethodPut,
+			Path:        "/databases/{name}",
+			Summary:     "Provision a database.",
+			Description: "Converge the database towards the desired state, creating it when missing. The stage, schema version, quotas, tags, statement policy and policies left out of the spec keep their current value. Applying the same spec again changes nothing.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *ProvisionDatabaseInput) (*ProvisionDatabaseOutput, error) {
+			// NOTE: policies are managed by the admins, they can only be provisioned once a token protects them, otherwise the
+			// clients they restrict could lift them
+			withPolicies := input.Body.Policies != nil
+			if withPolicies || input.Body.Statements != nil {
+				if utils.Config.Server.AdminToken.Value() == "" {
+					return nil, newErrorModel(utils.ErrorCodeForbidden, "Policies can't be provisioned.", "Set SERVER_ADMIN_TOKEN to manage the policies and statement policies.")
+				}
+				if err := authorizeAdmin(input.AdminToken); err != nil {
+					return nil, err
+				}
+			}
+
+			database, changes, err := databases.Dbs.Provision(input.Name, input.Body)
+			if err != nil {
+				if len(changes) > 0 {
+					recordAudit(ctx, audit.Event{
+						Type:     audit.EventDatabaseProvisioned,
+						Database: input.Name,
+						Details:  map[string]any{"changes": changes, "error": err.Error()},
+					})
+				}
+				return nil, errorFrom(err, "Failed to provision the database.")
+			}
+
+			if len(changes) > 0 {
+				recordAudit(ctx, audit.Event{
+					Type:     audit.EventDatabaseProvisioned,
+					Database: database.Name,
+					Details:  map[string]any{"changes": changes},
+				})
+			}
+
+			state, err := database.Describe(withPolicies)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to describe the database.")
+			}
+
+			response := &ProvisionDatabaseOutput{}
+			response.Body.State = state
+			response.Body.Changes = changes
+			return response, nil
+		},
+	)
+
+	type DescribeDatabaseInput struct {
+		Name       string `path:"name"`
+		AdminToken string `header:"X-Persisto-Admin-Token" doc:"Admin token, the policies are only included when it is given."`
+	}
+	type DescribeDatabaseOutput struct {
+		Body databases.State
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-describe",
+			Method:      http.MethodGet,
+			Path:        "/databases/{name}",
+			Summary:     "Describe a database.",
+			Description: "Get the current state of the database in the shape of its provisioning spec, so that drifts from the spec can be detected.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *DescribeDatabaseInput) (*DescribeDatabaseOutput, error) {
+			withPolicies := false
+			if input.AdminToken != "" && utils.Config.Server.AdminToken.Value() != "" {
+				if err := authorizeAdmin(input.AdminToken); err != nil {
+					return nil, err
+				}
+				withPolicies = true
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			state, err := database.Describe(withPolicies)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to describe the database.")
+			}
+			return &DescribeDatabaseOutput{Body: state}, nil
+		},
+	)
+
+	type DeleteDatabaseInput struct {
+		Name string `path:"name"`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "database-delete",
+			Method:        http.MethodDelete,
+			Path:          "/databases/{name}",
+			Summary:       "Delete a database.",
+			Description:   "Delete the database from every stage, once its copy at the persistence stage is confirmed current. The deletion is recorded before the copies are removed, the copies left behind by a failure are removed when the deletion is requested again or at startup. Deleting a missing database succeeds, so that the deletion can be retried.",
+			Tags:          []string{"databases"},
+			DefaultStatus: http.StatusNoContent,
+		},
+		func(ctx context.Context, input *DeleteDatabaseInput) (*struct{}, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				// NOTE: the database is already gone, e.g. the response of a previous deletion was lost, the cleanup of a
+				// deletion that didn't complete is resumed
+				if _, err := databases.ResumeDeletion(input.Name); err != nil {
+					return nil, errorFrom(err, "Failed to complete the deletion of the database.")
+				}
+				return nil, nil
+			}
+
+			if err := database.Delete(); err != nil {
+				return nil, errorFrom(err, "Failed to delete the database.")
+			}
+
+			recordAudit(ctx, audit.Event{Type: audit.EventDatabaseDeleted, Database: database.Name})
+			return nil, nil
+		},
+	)
+}
@@ -0,0 +1,272 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/journal"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterReconciliationRoutes(api huma.API) {
+	type ReconciliationOutput struct {
+		Body databases.ReconciliationReport
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "reconciliation-report",
+			Method:      http.MethodGet,
+			Path:        "/reconciliation",
+			Summary:     "Get the startup reconciliation report.",
+			Description: "Get what the stages held at startup: the databases adopted into the catalog, the objects skipped or conflicting with them, the orphaned objects and the local files discarded, with the suggested actions.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *struct{}) (*ReconciliationOutput, error) {
+			report := databases.Reconciliation()
+			if report == nil {
+				return nil, newErrorModel(utils.ErrorCodeNotFound, "No reconciliation yet.", "The catalog isn't setup.")
+			}
+			return &ReconciliationOutput{Body: *report}, nil
+		},
+	)
+
+	type JournalOutput struct {
+		Body struct {
+			Enabled   bool               `json:"enabled"`
+			Pending   []journal.Intent   `json:"pending"`
+			Recovered []journal.Recovery `json:"recovered"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "journal",
+			Method:      http.MethodGet,
+			Path:        "/journal",
+			Summary:     "Get the journal of the operations.",
+			Description: "Get the intents of the journal: the moves, deletions and restorations running or deferred to the next startup with the remote stage, and those whose recovery failed, held for an operator. Along with the operations interrupted by a crash which were replayed at startup, with their outcome: rolled_forward when the operation was completed, rolled_back when what it left behind was removed, deferred when the replay needs the remote stage, which is offline, failed when neither could be done.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *struct{}) (*JournalOutput, error) {
+			pending, err := journal.Pending()
+			if err != nil {
+				return nil, errorFrom(err, "Failed to read the journal.")
+			}
+
+			response := &JournalOutput{}
+			response.Body.Enabled = journal.Enabled()
+			response.Body.Pending = pending
+			if response.Body.Pending == nil {
+				response.Body.Pending = []journal.Intent{}
+			}
+			response.Body.Recovered = journal.Recovered()
+			return response, nil
+		},
+	)
+
+	// NOTE: the refresh removes databases from the catalog, it is only exposed once a token protects it
+	if utils.Config.Server.AdminToken.Value() == "" {
+		return
+	}
+
+	type RefreshCatalogInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type RefreshCatalogOutput struct {
+		Body databases.CatalogRefresh
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-refresh-catalog",
+			Method:      http.MethodPost,
+			Path:        "/admin/catalog/refresh",
+			Summary:     "Refresh the catalog.",
+			Description: "Run the discovery of the startup again and merge it into the running catalog: the databases placed in the bucket by other tools are added, those served from the remote stage whose object is gone are removed and those served from the local stage whose file is gone are restored from the remote stage. Returns the databases added, removed and changed.",
+			Tags:        []string{"admin", "databases"},
+		},
+		func(ctx context.Context, input *RefreshCatalogInput) (*RefreshCatalogOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if databases.Dbs == nil {
+				return nil, newErrorModel(utils.ErrorCodeInternal, "Initialization Error", "Databases weren't initialized.")
+			}
+
+			refresh, err := databases.Dbs.Refresh()
+			if err != nil {
+				return nil, errorFrom(err, "Failed to refresh the catalog.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:    audit.EventCatalogRefreshed,
+				Details: map[string]any{"added": refresh.Added, "removed": refresh.Removed, "changed": len(refresh.Changed)},
+			})
+			return &RefreshCatalogOutput{Body: refresh}, nil
+		},
+	)
+
+	type CatalogSnapshotInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type CatalogSnapshotOutput struct {
+		Body databases.CatalogSnapshot
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-catalog-snapshot",
+			Method:      http.MethodGet,
+			Path:        "/admin/catalog/snapshot",
+			Summary:     "Get the last snapshot of the catalog.",
+			Description: "Get the last snapshot of the catalog stored in the remote stage: the stage, placement, last move, last access and request count of every database and the freeze of the automatic movements.",
+			Tags:        []string{"admin", "databases"},
+		},
+		func(ctx context.Context, input *CatalogSnapshotInput) (*CatalogSnapshotOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			snapshot, err := databases.LoadCatalogSnapshot()
+			if err != nil {
+				return nil, errorFrom(err, "Failed to read the snapshot of the catalog.")
+			}
+			return &CatalogSnapshotOutput{Body: snapshot}, nil
+		},
+	)
+
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-snapshot-catalog",
+			Method:      http.MethodPost,
+			Path:        "/admin/catalog/snapshot",
+			Summary:     "Snapshot the catalog.",
+			Description: "Store the snapshot of the catalog in the remote stage now, replacing the previous one, as CATALOG_BACKUP_INTERVAL_SECONDS does periodically, e.g. before replacing the instance.",
+			Tags:        []string{"admin", "databases"},
+		},
+		func(ctx context.Context, input *CatalogSnapshotInput) (*CatalogSnapshotOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if databases.Dbs == nil {
+				return nil, newErrorModel(utils.ErrorCodeInternal, "Initialization Error", "Databases weren't initialized.")
+			}
+
+			snapshot, err := databases.Dbs.SnapshotCatalog()
+			if err != nil {
+				return nil, errorFrom(err, "Failed to snapshot the catalog.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:    audit.EventCatalogSnapshotted,
+				Details: map[string]any{"databases": len(snapshot.Databases)},
+			})
+			return &CatalogSnapshotOutput{Body: snapshot}, nil
+		},
+	)
+
+	type RestoreCatalogOutput struct {
+		Body databases.CatalogRestore
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-restore-catalog",
+			Method:      http.MethodPost,
+			Path:        "/admin/catalog/restore",
+			Summary:     "Restore the catalog from its last snapshot.",
+			Description: "Apply the last snapshot of the catalog to the running catalog, as CATALOG_RESTORE_ON_START does at startup: the databases served from a closer stage when it was taken are promoted back to it, the others get their placement and last move back, those not requested since the start get their request count and last access back, and the freeze of the automatic movements is restored. Returns the databases restored, promoted and missing from the catalog.",
+			Tags:        []string{"admin", "databases"},
+		},
+		func(ctx context.Context, input *CatalogSnapshotInput) (*RestoreCatalogOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if databases.Dbs == nil {
+				return nil, newErrorModel(utils.ErrorCodeInternal, "Initialization Error", "Databases weren't initialized.")
+			}
+
+			restore, err := databases.Dbs.RestoreCatalog()
+			if err != nil {
+				return nil, errorFrom(err, "Failed to restore the catalog.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:    audit.EventCatalogRestored,
+				Details: map[string]any{"taken_at": restore.TakenAt, "restored": len(restore.Restored), "promoted": restore.Promoted, "missing": restore.Missing},
+			})
+			return &RestoreCatalogOutput{Body: restore}, nil
+		},
+	)
+
+	type JournalIntentInput struct {
+		ID    int64  `path:"id"`
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type JournalIntentOutput struct {
+		Body journal.Intent
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-journal-retry",
+			Method:      http.MethodPost,
+			Path:        "/admin/journal/{id}:retry",
+			Summary:     "Retry the recovery of an operation.",
+			Description: "Mark the intent of an operation whose recovery failed at startup as pending again, it is replayed at the next startup. Returns the intent as it was.",
+			Tags:        []string{"admin", "databases"},
+		},
+		func(ctx context.Context, input *JournalIntentInput) (*JournalIntentOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			intent, err := journal.Retry(input.ID)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to retry the recovery.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventJournalRetried,
+				Database: intent.Database,
+				Details:  map[string]any{"id": intent.ID, "operation": intent.Operation, "error": intent.Error},
+			})
+			return &JournalIntentOutput{Body: intent}, nil
+		},
+	)
+
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-journal-dismiss",
+			Method:      http.MethodDelete,
+			Path:        "/admin/journal/{id}",
+			Summary:     "Dismiss the recovery of an operation.",
+			Description: "Remove the intent of an operation whose recovery failed at startup from the journal. What the operation left behind, e.g. the local copy of an interrupted demotion, is no longer kept and is discarded at the next startup. Returns the intent as it was.",
+			Tags:        []string{"admin", "databases"},
+		},
+		func(ctx context.Context, input *JournalIntentInput) (*JournalIntentOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			intent, err := journal.Dismiss(input.ID)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to dismiss the recovery.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventJournalDismissed,
+				Database: intent.Database,
+				Details:  map[string]any{"id": intent.ID, "operation": intent.Operation, "error": intent.Error},
+			})
+			return &JournalIntentOutput{Body: intent}, nil
+		},
+	)
+}
@@ -0,0 +1,185 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/replication"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+	"go.uber.org/zap"
+)
+
+// RejectWritesOnFollower refuses the requests that would modify a database on a follower or a standby, only reads,
+// queries and the admin routes are served. Writes go through once a standby is promoted.
+func RejectWritesOnFollower(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+		if !readOnly && !replication.IsPrimary() && !strings.HasSuffix(r.URL.Path, "/query") && !strings.HasPrefix(r.URL.Path, "/admin/") {
+			writeErrorModel(w, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Writes must be sent to the primary instance."))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func RegisterReplicationRoutes(api huma.API) {
+	type ReplicationOutput struct {
+		Body struct {
+			Role      string                      `json:"role"`
+			Replicas  []replication.ReplicaStatus `json:"replicas"`
+			Promotion *replication.Promotion      `json:"promotion,omitempty"`
+			Catalog   replication.CatalogStatus   `json:"catalog"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "replication-status",
+			Method:      http.MethodGet,
+			Path:        "/replication",
+			Summary:     "Get the replication status.",
+			Description: "Get the role of the instance, the replicas it keeps with their staleness on a follower or a standby, its promotion once a standby took over, and the catalog it publishes or mirrors.",
+			Tags:        []string{"replication"},
+		},
+		func(ctx context.Context, input *struct{}) (*ReplicationOutput, error) {
+			response := &ReplicationOutput{}
+			response.Body.Role = replication.Role()
+			response.Body.Replicas = replication.Status()
+			response.Body.Promotion = replication.LastPromotion()
+			return response, nil
+		},
+	)
+
+	type CatalogOutput struct {
+		Body replication.CatalogManifest
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "replication-catalog",
+			Method:      http.MethodGet,
+			Path:        "/replication/catalog",
+			Summary:     "Get the replicated catalog.",
+			Description: "Get the catalog and the sync state of the databases, as published by a primary or as last mirrored by a follower or a standby.",
+			Tags:        []string{"replication"},
+		},
+		func(ctx context.Context, input *struct{}) (*CatalogOutput, error) {
+			return &CatalogOutput{Body: replication.Catalog()}, nil
+		},
+	)
+
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "replication-catalog-events",
+			Method:      http.MethodGet,
+			Path:        "/replication/catalog/events",
+			Summary:     "Stream the catalog of the primary.",
+			Description: "Stream the catalog of the primary as server-sent events, a manifest event holding the whole catalog first, then an upsert or remove event for every database changed, the event ID being the sequence of the catalog. A subscriber too slow to keep up is disconnected and starts over from the manifest. Followers and standbys stream it from REPLICATION_PRIMARY_URL.",
+			Tags:        []string{"replication"},
+			Responses: map[string]*huma.Response{
+				"200": {Description: "Events of the catalog.", Content: map[string]*huma.MediaType{"text/event-stream": {}}},
+			},
+		},
+		func(ctx context.Context, input *struct{}) (*huma.StreamResponse, error) {
+			manifest, events, unsubscribe, err := replication.SubscribeCatalog()
+			if err != nil {
+				return nil, errorFrom(err, "Catalog not published.")
+			}
+
+			return &huma.StreamResponse{
+				Body: func(ctx huma.Context) {
+					defer unsubscribe()
+
+					ctx.SetHeader("Content-Type", "text/event-stream")
+					ctx.SetHeader("Cache-Control", "no-cache")
+					writer := ctx.BodyWriter()
+					flush := func() {
+						if flusher, ok := writer.(http.Flusher); ok {
+							flusher.Flush()
+						}
+					}
+					send := func(event replication.CatalogEvent) bool {
+						data, err := json.Marshal(event)
+						if err != nil {
+							utils.HTTPLogger.Warn("Failed to encode a catalog event.", zap.String("type", event.Type), zap.Error(err))
+							return false
+						}
+						fmt.Fprintf(writer, "id: %d\nevent: %s\ndata: %s\n\n", event.Sequence, event.Type, data)
+						return true
+					}
+
+					if !send(replication.CatalogEvent{Type: replication.CatalogEventManifest, Sequence: manifest.Sequence, Manifest: &manifest}) {
+						return
+					}
+					flush()
+
+					keepAlive := time.NewTicker(replication.CatalogKeepAlive)
+					defer keepAlive.Stop()
+					for {
+						select {
+						case <-ctx.Context().Done():
+							return
+						case <-keepAlive.C:
+							fmt.Fprint(writer, ": keep-alive\n\n")
+						case event, open := <-events:
+							if !open {
+								return
+							}
+							send(event)
+						}
+						flush()
+					}
+				},
+			}, nil
+		},
+	)
+
+	// NOTE: promoting a standby fences the active instance, it is restricted like the other admin routes
+	if utils.Config.Server.AdminToken.Value() == "" {
+		return
+	}
+
+	type PromoteInput struct {
+		Token string `header:"X-Persisto-Admin-Token"`
+		Force bool   `query:"force" doc:"Take the leases over even though the active instance still holds them, it must be stopped beforehand."`
+	}
+	type PromoteOutput struct {
+		Body replication.Promotion
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-replication-promote",
+			Method:      http.MethodPost,
+			Path:        "/admin/replication/promote",
+			Summary:     "Promote the standby.",
+			Description: "Turn the standby into the active instance, serving its prefetched databases from the local stage right away. Refused while the active instance holds its lease unless forced.",
+			Tags:        []string{"admin", "replication"},
+		},
+		func(ctx context.Context, input *PromoteInput) (*PromoteOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			promotion, err := replication.Promote(replication.PromotionRequested, input.Force)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to promote the standby.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:    audit.EventInstancePromoted,
+				Details: map[string]any{"reason": promotion.Reason, "forced": promotion.Forced, "adopted": promotion.Adopted, "cold": promotion.Cold, "unsynced": promotion.Unsynced},
+			})
+
+			return &PromoteOutput{Body: promotion}, nil
+		},
+	)
+}
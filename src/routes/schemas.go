@@ -0,0 +1,97 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/backups"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/schemas"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterSchemasRoutes(api huma.API) {
+	type SchemaDiffInput struct {
+		Name      string `path:"name"`
+		Against   string `query:"against" doc:"Name of the database compared to this one."`
+		Snapshot  string `query:"snapshot" doc:"Tag of the snapshot of this database compared to it."`
+		Backup    string `query:"backup" doc:"Key of the backup of this database compared to it, as listed."`
+		Migration bool   `query:"migration" default:"false" doc:"Also return the statements migrating the compared schema to the schema of this database."`
+	}
+	type SchemaDiffOutput struct {
+		Body schemas.Diff
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-schema-diff",
+			Method:      http.MethodGet,
+			Path:        "/databases/{name}/schema/diff",
+			Summary:     "Diff the schema of a database.",
+			Description: "Compare the tables, columns, indexes, triggers and views of the database to those of another database, or of one of its snapshots or backups. The changes go from the compared schema to the schema of the database, the migration applies them with ALTER TABLE when it can and rebuilds the tables otherwise.",
+			Tags:        []string{"schemas"},
+		},
+		func(ctx context.Context, input *SchemaDiffInput) (*SchemaDiffOutput, error) {
+			selected := 0
+			for _, source := range []string{input.Against, input.Snapshot, input.Backup} {
+				if source != "" {
+					selected++
+				}
+			}
+			if selected != 1 {
+				return nil, newErrorModel(utils.ErrorCodeInvalidInput, "Invalid schema selection.", "Exactly one of against, snapshot and backup must be given.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			var from schemas.Schema
+			switch {
+			case input.Against != "":
+				other, err := databases.Dbs.FindByName(input.Against)
+				if err != nil {
+					return nil, errorFrom(err, "Compared database not found.")
+				}
+				if from, err = other.ReadSchema(); err != nil {
+					return nil, errorFrom(err, "Failed to read the schema of the compared database.")
+				}
+			case input.Snapshot != "":
+				snapshot, err := backups.FindSnapshot(input.Name, input.Snapshot)
+				if err != nil {
+					return nil, errorFrom(err, "Snapshot not found.")
+				}
+				if from, err = schemas.Read(snapshot.URI()); err != nil {
+					return nil, newErrorModel(utils.ErrorCodeStageUnavailable, "Failed to read the schema of the snapshot.", err.Error())
+				}
+			default:
+				backup, err := backups.Find(input.Name, input.Backup)
+				if err != nil {
+					return nil, errorFrom(err, "Backup not found.")
+				}
+				uri, _, cleanup, err := backups.Open(backup)
+				if err != nil {
+					return nil, errorFrom(err, "Failed to read the backup.")
+				}
+				defer cleanup()
+				if from, err = schemas.Read(uri); err != nil {
+					return nil, newErrorModel(utils.ErrorCodeStageUnavailable, "Failed to read the schema of the backup.", err.Error())
+				}
+			}
+
+			to, err := database.ReadSchema()
+			if err != nil {
+				return nil, errorFrom(err, "Failed to read the schema of the database.")
+			}
+
+			diff := schemas.Compare(from, to)
+			if !input.Migration {
+				diff.Migration, diff.Warnings = nil, nil
+			}
+			return &SchemaDiffOutput{Body: diff}, nil
+		},
+	)
+}
@@ -0,0 +1,80 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/scrubber"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterScrubRoutes(api huma.API) {
+	type ListScrubReportsOutput struct {
+		Body struct {
+			Reports []scrubber.Report `json:"reports"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "scrub-reports",
+			Method:      http.MethodGet,
+			Path:        "/scrub",
+			Summary:     "List the scrub reports.",
+			Description: "List the outcome of the last scrub of every database scrubbed since startup.",
+			Tags:        []string{"scrub"},
+		},
+		func(ctx context.Context, input *struct{}) (*ListScrubReportsOutput, error) {
+			response := &ListScrubReportsOutput{}
+			response.Body.Reports = scrubber.Reports()
+			return response, nil
+		},
+	)
+
+	type ScrubDatabaseInput struct {
+		Name string `path:"name"`
+		Body struct {
+			Repair *bool `json:"repair,omitempty" doc:"Repair the diverging copies, defaults to SCRUB_REPAIR."`
+		}
+	}
+	type ScrubDatabaseOutput struct {
+		Body scrubber.Report
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-scrub",
+			Method:      http.MethodPost,
+			Path:        "/databases/{name}/scrub",
+			Summary:     "Scrub a database.",
+			Description: "Compare the copies of the database across stages right away, outside of the schedule, and repair the stale ones.",
+			Tags:        []string{"scrub"},
+		},
+		func(ctx context.Context, input *ScrubDatabaseInput) (*ScrubDatabaseOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			repair := utils.Config.Scrub.Repair
+			if input.Body.Repair != nil {
+				repair = *input.Body.Repair
+			}
+
+			report := scrubber.Scrub(database, repair)
+			if report.Diverged() {
+				recordAudit(ctx, audit.Event{
+					Type:     audit.EventDatabaseScrubbed,
+					Database: report.Database,
+					Details:  map[string]any{"status": report.Status, "repaired": report.Repaired},
+				})
+			}
+
+			return &ScrubDatabaseOutput{Body: report}, nil
+		},
+	)
+}
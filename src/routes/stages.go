@@ -0,0 +1,34 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/stages"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterStagesRoutes(api huma.API) {
+	type ListStagesOutput struct {
+		Body struct {
+			Stages []stages.StageInfo `json:"stages"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "list-stages",
+			Method:      http.MethodGet,
+			Path:        "/stages",
+			Summary:     "List stages.",
+			Description: "List the configured stages from the closest to the farthest, with their backend, usage, budget, the databases they serve and their health. Getting the usage of the remote stage lists its bucket.",
+			Tags:        []string{"stages"},
+		},
+		func(ctx context.Context, input *struct{}) (*ListStagesOutput, error) {
+			response := &ListStagesOutput{}
+			response.Body.Stages = stages.Topology()
+			return response, nil
+		},
+	)
+}
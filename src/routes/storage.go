@@ -0,0 +1,38 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/vfs/localvfs"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterStorageRoutes(api huma.API) {
+	type LocalUsageOutput struct {
+		Body struct {
+			UsedBytes      int64 `json:"used_bytes"`
+			MaxBytes       int64 `json:"max_bytes" doc:"Local stage budget, 0 means unlimited."`
+			AvailableBytes int64 `json:"available_bytes" doc:"Bytes left in the budget, -1 means unlimited."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "storage-local-usage",
+			Method:      http.MethodGet,
+			Path:        "/storage/local/usage",
+			Summary:     "Get local storage usage.",
+			Description: "Get the bytes used by the local stage and its configured budget.",
+			Tags:        []string{"storage"},
+		},
+		func(ctx context.Context, input *struct{}) (*LocalUsageOutput, error) {
+			response := &LocalUsageOutput{}
+			response.Body.UsedBytes = localvfs.UsedBytes()
+			response.Body.MaxBytes = localvfs.MaxBytes()
+			response.Body.AvailableBytes = localvfs.AvailableBytes()
+			return response, nil
+		},
+	)
+}
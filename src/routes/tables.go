@@ -0,0 +1,320 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/policies"
+	"persisto/src/internal/replication"
+	"persisto/src/internal/statements"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterTablesRoutes(api huma.API) {
+	type ReadRowsInput struct {
+		Name           string   `path:"name"`
+		Table          string   `path:"table"`
+		PrincipalToken string   `header:"X-Persisto-Principal-Token" doc:"Token of the principal whose policies restrict the rows."`
+		Columns        []string `query:"columns" doc:"Comma separated columns to return, every column of the table when left out."`
+		Filters        []string `query:"filter,explode" doc:"Filters as <column>:<operator>[:<value>], the operators are eq, ne, lt, lte, gt, gte, like, in with the values separated by |, null and notnull. All of them must match."`
+		OrderBy        string   `query:"order_by" doc:"NOT NULL column the rows are ordered by, the key of the table breaks the ties. The rows are ordered by the key when left out."`
+		Descending     bool     `query:"desc" doc:"Order the rows in descending order."`
+		Limit          int      `query:"limit" default:"100" minimum:"1" doc:"Maximum rows of the page, bounded by SETTINGS_MAX_RESULT_ROWS."`
+		After          string   `query:"after" doc:"Cursor of the previous page, the first page is returned when left out."`
+	}
+	type ReadRowsOutput struct {
+		Body struct {
+			Rows       utils.QueryResultType `json:"rows"`
+			Columns    []utils.QueryColumn   `json:"columns"`
+			NextCursor string                `json:"next_cursor,omitempty" doc:"Cursor of the next page, left out on the last page."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "table-rows",
+			Method:      http.MethodGet,
+			Path:        "/databases/{name}/tables/{table}/rows",
+			Summary:     "Read the rows of a table.",
+			Description: "Read a page of the rows of a table without writing SQL. The pages follow the key of the table, so that deep pages are read as fast as the first one and rows written in between don't shift them. Every value is bound as a parameter of the statement.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *ReadRowsInput) (*ReadRowsOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			request := databases.RowsRequest{
+				Table:      input.Table,
+				Columns:    input.Columns,
+				OrderBy:    input.OrderBy,
+				Descending: input.Descending,
+				Limit:      input.Limit,
+				After:      input.After,
+			}
+			if maxRows := utils.Config.Settings.MaxResultRows; maxRows > 0 && request.Limit > maxRows {
+				request.Limit = maxRows
+			}
+			for _, expression := range input.Filters {
+				filter, err := databases.ParseFilter(expression)
+				if err != nil {
+					return nil, errorFrom(err, "Invalid filter.")
+				}
+				request.Filters = append(request.Filters, filter)
+			}
+
+			principal, err := policies.Authenticate(input.PrincipalToken)
+			if err != nil {
+				return nil, errorFrom(err, "Invalid principal.")
+			}
+
+			// NOTE: the structure of the table is read unrestricted, the rows are read as the principal through the
+			// statement policy of the query endpoint
+			schema := func(window utils.ResultWindow, query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, bool, error) {
+				return database.QueryAs(ctx, "", "", window, query, parameters...)
+			}
+			read := func(window utils.ResultWindow, query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, bool, error) {
+				return database.QueryAs(ctx, principal, statements.EndpointQuery, window, query, parameters...)
+			}
+			if replication.IsFollower() {
+				// NOTE: followers answer from their local replica rather than reading the remote object
+				schema = func(window utils.ResultWindow, query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, bool, error) {
+					return replication.Query(ctx, database.Name, "", "", window, query, parameters...)
+				}
+				read = func(window utils.ResultWindow, query string, parameters ...any) (utils.QueryResultType, []utils.QueryColumn, bool, error) {
+					return replication.Query(ctx, database.Name, principal, statements.EndpointQuery, window, query, parameters...)
+				}
+			}
+
+			page, err := databases.ReadRows(schema, read, request, utils.ResultWindow{PageBytes: utils.Config.Settings.MaxResultBytes})
+			if err != nil {
+				return nil, errorFrom(err, "Failed to read the rows.")
+			}
+
+			response := &ReadRowsOutput{}
+			response.Body.Rows = page.Rows
+			response.Body.Columns = page.Columns
+			response.Body.NextCursor = page.NextCursor
+			return response, nil
+		},
+	)
+
+	type RowInput struct {
+		Name           string `path:"name"`
+		Table          string `path:"table"`
+		Key            string `path:"key" doc:"Value of the primary key of the row, or its rowid when the table has no primary key."`
+		PrincipalToken string `header:"X-Persisto-Principal-Token" doc:"Token of the principal whose policies restrict the row."`
+	}
+	type RowOutput struct {
+		ETag string `header:"ETag" doc:"Version of the row, changing whenever one of its values does."`
+		Body struct {
+			Row     map[string]any      `json:"row"`
+			Columns []utils.QueryColumn `json:"columns"`
+			Version string              `json:"version" doc:"Version of the row, as in the ETag header without the quotes."`
+		}
+	}
+	rowOutput := func(row utils.Row) *RowOutput {
+		response := &RowOutput{ETag: `"` + row.Version + `"`}
+		response.Body.Row = row.Values
+		response.Body.Columns = row.Columns
+		response.Body.Version = row.Version
+		return response
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "table-row-read",
+			Method:      http.MethodGet,
+			Path:        "/databases/{name}/tables/{table}/rows/{key}",
+			Summary:     "Read a row of a table.",
+			Description: "Read the row of a table with the given key, the table must have a single column primary key or a rowid. The ETag header holds the version of the row, to pass as If-Match when updating or deleting it.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *RowInput) (*RowOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			principal, err := policies.Authenticate(input.PrincipalToken)
+			if err != nil {
+				return nil, errorFrom(err, "Invalid principal.")
+			}
+
+			var row utils.Row
+			if replication.IsFollower() {
+				// NOTE: followers answer from their local replica rather than reading the remote object
+				row, err = replication.ReadRow(ctx, database.Name, principal, statements.EndpointQuery, input.Table, input.Key)
+			} else {
+				row, err = database.ReadRowAs(ctx, principal, statements.EndpointQuery, input.Table, input.Key)
+			}
+			if err != nil {
+				return nil, errorFrom(err, "Failed to read the row.")
+			}
+			return rowOutput(row), nil
+		},
+	)
+
+	type UpdateRowInput struct {
+		RowInput
+		IfMatch string `header:"If-Match" doc:"Versions of the row, as sent in its ETag header, the row is only updated while it still has one of them. * matches any version."`
+		Body    struct {
+			Values map[string]any `json:"values" minProperties:"1" doc:"New values by column, blobs are passed as {\"base64\": \"...\"}"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "table-row-update",
+			Method:      http.MethodPatch,
+			Path:        "/databases/{name}/tables/{table}/rows/{key}",
+			Summary:     "Update a row of a table.",
+			Description: "Set the values of some columns of the row of a table with the given key, and return the row as updated with its new version. With If-Match the row is only updated while its version matches, otherwise the update is refused with a precondition_failed error, so that concurrent updates of the same row don't overwrite each other.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *UpdateRowInput) (*RowOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			principal, err := policies.Authenticate(input.PrincipalToken)
+			if err != nil {
+				return nil, errorFrom(err, "Invalid principal.")
+			}
+
+			values := make(map[string]any, len(input.Body.Values))
+			for column, value := range input.Body.Values {
+				converted, err := utils.QueryParameters([]any{value})
+				if err != nil {
+					return nil, errorFrom(err, "Invalid value of column "+column+".")
+				}
+				values[column] = converted[0]
+			}
+
+			row, err := database.UpdateRowAs(ctx, principal, statements.EndpointExecute, input.Table, input.Key, values, input.IfMatch)
+
+			details := map[string]any{"table": input.Table, "key": input.Key, "operation": "update"}
+			if err != nil {
+				details["error"] = err.Error()
+			}
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventDatabaseExecuted,
+				Database: database.Name,
+				Details:  executedDetails(principal, details),
+			})
+
+			if err != nil {
+				return nil, errorFrom(err, "Failed to update the row.")
+			}
+			return rowOutput(row), nil
+		},
+	)
+
+	type DeleteRowInput struct {
+		RowInput
+		IfMatch string `header:"If-Match" doc:"Versions of the row, as sent in its ETag header, the row is only deleted while it still has one of them. * matches any version."`
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "table-row-delete",
+			Method:        http.MethodDelete,
+			Path:          "/databases/{name}/tables/{table}/rows/{key}",
+			Summary:       "Delete a row of a table.",
+			Description:   "Delete the row of a table with the given key. With If-Match the row is only deleted while its version matches, otherwise the deletion is refused with a precondition_failed error.",
+			Tags:          []string{"databases"},
+			DefaultStatus: http.StatusNoContent,
+		},
+		func(ctx context.Context, input *DeleteRowInput) (*struct{}, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			principal, err := policies.Authenticate(input.PrincipalToken)
+			if err != nil {
+				return nil, errorFrom(err, "Invalid principal.")
+			}
+
+			err = database.DeleteRowAs(ctx, principal, statements.EndpointExecute, input.Table, input.Key, input.IfMatch)
+
+			details := map[string]any{"table": input.Table, "key": input.Key, "operation": "delete"}
+			if err != nil {
+				details["error"] = err.Error()
+			}
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventDatabaseExecuted,
+				Database: database.Name,
+				Details:  executedDetails(principal, details),
+			})
+
+			if err != nil {
+				return nil, errorFrom(err, "Failed to delete the row.")
+			}
+			return nil, nil
+		},
+	)
+
+	type TierTableInput struct {
+		Name  string `path:"name"`
+		Table string `path:"table"`
+		Body  struct {
+			Tier string `json:"tier" enum:"local,database" doc:"local moves the table into the companion of the database on the local storage, database moves it back into the database."`
+		}
+	}
+	type TierTableOutput struct {
+		Body struct {
+			Name         string   `json:"name"`
+			Stage        uint     `json:"stage"`
+			TieredTables []string `json:"tiered_tables" doc:"Tables kept on the local storage while the database is served from its stage."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "table-tier",
+			Method:      http.MethodPost,
+			Path:        "/databases/{name}/tables/{table}/tier",
+			Summary:     "Move a table between tiers.",
+			Description: "Move the table of a large database into a companion database on the local storage, which every connection attaches, while the other tables stay at the stage of the database. The statements reach the table by its name as before. The tables with triggers, foreign keys or views depending on them can't be moved.",
+			Tags:        []string{"databases"},
+		},
+		func(ctx context.Context, input *TierTableInput) (*TierTableOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			var tables []string
+			if input.Body.Tier == tierLocal {
+				tables, err = database.PromoteTable(input.Table)
+			} else {
+				tables, err = database.DemoteTable(input.Table)
+			}
+			if err != nil {
+				return nil, errorFrom(err, "Failed to move the table.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventTableTiered,
+				Database: database.Name,
+				Details:  map[string]any{"table": input.Table, "tier": input.Body.Tier},
+			})
+
+			response := &TierTableOutput{}
+			response.Body.Name = database.GetName()
+			response.Body.Stage = database.GetStage()
+			response.Body.TieredTables = append([]string{}, tables...)
+			return response, nil
+		},
+	)
+}
+
+// NOTE: tier of the tables moved into the companion of their database on the local storage
+const tierLocal = "local"
@@ -0,0 +1,304 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"persisto/src/internal/audit"
+	"persisto/src/internal/budgets"
+	"persisto/src/internal/coordination"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/policies"
+	"persisto/src/internal/replication"
+	"persisto/src/internal/statements"
+	"persisto/src/internal/templates"
+	"persisto/src/utils"
+
+	huma "github.com/danielgtaylor/huma/v2"
+)
+
+func RegisterTemplatesRoutes(api huma.API) {
+	type RunTemplateInput struct {
+		Name           string `path:"name"`
+		Template       string `path:"template"`
+		PrincipalToken string `header:"X-Persisto-Principal-Token" doc:"Token of the principal whose policies restrict the template."`
+		Body           struct {
+			Parameters map[string]any `json:"parameters,omitempty" example:"{\"customer\": 42}" doc:"Value of every parameter of the template by name, blobs are passed as {\"base64\": \"...\"}"`
+			Version    int64          `json:"version,omitempty" minimum:"0" doc:"Version of the template to run, the latest one when left out."`
+			PageSize   int            `json:"page_size,omitempty" minimum:"0" doc:"Maximum rows of the result, bounded by SETTINGS_MAX_RESULT_ROWS"`
+			PageToken  string         `json:"page_token,omitempty" doc:"Next page token continuing a truncated result"`
+		}
+	}
+	type RunTemplateOutput struct {
+		Body struct {
+			Template      string                `json:"template"`
+			Version       int64                 `json:"version"`
+			Data          utils.QueryResultType `json:"data,omitempty" doc:"Rows read by a template reading the database."`
+			Truncated     bool                  `json:"truncated,omitempty" doc:"Rows were left past the limits, they are read by running the template again with the next page token"`
+			NextPageToken string                `json:"next_page_token,omitempty"`
+			Result        utils.ExecResultType  `json:"result,omitempty" doc:"Result of a template writing the database."`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "database-template-run",
+			Method:      http.MethodPost,
+			Path:        "/databases/{name}/templates/{template}:run",
+			Summary:     "Run a template of a database.",
+			Description: "Run the query of the template with the values of its parameters, restricted by the policies of the principal. A template reading the database returns its rows like the query endpoint, one writing it returns its result like the execute endpoint. The principals of POLICIES_TEMPLATE_PRINCIPALS can only reach the databases through the templates.",
+			Tags:        []string{"templates"},
+		},
+		func(ctx context.Context, input *RunTemplateInput) (*RunTemplateOutput, error) {
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			principal, err := policies.Authenticate(input.PrincipalToken)
+			if err != nil {
+				return nil, errorFrom(err, "Invalid principal.")
+			}
+
+			template, err := templates.Find(database, input.Template, input.Body.Version)
+			if err != nil {
+				return nil, errorFrom(err, "Template not found.")
+			}
+			parameters, err := template.Bind(input.Body.Parameters)
+			if err != nil {
+				return nil, errorFrom(err, "Invalid template parameters.")
+			}
+			budgets.CountQueries(ctx, 1)
+
+			response := &RunTemplateOutput{}
+			response.Body.Template = template.Name
+			response.Body.Version = template.Version
+
+			ctx = policies.WithinTemplate(ctx)
+			if utils.IsWriteOperation(template.Query) {
+				if err := coordination.Acquire(database.Name); err != nil {
+					return nil, errorFrom(err, "Database written by another instance.")
+				}
+
+				result, err := database.ExecuteAs(ctx, principal, statements.EndpointExecute, template.Query, parameters...)
+				failed := 0
+				if err != nil {
+					failed = 1
+				}
+				recordAudit(ctx, audit.Event{
+					Type:     audit.EventDatabaseExecuted,
+					Database: database.Name,
+					Details:  executedDetails(principal, map[string]any{"template": template.Name, "version": template.Version, "failed": failed}),
+				})
+				if err != nil {
+					return nil, errorFrom(err, "Failed to run the template.")
+				}
+				response.Body.Result = result
+				return response, nil
+			}
+
+			// NOTE: the page token is tied to the version of the template and the values of its parameters
+			fingerprint := [][]any{{template.Version, input.Body.Parameters}}
+			windows, err := pageWindows([]string{template.Query}, fingerprint, []string{input.Body.PageToken}, input.Body.PageSize)
+			if err != nil {
+				return nil, errorFrom(err, "Invalid page token.")
+			}
+
+			var rows utils.QueryResultType
+			var truncated bool
+			if replication.IsFollower() {
+				rows, _, truncated, err = replication.Query(ctx, database.Name, principal, statements.EndpointQuery, windows[0], template.Query, parameters...)
+			} else {
+				rows, _, truncated, err = database.QueryAs(ctx, principal, statements.EndpointQuery, windows[0], template.Query, parameters...)
+			}
+			if err != nil {
+				return nil, errorFrom(err, "Failed to run the template.")
+			}
+
+			response.Body.Data = rows
+			response.Body.Truncated = truncated
+			if truncated {
+				response.Body.NextPageToken = pageToken(template.Query, fingerprint[0], windows[0].Offset+len(rows))
+			}
+			return response, nil
+		},
+	)
+
+	// NOTE: the templates decide what the principals restricted to them may run, they are only managed with a token
+	if utils.Config.Server.AdminToken.Value() == "" {
+		return
+	}
+
+	type ListTemplatesInput struct {
+		Name  string `path:"name"`
+		Token string `header:"X-Persisto-Admin-Token"`
+	}
+	type ListTemplatesOutput struct {
+		Body struct {
+			Templates []templates.Template `json:"templates"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-templates-list",
+			Method:      http.MethodGet,
+			Path:        "/admin/databases/{name}/templates",
+			Summary:     "List the templates of a database.",
+			Description: "List the latest version of every template of the database.",
+			Tags:        []string{"admin", "templates"},
+		},
+		func(ctx context.Context, input *ListTemplatesInput) (*ListTemplatesOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			list, err := templates.List(database)
+			if err != nil {
+				return nil, errorFrom(err, "Failed to list the templates.")
+			}
+
+			response := &ListTemplatesOutput{}
+			response.Body.Templates = list
+			return response, nil
+		},
+	)
+
+	type TemplateInput struct {
+		Name     string `path:"name"`
+		Template string `path:"template"`
+		Token    string `header:"X-Persisto-Admin-Token"`
+	}
+	type TemplateVersionsOutput struct {
+		Body struct {
+			Versions []templates.Template `json:"versions"`
+		}
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-template-versions",
+			Method:      http.MethodGet,
+			Path:        "/admin/databases/{name}/templates/{template}",
+			Summary:     "List the versions of a template.",
+			Description: "List every version of the template, the latest first.",
+			Tags:        []string{"admin", "templates"},
+		},
+		func(ctx context.Context, input *TemplateInput) (*TemplateVersionsOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			versions, err := templates.Versions(database, input.Template)
+			if err != nil {
+				return nil, errorFrom(err, "Template not found.")
+			}
+
+			response := &TemplateVersionsOutput{}
+			response.Body.Versions = versions
+			return response, nil
+		},
+	)
+
+	type SetTemplateInput struct {
+		Name     string `path:"name"`
+		Template string `path:"template"`
+		Token    string `header:"X-Persisto-Admin-Token"`
+		Body     struct {
+			Query       string   `json:"query" minLength:"1" example:"SELECT id, total FROM orders WHERE customer = :customer" doc:"Query of the template, a single statement."`
+			Parameters  []string `json:"parameters,omitempty" example:"[\"customer\"]" doc:"Names of the parameters, bound to the :name, @name or $name placeholders of the query."`
+			Description string   `json:"description,omitempty"`
+		}
+	}
+	type TemplateOutput struct {
+		Body templates.Template
+	}
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID: "admin-template-set",
+			Method:      http.MethodPut,
+			Path:        "/admin/databases/{name}/templates/{template}",
+			Summary:     "Set a template of a database.",
+			Description: "Store a new version of the template once its query compiled against the database. The callers run the latest version unless they pin another, the previous versions are kept until the template is removed.",
+			Tags:        []string{"admin", "templates"},
+		},
+		func(ctx context.Context, input *SetTemplateInput) (*TemplateOutput, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Templates must be set on the primary instance.")
+			}
+			if err := checkStatementSize([]string{input.Body.Query}); err != nil {
+				return nil, errorFrom(err, "Query too large.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			template, err := templates.Set(database, templates.Template{Name: input.Template, Query: input.Body.Query, Parameters: input.Body.Parameters, Description: input.Body.Description})
+			if err != nil {
+				return nil, errorFrom(err, "Failed to set the template.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventTemplateSet,
+				Database: database.Name,
+				Details:  map[string]any{"template": template.Name, "version": template.Version, "query": template.Query, "parameters": template.Parameters},
+			})
+
+			return &TemplateOutput{Body: template}, nil
+		},
+	)
+
+	huma.Register(
+		api,
+		huma.Operation{
+			OperationID:   "admin-template-remove",
+			Method:        http.MethodDelete,
+			Path:          "/admin/databases/{name}/templates/{template}",
+			Summary:       "Remove a template of a database.",
+			Description:   "Remove every version of the template.",
+			Tags:          []string{"admin", "templates"},
+			DefaultStatus: http.StatusNoContent,
+		},
+		func(ctx context.Context, input *TemplateInput) (*struct{}, error) {
+			if err := authorizeAdmin(input.Token); err != nil {
+				return nil, err
+			}
+			if !replication.IsPrimary() {
+				return nil, newErrorModel(utils.ErrorCodeReadOnly, "Instance is a read replica.", "Templates must be removed on the primary instance.")
+			}
+
+			database, err := databases.Dbs.FindByName(input.Name)
+			if err != nil {
+				return nil, errorFrom(err, "Database not found.")
+			}
+
+			if err := templates.Remove(database, input.Template); err != nil {
+				return nil, errorFrom(err, "Failed to remove the template.")
+			}
+
+			recordAudit(ctx, audit.Event{
+				Type:     audit.EventTemplateRemoved,
+				Database: database.Name,
+				Details:  map[string]any{"template": input.Template},
+			})
+
+			return nil, nil
+		},
+	)
+}
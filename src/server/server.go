@@ -0,0 +1,178 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"persisto/src/internal"
+	"persisto/src/internal/budgets"
+	"persisto/src/internal/capabilities"
+	"persisto/src/internal/databases"
+	"persisto/src/internal/replication"
+	"persisto/src/internal/stages"
+	"persisto/src/internal/telemetry"
+	"persisto/src/routes"
+	"persisto/src/utils"
+	"persisto/src/vfs"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/adapters/humachi"
+	chi "github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Setup loads the configuration from the arguments and the environment and sets up the stages and the catalog, the
+// databases found in the stages are recovered and served once Start is called. It returns flag.ErrHelp when the
+// arguments ask for the usage.
+func Setup(arguments ...string) error {
+	if _, err := utils.SetupConfiguration(arguments...); err != nil {
+		return err
+	}
+
+	if _, err := utils.SetupLogger(zapcore.Level(utils.Config.Logging.Level)); err != nil {
+		return fmt.Errorf("failed to setup logger: %w", err)
+	}
+
+	utils.SetupMemory()
+
+	if err := vfs.RegisterVfs(); err != nil {
+		return fmt.Errorf("failed to setup the stages: %w", err)
+	}
+
+	if _, err := databases.SetupDatabases(); err != nil {
+		return fmt.Errorf("failed to setup the databases: %w", err)
+	}
+	return nil
+}
+
+// Start starts the background features and returns the handler serving the routes, Setup must have been called.
+func Start() http.Handler {
+	utils.StartSecretsRotation()
+	internal.SetupAuditing()
+	if err := telemetry.SetupMetrics(); err != nil {
+		utils.Logger.Fatal("Failed to setup metrics.", zap.Error(err))
+	}
+
+	// NOTE: the features keeping their state in the bucket or working on the copies of the remote stage are left out
+	// while it is offline
+	online := !utils.RemoteOffline()
+	if !online {
+		utils.Logger.Warn(
+			"Remote stage offline, not starting the features which need it.",
+			zap.Strings("disabled", []string{"coordination", "remote adoption", "catalog backups", "backups", "scrubber", "garbage collection", "drills", "metering", "budgets", "replication"}),
+		)
+	}
+
+	stages.SetupStages()
+	if online {
+		internal.SetupCoordination()
+	}
+	internal.SetupStagesMonitoring()
+	databases.SetupSyncWindowMonitor()
+	if online {
+		databases.SetupRemoteAdoption()
+		databases.SetupCatalogBackups()
+		internal.SetupBackups()
+		internal.SetupScrubber()
+		internal.SetupGarbageCollection()
+		internal.SetupDrills()
+	}
+	internal.SetupJobs()
+	internal.SetupHooks()
+	if online {
+		internal.SetupMetering()
+		budgets.SetupBudgets()
+		internal.SetupReplication()
+	}
+	internal.SetupPgwire()
+	internal.SetupLocalFileWatcher()
+	internal.SetupLogLevelSignals()
+
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID, middleware.RealIP)
+	if utils.Config.Logging.AccessLogEnabled {
+		router.Use(routes.AccessLog)
+	}
+	if utils.Config.Logging.MetricsExporter != telemetry.MetricsExporterNone {
+		router.Use(routes.RecordMetrics)
+	}
+	// NOTE: registered before the recoverer so that panicking requests are seen as failures and not stored
+	router.Use(routes.Idempotency)
+	router.Use(routes.Recoverer)
+	if !replication.IsPrimary() {
+		router.Use(routes.RejectWritesOnFollower)
+	}
+	if utils.Config.Budgets.Enabled {
+		router.Use(routes.EnforceBudgets)
+	}
+	router.Use(routes.Prioritize)
+	router.Use(routes.AdmissionControl)
+
+	config := huma.DefaultConfig(
+		utils.Config.Server.Information.Name,
+		utils.Config.Server.Version,
+	)
+	config.Info.Description = utils.Config.Server.Information.Description
+	config.Info.Contact = &huma.Contact{
+		Name:  utils.Config.Server.Information.Contact.Name,
+		Email: utils.Config.Server.Information.Contact.Email,
+	}
+	// NOTE: the clients generated from the OpenAPI description know which SQL features they can rely on without a request
+	if read, err := capabilities.Read(); err != nil {
+		utils.Logger.Warn("Failed to read the capabilities of SQLite.", zap.Error(err))
+	} else {
+		config.Info.Extensions = map[string]any{"x-persisto-capabilities": read}
+	}
+
+	routes.RegisterErrorModel()
+	api := humachi.New(router, config)
+	routes.LimitRequestBodies(api)
+
+	routes.RegisterHealthRoutes(api)
+	routes.RegisterMetaRoutes(api)
+	routes.RegisterDatabasesRoutes(api)
+	routes.RegisterProvisioningRoutes(api)
+	routes.RegisterStagesRoutes(api)
+	routes.RegisterMovesRoutes(api)
+	routes.RegisterImportsRoutes(api)
+	routes.RegisterTablesRoutes(api)
+	routes.RegisterBlobsRoutes(api)
+	routes.RegisterBackupsRoutes(api)
+	routes.RegisterSchemasRoutes(api)
+	routes.RegisterDataRoutes(api)
+	routes.RegisterScrubRoutes(api)
+	routes.RegisterDrillsRoutes(api)
+	routes.RegisterGCRoutes(api)
+	routes.RegisterReconciliationRoutes(api)
+	routes.RegisterMeteringRoutes(api)
+	routes.RegisterAnalyticsRoutes(api)
+	routes.RegisterReplicationRoutes(api)
+	routes.RegisterCoordinationRoutes(api)
+	routes.RegisterEventsRoutes(api)
+	routes.RegisterStorageRoutes(api)
+	routes.RegisterAdminRoutes(api)
+	routes.RegisterPoliciesRoutes(api)
+	routes.RegisterJobsRoutes(api)
+	routes.RegisterHooksRoutes(api)
+	routes.RegisterChecksRoutes(api)
+	routes.RegisterTemplatesRoutes(api)
+	routes.RegisterDiagnosticsRoutes(api)
+	routes.MountProfiler(router)
+
+	return router
+}
+
+// HTTPServer returns the server of the handler listening on the address, with the timeouts of the configuration.
+func HTTPServer(handler http.Handler, address string) *http.Server {
+	return &http.Server{
+		Addr:         address,
+		Handler:      handler,
+		ReadTimeout:  time.Duration(utils.Config.Server.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(utils.Config.Server.WriteTimeout) * time.Second,
+		IdleTimeout:  time.Duration(utils.Config.Server.IdleTimeout) * time.Second,
+		ConnState:    routes.TrackConnection,
+	}
+}
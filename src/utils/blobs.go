@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ncruces/go-sqlite3/driver"
+)
+
+// NOTE: blobs are streamed through the incremental blob I/O of SQLite, so that they are neither loaded in memory nor
+// encoded in JSON. It addresses the value by its table, column and rowid, the tables without rowid can't be streamed.
+
+// ReadBlob passes the value of the column of the row to read, with its size, in a read transaction. The value must be a
+// blob or a text.
+func ReadBlob(ctx context.Context, conn *sql.Conn, table string, column string, rowid int64, read func(size int64, blob io.Reader) error) error {
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "ROLLBACK")
+
+	if err := checkBlob(ctx, conn, table, column, rowid); err != nil {
+		return err
+	}
+
+	return conn.Raw(func(driverConn any) error {
+		blob, err := driverConn.(driver.Conn).Raw().OpenBlob("main", table, column, rowid, false)
+		if err != nil {
+			return err
+		}
+		defer blob.Close()
+
+		return read(blob.Size(), blob)
+	})
+}
+
+// WriteBlob replaces the value of the column of the row by the size bytes read from body, in a single transaction. The
+// statement resizing the value is run through the connection, its triggers fire with a blob of zeros.
+func WriteBlob(ctx context.Context, conn *sql.Conn, table string, column string, rowid int64, size int64, body io.Reader) error {
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			conn.ExecContext(context.Background(), "ROLLBACK")
+		}
+	}()
+
+	result, err := conn.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s = zeroblob(?) WHERE rowid = ?", QuoteIdentifier(table), QuoteIdentifier(column)), size, rowid)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return NewError(ErrorCodeNotFound, fmt.Sprintf("row %d not found in table %s", rowid, table), nil)
+	}
+
+	err = conn.Raw(func(driverConn any) error {
+		blob, err := driverConn.(driver.Conn).Raw().OpenBlob("main", table, column, rowid, true)
+		if err != nil {
+			return err
+		}
+		defer blob.Close()
+
+		written, err := blob.ReadFrom(io.LimitReader(body, size))
+		if err != nil {
+			return err
+		}
+		if written < size {
+			return NewError(ErrorCodeInvalidInput, fmt.Sprintf("the body ended after %d of its %d bytes", written, size), nil)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// NOTE: the value is read through a statement first, so that it is subject to the authorizers of the connection
+func checkBlob(ctx context.Context, conn *sql.Conn, table string, column string, rowid int64) error {
+	var kind string
+	query := fmt.Sprintf("SELECT typeof(%s) FROM %s WHERE rowid = ?", QuoteIdentifier(column), QuoteIdentifier(table))
+	if err := conn.QueryRowContext(ctx, query, rowid).Scan(&kind); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return NewError(ErrorCodeNotFound, fmt.Sprintf("row %d not found in table %s", rowid, table), nil)
+		}
+		return err
+	}
+	if kind != "blob" && kind != "text" {
+		return NewError(ErrorCodeInvalidInput, fmt.Sprintf("the value of column %s of row %d is of type %s, not a blob", column, rowid, kind), nil)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// NOTE: compressions of the backups and content codings of the exports, zstd compresses faster and smaller than gzip,
+// which every client decodes
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// EncodingFromAccept returns the content coding preferred by the Accept-Encoding header among zstd and gzip, zstd on a
+// tie, or an empty string when neither is accepted and the response is sent as is.
+func EncodingFromAccept(acceptEncoding string) string {
+	encoding, best := "", 0.0
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		coding, parameters, _ := strings.Cut(entry, ";")
+		quality := 1.0
+		if name, value, found := strings.Cut(strings.TrimSpace(parameters), "="); found && strings.TrimSpace(name) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != CompressionZstd && coding != CompressionGzip || quality <= 0 {
+			continue
+		}
+		if quality > best || quality == best && coding == CompressionZstd {
+			encoding, best = coding, quality
+		}
+	}
+	return encoding
+}
+
+// EncodingWriter compresses what is written to it with a content coding. The compression starts with the first write,
+// so that nothing is written to the underlying writer when nothing is written to it, e.g. for an error response.
+type EncodingWriter struct {
+	w          io.Writer
+	encoding   string
+	compressor io.WriteCloser
+}
+
+// NewEncodingWriter returns the writer compressing into w with the content coding, an empty coding writes as is.
+func NewEncodingWriter(w io.Writer, encoding string) *EncodingWriter {
+	return &EncodingWriter{w: w, encoding: encoding}
+}
+
+func (writer *EncodingWriter) Write(p []byte) (int, error) {
+	if writer.encoding == "" {
+		return writer.w.Write(p)
+	}
+	if writer.compressor == nil {
+		compressor, err := compressWriter(writer.w, writer.encoding)
+		if err != nil {
+			return 0, err
+		}
+		writer.compressor = compressor
+	}
+	return writer.compressor.Write(p)
+}
+
+// Close writes the end of the compressed stream, it doesn't close the underlying writer.
+func (writer *EncodingWriter) Close() error {
+	if writer.compressor == nil {
+		return nil
+	}
+	return writer.compressor.Close()
+}
+
+// Compress returns the body compressed with the compression, as is for none.
+func Compress(body []byte, compression string) ([]byte, error) {
+	if compression == "" || compression == CompressionNone {
+		return body, nil
+	}
+	var buffer bytes.Buffer
+	compressor, err := compressWriter(&buffer, compression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := compressor.Write(body); err != nil {
+		return nil, err
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Decompress returns the body compressed by Compress as it was.
+func Decompress(body []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "", CompressionNone:
+		return body, nil
+	case CompressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(body, nil)
+	}
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
+
+func compressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		// NOTE: a single goroutine, the streams are compressed as they are written rather than in parallel blocks
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
@@ -2,8 +2,13 @@ package utils
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	env "github.com/caarlos0/env/v10"
 	"github.com/joho/godotenv"
@@ -37,11 +42,18 @@ func GetClosestStage() uint {
 	return Config.Storage.Local.StageNumber
 }
 
+// NOTE: the local stage is the farthest one while the remote stage is offline, see SetRemoteOffline
 func GetFarthestStage() uint {
+	if RemoteOffline() {
+		return Config.Storage.Local.StageNumber
+	}
 	return Config.Storage.Remote.StageNumber
 }
 
 func GetAllStageNumbers() []uint {
+	if RemoteOffline() {
+		return []uint{Config.Storage.Local.StageNumber}
+	}
 	return []uint{Config.Storage.Local.StageNumber, Config.Storage.Remote.StageNumber}
 }
 
@@ -67,6 +79,58 @@ func IsFarthestStage(stage uint) bool {
 	return stage == GetFarthestStage()
 }
 
+// StageConnectionParameters returns the parameters to append to the connection strings of the databases served from the
+// stage, setting the pragmas of STORAGE_LOCAL_PRAGMAS or STORAGE_REMOTE_PRAGMAS on every connection.
+func StageConnectionParameters(stage uint) string {
+	var pragmas []string
+	switch stage {
+	case GetLocalStage():
+		pragmas = Config.Storage.Local.Pragmas
+	case GetRemoteStage():
+		pragmas = Config.Storage.Remote.Pragmas
+	}
+	if len(pragmas) == 0 {
+		return ""
+	}
+
+	var parameters strings.Builder
+	busyTimeout := false
+	for _, pragma := range pragmas {
+		name, value, _ := strings.Cut(pragma, "=")
+		busyTimeout = busyTimeout || name == "busy_timeout"
+		parameters.WriteString("&_pragma=" + url.QueryEscape(fmt.Sprintf("%s(%s)", name, value)))
+	}
+	// NOTE: the driver only waits for the locks of the connections without pragmas, a minute like it does by default
+	if !busyTimeout {
+		parameters.WriteString("&_pragma=" + url.QueryEscape(fmt.Sprintf("busy_timeout(%d)", defaultBusyTimeout.Milliseconds())))
+	}
+	return parameters.String()
+}
+
+// defaultBusyTimeout is the busy timeout of the connections without busy_timeout pragma.
+const defaultBusyTimeout = time.Minute
+
+// LockWait returns how long a file lock of the databases served from the stage waits for the conflicting locks to be
+// released, SETTINGS_LOCK_WAIT_MILLISECONDS bounded by the busy timeout of their connections.
+func LockWait(stage uint) time.Duration {
+	var pragmas []string
+	switch stage {
+	case GetLocalStage():
+		pragmas = Config.Storage.Local.Pragmas
+	case GetRemoteStage():
+		pragmas = Config.Storage.Remote.Pragmas
+	}
+
+	busyTimeout := defaultBusyTimeout
+	for _, pragma := range pragmas {
+		name, value, _ := strings.Cut(pragma, "=")
+		if milliseconds, err := strconv.Atoi(value); name == "busy_timeout" && err == nil {
+			busyTimeout = time.Duration(milliseconds) * time.Millisecond
+		}
+	}
+	return min(time.Duration(Config.Settings.LockWaitMilliseconds)*time.Millisecond, busyTimeout)
+}
+
 func GetNextCloserStage(currentStage uint) uint {
 	if currentStage <= GetClosestStage() {
 		return 0
@@ -82,7 +146,7 @@ func GetNextFartherStage(currentStage uint) uint {
 }
 
 func GetRemovableStages() []uint {
-	return []uint{Config.Storage.Local.StageNumber, Config.Storage.Remote.StageNumber}
+	return GetAllStageNumbers()
 }
 
 func IsRemovableStage(stage uint) bool {
@@ -111,11 +175,37 @@ type Configuration struct {
 		ReadTimeout  int `env:"READ_TIMEOUT_SECONDS" envDefault:"10" validate:"gt=0"`
 		WriteTimeout int `env:"WRITE_TIMEOUT_SECONDS" envDefault:"10" validate:"gt=0"`
 		IdleTimeout  int `env:"IDLE_TIMEOUT_SECONDS" envDefault:"15" validate:"gt=0"`
+
+		// NOTE: bound the body of the requests decoded by the API, larger ones are refused with a 413 rather than buffered
+		MaxBodyBytes int64 `env:"MAX_BODY_BYTES" envDefault:"1048576" validate:"gt=0"`
+
+		AdminToken Secret `env:"ADMIN_TOKEN"`
 	} `envPrefix:"SERVER_"`
 
 	Logging struct {
 		Level          LogLevel `env:"LEVEL" envDefault:"info"`
 		OutputFilePath string   `env:"OUTPUT_FILE_PATH" envDefault:"logs.log"`
+
+		AccessLogEnabled bool `env:"ACCESS_LOG_ENABLED" envDefault:"true"`
+
+		SamplingInitial    int `env:"SAMPLING_INITIAL" envDefault:"10" validate:"gte=0"`
+		SamplingThereafter int `env:"SAMPLING_THEREAFTER" envDefault:"100" validate:"gte=0"`
+
+		ErrorReportingDSN         Secret `env:"ERROR_REPORTING_DSN"`
+		ErrorReportingEnvironment string `env:"ERROR_REPORTING_ENVIRONMENT"`
+
+		MetricsExporter           string            `env:"METRICS_EXPORTER" envDefault:"none" validate:"oneof=none otlp"`
+		MetricsEndpoint           string            `env:"METRICS_OTLP_ENDPOINT" envDefault:"http://localhost:4318/v1/metrics"`
+		MetricsHeaders            map[string]string `env:"METRICS_OTLP_HEADERS" envKeyValSeparator:"="`
+		MetricsIntervalSeconds    int               `env:"METRICS_INTERVAL_SECONDS" envDefault:"60" validate:"gt=0"`
+		MetricsInstance           string            `env:"METRICS_INSTANCE"`
+		MetricsTenant             string            `env:"METRICS_TENANT"`
+		MetricsStage              string            `env:"METRICS_STAGE"`
+		MetricsResourceAttributes map[string]string `env:"METRICS_RESOURCE_ATTRIBUTES" envKeyValSeparator:"="`
+		// NOTE: labels of the metrics reported by database, the databases sharing the same labels are summed
+		MetricsDatabaseLabels []string `env:"METRICS_DATABASE_LABELS" envDefault:"database" validate:"dive,oneof=database tenant stage"`
+		// NOTE: databases keeping their own database label, the others are summed under _other, 0 keeps every database
+		MetricsTopDatabases int `env:"METRICS_TOP_DATABASES" envDefault:"0" validate:"gte=0"`
 	} `envPrefix:"LOGGING_"`
 
 	Settings struct {
@@ -125,26 +215,378 @@ type Configuration struct {
 		StageTimeoutSeconds          int  `env:"STAGE_TIMEOUT_SECONDS" envDefault:"300" validate:"gt=0"`
 		RequestCountThreshold        uint `env:"REQUEST_COUNT_THRESHOLD" envDefault:"2" validate:"gt=0"`
 		AutoSyncEnabled              bool `env:"AUTO_SYNC_ENABLED" envDefault:"true"`
+		// NOTE: retries of a failed background sync, the interval doubling before every retry, the databases still failing
+		// afterwards are dead-lettered, see GET /admin/sync/dead-letters
+		SyncMaxRetries                int `env:"SYNC_MAX_RETRIES" envDefault:"5" validate:"gte=0"`
+		SyncRetryIntervalMilliseconds int `env:"SYNC_RETRY_INTERVAL_MILLISECONDS" envDefault:"1000" validate:"gt=0"`
+		// NOTE: resolves the databases whose remote copy was written while their syncs failed, once the remote storage is
+		// healthy again: local overwrites the remote copy, remote restores it and manual dead-letters the database
+		FailbackConflictPolicy string `env:"FAILBACK_CONFLICT_POLICY" envDefault:"manual" validate:"oneof=local remote manual"`
+		// NOTE: bound the rows and serialized bytes of every query result, the rest is read through its page token (0 for
+		// unlimited)
+		MaxResultRows  int `env:"MAX_RESULT_ROWS" envDefault:"10000" validate:"gte=0"`
+		MaxResultBytes int `env:"MAX_RESULT_BYTES" envDefault:"16777216" validate:"gte=0"`
+		// NOTE: queries of a query or execute request
+		MaxBatchQueries int `env:"MAX_BATCH_QUERIES" envDefault:"256" validate:"gt=0"`
+		// NOTE: bytes of every statement sent through the API, longer ones are refused with a 413 before reaching SQLite
+		// (0 for unlimited)
+		MaxStatementBytes int `env:"MAX_STATEMENT_BYTES" envDefault:"262144" validate:"gte=0"`
+		// NOTE: workers shared by every query request, each request runs up to that many of its queries in parallel
+		QueryWorkers int `env:"QUERY_WORKERS" envDefault:"10" validate:"gt=0"`
+		// NOTE: bound the SQLite connections opened concurrently to a database, every connection to a remote-stage
+		// database reads its own sectors from the bucket (0 for unlimited)
+		MaxDatabaseConnections int `env:"MAX_DATABASE_CONNECTIONS" envDefault:"10" validate:"gte=0"`
+		// NOTE: how long a file lock waits for the conflicting locks of the other connections to be released before SQLite
+		// is told the database is busy, bounded by the busy timeout of the connections which retry it (0 to not wait)
+		LockWaitMilliseconds int `env:"LOCK_WAIT_MILLISECONDS" envDefault:"1000" validate:"gte=0"`
+		// NOTE: admission control of the requests and PostgreSQL queries running statements, bound the ones running at once
+		// on the server and on every database (0 for unlimited), the others wait in a queue and are shed with a 429 once
+		// it is full or after waiting for the queue timeout
+		MaxConcurrentQueries         int `env:"MAX_CONCURRENT_QUERIES" envDefault:"128" validate:"gte=0"`
+		MaxConcurrentDatabaseQueries int `env:"MAX_CONCURRENT_DATABASE_QUERIES" envDefault:"32" validate:"gte=0"`
+		MaxQueuedQueries             int `env:"MAX_QUEUED_QUERIES" envDefault:"512" validate:"gte=0"`
+		MaxQueuedDatabaseQueries     int `env:"MAX_QUEUED_DATABASE_QUERIES" envDefault:"128" validate:"gte=0"`
+		QueueTimeoutMilliseconds     int `env:"QUEUE_TIMEOUT_MILLISECONDS" envDefault:"10000" validate:"gt=0"`
+		// NOTE: share of the query slots, of the queue and of the query workers only the interactive work gets, the batch
+		// and maintenance work never takes them
+		InteractiveReservedPercent int `env:"INTERACTIVE_RESERVED_PERCENT" envDefault:"20" validate:"gte=0,lte=90"`
+		// NOTE: how long a request meeting a database moving between stages retries before failing with a retryable
+		// error (0 to fail right away)
+		MoveWaitMilliseconds int `env:"MOVE_WAIT_MILLISECONDS" envDefault:"5000" validate:"gte=0"`
+		// NOTE: starts with the automatic promotions, demotions and syncs frozen, they resume through PUT /admin/freeze
+		FreezeMovement bool `env:"FREEZE_MOVEMENT" envDefault:"false"`
+		// NOTE: hysteresis of the automatic movements, a database isn't demoted before it stayed that long at its stage
+		// nor promoted again that soon after a move, so that one hovering around the thresholds doesn't move back and
+		// forth, every move costing a full copy
+		MinStageResidencySeconds int `env:"MIN_STAGE_RESIDENCY_SECONDS" envDefault:"900" validate:"gte=0"`
+		MoveCooldownSeconds      int `env:"MOVE_COOLDOWN_SECONDS" envDefault:"300" validate:"gte=0"`
+		// NOTE: how long the accesses of the databases are kept for POST /admin/simulate to replay them against other
+		// settings of the automatic movements (0 to keep none)
+		AccessHistorySeconds int `env:"ACCESS_HISTORY_SECONDS" envDefault:"86400" validate:"gte=0"`
+		// NOTE: pause between two moves of a batch of moves, so that evacuating a stage leaves room for the requests
+		MoveQueueIntervalMilliseconds int `env:"MOVE_QUEUE_INTERVAL_MILLISECONDS" envDefault:"500" validate:"gte=0"`
+		// NOTE: largest database placed in the local stage when it is created, restored or cloned, the larger ones start
+		// in the farthest stage whatever their workload and are promoted once accessed (0 for unlimited)
+		LocalPlacementMaxBytes int64 `env:"LOCAL_PLACEMENT_MAX_BYTES" envDefault:"1073741824" validate:"gte=0"`
+		// NOTE: sync lag allowed to every database, the time since the oldest write its copy at the persistence stage
+		// misses (0 for none), checked every interval and reported to the webhook when exceeded and once back within it
+		SyncWindowSeconds              int    `env:"SYNC_WINDOW_SECONDS" envDefault:"0" validate:"gte=0"`
+		SyncWindowCheckIntervalSeconds int    `env:"SYNC_WINDOW_CHECK_INTERVAL_SECONDS" envDefault:"10" validate:"gt=0"`
+		SyncWindowWebhookURL           string `env:"SYNC_WINDOW_WEBHOOK_URL" validate:"omitempty,url"`
+		// NOTE: bucket prefix of the intents of the deletions, removed once the copies of the database are removed
+		DeletionPrefix string `env:"DELETION_PREFIX" envDefault:"deletions/" validate:"required,endswith=/"`
 	} `envPrefix:"SETTINGS_"`
 
+	Secrets struct {
+		RefreshIntervalSeconds int    `env:"REFRESH_INTERVAL_SECONDS" envDefault:"300" validate:"gte=0"`
+		AWSRegion              string `env:"AWS_REGION"`
+		VaultAddress           string `env:"VAULT_ADDRESS"`
+		VaultToken             Secret `env:"VAULT_TOKEN"`
+		VaultTokenFile         string `env:"VAULT_TOKEN_FILE"`
+	} `envPrefix:"SECRETS_"`
+
+	Audit struct {
+		Enabled                   bool     `env:"ENABLED" envDefault:"false"`
+		Sinks                     []string `env:"SINKS" envDefault:"stdout" validate:"dive,oneof=file stdout s3 kafka"`
+		Delivery                  string   `env:"DELIVERY" envDefault:"best_effort" validate:"oneof=best_effort at_least_once"`
+		BufferSize                int      `env:"BUFFER_SIZE" envDefault:"1024" validate:"gt=0"`
+		BatchSize                 int      `env:"BATCH_SIZE" envDefault:"100" validate:"gt=0"`
+		FlushIntervalMilliseconds int      `env:"FLUSH_INTERVAL_MILLISECONDS" envDefault:"1000" validate:"gt=0"`
+		RetryIntervalMilliseconds int      `env:"RETRY_INTERVAL_MILLISECONDS" envDefault:"1000" validate:"gt=0"`
+		MaxRetries                int      `env:"MAX_RETRIES" envDefault:"5" validate:"gte=0"`
+		FilePath                  string   `env:"FILE_PATH" envDefault:"audit.log"`
+		S3Prefix                  string   `env:"S3_PREFIX" envDefault:"audit/"`
+		KafkaBrokers              []string `env:"KAFKA_BROKERS"`
+		KafkaTopic                string   `env:"KAFKA_TOPIC" envDefault:"persisto-audit"`
+		KafkaRequiredAcks         int      `env:"KAFKA_REQUIRED_ACKS" envDefault:"-1" validate:"oneof=-1 0 1"`
+	} `envPrefix:"AUDIT_"`
+
+	Backups struct {
+		Enabled         bool     `env:"ENABLED" envDefault:"false"`
+		Databases       []string `env:"DATABASES"`
+		IntervalSeconds int      `env:"INTERVAL_SECONDS" envDefault:"3600" validate:"gte=60"`
+		Prefix          string   `env:"PREFIX" envDefault:"backups/" validate:"required,endswith=/"`
+		KeepHourly      int      `env:"KEEP_HOURLY" envDefault:"24" validate:"gte=0"`
+		KeepDaily       int      `env:"KEEP_DAILY" envDefault:"7" validate:"gte=0"`
+		KeepWeekly      int      `env:"KEEP_WEEKLY" envDefault:"4" validate:"gte=0"`
+		MaxAgeDays      int      `env:"MAX_AGE_DAYS" envDefault:"0" validate:"gte=0"`
+		// NOTE: the snapshots are taken on demand and kept until deleted, whether the scheduled backups are enabled or not
+		SnapshotsPrefix string `env:"SNAPSHOTS_PREFIX" envDefault:"snapshots/" validate:"required,endswith=/"`
+		// NOTE: with a key derived from the active key of ENCRYPTION_KEYS, the backups taken before stay readable
+		EncryptionEnabled bool `env:"ENCRYPTION_ENABLED" envDefault:"false"`
+		// NOTE: recorded in the manifest of every backup, the backups taken before stay readable
+		Compression string `env:"COMPRESSION" envDefault:"none" validate:"oneof=none gzip zstd"`
+	} `envPrefix:"BACKUPS_"`
+
+	Replication struct {
+		Role                 string `env:"ROLE" envDefault:"primary" validate:"oneof=primary follower standby"`
+		DirectoryPath        string `env:"DIRECTORY_PATH" envDefault:"./replicas"`
+		PollIntervalSeconds  int    `env:"POLL_INTERVAL_SECONDS" envDefault:"5" validate:"gt=0"`
+		MaxStalenessSeconds  int    `env:"MAX_STALENESS_SECONDS" envDefault:"0" validate:"gte=0"`
+		StandbyPrefetchCount int    `env:"STANDBY_PREFETCH_COUNT" envDefault:"10" validate:"gte=0"`
+		StandbyAutoPromote   bool   `env:"STANDBY_AUTO_PROMOTE" envDefault:"false"`
+		// NOTE: the primary publishes its catalog and the sync state of its databases under the key, every interval when it
+		// changed, and the followers and standbys read it at every poll
+		CatalogKey             string `env:"CATALOG_KEY" envDefault:"replication/catalog.json" validate:"required,contains=/"`
+		CatalogIntervalSeconds int    `env:"CATALOG_INTERVAL_SECONDS" envDefault:"5" validate:"gt=0"`
+		// NOTE: base URL of the primary, a follower or standby streams its catalog events between two reads of the manifest
+		PrimaryURL string `env:"PRIMARY_URL" validate:"omitempty,url"`
+	} `envPrefix:"REPLICATION_"`
+
+	Coordination struct {
+		Enabled              bool   `env:"ENABLED" envDefault:"false"`
+		InstanceID           string `env:"INSTANCE_ID"`
+		LeasePrefix          string `env:"LEASE_PREFIX" envDefault:"leases/" validate:"required,endswith=/"`
+		LeaseSeconds         int    `env:"LEASE_SECONDS" envDefault:"30" validate:"gte=5"`
+		RenewIntervalSeconds int    `env:"RENEW_INTERVAL_SECONDS" envDefault:"10" validate:"gt=0"`
+	} `envPrefix:"COORDINATION_"`
+
+	Scrub struct {
+		Enabled         bool `env:"ENABLED" envDefault:"false"`
+		IntervalSeconds int  `env:"INTERVAL_SECONDS" envDefault:"3600" validate:"gte=60"`
+		Repair          bool `env:"REPAIR" envDefault:"true"`
+		// NOTE: pause between two databases, keeps the scrubber from competing with the requests
+		PauseMilliseconds int `env:"PAUSE_MILLISECONDS" envDefault:"1000" validate:"gte=0"`
+	} `envPrefix:"SCRUB_"`
+
+	Drills struct {
+		Enabled         bool     `env:"ENABLED" envDefault:"false"`
+		Databases       []string `env:"DATABASES"`
+		IntervalSeconds int      `env:"INTERVAL_SECONDS" envDefault:"86400" validate:"gte=3600"`
+		// NOTE: where the copies are restored to, removed once checked, the temporary directory of the system when empty
+		ScratchDirectory string `env:"SCRATCH_DIRECTORY"`
+	} `envPrefix:"DRILLS_"`
+
+	GC struct {
+		Enabled         bool `env:"ENABLED" envDefault:"false"`
+		IntervalSeconds int  `env:"INTERVAL_SECONDS" envDefault:"86400" validate:"gte=60"`
+		// NOTE: files modified more recently may belong to an operation still running, they are never collected
+		SafetyWindowSeconds int `env:"SAFETY_WINDOW_SECONDS" envDefault:"86400" validate:"gte=3600"`
+		// NOTE: the orphaned files are only reported unless set
+		Delete bool `env:"DELETE" envDefault:"false"`
+	} `envPrefix:"GC_"`
+
+	Manifest struct {
+		// NOTE: key of the HMAC signing the manifests, they are served unsigned when unset
+		SigningKey Secret `env:"SIGNING_KEY"`
+	} `envPrefix:"MANIFEST_"`
+
+	Catalog struct {
+		// NOTE: 0 disables the snapshots of the catalog
+		BackupIntervalSeconds int    `env:"BACKUP_INTERVAL_SECONDS" envDefault:"0" validate:"gte=0"`
+		Prefix                string `env:"PREFIX" envDefault:"catalog/" validate:"required,endswith=/"`
+		// NOTE: applies the last snapshot to the catalog built from the stages at startup, e.g. on a replacement instance
+		RestoreOnStart bool `env:"RESTORE_ON_START" envDefault:"true"`
+		// NOTE: sqlite also writes the catalog through to the database at STORE_PATH
+		Store     string `env:"STORE" envDefault:"memory" validate:"oneof=memory sqlite"`
+		StorePath string `env:"STORE_PATH" envDefault:"catalog.db" validate:"required"`
+		// NOTE: records the moves, deletions and restorations running in the journal table of the database at STORE_PATH,
+		// whatever the store, so that those interrupted by a crash are recovered at startup
+		JournalEnabled bool `env:"JOURNAL_ENABLED" envDefault:"true"`
+	} `envPrefix:"CATALOG_"`
+
+	Jobs struct {
+		Enabled bool `env:"ENABLED" envDefault:"false"`
+		// NOTE: runs kept in the history of every job, the oldest ones are deleted first
+		HistorySize int `env:"HISTORY_SIZE" envDefault:"100" validate:"gt=0"`
+		// NOTE: receives a JSON POST for every failed run
+		AlertWebhookURL string `env:"ALERT_WEBHOOK_URL" validate:"omitempty,url"`
+	} `envPrefix:"JOBS_"`
+
+	Hooks struct {
+		Enabled bool `env:"ENABLED" envDefault:"false"`
+		// NOTE: changes posted per webhook request, the others follow in the next ones
+		BatchSize           int `env:"BATCH_SIZE" envDefault:"100" validate:"gt=0"`
+		TimeoutMilliseconds int `env:"TIMEOUT_MILLISECONDS" envDefault:"5000" validate:"gt=0"`
+		// NOTE: the failed deliveries are retried at this interval, the new changes are delivered as soon as written
+		RetryIntervalSeconds int `env:"RETRY_INTERVAL_SECONDS" envDefault:"10" validate:"gt=0"`
+	} `envPrefix:"HOOKS_"`
+
+	Metering struct {
+		Enabled               bool   `env:"ENABLED" envDefault:"false"`
+		IntervalSeconds       int    `env:"INTERVAL_SECONDS" envDefault:"3600" validate:"gte=60"`
+		SampleIntervalSeconds int    `env:"SAMPLE_INTERVAL_SECONDS" envDefault:"60" validate:"gt=0"`
+		Prefix                string `env:"PREFIX" envDefault:"usage/" validate:"required,endswith=/"`
+		Format                string `env:"FORMAT" envDefault:"json" validate:"oneof=json csv"`
+		TenantSeparator       string `env:"TENANT_SEPARATOR"`
+	} `envPrefix:"METERING_"`
+
+	Budgets struct {
+		Enabled bool `env:"ENABLED" envDefault:"false"`
+		// NOTE: format is <principal>:<budget>+<budget>,<principal>:<budget> with * for every principal, e.g.
+		// *:daily_queries=100000+monthly_cost=50, the budgets of a principal replace those of *
+		Limits []string `env:"LIMITS"`
+		// NOTE: R2 prices the costs are estimated from, in dollars per million operations and per GB transferred
+		ClassAPrice float64 `env:"CLASS_A_PRICE" envDefault:"4.5" validate:"gte=0"`
+		ClassBPrice float64 `env:"CLASS_B_PRICE" envDefault:"0.36" validate:"gte=0"`
+		EgressPrice float64 `env:"EGRESS_PRICE" envDefault:"0" validate:"gte=0"`
+		// NOTE: the consumption of the principals is saved under the prefix so that a restart doesn't reset it
+		Prefix              string `env:"PREFIX" envDefault:"budgets/" validate:"required,endswith=/"`
+		SaveIntervalSeconds int    `env:"SAVE_INTERVAL_SECONDS" envDefault:"60" validate:"gt=0"`
+	} `envPrefix:"BUDGETS_"`
+
+	Analytics struct {
+		Enabled          bool `env:"ENABLED" envDefault:"false"`
+		RetentionMinutes int  `env:"RETENTION_MINUTES" envDefault:"1440" validate:"gte=5"`
+		// NOTE: bounds the memory used per database, statements beyond it are aggregated together
+		MaxStatements int `env:"MAX_STATEMENTS" envDefault:"500" validate:"gt=0"`
+		DefaultLimit  int `env:"DEFAULT_LIMIT" envDefault:"10" validate:"gt=0"`
+	} `envPrefix:"ANALYTICS_"`
+
+	Policies struct {
+		Enabled bool `env:"ENABLED" envDefault:"false"`
+		// NOTE: format is <principal>:<token>,<principal>:<token>
+		Principals []Secret `env:"PRINCIPALS"`
+		// NOTE: refuses the requests to the databases made without a principal token
+		RequirePrincipal bool `env:"REQUIRE_PRINCIPAL" envDefault:"false"`
+		// NOTE: principals reading the sensitive columns as they are
+		UnmaskedPrincipals []string `env:"UNMASKED_PRINCIPALS"`
+		// NOTE: principals only running the templates of the databases, their raw SQL is refused
+		TemplatePrincipals []string `env:"TEMPLATE_PRINCIPALS"`
+		// NOTE: key of the hashes replacing the sensitive columns masked with the hash mode
+		MaskingKey Secret `env:"MASKING_KEY"`
+	} `envPrefix:"POLICIES_"`
+
+	Statements struct {
+		// NOTE: format is <tenant>:<rule>+<rule>,<tenant>:<rule> with * for every database, e.g. acme:deny_ddl+max_rows=1000
+		Policies []string `env:"POLICIES"`
+		// NOTE: the tenant of a database is the part of its name before the separator, the whole name without separator
+		TenantSeparator string `env:"TENANT_SEPARATOR" envDefault:"__"`
+		// NOTE: principals whose SELECTs are bounded, * for all of them, the other principals are trusted
+		AdhocPrincipals      []string `env:"ADHOC_PRINCIPALS"`
+		AdhocMaxRows         int      `env:"ADHOC_MAX_ROWS" envDefault:"1000" validate:"gte=0"`
+		AdhocMaxMilliseconds int      `env:"ADHOC_MAX_MILLISECONDS" envDefault:"5000" validate:"gte=0"`
+	} `envPrefix:"STATEMENTS_"`
+
+	Pgwire struct {
+		Enabled bool `env:"ENABLED" envDefault:"false"`
+		Port    int  `env:"PORT" envDefault:"5432" validate:"gt=0"`
+		// NOTE: password of the sessions without principal, the principals authenticate with their token
+		Password Secret `env:"PASSWORD"`
+		// NOTE: once set, the clients must upgrade their connection to TLS before sending the password
+		TLSCertPath        string `env:"TLS_CERT_PATH"`
+		TLSKeyPath         string `env:"TLS_KEY_PATH"`
+		MaxConnections     int    `env:"MAX_CONNECTIONS" envDefault:"100" validate:"gt=0"`
+		IdleTimeoutSeconds int    `env:"IDLE_TIMEOUT_SECONDS" envDefault:"600" validate:"gte=0"`
+	} `envPrefix:"PGWIRE_"`
+
+	// NOTE: the memory accountant bounding the sector caches and the query results being read by the memory limit of the
+	// Go runtime, LIMIT_BYTES or GOMEMLIMIT when unset (0), the shares and the shed threshold are in percent of it
+	Memory struct {
+		LimitBytes                int64 `env:"LIMIT_BYTES" envDefault:"0" validate:"gte=0"`
+		CachePercent              int   `env:"CACHE_PERCENT" envDefault:"30" validate:"gt=0,lte=100"`
+		ResultsPercent            int   `env:"RESULTS_PERCENT" envDefault:"30" validate:"gt=0,lte=100"`
+		ShedPercent               int   `env:"SHED_PERCENT" envDefault:"85" validate:"gt=0,lte=100"`
+		CheckIntervalMilliseconds int   `env:"CHECK_INTERVAL_MILLISECONDS" envDefault:"1000" validate:"gt=0"`
+	} `envPrefix:"MEMORY_"`
+
+	Encryption struct {
+		Keys        []Secret `env:"KEYS"`
+		ActiveKeyID string   `env:"ACTIVE_KEY_ID"`
+	} `envPrefix:"ENCRYPTION_"`
+
 	Storage struct {
 		Local struct {
 			Name          string `env:"NAME" envDefault:"Local Storage"`
 			StageNumber   uint   `envDefault:"2" validate:"gt=0"`
 			DirectoryPath string `env:"DIRECTORY_PATH" envDefault:"./storage"`
+			MaxSizeBytes  int64  `env:"MAX_SIZE_BYTES" envDefault:"0" validate:"gte=0"`
+
+			TempDirectoryPath string `env:"TEMP_DIRECTORY_PATH" envDefault:"./storage-tmp"`
+			TempMaxSizeBytes  int64  `env:"TEMP_MAX_SIZE_BYTES" envDefault:"0" validate:"gte=0"`
+			TempMaxAgeSeconds int    `env:"TEMP_MAX_AGE_SECONDS" envDefault:"3600" validate:"gt=0"`
+
+			SyncMode                 string `env:"SYNC_MODE" envDefault:"full" validate:"oneof=full dataonly batched none"`
+			SyncIntervalMilliseconds int    `env:"SYNC_INTERVAL_MILLISECONDS" envDefault:"1000" validate:"gt=0"`
+
+			MmapEnabled  bool  `env:"MMAP_ENABLED" envDefault:"false"`
+			MmapMaxBytes int64 `env:"MMAP_MAX_BYTES" envDefault:"268435456" validate:"gt=0"`
+
+			WatchEnabled bool `env:"WATCH_ENABLED" envDefault:"false"`
+
+			EncryptionEnabled bool `env:"ENCRYPTION_ENABLED" envDefault:"false"`
+
+			// NOTE: pragmas as <name>=<value> set on every connection to the databases served from the stage
+			Pragmas []string `env:"PRAGMAS"`
 		} `envPrefix:"STORAGE_LOCAL_"`
 
 		Remote struct {
 			Name        string `env:"NAME" envDefault:"Remote Storage"`
 			StageNumber uint   `envDefault:"3" validate:"gt=0"`
 
-			Enabled string
+			// NOTE: without the remote stage, disabled or unreachable at startup, the server serves the local stage only,
+			// unless it is required
+			Enabled  bool `env:"ENABLED" envDefault:"true"`
+			Required bool `env:"REQUIRED" envDefault:"false"`
 
-			AccessKeyID string `env:"ACCESS_KEY_ID"`
-			SecretKey   string `env:"SECRET_KEY"`
+			AccessKeyID Secret `env:"ACCESS_KEY_ID"`
+			SecretKey   Secret `env:"SECRET_KEY"`
 			BucketName  string `env:"BUCKET_NAME"`
 			Endpoint    string `env:"ENDPOINT"`
 			Region      string `env:"REGION" envDefault:"auto"`
+
+			CredentialsSource string `env:"CREDENTIALS_SOURCE" envDefault:"auto" validate:"oneof=auto static default"`
+			RoleARN           string `env:"ROLE_ARN"`
+			RoleSessionName   string `env:"ROLE_SESSION_NAME" envDefault:"persisto"`
+			RoleExternalID    string `env:"ROLE_EXTERNAL_ID"`
+
+			CredentialsExpiryWindowSeconds int `env:"CREDENTIALS_EXPIRY_WINDOW_SECONDS" envDefault:"60" validate:"gte=0"`
+
+			SecondaryEndpoint       string `env:"SECONDARY_ENDPOINT"`
+			FailoverErrorThreshold  int    `env:"FAILOVER_ERROR_THRESHOLD" envDefault:"5" validate:"gt=0"`
+			FailbackIntervalSeconds int    `env:"FAILBACK_INTERVAL_SECONDS" envDefault:"60" validate:"gt=0"`
+
+			// NOTE: consecutive failed operations opening the circuit breaker (0 disables it), and the interval between the
+			// probes of the bucket while it is open
+			CircuitFailureThreshold int `env:"CIRCUIT_FAILURE_THRESHOLD" envDefault:"20" validate:"gte=0"`
+			CircuitCooldownSeconds  int `env:"CIRCUIT_COOLDOWN_SECONDS" envDefault:"30" validate:"gt=0"`
+
+			EventsEnabled bool   `env:"EVENTS_ENABLED" envDefault:"false"`
+			EventsToken   Secret `env:"EVENTS_TOKEN"`
+			// NOTE: interval between the listings of the bucket adopting the databases placed in it by other tools (0 disables
+			// them), for the buckets sending no events
+			AdoptionIntervalSeconds int `env:"ADOPTION_INTERVAL_SECONDS" envDefault:"0" validate:"gte=0"`
+
+			PresignExpirySeconds    int `env:"PRESIGN_EXPIRY_SECONDS" envDefault:"900" validate:"gt=0"`
+			PresignMaxExpirySeconds int `env:"PRESIGN_MAX_EXPIRY_SECONDS" envDefault:"604800" validate:"gt=0"`
+
+			// NOTE: sectors read from the bucket kept on the local disk, under the local storage directory, across restarts
+			DiskCacheEnabled  bool  `env:"DISK_CACHE_ENABLED" envDefault:"false"`
+			DiskCacheMaxBytes int64 `env:"DISK_CACHE_MAX_BYTES" envDefault:"1073741824" validate:"gt=0"`
+
+			// NOTE: how long an object found missing is taken as missing without asking the bucket again, 0 to always ask
+			MissingObjectCacheMilliseconds int `env:"MISSING_OBJECT_CACHE_MILLISECONDS" envDefault:"2000" validate:"gte=0"`
+
+			// NOTE: the last operations of the VFS on every object, kept in memory for diagnostics
+			TraceEnabled bool `env:"TRACE_ENABLED" envDefault:"false"`
+			TraceSize    int  `env:"TRACE_SIZE" envDefault:"1000" validate:"gt=0"`
+
+			// NOTE: the sectors cached in memory for every open file and the policy evicting them, lru, lfu or 2q, the 2Q
+			// segments are in percent of the cached sectors
+			CachePolicy       string `env:"CACHE_POLICY" envDefault:"lru" validate:"oneof=lru lfu 2q"`
+			CacheMaxBytes     int64  `env:"CACHE_MAX_BYTES" envDefault:"104857600" validate:"gte=65536"`
+			Cache2QInPercent  int    `env:"CACHE_2Q_IN_PERCENT" envDefault:"25" validate:"gt=0,lt=100"`
+			Cache2QOutPercent int    `env:"CACHE_2Q_OUT_PERCENT" envDefault:"50" validate:"gt=0"`
+
+			// NOTE: bytes per second the uploads of the syncs and stage copies may use across every database and for each
+			// of them, 0 leaves them unbounded
+			UploadBytesPerSecond         int64 `env:"UPLOAD_BYTES_PER_SECOND" envDefault:"0" validate:"gte=0"`
+			DatabaseUploadBytesPerSecond int64 `env:"DATABASE_UPLOAD_BYTES_PER_SECOND" envDefault:"0" validate:"gte=0"`
+
+			// NOTE: milliseconds the commits to a database served from the stage wait to be uploaded together, 0 uploads
+			// every commit on its own
+			GroupCommitMilliseconds int `env:"GROUP_COMMIT_MILLISECONDS" envDefault:"0" validate:"gte=0"`
+
+			// NOTE: the checksums of the sectors of the databases are stored next to them and checked on every fetch
+			ChecksumsEnabled bool `env:"CHECKSUMS_ENABLED" envDefault:"false"`
+
+			// NOTE: tenants stored in buckets of their own as <tenant>:<bucket>[:<access key id>:<secret key>]
+			Tenants []Secret `env:"TENANTS"`
+			// NOTE: databases named <tenant><separator><name> belong to the tenant
+			TenantSeparator string `env:"TENANT_SEPARATOR" envDefault:"__"`
+
+			// NOTE: pragmas as <name>=<value> set on every connection to the databases served from the stage
+			Pragmas []string `env:"PRAGMAS"`
 		} `envPrefix:"STORAGE_REMOTE_"`
 	}
 }
@@ -156,17 +598,57 @@ var (
 	configurationSetupOnce sync.Once
 )
 
-func SetupConfiguration() (*Configuration, error) {
+// SetupConfiguration loads the configuration from, by order of precedence, the command-line arguments, the environment,
+// the env file and the profile defaults. Only the arguments of the first call are used.
+func SetupConfiguration(arguments ...string) (*Configuration, error) {
 	configurationSetupOnce.Do(func() {
-		if err := godotenv.Load(); err != nil {
+		flags, err := parseFlags(arguments)
+		if err != nil {
+			ConfigurationSetupError = err
+			return
+		}
+
+		environment := environmentNames()
+		fileVariables, _ := godotenv.Read(flags.ConfigPath)
+
+		if err := godotenv.Load(flags.ConfigPath); err != nil {
+			if flags.set["config"] {
+				ConfigurationSetupError = fmt.Errorf("failed to load env file %s: %w", flags.ConfigPath, err)
+				return
+			}
 			fmt.Fprintf(os.Stderr, "Warning: .env file not found or failed to load: %v\n", err)
 		}
 
+		origins = configurationOrigins{
+			flags:       flags.overriddenVariables(),
+			environment: environment,
+			file:        make(map[string]bool),
+			profile:     flags.applyProfile(),
+		}
+		for name := range fileVariables {
+			origins.file[name] = true
+		}
+
 		cfg := &Configuration{}
 		if err := env.Parse(cfg); err != nil {
 			ConfigurationSetupError = err
 			return
 		}
+		flags.applyOverrides(cfg)
+		activeProfile = flags.Profile
+
+		unresolvedConfiguration = cfg
+		secretReferences = collectSecretReferences(reflect.ValueOf(cfg).Elem(), nil, nil)
+		cfg, err = resolveSecrets(cfg, secretReferences)
+		if err != nil {
+			ConfigurationSetupError = err
+			return
+		}
+
+		if err := validateConfiguration(cfg); err != nil {
+			ConfigurationSetupError = err
+			return
+		}
 		Config = cfg
 	})
 	return Config, ConfigurationSetupError
@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// NOTE: the contention is tracked by database name, the VFS only knows the file names so the locks of the files which
+// aren't databases, e.g. the temporary ones, aren't tracked. The catalog counters are kept by the mutex of the database
+// itself. The counters are kept since the start, the rates are left to the metrics.
+
+// Contention is what the requests to a database spent waiting for each other.
+type Contention struct {
+	CatalogWaits     int64   `json:"catalog_waits" doc:"Requests and stage operations which waited for the catalog mutex of the database."`
+	CatalogWaitMs    float64 `json:"catalog_wait_ms" doc:"Time spent waiting for the catalog mutex."`
+	CatalogMaxWaitMs float64 `json:"catalog_max_wait_ms" doc:"Longest wait for the catalog mutex."`
+	CatalogHolds     int64   `json:"catalog_holds" doc:"Times the catalog mutex was held exclusively, by the stage operations."`
+	CatalogHoldMs    float64 `json:"catalog_hold_ms" doc:"Time the catalog mutex was held exclusively."`
+	CatalogMaxHoldMs float64 `json:"catalog_max_hold_ms" doc:"Longest exclusive hold of the catalog mutex."`
+
+	ConnectionWaits  int64   `json:"connection_waits" doc:"Requests which waited for a connection slot, see SETTINGS_MAX_DATABASE_CONNECTIONS."`
+	ConnectionWaitMs float64 `json:"connection_wait_ms" doc:"Time spent waiting for a connection slot."`
+
+	LockWaits  int64   `json:"lock_waits" doc:"File locks which waited for the conflicting locks of the other connections to be released."`
+	LockWaitMs float64 `json:"lock_wait_ms" doc:"Time spent waiting for file locks."`
+	// NOTE: the BUSY returned by the VFS are mostly retried by SQLite within the busy timeout, only BusyErrors reach the clients
+	BusyShared    int64 `json:"busy_shared" doc:"Shared file locks refused as a writer was committing."`
+	BusyReserved  int64 `json:"busy_reserved" doc:"Reserved file locks refused as another connection was already writing."`
+	BusyExclusive int64 `json:"busy_exclusive" doc:"Exclusive file locks refused as the readers didn't leave in time."`
+	BusyErrors    int64 `json:"busy_errors" doc:"Queries which failed as the database was busy or locked."`
+}
+
+type contentionCounters struct {
+	mtx sync.Mutex
+	Contention
+}
+
+var contentions sync.Map
+
+func contentionOf(name string) *contentionCounters {
+	counters, _ := contentions.LoadOrStore(name, &contentionCounters{})
+	return counters.(*contentionCounters)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// RecordConnectionWait adds a wait for a connection slot of the database.
+func RecordConnectionWait(name string, d time.Duration) {
+	counters := contentionOf(name)
+	counters.mtx.Lock()
+	defer counters.mtx.Unlock()
+
+	counters.ConnectionWaits++
+	counters.ConnectionWaitMs += milliseconds(d)
+}
+
+func databaseOfFile(file string) (string, bool) {
+	return DatabaseNameFromFileName(filepath.Base(file))
+}
+
+// RecordLockWait adds the time a lock of the database file waited for the conflicting locks to be released.
+func RecordLockWait(file string, d time.Duration) {
+	name, isDatabase := databaseOfFile(file)
+	if !isDatabase {
+		return
+	}
+
+	counters := contentionOf(name)
+	counters.mtx.Lock()
+	defer counters.mtx.Unlock()
+
+	counters.LockWaits++
+	counters.LockWaitMs += milliseconds(d)
+}
+
+// RecordLockBusy adds a lock of the database file refused with BUSY.
+func RecordLockBusy(file string, lock vfs.LockLevel) {
+	name, isDatabase := databaseOfFile(file)
+	if !isDatabase {
+		return
+	}
+
+	counters := contentionOf(name)
+	counters.mtx.Lock()
+	defer counters.mtx.Unlock()
+
+	switch lock {
+	case vfs.LOCK_SHARED:
+		counters.BusyShared++
+	case vfs.LOCK_RESERVED:
+		counters.BusyReserved++
+	case vfs.LOCK_EXCLUSIVE:
+		counters.BusyExclusive++
+	}
+}
+
+// RecordBusyError adds a query of the database which failed with err when it is a busy or locked error, and returns err.
+func RecordBusyError(name string, err error) error {
+	if !errors.Is(err, sqlite3.BUSY) && !errors.Is(err, sqlite3.LOCKED) {
+		return err
+	}
+
+	counters := contentionOf(name)
+	counters.mtx.Lock()
+	defer counters.mtx.Unlock()
+
+	counters.BusyErrors++
+	return err
+}
+
+// ContentionOf returns the contention of the database since the start, the catalog counters left out.
+func ContentionOf(name string) Contention {
+	counters, found := contentions.Load(name)
+	if !found {
+		return Contention{}
+	}
+
+	c := counters.(*contentionCounters)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.Contention
+}
+
+// ForgetContention drops the contention of the database, once it is deleted.
+func ForgetContention(name string) {
+	contentions.Delete(name)
+}
+
+// CatalogMutex is the catalog mutex of a database, it records the waits for it and its exclusive holds. Its zero value is
+// an unlocked mutex.
+type CatalogMutex struct {
+	sync.RWMutex
+
+	// NOTE: only written while the mutex is held exclusively
+	lockedAt time.Time
+
+	statsMtx sync.Mutex
+	waits    int64
+	waited   time.Duration
+	maxWait  time.Duration
+	holds    int64
+	held     time.Duration
+	maxHold  time.Duration
+}
+
+func (m *CatalogMutex) Lock() {
+	if !m.RWMutex.TryLock() {
+		since := time.Now()
+		m.RWMutex.Lock()
+		m.RecordWait(since)
+	}
+	m.lockedAt = time.Now()
+}
+
+func (m *CatalogMutex) TryLock() bool {
+	if !m.RWMutex.TryLock() {
+		return false
+	}
+	m.lockedAt = time.Now()
+	return true
+}
+
+func (m *CatalogMutex) Unlock() {
+	held := time.Since(m.lockedAt)
+	m.RWMutex.Unlock()
+
+	m.statsMtx.Lock()
+	defer m.statsMtx.Unlock()
+	m.holds++
+	m.held += held
+	m.maxHold = max(m.maxHold, held)
+}
+
+func (m *CatalogMutex) RLock() {
+	if !m.RWMutex.TryRLock() {
+		since := time.Now()
+		m.RWMutex.RLock()
+		m.RecordWait(since)
+	}
+}
+
+// RecordWait adds a wait for the mutex since the given time, for the mutex acquired without Lock or RLock, e.g. by a
+// TryRLock loop.
+func (m *CatalogMutex) RecordWait(since time.Time) {
+	waited := time.Since(since)
+
+	m.statsMtx.Lock()
+	defer m.statsMtx.Unlock()
+	m.waits++
+	m.waited += waited
+	m.maxWait = max(m.maxWait, waited)
+}
+
+// AddContention sets the catalog counters of the contention to those of the mutex.
+func (m *CatalogMutex) AddContention(contention *Contention) {
+	m.statsMtx.Lock()
+	defer m.statsMtx.Unlock()
+
+	contention.CatalogWaits = m.waits
+	contention.CatalogWaitMs = milliseconds(m.waited)
+	contention.CatalogMaxWaitMs = milliseconds(m.maxWait)
+	contention.CatalogHolds = m.holds
+	contention.CatalogHoldMs = milliseconds(m.held)
+	contention.CatalogMaxHoldMs = milliseconds(m.maxHold)
+}
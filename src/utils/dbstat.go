@@ -0,0 +1,355 @@
+package utils
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/driver"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// NOTE: the embedded SQLite is built without the DBSTAT virtual table, the b-trees are walked here instead, page by page
+// through the file of the connection as SQLite reads it, decrypted and fetched from the bucket by the VFS of the stage.
+// The walk runs in a read transaction so that the pages don't change under it, the pages of a WAL database still in
+// its WAL are checkpointed first and the breakdown is only approximate when some couldn't be.
+
+// StorageStats is the size breakdown of a database, the figures DBSTAT would report aggregated by table and index.
+type StorageStats struct {
+	PageSize         int64 `json:"page_size"`
+	Pages            int64 `json:"pages"`
+	SizeBytes        int64 `json:"size_bytes"`
+	FreelistPages    int64 `json:"freelist_pages" doc:"Pages of the freelist, left by the deletions and reused by the next writes."`
+	UnusedBytes      int64 `json:"unused_bytes" doc:"Bytes of the pages of the tables and indexes holding no data."`
+	ReclaimableBytes int64 `json:"reclaimable_bytes" doc:"Bytes a VACUUM would give back at most, the freelist pages and the unused bytes."`
+	Exact            bool  `json:"exact" doc:"Whether the breakdown is exact, false when pages of the WAL couldn't be checkpointed before the walk."`
+	// NOTE: sorted by size, the largest first
+	Btrees []BtreeStats `json:"btrees"`
+}
+
+// BtreeStats is the size of a table or an index.
+type BtreeStats struct {
+	Name          string `json:"name"`
+	Type          string `json:"type" enum:"table,index"`
+	Table         string `json:"table" doc:"Table the index belongs to, the table itself for a table."`
+	Pages         int64  `json:"pages"`
+	InteriorPages int64  `json:"interior_pages"`
+	LeafPages     int64  `json:"leaf_pages"`
+	OverflowPages int64  `json:"overflow_pages" doc:"Pages holding the end of the values too large for their page."`
+	Cells         int64  `json:"cells" doc:"Entries of the leaf pages, the rows of a table."`
+	SizeBytes     int64  `json:"size_bytes"`
+	PayloadBytes  int64  `json:"payload_bytes" doc:"Bytes of the keys and values stored."`
+	UnusedBytes   int64  `json:"unused_bytes"`
+	// NOTE: computed like sqlite3_analyzer, 0 right after a VACUUM
+	FragmentationPercent float64 `json:"fragmentation_percent" doc:"Share of the pages not following the previous page of the b-tree in the file."`
+}
+
+// NOTE: b-tree page types, see https://www.sqlite.org/fileformat.html#b_tree_pages
+const (
+	pageInteriorIndex = 0x02
+	pageInteriorTable = 0x05
+	pageLeafIndex     = 0x0a
+	pageLeafTable     = 0x0d
+)
+
+// ReadStorageStats returns the size breakdown of the main database of the connection. The connection must be outside
+// of any transaction and able to write, to checkpoint its WAL.
+func ReadStorageStats(ctx context.Context, conn *sql.Conn) (StorageStats, error) {
+	stats := StorageStats{Exact: true}
+
+	var journalMode string
+	if err := conn.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		return StorageStats{}, err
+	}
+	if journalMode == "wal" {
+		var busy, frames, checkpointed int64
+		if err := conn.QueryRowContext(ctx, "PRAGMA wal_checkpoint(PASSIVE)").Scan(&busy, &frames, &checkpointed); err != nil {
+			return StorageStats{}, err
+		}
+		stats.Exact = busy == 0 && frames == checkpointed
+	}
+
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		return StorageStats{}, err
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), "ROLLBACK")
+
+	// NOTE: reading the schema takes the shared lock the walk relies on
+	rows, err := conn.QueryContext(ctx, "SELECT type, name, tbl_name, rootpage FROM sqlite_schema WHERE rootpage > 0 ORDER BY rootpage")
+	if err != nil {
+		return StorageStats{}, err
+	}
+	btrees := []BtreeStats{{Name: "sqlite_schema", Type: "table", Table: "sqlite_schema"}}
+	roots := []uint32{1}
+	for rows.Next() {
+		var btree BtreeStats
+		var root int64
+		if err := rows.Scan(&btree.Type, &btree.Name, &btree.Table, &root); err != nil {
+			rows.Close()
+			return StorageStats{}, err
+		}
+		btrees = append(btrees, btree)
+		roots = append(roots, uint32(root))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return StorageStats{}, err
+	}
+
+	err = conn.Raw(func(driverConn any) error {
+		handle, err := driverConn.(driver.Conn).Raw().FileControl("main", sqlite3.FCNTL_FILE_POINTER)
+		if err != nil {
+			return err
+		}
+		file, isFile := handle.(vfs.File)
+		if !isFile {
+			return errors.New("the file of the database can't be read")
+		}
+		// NOTE: a database is only written once it holds a table
+		if size, err := file.Size(); err != nil || size == 0 {
+			btrees = []BtreeStats{}
+			return err
+		}
+
+		walker, err := newBtreeWalker(file)
+		if err != nil {
+			return err
+		}
+		stats.PageSize, stats.Pages, stats.FreelistPages = walker.pageSize, walker.pages, walker.freelistPages
+		for index, root := range roots {
+			if err := walker.walk(root, &btrees[index]); err != nil {
+				return fmt.Errorf("failed to walk the b-tree of %s: %w", btrees[index].Name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return StorageStats{}, err
+	}
+
+	stats.SizeBytes = stats.Pages * stats.PageSize
+	for _, btree := range btrees {
+		stats.UnusedBytes += btree.UnusedBytes
+	}
+	stats.ReclaimableBytes = stats.FreelistPages*stats.PageSize + stats.UnusedBytes
+	slices.SortStableFunc(btrees, func(a, b BtreeStats) int { return cmp.Compare(b.SizeBytes, a.SizeBytes) })
+	stats.Btrees = btrees
+	return stats, nil
+}
+
+type btreeWalker struct {
+	file          vfs.File
+	pageSize      int64
+	usable        int64
+	pages         int64
+	freelistPages int64
+
+	visited  map[uint32]bool
+	previous uint32
+	gaps     int64
+}
+
+func newBtreeWalker(file vfs.File) (*btreeWalker, error) {
+	header := make([]byte, 100)
+	if _, err := file.ReadAt(header, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if string(header[:16]) != "SQLite format 3\x00" {
+		return nil, errors.New("not a SQLite database")
+	}
+
+	walker := &btreeWalker{file: file, visited: map[uint32]bool{}}
+	// NOTE: 1 stands for 65536, which doesn't fit the 2 bytes
+	walker.pageSize = int64(binary.BigEndian.Uint16(header[16:18]))
+	if walker.pageSize == 1 {
+		walker.pageSize = 65536
+	}
+	walker.usable = walker.pageSize - int64(header[20])
+	walker.freelistPages = int64(binary.BigEndian.Uint32(header[36:40]))
+
+	// NOTE: the size in the header is only valid when written by a version which keeps it, as the matching counters tell
+	walker.pages = int64(binary.BigEndian.Uint32(header[28:32]))
+	if walker.pages == 0 || binary.BigEndian.Uint32(header[24:28]) != binary.BigEndian.Uint32(header[92:96]) {
+		size, err := file.Size()
+		if err != nil {
+			return nil, err
+		}
+		walker.pages = size / walker.pageSize
+	}
+	return walker, nil
+}
+
+func (walker *btreeWalker) read(number uint32) ([]byte, error) {
+	if number == 0 || int64(number) > walker.pages {
+		return nil, fmt.Errorf("page %d out of the database", number)
+	}
+	if walker.visited[number] {
+		return nil, fmt.Errorf("page %d reached twice, the database is corrupt", number)
+	}
+	walker.visited[number] = true
+
+	page := make([]byte, walker.pageSize)
+	if _, err := walker.file.ReadAt(page, int64(number-1)*walker.pageSize); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return page, nil
+}
+
+// walk adds the pages of the b-tree under the root to the stats, in the order of its keys.
+func (walker *btreeWalker) walk(root uint32, btree *BtreeStats) error {
+	walker.previous, walker.gaps = 0, 0
+	if err := walker.walkPage(root, btree); err != nil {
+		return err
+	}
+	btree.SizeBytes = btree.Pages * walker.pageSize
+	if btree.Pages > 1 {
+		btree.FragmentationPercent = float64(walker.gaps) * 100 / float64(btree.Pages-1)
+	}
+	return nil
+}
+
+// visit accounts the page in the order of the walk.
+func (walker *btreeWalker) visit(number uint32) {
+	if walker.previous != 0 && number != walker.previous+1 {
+		walker.gaps++
+	}
+	walker.previous = number
+}
+
+func (walker *btreeWalker) walkPage(number uint32, btree *BtreeStats) error {
+	page, err := walker.read(number)
+	if err != nil {
+		return err
+	}
+	walker.visit(number)
+	btree.Pages++
+
+	offset := 0
+	if number == 1 {
+		offset = 100
+	}
+	pageType := page[offset]
+	interior := pageType == pageInteriorIndex || pageType == pageInteriorTable
+	if !interior && pageType != pageLeafIndex && pageType != pageLeafTable {
+		return fmt.Errorf("page %d isn't a b-tree page", number)
+	}
+	headerSize := 8
+	if interior {
+		headerSize = 12
+		btree.InteriorPages++
+	} else {
+		btree.LeafPages++
+	}
+
+	cells := int(binary.BigEndian.Uint16(page[offset+3:]))
+	contentStart := int(binary.BigEndian.Uint16(page[offset+5:]))
+	if contentStart == 0 {
+		contentStart = 65536
+	}
+	pointers := offset + headerSize
+	if pointers+2*cells > int(walker.usable) {
+		return fmt.Errorf("page %d holds more cells than it can", number)
+	}
+
+	// NOTE: the gap between the cell pointers and the cells, the free blocks among the cells and their fragments
+	unused := int64(contentStart-pointers-2*cells) + int64(page[offset+7])
+	for block, blocks := int(binary.BigEndian.Uint16(page[offset+1:])), 0; block != 0 && block+4 <= int(walker.usable) && blocks < cells+1; blocks++ {
+		unused += int64(binary.BigEndian.Uint16(page[block+2:]))
+		block = int(binary.BigEndian.Uint16(page[block:]))
+	}
+	btree.UnusedBytes += unused
+
+	for index := range cells {
+		cell := int(binary.BigEndian.Uint16(page[pointers+2*index:]))
+		if cell+4 > int(walker.usable) {
+			return fmt.Errorf("cell %d of page %d out of the page", index, number)
+		}
+		if interior {
+			if err := walker.walkPage(binary.BigEndian.Uint32(page[cell:]), btree); err != nil {
+				return err
+			}
+			cell += 4
+		} else {
+			btree.Cells++
+		}
+		// NOTE: the interior cells of a table only hold a rowid, no payload
+		if pageType == pageInteriorTable {
+			continue
+		}
+
+		payload, size := readVarint(page[cell:])
+		cell += size
+		if pageType == pageLeafTable {
+			_, size := readVarint(page[cell:])
+			cell += size
+		}
+		btree.PayloadBytes += int64(payload)
+
+		local := walker.localPayload(int64(payload), pageType == pageLeafTable)
+		if local < int64(payload) && cell+int(local)+4 <= int(walker.usable) {
+			if err := walker.walkOverflow(binary.BigEndian.Uint32(page[cell+int(local):]), int64(payload)-local, btree); err != nil {
+				return err
+			}
+		}
+	}
+
+	if interior {
+		return walker.walkPage(binary.BigEndian.Uint32(page[offset+8:]), btree)
+	}
+	return nil
+}
+
+// localPayload returns the bytes of a payload stored in its cell, the rest being spilled to overflow pages.
+func (walker *btreeWalker) localPayload(payload int64, tableLeaf bool) int64 {
+	maxLocal := (walker.usable-12)*64/255 - 23
+	if tableLeaf {
+		maxLocal = walker.usable - 35
+	}
+	if payload <= maxLocal {
+		return payload
+	}
+	minLocal := (walker.usable-12)*32/255 - 23
+	if local := minLocal + (payload-minLocal)%(walker.usable-4); local <= maxLocal {
+		return local
+	}
+	return minLocal
+}
+
+func (walker *btreeWalker) walkOverflow(number uint32, remaining int64, btree *BtreeStats) error {
+	for number != 0 && remaining > 0 {
+		page, err := walker.read(number)
+		if err != nil {
+			return err
+		}
+		walker.visit(number)
+		btree.Pages++
+		btree.OverflowPages++
+
+		stored := min(remaining, walker.usable-4)
+		btree.UnusedBytes += walker.usable - 4 - stored
+		remaining -= stored
+		number = binary.BigEndian.Uint32(page)
+	}
+	return nil
+}
+
+// readVarint decodes a SQLite varint, big-endian on 1 to 9 bytes, it returns the value and the bytes read.
+func readVarint(buffer []byte) (uint64, int) {
+	var value uint64
+	for index := 0; index < 8 && index < len(buffer); index++ {
+		value = value<<7 | uint64(buffer[index]&0x7f)
+		if buffer[index]&0x80 == 0 {
+			return value, index + 1
+		}
+	}
+	if len(buffer) < 9 {
+		return value, len(buffer)
+	}
+	return value<<8 | uint64(buffer[8]), 9
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ncruces/go-sqlite3"
+)
+
+// ErrorCode is a stable, machine readable identifier of a failure, surfaced to clients and in logs.
+type ErrorCode string
+
+const (
+	ErrorCodeNotFound           ErrorCode = "not_found"
+	ErrorCodeConflict           ErrorCode = "conflict"
+	ErrorCodeInvalidInput       ErrorCode = "invalid_input"
+	ErrorCodeUnauthorized       ErrorCode = "unauthorized"
+	ErrorCodeQuotaExceeded      ErrorCode = "quota_exceeded"
+	ErrorCodeStageUnavailable   ErrorCode = "stage_unavailable"
+	ErrorCodeSyncFailed         ErrorCode = "sync_failed"
+	ErrorCodeBusy               ErrorCode = "busy"
+	ErrorCodeQueryFailed        ErrorCode = "query_failed"
+	ErrorCodeReadOnly           ErrorCode = "read_only"
+	ErrorCodeForbidden          ErrorCode = "forbidden"
+	ErrorCodePreconditionFailed ErrorCode = "precondition_failed"
+	ErrorCodeTooLarge           ErrorCode = "too_large"
+	ErrorCodeCorrupted          ErrorCode = "corrupted"
+	ErrorCodeInternal           ErrorCode = "internal"
+)
+
+// HTTPStatus returns the status responses failing with the code are sent with.
+func (code ErrorCode) HTTPStatus() int {
+	switch code {
+	case ErrorCodeNotFound:
+		return http.StatusNotFound
+	case ErrorCodeConflict:
+		return http.StatusConflict
+	case ErrorCodeInvalidInput, ErrorCodeQueryFailed:
+		return http.StatusBadRequest
+	case ErrorCodeUnauthorized:
+		return http.StatusUnauthorized
+	case ErrorCodeReadOnly, ErrorCodeForbidden:
+		return http.StatusForbidden
+	case ErrorCodeQuotaExceeded:
+		return http.StatusInsufficientStorage
+	case ErrorCodeStageUnavailable:
+		return http.StatusServiceUnavailable
+	case ErrorCodeBusy:
+		return http.StatusTooManyRequests
+	case ErrorCodePreconditionFailed:
+		return http.StatusPreconditionFailed
+	case ErrorCodeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Error is an error carrying an ErrorCode, errors.Is matches two errors with the same code.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Err     error
+}
+
+func NewError(code ErrorCode, message string, err error) *Error {
+	return &Error{Code: code, Message: message, Err: err}
+}
+
+func (err *Error) Error() string {
+	if err.Err != nil {
+		return err.Message + ": " + err.Err.Error()
+	}
+	return err.Message
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+func (err *Error) Is(target error) bool {
+	var other *Error
+	return errors.As(target, &other) && other.Code == err.Code && other.Message == ""
+}
+
+// NOTE: sentinels for errors.Is, e.g. errors.Is(err, utils.ErrNotFound)
+var (
+	ErrNotFound         = &Error{Code: ErrorCodeNotFound}
+	ErrConflict         = &Error{Code: ErrorCodeConflict}
+	ErrQuotaExceeded    = &Error{Code: ErrorCodeQuotaExceeded}
+	ErrStageUnavailable = &Error{Code: ErrorCodeStageUnavailable}
+	ErrSyncFailed       = &Error{Code: ErrorCodeSyncFailed}
+	ErrBusy             = &Error{Code: ErrorCodeBusy}
+)
+
+// ErrorCodeOf classifies any error, SQLite result codes are mapped to the closest code.
+func ErrorCodeOf(err error) ErrorCode {
+	var codedError *Error
+	if errors.As(err, &codedError) {
+		return codedError.Code
+	}
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, sqlite3.FULL):
+		return ErrorCodeQuotaExceeded
+	case errors.Is(err, sqlite3.CORRUPT), errors.Is(err, sqlite3.IOERR_CORRUPTFS):
+		return ErrorCodeCorrupted
+	case errors.Is(err, sqlite3.BUSY), errors.Is(err, sqlite3.LOCKED):
+		return ErrorCodeBusy
+	case errors.Is(err, sqlite3.AUTH):
+		return ErrorCodeForbidden
+	case errors.Is(err, sqlite3.ERROR), errors.Is(err, sqlite3.CONSTRAINT), errors.Is(err, sqlite3.MISMATCH),
+		errors.Is(err, sqlite3.RANGE), errors.Is(err, sqlite3.TOOBIG), errors.Is(err, sqlite3.READONLY):
+		return ErrorCodeQueryFailed
+	default:
+		return ErrorCodeInternal
+	}
+}
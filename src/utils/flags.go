@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	ProfileDev     = "dev"
+	ProfileStaging = "staging"
+	ProfileProd    = "prod"
+)
+
+// NOTE: profile defaults only apply to variables left unset by the environment and the env file
+var profiles = map[string]map[string]string{
+	ProfileDev: {
+		"LOGGING_LEVEL":                    "debug",
+		"SETTINGS_STAGE_TIMEOUT_SECONDS":   "60",
+		"STORAGE_LOCAL_SYNC_MODE":          "none",
+		"SECRETS_REFRESH_INTERVAL_SECONDS": "0",
+	},
+	ProfileStaging: {
+		"LOGGING_LEVEL":           "info",
+		"STORAGE_LOCAL_SYNC_MODE": "dataonly",
+	},
+	ProfileProd: {
+		"LOGGING_LEVEL":               "info",
+		"STORAGE_LOCAL_SYNC_MODE":     "full",
+		"STORAGE_LOCAL_WATCH_ENABLED": "true",
+	},
+}
+
+var activeProfile string
+
+// ActiveProfile returns the configuration profile in use, empty when none was selected.
+func ActiveProfile() string {
+	return activeProfile
+}
+
+// Flags holds the command-line options, they override the environment and the env file.
+type Flags struct {
+	ConfigPath       string
+	Profile          string
+	Port             int
+	LogLevel         LogLevel
+	StorageDirectory string
+
+	set map[string]bool
+}
+
+func parseFlags(arguments []string) (*Flags, error) {
+	flags := &Flags{set: make(map[string]bool)}
+
+	flagSet := flag.NewFlagSet("persisto", flag.ContinueOnError)
+	flagSet.StringVar(&flags.ConfigPath, "config", ".env", "path of the env file to load")
+	flagSet.StringVar(&flags.Profile, "profile", os.Getenv("PROFILE"), fmt.Sprintf("configuration profile (%s)", strings.Join(profileNames(), ", ")))
+	flagSet.IntVar(&flags.Port, "port", 0, "port the server listens on")
+	flagSet.Func("log-level", "log level (debug, info, warn, error)", func(value string) error {
+		return flags.LogLevel.Set([]byte(value))
+	})
+	flagSet.StringVar(&flags.StorageDirectory, "storage-dir", "", "local storage directory")
+
+	if err := flagSet.Parse(arguments); err != nil {
+		return nil, err
+	}
+	flagSet.Visit(func(f *flag.Flag) {
+		flags.set[f.Name] = true
+	})
+
+	if flags.Profile != "" {
+		if _, exists := profiles[flags.Profile]; !exists {
+			return nil, fmt.Errorf("unknown profile %q, valid profiles are %s", flags.Profile, strings.Join(profileNames(), ", "))
+		}
+	}
+
+	return flags, nil
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile sets the profile defaults of the variables not already set and returns their names.
+func (flags *Flags) applyProfile() map[string]bool {
+	applied := make(map[string]bool)
+	for name, value := range profiles[flags.Profile] {
+		if _, exists := os.LookupEnv(name); !exists {
+			os.Setenv(name, value)
+			applied[name] = true
+		}
+	}
+	return applied
+}
+
+// NOTE: environment variables replaced by each flag
+var flagVariables = map[string]string{
+	"port":        "SERVER_PORT",
+	"log-level":   "LOGGING_LEVEL",
+	"storage-dir": "STORAGE_LOCAL_DIRECTORY_PATH",
+}
+
+func (flags *Flags) overriddenVariables() map[string]bool {
+	overridden := make(map[string]bool)
+	for name := range flags.set {
+		if variable, exists := flagVariables[name]; exists {
+			overridden[variable] = true
+		}
+	}
+	return overridden
+}
+
+// applyOverrides replaces the configuration values given on the command line.
+func (flags *Flags) applyOverrides(cfg *Configuration) {
+	if flags.set["port"] {
+		cfg.Server.Port = flags.Port
+	}
+	if flags.set["log-level"] {
+		cfg.Logging.Level = flags.LogLevel
+	}
+	if flags.set["storage-dir"] {
+		cfg.Storage.Local.DirectoryPath = flags.StorageDirectory
+	}
+}
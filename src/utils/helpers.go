@@ -1,29 +1,110 @@
 package utils
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"strings"
 
+	"github.com/ncruces/go-sqlite3/driver"
 	"go.uber.org/zap"
 )
 
 type QueryResultType []map[string]interface{}
 type ExecResultType map[string]interface{}
 
-func QueryResultToMaps(rows *sql.Rows) (QueryResultType, error) {
+// SQLite storage classes reported in the column metadata, mixed when a column holds values of several classes.
+const (
+	ColumnTypeInteger = "integer"
+	ColumnTypeReal    = "real"
+	ColumnTypeText    = "text"
+	ColumnTypeBlob    = "blob"
+	ColumnTypeNull    = "null"
+	ColumnTypeMixed   = "mixed"
+)
+
+type QueryColumn struct {
+	Name         string `json:"name"`
+	DeclaredType string `json:"declaredType,omitempty"`
+	Type         string `json:"type"`
+}
+
+// ValueMask replaces a value of a result column before it is returned, e.g. to hide sensitive data.
+type ValueMask func(value any) any
+
+// QueryResultToMaps converts rows keeping their SQLite types: integers stay int64, NULL stays nil and blobs stay []byte
+// (base64 in JSON), only text is returned as a string.
+func QueryResultToMaps(rows *sql.Rows) (QueryResultType, []QueryColumn, error) {
+	output, columns, _, err := QueryResultToMapsMasked(rows, nil, ResultWindow{})
+	return output, columns, err
+}
+
+// ResultWindow bounds the rows read from a result, the zero value reads all of them.
+type ResultWindow struct {
+	// NOTE: rows skipped, returned by the previous pages of the result
+	Offset int
+	// NOTE: the rows past the page are left for the next one, a page holds at least one row however large it is
+	PageRows  int
+	PageBytes int
+	// NOTE: results holding more rows, the skipped ones included, are refused
+	MaxRows int
+	// NOTE: the status counters of the query are collected into it when set, see CollectStats
+	Stats *QueryStats
+	// NOTE: the values of the rows returned are collected into it in the order of the columns when set, the rows
+	// themselves are keyed by the names of the columns, which the columns of a join may share
+	Values *[][]any
+}
+
+// QueryResultToMapsMasked converts the rows of the window like QueryResultToMaps, passing the values of every column
+// with a mask through it. masks is indexed by column, nil masks and missing entries leave the values as they are. It
+// reports whether rows were left past the page, and stops with a forbidden error once the result holds more than the
+// maximum rows of the window.
+func QueryResultToMapsMasked(rows *sql.Rows, masks []ValueMask, window ResultWindow) (QueryResultType, []QueryColumn, bool, error) {
 	defer rows.Close()
 
-	cols, err := rows.Columns()
+	columnTypes, err := rows.ColumnTypes()
 	if err != nil {
-		return nil, err
+		return nil, nil, false, err
+	}
+
+	columns := make([]QueryColumn, len(columnTypes))
+	for i, columnType := range columnTypes {
+		columns[i] = QueryColumn{
+			Name:         columnType.Name(),
+			DeclaredType: columnType.DatabaseTypeName(),
+			Type:         ColumnTypeNull,
+		}
 	}
 
 	var results QueryResultType
+	var position, size int
+	if window.Values != nil {
+		*window.Values = nil
+	}
+	// NOTE: the rows are accounted while the result is read, the response holding it is written right after
+	var reserved int64
+	defer func() { ReleaseMemory(MemoryQueryResults, reserved) }()
 
 	for rows.Next() {
-		values := make([]interface{}, len(cols))
-		valuePtrs := make([]interface{}, len(cols))
+		if window.MaxRows > 0 && position == window.MaxRows {
+			return nil, nil, false, NewError(ErrorCodeForbidden, fmt.Sprintf("the query returns more than the %d rows allowed", window.MaxRows), nil)
+		}
+		position++
+		if position <= window.Offset {
+			continue
+		}
+		if window.PageRows > 0 && len(results) == window.PageRows {
+			return results, columns, true, rows.Err()
+		}
+
+		values := make([]interface{}, len(columns))
+		valuePtrs := make([]interface{}, len(columns))
 
 		for i := range values {
 			valuePtrs[i] = &values[i]
@@ -31,28 +112,205 @@ func QueryResultToMaps(rows *sql.Rows) (QueryResultType, error) {
 
 		err := rows.Scan(valuePtrs...)
 		if err != nil {
-			return nil, err
+			return nil, nil, false, err
 		}
 
 		rowMap := make(map[string]interface{})
-		for i, col := range cols {
+		for i, column := range columns {
 			val := values[i]
+			if i < len(masks) && masks[i] != nil {
+				val = masks[i](val)
+				values[i] = val
+			}
 
-			if b, ok := val.([]byte); ok {
-				rowMap[col] = string(b)
-			} else if intVal, ok := val.(int64); ok {
-				rowMap[col] = float64(intVal)
-			} else {
-				rowMap[col] = val
+			valueType := storageClassOf(val)
+			if column.Type == ColumnTypeNull {
+				columns[i].Type = valueType
+			} else if valueType != ColumnTypeNull && valueType != column.Type {
+				columns[i].Type = ColumnTypeMixed
+			}
+
+			rowMap[column.Name] = val
+		}
+
+		if window.PageBytes > 0 {
+			// NOTE: measured as serialized in the responses
+			encoded, err := json.Marshal(rowMap)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			if size += len(encoded); size > window.PageBytes && len(results) > 0 {
+				return results, columns, true, rows.Err()
+			}
+			if err := ReserveResultMemory(int64(len(encoded)), reserved); err != nil {
+				return nil, nil, false, err
 			}
+			reserved += int64(len(encoded))
 		}
 
 		results = append(results, rowMap)
+		if window.Values != nil {
+			*window.Values = append(*window.Values, values)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, false, err
 	}
 
+	return results, columns, false, nil
+}
+
+// EachRow passes the rows to fn one at a time as they are read, their values in the order of the columns and passed
+// through the masks like QueryResultToMapsMasked, so that a result of any size is processed without being held in
+// memory. The columns carry their names and declared types, the values slice is reused for the next row. It stops at
+// the first error of fn, and with a forbidden error once the result holds more than maxRows rows (0 for unlimited). It
+// returns the rows passed to fn.
+func EachRow(rows *sql.Rows, masks []ValueMask, maxRows int, fn func(columns []QueryColumn, values []any) error) (int, error) {
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+	columns := make([]QueryColumn, len(columnTypes))
+	for i, columnType := range columnTypes {
+		columns[i] = QueryColumn{Name: columnType.Name(), DeclaredType: columnType.DatabaseTypeName()}
+	}
+
+	values := make([]any, len(columns))
+	valuePtrs := make([]any, len(columns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+
+	count := 0
+	for rows.Next() {
+		if maxRows > 0 && count == maxRows {
+			return count, NewError(ErrorCodeForbidden, fmt.Sprintf("the query returns more than the %d rows allowed", maxRows), nil)
+		}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return count, err
+		}
+		for i := range values {
+			if i < len(masks) && masks[i] != nil {
+				values[i] = masks[i](values[i])
+			}
+		}
+		count++
+		if err := fn(columns, values); err != nil {
+			return count, err
+		}
+	}
+	return count, rows.Err()
+}
+
+// SnapshotResult is the result of one query of a batch read by ReadSnapshot.
+type SnapshotResult struct {
+	Rows      QueryResultType
+	Columns   []QueryColumn
+	Truncated bool
+	Err       error
+}
+
+// ReadSnapshot runs the queries one after the other in a single read transaction of the connection, so that all of them
+// see the database as it was when the first one read it. A failing query is reported in its result without failing the
+// others. masks returns the masks of the values of a query, maxRows is the hard limit of the statement policy.
+func ReadSnapshot(ctx context.Context, conn *sql.Conn, masks func(query string) ([]ValueMask, error), maxRows int, windows []ResultWindow, queries []string, parameters [][]any) ([]SnapshotResult, error) {
+	if _, err := conn.ExecContext(ctx, "BEGIN DEFERRED"); err != nil {
+		return nil, err
+	}
+
+	results := make([]SnapshotResult, len(queries))
+	for index, query := range queries {
+		// NOTE: a query ending the transaction itself would let the next ones read another snapshot
+		if autocommit(conn) {
+			results[index].Err = NewError(ErrorCodeInvalidInput, "a previous query of the batch ended its transaction", nil)
+			continue
+		}
+
+		queryMasks, err := masks(query)
+		if err != nil {
+			results[index].Err = err
+			continue
+		}
+
+		var queryParameters []any
+		if index < len(parameters) {
+			queryParameters = parameters[index]
+		}
+		window := windows[index]
+		finish := CollectStats(conn, window.Stats)
+		rows, err := conn.QueryContext(ctx, query, queryParameters...)
+		if err != nil {
+			finish()
+			results[index].Err = err
+			continue
+		}
+
+		window.MaxRows = maxRows
+		result := &results[index]
+		result.Rows, result.Columns, result.Truncated, result.Err = QueryResultToMapsMasked(rows, queryMasks, window)
+		finish()
+	}
+
+	if !autocommit(conn) {
+		if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+			return nil, err
+		}
+	}
 	return results, nil
 }
 
+// autocommit reports whether the connection is outside of any transaction.
+func autocommit(conn *sql.Conn) bool {
+	outside := true
+	conn.Raw(func(driverConn any) error {
+		outside = driverConn.(driver.Conn).Raw().GetAutocommit()
+		return nil
+	})
+	return outside
+}
+
+func storageClassOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return ColumnTypeNull
+	case int64:
+		return ColumnTypeInteger
+	case float64:
+		return ColumnTypeReal
+	case []byte:
+		return ColumnTypeBlob
+	default:
+		// NOTE: strings and times parsed from text columns
+		return ColumnTypeText
+	}
+}
+
+// ValueTypes returns the storage class of every value of the rows, given in the order of the columns, see
+// ResultWindow.Values. It returns nil when no column is mixed, the type of every column then tells the class of its
+// values.
+func ValueTypes(rows [][]any, columns []QueryColumn) [][]string {
+	mixed := false
+	for _, column := range columns {
+		mixed = mixed || column.Type == ColumnTypeMixed
+	}
+	if !mixed {
+		return nil
+	}
+
+	types := make([][]string, len(rows))
+	for index, row := range rows {
+		types[index] = make([]string, len(columns))
+		for position := range columns {
+			types[index][position] = storageClassOf(row[position])
+		}
+	}
+	return types
+}
+
 func ExecResultToMap(result sql.Result) (ExecResultType, error) {
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
@@ -70,6 +328,44 @@ func ExecResultToMap(result sql.Result) (ExecResultType, error) {
 	}, nil
 }
 
+// BlobParameterKey is the key of the object wrapping the base64 content of a blob query parameter, JSON having no
+// binary type.
+const BlobParameterKey = "base64"
+
+// QueryParameters converts the parameters of a query decoded from JSON to the values bound to its placeholders:
+// integral numbers are bound as integers and {"base64": "..."} objects as blobs.
+func QueryParameters(parameters []any) ([]any, error) {
+	values := make([]any, len(parameters))
+
+	for index, parameter := range parameters {
+		switch parameter := parameter.(type) {
+		case nil, bool, string:
+			values[index] = parameter
+		case float64:
+			// NOTE: JSON numbers decode as floats, binding 1 as 1.0 would store it as a REAL in TEXT and untyped columns
+			if parameter == math.Trunc(parameter) && math.Abs(parameter) < 1<<53 {
+				values[index] = int64(parameter)
+			} else {
+				values[index] = parameter
+			}
+		case map[string]any:
+			encoded, isString := parameter[BlobParameterKey].(string)
+			if !isString || len(parameter) != 1 {
+				return nil, NewError(ErrorCodeInvalidInput, fmt.Sprintf("parameter %d: objects must only hold a %q string", index+1, BlobParameterKey), nil)
+			}
+			blob, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, NewError(ErrorCodeInvalidInput, fmt.Sprintf("parameter %d: invalid base64 blob", index+1), err)
+			}
+			values[index] = blob
+		default:
+			return nil, NewError(ErrorCodeInvalidInput, fmt.Sprintf("parameter %d: unsupported type %T", index+1, parameter), nil)
+		}
+	}
+
+	return values, nil
+}
+
 func IsWriteOperation(query string) bool {
 	query = strings.ToUpper(strings.TrimSpace(query))
 	writeOperations := []string{"INSERT", "UPDATE", "DELETE", "CREATE", "DROP", "ALTER"}
@@ -116,3 +412,111 @@ func VerifyDatabaseIntegrity(connectionString string) error {
 
 	return nil
 }
+
+// DatabaseChecksum returns a digest of the schema and rows of the database, read in a single transaction. It only
+// depends on the content, not on the page layout, so copies made with VACUUM INTO have the same checksum as their
+// source.
+func DatabaseChecksum(connectionString string) (string, error) {
+	db, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return "", fmt.Errorf("failed to open database for checksum: %v", err)
+	}
+	defer db.Close()
+
+	transaction, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer transaction.Rollback()
+
+	hash := sha256.New()
+
+	schema, err := transaction.Query("SELECT type, name, tbl_name, COALESCE(sql, '') FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' ORDER BY type, name")
+	if err != nil {
+		return "", fmt.Errorf("failed to read schema: %v", err)
+	}
+	var tables []string
+	for schema.Next() {
+		var objectType, name, tableName, definition string
+		if err := schema.Scan(&objectType, &name, &tableName, &definition); err != nil {
+			schema.Close()
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s\x00", objectType, name, tableName, definition)
+		// NOTE: virtual tables are skipped, their content lives in shadow tables which are hashed on their own
+		if objectType == "table" && !strings.HasPrefix(strings.ToUpper(definition), "CREATE VIRTUAL TABLE") {
+			tables = append(tables, name)
+		}
+	}
+	schema.Close()
+	if err := schema.Err(); err != nil {
+		return "", err
+	}
+
+	for _, table := range tables {
+		if err := hashTableRows(hash, transaction, table); err != nil {
+			return "", fmt.Errorf("failed to read table %s: %v", table, err)
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// QuoteIdentifier quotes a table or column name so that it can be used in a statement.
+func QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func hashTableRows(hash io.Writer, transaction *sql.Tx, table string) error {
+	quoted := QuoteIdentifier(table)
+
+	columns, err := transaction.Query("SELECT * FROM " + quoted + " LIMIT 0")
+	if err != nil {
+		return err
+	}
+	names, err := columns.Columns()
+	columns.Close()
+	if err != nil {
+		return err
+	}
+
+	// NOTE: rows are ordered by all their columns rather than rowid, VACUUM may renumber the rowids
+	order := make([]string, len(names))
+	for i := range names {
+		order[i] = fmt.Sprint(i + 1)
+	}
+
+	rows, err := transaction.Query("SELECT * FROM " + quoted + " ORDER BY " + strings.Join(order, ", "))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	fmt.Fprintf(hash, "table\x00%s\x00", table)
+	values := make([]any, len(names))
+	pointers := make([]any, len(names))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		for _, value := range values {
+			HashValue(hash, value)
+		}
+	}
+	return rows.Err()
+}
+
+// HashValue writes the value as scanned from a row to the digest, along with its storage class so that 1 and '1' differ.
+func HashValue(hash io.Writer, value any) {
+	switch value := value.(type) {
+	case []byte:
+		fmt.Fprintf(hash, "%s:%d:", storageClassOf(value), len(value))
+		hash.Write(value)
+	default:
+		fmt.Fprintf(hash, "%s:%v", storageClassOf(value), value)
+	}
+	hash.Write([]byte{0})
+}
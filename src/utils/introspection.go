@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"os"
+	"reflect"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+type ConfigurationSource string
+
+const (
+	ConfigurationSourceDefault ConfigurationSource = "default"
+	ConfigurationSourceProfile ConfigurationSource = "profile"
+	ConfigurationSourceFile    ConfigurationSource = "file"
+	ConfigurationSourceEnv     ConfigurationSource = "env"
+	ConfigurationSourceFlag    ConfigurationSource = "flag"
+)
+
+// ConfigurationEntry is one effective configuration value and where it came from, secrets are redacted.
+type ConfigurationEntry struct {
+	Variable  string              `json:"variable,omitempty"`
+	Field     string              `json:"field"`
+	Value     any                 `json:"value"`
+	Source    ConfigurationSource `json:"source"`
+	SecretRef string              `json:"secretRef,omitempty" doc:"Reference the value was resolved from"`
+}
+
+// NOTE: recorded while loading the configuration, by order of precedence
+type configurationOrigins struct {
+	flags       map[string]bool
+	environment map[string]bool
+	file        map[string]bool
+	profile     map[string]bool
+}
+
+var origins = configurationOrigins{}
+
+func environmentNames() map[string]bool {
+	names := make(map[string]bool)
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		names[name] = true
+	}
+	return names
+}
+
+func (origins *configurationOrigins) sourceOf(variable string) ConfigurationSource {
+	switch {
+	case variable == "":
+		return ConfigurationSourceDefault
+	case origins.flags[variable]:
+		return ConfigurationSourceFlag
+	case origins.environment[variable]:
+		return ConfigurationSourceEnv
+	case origins.file[variable]:
+		return ConfigurationSourceFile
+	case origins.profile[variable]:
+		return ConfigurationSourceProfile
+	default:
+		return ConfigurationSourceDefault
+	}
+}
+
+// EffectiveConfiguration returns every configuration value in effect with its source.
+func EffectiveConfiguration() []ConfigurationEntry {
+	references := make(map[string]string)
+	for _, reference := range secretReferences {
+		// NOTE: list entries resolved from distinct references are reported together
+		key := fieldPath(reflect.TypeOf(*Config), reference.field)
+		if existing, exists := references[key]; exists {
+			references[key] = existing + "," + reference.reference
+		} else {
+			references[key] = reference.reference
+		}
+	}
+
+	var entries []ConfigurationEntry
+	collectConfigurationEntries(reflect.ValueOf(Config).Elem(), "", "", references, &entries)
+	return entries
+}
+
+func collectConfigurationEntries(value reflect.Value, namespace, prefix string, references map[string]string, entries *[]ConfigurationEntry) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		fieldValue := value.Field(i)
+
+		path := field.Name
+		if namespace != "" {
+			path = namespace + "." + field.Name
+		}
+
+		if fieldValue.Kind() == reflect.Struct {
+			collectConfigurationEntries(fieldValue, path, prefix+field.Tag.Get("envPrefix"), references, entries)
+			continue
+		}
+
+		variable := ""
+		if name := field.Tag.Get("env"); name != "" {
+			variable = prefix + name
+		}
+
+		var entryValue any = fieldValue.Interface()
+		if level, ok := entryValue.(LogLevel); ok {
+			entryValue = zapcore.Level(level).String()
+		}
+
+		*entries = append(*entries, ConfigurationEntry{
+			Variable:  variable,
+			Field:     path,
+			Value:     entryValue,
+			Source:    origins.sourceOf(variable),
+			SecretRef: references[path],
+		})
+	}
+}
+
+func fieldPath(t reflect.Type, index []int) string {
+	names := make([]string, 0, len(index))
+	for _, i := range index {
+		field := t.Field(i)
+		names = append(names, field.Name)
+		t = field.Type
+	}
+	return strings.Join(names, ".")
+}
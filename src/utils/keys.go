@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// NOTE: master keys are only used to derive per purpose keys, never to encrypt data directly
+const minEncryptionKeyLength = 32
+
+type EncryptionKey struct {
+	ID       string
+	Material []byte
+}
+
+var (
+	encryptionKeysMtx   sync.Mutex
+	encryptionKeys      map[string]EncryptionKey
+	activeEncryptionKey string
+	encryptionKeysError error
+
+	encryptionKeysSetupOnce sync.Once
+)
+
+func setupEncryptionKeys() {
+	encryptionKeysSetupOnce.Do(func() {
+		loadEncryptionKeys()
+		// NOTE: keys may come from a secret manager, rotated keys replace the current ones
+		OnSecretsRotated(loadEncryptionKeys)
+	})
+}
+
+func loadEncryptionKeys() {
+	keys := make(map[string]EncryptionKey)
+	active := ""
+
+	err := func() error {
+		for _, entry := range Config.Encryption.Keys {
+			id, material, found := strings.Cut(strings.TrimSpace(entry.Value()), ":")
+			if !found || id == "" {
+				return fmt.Errorf("invalid encryption key entry, expected <id>:<hex key>")
+			}
+
+			decoded, err := hex.DecodeString(material)
+			if err != nil {
+				return fmt.Errorf("invalid encryption key %s: %w", id, err)
+			}
+			if len(decoded) < minEncryptionKeyLength {
+				return fmt.Errorf("encryption key %s must be at least %d bytes", id, minEncryptionKeyLength)
+			}
+			if _, exists := keys[id]; exists {
+				return fmt.Errorf("duplicate encryption key %s", id)
+			}
+
+			keys[id] = EncryptionKey{ID: id, Material: decoded}
+			if active == "" {
+				active = id
+			}
+		}
+		return nil
+	}()
+
+	if Config.Encryption.ActiveKeyID != "" {
+		active = Config.Encryption.ActiveKeyID
+	}
+
+	encryptionKeysMtx.Lock()
+	defer encryptionKeysMtx.Unlock()
+
+	encryptionKeys, activeEncryptionKey, encryptionKeysError = keys, active, err
+}
+
+// GetEncryptionKey returns the configured master key with the given ID, keys retired from active use remain available
+// so data encrypted with them can still be read.
+func GetEncryptionKey(id string) (EncryptionKey, error) {
+	setupEncryptionKeys()
+
+	encryptionKeysMtx.Lock()
+	defer encryptionKeysMtx.Unlock()
+
+	if encryptionKeysError != nil {
+		return EncryptionKey{}, encryptionKeysError
+	}
+
+	key, exists := encryptionKeys[id]
+	if !exists {
+		return EncryptionKey{}, fmt.Errorf("encryption key %s not found", id)
+	}
+	return key, nil
+}
+
+// GetActiveEncryptionKey returns the master key new data should be encrypted with, the first configured key unless an
+// active key ID is set.
+func GetActiveEncryptionKey() (EncryptionKey, error) {
+	setupEncryptionKeys()
+
+	encryptionKeysMtx.Lock()
+	active := activeEncryptionKey
+	encryptionKeysMtx.Unlock()
+
+	if active == "" {
+		return EncryptionKey{}, fmt.Errorf("no encryption key configured")
+	}
+	return GetEncryptionKey(active)
+}
+
+// DeriveEncryptionKey derives a key of the given length dedicated to one purpose (e.g. a stage) from a master key.
+func DeriveEncryptionKey(key EncryptionKey, purpose string, length int) ([]byte, error) {
+	return hkdf.Key(sha256.New, key.Material, nil, "persisto/"+purpose, length)
+}
@@ -1,17 +1,38 @@
 package utils
 
 import (
+	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// NOTE: subsystems have their own level so e.g. the VFS can be debugged without the rest of the logs
+const (
+	SubsystemVFS    = "vfs"
+	SubsystemStages = "stages"
+	SubsystemHTTP   = "http"
+	SubsystemPgwire = "pgwire"
+)
+
+var Subsystems = []string{SubsystemVFS, SubsystemStages, SubsystemHTTP, SubsystemPgwire}
+
 var (
-	Logger           *zap.Logger
+	Logger       *zap.Logger
+	VFSLogger    *zap.Logger
+	StagesLogger *zap.Logger
+	HTTPLogger   *zap.Logger
+	PgwireLogger *zap.Logger
+	// NOTE: for the logs written on every read, write or open, identical messages are sampled
+	VFSSampledLogger *zap.Logger
 	LoggerSetupError error
 
+	logLevel          zap.AtomicLevel
+	subsystemLogLevel map[string]zap.AtomicLevel
+
 	loggerSetupOnce sync.Once
 )
 
@@ -37,13 +58,75 @@ func SetupLogger(level zapcore.Level) (*zap.Logger, error) {
 		consoleOutput := zapcore.Lock(os.Stdout)
 		fileOutput := zapcore.AddSync(logFile)
 
-		core := zapcore.NewTee(
-			zapcore.NewCore(consoleEncoder, consoleOutput, level),
-			zapcore.NewCore(fileEncoder, fileOutput, level),
-		)
+		if Config != nil {
+			if err := setupErrorReporter(); err != nil {
+				LoggerSetupError = err
+				return
+			}
+		}
+
+		newLogger := func(level zap.AtomicLevel) *zap.Logger {
+			core := zapcore.NewTee(
+				zapcore.NewCore(consoleEncoder, consoleOutput, level),
+				zapcore.NewCore(fileEncoder, fileOutput, level),
+				newReportingCore(),
+			)
+			return zap.New(core, zap.AddCaller(), zap.AddCallerSkip(1))
+		}
+
+		logLevel = zap.NewAtomicLevelAt(level)
+		Logger = newLogger(logLevel)
+
+		subsystemLogLevel = make(map[string]zap.AtomicLevel)
+		subsystemLoggers := make(map[string]*zap.Logger)
+		for _, subsystem := range Subsystems {
+			subsystemLogLevel[subsystem] = zap.NewAtomicLevelAt(level)
+			subsystemLoggers[subsystem] = newLogger(subsystemLogLevel[subsystem]).With(zap.String("subsystem", subsystem))
+		}
+		VFSLogger = subsystemLoggers[SubsystemVFS]
+		StagesLogger = subsystemLoggers[SubsystemStages]
+		HTTPLogger = subsystemLoggers[SubsystemHTTP]
+		PgwireLogger = subsystemLoggers[SubsystemPgwire]
 
-		Logger = zap.New(core, zap.AddCaller(), zap.AddCallerSkip(1))
+		VFSSampledLogger = VFSLogger
+		if Config != nil && Config.Logging.SamplingInitial > 0 {
+			VFSSampledLogger = VFSLogger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+				return zapcore.NewSamplerWithOptions(core, time.Second, Config.Logging.SamplingInitial, Config.Logging.SamplingThereafter)
+			}))
+		}
 	})
 
 	return Logger, LoggerSetupError
 }
+
+// SetLogLevel changes the level of a subsystem at runtime, an empty subsystem changes every level.
+func SetLogLevel(subsystem string, level zapcore.Level) error {
+	if subsystem == "" {
+		logLevel.SetLevel(level)
+		for _, subsystemLevel := range subsystemLogLevel {
+			subsystemLevel.SetLevel(level)
+		}
+		return nil
+	}
+
+	subsystemLevel, exists := subsystemLogLevel[subsystem]
+	if !exists {
+		return fmt.Errorf("unknown subsystem %q", subsystem)
+	}
+	subsystemLevel.SetLevel(level)
+	return nil
+}
+
+// LogLevels returns the current level of every subsystem, the default level is keyed by an empty subsystem.
+func LogLevels() map[string]zapcore.Level {
+	levels := map[string]zapcore.Level{"": logLevel.Level()}
+	for subsystem, subsystemLevel := range subsystemLogLevel {
+		levels[subsystem] = subsystemLevel.Level()
+	}
+	return levels
+}
+
+// ResetLogLevels restores the configured level everywhere.
+func ResetLogLevels() {
+	SetLogLevel("", zapcore.Level(Config.Logging.Level))
+}
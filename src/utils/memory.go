@@ -0,0 +1,221 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: the buffers growing with the load share the heap, the accountant bounds them by the memory limit of the Go
+// runtime: MEMORY_LIMIT_BYTES, or GOMEMLIMIT when unset. The sector caches of the open remote files and the query
+// results being read each get a share of the limit, and once the memory of the process goes past MEMORY_SHED_PERCENT
+// of it the caches are shed and the results refused until it is back under. Without a limit nothing is bounded beyond
+// the bounds of every buffer.
+
+// MemoryKind is a buffer accounted by the accountant.
+type MemoryKind string
+
+const (
+	MemorySectorCache  MemoryKind = "sector_cache"
+	MemoryQueryResults MemoryKind = "query_results"
+)
+
+// MemoryStats is the memory accounted against the limit of the Go runtime.
+type MemoryStats struct {
+	LimitBytes    int64        `json:"limit_bytes" doc:"Memory limit of the Go runtime, 0 when unlimited."`
+	UsedBytes     int64        `json:"used_bytes" doc:"Memory of the Go runtime, as weighed against the limit."`
+	UnderPressure bool         `json:"under_pressure" doc:"Whether the memory is past MEMORY_SHED_PERCENT of the limit."`
+	SectorCache   MemoryBudget `json:"sector_cache"`
+	QueryResults  MemoryBudget `json:"query_results"`
+	// NOTE: counted since the start
+	Sheds     int64 `json:"sheds" doc:"Times the caches were shed as the memory went past MEMORY_SHED_PERCENT of the limit."`
+	ShedBytes int64 `json:"shed_bytes" doc:"Bytes freed by shedding the caches."`
+	Rejected  int64 `json:"rejected" doc:"Query results refused for lack of memory."`
+}
+
+// MemoryBudget is the memory a kind of buffer holds and may hold.
+type MemoryBudget struct {
+	UsedBytes int64 `json:"used_bytes"`
+	MaxBytes  int64 `json:"max_bytes" doc:"Share of the limit the buffers may hold, 0 when unlimited."`
+}
+
+type memoryAccountant struct {
+	mtx sync.Mutex
+
+	limit    int64
+	used     map[MemoryKind]int64
+	pressure bool
+
+	sheds     int64
+	shedBytes int64
+	rejected  int64
+
+	shedders []func(excess int64) int64
+}
+
+var accountant = &memoryAccountant{used: map[MemoryKind]int64{}}
+
+// SetupMemory sets the memory limit of the Go runtime and watches the memory of the process against it.
+func SetupMemory() {
+	if Config.Memory.LimitBytes > 0 {
+		debug.SetMemoryLimit(Config.Memory.LimitBytes)
+	}
+	// NOTE: a negative input only reads the limit, math.MaxInt64 when neither GOMEMLIMIT nor the setting set it
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		Logger.Info("No memory limit, the memory accountant only reports the buffers.")
+		return
+	}
+
+	accountant.mtx.Lock()
+	accountant.limit = limit
+	accountant.mtx.Unlock()
+
+	go func() {
+		Logger.Info("Starting memory accountant.", zap.Int64("limitBytes", limit))
+
+		ticker := time.NewTicker(time.Duration(Config.Memory.CheckIntervalMilliseconds) * time.Millisecond)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			accountant.check()
+		}
+	}()
+}
+
+// memoryUsed returns the memory mapped by the Go runtime less the one released to the operating system, what the memory
+// limit bounds.
+func memoryUsed() int64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/total:bytes"}, {Name: "/memory/classes/heap/released:bytes"}}
+	metrics.Read(sample)
+	return int64(sample[0].Value.Uint64() - sample[1].Value.Uint64())
+}
+
+// NOTE: mtx must be held
+func (accountant *memoryAccountant) budget(kind MemoryKind) int64 {
+	if accountant.limit == 0 {
+		return 0
+	}
+	switch kind {
+	case MemorySectorCache:
+		return accountant.limit * int64(Config.Memory.CachePercent) / 100
+	case MemoryQueryResults:
+		return accountant.limit * int64(Config.Memory.ResultsPercent) / 100
+	}
+	return 0
+}
+
+// check sheds the caches while the memory of the process is past the shed threshold of the limit.
+func (accountant *memoryAccountant) check() {
+	threshold := accountant.limit * int64(Config.Memory.ShedPercent) / 100
+	used := memoryUsed()
+
+	accountant.mtx.Lock()
+	wasUnderPressure := accountant.pressure
+	accountant.pressure = used > threshold
+	shedders := accountant.shedders
+	accountant.mtx.Unlock()
+
+	if used <= threshold {
+		if wasUnderPressure {
+			Logger.Info("Memory back under the shed threshold.", zap.Int64("usedBytes", used), zap.Int64("thresholdBytes", threshold))
+		}
+		return
+	}
+
+	excess, freed := used-threshold, int64(0)
+	for _, shed := range shedders {
+		if freed >= excess {
+			break
+		}
+		freed += shed(excess - freed)
+	}
+
+	accountant.mtx.Lock()
+	accountant.sheds++
+	accountant.shedBytes += freed
+	accountant.mtx.Unlock()
+
+	Logger.Warn("Memory past the shed threshold, shedding caches.", zap.Int64("usedBytes", used), zap.Int64("thresholdBytes", threshold), zap.Int64("freedBytes", freed))
+	// NOTE: the memory freed only goes back to the limit once collected
+	if freed > 0 {
+		debug.FreeOSMemory()
+	}
+}
+
+// OnMemoryPressure registers a shedder called with the bytes to free once the memory of the process goes past the shed
+// threshold, it returns the bytes it freed.
+func OnMemoryPressure(shed func(excess int64) int64) {
+	accountant.mtx.Lock()
+	defer accountant.mtx.Unlock()
+
+	accountant.shedders = append(accountant.shedders, shed)
+}
+
+// ReserveMemory accounts the bytes to the buffers of the kind when they fit in their share of the limit and the memory
+// isn't past the shed threshold, it reports whether they were.
+func ReserveMemory(kind MemoryKind, bytes int64) bool {
+	accountant.mtx.Lock()
+	defer accountant.mtx.Unlock()
+
+	if budget := accountant.budget(kind); accountant.pressure || (budget > 0 && accountant.used[kind]+bytes > budget) {
+		return false
+	}
+	accountant.used[kind] += bytes
+	return true
+}
+
+// AcquireMemory accounts the bytes to the buffers of the kind whether they fit or not, for the buffers which can't be
+// refused, e.g. the sectors of a file which are all dirty.
+func AcquireMemory(kind MemoryKind, bytes int64) {
+	accountant.mtx.Lock()
+	defer accountant.mtx.Unlock()
+
+	accountant.used[kind] += bytes
+}
+
+// ReleaseMemory gives back the bytes reserved or acquired for the buffers of the kind.
+func ReleaseMemory(kind MemoryKind, bytes int64) {
+	accountant.mtx.Lock()
+	defer accountant.mtx.Unlock()
+
+	accountant.used[kind] = max(accountant.used[kind]-bytes, 0)
+}
+
+// ReserveResultMemory reserves the next bytes of a query result being read, refusing them with a busy error once the
+// results being read hold their share of the limit or the memory is past the shed threshold. read is what the result
+// already holds.
+func ReserveResultMemory(bytes int64, read int64) error {
+	if ReserveMemory(MemoryQueryResults, bytes) {
+		return nil
+	}
+
+	accountant.mtx.Lock()
+	accountant.rejected++
+	accountant.mtx.Unlock()
+	return NewError(ErrorCodeBusy, fmt.Sprintf("not enough memory to read the result past its first %d bytes, retry later or read it in smaller pages", read), nil)
+}
+
+// GetMemoryStats returns the memory accounted against the limit.
+func GetMemoryStats() MemoryStats {
+	used := memoryUsed()
+
+	accountant.mtx.Lock()
+	defer accountant.mtx.Unlock()
+
+	return MemoryStats{
+		LimitBytes:    accountant.limit,
+		UsedBytes:     used,
+		UnderPressure: accountant.pressure,
+		SectorCache:   MemoryBudget{UsedBytes: accountant.used[MemorySectorCache], MaxBytes: accountant.budget(MemorySectorCache)},
+		QueryResults:  MemoryBudget{UsedBytes: accountant.used[MemoryQueryResults], MaxBytes: accountant.budget(MemoryQueryResults)},
+		Sheds:         accountant.sheds,
+		ShedBytes:     accountant.shedBytes,
+		Rejected:      accountant.rejected,
+	}
+}
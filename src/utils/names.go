@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// NOTE: bounds the length of the keys and paths built from the names, well below the limits of S3 and the filesystems
+const DatabaseNameMaxLength = 128
+
+// DatabaseFileExtension is the extension of the file and of the object of a database at every stage.
+const DatabaseFileExtension = ".db"
+
+// NOTE: lowercase letters, digits, _ and -, starting with a letter or a digit. Without dot nor slash, the name of a
+// database can't be mistaken for a journal, a temporary file or a nested object, and without uppercase two databases
+// can't share a file on a case-insensitive filesystem.
+var databaseNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// NOTE: prefixes of the files and tables persisto keeps for itself
+var reservedDatabaseNamePrefixes = []string{"_persisto", "temp_"}
+
+// NormalizeDatabaseName returns the canonical form of a database name, the one used to store and look it up.
+func NormalizeDatabaseName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// ValidateDatabaseName checks that the name is a canonical database name, see NormalizeDatabaseName.
+func ValidateDatabaseName(name string) error {
+	switch {
+	case name == "":
+		return NewError(ErrorCodeInvalidInput, "the database name must not be empty", nil)
+	case len(name) > DatabaseNameMaxLength:
+		return NewError(ErrorCodeInvalidInput, fmt.Sprintf("the database name must be at most %d characters long", DatabaseNameMaxLength), nil)
+	case !databaseNamePattern.MatchString(name):
+		return NewError(ErrorCodeInvalidInput, fmt.Sprintf("invalid database name %q, it must only contain lowercase letters, digits, _ and - and start with a letter or a digit", name), nil)
+	}
+	for _, prefix := range reservedDatabaseNamePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return NewError(ErrorCodeInvalidInput, fmt.Sprintf("invalid database name %q, the %s prefix is reserved", name, prefix), nil)
+		}
+	}
+	return nil
+}
+
+// DatabaseFileName returns the name of the file of the database, which is also the key of its remote object.
+func DatabaseFileName(name string) string {
+	return name + DatabaseFileExtension
+}
+
+// DatabaseNameFromFileName returns the name of the database stored in the file or object, reporting false for any file
+// that isn't named after a valid database name, so that journals, temporary files and other data are never listed.
+func DatabaseNameFromFileName(file string) (string, bool) {
+	name, hasExtension := strings.CutSuffix(file, DatabaseFileExtension)
+	if !hasExtension || ValidateDatabaseName(name) != nil {
+		return "", false
+	}
+	return name, true
+}
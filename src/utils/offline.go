@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: the server runs offline when the remote stage is disabled, has no bucket or can't be reached at startup. The
+// databases are then served from the local stage only, which holds their only copy, and the features keeping their
+// state in the bucket are left out until a restart with the remote stage back. Unless STORAGE_REMOTE_REQUIRED is set,
+// in which case the server doesn't start.
+var remoteOffline atomic.Pointer[string]
+
+// SetRemoteOffline runs the server without its remote stage for the given reason. The settings which would reach the
+// remote stage are brought back to the local stage, and the ones which can't do without it are refused.
+func SetRemoteOffline(reason string) error {
+	if Config.Replication.Role != "primary" {
+		return fmt.Errorf("REPLICATION_ROLE=%s requires the remote stage, which is offline: %s", Config.Replication.Role, reason)
+	}
+
+	local := GetLocalStage()
+	Config.Settings.DefaultDatabaseCreationStage = min(Config.Settings.DefaultDatabaseCreationStage, local)
+	Config.Settings.PersistenceStage = min(Config.Settings.PersistenceStage, local)
+	// NOTE: the leases and the consumption of the budgets are kept in the bucket, a single instance serves the local stage
+	Config.Coordination.Enabled = false
+	Config.Budgets.Enabled = false
+
+	remoteOffline.Store(&reason)
+	Logger.Warn("Remote stage offline, serving the databases from the local stage only.", zap.String("reason", reason))
+	return nil
+}
+
+// RemoteOffline reports whether the server runs without its remote stage.
+func RemoteOffline() bool {
+	return remoteOffline.Load() != nil
+}
+
+// RemoteOfflineReason returns why the server runs without its remote stage, empty when it doesn't.
+func RemoteOfflineReason() string {
+	if reason := remoteOffline.Load(); reason != nil {
+		return *reason
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+)
+
+// Priority is the class of the work a request or a job does, the admission control, the query workers and the syncs
+// serve the interactive work first.
+type Priority string
+
+const (
+	// NOTE: the default, answered to a user waiting for it
+	PriorityInteractive Priority = "interactive"
+	// NOTE: bulk reads and writes whose latency matters less, e.g. exports and imports
+	PriorityBatch Priority = "batch"
+	// NOTE: the housekeeping, e.g. the scheduled jobs and the retention rules
+	PriorityMaintenance Priority = "maintenance"
+)
+
+// Priorities are the priority classes from the most to the least urgent.
+var Priorities = []Priority{PriorityInteractive, PriorityBatch, PriorityMaintenance}
+
+type priorityKey struct{}
+
+// ParsePriority returns the priority named, the interactive one when the name is empty.
+func ParsePriority(name string) (Priority, error) {
+	if name == "" {
+		return PriorityInteractive, nil
+	}
+	for _, priority := range Priorities {
+		if string(priority) == name {
+			return priority, nil
+		}
+	}
+	return "", NewError(ErrorCodeInvalidInput, fmt.Sprintf("unknown priority %q, expected interactive, batch or maintenance", name), nil)
+}
+
+// Rank returns the position of the priority from the most urgent, 0 for the interactive one.
+func (priority Priority) Rank() int {
+	switch priority {
+	case PriorityBatch:
+		return 1
+	case PriorityMaintenance:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// WithPriority returns the context of the work done at the priority.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// PriorityOf returns the priority of the work done under the context, the interactive one unless set by WithPriority.
+func PriorityOf(ctx context.Context) Priority {
+	if priority, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return priority
+	}
+	return PriorityInteractive
+}
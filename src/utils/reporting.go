@@ -0,0 +1,304 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// NOTE: errors are sent in the background, reports are dropped rather than slowing down the caller once the queue is full
+const (
+	reportQueueSize = 128
+	reportTimeout   = 5 * time.Second
+)
+
+// errorReporter sends error events to a Sentry compatible store endpoint.
+type errorReporter struct {
+	storeURL string
+	auth     string
+	queue    chan reportEvent
+	client   *http.Client
+}
+
+type reportFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type reportException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []reportFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type reportEvent struct {
+	EventID     string                       `json:"event_id"`
+	Timestamp   string                       `json:"timestamp"`
+	Level       string                       `json:"level"`
+	Platform    string                       `json:"platform"`
+	Logger      string                       `json:"logger,omitempty"`
+	Message     string                       `json:"message"`
+	Release     string                       `json:"release,omitempty"`
+	Environment string                       `json:"environment,omitempty"`
+	ServerName  string                       `json:"server_name,omitempty"`
+	Tags        map[string]string            `json:"tags,omitempty"`
+	Extra       map[string]any               `json:"extra,omitempty"`
+	Exception   map[string][]reportException `json:"exception,omitempty"`
+}
+
+var reporter *errorReporter
+
+// parseReportingDSN turns a DSN, https://<key>@<host>/<project>, into the store endpoint and its auth header.
+func parseReportingDSN(dsn, version string) (string, string, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	if parsed.User == nil || parsed.User.Username() == "" {
+		return "", "", fmt.Errorf("missing public key")
+	}
+
+	path := strings.Trim(parsed.Path, "/")
+	index := strings.LastIndex(path, "/")
+	project := path[index+1:]
+	if project == "" {
+		return "", "", fmt.Errorf("missing project ID")
+	}
+
+	base := parsed.Scheme + "://" + parsed.Host
+	if index >= 0 {
+		base += "/" + path[:index]
+	}
+
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=persisto/%s, sentry_key=%s", version, parsed.User.Username())
+	if secret, exists := parsed.User.Password(); exists {
+		auth += ", sentry_secret=" + secret
+	}
+	return base + "/api/" + project + "/store/", auth, nil
+}
+
+// setupErrorReporter starts the reporter when a DSN is configured.
+func setupErrorReporter() error {
+	dsn := Config.Logging.ErrorReportingDSN.Value()
+	if dsn == "" {
+		return nil
+	}
+
+	storeURL, auth, err := parseReportingDSN(dsn, Config.Server.Version)
+	if err != nil {
+		return fmt.Errorf("invalid error reporting DSN: %w", err)
+	}
+
+	reporter = &errorReporter{
+		storeURL: storeURL,
+		auth:     auth,
+		queue:    make(chan reportEvent, reportQueueSize),
+		client:   &http.Client{Timeout: reportTimeout},
+	}
+	go func() {
+		for event := range reporter.queue {
+			reporter.send(event)
+		}
+	}()
+	return nil
+}
+
+func (reporter *errorReporter) send(event reportEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		// NOTE: reporting failures go to stderr, logging them as errors would report them again
+		fmt.Fprintf(os.Stderr, "Failed to encode error report: %v\n", err)
+		return
+	}
+
+	request, err := http.NewRequest(http.MethodPost, reporter.storeURL, bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to build error report request: %v\n", err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Sentry-Auth", reporter.auth)
+
+	response, err := reporter.client.Do(request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to send error report: %v\n", err)
+		return
+	}
+	response.Body.Close()
+
+	if response.StatusCode >= http.StatusBadRequest {
+		fmt.Fprintf(os.Stderr, "Error reporting endpoint responded with status %d\n", response.StatusCode)
+	}
+}
+
+func (reporter *errorReporter) report(event reportEvent, wait bool) {
+	if wait {
+		reporter.send(event)
+		return
+	}
+
+	select {
+	case reporter.queue <- event:
+	default:
+		fmt.Fprintln(os.Stderr, "Error report queue full, dropping report.")
+	}
+}
+
+func newReportEvent(level zapcore.Level, message string) reportEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	hostname, _ := os.Hostname()
+
+	return reportEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Level:       reportLevel(level),
+		Platform:    "go",
+		Message:     message,
+		Release:     Config.Server.Version,
+		Environment: Config.Logging.ErrorReportingEnvironment,
+		ServerName:  hostname,
+		Tags:        make(map[string]string),
+		Extra:       make(map[string]any),
+	}
+}
+
+func reportLevel(level zapcore.Level) string {
+	switch {
+	case level >= zapcore.FatalLevel:
+		return "fatal"
+	case level >= zapcore.ErrorLevel:
+		return "error"
+	case level == zapcore.WarnLevel:
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+// reportStacktrace captures the current goroutine frames, oldest first as expected by the endpoint, without the
+// logging and reporting frames.
+func reportStacktrace() []reportFrame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(2, pcs)
+	callers := runtime.CallersFrames(pcs[:n])
+
+	var frames []reportFrame
+	for {
+		frame, more := callers.Next()
+		if !strings.HasPrefix(frame.Function, "go.uber.org/zap") && !strings.HasPrefix(frame.Function, "persisto/src/utils.(*reportingCore)") && !strings.HasPrefix(frame.Function, "persisto/src/utils.reportStacktrace") {
+			module, function := splitFunctionName(frame.Function)
+			frames = append(frames, reportFrame{
+				Function: function,
+				Module:   module,
+				Filename: frame.File[strings.LastIndex(frame.File, "/")+1:],
+				AbsPath:  frame.File,
+				Lineno:   frame.Line,
+				InApp:    strings.HasPrefix(frame.Function, "persisto/"),
+			})
+		}
+		if !more {
+			break
+		}
+	}
+
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+	}
+	return frames
+}
+
+func splitFunctionName(name string) (string, string) {
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return "", name
+	}
+	return name[:slash+1+dot], name[slash+1+dot+1:]
+}
+
+// reportingCore forwards error logs to the error reporter, fields become the event context and the error field its
+// exception.
+type reportingCore struct {
+	zapcore.LevelEnabler
+	fields []zapcore.Field
+}
+
+func newReportingCore() zapcore.Core {
+	return &reportingCore{LevelEnabler: zapcore.ErrorLevel}
+}
+
+func (core *reportingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &reportingCore{
+		LevelEnabler: core.LevelEnabler,
+		fields:       append(append([]zapcore.Field{}, core.fields...), fields...),
+	}
+}
+
+func (core *reportingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if reporter != nil && core.Enabled(entry.Level) {
+		return checked.AddCore(entry, core)
+	}
+	return checked
+}
+
+func (core *reportingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	event := newReportEvent(entry.Level, entry.Message)
+	event.Logger = entry.LoggerName
+
+	encoder := zapcore.NewMapObjectEncoder()
+	var reportedError error
+	for _, field := range append(append([]zapcore.Field{}, core.fields...), fields...) {
+		if field.Type == zapcore.ErrorType {
+			if err, ok := field.Interface.(error); ok && reportedError == nil {
+				reportedError = err
+			}
+		}
+		field.AddTo(encoder)
+	}
+
+	for key, value := range encoder.Fields {
+		// NOTE: identifying fields become tags so events can be searched by them
+		if text, ok := value.(string); ok && (key == "subsystem" || key == "database" || key == "code") {
+			event.Tags[key] = text
+			continue
+		}
+		event.Extra[key] = value
+	}
+	if entry.Caller.Defined {
+		event.Extra["caller"] = entry.Caller.TrimmedPath()
+	}
+
+	exception := reportException{Type: entry.Message, Value: entry.Message}
+	if reportedError != nil {
+		exception.Type = fmt.Sprintf("%T", reportedError)
+		exception.Value = reportedError.Error()
+	}
+	exception.Stacktrace.Frames = reportStacktrace()
+	event.Exception = map[string][]reportException{"values": {exception}}
+
+	// NOTE: the process is about to exit on fatal logs, the report must be sent before
+	reporter.report(event, entry.Level >= zapcore.DPanicLevel)
+	return nil
+}
+
+func (core *reportingCore) Sync() error {
+	return nil
+}
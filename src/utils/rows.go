@@ -0,0 +1,252 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// NOTE: rows are addressed by the value of their single column primary key, or by their rowid when the table has no
+// primary key. Their version is a hash of their values, it changes whenever one of them does and is sent as the ETag of
+// the row, a write carrying it in If-Match is refused once the row changed.
+
+// Row is a row of a table read by its key.
+type Row struct {
+	Values  map[string]any
+	Columns []QueryColumn
+	Version string
+}
+
+// RowVersion hashes the values of the row in the order of its columns.
+func RowVersion(values map[string]any, columns []QueryColumn) (string, error) {
+	ordered := make([]any, len(columns))
+	for index, column := range columns {
+		ordered[index] = values[column.Name]
+	}
+	encoded, err := json.Marshal(ordered)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(encoded)
+	return hex.EncodeToString(hash[:16]), nil
+}
+
+// MatchesVersion tells whether the If-Match header matches the version, * matches every existing row. The weak tags
+// never match, the versions are compared strongly.
+func MatchesVersion(ifMatch string, version string) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == `"`+version+`"` {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadRow reads the row of the table with the given key, passing the values of its columns through their masks.
+func ReadRow(ctx context.Context, conn *sql.Conn, masks func(query string) ([]ValueMask, error), table string, key string) (Row, error) {
+	keyColumn, err := rowKeyColumn(ctx, conn, table)
+	if err != nil {
+		return Row{}, err
+	}
+	return readRowBy(ctx, conn, masks, table, keyColumn, key)
+}
+
+// UpdateRow sets the values of the columns of the row of the table with the given key and returns the row as updated.
+// With ifMatch the row is only updated while its version matches, in the same transaction.
+func UpdateRow(ctx context.Context, conn *sql.Conn, masks func(query string) ([]ValueMask, error), table string, key string, values map[string]any, ifMatch string) (Row, error) {
+	if len(values) == 0 {
+		return Row{}, NewError(ErrorCodeInvalidInput, "no value to update", nil)
+	}
+
+	var row Row
+	err := writeRow(ctx, conn, func() error {
+		keyColumn, err := rowKeyColumn(ctx, conn, table)
+		if err != nil {
+			return err
+		}
+		if err := checkRowVersion(ctx, conn, masks, table, keyColumn, key, ifMatch); err != nil {
+			return err
+		}
+
+		columns, err := tableColumnNames(ctx, conn, table)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(values))
+		for name := range values {
+			if !slices.Contains(columns, name) {
+				return NewError(ErrorCodeInvalidInput, fmt.Sprintf("unknown column %s", name), nil)
+			}
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		assignments := make([]string, len(names))
+		parameters := make([]any, 0, len(names)+1)
+		for index, name := range names {
+			assignments[index] = QuoteIdentifier(name) + " = ?"
+			parameters = append(parameters, values[name])
+		}
+		parameters = append(parameters, key)
+
+		result, err := conn.ExecContext(ctx, "UPDATE "+QuoteIdentifier(table)+" SET "+strings.Join(assignments, ", ")+" WHERE "+QuoteIdentifier(keyColumn)+" = ?", parameters...)
+		if err != nil {
+			return err
+		}
+		if updated, err := result.RowsAffected(); err != nil {
+			return err
+		} else if updated == 0 {
+			return NewError(ErrorCodeNotFound, fmt.Sprintf("row %s not found in table %s", key, table), nil)
+		}
+
+		// NOTE: the key itself may have been updated
+		if value, updatesKey := values[keyColumn]; updatesKey {
+			key = fmt.Sprint(value)
+		}
+		row, err = readRowBy(ctx, conn, masks, table, keyColumn, key)
+		return err
+	})
+	return row, err
+}
+
+// DeleteRow deletes the row of the table with the given key. With ifMatch the row is only deleted while its version
+// matches, in the same transaction.
+func DeleteRow(ctx context.Context, conn *sql.Conn, masks func(query string) ([]ValueMask, error), table string, key string, ifMatch string) error {
+	return writeRow(ctx, conn, func() error {
+		keyColumn, err := rowKeyColumn(ctx, conn, table)
+		if err != nil {
+			return err
+		}
+		if err := checkRowVersion(ctx, conn, masks, table, keyColumn, key, ifMatch); err != nil {
+			return err
+		}
+
+		result, err := conn.ExecContext(ctx, "DELETE FROM "+QuoteIdentifier(table)+" WHERE "+QuoteIdentifier(keyColumn)+" = ?", key)
+		if err != nil {
+			return err
+		}
+		if deleted, err := result.RowsAffected(); err != nil {
+			return err
+		} else if deleted == 0 {
+			return NewError(ErrorCodeNotFound, fmt.Sprintf("row %s not found in table %s", key, table), nil)
+		}
+		return nil
+	})
+}
+
+// NOTE: the version is checked and the row written in a single write transaction, no other write can come in between
+func writeRow(ctx context.Context, conn *sql.Conn, write func() error) error {
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		return err
+	}
+	_, err := conn.ExecContext(ctx, "COMMIT")
+	return err
+}
+
+func checkRowVersion(ctx context.Context, conn *sql.Conn, masks func(query string) ([]ValueMask, error), table string, keyColumn string, key string, ifMatch string) error {
+	if ifMatch == "" {
+		return nil
+	}
+	current, err := readRowBy(ctx, conn, masks, table, keyColumn, key)
+	if err != nil {
+		return err
+	}
+	if !MatchesVersion(ifMatch, current.Version) {
+		return NewError(ErrorCodePreconditionFailed, fmt.Sprintf("row %s of table %s changed, its version is now %s", key, table, current.Version), nil)
+	}
+	return nil
+}
+
+func readRowBy(ctx context.Context, conn *sql.Conn, masks func(query string) ([]ValueMask, error), table string, keyColumn string, key string) (Row, error) {
+	query := "SELECT * FROM " + QuoteIdentifier(table) + " WHERE " + QuoteIdentifier(keyColumn) + " = ?"
+	rowMasks, err := masks(query)
+	if err != nil {
+		return Row{}, err
+	}
+
+	rows, err := conn.QueryContext(ctx, query, key)
+	if err != nil {
+		return Row{}, err
+	}
+	results, columns, _, err := QueryResultToMapsMasked(rows, rowMasks, ResultWindow{})
+	if err != nil {
+		return Row{}, err
+	}
+	if len(results) == 0 {
+		return Row{}, NewError(ErrorCodeNotFound, fmt.Sprintf("row %s not found in table %s", key, table), nil)
+	}
+
+	row := Row{Values: results[0], Columns: columns}
+	if row.Version, err = RowVersion(row.Values, columns); err != nil {
+		return Row{}, err
+	}
+	return row, nil
+}
+
+func rowKeyColumn(ctx context.Context, conn *sql.Conn, table string) (string, error) {
+	if strings.HasPrefix(strings.ToLower(table), "_persisto_") {
+		return "", NewError(ErrorCodeNotFound, fmt.Sprintf("table %s not found", table), nil)
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT name, pk FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	found := false
+	var keys []string
+	for rows.Next() {
+		var name string
+		var position int
+		if err := rows.Scan(&name, &position); err != nil {
+			return "", err
+		}
+		found = true
+		if position > 0 {
+			keys = append(keys, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	switch {
+	case !found:
+		return "", NewError(ErrorCodeNotFound, fmt.Sprintf("table %s not found", table), nil)
+	case len(keys) > 1:
+		return "", NewError(ErrorCodeInvalidInput, fmt.Sprintf("table %s has a composite primary key, its rows can't be addressed by a single key", table), nil)
+	case len(keys) == 1:
+		return keys[0], nil
+	default:
+		return "rowid", nil
+	}
+}
+
+func tableColumnNames(ctx context.Context, conn *sql.Conn, table string) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const redactedValue = "[redacted]"
+
+// Secret holds a sensitive configuration value, it is masked whenever printed, logged or encoded so configuration
+// dumps are safe by default. Value returns the actual secret.
+type Secret string
+
+func (secret Secret) Value() string {
+	return string(secret)
+}
+
+func (secret Secret) masked() string {
+	if secret == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+func (secret Secret) String() string {
+	return secret.masked()
+}
+
+func (secret Secret) GoString() string {
+	return fmt.Sprintf("%q", secret.masked())
+}
+
+// NOTE: Format covers every verb, e.g. %s and %v but also %q and %x which would otherwise bypass String
+func (secret Secret) Format(state fmt.State, verb rune) {
+	fmt.Fprint(state, secret.masked())
+}
+
+func (secret Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(secret.masked())
+}
+
+func (secret Secret) MarshalText() ([]byte, error) {
+	return []byte(secret.masked()), nil
+}
@@ -0,0 +1,315 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"go.uber.org/zap"
+)
+
+// NOTE: Secret configuration values may reference a secret instead of holding it
+const (
+	// file:///run/secrets/name, content of a mounted file
+	secretSchemeFile = "file://"
+	// awssm://secret-id#json-key, AWS Secrets Manager secret, optionally a key of a JSON secret
+	secretSchemeAWS = "awssm://"
+	// vault://mount/path#field, field of a Vault KV secret (v1 or v2)
+	secretSchemeVault = "vault://"
+)
+
+const secretResolutionTimeout = 10 * time.Second
+
+// secretReference is a configuration value pointing to a secret, index is -1 for plain string fields
+type secretReference struct {
+	field     []int
+	index     int
+	reference string
+}
+
+var (
+	// NOTE: the configuration as parsed, references are resolved again from it on rotation
+	unresolvedConfiguration *Configuration
+	secretReferences        []secretReference
+	secretsMtx              sync.Mutex
+	secretListeners         []func()
+
+	secretsRotationOnce sync.Once
+)
+
+func isSecretReference(value string) bool {
+	return strings.HasPrefix(value, secretSchemeFile) ||
+		strings.HasPrefix(value, secretSchemeAWS) ||
+		strings.HasPrefix(value, secretSchemeVault)
+}
+
+var (
+	secretType     = reflect.TypeOf(Secret(""))
+	secretListType = reflect.TypeOf([]Secret{})
+)
+
+// collectSecretReferences finds every Secret field of the configuration holding a secret reference.
+func collectSecretReferences(value reflect.Value, field []int, references []secretReference) []secretReference {
+	for i := 0; i < value.NumField(); i++ {
+		structField := value.Type().Field(i)
+		fieldValue := value.Field(i)
+		path := append(append([]int{}, field...), i)
+
+		if fieldValue.Kind() == reflect.Struct {
+			references = collectSecretReferences(fieldValue, path, references)
+			continue
+		}
+
+		switch structField.Type {
+		case secretType:
+			if isSecretReference(fieldValue.String()) {
+				references = append(references, secretReference{field: path, index: -1, reference: fieldValue.String()})
+			}
+		case secretListType:
+			for j := 0; j < fieldValue.Len(); j++ {
+				if element := fieldValue.Index(j).String(); isSecretReference(element) {
+					references = append(references, secretReference{field: path, index: j, reference: element})
+				}
+			}
+		}
+	}
+	return references
+}
+
+// resolveSecrets resolves every secret reference and returns the configuration with the secrets in place of the references.
+func resolveSecrets(cfg *Configuration, references []secretReference) (*Configuration, error) {
+	resolved := *cfg
+	root := reflect.ValueOf(&resolved).Elem()
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretResolutionTimeout)
+	defer cancel()
+
+	// NOTE: slices are shared with the source configuration, they are rebuilt rather than modified in place
+	lists := make(map[string][]Secret)
+	var listFields [][]int
+
+	for _, reference := range references {
+		// NOTE: references are resolved in field order, the secrets settings resolved first can be used by the others
+		secret, err := resolveSecret(ctx, &resolved, reference.reference)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve secret %s: %w", reference.reference, err)
+		}
+
+		field := root.FieldByIndex(reference.field)
+		if reference.index < 0 {
+			field.SetString(secret)
+			continue
+		}
+
+		key := fmt.Sprint(reference.field)
+		if _, exists := lists[key]; !exists {
+			lists[key] = append([]Secret{}, field.Interface().([]Secret)...)
+			listFields = append(listFields, reference.field)
+		}
+		lists[key][reference.index] = Secret(secret)
+	}
+
+	for _, fieldIndex := range listFields {
+		// NOTE: a single secret may hold a whole comma separated list
+		var entries []Secret
+		for _, entry := range lists[fmt.Sprint(fieldIndex)] {
+			for _, part := range strings.Split(entry.Value(), ",") {
+				entries = append(entries, Secret(part))
+			}
+		}
+		root.FieldByIndex(fieldIndex).Set(reflect.ValueOf(entries))
+	}
+
+	return &resolved, nil
+}
+
+func resolveSecret(ctx context.Context, cfg *Configuration, reference string) (string, error) {
+	switch {
+	case strings.HasPrefix(reference, secretSchemeFile):
+		content, err := os.ReadFile(strings.TrimPrefix(reference, secretSchemeFile))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+
+	case strings.HasPrefix(reference, secretSchemeAWS):
+		id, key, _ := strings.Cut(strings.TrimPrefix(reference, secretSchemeAWS), "#")
+		return resolveAWSSecret(ctx, cfg, id, key)
+
+	case strings.HasPrefix(reference, secretSchemeVault):
+		path, field, _ := strings.Cut(strings.TrimPrefix(reference, secretSchemeVault), "#")
+		return resolveVaultSecret(ctx, cfg, path, field)
+
+	default:
+		return "", fmt.Errorf("unsupported secret reference")
+	}
+}
+
+func resolveAWSSecret(ctx context.Context, cfg *Configuration, id, key string) (string, error) {
+	var options []func(*config.LoadOptions) error
+	if cfg.Secrets.AWSRegion != "" {
+		options = append(options, config.WithRegion(cfg.Secrets.AWSRegion))
+	}
+
+	awsConfig, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := secretsmanager.NewFromConfig(awsConfig).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(id),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	secret := aws.ToString(output.SecretString)
+	if secret == "" && output.SecretBinary != nil {
+		secret = string(output.SecretBinary)
+	}
+
+	if key == "" {
+		return secret, nil
+	}
+
+	var data map[string]any
+	if err := json.Unmarshal([]byte(secret), &data); err != nil {
+		return "", fmt.Errorf("secret is not a JSON document, can't extract %s: %w", key, err)
+	}
+	return secretField(data, key)
+}
+
+func resolveVaultSecret(ctx context.Context, cfg *Configuration, path, field string) (string, error) {
+	if cfg.Secrets.VaultAddress == "" {
+		return "", fmt.Errorf("SECRETS_VAULT_ADDRESS is required for vault secrets")
+	}
+	if field == "" {
+		return "", fmt.Errorf("vault secrets require a field, e.g. vault://secret/data/persisto#field")
+	}
+
+	token := cfg.Secrets.VaultToken.Value()
+	if cfg.Secrets.VaultTokenFile != "" {
+		content, err := os.ReadFile(cfg.Secrets.VaultTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read vault token file: %w", err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+
+	url := strings.TrimSuffix(cfg.Secrets.VaultAddress, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-Vault-Token", token)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault responded with status %d", response.StatusCode)
+	}
+
+	var payload struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", fmt.Errorf("invalid vault response: %w", err)
+	}
+
+	// NOTE: KV v2 nests the secret under data.data, KV v1 returns it directly under data
+	data := payload.Data
+	if nested, ok := data["data"].(map[string]any); ok {
+		data = nested
+	}
+	return secretField(data, field)
+}
+
+func secretField(data map[string]any, field string) (string, error) {
+	value, exists := data[field]
+	if !exists {
+		return "", fmt.Errorf("secret has no field %s", field)
+	}
+	if text, ok := value.(string); ok {
+		return text, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// OnSecretsRotated registers a listener called after secrets changed on rotation, the configuration already holds the
+// new values when it runs.
+func OnSecretsRotated(listener func()) {
+	secretsMtx.Lock()
+	defer secretsMtx.Unlock()
+
+	secretListeners = append(secretListeners, listener)
+}
+
+// StartSecretsRotation periodically resolves the secret references again and applies the secrets that changed.
+func StartSecretsRotation() {
+	secretsRotationOnce.Do(func() {
+		interval := Config.Secrets.RefreshIntervalSeconds
+		if interval <= 0 || len(secretReferences) == 0 {
+			return
+		}
+
+		Logger.Info("Starting secrets rotation.", zap.Int("references", len(secretReferences)), zap.Int("intervalSeconds", interval))
+
+		go func() {
+			ticker := time.NewTicker(time.Duration(interval) * time.Second)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				rotateSecrets()
+			}
+		}()
+	})
+}
+
+func rotateSecrets() {
+	secretsMtx.Lock()
+	defer secretsMtx.Unlock()
+
+	resolved, err := resolveSecrets(unresolvedConfiguration, secretReferences)
+	if err != nil {
+		// NOTE: keep serving with the current secrets, the next rotation may succeed
+		Logger.Error("Failed to resolve secrets for rotation.", zap.Error(err))
+		return
+	}
+
+	changed := false
+	for _, reference := range secretReferences {
+		current := reflect.ValueOf(Config).Elem().FieldByIndex(reference.field)
+		next := reflect.ValueOf(resolved).Elem().FieldByIndex(reference.field)
+		if !reflect.DeepEqual(current.Interface(), next.Interface()) {
+			current.Set(next)
+			changed = true
+			Logger.Info("Secret rotated.", zap.String("reference", reference.reference))
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	for _, listener := range secretListeners {
+		listener()
+	}
+}
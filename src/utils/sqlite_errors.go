@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/ncruces/go-sqlite3"
+)
+
+// SQLiteError details a failure reported by SQLite, so that clients tell constraint violations from syntax errors or
+// BUSY without parsing the messages.
+type SQLiteError struct {
+	Code         int    `json:"code" example:"19" doc:"Primary result code"`
+	Name         string `json:"name" example:"SQLITE_CONSTRAINT" doc:"Name of the primary result code"`
+	ExtendedCode int    `json:"extended_code" example:"2067" doc:"Extended result code, equal to the primary one when SQLite has no detail"`
+	ExtendedName string `json:"extended_name" example:"SQLITE_CONSTRAINT_UNIQUE" doc:"Name of the extended result code"`
+	Statement    int    `json:"statement" doc:"Index in the batch of the query which failed, the one which rolled back the others in a transaction, -1 when no query failed on its own, e.g. the commit"`
+	Offset       *int   `json:"offset,omitempty" doc:"Byte offset in the failing query of the token which triggered a syntax error"`
+}
+
+var sqliteCodeNames = map[sqlite3.ErrorCode]string{
+	sqlite3.ERROR:      "SQLITE_ERROR",
+	sqlite3.INTERNAL:   "SQLITE_INTERNAL",
+	sqlite3.PERM:       "SQLITE_PERM",
+	sqlite3.ABORT:      "SQLITE_ABORT",
+	sqlite3.BUSY:       "SQLITE_BUSY",
+	sqlite3.LOCKED:     "SQLITE_LOCKED",
+	sqlite3.NOMEM:      "SQLITE_NOMEM",
+	sqlite3.READONLY:   "SQLITE_READONLY",
+	sqlite3.INTERRUPT:  "SQLITE_INTERRUPT",
+	sqlite3.IOERR:      "SQLITE_IOERR",
+	sqlite3.CORRUPT:    "SQLITE_CORRUPT",
+	sqlite3.NOTFOUND:   "SQLITE_NOTFOUND",
+	sqlite3.FULL:       "SQLITE_FULL",
+	sqlite3.CANTOPEN:   "SQLITE_CANTOPEN",
+	sqlite3.PROTOCOL:   "SQLITE_PROTOCOL",
+	sqlite3.EMPTY:      "SQLITE_EMPTY",
+	sqlite3.SCHEMA:     "SQLITE_SCHEMA",
+	sqlite3.TOOBIG:     "SQLITE_TOOBIG",
+	sqlite3.CONSTRAINT: "SQLITE_CONSTRAINT",
+	sqlite3.MISMATCH:   "SQLITE_MISMATCH",
+	sqlite3.MISUSE:     "SQLITE_MISUSE",
+	sqlite3.NOLFS:      "SQLITE_NOLFS",
+	sqlite3.AUTH:       "SQLITE_AUTH",
+	sqlite3.FORMAT:     "SQLITE_FORMAT",
+	sqlite3.RANGE:      "SQLITE_RANGE",
+	sqlite3.NOTADB:     "SQLITE_NOTADB",
+	sqlite3.NOTICE:     "SQLITE_NOTICE",
+	sqlite3.WARNING:    "SQLITE_WARNING",
+}
+
+// NOTE: the extended codes clients act upon, the others are named after their primary code
+var sqliteExtendedCodeNames = map[sqlite3.ExtendedErrorCode]string{
+	sqlite3.CONSTRAINT_CHECK:      "SQLITE_CONSTRAINT_CHECK",
+	sqlite3.CONSTRAINT_COMMITHOOK: "SQLITE_CONSTRAINT_COMMITHOOK",
+	sqlite3.CONSTRAINT_FOREIGNKEY: "SQLITE_CONSTRAINT_FOREIGNKEY",
+	sqlite3.CONSTRAINT_FUNCTION:   "SQLITE_CONSTRAINT_FUNCTION",
+	sqlite3.CONSTRAINT_NOTNULL:    "SQLITE_CONSTRAINT_NOTNULL",
+	sqlite3.CONSTRAINT_PRIMARYKEY: "SQLITE_CONSTRAINT_PRIMARYKEY",
+	sqlite3.CONSTRAINT_TRIGGER:    "SQLITE_CONSTRAINT_TRIGGER",
+	sqlite3.CONSTRAINT_UNIQUE:     "SQLITE_CONSTRAINT_UNIQUE",
+	sqlite3.CONSTRAINT_VTAB:       "SQLITE_CONSTRAINT_VTAB",
+	sqlite3.CONSTRAINT_ROWID:      "SQLITE_CONSTRAINT_ROWID",
+	sqlite3.CONSTRAINT_PINNED:     "SQLITE_CONSTRAINT_PINNED",
+	sqlite3.CONSTRAINT_DATATYPE:   "SQLITE_CONSTRAINT_DATATYPE",
+	sqlite3.BUSY_RECOVERY:         "SQLITE_BUSY_RECOVERY",
+	sqlite3.BUSY_SNAPSHOT:         "SQLITE_BUSY_SNAPSHOT",
+	sqlite3.BUSY_TIMEOUT:          "SQLITE_BUSY_TIMEOUT",
+	sqlite3.LOCKED_SHAREDCACHE:    "SQLITE_LOCKED_SHAREDCACHE",
+	sqlite3.LOCKED_VTAB:           "SQLITE_LOCKED_VTAB",
+	sqlite3.READONLY_RECOVERY:     "SQLITE_READONLY_RECOVERY",
+	sqlite3.READONLY_CANTLOCK:     "SQLITE_READONLY_CANTLOCK",
+	sqlite3.READONLY_ROLLBACK:     "SQLITE_READONLY_ROLLBACK",
+	sqlite3.READONLY_DBMOVED:      "SQLITE_READONLY_DBMOVED",
+	sqlite3.READONLY_CANTINIT:     "SQLITE_READONLY_CANTINIT",
+	sqlite3.READONLY_DIRECTORY:    "SQLITE_READONLY_DIRECTORY",
+	sqlite3.ERROR_MISSING_COLLSEQ: "SQLITE_ERROR_MISSING_COLLSEQ",
+	sqlite3.ERROR_RETRY:           "SQLITE_ERROR_RETRY",
+	sqlite3.ERROR_SNAPSHOT:        "SQLITE_ERROR_SNAPSHOT",
+	sqlite3.ABORT_ROLLBACK:        "SQLITE_ABORT_ROLLBACK",
+	sqlite3.CORRUPT_VTAB:          "SQLITE_CORRUPT_VTAB",
+	sqlite3.CORRUPT_SEQUENCE:      "SQLITE_CORRUPT_SEQUENCE",
+	sqlite3.CORRUPT_INDEX:         "SQLITE_CORRUPT_INDEX",
+	sqlite3.IOERR_READ:            "SQLITE_IOERR_READ",
+	sqlite3.IOERR_SHORT_READ:      "SQLITE_IOERR_SHORT_READ",
+	sqlite3.IOERR_WRITE:           "SQLITE_IOERR_WRITE",
+	sqlite3.IOERR_FSYNC:           "SQLITE_IOERR_FSYNC",
+	sqlite3.IOERR_TRUNCATE:        "SQLITE_IOERR_TRUNCATE",
+	sqlite3.IOERR_LOCK:            "SQLITE_IOERR_LOCK",
+	sqlite3.IOERR_NOMEM:           "SQLITE_IOERR_NOMEM",
+	sqlite3.IOERR_CORRUPTFS:       "SQLITE_IOERR_CORRUPTFS",
+}
+
+// SQLiteErrorOf returns the SQLite result codes of err, nil when SQLite didn't report it. statement is the index in the
+// batch of the query which failed and query its text, used to locate the syntax errors.
+func SQLiteErrorOf(err error, statement int, query string) *SQLiteError {
+	var sqliteError *sqlite3.Error
+	if !errors.As(err, &sqliteError) {
+		return nil
+	}
+
+	code, extendedCode := sqliteError.Code(), sqliteError.ExtendedCode()
+	result := &SQLiteError{
+		Code:         int(code),
+		Name:         sqliteCodeNames[code],
+		ExtendedCode: int(extendedCode),
+		ExtendedName: sqliteExtendedCodeNames[extendedCode],
+		Statement:    statement,
+	}
+	if result.Name == "" {
+		result.Name = "SQLITE_UNKNOWN"
+	}
+	if result.ExtendedName == "" {
+		result.ExtendedName = result.Name
+	}
+
+	// NOTE: SQLite returns the query from the token which triggered a syntax error, the tail of the query
+	if tail := sqliteError.SQL(); tail != "" && strings.HasSuffix(query, tail) {
+		offset := len(query) - len(tail)
+		result.Offset = &offset
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/driver"
+)
+
+// QueryStats are the SQLite status counters of a query, what it actually did to produce its result.
+type QueryStats struct {
+	Statements    int     `json:"statements" doc:"Statements run, the prepared statement and those it triggered."`
+	DurationMs    float64 `json:"duration_ms" doc:"Time spent running the statements, as measured by SQLite."`
+	VMSteps       int     `json:"vm_steps" doc:"Virtual machine operations run."`
+	FullscanSteps int     `json:"fullscan_steps" doc:"Rows stepped through by full table scans, high counts hint at a missing index."`
+	Sorts         int     `json:"sorts" doc:"Sorts that couldn't use an index."`
+	AutoIndexes   int     `json:"autoindexes" doc:"Rows inserted in automatic indexes built for the query."`
+	CacheHits     int     `json:"cache_hits" doc:"Pages found in the page cache."`
+	PagesRead     int     `json:"pages_read" doc:"Pages missing from the page cache, read from the database file."`
+	PagesWritten  int     `json:"pages_written" doc:"Pages written to the database file."`
+}
+
+// NOTE: the stats being collected by connection, a connection runs a single query at a time
+var collectors sync.Map
+
+// CollectStats adds the status counters of the statements run on the connection to stats until the returned function
+// is called, once every statement was finished. It does nothing when stats is nil.
+func CollectStats(conn *sql.Conn, stats *QueryStats) func() {
+	if stats == nil {
+		return func() {}
+	}
+
+	var raw *sqlite3.Conn
+	conn.Raw(func(driverConn any) error {
+		raw = driverConn.(driver.Conn).Raw()
+		return nil
+	})
+
+	// NOTE: the connection counters are reset so that only the pages of the query are counted
+	for _, status := range []sqlite3.DBStatus{sqlite3.DBSTATUS_CACHE_HIT, sqlite3.DBSTATUS_CACHE_MISS, sqlite3.DBSTATUS_CACHE_WRITE} {
+		raw.Status(status, true)
+	}
+	collectors.Store(raw, stats)
+
+	// NOTE: a connection has a single trace callback, the analytics profile the connections when enabled and pass the
+	// finished statements on to ObserveStatement
+	traced := !Config.Analytics.Enabled
+	if traced {
+		raw.Trace(sqlite3.TRACE_PROFILE, func(event sqlite3.TraceEvent, statement any, duration any) error {
+			stmt, isStmt := statement.(*sqlite3.Stmt)
+			nanoseconds, isDuration := duration.(int64)
+			if isStmt && isDuration {
+				ObserveStatement(raw, stmt, nanoseconds, stmt.Status(sqlite3.STMTSTATUS_FULLSCAN_STEP, true), stmt.Status(sqlite3.STMTSTATUS_VM_STEP, true))
+			}
+			return nil
+		})
+	}
+
+	return func() {
+		if traced {
+			raw.Trace(0, nil)
+		}
+		collectors.Delete(raw)
+		stats.CacheHits, _, _ = raw.Status(sqlite3.DBSTATUS_CACHE_HIT, true)
+		stats.PagesRead, _, _ = raw.Status(sqlite3.DBSTATUS_CACHE_MISS, true)
+		stats.PagesWritten, _, _ = raw.Status(sqlite3.DBSTATUS_CACHE_WRITE, true)
+	}
+}
+
+// ObserveStatement adds the counters of a statement that finished running to the stats collected on its connection, if
+// any. The full scan and virtual machine steps are passed as read, and reset, by the trace callback.
+func ObserveStatement(raw *sqlite3.Conn, stmt *sqlite3.Stmt, nanoseconds int64, fullscanSteps int, vmSteps int) {
+	value, collecting := collectors.Load(raw)
+	if !collecting {
+		return
+	}
+	stats := value.(*QueryStats)
+	stats.Statements++
+	stats.DurationMs += float64(nanoseconds) / 1e6
+	stats.FullscanSteps += fullscanSteps
+	stats.VMSteps += vmSteps
+	stats.Sorts += stmt.Status(sqlite3.STMTSTATUS_SORT, true)
+	stats.AutoIndexes += stmt.Status(sqlite3.STMTSTATUS_AUTOINDEX, true)
+}
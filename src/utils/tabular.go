@@ -0,0 +1,339 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+)
+
+// NOTE: formats the results of a query can be exported in, for the consumers pulling large extracts, CSV for the tools
+// reading neither of the columnar ones
+const (
+	TabularFormatArrow   = "arrow"
+	TabularFormatParquet = "parquet"
+	TabularFormatCSV     = "csv"
+
+	ContentTypeArrow   = "application/vnd.apache.arrow.stream"
+	ContentTypeParquet = "application/vnd.apache.parquet"
+	ContentTypeCSV     = "text/csv"
+)
+
+// NOTE: rows encoded at once, every batch is an Arrow record batch or a Parquet row group
+const tabularBatchRows = 4096
+
+// TabularFormatFromAccept returns the columnar format requested by the Accept header, or an empty string when none is.
+func TabularFormatFromAccept(accept string) string {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(mediaRange, ";")
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case ContentTypeArrow:
+			return TabularFormatArrow
+		case ContentTypeParquet:
+			return TabularFormatParquet
+		case ContentTypeCSV:
+			return TabularFormatCSV
+		}
+	}
+	return ""
+}
+
+// TabularContentType returns the content type of the columnar format.
+func TabularContentType(format string) string {
+	switch format {
+	case TabularFormatParquet:
+		return ContentTypeParquet
+	case TabularFormatCSV:
+		return ContentTypeCSV
+	}
+	return ContentTypeArrow
+}
+
+// WriteTabular encodes the rows in the format as they are read, a batch at a time, passing the values of every
+// column with a mask through it like QueryResultToMapsMasked. The type of a column is its declared type, or the type of
+// its first values when it has none, the values that can't be converted to it fail the export. begin is called before
+// the first byte is written, so that errors seen before can still be reported. It returns the rows written.
+func WriteTabular(rows *sql.Rows, masks []ValueMask, maxRows int, format string, begin func(), w io.Writer) (int, error) {
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	next := func() ([][]any, error) {
+		var batch [][]any
+		for len(batch) < tabularBatchRows && rows.Next() {
+			if maxRows > 0 && count == maxRows {
+				return nil, NewError(ErrorCodeForbidden, fmt.Sprintf("the query returns more than the %d rows allowed", maxRows), nil)
+			}
+			count++
+
+			values := make([]any, len(columnTypes))
+			valuePtrs := make([]any, len(columnTypes))
+			for i := range values {
+				valuePtrs[i] = &values[i]
+			}
+			if err := rows.Scan(valuePtrs...); err != nil {
+				return nil, err
+			}
+			for i := range values {
+				if i < len(masks) && masks[i] != nil {
+					values[i] = masks[i](values[i])
+				}
+			}
+			batch = append(batch, values)
+		}
+		return batch, rows.Err()
+	}
+
+	// NOTE: the first batch is read before writing anything, the types of the columns without a declared type are taken
+	// from it
+	batch, err := next()
+	if err != nil {
+		return 0, err
+	}
+
+	if format == TabularFormatCSV {
+		return writeCSV(columnTypes, batch, next, begin, w)
+	}
+
+	fields := make([]arrow.Field, len(columnTypes))
+	for i, columnType := range columnTypes {
+		declaredType := columnType.DatabaseTypeName()
+		// NOTE: masked values don't keep the type of the column
+		if i < len(masks) && masks[i] != nil {
+			declaredType = ""
+		}
+		fields[i] = arrow.Field{Name: columnType.Name(), Type: tabularType(declaredType, batch, i), Nullable: true}
+	}
+	schema := arrow.NewSchema(fields, nil)
+
+	if format != TabularFormatArrow && format != TabularFormatParquet {
+		return 0, NewError(ErrorCodeInvalidInput, fmt.Sprintf("unknown tabular format %s", format), nil)
+	}
+
+	// NOTE: the writer is opened once the first batch is converted, so that its failures can still be reported
+	var write func(record arrow.Record) error
+	finish := func() error { return nil }
+	open := func() error {
+		begin()
+		if format == TabularFormatArrow {
+			writer := ipc.NewWriter(w, ipc.WithSchema(schema))
+			write, finish = writer.Write, writer.Close
+			return nil
+		}
+		properties := parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Snappy))
+		writer, err := pqarrow.NewFileWriter(schema, w, properties, pqarrow.DefaultWriterProps())
+		if err != nil {
+			return err
+		}
+		write, finish = writer.Write, writer.Close
+		return nil
+	}
+
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+
+	for len(batch) > 0 {
+		for _, values := range batch {
+			for i, value := range values {
+				if err := appendTabular(builder.Field(i), value); err != nil {
+					finish()
+					return count, NewError(ErrorCodeInvalidInput, fmt.Sprintf("column %s: %v, cast it in the query", fields[i].Name, err), nil)
+				}
+			}
+		}
+
+		record := builder.NewRecord()
+		if write == nil {
+			if err := open(); err != nil {
+				record.Release()
+				return count, err
+			}
+		}
+		err := write(record)
+		record.Release()
+		if err != nil {
+			finish()
+			return count, err
+		}
+
+		if batch, err = next(); err != nil {
+			finish()
+			return count, err
+		}
+	}
+
+	// NOTE: an empty result still carries its schema
+	if write == nil {
+		if err := open(); err != nil {
+			return count, err
+		}
+	}
+	return count, finish()
+}
+
+// writeCSV writes the rows as CSV with a header row, the batches being written as they are read. NULL is written as an
+// empty field and the blobs base64-encoded.
+func writeCSV(columnTypes []*sql.ColumnType, batch [][]any, next func() ([][]any, error), begin func(), w io.Writer) (int, error) {
+	begin()
+	writer := csv.NewWriter(w)
+
+	record := make([]string, len(columnTypes))
+	for i, columnType := range columnTypes {
+		record[i] = columnType.Name()
+	}
+	if err := writer.Write(record); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for len(batch) > 0 {
+		for _, values := range batch {
+			for i, value := range values {
+				record[i] = csvField(value)
+			}
+			if err := writer.Write(record); err != nil {
+				return count, err
+			}
+			count++
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return count, err
+		}
+
+		var err error
+		if batch, err = next(); err != nil {
+			return count, err
+		}
+	}
+	writer.Flush()
+	return count, writer.Error()
+}
+
+func csvField(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return base64.StdEncoding.EncodeToString(value)
+	case string:
+		return value
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(value)
+}
+
+// NOTE: the declared types map to their SQLite affinity, the columns without one or with the numeric affinity take the
+// type of their first values
+func tabularType(declaredType string, batch [][]any, column int) arrow.DataType {
+	declaredType = strings.ToUpper(declaredType)
+	switch {
+	case strings.Contains(declaredType, "INT"):
+		return arrow.PrimitiveTypes.Int64
+	case strings.Contains(declaredType, "CHAR"), strings.Contains(declaredType, "CLOB"), strings.Contains(declaredType, "TEXT"):
+		return arrow.BinaryTypes.String
+	case strings.Contains(declaredType, "BLOB"):
+		return arrow.BinaryTypes.Binary
+	case strings.Contains(declaredType, "REAL"), strings.Contains(declaredType, "FLOA"), strings.Contains(declaredType, "DOUB"):
+		return arrow.PrimitiveTypes.Float64
+	}
+
+	kind := ColumnTypeNull
+	for _, values := range batch {
+		valueType := storageClassOf(values[column])
+		if kind == ColumnTypeNull {
+			kind = valueType
+		} else if valueType != ColumnTypeNull && valueType != kind {
+			if (kind == ColumnTypeInteger || kind == ColumnTypeReal) && (valueType == ColumnTypeInteger || valueType == ColumnTypeReal) {
+				kind = ColumnTypeReal
+			} else {
+				kind = ColumnTypeText
+			}
+		}
+	}
+
+	switch kind {
+	case ColumnTypeInteger:
+		return arrow.PrimitiveTypes.Int64
+	case ColumnTypeReal:
+		return arrow.PrimitiveTypes.Float64
+	case ColumnTypeBlob:
+		return arrow.BinaryTypes.Binary
+	default:
+		return arrow.BinaryTypes.String
+	}
+}
+
+func appendTabular(builder array.Builder, value any) error {
+	if value == nil {
+		builder.AppendNull()
+		return nil
+	}
+
+	switch builder := builder.(type) {
+	case *array.Int64Builder:
+		switch value := value.(type) {
+		case int64:
+			builder.Append(value)
+			return nil
+		}
+	case *array.Float64Builder:
+		switch value := value.(type) {
+		case float64:
+			builder.Append(value)
+			return nil
+		case int64:
+			builder.Append(float64(value))
+			return nil
+		}
+	case *array.StringBuilder:
+		switch value := value.(type) {
+		case string:
+			builder.Append(value)
+			return nil
+		case int64:
+			builder.Append(strconv.FormatInt(value, 10))
+			return nil
+		case float64:
+			builder.Append(strconv.FormatFloat(value, 'g', -1, 64))
+			return nil
+		case bool:
+			builder.Append(strconv.FormatBool(value))
+			return nil
+		case time.Time:
+			builder.Append(value.Format(time.RFC3339Nano))
+			return nil
+		}
+	case *array.BinaryBuilder:
+		switch value := value.(type) {
+		case []byte:
+			builder.Append(value)
+			return nil
+		case string:
+			builder.AppendString(value)
+			return nil
+		}
+	}
+	return fmt.Errorf("a %s value can't be stored as %s", storageClassOf(value), builder.Type())
+}
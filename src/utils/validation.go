@@ -0,0 +1,389 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// ConfigurationError lists every problem found in the configuration, so all of them can be fixed in one go.
+type ConfigurationError struct {
+	Problems []string
+}
+
+func (err *ConfigurationError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  - %s", strings.Join(err.Problems, "\n  - "))
+}
+
+func validateConfiguration(cfg *Configuration) error {
+	names := make(map[string]string)
+	collectEnvNames(reflect.TypeOf(*cfg), "Configuration", "", names)
+
+	var problems []string
+
+	err := validator.New().Struct(cfg)
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		for _, fieldError := range validationErrors {
+			problems = append(problems, describeFieldError(fieldError, names))
+		}
+	} else if err != nil {
+		return err
+	}
+
+	problems = append(problems, checkConfigurationConsistency(cfg)...)
+
+	if len(problems) > 0 {
+		return &ConfigurationError{Problems: problems}
+	}
+	return nil
+}
+
+// NOTE: problems are reported with the environment variable to fix rather than the Go field path
+func collectEnvNames(t reflect.Type, namespace, prefix string, names map[string]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fieldNamespace := namespace + "." + field.Name
+
+		if field.Type.Kind() == reflect.Struct {
+			collectEnvNames(field.Type, fieldNamespace, prefix+field.Tag.Get("envPrefix"), names)
+			continue
+		}
+
+		if name := field.Tag.Get("env"); name != "" {
+			names[fieldNamespace] = prefix + name
+		}
+	}
+}
+
+func describeFieldError(fieldError validator.FieldError, names map[string]string) string {
+	name, exists := names[fieldError.Namespace()]
+	if !exists {
+		name = strings.TrimPrefix(fieldError.Namespace(), "Configuration.")
+	}
+
+	switch fieldError.Tag() {
+	case "required":
+		return fmt.Sprintf("%s is required", name)
+	case "gt":
+		return fmt.Sprintf("%s must be greater than %s, got %v", name, fieldError.Param(), fieldError.Value())
+	case "gte":
+		return fmt.Sprintf("%s must be greater than or equal to %s, got %v", name, fieldError.Param(), fieldError.Value())
+	case "oneof":
+		return fmt.Sprintf("%s must be one of [%s], got %q", name, fieldError.Param(), fieldError.Value())
+	default:
+		return fmt.Sprintf("%s failed the %q check, got %v", name, fieldError.Tag(), fieldError.Value())
+	}
+}
+
+// checkConfigurationConsistency runs the checks spanning several fields that struct tags can't express.
+func checkConfigurationConsistency(cfg *Configuration) []string {
+	var problems []string
+
+	local, remote := cfg.Storage.Local, cfg.Storage.Remote
+
+	// NOTE: stage movements step one stage at a time, the stages must follow each other
+	if remote.StageNumber != local.StageNumber+1 {
+		problems = append(problems, fmt.Sprintf("remote stage number (%d) must directly follow the local stage number (%d)", remote.StageNumber, local.StageNumber))
+	}
+
+	stageSettings := []struct {
+		name  string
+		stage uint
+	}{
+		{"SETTINGS_DEFAULT_DATABASE_CREATION_STAGE", cfg.Settings.DefaultDatabaseCreationStage},
+		{"SETTINGS_PERSISTENCE_STAGE", cfg.Settings.PersistenceStage},
+	}
+	for _, setting := range stageSettings {
+		if setting.stage < local.StageNumber || setting.stage > remote.StageNumber {
+			problems = append(problems, fmt.Sprintf("%s must be between %d and %d, got %d", setting.name, local.StageNumber, remote.StageNumber, setting.stage))
+		}
+	}
+
+	if (remote.AccessKeyID == "") != (remote.SecretKey == "") {
+		problems = append(problems, "STORAGE_REMOTE_ACCESS_KEY_ID and STORAGE_REMOTE_SECRET_KEY must be set together")
+	}
+	if remote.CredentialsSource == "static" && (remote.AccessKeyID == "" || remote.SecretKey == "") {
+		problems = append(problems, "STORAGE_REMOTE_CREDENTIALS_SOURCE=static requires STORAGE_REMOTE_ACCESS_KEY_ID and STORAGE_REMOTE_SECRET_KEY")
+	}
+	if remote.RoleExternalID != "" && remote.RoleARN == "" {
+		problems = append(problems, "STORAGE_REMOTE_ROLE_EXTERNAL_ID requires STORAGE_REMOTE_ROLE_ARN")
+	}
+
+	if remote.PresignExpirySeconds > remote.PresignMaxExpirySeconds {
+		problems = append(problems, fmt.Sprintf("STORAGE_REMOTE_PRESIGN_EXPIRY_SECONDS (%d) must not exceed STORAGE_REMOTE_PRESIGN_MAX_EXPIRY_SECONDS (%d)", remote.PresignExpirySeconds, remote.PresignMaxExpirySeconds))
+	}
+
+	if local.EncryptionEnabled && len(cfg.Encryption.Keys) == 0 {
+		problems = append(problems, "STORAGE_LOCAL_ENCRYPTION_ENABLED requires at least one key in ENCRYPTION_KEYS")
+	}
+	if cfg.Backups.EncryptionEnabled && len(cfg.Encryption.Keys) == 0 {
+		problems = append(problems, "BACKUPS_ENCRYPTION_ENABLED requires at least one key in ENCRYPTION_KEYS")
+	}
+	if cfg.Encryption.ActiveKeyID != "" {
+		found := false
+		for _, entry := range cfg.Encryption.Keys {
+			if id, _, _ := strings.Cut(strings.TrimSpace(entry.Value()), ":"); id == cfg.Encryption.ActiveKeyID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("ENCRYPTION_ACTIVE_KEY_ID %q doesn't match any key of ENCRYPTION_KEYS", cfg.Encryption.ActiveKeyID))
+		}
+	}
+
+	if len(remote.Tenants) > 0 && remote.TenantSeparator == "" {
+		problems = append(problems, "STORAGE_REMOTE_TENANTS requires STORAGE_REMOTE_TENANT_SEPARATOR")
+	}
+	// NOTE: the tenant of a database is read from its name, a separator no name can hold would route nothing
+	if len(remote.Tenants) > 0 && remote.TenantSeparator != "" && ValidateDatabaseName("a"+remote.TenantSeparator+"a") != nil {
+		problems = append(problems, "STORAGE_REMOTE_TENANT_SEPARATOR must only contain lowercase letters, digits, _ and -, the characters of the database names")
+	}
+	tenants := map[string]bool{}
+	for _, entry := range remote.Tenants {
+		fields := strings.SplitN(strings.TrimSpace(entry.Value()), ":", 4)
+		switch {
+		case (len(fields) != 2 && len(fields) != 4) || fields[0] == "" || fields[1] == "":
+			problems = append(problems, "invalid STORAGE_REMOTE_TENANTS entry, expected <tenant>:<bucket>[:<access key id>:<secret key>]")
+			continue
+		case len(fields) == 4 && (fields[2] == "" || fields[3] == ""):
+			problems = append(problems, fmt.Sprintf("the access key id and secret key of tenant %s in STORAGE_REMOTE_TENANTS must be set together", fields[0]))
+		case strings.Contains(fields[0], "/") || (remote.TenantSeparator != "" && strings.Contains(fields[0], remote.TenantSeparator)):
+			problems = append(problems, fmt.Sprintf("tenant %s in STORAGE_REMOTE_TENANTS must not contain / or STORAGE_REMOTE_TENANT_SEPARATOR", fields[0]))
+		case ValidateDatabaseName(fields[0]) != nil:
+			problems = append(problems, fmt.Sprintf("tenant %s in STORAGE_REMOTE_TENANTS must follow the naming scheme of the databases", fields[0]))
+		case tenants[fields[0]]:
+			problems = append(problems, fmt.Sprintf("duplicate tenant %s in STORAGE_REMOTE_TENANTS", fields[0]))
+		}
+		tenants[fields[0]] = true
+	}
+
+	if cfg.Policies.Enabled && len(cfg.Policies.Principals) == 0 {
+		problems = append(problems, "POLICIES_ENABLED requires at least one principal in POLICIES_PRINCIPALS")
+	}
+	principals := map[string]bool{}
+	for _, entry := range cfg.Policies.Principals {
+		name, token, found := strings.Cut(strings.TrimSpace(entry.Value()), ":")
+		switch {
+		case !found || name == "" || token == "":
+			problems = append(problems, "invalid POLICIES_PRINCIPALS entry, expected <principal>:<token>")
+		case principals[name]:
+			problems = append(problems, fmt.Sprintf("duplicate principal %s in POLICIES_PRINCIPALS", name))
+		}
+		principals[name] = true
+	}
+	for _, name := range cfg.Policies.UnmaskedPrincipals {
+		if !principals[name] {
+			problems = append(problems, fmt.Sprintf("POLICIES_UNMASKED_PRINCIPALS names %s, which is not in POLICIES_PRINCIPALS", name))
+		}
+	}
+
+	statementTenants := map[string]bool{}
+	for _, entry := range cfg.Statements.Policies {
+		tenant, rules, found := strings.Cut(strings.TrimSpace(entry), ":")
+		switch {
+		case !found || tenant == "" || rules == "":
+			problems = append(problems, "invalid STATEMENTS_POLICIES entry, expected <tenant>:<rule>[+<rule>]")
+			continue
+		case statementTenants[tenant]:
+			problems = append(problems, fmt.Sprintf("duplicate tenant %s in STATEMENTS_POLICIES", tenant))
+		}
+		statementTenants[tenant] = true
+
+		for _, rule := range strings.Split(rules, "+") {
+			if problem := statementRuleProblem(rule); problem != "" {
+				problems = append(problems, fmt.Sprintf("invalid rule %q of tenant %s in STATEMENTS_POLICIES, %s", rule, tenant, problem))
+			}
+		}
+	}
+
+	for _, name := range cfg.Statements.AdhocPrincipals {
+		if name != "*" && !principals[name] {
+			problems = append(problems, fmt.Sprintf("STATEMENTS_ADHOC_PRINCIPALS names %s, which is not in POLICIES_PRINCIPALS", name))
+		}
+	}
+
+	if cfg.Budgets.Enabled && !cfg.Policies.Enabled {
+		problems = append(problems, "BUDGETS_ENABLED requires POLICIES_ENABLED, the budgets apply to the principals")
+	}
+	problems = append(problems, BudgetLimitsProblems(cfg.Budgets.Limits, principals)...)
+
+	for _, sink := range cfg.Audit.Sinks {
+		if sink == "kafka" && len(cfg.Audit.KafkaBrokers) == 0 {
+			problems = append(problems, "AUDIT_SINKS=kafka requires AUDIT_KAFKA_BROKERS")
+		}
+	}
+
+	if cfg.Backups.Enabled && cfg.Backups.KeepHourly+cfg.Backups.KeepDaily+cfg.Backups.KeepWeekly == 0 {
+		problems = append(problems, "BACKUPS_ENABLED requires at least one of BACKUPS_KEEP_HOURLY, BACKUPS_KEEP_DAILY and BACKUPS_KEEP_WEEKLY")
+	}
+
+	for _, stage := range []struct {
+		name    string
+		pragmas []string
+	}{
+		{"STORAGE_LOCAL_PRAGMAS", cfg.Storage.Local.Pragmas},
+		{"STORAGE_REMOTE_PRAGMAS", cfg.Storage.Remote.Pragmas},
+	} {
+		for _, pragma := range stage.pragmas {
+			if !pragmaPattern.MatchString(pragma) {
+				problems = append(problems, fmt.Sprintf("invalid pragma %q in %s, expected <name>=<value> with a value made of letters, digits and _, optionally negative", pragma, stage.name))
+			}
+		}
+	}
+
+	// NOTE: objects written under these prefixes are listed and pruned by their owner, sharing one would mix them up
+	prefixes := []struct{ name, value string }{
+		{"AUDIT_S3_PREFIX", cfg.Audit.S3Prefix},
+		{"BACKUPS_PREFIX", cfg.Backups.Prefix},
+		{"BUDGETS_PREFIX", cfg.Budgets.Prefix},
+		{"CATALOG_PREFIX", cfg.Catalog.Prefix},
+		{"COORDINATION_LEASE_PREFIX", cfg.Coordination.LeasePrefix},
+		{"METERING_PREFIX", cfg.Metering.Prefix},
+	}
+	for i, first := range prefixes {
+		for _, second := range prefixes[i+1:] {
+			if first.value != "" && second.value != "" && (strings.HasPrefix(first.value, second.value) || strings.HasPrefix(second.value, first.value)) {
+				problems = append(problems, fmt.Sprintf("%s (%s) and %s (%s) must not overlap", first.name, first.value, second.name, second.value))
+			}
+		}
+	}
+
+	if cfg.Replication.Role == "follower" {
+		if cfg.Settings.AutoStageMovement {
+			problems = append(problems, "REPLICATION_ROLE=follower requires SETTINGS_AUTO_STAGE_MOVEMENT=false, followers never move databases")
+		}
+		if cfg.Backups.Enabled {
+			problems = append(problems, "REPLICATION_ROLE=follower requires BACKUPS_ENABLED=false, backups are taken by the primary")
+		}
+		if cfg.Catalog.BackupIntervalSeconds > 0 {
+			problems = append(problems, "REPLICATION_ROLE=follower requires CATALOG_BACKUP_INTERVAL_SECONDS=0, the catalog is snapshotted by the primary")
+		}
+	}
+
+	if cfg.Replication.Role == "standby" {
+		if !cfg.Coordination.Enabled {
+			problems = append(problems, "REPLICATION_ROLE=standby requires COORDINATION_ENABLED=true, the leases fence the active instance once the standby takes over")
+		}
+		if cfg.Backups.Enabled {
+			problems = append(problems, "REPLICATION_ROLE=standby requires BACKUPS_ENABLED=false, backups are taken by the active instance")
+		}
+		if cfg.Catalog.BackupIntervalSeconds > 0 {
+			problems = append(problems, "REPLICATION_ROLE=standby requires CATALOG_BACKUP_INTERVAL_SECONDS=0, the catalog is snapshotted by the active instance")
+		}
+	}
+
+	if cfg.Coordination.Enabled {
+		if cfg.Coordination.RenewIntervalSeconds*2 > cfg.Coordination.LeaseSeconds {
+			problems = append(problems, fmt.Sprintf("COORDINATION_RENEW_INTERVAL_SECONDS (%d) must be at most half of COORDINATION_LEASE_SECONDS (%d)", cfg.Coordination.RenewIntervalSeconds, cfg.Coordination.LeaseSeconds))
+		}
+	}
+
+	if remote.Required && !remote.Enabled {
+		problems = append(problems, "STORAGE_REMOTE_REQUIRED requires STORAGE_REMOTE_ENABLED")
+	}
+	if remote.Required && remote.BucketName == "" {
+		problems = append(problems, "STORAGE_REMOTE_REQUIRED requires STORAGE_REMOTE_BUCKET_NAME")
+	}
+
+	if cfg.Memory.CachePercent+cfg.Memory.ResultsPercent > cfg.Memory.ShedPercent {
+		problems = append(problems, fmt.Sprintf("MEMORY_CACHE_PERCENT (%d) and MEMORY_RESULTS_PERCENT (%d) must add up to at most MEMORY_SHED_PERCENT (%d)", cfg.Memory.CachePercent, cfg.Memory.ResultsPercent, cfg.Memory.ShedPercent))
+	}
+
+	if cfg.Pgwire.Enabled {
+		if cfg.Pgwire.Password.Value() == "" && (!cfg.Policies.Enabled || len(cfg.Policies.Principals) == 0) {
+			problems = append(problems, "PGWIRE_ENABLED=true requires PGWIRE_PASSWORD or POLICIES_PRINCIPALS, the sessions must authenticate")
+		}
+		if (cfg.Pgwire.TLSCertPath == "") != (cfg.Pgwire.TLSKeyPath == "") {
+			problems = append(problems, "PGWIRE_TLS_CERT_PATH and PGWIRE_TLS_KEY_PATH must be set together")
+		}
+		if cfg.Pgwire.Port == cfg.Server.Port {
+			problems = append(problems, fmt.Sprintf("PGWIRE_PORT (%d) must differ from SERVER_PORT", cfg.Pgwire.Port))
+		}
+	}
+
+	if dsn := cfg.Logging.ErrorReportingDSN.Value(); dsn != "" {
+		if _, _, err := parseReportingDSN(dsn, cfg.Server.Version); err != nil {
+			problems = append(problems, fmt.Sprintf("LOGGING_ERROR_REPORTING_DSN is invalid: %v", err))
+		}
+	}
+
+	return problems
+}
+
+// NOTE: the pragmas end up in the connection strings, the values are restricted to keep them from running anything else
+var pragmaPattern = regexp.MustCompile(`^[a-z_]+=-?[A-Za-z0-9_]+$`)
+
+// statementRuleProblem describes what is wrong with a rule of STATEMENTS_POLICIES, empty when it is valid.
+func statementRuleProblem(rule string) string {
+	name, value, _ := strings.Cut(rule, "=")
+	switch name {
+	case "deny_ddl", "deny_attach", "deny_pragma":
+		if value != "" {
+			return "it takes no value"
+		}
+	case "max_rows":
+		if rows, err := strconv.Atoi(value); err != nil || rows <= 0 {
+			return "expected max_rows=<positive number>"
+		}
+	case "read_only":
+		for _, endpoint := range strings.Split(value, "|") {
+			if endpoint != "query" && endpoint != "execute" && endpoint != "pgwire" {
+				return "expected read_only=<endpoint>[|<endpoint>] with the endpoints query, execute and pgwire"
+			}
+		}
+	default:
+		return "expected deny_ddl, deny_attach, deny_pragma, read_only or max_rows"
+	}
+	return ""
+}
+
+// budgetProblem describes what is wrong with a budget of BUDGETS_LIMITS, empty when it is valid.
+// BudgetLimitsProblems returns what is wrong with the entries of BUDGETS_LIMITS, given the configured principals.
+func BudgetLimitsProblems(entries []string, principals map[string]bool) []string {
+	var problems []string
+	budgetPrincipals := map[string]bool{}
+	for _, entry := range entries {
+		principal, limits, found := strings.Cut(strings.TrimSpace(entry), ":")
+		switch {
+		case !found || principal == "" || limits == "":
+			problems = append(problems, "invalid BUDGETS_LIMITS entry, expected <principal>:<budget>[+<budget>]")
+			continue
+		case principal != "*" && !principals[principal]:
+			problems = append(problems, fmt.Sprintf("BUDGETS_LIMITS names %s, which is not in POLICIES_PRINCIPALS", principal))
+		case budgetPrincipals[principal]:
+			problems = append(problems, fmt.Sprintf("duplicate principal %s in BUDGETS_LIMITS", principal))
+		}
+		budgetPrincipals[principal] = true
+
+		for _, limit := range strings.Split(limits, "+") {
+			if problem := budgetProblem(limit); problem != "" {
+				problems = append(problems, fmt.Sprintf("invalid budget %q of principal %s in BUDGETS_LIMITS, %s", limit, principal, problem))
+			}
+		}
+	}
+	return problems
+}
+
+func budgetProblem(limit string) string {
+	name, value, _ := strings.Cut(limit, "=")
+	switch name {
+	case "daily_queries", "monthly_queries", "daily_bytes", "monthly_bytes":
+		if amount, err := strconv.ParseInt(value, 10, 64); err != nil || amount <= 0 {
+			return fmt.Sprintf("expected %s=<positive number>", name)
+		}
+	case "daily_cost", "monthly_cost":
+		if amount, err := strconv.ParseFloat(value, 64); err != nil || amount <= 0 {
+			return fmt.Sprintf("expected %s=<positive amount of dollars>", name)
+		}
+	default:
+		return "expected daily_queries, monthly_queries, daily_bytes, monthly_bytes, daily_cost or monthly_cost"
+	}
+	return ""
+}
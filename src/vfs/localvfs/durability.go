@@ -0,0 +1,97 @@
+package localvfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// NOTE: fsync on every sync request, the default
+	syncModeFull = "full"
+	// NOTE: fdatasync on every sync request, skipping metadata not needed to read the data back
+	syncModeDataOnly = "dataonly"
+	// NOTE: sync requests return immediately and a background flusher syncs dirty files at a fixed interval
+	syncModeBatched = "batched"
+	// NOTE: never sync, local copies can be re-fetched from the remote stage
+	syncModeNone = "none"
+)
+
+// NOTE: files with writes waiting for the batched flusher
+var (
+	pendingSyncsMtx sync.Mutex
+	pendingSyncs    = make(map[*diskFile]struct{})
+)
+
+func validateSyncMode(mode string) error {
+	switch mode {
+	case syncModeFull, syncModeDataOnly, syncModeBatched, syncModeNone:
+		return nil
+	default:
+		return fmt.Errorf("invalid sync mode %q, valid modes are %s, %s, %s and %s", mode, syncModeFull, syncModeDataOnly, syncModeBatched, syncModeNone)
+	}
+}
+
+// syncFile applies the configured durability mode to a sync request.
+func (f *diskFile) syncFile() error {
+	switch utils.Config.Storage.Local.SyncMode {
+	case syncModeNone:
+		return nil
+	case syncModeBatched:
+		pendingSyncsMtx.Lock()
+		pendingSyncs[f] = struct{}{}
+		pendingSyncsMtx.Unlock()
+		return nil
+	case syncModeDataOnly:
+		return fdatasync(f.file)
+	default:
+		return f.file.Sync()
+	}
+}
+
+// flushPendingSync syncs the file right away if it is waiting for the batched flusher, used before closing it.
+func (f *diskFile) flushPendingSync() error {
+	pendingSyncsMtx.Lock()
+	_, pending := pendingSyncs[f]
+	delete(pendingSyncs, f)
+	pendingSyncsMtx.Unlock()
+
+	if !pending {
+		return nil
+	}
+	return f.file.Sync()
+}
+
+// PendingSyncs returns the number of files waiting for the batched flusher.
+func PendingSyncs() int {
+	pendingSyncsMtx.Lock()
+	defer pendingSyncsMtx.Unlock()
+
+	return len(pendingSyncs)
+}
+
+func startBatchedSyncFlusher() {
+	interval := time.Duration(utils.Config.Storage.Local.SyncIntervalMilliseconds) * time.Millisecond
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			pendingSyncsMtx.Lock()
+			files := pendingSyncs
+			pendingSyncs = make(map[*diskFile]struct{})
+			pendingSyncsMtx.Unlock()
+
+			for file := range files {
+				if err := file.file.Sync(); err != nil {
+					utils.VFSLogger.Error("Batched sync of local file failed.", zap.String("name", file.name), zap.Error(err))
+				}
+			}
+		}
+	}()
+}
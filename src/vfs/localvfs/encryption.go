@@ -0,0 +1,154 @@
+package localvfs
+
+import (
+	"crypto/aes"
+	"fmt"
+	"io"
+
+	"persisto/src/utils"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/xts"
+)
+
+// NOTE: files are encrypted in 512 bytes sectors, the smallest SQLite page size, using the sector number as tweak
+const encryptionSectorSize = 512
+
+// AES-256-XTS takes two 256 bits keys
+const encryptionKeyLength = 64
+
+var localCipher *xts.Cipher
+
+func setupEncryption() error {
+	localCipher = nil
+	if !utils.Config.Storage.Local.EncryptionEnabled {
+		return nil
+	}
+
+	key, err := utils.GetActiveEncryptionKey()
+	if err != nil {
+		return fmt.Errorf("failed to get local stage encryption key: %w", err)
+	}
+
+	derived, err := utils.DeriveEncryptionKey(key, "local-stage", encryptionKeyLength)
+	if err != nil {
+		return fmt.Errorf("failed to derive local stage encryption key: %w", err)
+	}
+
+	localCipher, err = xts.NewCipher(aes.NewCipher, derived)
+	if err != nil {
+		return fmt.Errorf("failed to create local stage cipher: %w", err)
+	}
+
+	utils.VFSLogger.Info("Local stage encryption enabled.", zap.String("keyId", key.ID))
+	return nil
+}
+
+func sectorFloor(i int64) int64 {
+	return i &^ (encryptionSectorSize - 1)
+}
+
+func sectorCeil(i int64) int64 {
+	return (i + encryptionSectorSize - 1) &^ (encryptionSectorSize - 1)
+}
+
+// encryptedFile wraps a diskFile so everything reaching the disk is encrypted, locking, quota and shared memory are
+// left to the underlying file.
+type encryptedFile struct {
+	*diskFile
+	cipher *xts.Cipher
+	sector [encryptionSectorSize]byte
+}
+
+func (f *encryptedFile) ReadAt(b []byte, off int64) (n int, err error) {
+	start := sectorFloor(off)
+	end := sectorCeil(off + int64(len(b)))
+
+	for ; start < end; start += encryptionSectorSize {
+		m, err := f.diskFile.ReadAt(f.sector[:], start)
+		if m != encryptionSectorSize {
+			// NOTE: a partially written trailing sector can't be decrypted and is treated as missing
+			if err == nil || err == io.EOF {
+				return n, io.EOF
+			}
+			return n, err
+		}
+
+		f.cipher.Decrypt(f.sector[:], f.sector[:], uint64(start/encryptionSectorSize))
+
+		data := f.sector[:]
+		if off > start {
+			data = data[off-start:]
+		}
+		n += copy(b[n:], data)
+	}
+
+	return n, nil
+}
+
+func (f *encryptedFile) WriteAt(b []byte, off int64) (n int, err error) {
+	start := sectorFloor(off)
+	end := sectorCeil(off + int64(len(b)))
+
+	for ; start < end; start += encryptionSectorSize {
+		sectorNumber := uint64(start / encryptionSectorSize)
+		data := f.sector[:]
+
+		if off > start || len(b[n:]) < encryptionSectorSize {
+			// Partial sector write, the rest of the sector has to be preserved
+			m, err := f.diskFile.ReadAt(f.sector[:], start)
+			if m != encryptionSectorSize {
+				if err != nil && err != io.EOF {
+					return n, err
+				}
+				// NOTE: writing past the end of the file, the sector is zero padded
+				clear(f.sector[:])
+			} else {
+				f.cipher.Decrypt(f.sector[:], f.sector[:], sectorNumber)
+			}
+			if off > start {
+				data = data[off-start:]
+			}
+		}
+
+		written := copy(data, b[n:])
+		f.cipher.Encrypt(f.sector[:], f.sector[:], sectorNumber)
+
+		m, err := f.diskFile.WriteAt(f.sector[:], start)
+		if m != encryptionSectorSize {
+			if err == nil {
+				err = sqlite3.IOERR_WRITE
+			}
+			return n, err
+		}
+		n += written
+	}
+
+	return n, nil
+}
+
+func (f *encryptedFile) Truncate(size int64) error {
+	return f.diskFile.Truncate(sectorCeil(size))
+}
+
+func (f *encryptedFile) SizeHint(size int64) error {
+	return f.diskFile.SizeHint(sectorCeil(size))
+}
+
+func (f *encryptedFile) SectorSize() int {
+	return max(f.diskFile.SectorSize(), encryptionSectorSize)
+}
+
+func (f *encryptedFile) DeviceCharacteristics() vfs.DeviceCharacteristic {
+	// NOTE: small writes go through read-modify-write of a whole sector, so neighbouring bytes may be damaged on power
+	// loss and appends are no longer safe
+	return f.diskFile.DeviceCharacteristics() &^ (vfs.IOCAP_POWERSAFE_OVERWRITE | vfs.IOCAP_SAFE_APPEND)
+}
+
+var (
+	_ vfs.FileLockState    = &encryptedFile{}
+	_ vfs.FileSizeHint     = &encryptedFile{}
+	_ vfs.FileSharedMemory = &encryptedFile{}
+)
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package localvfs
+
+import "os"
+
+// fdatasync falls back to a full sync on platforms without fdatasync.
+func fdatasync(file *os.File) error {
+	return file.Sync()
+}
@@ -0,0 +1,55 @@
+package localvfs
+
+import (
+	"sync"
+
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// Used when the filesystem can't be queried
+const defaultSectorSize = 4096
+
+const (
+	minSectorSize = 512
+	maxSectorSize = 65536
+)
+
+// filesystemInfo describes what SQLite may assume about the filesystem a file lives on
+type filesystemInfo struct {
+	name            string
+	sectorSize      int
+	characteristics vfs.DeviceCharacteristic
+}
+
+var (
+	filesystemsMtx sync.Mutex
+	// NOTE: detection is done once per directory, files of a directory always share a filesystem
+	filesystems = make(map[string]filesystemInfo)
+)
+
+// filesystemInfoFor returns the detected characteristics of the filesystem holding the given directory.
+func filesystemInfoFor(directory string) filesystemInfo {
+	filesystemsMtx.Lock()
+	defer filesystemsMtx.Unlock()
+
+	if info, exists := filesystems[directory]; exists {
+		return info
+	}
+
+	info, err := detectFilesystem(directory)
+	if err != nil {
+		// NOTE: claim nothing on filesystems we know nothing about, SQLite then takes the safe paths
+		info = filesystemInfo{name: "unknown", sectorSize: defaultSectorSize}
+	}
+	info.sectorSize = sanitizeSectorSize(info.sectorSize)
+
+	filesystems[directory] = info
+	return info
+}
+
+func sanitizeSectorSize(size int) int {
+	if size < minSectorSize || size > maxSectorSize || size&(size-1) != 0 {
+		return defaultSectorSize
+	}
+	return size
+}
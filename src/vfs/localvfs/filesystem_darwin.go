@@ -0,0 +1,26 @@
+package localvfs
+
+import (
+	"github.com/ncruces/go-sqlite3/vfs"
+	"golang.org/x/sys/unix"
+)
+
+func detectFilesystem(directory string) (filesystemInfo, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(directory, &stat); err != nil {
+		return filesystemInfo{}, err
+	}
+
+	info := filesystemInfo{
+		name:       unix.ByteSliceToString(stat.Fstypename[:]),
+		sectorSize: int(stat.Bsize),
+	}
+
+	// NOTE: only local filesystems are known not to damage neighbouring bytes of an overwrite on power loss
+	switch info.name {
+	case "apfs", "hfs":
+		info.characteristics = vfs.IOCAP_POWERSAFE_OVERWRITE
+	}
+
+	return info, nil
+}
@@ -0,0 +1,53 @@
+package localvfs
+
+import (
+	"github.com/ncruces/go-sqlite3/vfs"
+	"golang.org/x/sys/unix"
+)
+
+func detectFilesystem(directory string) (filesystemInfo, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(directory, &stat); err != nil {
+		return filesystemInfo{}, err
+	}
+
+	info := filesystemInfo{sectorSize: int(stat.Bsize)}
+
+	// NOTE: none of these guarantee atomic sector writes through plain pwrite, only overwrites are known not to
+	// damage neighbouring bytes on power loss, network and userspace filesystems don't even promise that
+	switch uint32(stat.Type) {
+	case unix.EXT4_SUPER_MAGIC:
+		info.name = "ext4"
+		info.characteristics = vfs.IOCAP_POWERSAFE_OVERWRITE
+	case unix.XFS_SUPER_MAGIC:
+		info.name = "xfs"
+		info.characteristics = vfs.IOCAP_POWERSAFE_OVERWRITE
+	case unix.BTRFS_SUPER_MAGIC:
+		info.name = "btrfs"
+		info.characteristics = vfs.IOCAP_POWERSAFE_OVERWRITE
+	case unix.F2FS_SUPER_MAGIC:
+		info.name = "f2fs"
+		info.characteristics = vfs.IOCAP_POWERSAFE_OVERWRITE
+	case unix.OVERLAYFS_SUPER_MAGIC:
+		info.name = "overlayfs"
+		info.characteristics = vfs.IOCAP_POWERSAFE_OVERWRITE
+	case unix.TMPFS_MAGIC:
+		// NOTE: nothing survives a power loss anyway
+		info.name = "tmpfs"
+		info.characteristics = vfs.IOCAP_POWERSAFE_OVERWRITE
+	case unix.NFS_SUPER_MAGIC:
+		info.name = "nfs"
+	case unix.CIFS_SUPER_MAGIC, unix.SMB_SUPER_MAGIC, unix.SMB2_SUPER_MAGIC:
+		info.name = "smb"
+	case unix.FUSE_SUPER_MAGIC:
+		info.name = "fuse"
+	case unix.CEPH_SUPER_MAGIC:
+		info.name = "ceph"
+	case unix.V9FS_MAGIC:
+		info.name = "9p"
+	default:
+		info.name = "other"
+	}
+
+	return info, nil
+}
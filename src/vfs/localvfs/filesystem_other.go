@@ -0,0 +1,9 @@
+//go:build !(linux || darwin)
+
+package localvfs
+
+import "errors"
+
+func detectFilesystem(directory string) (filesystemInfo, error) {
+	return filesystemInfo{}, errors.New("filesystem detection not supported on this platform")
+}
@@ -6,19 +6,17 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"persisto/src/internal/journal"
 	"persisto/src/utils"
 
 	sqlite3 "github.com/ncruces/go-sqlite3"
 	"github.com/ncruces/go-sqlite3/vfs"
-)
-
-const (
-	diskSectorSize = 4096 // 4KB sectors (typical OS page size)
+	"go.uber.org/zap"
 )
 
 func RegisterLocalVfs() error {
@@ -37,6 +35,9 @@ func RegisterLocalVfs() error {
 		return fmt.Errorf("failed to get absolute path for local storage directory %s: %w", localStorageDir, err)
 	}
 
+	// NOTE: set when files are kept in the local storage directory, its usage is then measured
+	measured := utils.RemoteOffline()
+
 	// Check if directory exists
 	if _, err := os.Stat(absPath); os.IsNotExist(err) {
 		// Create the directory with appropriate permissions
@@ -45,6 +46,9 @@ func RegisterLocalVfs() error {
 		}
 	} else if err != nil {
 		return fmt.Errorf("failed to check local storage directory %s: %w", absPath, err)
+	} else if utils.RemoteOffline() {
+		// NOTE: the local stage holds the only copy of the databases while the remote stage is offline, it is kept
+		utils.VFSLogger.Info("Remote stage offline, keeping the content of the local storage directory.", zap.String("path", absPath))
 	} else {
 		// Directory exists, ensure it's empty as it will be managed by the program
 		entries, err := os.ReadDir(absPath)
@@ -52,28 +56,140 @@ func RegisterLocalVfs() error {
 			return fmt.Errorf("failed to read local storage directory %s: %w", absPath, err)
 		}
 
+		// NOTE: the local copies of the databases whose demotion was interrupted, or which were written while the remote
+		// stage was offline, may be the only ones holding their last writes, they are kept for their recovery to copy them
+		// to the remote stage
+		kept, err := journaledLocalCopies()
+		if err != nil {
+			return fmt.Errorf("failed to read the journal, the local storage directory %s isn't emptied: %w", absPath, err)
+		}
+
 		// Remove all existing files and subdirectories
 		for _, entry := range entries {
+			// NOTE: the disk cache of the remote sectors is meant to survive restarts
+			if entry.Name() == RemoteCacheDirectoryName && entry.IsDir() {
+				continue
+			}
+			if operation, found := kept[databaseFileOf(entry.Name())]; found && !entry.IsDir() {
+				utils.VFSLogger.Warn("Keeping the local copy of a database until it is recovered.", zap.String("file", entry.Name()), zap.String("operation", operation))
+				measured = true
+				continue
+			}
 			entryPath := filepath.Join(absPath, entry.Name())
+			discarded := FileInfo{Name: entry.Name(), FullPath: entryPath, IsDir: entry.IsDir()}
+			if info, err := entry.Info(); err == nil {
+				discarded.Size, discarded.ModTime = info.Size(), info.ModTime()
+			}
+			discardedAtStartup = append(discardedAtStartup, discarded)
 			if err := os.RemoveAll(entryPath); err != nil {
 				return fmt.Errorf("failed to remove existing content %s from local storage directory: %w", entryPath, err)
 			}
 		}
 	}
 
+	// NOTE: the directory was just emptied, usage starts from scratch, unless files were kept
+	usedBytes.Store(0)
+	if measured {
+		if _, err := ReconcileUsage(); err != nil {
+			return fmt.Errorf("failed to measure local storage directory %s: %w", absPath, err)
+		}
+	}
+
+	if err := setupTempDirectory(absPath); err != nil {
+		return err
+	}
+
+	if err := validateSyncMode(config.Storage.Local.SyncMode); err != nil {
+		return err
+	}
+	if config.Storage.Local.SyncMode == syncModeBatched {
+		startBatchedSyncFlusher()
+	}
+
+	if err := setupEncryption(); err != nil {
+		return err
+	}
+
+	filesystem := filesystemInfoFor(absPath)
+	storageFilesystem = filesystem
+	utils.VFSLogger.Info(
+		"Detected local storage filesystem.",
+		zap.String("filesystem", filesystem.name),
+		zap.Int("sectorSize", filesystem.sectorSize),
+		zap.Bool("powersafeOverwrite", filesystem.characteristics&vfs.IOCAP_POWERSAFE_OVERWRITE != 0),
+	)
+
 	// Register the VFS
 	vfs.Register("disk", diskVFS{})
 	return nil
 }
 
+// journaledLocalCopies returns the file names of the databases whose local copy the journal needs, those whose move
+// from the local stage was interrupted and those written while the remote stage was offline, and of the companions
+// holding tiered tables written since their last upload, along with the operation of their intent, see journal.Pending.
+func journaledLocalCopies() (map[string]string, error) {
+	intents, err := journal.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	kept := map[string]string{}
+	for _, intent := range intents {
+		if intent.Operation == journal.OperationOfflineWrite || (intent.Operation == journal.OperationMove && intent.SourceStage == utils.GetLocalStage()) {
+			kept[utils.DatabaseFileName(intent.Database)] = intent.Operation
+		}
+		// NOTE: the companion is named after the database file, see stages.TieredPath
+		if intent.Operation == journal.OperationTieredWrite {
+			kept[utils.DatabaseFileName(intent.Database)+tieredSuffix] = intent.Operation
+		}
+	}
+	return kept, nil
+}
+
+// NOTE: appended to the file name of a database for its companion, see stages.TieredSuffix
+const tieredSuffix = ".tiered"
+
+// databaseFileOf returns the file of the database a file of the local storage directory belongs to, e.g. its WAL.
+func databaseFileOf(name string) string {
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if file, found := strings.CutSuffix(name, suffix); found {
+			return file
+		}
+	}
+	return name
+}
+
 type diskVFS struct{}
 
+// NOTE: the filesystem of the local storage directory, detected when the VFS is registered
+var storageFilesystem filesystemInfo
+
+// Describe returns the filesystem of the local storage directory along with the sector size and the device
+// characteristics SQLite is told its database files have.
+func Describe() (filesystem string, sectorSize int, characteristics vfs.DeviceCharacteristic) {
+	return storageFilesystem.name, storageFilesystem.sectorSize, storageFilesystem.characteristics
+}
+
 type diskFile struct {
 	file     *os.File
 	name     string
 	lock     vfs.LockLevel
 	readOnly bool
 
+	// WAL-index shared memory, nil for files other than main databases or on unsupported platforms
+	shm vfs.SharedMemory
+
+	// Read-only memory mapping of main databases, nil when disabled or not mapped yet
+	mmap        []byte
+	mmapEnabled bool
+
+	// Block size and write guarantees of the underlying filesystem
+	filesystem filesystemInfo
+
+	// Temp files live in the scratch directory and count towards its own size cap
+	temp          bool
+	deleteOnClose bool
+
 	// Locking state
 	lockMtx  sync.Mutex
 	shared   int32
@@ -93,12 +209,43 @@ type fileLockState struct {
 	shared   int32
 	pending  bool
 	reserved bool
+
+	// NOTE: signaled whenever a lock is released, on mtx
+	released *sync.Cond
+	// NOTE: files opened on the path, guarded by globalLockMtx
+	opens int
+}
+
+// wait waits until ready holds or the deadline passes, it reports whether ready holds. The time waited is recorded for
+// the file. The mutex of the lock state must be held, it is released while waiting.
+func (state *fileLockState) wait(file string, deadline time.Time, ready func() bool) bool {
+	if ready() {
+		return true
+	}
+	before := time.Now()
+	defer func() { utils.RecordLockWait(file, time.Since(before)) }()
+
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		state.mtx.Lock()
+		defer state.mtx.Unlock()
+		state.released.Broadcast()
+	})
+	defer timer.Stop()
+
+	for !ready() {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		state.released.Wait()
+	}
+	return true
 }
 
 func (diskVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
 	// Support all standard SQLite file types
+	// NOTE: the super-journal is written next to the main database by the transactions spanning attached databases
 	const supportedTypes = vfs.OPEN_MAIN_DB | vfs.OPEN_TEMP_DB | vfs.OPEN_TRANSIENT_DB |
-		vfs.OPEN_MAIN_JOURNAL | vfs.OPEN_TEMP_JOURNAL | vfs.OPEN_SUBJOURNAL | vfs.OPEN_WAL
+		vfs.OPEN_MAIN_JOURNAL | vfs.OPEN_TEMP_JOURNAL | vfs.OPEN_SUBJOURNAL | vfs.OPEN_SUPER_JOURNAL | vfs.OPEN_WAL
 
 	if flags&supportedTypes == 0 {
 		return nil, flags, sqlite3.CANTOPEN
@@ -122,9 +269,21 @@ func (diskVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, er
 		osFlags |= os.O_EXCL
 	}
 
+	// NOTE: temp and transient files are routed to the scratch directory
+	isTemp := name == "" || flags&(vfs.OPEN_TEMP_DB|vfs.OPEN_TRANSIENT_DB|vfs.OPEN_TEMP_JOURNAL|vfs.OPEN_SUBJOURNAL) != 0
+
 	// Open the file
-	file, err := os.OpenFile(name, osFlags, 0644)
+	var file *os.File
+	var err error
+	if isTemp {
+		file, err = openTempFile(name, osFlags)
+	} else {
+		file, err = os.OpenFile(name, osFlags, 0644)
+	}
 	if err != nil {
+		if isTemp {
+			return nil, flags, sqlite3.IOERR_GETTEMPPATH
+		}
 		if os.IsNotExist(err) {
 			return nil, flags, sqlite3.CANTOPEN
 		}
@@ -132,7 +291,7 @@ func (diskVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, er
 	}
 
 	// Get absolute path for lock coordination
-	absPath, err := filepath.Abs(name)
+	absPath, err := filepath.Abs(file.Name())
 	if err != nil {
 		file.Close()
 		return nil, flags, sqlite3.IOERR
@@ -141,21 +300,57 @@ func (diskVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, er
 	// Initialize lock state for this file if not exists
 	globalLockMtx.Lock()
 	if _, exists := fileLocks[absPath]; !exists {
-		fileLocks[absPath] = &fileLockState{}
+		state := &fileLockState{}
+		state.released = sync.NewCond(&state.mtx)
+		fileLocks[absPath] = state
 	}
+	fileLocks[absPath].opens++
 	globalLockMtx.Unlock()
 
 	diskFile := &diskFile{
 		file:     file,
 		name:     absPath,
 		readOnly: flags&vfs.OPEN_READONLY != 0,
+		// NOTE: all connections to the same database must share the same -shm path for the WAL-index to be coherent
+		shm:         vfs.NewSharedMemory(absPath+"-shm", flags),
+		mmapEnabled: mmapSupported && utils.Config.Storage.Local.MmapEnabled && flags&vfs.OPEN_MAIN_DB != 0,
+		filesystem:  filesystemInfoFor(filepath.Dir(absPath)),
+		temp:        isTemp,
+		// NOTE: anonymous files are always temporary
+		deleteOnClose: flags&vfs.OPEN_DELETEONCLOSE != 0 || name == "",
+	}
+
+	if isTemp {
+		trackTempFile(absPath, true)
+	} else if flags&vfs.OPEN_CREATE != 0 {
+		recordInternalModification(absPath)
+	}
+
+	if localCipher != nil {
+		return &encryptedFile{diskFile: diskFile, cipher: localCipher}, flags, nil
 	}
 
 	return diskFile, flags, nil
 }
 
 func (diskVFS) Delete(name string, dirSync bool) error {
+	var size int64
+	if info, err := os.Stat(name); err == nil {
+		size = info.Size()
+	}
+
+	if absPath, err := filepath.Abs(name); err == nil {
+		recordInternalModification(absPath)
+	}
+
 	err := os.Remove(name)
+	if err == nil {
+		if isTempPath(name) {
+			tempUsedBytes.Add(-size)
+		} else {
+			addUsage(-size)
+		}
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
@@ -227,6 +422,16 @@ func (diskVFS) FullPathname(name string) (string, error) {
 }
 
 func (f *diskFile) Close() error {
+	if f.shm != nil {
+		f.shm.Close()
+	}
+
+	f.unmap()
+
+	if err := f.flushPendingSync(); err != nil {
+		return sqlite3.IOERR_FSYNC
+	}
+
 	if err := f.Unlock(vfs.LOCK_NONE); err != nil {
 		return err
 	}
@@ -237,14 +442,23 @@ func (f *diskFile) Close() error {
 		return sqlite3.IOERR_CLOSE
 	}
 
+	if f.temp {
+		trackTempFile(f.name, false)
+	}
+
+	if f.deleteOnClose {
+		if err := (diskVFS{}).Delete(f.name, false); err != nil {
+			return err
+		}
+	}
+
 	// Clean up lock state if no references remain
 	globalLockMtx.Lock()
 	if lockState, exists := fileLocks[f.name]; exists {
-		lockState.mtx.Lock()
-		if lockState.shared == 0 && !lockState.pending && !lockState.reserved {
+		lockState.opens--
+		if lockState.opens <= 0 {
 			delete(fileLocks, f.name)
 		}
-		lockState.mtx.Unlock()
 	}
 	globalLockMtx.Unlock()
 
@@ -252,6 +466,10 @@ func (f *diskFile) Close() error {
 }
 
 func (f *diskFile) ReadAt(b []byte, off int64) (n int, err error) {
+	if n, ok := f.readMapped(b, off); ok {
+		return n, nil
+	}
+
 	n, err = f.file.ReadAt(b, off)
 	if err != nil {
 		if err == io.EOF {
@@ -268,7 +486,25 @@ func (f *diskFile) WriteAt(b []byte, off int64) (n int, err error) {
 		return 0, sqlite3.IOERR_READ
 	}
 
+	current, err := f.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	// NOTE: only writes extending the file consume budget
+	growth := off + int64(len(b)) - current
+	if growth > 0 && !f.fits(growth) {
+		return 0, sqlite3.FULL
+	}
+
+	recordInternalModification(f.name)
+
 	n, err = f.file.WriteAt(b, off)
+	// NOTE: the mapping is shared so in place writes are visible through it, growth only needs a remap
+	if growth > 0 {
+		f.unmap()
+		f.addUsage(max(off+int64(n)-current, 0))
+	}
 	if err != nil {
 		return n, sqlite3.IOERR_WRITE
 	}
@@ -281,10 +517,23 @@ func (f *diskFile) Truncate(size int64) error {
 		return sqlite3.IOERR_READ
 	}
 
-	err := f.file.Truncate(size)
+	current, err := f.Size()
+	if err != nil {
+		return err
+	}
+
+	if size > current && !f.fits(size-current) {
+		return sqlite3.FULL
+	}
+
+	f.unmap()
+	recordInternalModification(f.name)
+
+	err = f.file.Truncate(size)
 	if err != nil {
 		return sqlite3.IOERR_TRUNCATE
 	}
+	f.addUsage(size - current)
 	return nil
 }
 
@@ -294,16 +543,13 @@ func (f *diskFile) Sync(flag vfs.SyncFlag) error {
 	}
 
 	var err error
-	switch flag {
-	case vfs.SYNC_NORMAL:
-		err = f.file.Sync()
-	case vfs.SYNC_FULL:
-		// Force all data to disk
-		err = f.file.Sync()
-	case vfs.SYNC_DATAONLY:
+	switch {
+	case flag&vfs.SYNC_DATAONLY != 0 && utils.Config.Storage.Local.SyncMode == syncModeFull:
 		// Sync data but not necessarily metadata
-		// On most systems, Sync() does both anyway
-		err = f.file.Sync()
+		err = fdatasync(f.file)
+	default:
+		// NOTE: the configured durability mode decides how hard the data is forced to disk
+		err = f.syncFile()
 	}
 
 	if err != nil {
@@ -320,8 +566,6 @@ func (f *diskFile) Size() (int64, error) {
 	return stat.Size(), nil
 }
 
-const localSpinWait = 25 * time.Microsecond
-
 func (f *diskFile) Lock(lock vfs.LockLevel) error {
 	if f.lock >= lock {
 		return nil
@@ -346,38 +590,65 @@ func (f *diskFile) Lock(lock vfs.LockLevel) error {
 	f.lockMtx.Lock()
 	defer f.lockMtx.Unlock()
 
+	// NOTE: the in-process state coordinates connections of this process, OS locks exclude external processes. The
+	// conflicting locks are waited for until they are released rather than failing right away, for at most the lock wait
+	// after which SQLite retries within its busy timeout.
+	deadline := time.Now().Add(utils.LockWait(utils.GetLocalStage()))
 	switch lock {
 	case vfs.LOCK_SHARED:
-		if lockState.pending {
+		f.lockMtx.Unlock()
+		acquired := lockState.wait(f.name, deadline, func() bool { return !lockState.pending })
+		f.lockMtx.Lock()
+		if !acquired {
+			utils.RecordLockBusy(f.name, lock)
 			return sqlite3.BUSY
 		}
+		if err := osLockShared(f.file); err != nil {
+			return err
+		}
 		lockState.shared++
 		f.shared++
+		f.remap()
 
 	case vfs.LOCK_RESERVED:
+		// NOTE: the connection holds a shared lock, waiting is given up once the writer holding the reserved lock waits for
+		// the readers to leave
+		f.lockMtx.Unlock()
+		lockState.wait(f.name, deadline, func() bool { return !lockState.reserved || lockState.pending })
+		f.lockMtx.Lock()
 		if lockState.reserved {
+			utils.RecordLockBusy(f.name, lock)
 			return sqlite3.BUSY
 		}
+		if err := osLockReserved(f.file); err != nil {
+			return err
+		}
 		lockState.reserved = true
 		f.reserved = true
 
 	case vfs.LOCK_EXCLUSIVE:
 		if f.lock < vfs.LOCK_PENDING {
+			if err := osLockPending(f.file); err != nil {
+				return err
+			}
 			f.lock = vfs.LOCK_PENDING
 			lockState.pending = true
 			f.pending = true
 		}
 
 		// Wait for other shared locks to be released
-		for before := time.Now(); lockState.shared > 1 || (lockState.shared > 0 && f.shared == 0); {
-			if time.Since(before) > localSpinWait {
-				return sqlite3.BUSY
-			}
-			lockState.mtx.Unlock()
-			f.lockMtx.Unlock()
-			runtime.Gosched()
-			f.lockMtx.Lock()
-			lockState.mtx.Lock()
+		holdsShared := f.shared > 0
+		readersLeft := func() bool { return lockState.shared <= 1 && (lockState.shared == 0 || holdsShared) }
+		f.lockMtx.Unlock()
+		acquired := lockState.wait(f.name, deadline, readersLeft)
+		f.lockMtx.Lock()
+		if !acquired {
+			utils.RecordLockBusy(f.name, lock)
+			return sqlite3.BUSY
+		}
+
+		if err := osLockExclusive(f.file); err != nil {
+			return err
 		}
 	}
 
@@ -405,6 +676,17 @@ func (f *diskFile) Unlock(lock vfs.LockLevel) error {
 	f.lockMtx.Lock()
 	defer f.lockMtx.Unlock()
 
+	// NOTE: SQLite only ever unlocks down to a shared lock or no lock at all
+	var err error
+	if lock >= vfs.LOCK_SHARED {
+		err = osDowngradeToShared(f.file)
+	} else {
+		err = osUnlockAll(f.file)
+	}
+	if err != nil {
+		return err
+	}
+
 	if f.lock >= vfs.LOCK_RESERVED && f.reserved {
 		lockState.reserved = false
 		f.reserved = false
@@ -418,6 +700,7 @@ func (f *diskFile) Unlock(lock vfs.LockLevel) error {
 		f.shared--
 	}
 	f.lock = lock
+	lockState.released.Broadcast()
 	return nil
 }
 
@@ -437,48 +720,51 @@ func (f *diskFile) CheckReservedLock() (bool, error) {
 
 	lockState.mtx.Lock()
 	defer lockState.mtx.Unlock()
-	return lockState.reserved, nil
+
+	if lockState.reserved {
+		return true, nil
+	}
+
+	// NOTE: an external process may hold the reserved lock
+	reserved, err := osReservedLocked(f.file)
+	if err != nil {
+		return false, sqlite3.IOERR_CHECKRESERVEDLOCK
+	}
+	return reserved, nil
 }
 
 func (f *diskFile) SectorSize() int {
-	return diskSectorSize
+	return f.filesystem.sectorSize
 }
 
 func (f *diskFile) DeviceCharacteristics() vfs.DeviceCharacteristic {
-	// Most modern filesystems support these characteristics
-	characteristics := vfs.IOCAP_ATOMIC512 | vfs.IOCAP_SAFE_APPEND
-
-	// Check if we're on a filesystem that supports atomic writes
-	// This is a simplified check - in practice, you might want to detect
-	// specific filesystems or use platform-specific APIs
-	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
-		characteristics |= vfs.IOCAP_ATOMIC1K | vfs.IOCAP_ATOMIC2K | vfs.IOCAP_ATOMIC4K
-	}
-
-	return characteristics
+	// NOTE: detected from the filesystem the file lives on, claiming atomic writes the filesystem doesn't provide
+	// would let SQLite skip journaling steps it needs
+	return f.filesystem.characteristics
 }
 
 // Interface implementations
 var (
-	_ vfs.FileLockState = &diskFile{}
-	_ vfs.FileSizeHint  = &diskFile{}
+	_ vfs.FileLockState    = &diskFile{}
+	_ vfs.FileSizeHint     = &diskFile{}
+	_ vfs.FileSharedMemory = &diskFile{}
 )
 
 func (f *diskFile) SizeHint(size int64) error {
-	// Pre-allocate space if the OS supports it
-	// This is optional but can improve performance
+	// Pre-allocate space if the OS supports it, this reserves the blocks up front and limits fragmentation during
+	// bulk loads, the file size itself is left untouched
 	if size > 0 {
 		current, err := f.Size()
 		if err != nil {
 			return err
 		}
 		if size > current {
-			// Try to extend the file (this may not work on all filesystems)
-			if err := f.file.Truncate(size); err != nil {
-				return err
+			if !f.fits(size - current) {
+				return sqlite3.FULL
 			}
-			if err := f.file.Truncate(current); err != nil {
-				return err
+			// NOTE: preallocation is only an optimization, filesystems not supporting it are fine
+			if err := preallocate(f.file, current, size); err != nil {
+				utils.VFSSampledLogger.Debug("Failed to preallocate local file.", zap.String("name", f.name), zap.Int64("size", size), zap.Error(err))
 			}
 		}
 	}
@@ -489,6 +775,11 @@ func (f *diskFile) LockState() vfs.LockLevel {
 	return f.lock
 }
 
+// SharedMemory returns the WAL-index shared memory of the file, allowing local databases to run in WAL mode.
+func (f *diskFile) SharedMemory() vfs.SharedMemory {
+	return f.shm
+}
+
 // TestDB creates a temporary database file for testing
 func LocalTestDB(tb testing.TB, params ...url.Values) string {
 	tb.Helper()
@@ -572,6 +863,18 @@ type FileInfo struct {
 	IsDir    bool
 }
 
+// NOTE: entries of the local storage directory removed when the VFS was registered
+var discardedAtStartup []FileInfo
+
+// RemoteCacheDirectoryName is the directory of the local storage holding the disk cache of the remote sectors. It is
+// managed by the remote VFS, kept at startup and left out of the usage of the stage.
+const RemoteCacheDirectoryName = ".remote-cache"
+
+// DiscardedAtStartup returns the entries the local storage directory held before it was emptied at startup.
+func DiscardedAtStartup() []FileInfo {
+	return discardedAtStartup
+}
+
 // ListFiles lists all files in the specified directory
 func ListFiles(dirPath string) ([]FileInfo, error) {
 	files, err := os.ReadDir(dirPath)
@@ -0,0 +1,61 @@
+package localvfs
+
+import (
+	"persisto/src/utils"
+
+	"github.com/ncruces/go-sqlite3/vfs"
+	"go.uber.org/zap"
+)
+
+// remap refreshes the read-only mapping of the file to its current size, it is called whenever a shared lock is
+// acquired since the size can only change under an exclusive lock. Failures silently fall back to regular reads.
+func (f *diskFile) remap() {
+	if !f.mmapEnabled {
+		return
+	}
+
+	size, err := f.Size()
+	if err != nil {
+		f.unmap()
+		return
+	}
+
+	size = min(size, utils.Config.Storage.Local.MmapMaxBytes)
+	if int64(len(f.mmap)) == size {
+		return
+	}
+
+	f.unmap()
+
+	if size == 0 {
+		return
+	}
+
+	data, err := mmapFile(f.file, size)
+	if err != nil {
+		utils.VFSSampledLogger.Debug("Failed to memory map local file, falling back to regular reads.", zap.String("name", f.name), zap.Error(err))
+		return
+	}
+	f.mmap = data
+}
+
+func (f *diskFile) unmap() {
+	if f.mmap == nil {
+		return
+	}
+
+	if err := munmapFile(f.mmap); err != nil {
+		utils.VFSLogger.Warn("Failed to unmap local file.", zap.String("name", f.name), zap.Error(err))
+	}
+	f.mmap = nil
+}
+
+// readMapped serves a read from the mapping when it covers the requested range and the file is locked, reporting
+// false when the caller has to fall back to a regular read.
+func (f *diskFile) readMapped(b []byte, off int64) (int, bool) {
+	// NOTE: without a lock another connection may shrink the file, touching unmapped pages would fault
+	if f.mmap == nil || f.lock < vfs.LOCK_SHARED || off+int64(len(b)) > int64(len(f.mmap)) {
+		return 0, false
+	}
+	return copy(b, f.mmap[off:]), true
+}
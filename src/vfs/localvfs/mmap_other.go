@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package localvfs
+
+import (
+	"errors"
+	"os"
+)
+
+const mmapSupported = false
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("memory mapped files are not supported on this platform")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
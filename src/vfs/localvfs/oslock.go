@@ -0,0 +1,80 @@
+package localvfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	sqlite3 "github.com/ncruces/go-sqlite3"
+)
+
+// Byte ranges locked by SQLite's own unix VFS, using the same ones keeps external processes (sqlite3 CLI,
+// backup tools) correctly excluded while persisto holds a lock on the database.
+const (
+	pendingByte  = 0x40000000
+	reservedByte = pendingByte + 1
+	sharedFirst  = pendingByte + 2
+	sharedSize   = 510
+)
+
+// osLockShared acquires the OS level shared lock, guarding the shared range with the pending byte so no new
+// reader sneaks in while a writer is waiting for an exclusive lock.
+func osLockShared(file *os.File) error {
+	if err := osLock(file, osReadLock, pendingByte, 1); err != nil {
+		return lockError(err, sqlite3.IOERR_RDLOCK)
+	}
+	defer osLock(file, osUnlock, pendingByte, 1)
+
+	if err := osLock(file, osReadLock, sharedFirst, sharedSize); err != nil {
+		return lockError(err, sqlite3.IOERR_RDLOCK)
+	}
+	return nil
+}
+
+func osLockReserved(file *os.File) error {
+	if err := osLock(file, osWriteLock, reservedByte, 1); err != nil {
+		return lockError(err, sqlite3.IOERR_LOCK)
+	}
+	return nil
+}
+
+func osLockPending(file *os.File) error {
+	if err := osLock(file, osWriteLock, pendingByte, 1); err != nil {
+		return lockError(err, sqlite3.IOERR_LOCK)
+	}
+	return nil
+}
+
+func osLockExclusive(file *os.File) error {
+	if err := osLock(file, osWriteLock, sharedFirst, sharedSize); err != nil {
+		return lockError(err, sqlite3.IOERR_LOCK)
+	}
+	return nil
+}
+
+// osDowngradeToShared keeps a read lock on the shared range and releases the pending and reserved bytes.
+func osDowngradeToShared(file *os.File) error {
+	if err := osLock(file, osReadLock, sharedFirst, sharedSize); err != nil {
+		return sqlite3.IOERR_RDLOCK
+	}
+	if err := osLock(file, osUnlock, pendingByte, 2); err != nil {
+		return sqlite3.IOERR_UNLOCK
+	}
+	return nil
+}
+
+func osUnlockAll(file *os.File) error {
+	// NOTE: a zero length covers the whole file
+	if err := osLock(file, osUnlock, 0, 0); err != nil {
+		return sqlite3.IOERR_UNLOCK
+	}
+	return nil
+}
+
+// lockError maps contention to SQLITE_BUSY and any other failure to the given I/O error.
+func lockError(err error, ioerr sqlite3.ExtendedErrorCode) error {
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EWOULDBLOCK) {
+		return sqlite3.BUSY
+	}
+	return ioerr
+}
@@ -0,0 +1,42 @@
+//go:build darwin || freebsd || netbsd || openbsd || dragonfly
+
+package localvfs
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	osReadLock  = unix.F_RDLCK
+	osWriteLock = unix.F_WRLCK
+	osUnlock    = unix.F_UNLCK
+)
+
+// osLock uses POSIX advisory locks, they are owned by the process so the in-process lock map remains responsible for
+// coordinating connections of this process.
+func osLock(file *os.File, lockType int16, start, length int64) error {
+	lock := unix.Flock_t{
+		Type:   lockType,
+		Whence: io.SeekStart,
+		Start:  start,
+		Len:    length,
+	}
+	return unix.FcntlFlock(file.Fd(), unix.F_SETLK, &lock)
+}
+
+// osReservedLocked reports whether another file descriptor holds the reserved byte.
+func osReservedLocked(file *os.File) (bool, error) {
+	lock := unix.Flock_t{
+		Type:   unix.F_WRLCK,
+		Whence: io.SeekStart,
+		Start:  reservedByte,
+		Len:    1,
+	}
+	if err := unix.FcntlFlock(file.Fd(), unix.F_GETLK, &lock); err != nil {
+		return false, err
+	}
+	return lock.Type != unix.F_UNLCK, nil
+}
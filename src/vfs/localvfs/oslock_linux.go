@@ -0,0 +1,40 @@
+package localvfs
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	osReadLock  = unix.F_RDLCK
+	osWriteLock = unix.F_WRLCK
+	osUnlock    = unix.F_UNLCK
+)
+
+// osLock uses open file description locks, unlike POSIX locks they are owned by the file descriptor rather than the
+// process, so they also exclude connections of this process and aren't dropped when another descriptor is closed.
+func osLock(file *os.File, lockType int16, start, length int64) error {
+	lock := unix.Flock_t{
+		Type:   lockType,
+		Whence: io.SeekStart,
+		Start:  start,
+		Len:    length,
+	}
+	return unix.FcntlFlock(file.Fd(), unix.F_OFD_SETLK, &lock)
+}
+
+// osReservedLocked reports whether another file descriptor holds the reserved byte.
+func osReservedLocked(file *os.File) (bool, error) {
+	lock := unix.Flock_t{
+		Type:   unix.F_WRLCK,
+		Whence: io.SeekStart,
+		Start:  reservedByte,
+		Len:    1,
+	}
+	if err := unix.FcntlFlock(file.Fd(), unix.F_OFD_GETLK, &lock); err != nil {
+		return false, err
+	}
+	return lock.Type != unix.F_UNLCK, nil
+}
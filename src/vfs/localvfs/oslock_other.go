@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package localvfs
+
+import "os"
+
+const (
+	osReadLock  = 0
+	osWriteLock = 1
+	osUnlock    = 2
+)
+
+// osLock is a no-op on platforms without advisory byte-range locks, only the in-process lock map applies.
+func osLock(file *os.File, lockType int16, start, length int64) error {
+	return nil
+}
+
+func osReservedLocked(file *os.File) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,25 @@
+package localvfs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves disk blocks up to size without changing the file size.
+func preallocate(file *os.File, current, size int64) error {
+	store := unix.Fstore_t{
+		Flags:   unix.F_ALLOCATEALL | unix.F_ALLOCATECONTIG,
+		Posmode: unix.F_PEOFPOSMODE,
+		Offset:  0,
+		Length:  size - current,
+	}
+
+	// NOTE: try to get a contiguous chunk first, a fragmented one otherwise
+	err := unix.FcntlFstore(file.Fd(), unix.F_PREALLOCATE, &store)
+	if err != nil {
+		store.Flags = unix.F_ALLOCATEALL
+		err = unix.FcntlFstore(file.Fd(), unix.F_PREALLOCATE, &store)
+	}
+	return err
+}
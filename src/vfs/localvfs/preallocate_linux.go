@@ -0,0 +1,17 @@
+package localvfs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves disk blocks up to size without changing the file size.
+func preallocate(file *os.File, current, size int64) error {
+	for {
+		err := unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_KEEP_SIZE, current, size-current)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
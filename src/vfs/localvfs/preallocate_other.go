@@ -0,0 +1,10 @@
+//go:build !(linux || darwin)
+
+package localvfs
+
+import "os"
+
+// preallocate is a no-op on platforms without a way to reserve blocks without changing the file size.
+func preallocate(file *os.File, current, size int64) error {
+	return nil
+}
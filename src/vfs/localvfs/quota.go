@@ -0,0 +1,100 @@
+package localvfs
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: bytes used by the files of the local stage, maintained incrementally by the disk VFS and periodically
+// reconciled with the directory content
+var usedBytes atomic.Int64
+
+// UsedBytes returns the number of bytes currently used by the local stage.
+func UsedBytes() int64 {
+	return usedBytes.Load()
+}
+
+// MaxBytes returns the configured local stage budget, zero meaning unlimited.
+func MaxBytes() int64 {
+	return utils.Config.Storage.Local.MaxSizeBytes
+}
+
+// AvailableBytes returns the bytes left in the local stage budget, or -1 when unlimited.
+func AvailableBytes() int64 {
+	maxBytes := MaxBytes()
+	if maxBytes <= 0 {
+		return -1
+	}
+	return max(maxBytes-UsedBytes(), 0)
+}
+
+// Fits reports whether size additional bytes fit in the local stage budget.
+func Fits(size int64) bool {
+	maxBytes := MaxBytes()
+	return maxBytes <= 0 || UsedBytes()+size <= maxBytes
+}
+
+// ReconcileUsage recomputes the local stage usage from the directory content, correcting any drift of the
+// incremental accounting (e.g. concurrent writers extending the same file).
+func ReconcileUsage() (int64, error) {
+	directory, err := GetLocalStorageDirectory()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	err = filepath.WalkDir(directory, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path == filepath.Join(directory, RemoteCacheDirectoryName) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// NOTE: file removed while walking
+			return nil
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	previous := usedBytes.Swap(total)
+	if previous != total {
+		utils.VFSLogger.Debug("Reconciled local stage usage.", zap.Int64("previous", previous), zap.Int64("current", total))
+	}
+
+	return total, nil
+}
+
+func (f *diskFile) fits(size int64) bool {
+	if f.temp {
+		return tempFits(size)
+	}
+	return Fits(size)
+}
+
+func (f *diskFile) addUsage(delta int64) {
+	if f.temp {
+		tempUsedBytes.Add(delta)
+		return
+	}
+	addUsage(delta)
+}
+
+func addUsage(delta int64) {
+	if delta != 0 {
+		usedBytes.Add(delta)
+	}
+}
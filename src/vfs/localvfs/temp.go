@@ -0,0 +1,121 @@
+package localvfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"persisto/src/utils"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: temp and transient SQLite files live in a dedicated scratch directory with its own size cap, apart from the
+// managed database files
+var (
+	tempDirectory string
+	tempUsedBytes atomic.Int64
+
+	openTempFilesMtx sync.Mutex
+	openTempFiles    = make(map[string]struct{})
+)
+
+// setupTempDirectory creates or empties the scratch directory and starts its cleanup.
+func setupTempDirectory(localDirectory string) error {
+	absPath, err := filepath.Abs(utils.Config.Storage.Local.TempDirectoryPath)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path for temp directory %s: %w", utils.Config.Storage.Local.TempDirectoryPath, err)
+	}
+
+	if absPath == localDirectory || strings.HasPrefix(absPath, localDirectory+string(filepath.Separator)) {
+		return fmt.Errorf("temp directory %s can't be inside the local storage directory %s", absPath, localDirectory)
+	}
+
+	if err := os.RemoveAll(absPath); err != nil {
+		return fmt.Errorf("failed to clean temp directory %s: %w", absPath, err)
+	}
+	if err := os.MkdirAll(absPath, 0755); err != nil {
+		return fmt.Errorf("failed to create temp directory %s: %w", absPath, err)
+	}
+
+	tempDirectory = absPath
+	tempUsedBytes.Store(0)
+
+	go cleanupTempDirectory()
+
+	return nil
+}
+
+// openTempFile opens a temp file in the scratch directory, creating a uniquely named one for anonymous files.
+func openTempFile(name string, osFlags int) (*os.File, error) {
+	if name == "" {
+		return os.CreateTemp(tempDirectory, "persisto-*.tmp")
+	}
+	return os.OpenFile(filepath.Join(tempDirectory, filepath.Base(name)), osFlags, 0644)
+}
+
+func isTempPath(path string) bool {
+	return tempDirectory != "" && filepath.Dir(path) == tempDirectory
+}
+
+func trackTempFile(path string, open bool) {
+	openTempFilesMtx.Lock()
+	defer openTempFilesMtx.Unlock()
+
+	if open {
+		openTempFiles[path] = struct{}{}
+	} else {
+		delete(openTempFiles, path)
+	}
+}
+
+// TempUsedBytes returns the number of bytes currently used by temp files.
+func TempUsedBytes() int64 {
+	return tempUsedBytes.Load()
+}
+
+func tempFits(size int64) bool {
+	maxBytes := utils.Config.Storage.Local.TempMaxSizeBytes
+	return maxBytes <= 0 || TempUsedBytes()+size <= maxBytes
+}
+
+// cleanupTempDirectory periodically removes temp files left behind, e.g. by connections that were never closed.
+func cleanupTempDirectory() {
+	maxAge := time.Duration(utils.Config.Storage.Local.TempMaxAgeSeconds) * time.Second
+
+	ticker := time.NewTicker(maxAge / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		entries, err := os.ReadDir(tempDirectory)
+		if err != nil {
+			utils.VFSLogger.Warn("Failed to read temp directory.", zap.String("directory", tempDirectory), zap.Error(err))
+			continue
+		}
+
+		for _, entry := range entries {
+			path := filepath.Join(tempDirectory, entry.Name())
+
+			openTempFilesMtx.Lock()
+			_, open := openTempFiles[path]
+			openTempFilesMtx.Unlock()
+
+			info, err := entry.Info()
+			if open || err != nil || time.Since(info.ModTime()) < maxAge {
+				continue
+			}
+
+			if err := os.Remove(path); err != nil {
+				utils.VFSLogger.Warn("Failed to remove stale temp file.", zap.String("path", path), zap.Error(err))
+				continue
+			}
+			tempUsedBytes.Add(-info.Size())
+
+			utils.VFSLogger.Debug("Removed stale temp file.", zap.String("path", path), zap.Duration("age", time.Since(info.ModTime())))
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package localvfs
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// NOTE: filesystem events arriving this soon after a modification made through the disk VFS are our own
+const internalModificationGrace = 2 * time.Second
+
+var (
+	internalModificationsMtx sync.Mutex
+	internalModifications    = make(map[string]time.Time)
+)
+
+// recordInternalModification marks the file as modified by persisto itself so the watcher ignores the resulting events.
+func recordInternalModification(path string) {
+	internalModificationsMtx.Lock()
+	defer internalModificationsMtx.Unlock()
+
+	internalModifications[path] = time.Now()
+}
+
+func isInternalModification(path string) bool {
+	internalModificationsMtx.Lock()
+	defer internalModificationsMtx.Unlock()
+
+	modifiedAt, exists := internalModifications[path]
+	if !exists {
+		return false
+	}
+	if time.Since(modifiedAt) > internalModificationGrace {
+		delete(internalModifications, path)
+		return false
+	}
+	return true
+}
+
+// WatchExternalChanges watches the local storage directory and calls onChange for database files modified or removed
+// outside persisto. It does nothing unless watching is enabled.
+func WatchExternalChanges(onChange func(path string, removed bool)) error {
+	if !utils.Config.Storage.Local.WatchEnabled {
+		return nil
+	}
+
+	directory, err := GetLocalStorageDirectory()
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(directory); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	utils.VFSLogger.Info("Watching local storage directory for external changes.", zap.String("directory", directory))
+
+	go func() {
+		defer watcher.Close()
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				// NOTE: only database files matter, journals and WAL files follow their database
+				if !strings.HasSuffix(event.Name, ".db") {
+					continue
+				}
+
+				removed := event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)
+				if !removed && !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+					continue
+				}
+
+				path, err := filepath.Abs(event.Name)
+				if err != nil || isInternalModification(path) {
+					continue
+				}
+
+				utils.VFSLogger.Warn("External change detected on local file.", zap.String("path", path), zap.String("operation", event.Op.String()))
+				onChange(path, removed)
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				utils.VFSLogger.Error("Local storage watcher error.", zap.Error(err))
+			}
+		}
+	}()
+
+	return nil
+}
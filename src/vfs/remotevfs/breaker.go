@@ -0,0 +1,173 @@
+package remotevfs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.uber.org/zap"
+)
+
+// NOTE: the circuit breaker opens once the remote operations keep failing, after failing over to the secondary endpoint
+// when there is one. While open every remote operation fails right away instead of going through the retries, and the
+// bucket is probed every cool-down period, the breaker closes at the first successful probe.
+
+var ErrRemoteUnavailable = errors.New("remote storage is failing, its operations are suspended")
+
+var ErrRemoteOffline = errors.New("remote storage is offline, the server started without it")
+
+type circuitBreaker struct {
+	mtx sync.Mutex
+
+	open                bool
+	openedAt            time.Time
+	consecutiveFailures int
+	lastError           string
+
+	trips    int64
+	rejected int64
+}
+
+var remoteCircuit = &circuitBreaker{}
+
+var (
+	closedListeners    []func(downtime time.Duration)
+	closedListenersMtx sync.Mutex
+)
+
+// CircuitStats is the state of the circuit breaker of the remote storage.
+type CircuitStats struct {
+	Open     bool       `json:"open" doc:"Whether the remote operations fail right away."`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+	// NOTE: the error which opened the circuit, or the last failed probe
+	LastError string `json:"last_error,omitempty"`
+	Trips     int64  `json:"trips" doc:"Times the circuit opened since the start."`
+	Rejected  int64  `json:"rejected" doc:"Remote operations failed right away since the start."`
+}
+
+// CircuitOpen reports whether the remote operations currently fail right away.
+func CircuitOpen() bool {
+	remoteCircuit.mtx.Lock()
+	defer remoteCircuit.mtx.Unlock()
+	return remoteCircuit.open
+}
+
+// OnCircuitClosed registers a listener called, in a goroutine of its own, with how long the circuit stayed open once
+// the remote storage is healthy again.
+func OnCircuitClosed(listener func(downtime time.Duration)) {
+	closedListenersMtx.Lock()
+	defer closedListenersMtx.Unlock()
+
+	closedListeners = append(closedListeners, listener)
+}
+
+// GetCircuitStats returns the state of the circuit breaker.
+func GetCircuitStats() CircuitStats {
+	remoteCircuit.mtx.Lock()
+	defer remoteCircuit.mtx.Unlock()
+
+	stats := CircuitStats{
+		Open:      remoteCircuit.open,
+		LastError: remoteCircuit.lastError,
+		Trips:     remoteCircuit.trips,
+		Rejected:  remoteCircuit.rejected,
+	}
+	if remoteCircuit.open {
+		openedAt := remoteCircuit.openedAt
+		stats.OpenedAt = &openedAt
+	}
+	return stats
+}
+
+func (breaker *circuitBreaker) allow() error {
+	if utils.RemoteOffline() {
+		return ErrRemoteOffline
+	}
+	if utils.Config.Storage.Remote.CircuitFailureThreshold == 0 {
+		return nil
+	}
+
+	breaker.mtx.Lock()
+	defer breaker.mtx.Unlock()
+
+	if breaker.open {
+		breaker.rejected++
+		return ErrRemoteUnavailable
+	}
+	return nil
+}
+
+func (breaker *circuitBreaker) record(err error) {
+	if utils.Config.Storage.Remote.CircuitFailureThreshold == 0 {
+		return
+	}
+
+	breaker.mtx.Lock()
+	defer breaker.mtx.Unlock()
+
+	if !isEndpointFailure(err) {
+		breaker.consecutiveFailures = 0
+		return
+	}
+
+	breaker.consecutiveFailures++
+	if breaker.open || breaker.consecutiveFailures < utils.Config.Storage.Remote.CircuitFailureThreshold {
+		return
+	}
+
+	utils.VFSLogger.Error(
+		"R2 - Remote storage keeps failing, suspending its operations.",
+		zap.Int("consecutiveFailures", breaker.consecutiveFailures),
+		zap.Int("cooldownSeconds", utils.Config.Storage.Remote.CircuitCooldownSeconds),
+		zap.Error(err),
+	)
+	breaker.open = true
+	breaker.openedAt = time.Now().UTC()
+	breaker.lastError = err.Error()
+	breaker.trips++
+	go breaker.probe()
+}
+
+// probe checks the bucket every cool-down period while the circuit is open and closes it once it answers again.
+func (breaker *circuitBreaker) probe() {
+	interval := time.Duration(utils.Config.Storage.Remote.CircuitCooldownSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), probeContextKey{}, true), interval)
+		_, err := getRemoteClient().HeadBucket(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(utils.Config.Storage.Remote.BucketName),
+		})
+		cancel()
+
+		if isEndpointFailure(err) {
+			breaker.mtx.Lock()
+			breaker.lastError = err.Error()
+			breaker.mtx.Unlock()
+			utils.VFSLogger.Debug("R2 - Remote storage still failing.", zap.Error(err))
+			continue
+		}
+
+		breaker.mtx.Lock()
+		breaker.open = false
+		breaker.consecutiveFailures = 0
+		breaker.lastError = ""
+		downtime := time.Since(breaker.openedAt)
+		breaker.mtx.Unlock()
+
+		utils.VFSLogger.Info("R2 - Remote storage healthy again, resuming its operations.", zap.Duration("downtime", downtime))
+
+		closedListenersMtx.Lock()
+		for _, listener := range closedListeners {
+			go listener(downtime)
+		}
+		closedListenersMtx.Unlock()
+		return
+	}
+}
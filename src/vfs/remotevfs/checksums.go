@@ -0,0 +1,200 @@
+package remotevfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"persisto/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.uber.org/zap"
+)
+
+// NOTE: with STORAGE_REMOTE_CHECKSUMS_ENABLED, every upload of a database stores the CRC-32C of each of its sectors in
+// a sidecar object, <key>.checksums, tied to the generation of the object it describes. The sectors fetched from the
+// bucket are checked against it: a mismatching run is fetched once more, in case the transfer garbled it, and then
+// fails the read with SQLITE_IOERR_CORRUPTFS and is reported to the corruption listeners. The objects without sidecar,
+// or whose sidecar describes another generation, e.g. written outside persisto, are read unchecked.
+const checksumsKeySuffix = ".checksums"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// sectorChecksums are the checksums of the sectors of a generation of an object, the last one covers the bytes left.
+type sectorChecksums struct {
+	Generation string   `json:"generation"`
+	Size       int64    `json:"size"`
+	SectorSize int64    `json:"sector_size"`
+	Sums       []uint32 `json:"sums"`
+}
+
+// ChecksumStats counts the sectors checked against their checksums since the start.
+type ChecksumStats struct {
+	Verified    int64 `json:"verified" doc:"Sectors fetched from the bucket and matching their checksum."`
+	Refetched   int64 `json:"refetched" doc:"Runs of sectors fetched again after a mismatch."`
+	Corruptions int64 `json:"corruptions" doc:"Sectors still mismatching once fetched again, reported as corrupted."`
+}
+
+var (
+	verifiedSectors  atomic.Int64
+	refetchedRuns    atomic.Int64
+	corruptedSectors atomic.Int64
+
+	corruptionListenersMtx sync.Mutex
+	corruptionListeners    []func(key string, sectorNum int64)
+)
+
+// GetChecksumStats returns the sectors checked against their checksums since the start.
+func GetChecksumStats() ChecksumStats {
+	return ChecksumStats{
+		Verified:    verifiedSectors.Load(),
+		Refetched:   refetchedRuns.Load(),
+		Corruptions: corruptedSectors.Load(),
+	}
+}
+
+// OnCorruption registers a listener called, in a goroutine of its own, with the object and the sector found corrupted.
+func OnCorruption(listener func(key string, sectorNum int64)) {
+	corruptionListenersMtx.Lock()
+	defer corruptionListenersMtx.Unlock()
+
+	corruptionListeners = append(corruptionListeners, listener)
+}
+
+func reportCorruption(key string, sectorNum int64) {
+	corruptedSectors.Add(1)
+	utils.VFSLogger.Error("R2 - Sector of remote object is corrupted.", zap.String("name", key), zap.Int64("sectorNum", sectorNum))
+
+	corruptionListenersMtx.Lock()
+	defer corruptionListenersMtx.Unlock()
+	for _, listener := range corruptionListeners {
+		go listener(key, sectorNum)
+	}
+}
+
+// checksummed reports whether the sectors of the object stored under the key get checksums, only those of the databases
+// do, the journals are short-lived.
+func checksummed(key string) bool {
+	if !utils.Config.Storage.Remote.ChecksumsEnabled {
+		return false
+	}
+	_, isDatabase := DatabaseNameFromKey(key)
+	return isDatabase
+}
+
+func checksumsKey(key string) string {
+	return key + checksumsKeySuffix
+}
+
+func computeChecksums(buf []byte, generation string) *sectorChecksums {
+	sums := &sectorChecksums{Generation: generation, Size: int64(len(buf)), SectorSize: remoteSectorSize}
+	for start := int64(0); start < int64(len(buf)); start += remoteSectorSize {
+		sums.Sums = append(sums.Sums, crc32.Checksum(buf[start:min(start+remoteSectorSize, int64(len(buf)))], castagnoli))
+	}
+	return sums
+}
+
+// matches reports whether the bytes read for the sector match its checksum. The sectors past the object described and
+// those read partially, e.g. once the file was truncated, are left unchecked and match.
+func (sums *sectorChecksums) matches(sectorNum int64, data []byte) bool {
+	if sums == nil || sectorNum >= int64(len(sums.Sums)) {
+		return true
+	}
+	if expected := min(sums.SectorSize, sums.Size-sectorNum*sums.SectorSize); int64(len(data)) != expected {
+		return true
+	}
+	return crc32.Checksum(data, castagnoli) == sums.Sums[sectorNum]
+}
+
+// putChecksums stores the checksums of the object uploaded as buf, now at the generation. A failure only leaves its
+// sectors unchecked.
+func (f *r2File) putChecksums(ctx context.Context, buf []byte, generation string) {
+	sums := computeChecksums(buf, generation)
+	body, err := json.Marshal(sums)
+	if err == nil {
+		_, err = f.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(f.bucket),
+			Key:         aws.String(checksumsKey(f.name)),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		})
+	}
+	if err != nil {
+		utils.VFSLogger.Warn("R2 - Failed to store the sector checksums, the sectors are read unchecked.", zap.String("name", f.name), zap.Error(err))
+		return
+	}
+
+	f.checksumsMtx.Lock()
+	defer f.checksumsMtx.Unlock()
+	f.checksums = sums
+}
+
+// checksumsOf returns the checksums of the generation of the object, its sidecar is read once per generation. Returns
+// nil when the sectors are read unchecked.
+func (f *r2File) checksumsOf(generation string) *sectorChecksums {
+	if generation == "" || !checksummed(f.name) {
+		return nil
+	}
+
+	f.checksumsMtx.Lock()
+	defer f.checksumsMtx.Unlock()
+
+	if f.checksums != nil && f.checksums.Generation == generation {
+		return f.checksums
+	}
+	if f.checksumsMissing == generation {
+		return nil
+	}
+
+	sums, err := f.loadChecksums()
+	if err != nil || sums.Generation != generation {
+		if err != nil && !errors.Is(conditionalError(err), ErrObjectNotFound) {
+			utils.VFSLogger.Warn("R2 - Failed to read the sector checksums, the sectors are read unchecked.", zap.String("name", f.name), zap.Error(err))
+		}
+		f.checksumsMissing = generation
+		return nil
+	}
+	f.checksums = sums
+	return sums
+}
+
+func (f *r2File) loadChecksums() (*sectorChecksums, error) {
+	resp, err := f.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(f.bucket),
+		Key:    aws.String(checksumsKey(f.name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	sums := &sectorChecksums{}
+	if err := json.Unmarshal(body, sums); err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+// deleteChecksums removes the sidecar of the object deleted, it would otherwise be left behind.
+func deleteChecksums(location *location, key string) {
+	if !checksummed(key) {
+		return
+	}
+	_, err := location.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(location.bucket),
+		Key:    aws.String(checksumsKey(key)),
+	})
+	if err != nil {
+		utils.VFSLogger.Warn("R2 - Failed to delete the sector checksums.", zap.String("name", key), zap.Error(err))
+	}
+}
@@ -0,0 +1,235 @@
+package remotevfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"persisto/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/ncruces/go-sqlite3"
+	"go.uber.org/zap"
+)
+
+// NOTE: the missing sectors are fetched in runs of consecutive sectors, each with a single ranged GET. A run covers the
+// sectors the read or write needs, and reads ahead when the misses are sequential, e.g. during a table scan, doubling at
+// each sequential miss of the read transaction up to maxCoalescedSectors.
+const maxCoalescedSectors = 16
+
+// NOTE: no sector missed yet, the first miss of the file or of a read transaction is never sequential
+const noMiss = -2
+
+// fetch is a run of sectors being fetched, the reads of its sectors wait for it rather than fetching them again.
+type fetch struct {
+	done chan struct{}
+	err  error
+}
+
+// NOTE: dataMtx must be held, the cache lock is released while the sectors are fetched so other reads go on. span is the
+// number of sectors the caller accesses from sectorNum on.
+func (f *r2File) getSector(sectorNum int64, span int64) (*sector, error) {
+	for {
+		f.cacheMtx.Lock()
+
+		if s, exists := f.cache[sectorNum]; exists {
+			utils.VFSSampledLogger.Debug("R2 - Sector found in cache.", zap.Int("sectorNum", int(sectorNum)))
+			f.eviction.touch(sectorNum)
+			f.cacheMtx.Unlock()
+			return s, nil
+		}
+
+		if pending, fetching := f.inflight[sectorNum]; fetching {
+			f.cacheMtx.Unlock()
+			utils.VFSSampledLogger.Debug("R2 - Waiting for sector being fetched.", zap.Int("sectorNum", int(sectorNum)))
+			<-pending.done
+			if pending.err != nil {
+				return nil, pending.err
+			}
+			// NOTE: the sector is cached now, unless it was already evicted and is fetched again
+			continue
+		}
+
+		if s := f.stagedSector(sectorNum); s != nil {
+			f.cacheSector(sectorNum, s)
+			f.cacheMtx.Unlock()
+			return s, nil
+		}
+
+		if sectorNum*remoteSectorSize >= f.storedSize {
+			utils.VFSSampledLogger.Debug("R2 - Sector is beyond stored object, creating empty sector.", zap.Int("sectorNum", int(sectorNum)), zap.Int64("storedSize", f.storedSize))
+			s := &sector{}
+			f.cacheSector(sectorNum, s)
+			f.cacheMtx.Unlock()
+			return s, nil
+		}
+
+		last := f.planFetch(sectorNum, span)
+		pending := &fetch{done: make(chan struct{})}
+		for n := sectorNum; n <= last; n++ {
+			f.inflight[n] = pending
+		}
+		f.cacheMtx.Unlock()
+
+		sectors, err := f.loadSectors(sectorNum, last)
+
+		f.cacheMtx.Lock()
+		for n := sectorNum; n <= last; n++ {
+			delete(f.inflight, n)
+		}
+		if err == nil {
+			for index, s := range sectors {
+				if _, exists := f.cache[sectorNum+int64(index)]; !exists {
+					f.cacheSector(sectorNum+int64(index), s)
+				}
+			}
+		}
+		f.cacheMtx.Unlock()
+
+		pending.err = err
+		close(pending.done)
+		if err != nil {
+			return nil, err
+		}
+		return sectors[0], nil
+	}
+}
+
+// NOTE: cacheMtx must be held, returns the last sector of the run starting at sectorNum. The run stops before the
+// sectors already cached, being fetched or staged and at the end of the stored object.
+func (f *r2File) planFetch(sectorNum int64, span int64) int64 {
+	if sectorNum == f.lastMiss+1 {
+		f.readAhead = min(max(f.readAhead*2, 2), maxCoalescedSectors)
+	} else {
+		f.readAhead = 1
+	}
+
+	length := min(max(span, f.readAhead), maxCoalescedSectors)
+	storedSectors := (f.storedSize + remoteSectorSize - 1) / remoteSectorSize
+
+	last := sectorNum
+	for next := sectorNum + 1; next < sectorNum+length && next < storedSectors; next++ {
+		if _, cached := f.cache[next]; cached {
+			break
+		}
+		if _, fetching := f.inflight[next]; fetching {
+			break
+		}
+		if _, staged := f.committed[next]; staged {
+			break
+		}
+		last = next
+	}
+
+	// NOTE: the sequential misses go on from the end of the run, the sectors read ahead aren't missed
+	f.lastMiss = last
+	return last
+}
+
+// NOTE: dataMtx must be held, the stored size doesn't change during the fetch. The sectors are checked against their
+// checksums, a run mismatching is fetched once more before being reported as corrupted, see checksums.go.
+func (f *r2File) fetchSectors(first int64, last int64) ([]*sector, error) {
+	sums := f.checksumsOf(f.generation)
+	sectors, corrupted, err := f.fetchRange(first, last, sums)
+	if err != nil || corrupted < 0 {
+		return sectors, err
+	}
+
+	refetchedRuns.Add(1)
+	utils.VFSLogger.Warn("R2 - Sector mismatches its checksum, fetching it again.", zap.String("fileName", f.name), zap.Int64("sectorNum", corrupted))
+	sectors, corrupted, err = f.fetchRange(first, last, sums)
+	if err != nil || corrupted < 0 {
+		return sectors, err
+	}
+	reportCorruption(f.name, corrupted)
+	return nil, sqlite3.IOERR_CORRUPTFS
+}
+
+// fetchRange fetches the sectors with a single ranged GET, it returns the first of them mismatching its checksum, or -1.
+func (f *r2File) fetchRange(first int64, last int64, sums *sectorChecksums) ([]*sector, int64, error) {
+	start := first * remoteSectorSize
+	end := min((last+1)*remoteSectorSize, f.storedSize) - 1
+
+	utils.VFSSampledLogger.Debug("R2 - Loading sectors.", zap.Int64("firstSector", first), zap.Int64("lastSector", last), zap.Int64("startByte", start), zap.Int64("endByte", end), zap.Int64("fileSize", f.size))
+
+	var err error
+	if tracing() {
+		defer func(started time.Time) {
+			traceSince(f.name, started, Operation{Kind: OperationFetch, Offset: start, Length: end - start + 1, Source: SourceRemote}, err)
+		}(time.Now())
+	}
+
+	resp, err := f.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(f.bucket),
+		Key:    aws.String(f.name),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+	})
+	if err != nil {
+		utils.VFSLogger.Error("R2 - GetObject failed.", zap.String("fileName", f.name), zap.Int64("firstSector", first), zap.Int64("lastSector", last), zap.Int64("startByte", start), zap.Int64("endByte", end), zap.Error(err))
+		return nil, -1, sqlite3.IOERR_READ
+	}
+	defer resp.Body.Close()
+
+	sectors := make([]*sector, last-first+1)
+	read := int64(0)
+	corrupted := int64(-1)
+	for index := range sectors {
+		s := &sector{}
+		sectors[index] = s
+
+		// NOTE: a shorter object than expected leaves the rest of the sectors empty
+		if read < end-start+1 {
+			n, readErr := io.ReadFull(resp.Body, s.data[:min(remoteSectorSize, end-start+1-read)])
+			read += int64(n)
+			if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+				utils.VFSLogger.Error("R2 - ReadFull failed.", zap.Error(readErr))
+				err = readErr
+				return nil, -1, sqlite3.IOERR_READ
+			}
+			if !sums.matches(first+int64(index), s.data[:n]) {
+				if corrupted < 0 {
+					corrupted = first + int64(index)
+				}
+			} else if sums != nil {
+				verifiedSectors.Add(1)
+			}
+		}
+	}
+	recordTransfer(f.name, read, 0)
+
+	return sectors, corrupted, nil
+}
+
+// NOTE: cacheMtx must be held
+func (f *r2File) cacheSector(sectorNum int64, s *sector) {
+	// NOTE: evict sectors if cache is full, it grows past its size while every sector is dirty
+	for len(f.cache) >= maxCachedSectors() {
+		utils.VFSSampledLogger.Debug("R2 - Cache is full, evicting sectors.", zap.Int("fileCache", len(f.cache)))
+		if !f.evictSector() {
+			break
+		}
+	}
+	// NOTE: past the share of the memory limit of the caches, the file makes room among its own sectors
+	for !utils.ReserveMemory(utils.MemorySectorCache, remoteSectorSize) {
+		if !f.evictSector() {
+			utils.AcquireMemory(utils.MemorySectorCache, remoteSectorSize)
+			break
+		}
+	}
+	if _, replaced := f.cache[sectorNum]; replaced {
+		utils.ReleaseMemory(utils.MemorySectorCache, remoteSectorSize)
+	}
+	f.cache[sectorNum] = s
+	f.eviction.insert(sectorNum)
+}
+
+// NOTE: a new read transaction starts, its misses aren't sequential with those of the previous one
+func (f *r2File) resetReadAhead() {
+	f.cacheMtx.Lock()
+	defer f.cacheMtx.Unlock()
+
+	f.lastMiss = noMiss
+	f.readAhead = 0
+}
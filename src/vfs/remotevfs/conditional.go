@@ -0,0 +1,90 @@
+package remotevfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+var (
+	ErrObjectNotFound     = errors.New("remote object not found")
+	ErrPreconditionFailed = errors.New("remote object changed concurrently")
+)
+
+// GetObjectWithGeneration returns the content of the remote object along with its ETag, ErrObjectNotFound when it
+// doesn't exist.
+func GetObjectWithGeneration(ctx context.Context, key string) ([]byte, string, error) {
+	location := locate(key)
+	response, err := location.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(location.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, "", conditionalError(err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, aws.ToString(response.ETag), nil
+}
+
+// PutObjectIfGeneration stores body under the given key only if the object is still at the given generation, or
+// doesn't exist yet when generation is empty, and returns the new generation. ErrPreconditionFailed is returned when
+// another writer got there first.
+func PutObjectIfGeneration(ctx context.Context, key string, body []byte, contentType string, generation string) (string, error) {
+	location := locate(key)
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(location.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	}
+	if generation == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(generation)
+	}
+
+	response, err := location.client.PutObject(ctx, input)
+	if err != nil {
+		return "", conditionalError(err)
+	}
+	forgetMissing(key)
+	return aws.ToString(response.ETag), nil
+}
+
+// DeleteObjectIfGeneration deletes the remote object only if it is still at the given generation.
+func DeleteObjectIfGeneration(ctx context.Context, key string, generation string) error {
+	location := locate(key)
+	_, err := location.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  aws.String(location.bucket),
+		Key:     aws.String(key),
+		IfMatch: aws.String(generation),
+	})
+	return conditionalError(err)
+}
+
+func conditionalError(err error) error {
+	var responseErr *smithyhttp.ResponseError
+	if !errors.As(err, &responseErr) {
+		return err
+	}
+
+	switch responseErr.HTTPStatusCode() {
+	case http.StatusNotFound:
+		return ErrObjectNotFound
+	// NOTE: S3 answers 409 when a concurrent conditional write is still in progress
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return ErrPreconditionFailed
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package remotevfs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"persisto/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"go.uber.org/zap"
+)
+
+const (
+	// NOTE: static keys when both are configured, the default chain otherwise
+	credentialsSourceAuto = "auto"
+	// NOTE: access key id and secret key from the configuration
+	credentialsSourceStatic = "static"
+	// NOTE: default AWS chain, env, shared config, web identity (IRSA) and instance profiles
+	credentialsSourceDefault = "default"
+)
+
+// resolveCredentialsSource returns the effective credentials source for the configured remote storage.
+func resolveCredentialsSource() (string, error) {
+	remote := utils.Config.Storage.Remote
+
+	switch remote.CredentialsSource {
+	case credentialsSourceAuto, "":
+		if remote.AccessKeyID != "" && remote.SecretKey != "" {
+			return credentialsSourceStatic, nil
+		}
+		return credentialsSourceDefault, nil
+	case credentialsSourceStatic:
+		if remote.AccessKeyID == "" || remote.SecretKey == "" {
+			return "", fmt.Errorf("static credentials source requires both an access key id and a secret key")
+		}
+		return credentialsSourceStatic, nil
+	case credentialsSourceDefault:
+		return credentialsSourceDefault, nil
+	default:
+		return "", fmt.Errorf("invalid credentials source %q, valid sources are %s, %s and %s", remote.CredentialsSource, credentialsSourceAuto, credentialsSourceStatic, credentialsSourceDefault)
+	}
+}
+
+// staticCredentials returns the configured keys, read on every retrieval so rotated secrets are used once the cache
+// is invalidated.
+func staticCredentials(ctx context.Context) (aws.Credentials, error) {
+	remote := utils.Config.Storage.Remote
+	return aws.Credentials{
+		AccessKeyID:     remote.AccessKeyID.Value(),
+		SecretAccessKey: remote.SecretKey.Value(),
+		Source:          credentialsSourceStatic,
+	}, nil
+}
+
+// loadRemoteConfig builds the AWS configuration used by the remote client, resolving the base credentials and
+// optionally assuming the configured role on top of them.
+func loadRemoteConfig(ctx context.Context) (aws.Config, error) {
+	remote := utils.Config.Storage.Remote
+
+	source, err := resolveCredentialsSource()
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	options := []func(*config.LoadOptions) error{
+		config.WithRegion(remote.Region),
+	}
+
+	if source == credentialsSourceStatic {
+		options = append(options, config.WithCredentialsProvider(aws.CredentialsProviderFunc(staticCredentials)))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	if remote.RoleARN != "" {
+		// NOTE: role assumption goes through the regular STS endpoint, not the bucket endpoint
+		stsClient := sts.NewFromConfig(cfg)
+		provider := stscreds.NewAssumeRoleProvider(stsClient, remote.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = remote.RoleSessionName
+			if remote.RoleExternalID != "" {
+				o.ExternalID = aws.String(remote.RoleExternalID)
+			}
+		})
+		cfg.Credentials = provider
+	}
+
+	// NOTE: cached credentials are refreshed before expiry and can be invalidated when the backend rejects them
+	if cache, ok := cfg.Credentials.(*aws.CredentialsCache); ok {
+		remoteCredentials = cache
+	} else {
+		remoteCredentials = aws.NewCredentialsCache(cfg.Credentials, func(o *aws.CredentialsCacheOptions) {
+			o.ExpiryWindow = time.Duration(remote.CredentialsExpiryWindowSeconds) * time.Second
+		})
+		cfg.Credentials = remoteCredentials
+	}
+
+	// NOTE: cached credentials are dropped when secrets rotate
+	utils.OnSecretsRotated(remoteCredentials.Invalidate)
+
+	utils.VFSLogger.Debug(
+		"Resolved remote credentials.",
+		zap.String("source", source),
+		zap.Bool("assumeRole", remote.RoleARN != ""),
+		zap.String("roleARN", remote.RoleARN),
+	)
+
+	return cfg, nil
+}
@@ -0,0 +1,305 @@
+package remotevfs
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+	"persisto/src/vfs/localvfs"
+
+	"go.uber.org/zap"
+)
+
+// NOTE: the disk cache keeps the sectors fetched from the bucket as files named after their object, the generation of
+// its content and their number. A rewritten object has another generation, the sectors of its previous content are
+// never read again and are evicted as the least recently used ones. Only the sectors entirely within the stored object
+// are cached, the last one of an object is partly made of the bytes past its end.
+
+type diskCache struct {
+	directory string
+	maxBytes  int64
+
+	mutex     sync.Mutex
+	entries   map[string]*list.Element
+	order     *list.List
+	usedBytes int64
+}
+
+type diskEntry struct {
+	path string
+	size int64
+}
+
+// NOTE: nil when the disk cache is disabled
+var disk *diskCache
+
+// setupDiskCache indexes the sectors cached on disk by a previous run, once the local storage directory was setup.
+func setupDiskCache() {
+	if !utils.Config.Storage.Remote.DiskCacheEnabled {
+		return
+	}
+
+	local, err := localvfs.GetLocalStorageDirectory()
+	if err != nil {
+		utils.VFSLogger.Error("R2 - Disk cache disabled, failed to locate the local storage directory.", zap.Error(err))
+		return
+	}
+
+	cache := &diskCache{
+		directory: filepath.Join(local, localvfs.RemoteCacheDirectoryName),
+		maxBytes:  utils.Config.Storage.Remote.DiskCacheMaxBytes,
+		entries:   map[string]*list.Element{},
+		order:     list.New(),
+	}
+	if err := os.MkdirAll(cache.directory, 0755); err != nil {
+		utils.VFSLogger.Error("R2 - Disk cache disabled, failed to create its directory.", zap.String("directory", cache.directory), zap.Error(err))
+		return
+	}
+
+	type found struct {
+		entry   diskEntry
+		modTime time.Time
+	}
+	var files []found
+	err = filepath.WalkDir(cache.directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		// NOTE: left behind by a write interrupted by the previous shutdown
+		if strings.HasSuffix(path, ".tmp") {
+			os.Remove(path)
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, found{entry: diskEntry{path: path, size: info.Size()}, modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		utils.VFSLogger.Error("R2 - Disk cache disabled, failed to index its directory.", zap.String("directory", cache.directory), zap.Error(err))
+		return
+	}
+
+	// NOTE: the sectors are touched when read, the most recently used ones are at the front of the list
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, file := range files {
+		cache.entries[file.entry.path] = cache.order.PushFront(file.entry)
+		cache.usedBytes += file.entry.size
+	}
+	cache.mutex.Lock()
+	cache.evict()
+	cache.mutex.Unlock()
+
+	disk = cache
+	utils.VFSLogger.Info("R2 - Disk cache enabled.", zap.String("directory", cache.directory), zap.Int("sectors", len(cache.entries)), zap.Int64("usedBytes", cache.usedBytes))
+}
+
+func hashName(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:8])
+}
+
+func (c *diskCache) objectDirectory(key string) string {
+	return filepath.Join(c.directory, hashName(key))
+}
+
+func (c *diskCache) sectorPath(key string, generation string, sectorNum int64) string {
+	return filepath.Join(c.objectDirectory(key), hashName(generation), strconv.FormatInt(sectorNum, 10))
+}
+
+// read fills the sector from the disk cache, returns whether it was cached.
+func (c *diskCache) read(key string, generation string, sectorNum int64, s *sector) bool {
+	path := c.sectorPath(key, generation, sectorNum)
+
+	c.mutex.Lock()
+	element, cached := c.entries[path]
+	if cached {
+		c.order.MoveToFront(element)
+	}
+	c.mutex.Unlock()
+	if !cached {
+		return false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) != remoteSectorSize {
+		utils.VFSLogger.Warn("R2 - Dropping unreadable sector from the disk cache.", zap.String("path", path), zap.Int("size", len(data)), zap.Error(err))
+		c.remove(path)
+		return false
+	}
+	copy(s.data[:], data)
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return true
+}
+
+// write stores the sector in the disk cache, failing to is only logged.
+func (c *diskCache) write(key string, generation string, sectorNum int64, s *sector) {
+	path := c.sectorPath(key, generation, sectorNum)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		utils.VFSLogger.Warn("R2 - Failed to create disk cache directory.", zap.String("path", path), zap.Error(err))
+		return
+	}
+
+	// NOTE: written aside and renamed, a sector is never read half written
+	temp, err := os.CreateTemp(filepath.Dir(path), "*.tmp")
+	if err != nil {
+		utils.VFSLogger.Warn("R2 - Failed to write sector to the disk cache.", zap.String("path", path), zap.Error(err))
+		return
+	}
+	_, err = temp.Write(s.data[:])
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		utils.VFSLogger.Warn("R2 - Failed to write sector to the disk cache.", zap.String("path", path), zap.Error(err))
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, cached := c.entries[path]; cached {
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[path] = c.order.PushFront(diskEntry{path: path, size: remoteSectorSize})
+	c.usedBytes += remoteSectorSize
+	c.evict()
+}
+
+// retain drops the sectors of the other generations of the object, they are never read again.
+func (c *diskCache) retain(key string, generation string) {
+	current := hashName(generation)
+	entries, err := os.ReadDir(c.objectDirectory(key))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() != current {
+			c.removeAll(filepath.Join(c.objectDirectory(key), entry.Name()))
+		}
+	}
+}
+
+// forget drops every sector of the object, once it was deleted.
+func (c *diskCache) forget(key string) {
+	c.removeAll(c.objectDirectory(key))
+}
+
+func (c *diskCache) removeAll(directory string) {
+	c.mutex.Lock()
+	for path, element := range c.entries {
+		if strings.HasPrefix(path, directory+string(filepath.Separator)) {
+			c.usedBytes -= element.Value.(diskEntry).size
+			c.order.Remove(element)
+			delete(c.entries, path)
+		}
+	}
+	c.mutex.Unlock()
+
+	if err := os.RemoveAll(directory); err != nil {
+		utils.VFSLogger.Warn("R2 - Failed to remove disk cache directory.", zap.String("directory", directory), zap.Error(err))
+	}
+}
+
+func (c *diskCache) remove(path string) {
+	c.mutex.Lock()
+	if element, cached := c.entries[path]; cached {
+		c.usedBytes -= element.Value.(diskEntry).size
+		c.order.Remove(element)
+		delete(c.entries, path)
+	}
+	c.mutex.Unlock()
+	os.Remove(path)
+}
+
+// NOTE: mutex must be held
+func (c *diskCache) evict() {
+	for c.usedBytes > c.maxBytes {
+		oldest := c.order.Back()
+		if oldest == nil {
+			return
+		}
+		entry := oldest.Value.(diskEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.path)
+		c.usedBytes -= entry.size
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			utils.VFSLogger.Warn("R2 - Failed to evict sector from the disk cache.", zap.String("path", entry.path), zap.Error(err))
+		}
+	}
+}
+
+// NOTE: returns 0 when the disk cache is disabled
+func diskCachedBytes() int64 {
+	if disk == nil {
+		return 0
+	}
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+	return disk.usedBytes
+}
+
+// NOTE: dataMtx must be held. The sectors of the run found on disk are read from it, the others are fetched from the
+// bucket by runs of consecutive sectors and written to it.
+func (f *r2File) loadSectors(first int64, last int64) ([]*sector, error) {
+	if disk == nil || f.generation == "" {
+		return f.fetchSectors(first, last)
+	}
+
+	sectors := make([]*sector, last-first+1)
+	for index := range sectors {
+		s := &sector{}
+		started := time.Now()
+		if f.diskCacheable(first+int64(index)) && disk.read(f.name, f.generation, first+int64(index), s) {
+			sectors[index] = s
+			traceSince(f.name, started, Operation{Kind: OperationFetch, Offset: (first + int64(index)) * remoteSectorSize, Length: remoteSectorSize, Source: SourceDisk}, nil)
+		}
+	}
+
+	for index := 0; index < len(sectors); {
+		if sectors[index] != nil {
+			index++
+			continue
+		}
+		end := index
+		for end+1 < len(sectors) && sectors[end+1] == nil {
+			end++
+		}
+
+		fetched, err := f.fetchSectors(first+int64(index), first+int64(end))
+		if err != nil {
+			return nil, err
+		}
+		for offset, s := range fetched {
+			sectorNum := first + int64(index+offset)
+			sectors[index+offset] = s
+			if f.diskCacheable(sectorNum) {
+				disk.write(f.name, f.generation, sectorNum, s)
+			}
+		}
+		index = end + 1
+	}
+	return sectors, nil
+}
+
+func (f *r2File) diskCacheable(sectorNum int64) bool {
+	return (sectorNum+1)*remoteSectorSize <= f.storedSize
+}
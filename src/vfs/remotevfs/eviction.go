@@ -0,0 +1,213 @@
+package remotevfs
+
+import (
+	"container/list"
+
+	"persisto/src/utils"
+)
+
+// NOTE: policies choosing the sector evicted once the cache of a file is full
+const (
+	// NOTE: the least recently used sector, suits point reads of a working set
+	EvictionLRU = "lru"
+	// NOTE: the least frequently used sector, the hot pages, e.g. the upper levels of the indexes, stay cached
+	EvictionLFU = "lfu"
+	// NOTE: the sectors read once go through a FIFO of their own, a scan doesn't flush the sectors read repeatedly
+	Eviction2Q = "2q"
+)
+
+// NOTE: the policies are guarded by the cache lock of their file
+type evictionPolicy interface {
+	// NOTE: a sector was added to the cache
+	insert(sectorNum int64)
+	// NOTE: a cached sector was accessed
+	touch(sectorNum int64)
+	// NOTE: a sector was dropped from the cache other than by eviction, e.g. truncated away
+	remove(sectorNum int64)
+	// NOTE: picks the sector to evict among the evictable ones and forgets it, false when none is evictable
+	evict(evictable func(sectorNum int64) bool) (int64, bool)
+}
+
+func maxCachedSectors() int {
+	return int(utils.Config.Storage.Remote.CacheMaxBytes / remoteSectorSize)
+}
+
+func newEvictionPolicy() evictionPolicy {
+	switch utils.Config.Storage.Remote.CachePolicy {
+	case EvictionLFU:
+		return &lfuPolicy{entries: map[int64]*lfuEntry{}}
+	case Eviction2Q:
+		capacity := maxCachedSectors()
+		return &twoQueuePolicy{
+			in:      newLRUList(),
+			main:    newLRUList(),
+			out:     newLRUList(),
+			inSize:  max(capacity*utils.Config.Storage.Remote.Cache2QInPercent/100, 1),
+			outSize: max(capacity*utils.Config.Storage.Remote.Cache2QOutPercent/100, 1),
+		}
+	default:
+		return &lruPolicy{list: newLRUList()}
+	}
+}
+
+// NOTE: sectors from the most recently inserted or touched, at the front, to the least recently one
+type lruList struct {
+	order    *list.List
+	elements map[int64]*list.Element
+}
+
+func newLRUList() *lruList {
+	return &lruList{order: list.New(), elements: map[int64]*list.Element{}}
+}
+
+func (l *lruList) contains(sectorNum int64) bool {
+	_, exists := l.elements[sectorNum]
+	return exists
+}
+
+func (l *lruList) pushFront(sectorNum int64) {
+	if element, exists := l.elements[sectorNum]; exists {
+		l.order.MoveToFront(element)
+		return
+	}
+	l.elements[sectorNum] = l.order.PushFront(sectorNum)
+}
+
+func (l *lruList) moveToFront(sectorNum int64) {
+	if element, exists := l.elements[sectorNum]; exists {
+		l.order.MoveToFront(element)
+	}
+}
+
+func (l *lruList) remove(sectorNum int64) {
+	if element, exists := l.elements[sectorNum]; exists {
+		l.order.Remove(element)
+		delete(l.elements, sectorNum)
+	}
+}
+
+func (l *lruList) len() int {
+	return len(l.elements)
+}
+
+// NOTE: removes and returns the least recent evictable sector
+func (l *lruList) evict(evictable func(sectorNum int64) bool) (int64, bool) {
+	for element := l.order.Back(); element != nil; element = element.Prev() {
+		sectorNum := element.Value.(int64)
+		if evictable(sectorNum) {
+			l.order.Remove(element)
+			delete(l.elements, sectorNum)
+			return sectorNum, true
+		}
+	}
+	return 0, false
+}
+
+type lruPolicy struct {
+	list *lruList
+}
+
+func (p *lruPolicy) insert(sectorNum int64) { p.list.pushFront(sectorNum) }
+func (p *lruPolicy) touch(sectorNum int64)  { p.list.moveToFront(sectorNum) }
+func (p *lruPolicy) remove(sectorNum int64) { p.list.remove(sectorNum) }
+func (p *lruPolicy) evict(evictable func(sectorNum int64) bool) (int64, bool) {
+	return p.list.evict(evictable)
+}
+
+type lfuEntry struct {
+	count    uint64
+	lastUsed uint64
+}
+
+// NOTE: the ties between the least frequently used sectors are broken by recency, the clock counts the accesses
+type lfuPolicy struct {
+	entries map[int64]*lfuEntry
+	clock   uint64
+}
+
+func (p *lfuPolicy) insert(sectorNum int64) {
+	p.clock++
+	p.entries[sectorNum] = &lfuEntry{count: 1, lastUsed: p.clock}
+}
+
+func (p *lfuPolicy) touch(sectorNum int64) {
+	if entry, exists := p.entries[sectorNum]; exists {
+		p.clock++
+		entry.count++
+		entry.lastUsed = p.clock
+	}
+}
+
+func (p *lfuPolicy) remove(sectorNum int64) { delete(p.entries, sectorNum) }
+
+func (p *lfuPolicy) evict(evictable func(sectorNum int64) bool) (int64, bool) {
+	var victim int64
+	var victimEntry *lfuEntry
+	for sectorNum, entry := range p.entries {
+		if !evictable(sectorNum) {
+			continue
+		}
+		if victimEntry == nil || entry.count < victimEntry.count || (entry.count == victimEntry.count && entry.lastUsed < victimEntry.lastUsed) {
+			victim, victimEntry = sectorNum, entry
+		}
+	}
+	if victimEntry == nil {
+		return 0, false
+	}
+	delete(p.entries, victim)
+	return victim, true
+}
+
+// NOTE: the full 2Q. The sectors inserted go to the in FIFO, touching them there doesn't promote them as the accesses
+// right after a read are usually to the same pages. Those evicted from it are remembered in the out ghost queue, a
+// sector inserted again while remembered goes to the main LRU.
+type twoQueuePolicy struct {
+	in      *lruList
+	main    *lruList
+	out     *lruList
+	inSize  int
+	outSize int
+}
+
+func (p *twoQueuePolicy) insert(sectorNum int64) {
+	if p.out.contains(sectorNum) {
+		p.out.remove(sectorNum)
+		p.main.pushFront(sectorNum)
+		return
+	}
+	p.in.pushFront(sectorNum)
+}
+
+func (p *twoQueuePolicy) touch(sectorNum int64) {
+	p.main.moveToFront(sectorNum)
+}
+
+func (p *twoQueuePolicy) remove(sectorNum int64) {
+	p.in.remove(sectorNum)
+	p.main.remove(sectorNum)
+	p.out.remove(sectorNum)
+}
+
+func (p *twoQueuePolicy) evict(evictable func(sectorNum int64) bool) (int64, bool) {
+	if p.in.len() > p.inSize || p.main.len() == 0 {
+		if sectorNum, found := p.evictIn(evictable); found {
+			return sectorNum, true
+		}
+	}
+	if sectorNum, found := p.main.evict(evictable); found {
+		return sectorNum, true
+	}
+	return p.evictIn(evictable)
+}
+
+func (p *twoQueuePolicy) evictIn(evictable func(sectorNum int64) bool) (int64, bool) {
+	sectorNum, found := p.in.evict(evictable)
+	if !found {
+		return 0, false
+	}
+	p.out.pushFront(sectorNum)
+	for p.out.len() > p.outSize {
+		p.out.evict(func(int64) bool { return true })
+	}
+	return sectorNum, true
+}
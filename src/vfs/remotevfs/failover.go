@@ -0,0 +1,191 @@
+package remotevfs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	smithyendpoints "github.com/aws/smithy-go/endpoints"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"go.uber.org/zap"
+)
+
+// NOTE: error codes returned by S3 compatible backends when the signing credentials are no longer valid
+var expiredCredentialsErrorCodes = map[string]bool{
+	"ExpiredToken":          true,
+	"ExpiredTokenException": true,
+	"InvalidAccessKeyId":    true,
+	"InvalidToken":          true,
+	"TokenRefreshRequired":  true,
+}
+
+type endpointHealth struct {
+	mtx sync.Mutex
+
+	primary   string
+	secondary string
+
+	failedOver          bool
+	consecutiveFailures int
+}
+
+var (
+	remoteHealth = &endpointHealth{}
+
+	remoteCredentials *aws.CredentialsCache
+)
+
+// NOTE: marks requests issued by the fail-back and circuit probes so they don't feed the health tracking
+type probeContextKey struct{}
+
+func setupEndpointHealth() {
+	remoteHealth.mtx.Lock()
+	defer remoteHealth.mtx.Unlock()
+
+	remoteHealth.primary = utils.Config.Storage.Remote.Endpoint
+	remoteHealth.secondary = utils.Config.Storage.Remote.SecondaryEndpoint
+}
+
+func (health *endpointHealth) activeEndpoint() string {
+	health.mtx.Lock()
+	defer health.mtx.Unlock()
+
+	if health.failedOver {
+		return health.secondary
+	}
+	return health.primary
+}
+
+func (health *endpointHealth) record(err error) {
+	if err != nil && isExpiredCredentialsError(err) && remoteCredentials != nil {
+		utils.VFSLogger.Warn("R2 - Credentials rejected, invalidating cached credentials.", zap.Error(err))
+		remoteCredentials.Invalidate()
+	}
+
+	health.mtx.Lock()
+	defer health.mtx.Unlock()
+
+	if !isEndpointFailure(err) {
+		health.consecutiveFailures = 0
+		return
+	}
+
+	health.consecutiveFailures++
+
+	if health.failedOver || health.secondary == "" {
+		return
+	}
+
+	if health.consecutiveFailures >= utils.Config.Storage.Remote.FailoverErrorThreshold {
+		utils.VFSLogger.Warn(
+			"R2 - Primary endpoint unhealthy, failing over to secondary endpoint.",
+			zap.String("primary", health.primary),
+			zap.String("secondary", health.secondary),
+			zap.Int("consecutiveFailures", health.consecutiveFailures),
+			zap.Error(err),
+		)
+		health.failedOver = true
+		health.consecutiveFailures = 0
+		go health.probePrimary()
+	}
+}
+
+// probePrimary periodically checks the primary endpoint while failed over and fails back once it answers again.
+func (health *endpointHealth) probePrimary() {
+	interval := time.Duration(utils.Config.Storage.Remote.FailbackIntervalSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), probeContextKey{}, true), interval)
+		_, err := getRemoteClient().HeadBucket(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(utils.Config.Storage.Remote.BucketName),
+		}, func(o *s3.Options) {
+			o.BaseEndpoint = aws.String(health.primary)
+			o.EndpointResolverV2 = s3.NewDefaultEndpointResolverV2()
+		})
+		cancel()
+
+		if isEndpointFailure(err) {
+			utils.VFSLogger.Debug("R2 - Primary endpoint still unhealthy.", zap.String("primary", health.primary), zap.Error(err))
+			continue
+		}
+
+		health.mtx.Lock()
+		health.failedOver = false
+		health.consecutiveFailures = 0
+		health.mtx.Unlock()
+
+		utils.VFSLogger.Info("R2 - Primary endpoint healthy again, failing back.", zap.String("primary", health.primary))
+		return
+	}
+}
+
+// isEndpointFailure reports whether err indicates the endpoint itself is unhealthy (network or server errors),
+// as opposed to regular client errors such as missing objects.
+func isEndpointFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var responseErr *smithyhttp.ResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.HTTPStatusCode() >= 500
+	}
+
+	return true
+}
+
+func isExpiredCredentialsError(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return expiredCredentialsErrorCodes[apiErr.ErrorCode()]
+	}
+	return false
+}
+
+// failoverEndpointResolver resolves every request against the currently active endpoint.
+type failoverEndpointResolver struct {
+	base s3.EndpointResolverV2
+}
+
+func (resolver failoverEndpointResolver) ResolveEndpoint(ctx context.Context, params s3.EndpointParameters) (smithyendpoints.Endpoint, error) {
+	if endpoint := remoteHealth.activeEndpoint(); endpoint != "" {
+		params.Endpoint = aws.String(endpoint)
+	}
+	return resolver.base.ResolveEndpoint(ctx, params)
+}
+
+// addEndpointHealthMiddleware records the outcome of every remote operation, after retries, into the endpoint health
+// and the circuit breaker, the operations fail right away while the circuit is open.
+func addEndpointHealthMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc(
+		"PersistoEndpointHealth",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			probing := ctx.Value(probeContextKey{}) != nil
+			if !probing {
+				if err := remoteCircuit.allow(); err != nil {
+					return middleware.InitializeOutput{}, middleware.Metadata{}, err
+				}
+			}
+
+			out, metadata, err := next.HandleInitialize(ctx, in)
+			if !probing {
+				remoteHealth.record(err)
+				remoteCircuit.record(err)
+			}
+			return out, metadata, err
+		},
+	), middleware.Before)
+}
@@ -0,0 +1,60 @@
+package remotevfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// NOTE: foreign buckets hold objects persisto doesn't manage, e.g. a fleet of SQLite files being imported. They are
+// reached with the shared credentials, which must be allowed to read them.
+
+// ListForeignObjects lists the objects of the foreign bucket right under the prefix, the nested keys are grouped away.
+func ListForeignObjects(bucket string, prefix string) ([]FileInfo, error) {
+	location := &location{bucket: bucket, client: getRemoteClient()}
+	files, _, err := listLocation(location, ListOptions{Prefix: prefix, Delimiter: "/"})
+	return files, err
+}
+
+// ReadForeignObjectHead returns the first bytes of the object of the foreign bucket, fewer when the object is shorter.
+func ReadForeignObjectHead(ctx context.Context, bucket string, key string, length int64) ([]byte, error) {
+	response, err := getRemoteClient().GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", length-1)),
+	})
+	if err != nil {
+		return nil, conditionalError(err)
+	}
+	defer response.Body.Close()
+
+	return io.ReadAll(io.LimitReader(response.Body, length))
+}
+
+// CopyForeignObject copies the object of the foreign bucket under the given key of the managed buckets. The copy is
+// made by the bucket itself, the credentials of the destination must be allowed to read the source and the object must
+// be under the 5GB limit of a single copy.
+func CopyForeignObject(ctx context.Context, bucket string, key string, targetKey string) error {
+	// NOTE: the segments of the source key are escaped on their own, its slashes are kept
+	segments := strings.Split(key, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+
+	location := locate(targetKey)
+	_, err := location.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(location.bucket),
+		Key:        aws.String(targetKey),
+		CopySource: aws.String(bucket + "/" + strings.Join(segments, "/")),
+	})
+	if err != nil {
+		return conditionalError(err)
+	}
+	forgetMissing(targetKey)
+	return nil
+}
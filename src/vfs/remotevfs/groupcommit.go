@@ -0,0 +1,166 @@
+package remotevfs
+
+import (
+	"context"
+	"time"
+
+	"persisto/src/utils"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"go.uber.org/zap"
+)
+
+// NOTE: with STORAGE_REMOTE_GROUP_COMMIT_MILLISECONDS, the sync of a transaction committing to a database no longer
+// uploads the object itself: the sectors it committed are staged and the object is uploaded once for every transaction
+// committed within the latency budget. The staged sectors are copied, the next transaction goes on writing over the
+// cached ones. The commits are uploaded before the file is closed, so a request gets its response once they are
+// stored, and before another connection reads the object, so it never sees an older one. A connection kept open, e.g.
+// a PostgreSQL wire session, sees its commits acknowledged up to the budget before they are stored.
+//
+// NOTE: a failed upload leaves the commits staged, they are uploaded again after groupCommitRetryInterval.
+const groupCommitRetryInterval = time.Second
+
+func groupCommitDelay() time.Duration {
+	return time.Duration(utils.Config.Storage.Remote.GroupCommitMilliseconds) * time.Millisecond
+}
+
+// groupsCommits reports whether the syncs of the file opened with the flags are grouped, only those of the databases
+// are, the journals are uploaded at every sync as SQLite relies on them being stored before the database is written.
+func groupsCommits(flags vfs.OpenFlag) bool {
+	return flags&vfs.OPEN_MAIN_DB != 0 && flags&vfs.OPEN_READONLY == 0 && utils.Config.Storage.Remote.GroupCommitMilliseconds > 0
+}
+
+// stageCommit stages the sectors and the size left by the transaction committing for the next upload, and schedules it
+// within the latency budget when none is.
+func (f *r2File) stageCommit() {
+	// NOTE: waits for the upload in progress, the commits staged meanwhile would be taken as uploaded by it
+	f.syncMtx.Lock()
+	defer f.syncMtx.Unlock()
+
+	f.dataMtx.Lock()
+	if len(f.dirtySectors) == 0 && !f.sizeDirty {
+		f.dataMtx.Unlock()
+		return
+	}
+
+	if f.committed == nil {
+		f.committed = make(map[int64]*sector)
+	}
+	// NOTE: the sectors staged by the previous transactions past what this one truncated the file to are gone
+	for sectorNum, s := range f.committed {
+		if start := sectorNum * remoteSectorSize; start >= f.truncatedTo {
+			delete(f.committed, sectorNum)
+		} else if end := start + remoteSectorSize; end > f.truncatedTo {
+			staged := &sector{data: s.data}
+			clear(staged.data[f.truncatedTo-start:])
+			f.committed[sectorNum] = staged
+		}
+	}
+	for sectorNum, s := range f.dirtySectors {
+		if sectorNum*remoteSectorSize < f.size {
+			f.committed[sectorNum] = &sector{data: s.data}
+		}
+		s.dirty = false
+	}
+
+	f.dirtySectors = make(map[int64]*sector)
+	f.sizeDirty = false
+	f.staged = true
+	f.committedSize, f.committedStoredSize = f.size, f.storedSize
+	f.truncatedTo = f.size
+	f.dataMtx.Unlock()
+
+	f.locks.mtx.Lock()
+	f.locks.staged = f
+	f.locks.mtx.Unlock()
+
+	if f.flushTimer == nil {
+		f.flushTimer = time.AfterFunc(groupCommitDelay(), f.flushInBackground)
+	}
+}
+
+// flush uploads the commits staged since the last upload, at once, it does nothing when none is.
+func (f *r2File) flush() error {
+	f.syncMtx.Lock()
+	defer f.syncMtx.Unlock()
+
+	if f.flushTimer != nil {
+		f.flushTimer.Stop()
+		f.flushTimer = nil
+	}
+
+	f.dataMtx.RLock()
+	staged, size, storedSize, committed := f.staged, f.committedSize, f.committedStoredSize, f.committed
+	f.dataMtx.RUnlock()
+	if !staged {
+		return nil
+	}
+
+	ctx := context.Background()
+	started := time.Now()
+
+	base, err := f.readStoredObject(ctx, started)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: the staged sectors are only replaced by the next commit, which waits for the upload
+	buf := make([]byte, size)
+	copy(buf, base[:min(int64(len(base)), storedSize)])
+	for sectorNum, s := range committed {
+		start := sectorNum * remoteSectorSize
+		if start >= size {
+			continue
+		}
+		end := min(start+remoteSectorSize, size)
+		copy(buf[start:end], s.data[:end-start])
+	}
+
+	generation, err := f.stagedPut(ctx, buf)
+	traceSince(f.name, started, Operation{Kind: OperationSync, Length: int64(len(buf))}, err)
+	if err != nil {
+		utils.VFSLogger.Error("R2 - Group commit failed; staged upload failed.", zap.String("name", f.name), zap.Error(err))
+		return sqlite3.IOERR_FSYNC
+	}
+
+	f.dataMtx.Lock()
+	f.storedSize = min(size, f.truncatedTo)
+	f.generation = generation
+	f.committed, f.staged = nil, false
+	f.dataMtx.Unlock()
+
+	f.locks.mtx.Lock()
+	if f.locks.staged == f {
+		f.locks.staged = nil
+		f.locks.size, f.locks.generation = size, generation
+	}
+	f.locks.mtx.Unlock()
+	return nil
+}
+
+func (f *r2File) flushInBackground() {
+	if err := f.flush(); err != nil {
+		f.syncMtx.Lock()
+		defer f.syncMtx.Unlock()
+		if f.flushTimer == nil {
+			f.flushTimer = time.AfterFunc(max(groupCommitDelay(), groupCommitRetryInterval), f.flushInBackground)
+		}
+	}
+}
+
+// NOTE: dataMtx must be held, returns a copy of the sector as staged by the last commit, or nil when it isn't staged.
+// The bytes past what the transaction in progress truncated the file to read as zeros.
+func (f *r2File) stagedSector(sectorNum int64) *sector {
+	staged, exists := f.committed[sectorNum]
+	start := sectorNum * remoteSectorSize
+	if !exists || start >= f.truncatedTo {
+		return nil
+	}
+
+	s := &sector{data: staged.data}
+	if end := start + remoteSectorSize; end > f.truncatedTo {
+		clear(s.data[f.truncatedTo-start:])
+	}
+	return s
+}
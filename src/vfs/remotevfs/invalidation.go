@@ -0,0 +1,174 @@
+package remotevfs
+
+import (
+	"context"
+	"sync"
+
+	"persisto/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.uber.org/zap"
+)
+
+// NOTE: files currently opened through the remote VFS, indexed by key, so external changes can invalidate their caches
+var (
+	openFilesMtx sync.Mutex
+	openFiles    = make(map[string]map[*r2File]struct{})
+)
+
+func registerOpenFile(file *r2File) {
+	openFilesMtx.Lock()
+	defer openFilesMtx.Unlock()
+
+	if _, exists := openFiles[file.name]; !exists {
+		openFiles[file.name] = make(map[*r2File]struct{})
+	}
+	openFiles[file.name][file] = struct{}{}
+}
+
+func unregisterOpenFile(file *r2File) {
+	openFilesMtx.Lock()
+	defer openFilesMtx.Unlock()
+
+	files, exists := openFiles[file.name]
+	if !exists {
+		return
+	}
+
+	delete(files, file)
+	if len(files) == 0 {
+		delete(openFiles, file.name)
+	}
+}
+
+type CacheStats struct {
+	OpenFiles       int   `json:"open_files"`
+	CachedSectors   int   `json:"cached_sectors"`
+	DirtySectors    int   `json:"dirty_sectors"`
+	CachedBytes     int64 `json:"cached_bytes"`
+	DiskCachedBytes int64 `json:"disk_cached_bytes"`
+}
+
+// GetCacheStats returns the size of the sector caches of every open file.
+func GetCacheStats() CacheStats {
+	openFilesMtx.Lock()
+	files := make([]*r2File, 0, len(openFiles))
+	for _, keyFiles := range openFiles {
+		for file := range keyFiles {
+			files = append(files, file)
+		}
+	}
+	openFilesMtx.Unlock()
+
+	stats := CacheStats{OpenFiles: len(files)}
+	for _, file := range files {
+		file.cacheMtx.RLock()
+		stats.CachedSectors += len(file.cache)
+		file.cacheMtx.RUnlock()
+
+		file.dataMtx.RLock()
+		stats.DirtySectors += len(file.dirtySectors)
+		file.dataMtx.RUnlock()
+	}
+	stats.CachedBytes = int64(stats.CachedSectors) * remoteSectorSize
+	stats.DiskCachedBytes = diskCachedBytes()
+	return stats
+}
+
+// shedCaches evicts the clean sectors of the open files, from every file in turn so that no file loses its whole cache
+// first, until the excess is freed or only dirty sectors are left. It returns the bytes freed.
+func shedCaches(excess int64) int64 {
+	openFilesMtx.Lock()
+	files := make([]*r2File, 0, len(openFiles))
+	for _, keyFiles := range openFiles {
+		for file := range keyFiles {
+			files = append(files, file)
+		}
+	}
+	openFilesMtx.Unlock()
+
+	var freed int64
+	for freed < excess && len(files) > 0 {
+		remaining := files[:0]
+		for _, file := range files {
+			file.cacheMtx.Lock()
+			evicted := file.evictSector()
+			file.cacheMtx.Unlock()
+			if evicted {
+				freed += remoteSectorSize
+				remaining = append(remaining, file)
+			}
+			if freed >= excess {
+				break
+			}
+		}
+		files = remaining
+	}
+
+	utils.VFSLogger.Info("R2 - Shed sector caches under memory pressure.", zap.Int64("freedBytes", freed), zap.Int64("excessBytes", excess))
+	return freed
+}
+
+// InvalidateFile drops the cached clean sectors of every open file stored under key and reloads its size, so
+// changes made to the object outside this process become visible, including its creation when it was found missing.
+// Dirty sectors are kept as they hold local writes.
+func InvalidateFile(key string) {
+	forgetMissing(key)
+
+	openFilesMtx.Lock()
+	files := make([]*r2File, 0, len(openFiles[key]))
+	for file := range openFiles[key] {
+		files = append(files, file)
+	}
+	openFilesMtx.Unlock()
+
+	if len(files) == 0 {
+		return
+	}
+
+	var size int64
+	var generation string
+	location := locate(key)
+	headResp, err := location.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(location.bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		size = reconcileSize(key, headResp)
+		generation = generationOf(headResp)
+	}
+
+	for _, file := range files {
+		file.invalidate(size, generation)
+	}
+
+	utils.VFSLogger.Debug("R2 - Invalidated open files after external change.", zap.String("key", key), zap.Int("files", len(files)), zap.Int64("size", size))
+}
+
+func (f *r2File) invalidate(size int64, generation string) {
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+
+	f.cacheMtx.Lock()
+	defer f.cacheMtx.Unlock()
+
+	for sectorNum, s := range f.cache {
+		if !s.dirty {
+			delete(f.cache, sectorNum)
+			f.eviction.remove(sectorNum)
+			utils.ReleaseMemory(utils.MemorySectorCache, remoteSectorSize)
+		}
+	}
+
+	hasLocalChanges := len(f.dirtySectors) > 0 || f.sizeDirty || f.staged
+
+	if !hasLocalChanges {
+		f.size = size
+		f.storedSize = size
+		f.generation = generation
+	} else {
+		// NOTE: the local changes are kept over an object of unknown content, its sectors aren't cached on disk anymore
+		f.generation = ""
+	}
+}
@@ -0,0 +1,104 @@
+package remotevfs
+
+import (
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// NOTE: the connections to the same database object share its lock state, as the local VFS shares the one of a path, so
+// that a reader doesn't go through the sectors a writer is committing. A lock conflicting with those of the other
+// connections waits for them to be released rather than failing right away, for at most the lock wait after which
+// SQLite retries it within its busy timeout.
+//
+// NOTE: every connection reads the object through the sectors cached by its own file, a file taking a shared lock after
+// another one wrote to the object drops them so that SQLite sees the write.
+
+type objectLockState struct {
+	mtx      sync.Mutex
+	shared   int32
+	pending  bool
+	reserved bool
+
+	// NOTE: signaled whenever a lock is released, on mtx
+	released *sync.Cond
+	// NOTE: exclusive locks released so far, and the stored size and generation of the object as the last writer left it
+	writes     uint64
+	size       int64
+	generation string
+	// NOTE: file holding commits staged and not uploaded yet, see stageCommit
+	staged *r2File
+	// NOTE: files opened on the object, guarded by objectLocksMtx
+	opens int
+}
+
+var (
+	objectLocksMtx sync.Mutex
+	objectLocks    = make(map[string]*objectLockState)
+)
+
+func newObjectLockState() *objectLockState {
+	state := &objectLockState{}
+	state.released = sync.NewCond(&state.mtx)
+	return state
+}
+
+// acquireObjectLocks returns the lock state of the object the file is opened on, the temporary files and the journals
+// aren't shared and get their own.
+func acquireObjectLocks(name string, flags vfs.OpenFlag) *objectLockState {
+	if flags&vfs.OPEN_MAIN_DB == 0 {
+		return newObjectLockState()
+	}
+
+	objectLocksMtx.Lock()
+	defer objectLocksMtx.Unlock()
+
+	state, exists := objectLocks[name]
+	if !exists {
+		state = newObjectLockState()
+		objectLocks[name] = state
+	}
+	state.opens++
+	return state
+}
+
+func releaseObjectLocks(name string, state *objectLockState) {
+	objectLocksMtx.Lock()
+	defer objectLocksMtx.Unlock()
+
+	if objectLocks[name] != state {
+		return
+	}
+	state.opens--
+	if state.opens <= 0 {
+		delete(objectLocks, name)
+	}
+}
+
+// wait waits until ready holds or the deadline passes, it reports whether ready holds. The time waited is recorded for
+// the file. The mutex of the lock state must be held, it is released while waiting.
+func (state *objectLockState) wait(file string, deadline time.Time, ready func() bool) bool {
+	if ready() {
+		return true
+	}
+	before := time.Now()
+	defer func() { utils.RecordLockWait(file, time.Since(before)) }()
+
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		state.mtx.Lock()
+		defer state.mtx.Unlock()
+		state.released.Broadcast()
+	})
+	defer timer.Stop()
+
+	for !ready() {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		state.released.Wait()
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package remotevfs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// NOTE: SQLite probes the journals of the databases at every transaction, most of the time they don't exist. The keys
+// found missing are remembered for a short while and the probes answered without asking the bucket. The keys written
+// through this process are forgotten right away, those written by other instances show up once the answer expires.
+var (
+	missingObjects      = map[string]time.Time{}
+	missingObjectsMutex sync.Mutex
+)
+
+// NOTE: the expired answers are swept once the map grows past this size
+const missingObjectsSweepSize = 1024
+
+// headObject returns the metadata of the object, ErrObjectNotFound when it doesn't exist or was recently found missing.
+func headObject(ctx context.Context, location *location, key string) (*s3.HeadObjectOutput, error) {
+	if knownMissing(key) {
+		return nil, ErrObjectNotFound
+	}
+
+	headResp, err := location.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(location.bucket),
+		Key:    aws.String(key),
+	})
+	if err := conditionalError(err); err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			rememberMissing(key)
+		}
+		return nil, err
+	}
+	return headResp, nil
+}
+
+func knownMissing(key string) bool {
+	missingObjectsMutex.Lock()
+	defer missingObjectsMutex.Unlock()
+
+	expiresAt, missing := missingObjects[key]
+	if missing && time.Now().After(expiresAt) {
+		delete(missingObjects, key)
+		return false
+	}
+	return missing
+}
+
+func rememberMissing(key string) {
+	ttl := time.Duration(utils.Config.Storage.Remote.MissingObjectCacheMilliseconds) * time.Millisecond
+	if ttl <= 0 {
+		return
+	}
+
+	missingObjectsMutex.Lock()
+	defer missingObjectsMutex.Unlock()
+
+	now := time.Now()
+	if len(missingObjects) >= missingObjectsSweepSize {
+		for missingKey, expiresAt := range missingObjects {
+			if now.After(expiresAt) {
+				delete(missingObjects, missingKey)
+			}
+		}
+	}
+	missingObjects[key] = now.Add(ttl)
+}
+
+func forgetMissing(key string) {
+	missingObjectsMutex.Lock()
+	defer missingObjectsMutex.Unlock()
+
+	delete(missingObjects, key)
+}
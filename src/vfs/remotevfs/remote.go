@@ -3,18 +3,18 @@ package remotevfs
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"runtime"
-	"strings"
+	"net/url"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"persisto/src/utils"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/ncruces/go-sqlite3"
 	"github.com/ncruces/go-sqlite3/vfs"
@@ -24,58 +24,102 @@ import (
 const (
 	// 64KB sectors
 	remoteSectorSize = 65536
-	// Cache configuration
-	// 100MB cache
-	maxCacheSize     = 100 * 1024 * 1024
-	maxCachedSectors = maxCacheSize / remoteSectorSize
+	// NOTE: object metadata key holding the logical file size, S3 lowercases user metadata keys
+	sizeMetadataKey = "persisto-size"
+	// NOTE: suffix of the temporary keys used during staged syncs, contains "temp_" so listings skip it
+	stagingKeySuffix = ".temp_sync_"
 )
 
+// NOTE: the objects are written whole, a sector is never seen half written
+const remoteCharacteristics = vfs.IOCAP_ATOMIC | vfs.IOCAP_SEQUENTIAL | vfs.IOCAP_SAFE_APPEND
+
 // Ensure remoteSectorSize is a multiple of 64K (the largest page size)
 var _ [0]struct{} = [remoteSectorSize & 65535]struct{}{}
 
+// NOTE: how long the bucket gets to answer at startup before the server starts offline
+const startupCheckTimeout = 15 * time.Second
+
+// CheckRemote tells why the remote stage can't be used, nil when its bucket answers. It is checked once at startup.
+func CheckRemote() error {
+	remote := utils.Config.Storage.Remote
+	if !remote.Enabled {
+		return errors.New("the remote stage is disabled by STORAGE_REMOTE_ENABLED")
+	}
+	if remote.BucketName == "" {
+		return errors.New("STORAGE_REMOTE_BUCKET_NAME isn't set")
+	}
+	if _, err := loadRemoteConfig(context.TODO()); err != nil {
+		return fmt.Errorf("failed to load the remote credentials: %w", err)
+	}
+
+	// NOTE: checked as a probe, the failures don't count towards the circuit breaker
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), probeContextKey{}, true), startupCheckTimeout)
+	defer cancel()
+	if _, err := getRemoteClient().HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(remote.BucketName)}); err != nil {
+		return fmt.Errorf("the bucket %s can't be reached: %w", remote.BucketName, err)
+	}
+	return nil
+}
+
 func RegisterRemoteVfs() {
+	setupDiskCache()
+	utils.OnMemoryPressure(shedCaches)
 	vfs.Register("r2", r2VFS{})
 }
 
 type r2VFS struct{}
 
+// Describe returns the sector size and the device characteristics SQLite is told the remote database files have.
+func Describe() (sectorSize int, characteristics vfs.DeviceCharacteristic) {
+	return remoteSectorSize, remoteCharacteristics
+}
+
 var (
 	r2Client     *s3.Client
 	r2ClientOnce sync.Once
+
+	// NOTE: configuration of the shared client, the clients of the tenants with their own keys derive from it
+	remoteConfig aws.Config
 )
 
 func getRemoteClient() *s3.Client {
 	r2ClientOnce.Do(func() {
-		utils.Logger.Debug(
+		utils.VFSLogger.Debug(
 			"Initializing r2 client.",
 			zap.String("Endpoint", utils.Config.Storage.Remote.Endpoint),
-			zap.String("AccessKeyID", utils.Config.Storage.Remote.AccessKeyID),
-			zap.String("SecretKey", utils.Config.Storage.Remote.SecretKey),
 			zap.String("BucketName", utils.Config.Storage.Remote.BucketName),
+			zap.String("CredentialsSource", utils.Config.Storage.Remote.CredentialsSource),
 		)
 
-		cfg, err := config.LoadDefaultConfig(context.TODO(),
-			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-				utils.Config.Storage.Remote.AccessKeyID,
-				utils.Config.Storage.Remote.SecretKey,
-				"",
-			)),
-			config.WithRegion(utils.Config.Storage.Remote.Region),
-		)
-		if err != nil {
-			utils.Logger.Fatal("Failed to load R2 config.", zap.Error(err))
-			panic(fmt.Sprintf("Failed to load R2 config: %v", err))
+		// NOTE: offline, the credentials may well be missing, the client only serves to fail every operation right away
+		cfg := aws.Config{Region: utils.Config.Storage.Remote.Region}
+		if !utils.RemoteOffline() {
+			var err error
+			if cfg, err = loadRemoteConfig(context.TODO()); err != nil {
+				utils.VFSLogger.Fatal("Failed to load R2 config.", zap.Error(err))
+				panic(fmt.Sprintf("Failed to load R2 config: %v", err))
+			}
 		}
 
-		r2Client = s3.NewFromConfig(cfg, func(o *s3.Options) {
-			o.BaseEndpoint = aws.String(utils.Config.Storage.Remote.Endpoint)
-		})
+		setupEndpointHealth()
+
+		remoteConfig = cfg
+		r2Client = newRemoteClient(cfg)
 
-		utils.Logger.Debug("R2 client initialized successfully.", zap.Reflect("r2Client", r2Client))
+		utils.VFSLogger.Debug("R2 client initialized successfully.", zap.Reflect("r2Client", r2Client))
 	})
 	return r2Client
 }
 
+// newRemoteClient returns a client of the configured endpoint, failing over to the secondary one along with the others.
+func newRemoteClient(cfg aws.Config) *s3.Client {
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(utils.Config.Storage.Remote.Endpoint)
+		o.EndpointResolverV2 = failoverEndpointResolver{base: s3.NewDefaultEndpointResolverV2()}
+		o.APIOptions = append(o.APIOptions, addEndpointHealthMiddleware)
+	})
+}
+
 type r2File struct {
 	name     string
 	client   *s3.Client
@@ -83,92 +127,174 @@ type r2File struct {
 	lock     vfs.LockLevel
 	readOnly bool
 
+	// NOTE: guards the size, the content of the sectors and the dirty sectors tracking, held exclusively while they are
+	// modified and shared while they are read. It is always acquired before cacheMtx.
+	dataMtx sync.RWMutex
+	// NOTE: held for the whole of a sync, two syncs interleaving their uploads would overwrite each other
+	syncMtx sync.Mutex
+
 	// File metadata
 	size int64
+	// NOTE: set when the logical size changed (e.g. Truncate) and has not been persisted yet
+	sizeDirty bool
+	// NOTE: length of the prefix of the stored object that is still part of the file. The bytes past it were truncated
+	// away locally, they read as zeros and are dropped by the next sync even when the file grows again.
+	storedSize int64
+	// NOTE: smallest size truncated to while a sync uploads, the uploaded object is only valid up to it
+	truncatedTo int64
+	// NOTE: generation of the stored object the sectors are read from, the sectors are kept in the disk cache under it.
+	// Empty when unknown, the disk cache isn't used then.
+	generation string
 
 	// Cache for sectors
 	cache    map[int64]*sector
 	cacheMtx sync.RWMutex
+	// NOTE: chooses the sectors evicted once the cache is full, guarded by cacheMtx
+	eviction evictionPolicy
+	// NOTE: the sectors being fetched and the read-ahead of the sequential misses, guarded by cacheMtx
+	inflight  map[int64]*fetch
+	lastMiss  int64
+	readAhead int64
 
 	// Locking
-	lockMtx  sync.Mutex
-	shared   int32
-	pending  bool
-	reserved bool
+	locks *objectLockState
+	// NOTE: the locks of the shared lock state held by this file and the writes to the object it saw, guarded by its mutex
+	pending    bool
+	reserved   bool
+	writesSeen uint64
 
 	// Dirty sectors tracking
-	dirtyMtx     sync.RWMutex
 	dirtySectors map[int64]*sector
+
+	// NOTE: with group commit, the sectors and the size committed and not uploaded yet, along with the length of the
+	// prefix of the stored object still part of them, and the upload scheduled, see stageCommit
+	groupCommit         bool
+	staged              bool
+	committed           map[int64]*sector
+	committedSize       int64
+	committedStoredSize int64
+	flushTimer          *time.Timer
+
+	// NOTE: checksums of the sectors of the stored object, and the generation found without them, see checksums.go
+	checksumsMtx     sync.Mutex
+	checksums        *sectorChecksums
+	checksumsMissing string
 }
 
 type sector struct {
-	data     [remoteSectorSize]byte
-	dirty    bool
-	lastUsed time.Time
+	data  [remoteSectorSize]byte
+	dirty bool
 }
 
 func (r2VFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
-	utils.Logger.Debug(fmt.Sprintf("R2 - Opening file %s with flags %v.", name, flags))
+	utils.VFSSampledLogger.Debug("R2 - Opening file.", zap.String("name", name), zap.Uint32("flags", uint32(flags)))
 
 	const types = vfs.OPEN_MAIN_DB | vfs.OPEN_TEMP_DB | vfs.OPEN_TRANSIENT_DB | vfs.OPEN_MAIN_JOURNAL | vfs.OPEN_TEMP_JOURNAL | vfs.OPEN_SUBJOURNAL | vfs.OPEN_SUPER_JOURNAL
 	if flags&types == 0 {
-		utils.Logger.Error(fmt.Sprintf("R2 - Unsupported file type for given flags: %v.", flags))
+		utils.VFSLogger.Error(fmt.Sprintf("R2 - Unsupported file type for given flags: %v.", flags))
 		return nil, flags, sqlite3.CANTOPEN
 	}
 
-	client := getRemoteClient()
+	location := locate(name)
+	client := location.client
 
 	file := &r2File{
 		name:         name,
 		client:       client,
-		bucket:       utils.Config.Storage.Remote.BucketName,
+		bucket:       location.bucket,
 		readOnly:     flags&vfs.OPEN_READONLY != 0,
+		groupCommit:  groupsCommits(flags),
 		cache:        make(map[int64]*sector),
+		eviction:     newEvictionPolicy(),
+		inflight:     make(map[int64]*fetch),
 		dirtySectors: make(map[int64]*sector),
+		lastMiss:     noMiss,
+		locks:        acquireObjectLocks(name, flags),
 	}
 
 	ctx := context.Background()
 
-	headResp, err := client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(file.bucket),
-		Key:    aws.String(name),
-	})
+	headResp, err := headObject(ctx, location, name)
 
 	if err != nil {
-		utils.Logger.Debug(
+		utils.VFSSampledLogger.Debug(
 			"R2 - File doesn't exist or HeadObject failed.",
 			zap.Error(err),
 		)
 		if flags&vfs.OPEN_CREATE == 0 {
-			utils.Logger.Error("R2 - File doesn't exist and CREATE flag isn't set.")
+			utils.VFSLogger.Error("R2 - File doesn't exist and CREATE flag isn't set.")
+			releaseObjectLocks(name, file.locks)
 			return nil, flags, sqlite3.CANTOPEN
 		}
-		utils.Logger.Debug("R2 - File will be created.")
+		utils.VFSSampledLogger.Debug("R2 - File will be created.")
 		file.size = 0
+		traceOperation(name, Operation{Kind: OperationOpen, Error: err.Error()})
 	} else {
-		file.size = *headResp.ContentLength
-		utils.Logger.Debug(
+		file.size = reconcileSize(name, headResp)
+		file.storedSize = file.size
+		file.generation = generationOf(headResp)
+		if disk != nil && file.generation != "" {
+			disk.retain(name, file.generation)
+		}
+		utils.VFSSampledLogger.Debug(
 			"R2 - File exists.",
 			zap.Int("size", int(file.size)),
 		)
+		traceOperation(name, Operation{Kind: OperationOpen, Length: file.size})
 	}
 
-	utils.Logger.Debug("R2 - Successfully opened file.", zap.String("name", name))
+	registerOpenFile(file)
+
+	utils.VFSSampledLogger.Debug("R2 - Successfully opened file.", zap.String("name", name))
 	return file, flags, nil
 }
 
+// reconcileSize returns the logical size of an object, preferring the size persisted in its metadata
+// and falling back to the ContentLength when the metadata is missing or inconsistent with the stored bytes.
+func reconcileSize(name string, headResp *s3.HeadObjectOutput) int64 {
+	contentLength := aws.ToInt64(headResp.ContentLength)
+
+	value, exists := headResp.Metadata[sizeMetadataKey]
+	if !exists {
+		return contentLength
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		utils.VFSLogger.Warn("R2 - Invalid size metadata, falling back to content length.", zap.String("name", name), zap.String("value", value), zap.Error(err))
+		return contentLength
+	}
+
+	if size > contentLength {
+		utils.VFSLogger.Warn("R2 - Size metadata exceeds stored object, falling back to content length.", zap.String("name", name), zap.Int64("metadataSize", size), zap.Int64("contentLength", contentLength))
+		return contentLength
+	}
+
+	if size != contentLength {
+		utils.VFSLogger.Debug("R2 - Reconciled file size from metadata.", zap.String("name", name), zap.Int64("metadataSize", size), zap.Int64("contentLength", contentLength))
+	}
+
+	return size
+}
+
 func (r2VFS) Delete(name string, dirSync bool) error {
-	client := getRemoteClient()
+	location := locate(name)
 	ctx := context.Background()
 
-	_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
-		Bucket: aws.String(utils.Config.Storage.Remote.BucketName),
+	_, err := location.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(location.bucket),
 		Key:    aws.String(name),
 	})
 
+	traceOperation(name, Operation{Kind: OperationDelete, Error: errorString(err)})
 	if err != nil {
 		return sqlite3.IOERR_DELETE
 	}
+	rememberMissing(name)
+	if disk != nil {
+		disk.forget(name)
+	}
+	deleteChecksums(location, name)
 	return nil
 }
 
@@ -179,14 +305,7 @@ func Delete(name string) error {
 }
 
 func (r2VFS) Access(name string, flag vfs.AccessFlag) (bool, error) {
-	client := getRemoteClient()
-	ctx := context.Background()
-
-	_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(utils.Config.Storage.Remote.BucketName),
-		Key:    aws.String(name),
-	})
-
+	_, err := headObject(context.Background(), locate(name), name)
 	return err == nil, nil
 }
 
@@ -198,104 +317,55 @@ func (f *r2File) Close() error {
 	if err := f.Sync(vfs.SYNC_NORMAL); err != nil {
 		return err
 	}
+	if err := f.flush(); err != nil {
+		return err
+	}
+
+	unregisterOpenFile(f)
+	traceOperation(f.name, Operation{Kind: OperationClose})
+
+	f.cacheMtx.Lock()
+	utils.ReleaseMemory(utils.MemorySectorCache, int64(len(f.cache))*remoteSectorSize)
+	clear(f.cache)
+	f.cacheMtx.Unlock()
 
-	return f.Unlock(vfs.LOCK_NONE)
+	err := f.Unlock(vfs.LOCK_NONE)
+	releaseObjectLocks(f.name, f.locks)
+	return err
 }
 
 func (f *r2File) SectorSize() int {
 	return remoteSectorSize
 }
 
-func (f *r2File) getSector(sectorNum int64) (*sector, error) {
-	utils.Logger.Debug("R2 - Getting sector.", zap.Int("sectorNum", int(sectorNum)), zap.String("fileName", f.name))
-	f.cacheMtx.RLock()
-	if s, exists := f.cache[sectorNum]; exists {
-		utils.Logger.Debug("R2 - Sector found in cache.", zap.Int("sectorNum", int(sectorNum)))
-		s.lastUsed = time.Now()
-		f.cacheMtx.RUnlock()
-		return s, nil
-	}
-	f.cacheMtx.RUnlock()
-
-	f.cacheMtx.Lock()
-	defer f.cacheMtx.Unlock()
-
-	if s, exists := f.cache[sectorNum]; exists {
-		utils.Logger.Debug("R2 - Sector appeared in cache during lock acquisition.", zap.Int("sectorNum", int(sectorNum)))
-		s.lastUsed = time.Now()
-		return s, nil
-	}
-
-	// NOTE: evict old sectors if cache is full
-	if len(f.cache) >= maxCachedSectors {
-		utils.Logger.Debug("R2 - Cache is full, evicting old sectors.", zap.Int("fileCache", len(f.cache)))
-		f.evictOldSectors()
-	}
-
-	s := &sector{lastUsed: time.Now()}
-
-	// NOTE: calculate byte range for this sector to read
-	start := sectorNum * remoteSectorSize
-	end := start + remoteSectorSize - 1
-	if end >= f.size {
-		end = f.size - 1
-	}
-
-	utils.Logger.Debug(fmt.Sprintf("[r2]: Loading sector %d: byte range %d-%d (file size: %d)\n", sectorNum, start, end, f.size))
-
-	if start < f.size {
-		ctx := context.Background()
-		rangeHeader := fmt.Sprintf("bytes=%d-%d", start, end)
-
-		resp, err := f.client.GetObject(ctx, &s3.GetObjectInput{
-			Bucket: aws.String(f.bucket),
-			Key:    aws.String(f.name),
-			Range:  aws.String(rangeHeader),
-		})
-
-		if err != nil {
-			utils.Logger.Error("R2 - GetObject failed.", zap.String("fileName", f.name), zap.Int("sectorNum", int(sectorNum)), zap.Int("startByte", int(start)), zap.Int("endByte", int(end)), zap.Error(err))
-			return nil, sqlite3.IOERR_READ
-		}
-
-		defer resp.Body.Close()
-		n, err := io.ReadFull(resp.Body, s.data[:end-start+1])
-		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-			utils.Logger.Error("R2 - ReadFull failed.", zap.Error(err))
-			return nil, sqlite3.IOERR_READ
-		}
-
-		if n < remoteSectorSize {
-			clear(s.data[n:])
-		}
-	} else {
-		// TODO: treat case
-		utils.Logger.Debug("R2 - Sector is beyond file size, creating empty sector.", zap.Int("sectorNum", int(sectorNum)), zap.Int64("fileSize", f.size))
+// NOTE: cacheMtx must be held, the dirty sectors are never evicted. Returns false when every sector is dirty.
+func (f *r2File) evictSector() bool {
+	sectorNum, found := f.eviction.evict(func(sectorNum int64) bool {
+		s, cached := f.cache[sectorNum]
+		return cached && !s.dirty
+	})
+	if !found {
+		return false
 	}
 
-	f.cache[sectorNum] = s
-	return s, nil
+	delete(f.cache, sectorNum)
+	utils.ReleaseMemory(utils.MemorySectorCache, remoteSectorSize)
+	traceOperation(f.name, Operation{Kind: OperationEvict, Offset: sectorNum * remoteSectorSize, Length: remoteSectorSize})
+	return true
 }
 
-func (f *r2File) evictOldSectors() {
-	var oldestTime time.Time
-	var oldestSector int64 = -1
-
-	for sectorNum, s := range f.cache {
-		if !s.dirty && (oldestTime.IsZero() || s.lastUsed.Before(oldestTime)) {
-			oldestTime = s.lastUsed
-			oldestSector = sectorNum
-		}
+func (f *r2File) ReadAt(b []byte, off int64) (n int, err error) {
+	if tracing() {
+		defer func(started time.Time) {
+			traceSince(f.name, started, Operation{Kind: OperationRead, Offset: off, Length: int64(len(b))}, err)
+		}(time.Now())
 	}
 
-	if oldestSector != -1 {
-		delete(f.cache, oldestSector)
-	}
-}
+	f.dataMtx.RLock()
+	defer f.dataMtx.RUnlock()
 
-func (f *r2File) ReadAt(b []byte, off int64) (n int, err error) {
 	if off >= f.size {
-		utils.Logger.Error("R2 - offset beyond file size, returning EOF.")
+		utils.VFSLogger.Error("R2 - offset beyond file size, returning EOF.")
 		return 0, io.EOF
 	}
 
@@ -311,9 +381,9 @@ func (f *r2File) ReadAt(b []byte, off int64) (n int, err error) {
 		sectorNum := currentOffset / remoteSectorSize
 		sectorOffset := currentOffset % remoteSectorSize
 
-		s, err := f.getSector(sectorNum)
+		s, err := f.getSector(sectorNum, (off+int64(totalBytes)-1)/remoteSectorSize-sectorNum+1)
 		if err != nil {
-			utils.Logger.Error("R2 - getSector failed.", zap.Error(err))
+			utils.VFSLogger.Error("R2 - getSector failed.", zap.Error(err))
 			return bytesRead, err
 		}
 
@@ -339,10 +409,19 @@ func (f *r2File) ReadAt(b []byte, off int64) (n int, err error) {
 
 func (f *r2File) WriteAt(b []byte, off int64) (n int, err error) {
 	if f.readOnly {
-		utils.Logger.Error("File is readonly, returning error.")
+		utils.VFSLogger.Error("File is readonly, returning error.")
 		return 0, sqlite3.IOERR_READ
 	}
 
+	if tracing() {
+		defer func(started time.Time) {
+			traceSince(f.name, started, Operation{Kind: OperationWrite, Offset: off, Length: int64(len(b))}, err)
+		}(time.Now())
+	}
+
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+
 	totalBytes := len(b)
 	bytesWritten := 0
 
@@ -351,9 +430,9 @@ func (f *r2File) WriteAt(b []byte, off int64) (n int, err error) {
 		sectorNum := currentOffset / remoteSectorSize
 		sectorOffset := currentOffset % remoteSectorSize
 
-		s, err := f.getSector(sectorNum)
+		s, err := f.getSector(sectorNum, (off+int64(totalBytes)-1)/remoteSectorSize-sectorNum+1)
 		if err != nil {
-			utils.Logger.Error("R2 - getSector failed.", zap.Error(err))
+			utils.VFSLogger.Error("R2 - getSector failed.", zap.Error(err))
 			return bytesWritten, err
 		}
 
@@ -365,13 +444,9 @@ func (f *r2File) WriteAt(b []byte, off int64) (n int, err error) {
 		bytesWritten += int(toWrite)
 
 		s.dirty = true
-		s.lastUsed = time.Now()
-
-		f.dirtyMtx.Lock()
 		f.dirtySectors[sectorNum] = s
-		f.dirtyMtx.Unlock()
 
-		utils.Logger.Debug("R2 - Marked sector as dirty.", zap.Int("sectorNum", int(sectorNum)))
+		utils.VFSSampledLogger.Debug("R2 - Marked sector as dirty.", zap.Int("sectorNum", int(sectorNum)))
 	}
 
 	newSize := off + int64(totalBytes)
@@ -387,7 +462,15 @@ func (f *r2File) Truncate(size int64) error {
 		return sqlite3.IOERR_READ
 	}
 
+	traceOperation(f.name, Operation{Kind: OperationTruncate, Length: size})
+
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+
 	f.size = size
+	f.sizeDirty = true
+	f.storedSize = min(f.storedSize, size)
+	f.truncatedTo = min(f.truncatedTo, size)
 
 	f.cacheMtx.Lock()
 	defer f.cacheMtx.Unlock()
@@ -396,6 +479,8 @@ func (f *r2File) Truncate(size int64) error {
 	for sectorNum := range f.cache {
 		if sectorNum >= firstSectorToRemove {
 			delete(f.cache, sectorNum)
+			f.eviction.remove(sectorNum)
+			utils.ReleaseMemory(utils.MemorySectorCache, remoteSectorSize)
 		}
 	}
 
@@ -405,9 +490,7 @@ func (f *r2File) Truncate(size int64) error {
 			offset := size % remoteSectorSize
 			clear(s.data[offset:])
 			s.dirty = true
-			f.dirtyMtx.Lock()
 			f.dirtySectors[lastSectorNum] = s
-			f.dirtyMtx.Unlock()
 		}
 	}
 
@@ -415,73 +498,192 @@ func (f *r2File) Truncate(size int64) error {
 }
 
 // TODO: implement a more sophisticated sync, currently we are uploading the whole file which isn't the best way
+// NOTE: the syncs run one at a time, each one uploads the object as left by the previous one with the sectors dirtied
+// since. The dirty sectors are copied under the data lock, the writes go on during the upload and are left dirty for
+// the next sync.
 func (f *r2File) Sync(flag vfs.SyncFlag) error {
 	if f.readOnly {
-		utils.Logger.Error("R2 - Sync aborted, file is read-only.")
+		utils.VFSLogger.Error("R2 - Sync aborted, file is read-only.")
 		return nil
 	}
 
-	f.dirtyMtx.Lock()
-	dirtySectors := make(map[int64]*sector)
-	for k, v := range f.dirtySectors {
-		dirtySectors[k] = v
+	if f.groupCommit {
+		f.stageCommit()
+		return nil
 	}
-	f.dirtySectors = make(map[int64]*sector)
-	f.dirtyMtx.Unlock()
 
-	if len(dirtySectors) == 0 {
-		utils.Logger.Debug("R2 - No dirty sectors to sync.")
+	f.syncMtx.Lock()
+	defer f.syncMtx.Unlock()
+
+	f.dataMtx.RLock()
+	clean := len(f.dirtySectors) == 0 && !f.sizeDirty
+	f.dataMtx.RUnlock()
+	if clean {
+		utils.VFSSampledLogger.Debug("R2 - No dirty sectors to sync.")
 		return nil
 	}
 
 	ctx := context.Background()
+	started := time.Now()
 
-	buf := make([]byte, f.size)
-
-	if f.size > 0 {
-		resp, err := f.client.GetObject(ctx, &s3.GetObjectInput{
-			Bucket: aws.String(f.bucket),
-			Key:    aws.String(f.name),
-		})
-		if err == nil {
-			defer resp.Body.Close()
-			n, readErr := io.ReadFull(resp.Body, buf)
-			utils.Logger.Debug("[r2]: Sync - read existing file.", zap.Int("bytesRead", n), zap.Error(readErr))
-		} else {
-			utils.Logger.Debug("[r2]: Sync - file does not exist, creating new.", zap.Error(err))
-		}
+	base, err := f.readStoredObject(ctx, started)
+	if err != nil {
+		return err
 	}
 
+	f.dataMtx.Lock()
+	size := f.size
+	buf := make([]byte, size)
+	copy(buf, base[:min(int64(len(base)), f.storedSize)])
+	f.truncatedTo = size
+
+	dirtySectors := f.dirtySectors
+	f.dirtySectors = make(map[int64]*sector)
+	sizeDirty := f.sizeDirty
+	f.sizeDirty = false
+
 	for sectorNum, s := range dirtySectors {
 		start := sectorNum * remoteSectorSize
-		end := start + remoteSectorSize
-		if end > f.size {
-			end = f.size
+		if start >= size {
+			continue
 		}
+		end := min(start+remoteSectorSize, size)
 		copy(buf[start:end], s.data[:end-start])
-		s.dirty = false
 	}
+	f.dataMtx.Unlock()
 
-	_, err := f.client.PutObject(ctx, &s3.PutObjectInput{
+	generation, err := f.stagedPut(ctx, buf)
+	traceSince(f.name, started, Operation{Kind: OperationSync, Length: int64(len(buf))}, err)
+
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+
+	if err != nil {
+		utils.VFSLogger.Error("R2 - Sync failed; staged upload failed.", zap.Error(err))
+		for sectorNum, s := range dirtySectors {
+			if _, exists := f.dirtySectors[sectorNum]; !exists {
+				f.dirtySectors[sectorNum] = s
+			}
+		}
+		f.sizeDirty = f.sizeDirty || sizeDirty
+		return sqlite3.IOERR_FSYNC
+	}
+
+	// NOTE: the object now has the uploaded length, minus what was truncated during the upload. The clean sectors are
+	// the same in both generations, those already fetched stay valid.
+	f.storedSize = min(size, f.truncatedTo)
+	f.generation = generation
+
+	// NOTE: the sectors stay dirty, and can't be evicted, until they are uploaded. Those written again during the upload
+	// are dirty for the next sync.
+	for sectorNum, s := range dirtySectors {
+		if _, redirtied := f.dirtySectors[sectorNum]; !redirtied {
+			s.dirty = false
+		}
+	}
+	return nil
+}
+
+// readStoredObject returns the content of the stored object the dirty sectors are uploaded over, empty when it doesn't
+// exist yet.
+func (f *r2File) readStoredObject(ctx context.Context, started time.Time) ([]byte, error) {
+	var base []byte
+	resp, err := f.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(f.bucket),
 		Key:    aws.String(f.name),
-		Body:   bytes.NewReader(buf),
 	})
+	switch err := conditionalError(err); {
+	case err == nil:
+		base, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			// NOTE: the clean sectors would be uploaded as zeros over the stored ones, the sectors stay dirty instead
+			utils.VFSLogger.Error("R2 - Sync failed; reading the stored object failed.", zap.String("name", f.name), zap.Error(err))
+			traceSince(f.name, started, Operation{Kind: OperationSync}, err)
+			return nil, sqlite3.IOERR_FSYNC
+		}
+		utils.VFSLogger.Debug("[r2]: Sync - read existing file.", zap.Int("bytesRead", len(base)))
+	case errors.Is(err, ErrObjectNotFound):
+		utils.VFSLogger.Debug("[r2]: Sync - file does not exist, creating new.")
+	default:
+		utils.VFSLogger.Error("R2 - Sync failed; getting the stored object failed.", zap.String("name", f.name), zap.Error(err))
+		traceSince(f.name, started, Operation{Kind: OperationSync}, err)
+		return nil, sqlite3.IOERR_FSYNC
+	}
+	return base, nil
+}
+
+// stagedPut uploads buf to a temporary staging key, verifies it and only then copies it over the live key,
+// so an interrupted sync can never leave a truncated primary object behind.
+func (f *r2File) stagedPut(ctx context.Context, buf []byte) (string, error) {
+	stagingKey := fmt.Sprintf("%s%s%d", f.name, stagingKeySuffix, time.Now().UnixNano())
+
+	// NOTE: the staging object is always cleaned up, on success it is redundant and on failure it is garbage
+	defer func() {
+		_, err := f.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(f.bucket),
+			Key:    aws.String(stagingKey),
+		})
+		if err != nil {
+			utils.VFSLogger.Warn("R2 - Failed to delete staging object.", zap.String("stagingKey", stagingKey), zap.Error(err))
+		}
+	}()
+
+	body, release := throttleUpload(ctx, f.name, buf)
+	defer release()
+
+	_, err := f.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(f.bucket),
+		Key:    aws.String(stagingKey),
+		Body:   body,
+		Metadata: map[string]string{
+			sizeMetadataKey: strconv.FormatInt(int64(len(buf)), 10),
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload staging object %s: %w", stagingKey, err)
+	}
+	recordTransfer(f.name, 0, int64(len(buf)))
 
+	headResp, err := f.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(f.bucket),
+		Key:    aws.String(stagingKey),
+	})
 	if err != nil {
-		utils.Logger.Error("R2 - Sync failed; PutObject failed.", zap.Error(err))
-		return sqlite3.IOERR_FSYNC
+		return "", fmt.Errorf("failed to verify staging object %s: %w", stagingKey, err)
 	}
 
-	return nil
+	if stagedSize := aws.ToInt64(headResp.ContentLength); stagedSize != int64(len(buf)) {
+		return "", fmt.Errorf("staging object %s has size %d, expected %d", stagingKey, stagedSize, len(buf))
+	}
+
+	copyResp, err := f.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(f.bucket),
+		Key:        aws.String(f.name),
+		CopySource: aws.String(fmt.Sprintf("%s/%s", f.bucket, url.PathEscape(stagingKey))),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to swap staging object %s into %s: %w", stagingKey, f.name, err)
+	}
+	forgetMissing(f.name)
+
+	// NOTE: the generation of the live object, left unknown when the store doesn't return it
+	if copyResp.CopyObjectResult == nil {
+		return "", nil
+	}
+	generation := aws.ToString(copyResp.CopyObjectResult.ETag)
+	if generation != "" && checksummed(f.name) {
+		f.putChecksums(ctx, buf, generation)
+	}
+	return generation, nil
 }
 
 func (f *r2File) Size() (int64, error) {
+	f.dataMtx.RLock()
+	defer f.dataMtx.RUnlock()
 	return f.size, nil
 }
 
-const spinWait = 25 * time.Microsecond
-
 func (f *r2File) Lock(lock vfs.LockLevel) error {
 	if f.lock >= lock {
 		return nil
@@ -491,35 +693,58 @@ func (f *r2File) Lock(lock vfs.LockLevel) error {
 		return sqlite3.IOERR_LOCK
 	}
 
-	f.lockMtx.Lock()
-	defer f.lockMtx.Unlock()
+	locks := f.locks
+	locks.mtx.Lock()
+	defer locks.mtx.Unlock()
 
+	deadline := time.Now().Add(utils.LockWait(utils.GetRemoteStage()))
 	switch lock {
 	case vfs.LOCK_SHARED:
-		if f.pending {
-			return sqlite3.BUSY
+		for {
+			if !locks.wait(f.name, deadline, func() bool { return !locks.pending }) {
+				utils.RecordLockBusy(f.name, lock)
+				return sqlite3.BUSY
+			}
+			// NOTE: the commits another connection staged are uploaded before the object is read, see stageCommit
+			writer := locks.staged
+			if writer == nil || writer == f {
+				break
+			}
+			locks.mtx.Unlock()
+			err := writer.flush()
+			locks.mtx.Lock()
+			if err != nil {
+				return sqlite3.IOERR_LOCK
+			}
+		}
+		locks.shared++
+		if f.writesSeen != locks.writes {
+			f.invalidate(locks.size, locks.generation)
+			f.writesSeen = locks.writes
 		}
-		f.shared++
+		f.resetReadAhead()
 
 	case vfs.LOCK_RESERVED:
-		if f.reserved {
+		// NOTE: the connection holds a shared lock, waiting is given up once the writer holding the reserved lock waits for
+		// the readers to leave
+		locks.wait(f.name, deadline, func() bool { return !locks.reserved || locks.pending })
+		if locks.reserved {
+			utils.RecordLockBusy(f.name, lock)
 			return sqlite3.BUSY
 		}
+		locks.reserved = true
 		f.reserved = true
 
 	case vfs.LOCK_EXCLUSIVE:
 		if f.lock < vfs.LOCK_PENDING {
 			f.lock = vfs.LOCK_PENDING
+			locks.pending = true
 			f.pending = true
 		}
 
-		for before := time.Now(); f.shared > 1; {
-			if time.Since(before) > spinWait {
-				return sqlite3.BUSY
-			}
-			f.lockMtx.Unlock()
-			runtime.Gosched()
-			f.lockMtx.Lock()
+		if !locks.wait(f.name, deadline, func() bool { return locks.shared <= 1 }) {
+			utils.RecordLockBusy(f.name, lock)
+			return sqlite3.BUSY
 		}
 	}
 
@@ -532,19 +757,30 @@ func (f *r2File) Unlock(lock vfs.LockLevel) error {
 		return nil
 	}
 
-	f.lockMtx.Lock()
-	defer f.lockMtx.Unlock()
+	locks := f.locks
+	locks.mtx.Lock()
+	defer locks.mtx.Unlock()
 
-	if f.lock >= vfs.LOCK_RESERVED {
+	if f.lock == vfs.LOCK_EXCLUSIVE {
+		f.dataMtx.RLock()
+		locks.size, locks.generation = f.storedSize, f.generation
+		f.dataMtx.RUnlock()
+		locks.writes++
+		f.writesSeen = locks.writes
+	}
+	if f.reserved {
+		locks.reserved = false
 		f.reserved = false
 	}
-	if f.lock >= vfs.LOCK_PENDING {
+	if f.pending {
+		locks.pending = false
 		f.pending = false
 	}
-	if lock < vfs.LOCK_SHARED {
-		f.shared--
+	if f.lock >= vfs.LOCK_SHARED && lock < vfs.LOCK_SHARED {
+		locks.shared--
 	}
 	f.lock = lock
+	locks.released.Broadcast()
 	return nil
 }
 
@@ -552,15 +788,13 @@ func (f *r2File) CheckReservedLock() (bool, error) {
 	if f.lock >= vfs.LOCK_RESERVED {
 		return true, nil
 	}
-	f.lockMtx.Lock()
-	defer f.lockMtx.Unlock()
-	return f.reserved, nil
+	f.locks.mtx.Lock()
+	defer f.locks.mtx.Unlock()
+	return f.locks.reserved, nil
 }
 
 func (f *r2File) DeviceCharacteristics() vfs.DeviceCharacteristic {
-	return vfs.IOCAP_ATOMIC |
-		vfs.IOCAP_SEQUENTIAL |
-		vfs.IOCAP_SAFE_APPEND
+	return remoteCharacteristics
 }
 
 var (
@@ -568,7 +802,22 @@ var (
 	_ vfs.FileSizeHint  = &r2File{}
 )
 
+// SizeHint grows the file to the size SQLite is about to write, as the OS VFS preallocates it. The file is never shrunk
+// and the added bytes are zeros, uploaded with the next sync.
 func (f *r2File) SizeHint(size int64) error {
+	if f.readOnly {
+		return sqlite3.IOERR_READ
+	}
+
+	traceOperation(f.name, Operation{Kind: OperationSizeHint, Length: size})
+
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+
+	if size > f.size {
+		f.size = size
+		f.sizeDirty = true
+	}
 	return nil
 }
 
@@ -583,33 +832,232 @@ func min(a, b int64) int64 {
 	return b
 }
 
+// FileSize returns the logical size of the given remote object.
+func FileSize(key string) (int64, error) {
+	location := locate(key)
+	headResp, err := location.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(location.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return reconcileSize(key, headResp), nil
+}
+
+// ObjectExists reports whether an object is stored under the key, failing when the bucket can't tell.
+func ObjectExists(key string) (bool, error) {
+	location := locate(key)
+	_, err := location.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(location.bucket),
+		Key:    aws.String(key),
+	})
+	if err := conditionalError(err); err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// ObjectGeneration returns an identifier of the current content of the remote object, it changes whenever the object
+// is rewritten. It fails with ErrObjectNotFound when no object is stored under the key.
+func ObjectGeneration(key string) (string, error) {
+	location := locate(key)
+	headResp, err := location.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(location.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", conditionalError(err)
+	}
+
+	if generation := generationOf(headResp); generation != "" {
+		return generation, nil
+	}
+	return "", fmt.Errorf("remote object %s has no generation identifier", key)
+}
+
+// ObjectStat is the metadata of a remote object.
+type ObjectStat struct {
+	Size         int64
+	LastModified time.Time
+	Generation   string
+}
+
+// StatObject returns the logical size, the last write and the generation of the remote object.
+func StatObject(key string) (ObjectStat, error) {
+	location := locate(key)
+	headResp, err := location.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(location.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectStat{}, conditionalError(err)
+	}
+
+	return ObjectStat{
+		Size:         reconcileSize(key, headResp),
+		LastModified: aws.ToTime(headResp.LastModified),
+		Generation:   generationOf(headResp),
+	}, nil
+}
+
+func generationOf(headResp *s3.HeadObjectOutput) string {
+	if headResp.ETag != nil && *headResp.ETag != "" {
+		return *headResp.ETag
+	}
+	// NOTE: some S3 compatible stores omit the ETag of objects written through multipart uploads
+	if headResp.LastModified != nil {
+		return headResp.LastModified.UTC().Format(time.RFC3339Nano)
+	}
+	return ""
+}
+
+// PutObject stores body under the given key, for objects written outside of the VFS, e.g. audit batches.
+func PutObject(ctx context.Context, key string, body []byte, contentType string) error {
+	location := locate(key)
+	_, err := location.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(location.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
+	if err == nil {
+		forgetMissing(key)
+	}
+	return err
+}
+
+// DownloadObject copies the content of the given remote object to w.
+func DownloadObject(ctx context.Context, key string, w io.Writer) (int64, error) {
+	location := locate(key)
+	response, err := location.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(location.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	n, err := io.Copy(w, response.Body)
+	recordTransfer(key, n, 0)
+	return n, err
+}
+
+// PresignDownloadURL returns a time-limited presigned GET URL for the given remote object.
+func PresignDownloadURL(key string, expiry time.Duration) (string, time.Time, error) {
+	// NOTE: signed with the credentials of the bucket holding the object, the keys of a tenant only reach its bucket
+	location := locate(key)
+	presignClient := s3.NewPresignClient(location.client)
+
+	request, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(location.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		utils.VFSLogger.Error("Failed to presign remote object download.", zap.String("key", key), zap.Error(err))
+		return "", time.Time{}, err
+	}
+
+	return request.URL, time.Now().Add(expiry), nil
+}
+
 type FileInfo struct {
 	Key          string
 	Size         int64
 	LastModified *time.Time
 }
 
+// ListOptions filters the objects returned by ListFilesWithOptions.
+type ListOptions struct {
+	// Prefix restricts the listing to keys starting with it.
+	Prefix string
+	// Delimiter groups keys sharing the same prefix up to the delimiter into common prefixes instead of listing them.
+	Delimiter string
+}
+
 func ListFiles() ([]FileInfo, error) {
-	client := getRemoteClient()
+	files, _, err := ListFilesWithOptions(ListOptions{})
+	return files, err
+}
 
-	resp, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket: aws.String(utils.Config.Storage.Remote.BucketName),
-	})
-	if err != nil {
-		utils.Logger.Error("Failed to list objects in remote bucket.", zap.Error(err), zap.String("bucket", utils.Config.Storage.Remote.BucketName))
-		return nil, err
+// ListFilesWithOptions lists the objects of the remote buckets following continuation tokens, returning the matching
+// files and, when a delimiter is provided, the common prefixes. A prefix owned by a tenant is only listed in its bucket,
+// other listings span the shared bucket and those of the tenants.
+func ListFilesWithOptions(options ListOptions) ([]FileInfo, []string, error) {
+	if tenant := TenantOf(options.Prefix); tenant != "" {
+		return listLocation(locate(options.Prefix), options)
 	}
 
 	var files []FileInfo
-	for _, obj := range resp.Contents {
-		files = append(files, FileInfo{
-			Key:          *obj.Key,
-			Size:         *obj.Size,
-			LastModified: obj.LastModified,
-		})
+	var prefixes []string
+
+	for _, location := range allLocations() {
+		locationFiles, locationPrefixes, err := listLocation(location, options)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// NOTE: objects are only reported from the bucket they are routed to, e.g. the copies left in the shared bucket
+		// by a tenant configured afterwards are ignored
+		for _, file := range locationFiles {
+			if TenantOf(file.Key) == location.tenant {
+				files = append(files, file)
+			}
+		}
+		for _, prefix := range locationPrefixes {
+			if TenantOf(prefix) == location.tenant {
+				prefixes = append(prefixes, prefix)
+			}
+		}
 	}
 
-	return files, nil
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+	sort.Strings(prefixes)
+
+	return files, prefixes, nil
+}
+
+func listLocation(location *location, options ListOptions) ([]FileInfo, []string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(location.bucket),
+	}
+	if options.Prefix != "" {
+		input.Prefix = aws.String(options.Prefix)
+	}
+	if options.Delimiter != "" {
+		input.Delimiter = aws.String(options.Delimiter)
+	}
+
+	var files []FileInfo
+	var prefixes []string
+
+	paginator := s3.NewListObjectsV2Paginator(location.client, input)
+	for page := 1; paginator.HasMorePages(); page++ {
+		resp, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			utils.VFSLogger.Error("Failed to list objects in remote bucket.", zap.Error(err), zap.String("bucket", location.bucket), zap.Int("page", page))
+			return nil, nil, err
+		}
+
+		for _, obj := range resp.Contents {
+			files = append(files, FileInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: obj.LastModified,
+			})
+		}
+
+		for _, commonPrefix := range resp.CommonPrefixes {
+			prefixes = append(prefixes, aws.ToString(commonPrefix.Prefix))
+		}
+	}
+
+	return files, prefixes, nil
 }
 
 type DatabaseStruct struct {
@@ -618,46 +1066,42 @@ type DatabaseStruct struct {
 	Stage        uint
 	LastAccessed time.Time
 	RequestCount uint
+	// NOTE: last write of the remote object, zero when the bucket doesn't report it
+	LastModified time.Time
+}
+
+// DatabaseNameFromKey returns the name of the database stored under the given key, reporting false for keys that
+// don't hold a database (journals, temporary and nested objects, other data), see utils.DatabaseNameFromFileName.
+func DatabaseNameFromKey(key string) (string, bool) {
+	return utils.DatabaseNameFromFileName(key)
 }
 
 func ListDatabases() ([]*DatabaseStruct, error) {
 	var databases []*DatabaseStruct
 
-	files, err := ListFiles()
+	// NOTE: databases live at the root of the bucket, nested keys are grouped away by the delimiter
+	files, _, err := ListFilesWithOptions(ListOptions{Delimiter: "/"})
 	if err != nil {
-		utils.Logger.Error("Failed to list files from remote storage.", zap.Error(err))
+		utils.VFSLogger.Error("Failed to list files from remote storage.", zap.Error(err))
 		return databases, err
 	}
 
 	for _, file := range files {
-		key := file.Key
-
-		// TODO: be carful for the temp_
-		if strings.Contains(key, "temp_") || strings.Contains(key, "-journal") || strings.Contains(key, "-wal") || strings.Contains(key, "-shm") {
-			continue
-		}
+		// NOTE: the objects skipped are reported by the reconciliation of the catalog
+		baseName, isDatabase := DatabaseNameFromKey(file.Key)
 
-		var baseName string
-		var isDatabase bool
-
-		if strings.HasSuffix(key, ".db") {
-			baseName = strings.TrimSuffix(key, ".db")
-			isDatabase = true
-		} else {
-			if !strings.Contains(key, ".") && !strings.Contains(key, "/") {
-				baseName = key
-				isDatabase = true
-			}
-		}
-
-		if isDatabase && baseName != "" {
-			databases = append(databases, &DatabaseStruct{
-				Path:         key,
+		if isDatabase {
+			database := &DatabaseStruct{
+				Path:         file.Key,
 				Name:         baseName,
 				Stage:        utils.Config.Storage.Remote.StageNumber,
 				LastAccessed: time.Now(),
 				RequestCount: 0,
-			})
+			}
+			if file.LastModified != nil {
+				database.LastModified = *file.LastModified
+			}
+			databases = append(databases, database)
 		}
 	}
 
@@ -0,0 +1,142 @@
+package remotevfs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.uber.org/zap"
+)
+
+// location is a bucket objects are stored in along with the client allowed to reach it.
+type location struct {
+	// NOTE: empty for the shared bucket
+	tenant string
+	bucket string
+	client *s3.Client
+}
+
+// tenantConfig is an entry of STORAGE_REMOTE_TENANTS, the keys are empty when the tenant uses the shared credentials.
+type tenantConfig struct {
+	name        string
+	bucket      string
+	accessKeyID string
+	secretKey   string
+}
+
+var (
+	tenantLocations     map[string]*location
+	tenantLocationsOnce sync.Once
+)
+
+// parseTenant decodes a <tenant>:<bucket>[:<access key id>:<secret key>] entry.
+func parseTenant(entry string) (tenantConfig, bool) {
+	fields := strings.SplitN(strings.TrimSpace(entry), ":", 4)
+	if len(fields) != 2 && len(fields) != 4 {
+		return tenantConfig{}, false
+	}
+
+	tenant := tenantConfig{name: fields[0], bucket: fields[1]}
+	if len(fields) == 4 {
+		tenant.accessKeyID, tenant.secretKey = fields[2], fields[3]
+	}
+	return tenant, tenant.name != "" && tenant.bucket != ""
+}
+
+// TenantOf returns the tenant owning the key, empty for the keys stored in the shared bucket. A key belongs to a tenant
+// when one of its path segments starts with the tenant name followed by the separator, so the databases of the tenant
+// along with their backups and leases are all stored in its bucket.
+func TenantOf(key string) string {
+	separator := utils.Config.Storage.Remote.TenantSeparator
+	if len(utils.Config.Storage.Remote.Tenants) == 0 || separator == "" {
+		return ""
+	}
+
+	for _, segment := range strings.Split(key, "/") {
+		name, _, found := strings.Cut(segment, separator)
+		if !found || name == "" {
+			continue
+		}
+		if _, configured := getTenantLocations()[name]; configured {
+			return name
+		}
+	}
+	return ""
+}
+
+// locate returns where the object stored under key lives.
+func locate(key string) *location {
+	if tenant := TenantOf(key); tenant != "" {
+		return getTenantLocations()[tenant]
+	}
+	return sharedLocation()
+}
+
+// BucketOf returns the name of the bucket the object stored under key lives in.
+func BucketOf(key string) string {
+	return locate(key).bucket
+}
+
+func sharedLocation() *location {
+	return &location{bucket: utils.Config.Storage.Remote.BucketName, client: getRemoteClient()}
+}
+
+// allLocations returns the shared bucket followed by the buckets of the tenants.
+func allLocations() []*location {
+	locations := []*location{sharedLocation()}
+	for _, tenant := range getTenantLocations() {
+		locations = append(locations, tenant)
+	}
+	sort.Slice(locations[1:], func(i, j int) bool { return locations[i+1].tenant < locations[j+1].tenant })
+	return locations
+}
+
+func getTenantLocations() map[string]*location {
+	tenantLocationsOnce.Do(func() {
+		tenantLocations = map[string]*location{}
+
+		for _, entry := range utils.Config.Storage.Remote.Tenants {
+			tenant, valid := parseTenant(entry.Value())
+			if !valid {
+				continue
+			}
+
+			client := getRemoteClient()
+			if tenant.accessKeyID != "" {
+				// NOTE: the tenant keys are scoped to its bucket, they replace the shared credentials rather than add to them
+				cfg := remoteConfig.Copy()
+				cache := aws.NewCredentialsCache(tenantCredentials(tenant.name), func(o *aws.CredentialsCacheOptions) {
+					o.ExpiryWindow = time.Duration(utils.Config.Storage.Remote.CredentialsExpiryWindowSeconds) * time.Second
+				})
+				cfg.Credentials = cache
+				utils.OnSecretsRotated(cache.Invalidate)
+				client = newRemoteClient(cfg)
+			}
+
+			tenantLocations[tenant.name] = &location{tenant: tenant.name, bucket: tenant.bucket, client: client}
+
+			utils.VFSLogger.Debug("Initialized tenant bucket.", zap.String("tenant", tenant.name), zap.String("bucket", tenant.bucket), zap.Bool("ownCredentials", tenant.accessKeyID != ""))
+		}
+	})
+	return tenantLocations
+}
+
+// tenantCredentials returns the keys of the tenant, read on every retrieval so rotated secrets are used once the cache
+// is invalidated.
+func tenantCredentials(name string) aws.CredentialsProviderFunc {
+	return func(ctx context.Context) (aws.Credentials, error) {
+		for _, entry := range utils.Config.Storage.Remote.Tenants {
+			if tenant, valid := parseTenant(entry.Value()); valid && tenant.name == name {
+				return aws.Credentials{AccessKeyID: tenant.accessKeyID, SecretAccessKey: tenant.secretKey, Source: credentialsSourceStatic}, nil
+			}
+		}
+		return aws.Credentials{}, fmt.Errorf("tenant %s is no longer configured", name)
+	}
+}
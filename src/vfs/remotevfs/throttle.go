@@ -0,0 +1,220 @@
+package remotevfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"persisto/src/utils"
+)
+
+// NOTE: the uploads of the syncs and stage copies share a bandwidth budget across the databases and one for each of
+// them, so that the background upload of a large database doesn't starve the sector reads. The uploads waiting for
+// the same budget are served smallest first, a sync of a few pages goes ahead of the demotion of a large database.
+
+// NOTE: the bytes charged at once, the budget holds at least that much so that a low rate still lets the uploads move
+const throttleChunkSize = 64 * 1024
+
+type uploadWaiter struct {
+	size int64
+}
+
+type bandwidth struct {
+	mtx sync.Mutex
+
+	tokens  float64
+	filled  time.Time
+	waiters []*uploadWaiter
+}
+
+var (
+	globalBandwidth   = &bandwidth{}
+	databaseBandwidth = map[string]*bandwidth{}
+	databaseMtx       sync.Mutex
+
+	throttledUploads atomic.Int64
+	throttledWaitMs  atomic.Int64
+	waitingUploads   atomic.Int64
+)
+
+// UploadThrottleStats is the activity of the bandwidth budgets of the uploads.
+type UploadThrottleStats struct {
+	Waiting   int64 `json:"waiting" doc:"Uploads currently waiting for their bandwidth budget."`
+	Throttled int64 `json:"throttled" doc:"Uploads slowed down by a bandwidth budget since the start."`
+	WaitedMs  int64 `json:"waited_ms" doc:"Time the uploads spent waiting for their bandwidth budget since the start."`
+}
+
+// GetUploadThrottleStats returns the activity of the bandwidth budgets of the uploads.
+func GetUploadThrottleStats() UploadThrottleStats {
+	return UploadThrottleStats{
+		Waiting:   waitingUploads.Load(),
+		Throttled: throttledUploads.Load(),
+		WaitedMs:  throttledWaitMs.Load(),
+	}
+}
+
+func bandwidthOf(key string) *bandwidth {
+	name, isDatabase := DatabaseNameFromKey(key)
+	if !isDatabase {
+		name = key
+	}
+
+	databaseMtx.Lock()
+	defer databaseMtx.Unlock()
+	budget, exists := databaseBandwidth[name]
+	if !exists {
+		budget = &bandwidth{}
+		databaseBandwidth[name] = budget
+	}
+	return budget
+}
+
+// enqueue registers the upload among those waiting for the budget, ordered by size.
+func (budget *bandwidth) enqueue(waiter *uploadWaiter) {
+	budget.mtx.Lock()
+	defer budget.mtx.Unlock()
+	position, _ := slices.BinarySearchFunc(budget.waiters, waiter.size, func(queued *uploadWaiter, size int64) int {
+		// NOTE: placed after the uploads of the same size, those of equal size are served in order of arrival
+		if queued.size <= size {
+			return -1
+		}
+		return 1
+	})
+	budget.waiters = slices.Insert(budget.waiters, position, waiter)
+}
+
+func (budget *bandwidth) dequeue(waiter *uploadWaiter) {
+	budget.mtx.Lock()
+	defer budget.mtx.Unlock()
+	budget.waiters = slices.DeleteFunc(budget.waiters, func(queued *uploadWaiter) bool {
+		return queued == waiter
+	})
+}
+
+// take waits until the budget allows n more bytes of the upload, the smallest upload waiting being served first. It
+// returns whether the upload had to wait.
+func (budget *bandwidth) take(ctx context.Context, waiter *uploadWaiter, n int, rate int64) (bool, error) {
+	if rate <= 0 {
+		return false, nil
+	}
+
+	waited := false
+	for {
+		budget.mtx.Lock()
+		now := time.Now()
+		capacity := float64(max(rate, throttleChunkSize))
+		if budget.filled.IsZero() {
+			budget.tokens = capacity
+		} else {
+			budget.tokens = math.Min(capacity, budget.tokens+now.Sub(budget.filled).Seconds()*float64(rate))
+		}
+		budget.filled = now
+
+		// NOTE: the uploads behind the head check back shortly, the head may finish or a smaller upload may arrive
+		wait := 10 * time.Millisecond
+		if len(budget.waiters) > 0 && budget.waiters[0] == waiter {
+			if budget.tokens >= float64(n) {
+				budget.tokens -= float64(n)
+				budget.mtx.Unlock()
+				return waited, nil
+			}
+			wait = time.Duration((float64(n) - budget.tokens) / float64(rate) * float64(time.Second))
+		}
+		budget.mtx.Unlock()
+
+		waited = true
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return waited, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// throttledReader charges the bytes of an upload against the global and the database budgets as the client reads
+// them. It only implements Read and Seek, the client would otherwise copy the body at once through WriteTo.
+type throttledReader struct {
+	ctx    context.Context
+	reader *bytes.Reader
+	budget *bandwidth
+	waiter *uploadWaiter
+
+	// NOTE: the bytes read again after a retry rewound the body were already charged
+	charged   int64
+	throttled bool
+}
+
+// throttleUpload returns the body of the upload of buf to key bound by the bandwidth budgets, and the function
+// releasing its place among the waiting uploads once it is done.
+func throttleUpload(ctx context.Context, key string, buf []byte) (io.ReadSeeker, func()) {
+	remoteConfig := utils.Config.Storage.Remote
+	if remoteConfig.UploadBytesPerSecond == 0 && remoteConfig.DatabaseUploadBytesPerSecond == 0 {
+		return bytes.NewReader(buf), func() {}
+	}
+
+	reader := &throttledReader{
+		ctx:    ctx,
+		reader: bytes.NewReader(buf),
+		budget: bandwidthOf(key),
+		waiter: &uploadWaiter{size: int64(len(buf))},
+	}
+	reader.budget.enqueue(reader.waiter)
+	globalBandwidth.enqueue(reader.waiter)
+	return reader, func() {
+		reader.budget.dequeue(reader.waiter)
+		globalBandwidth.dequeue(reader.waiter)
+	}
+}
+
+func (reader *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+
+	offset := reader.reader.Size() - int64(reader.reader.Len())
+	if uncharged := offset + int64(len(p)) - reader.charged; uncharged > 0 && reader.reader.Len() > 0 {
+		uncharged = min(uncharged, int64(reader.reader.Len()))
+		if err := reader.wait(int(uncharged)); err != nil {
+			return 0, err
+		}
+		reader.charged += uncharged
+	}
+	return reader.reader.Read(p)
+}
+
+func (reader *throttledReader) Seek(offset int64, whence int) (int64, error) {
+	return reader.reader.Seek(offset, whence)
+}
+
+func (reader *throttledReader) wait(n int) error {
+	remoteConfig := utils.Config.Storage.Remote
+	start := time.Now()
+
+	waitingUploads.Add(1)
+	defer waitingUploads.Add(-1)
+
+	waitedDatabase, err := reader.budget.take(reader.ctx, reader.waiter, n, remoteConfig.DatabaseUploadBytesPerSecond)
+	if err != nil {
+		return err
+	}
+	waitedGlobal, err := globalBandwidth.take(reader.ctx, reader.waiter, n, remoteConfig.UploadBytesPerSecond)
+	if err != nil {
+		return err
+	}
+
+	if waitedDatabase || waitedGlobal {
+		if !reader.throttled {
+			reader.throttled = true
+			throttledUploads.Add(1)
+		}
+		throttledWaitMs.Add(time.Since(start).Milliseconds())
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package remotevfs
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"persisto/src/utils"
+)
+
+// NOTE: kinds of the traced operations
+const (
+	OperationOpen     = "open"
+	OperationClose    = "close"
+	OperationDelete   = "delete"
+	OperationRead     = "read"
+	OperationWrite    = "write"
+	OperationTruncate = "truncate"
+	OperationSizeHint = "size_hint"
+	OperationSync     = "sync"
+	// NOTE: sectors read from the bucket, or from the disk cache, on a miss of the sector cache
+	OperationFetch = "fetch"
+	OperationEvict = "evict"
+)
+
+// NOTE: sources of the fetched sectors
+const (
+	SourceRemote = "remote"
+	SourceDisk   = "disk"
+)
+
+// Operation is an operation of the remote VFS on an object, as traced for diagnostics.
+type Operation struct {
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	Offset     int64     `json:"offset" doc:"First byte of the object the operation is about."`
+	Length     int64     `json:"length" doc:"Bytes the operation is about, the size of the object for the opens, truncations and size hints."`
+	Source     string    `json:"source,omitempty" doc:"Where the fetched sectors were read from, remote or disk."`
+	DurationMs float64   `json:"duration_ms,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// NOTE: the last operations of an object, the oldest one is overwritten once the ring is full
+type traceRing struct {
+	operations []Operation
+	next       int
+}
+
+var (
+	traces      = map[string]*traceRing{}
+	tracesMutex sync.Mutex
+)
+
+func tracing() bool {
+	return utils.Config.Storage.Remote.TraceEnabled
+}
+
+func traceOperation(key string, operation Operation) {
+	if !tracing() {
+		return
+	}
+	if operation.Time.IsZero() {
+		operation.Time = time.Now().UTC()
+	}
+
+	tracesMutex.Lock()
+	defer tracesMutex.Unlock()
+
+	ring, exists := traces[key]
+	if !exists {
+		ring = &traceRing{operations: make([]Operation, 0, utils.Config.Storage.Remote.TraceSize)}
+		traces[key] = ring
+	}
+	if len(ring.operations) < cap(ring.operations) {
+		ring.operations = append(ring.operations, operation)
+		return
+	}
+	ring.operations[ring.next] = operation
+	ring.next = (ring.next + 1) % len(ring.operations)
+}
+
+// traceSince traces an operation that started at the given time, with its duration and error.
+func traceSince(key string, started time.Time, operation Operation, err error) {
+	if !tracing() {
+		return
+	}
+	operation.Time = started.UTC()
+	operation.DurationMs = float64(time.Since(started).Microseconds()) / 1000
+	operation.Error = errorString(err)
+	traceOperation(key, operation)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// ObjectTrace is the trace of the operations on a remote object.
+type ObjectTrace struct {
+	Key        string      `json:"key"`
+	Operations []Operation `json:"operations" doc:"Last operations on the object, oldest first."`
+}
+
+// Trace returns the operations traced on the objects, of every object when key is empty.
+func Trace(key string) []ObjectTrace {
+	tracesMutex.Lock()
+	defer tracesMutex.Unlock()
+
+	result := []ObjectTrace{}
+	for traced, ring := range traces {
+		if key != "" && traced != key {
+			continue
+		}
+		operations := make([]Operation, 0, len(ring.operations))
+		operations = append(operations, ring.operations[ring.next:]...)
+		operations = append(operations, ring.operations[:ring.next]...)
+		result = append(result, ObjectTrace{Key: traced, Operations: operations})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+// ClearTrace drops the operations traced on the objects, of every object when key is empty.
+func ClearTrace(key string) {
+	tracesMutex.Lock()
+	defer tracesMutex.Unlock()
+
+	if key == "" {
+		traces = map[string]*traceRing{}
+		return
+	}
+	delete(traces, key)
+}
@@ -0,0 +1,40 @@
+package remotevfs
+
+import "sync"
+
+// Transfer is the number of bytes exchanged with the bucket for an object.
+type Transfer struct {
+	Downloaded int64
+	Uploaded   int64
+}
+
+var (
+	transfers      = map[string]*Transfer{}
+	transfersMutex sync.Mutex
+)
+
+func recordTransfer(key string, downloaded, uploaded int64) {
+	transfersMutex.Lock()
+	defer transfersMutex.Unlock()
+
+	transfer, exists := transfers[key]
+	if !exists {
+		transfer = &Transfer{}
+		transfers[key] = transfer
+	}
+	transfer.Downloaded += downloaded
+	transfer.Uploaded += uploaded
+}
+
+// TakeTransfers returns the bytes exchanged per object key since the previous call and resets the counters.
+func TakeTransfers() map[string]Transfer {
+	transfersMutex.Lock()
+	defer transfersMutex.Unlock()
+
+	result := make(map[string]Transfer, len(transfers))
+	for key, transfer := range transfers {
+		result[key] = *transfer
+	}
+	transfers = map[string]*Transfer{}
+	return result
+}
@@ -1,20 +1,99 @@
 package vfs
 
 import (
+	"fmt"
+
 	"persisto/src/utils"
 	"persisto/src/vfs/localvfs"
 	"persisto/src/vfs/remotevfs"
+
+	sqlitevfs "github.com/ncruces/go-sqlite3/vfs"
 )
 
+// Info describes a VFS the databases are opened through, as SQLite sees it.
+type Info struct {
+	Name            string   `json:"name"`
+	Description     string   `json:"description"`
+	Filesystem      string   `json:"filesystem,omitempty" doc:"Filesystem detected for the local storage directory."`
+	SectorSize      int      `json:"sector_size,omitempty"`
+	Characteristics []string `json:"characteristics" doc:"Device characteristics SQLite is told the files have, e.g. atomic or powersafe_overwrite."`
+}
+
+var characteristicNames = []struct {
+	characteristic sqlitevfs.DeviceCharacteristic
+	name           string
+}{
+	{sqlitevfs.IOCAP_ATOMIC, "atomic"},
+	{sqlitevfs.IOCAP_ATOMIC512, "atomic512"},
+	{sqlitevfs.IOCAP_ATOMIC1K, "atomic1k"},
+	{sqlitevfs.IOCAP_ATOMIC2K, "atomic2k"},
+	{sqlitevfs.IOCAP_ATOMIC4K, "atomic4k"},
+	{sqlitevfs.IOCAP_ATOMIC8K, "atomic8k"},
+	{sqlitevfs.IOCAP_ATOMIC16K, "atomic16k"},
+	{sqlitevfs.IOCAP_ATOMIC32K, "atomic32k"},
+	{sqlitevfs.IOCAP_ATOMIC64K, "atomic64k"},
+	{sqlitevfs.IOCAP_SAFE_APPEND, "safe_append"},
+	{sqlitevfs.IOCAP_SEQUENTIAL, "sequential"},
+	{sqlitevfs.IOCAP_UNDELETABLE_WHEN_OPEN, "undeletable_when_open"},
+	{sqlitevfs.IOCAP_POWERSAFE_OVERWRITE, "powersafe_overwrite"},
+	{sqlitevfs.IOCAP_IMMUTABLE, "immutable"},
+	{sqlitevfs.IOCAP_BATCH_ATOMIC, "batch_atomic"},
+	{sqlitevfs.IOCAP_SUBPAGE_READ, "subpage_read"},
+}
+
 func RegisterVfs() error {
-	utils.Logger.Info("Registering Local VFS.")
+	// NOTE: checked first, the local storage directory is only emptied when the remote stage holds the databases
+	if err := remotevfs.CheckRemote(); err != nil {
+		if utils.Config.Storage.Remote.Required {
+			return fmt.Errorf("the remote stage is required: %w", err)
+		}
+		if err := utils.SetRemoteOffline(err.Error()); err != nil {
+			return err
+		}
+	}
+
+	utils.VFSLogger.Info("Registering Local VFS.")
 	if err := localvfs.RegisterLocalVfs(); err != nil {
-		utils.Logger.Error("Failed to register Local VFS: " + err.Error())
+		utils.VFSLogger.Error("Failed to register Local VFS: " + err.Error())
 		return err
 	}
 
-	utils.Logger.Info("Registering Remote VFS.")
+	utils.VFSLogger.Info("Registering Remote VFS.")
 	remotevfs.RegisterRemoteVfs()
 
 	return nil
 }
+
+// Registered describes the VFSes registered with SQLite: the one of the operating system, used for scratch files such
+// as the backups being read, and those of the local and remote stages.
+func Registered() []Info {
+	filesystem, localSectorSize, localCharacteristics := localvfs.Describe()
+	remoteSectorSize, remoteCharacteristics := remotevfs.Describe()
+
+	return []Info{
+		{Name: "os", Description: "Files of the operating system, used for scratch copies.", Characteristics: []string{}},
+		{
+			Name:            "disk",
+			Description:     "Databases of the local stage.",
+			Filesystem:      filesystem,
+			SectorSize:      localSectorSize,
+			Characteristics: describeCharacteristics(localCharacteristics),
+		},
+		{
+			Name:            "r2",
+			Description:     "Databases of the remote stage, read and written by sector from the bucket.",
+			SectorSize:      remoteSectorSize,
+			Characteristics: describeCharacteristics(remoteCharacteristics),
+		},
+	}
+}
+
+func describeCharacteristics(characteristics sqlitevfs.DeviceCharacteristic) []string {
+	names := []string{}
+	for _, known := range characteristicNames {
+		if characteristics&known.characteristic != 0 {
+			names = append(names, known.name)
+		}
+	}
+	return names
+}